@@ -3,6 +3,8 @@
 package main
 
 import (
+	"time"
+
 	"github.com/pingcap/errors"
 	"github.com/pingcap/log"
 	"github.com/pingcap/tidb/ddl"
@@ -37,7 +39,12 @@ func runBackupCommand(command *cobra.Command, cmdName string) error {
 		session.DisableStats4Test()
 	}
 
-	if err := task.RunBackup(ctx, tidbGlue, cmdName, &cfg); err != nil {
+	start := time.Now()
+	finishMetrics := task.StartMetricsPusher(ctx, &cfg.Config, cmdName)
+	err := task.RunBackup(ctx, tidbGlue, cmdName, &cfg)
+	finishMetrics(err)
+	task.RecordHistory(ctx, &cfg.Config, cmdName, start, err)
+	if err != nil {
 		log.Error("failed to backup", zap.Error(err))
 		return errors.Trace(err)
 	}
@@ -57,7 +64,12 @@ func runBackupRawCommand(command *cobra.Command, cmdName string) error {
 		ctx, store = trace.TracerStartSpan(ctx)
 		defer trace.TracerFinishSpan(ctx, store)
 	}
-	if err := task.RunBackupRaw(ctx, gluetikv.Glue{}, cmdName, &cfg); err != nil {
+	start := time.Now()
+	finishMetrics := task.StartMetricsPusher(ctx, &cfg.Config, cmdName)
+	err := task.RunBackupRaw(ctx, gluetikv.Glue{}, cmdName, &cfg)
+	finishMetrics(err)
+	task.RecordHistory(ctx, &cfg.Config, cmdName, start, err)
+	if err != nil {
 		log.Error("failed to backup raw kv", zap.Error(err))
 		return errors.Trace(err)
 	}
@@ -88,7 +88,8 @@ func AddFlags(cmd *cobra.Command) {
 	cmd.PersistentFlags().Bool(FlagRedactInfoLog, false,
 		"Set whether to redact sensitive info in log")
 	cmd.PersistentFlags().String(FlagStatusAddr, "",
-		"Set the HTTP listening address for the status report service. Set to empty string to disable")
+		"Set the HTTP listening address for the status report service, which serves the progress of the task "+
+			"in JSON at /progress and the metrics at /metrics. Set to empty string to disable")
 	task.DefineCommonFlags(cmd.PersistentFlags())
 
 	cmd.PersistentFlags().StringP(FlagSlowLogFile, "", "",
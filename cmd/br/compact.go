@@ -0,0 +1,52 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package main
+
+import (
+	"github.com/pingcap/errors"
+	"github.com/pingcap/log"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+
+	"github.com/pingcap/br/pkg/gluetikv"
+	"github.com/pingcap/br/pkg/task"
+	"github.com/pingcap/br/pkg/utils"
+	"github.com/pingcap/br/pkg/version/build"
+)
+
+// NewCompactCommand returns a subcommand merging a full backup and its
+// incremental backups into a new full backup.
+func NewCompactCommand() *cobra.Command {
+	command := &cobra.Command{
+		Use:   "compact",
+		Short: "merge a full backup and its incremental backups into a new full backup",
+		Long: "merge the full backup in --storage and its incremental backups in --incremental into " +
+			"a new full backup in --target, which is restored without the incremental backups. " +
+			"It doesn't access the cluster, the checksums of the tables are dropped",
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		PersistentPreRunE: func(c *cobra.Command, args []string) error {
+			if err := Init(c); err != nil {
+				return errors.Trace(err)
+			}
+			build.LogInfo(build.BR)
+			utils.LogEnvVariables()
+			task.LogArguments(c)
+			return nil
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var cfg task.CompactConfig
+			if err := cfg.ParseFromFlags(cmd.Flags()); err != nil {
+				cmd.SilenceUsage = false
+				return errors.Trace(err)
+			}
+			if err := task.RunCompact(GetDefaultContext(), gluetikv.Glue{}, "Compact", &cfg); err != nil {
+				log.Error("failed to compact the backups", zap.Error(err))
+				return errors.Trace(err)
+			}
+			return nil
+		},
+	}
+	task.DefineCompactFlags(command.Flags())
+	return command
+}
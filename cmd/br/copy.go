@@ -0,0 +1,89 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package main
+
+import (
+	"github.com/pingcap/errors"
+	"github.com/pingcap/log"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+
+	"github.com/pingcap/br/pkg/gluetikv"
+	"github.com/pingcap/br/pkg/task"
+	"github.com/pingcap/br/pkg/utils"
+	"github.com/pingcap/br/pkg/version/build"
+)
+
+// NewCopyCommand returns a subcommand copying an archive between the storages.
+func NewCopyCommand() *cobra.Command {
+	command := &cobra.Command{
+		Use:   "copy",
+		Short: "copy a backup between the storages, e.g. from S3 to GCS",
+		Long: "stream the backup in --from into the empty storage --to without a local staging disk. " +
+			"The data files are verified against the backupmeta, and the backupmeta and the finish marker " +
+			"are copied at last. It doesn't access the cluster",
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		PersistentPreRunE: func(c *cobra.Command, args []string) error {
+			if err := Init(c); err != nil {
+				return errors.Trace(err)
+			}
+			build.LogInfo(build.BR)
+			utils.LogEnvVariables()
+			task.LogArguments(c)
+			return nil
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var cfg task.CopyConfig
+			if err := cfg.ParseFromFlags(cmd.Flags()); err != nil {
+				cmd.SilenceUsage = false
+				return errors.Trace(err)
+			}
+			if err := task.RunCopy(GetDefaultContext(), gluetikv.Glue{}, "Copy", &cfg); err != nil {
+				log.Error("failed to copy the backup", zap.Error(err))
+				return errors.Trace(err)
+			}
+			return nil
+		},
+	}
+	task.DefineCopyFlags(command.Flags())
+	return command
+}
+
+// NewCopyClusterCommand returns a subcommand copying the tables of a cluster
+// into another cluster.
+func NewCopyClusterCommand() *cobra.Command {
+	command := &cobra.Command{
+		Use:   "copy-cluster",
+		Short: "copy the tables of the cluster of --pd into the cluster of --dest-pd without external storage",
+		Long: "create the tables in the destination cluster, then scan the source cluster at the backup ts " +
+			"and write the data into the destination TiKV directly. All data goes through BR, " +
+			"so it is slower than a backup followed by a restore",
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		PersistentPreRunE: func(c *cobra.Command, args []string) error {
+			if err := Init(c); err != nil {
+				return errors.Trace(err)
+			}
+			build.LogInfo(build.BR)
+			utils.LogEnvVariables()
+			task.LogArguments(c)
+			return nil
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var cfg task.CopyClusterConfig
+			if err := cfg.ParseFromFlags(cmd.Flags()); err != nil {
+				cmd.SilenceUsage = false
+				return errors.Trace(err)
+			}
+			if err := task.RunCopyCluster(GetDefaultContext(), tidbGlue, "Copy cluster", &cfg); err != nil {
+				log.Error("failed to copy the cluster", zap.Error(err))
+				return errors.Trace(err)
+			}
+			return nil
+		},
+	}
+	task.DefineFilterFlags(command, filterOutSysAndMemTables)
+	task.DefineCopyClusterFlags(command.Flags())
+	return command
+}
@@ -20,12 +20,14 @@ import (
 	"github.com/spf13/cobra"
 	"go.uber.org/zap"
 
+	"github.com/pingcap/br/pkg/backup"
 	berrors "github.com/pingcap/br/pkg/errors"
 	"github.com/pingcap/br/pkg/logutil"
 	"github.com/pingcap/br/pkg/metautil"
 	"github.com/pingcap/br/pkg/mock/mockid"
 	"github.com/pingcap/br/pkg/restore"
 	"github.com/pingcap/br/pkg/rtree"
+	"github.com/pingcap/br/pkg/storage"
 	"github.com/pingcap/br/pkg/task"
 	"github.com/pingcap/br/pkg/utils"
 	"github.com/pingcap/br/pkg/version/build"
@@ -54,6 +56,7 @@ func NewDebugCommand() *cobra.Command {
 	meta.AddCommand(decodeBackupMetaCommand())
 	meta.AddCommand(encodeBackupMetaCommand())
 	meta.AddCommand(setPDConfigCommand())
+	meta.AddCommand(repairBackupMetaCommand())
 	meta.Hidden = true
 
 	return meta
@@ -73,10 +76,11 @@ func newCheckSumCommand() *cobra.Command {
 				return errors.Trace(err)
 			}
 
-			_, s, backupMeta, err := task.ReadBackupMeta(ctx, metautil.MetaFile, &cfg)
+			mgr, backupMeta, err := task.NewReadOnlyMgr(ctx, &cfg)
 			if err != nil {
 				return errors.Trace(err)
 			}
+			s := mgr.GetExternalStorage()
 
 			reader := metautil.NewMetaReader(backupMeta, s)
 			dbs, err := utils.LoadBackupTables(ctx, reader)
@@ -115,12 +119,12 @@ func newCheckSumCommand() *cobra.Command {
 						logutil.Key("endKey", file.GetEndKey()),
 					)
 
-					var data []byte
-					data, err = s.ReadFile(ctx, file.Name)
+					data, release, err := storage.ReadFileMapped(ctx, s, file.Name)
 					if err != nil {
 						return errors.Trace(err)
 					}
 					s := sha256.Sum256(data)
+					release()
 					if !bytes.Equal(s[:], file.Sha256) {
 						return errors.Annotatef(berrors.ErrBackupChecksumMismatch, `
 backup data checksum failed: %s may be changed
@@ -172,12 +176,12 @@ func newBackupMetaValidateCommand() *cobra.Command {
 			if err = cfg.ParseFromFlags(cmd.Flags()); err != nil {
 				return errors.Trace(err)
 			}
-			_, s, backupMeta, err := task.ReadBackupMeta(ctx, metautil.MetaFile, &cfg)
+			mgr, backupMeta, err := task.NewReadOnlyMgr(ctx, &cfg)
 			if err != nil {
 				log.Error("read backupmeta failed", zap.Error(err))
 				return errors.Trace(err)
 			}
-			reader := metautil.NewMetaReader(backupMeta, s)
+			reader := metautil.NewMetaReader(backupMeta, mgr.GetExternalStorage())
 			dbs, err := utils.LoadBackupTables(ctx, reader)
 			if err != nil {
 				log.Error("load tables failed", zap.Error(err))
@@ -375,7 +379,6 @@ func setPDConfigCommand() *cobra.Command {
 			if err != nil {
 				return errors.Trace(err)
 			}
-			defer mgr.Close()
 
 			if err := mgr.UpdatePDScheduleConfig(ctx); err != nil {
 				return errors.Annotate(err, "fail to update PD merge config")
@@ -386,3 +389,74 @@ func setPDConfigCommand() *cobra.Command {
 	}
 	return pdConfigCmd
 }
+
+func repairBackupMetaCommand() *cobra.Command {
+	repairCmd := &cobra.Command{
+		Use:   "repair-meta",
+		Short: "reconcile backupmeta with the sst files in the storage",
+		Long: "reconcile the data files in backupmeta with the sst files in the storage, " +
+			"the missing files are removed and the unrecorded files are added with the ranges derived from their content. " +
+			"The finish marker is rewritten, and the backup is signed again if --signing-key is set, " +
+			"otherwise its stale signature is removed",
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx, cancel := context.WithCancel(GetDefaultContext())
+			defer cancel()
+
+			var cfg task.Config
+			if err := cfg.ParseFromFlags(cmd.Flags()); err != nil {
+				return errors.Trace(err)
+			}
+			dryRun, err := cmd.Flags().GetBool("dry-run")
+			if err != nil {
+				return errors.Trace(err)
+			}
+			_, s, backupMeta, err := task.ReadBackupMeta(ctx, metautil.MetaFile, &cfg)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			repaired, report, err := metautil.RepairBackupMeta(ctx, s, backupMeta)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			for _, name := range report.Missing {
+				cmd.Printf("missing: %s\n", name)
+			}
+			for _, name := range report.Recovered {
+				cmd.Printf("recovered: %s\n", name)
+			}
+			for _, name := range report.Unrecoverable {
+				cmd.Printf("unrecoverable: %s\n", name)
+			}
+			if !report.Changed() {
+				cmd.Println("backupmeta is consistent with the storage, nothing to repair")
+				return nil
+			}
+			if dryRun {
+				return nil
+			}
+
+			var signer metautil.Signer
+			if len(cfg.SigningKey) > 0 {
+				if signer, err = backup.NewSigner(ctx, cfg.SigningKey); err != nil {
+					return errors.Trace(err)
+				}
+			}
+			signatureRemoved, err := metautil.WriteRepairedBackupMeta(ctx, s, repaired, signer, cfg.SigningKey)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			if signatureRemoved {
+				cmd.Println("WARNING: the signature of the backup is removed since it doesn't match the repaired " +
+					"backupmeta, the restore with --signing-key will fail until it's signed again by repair-meta " +
+					"with --signing-key")
+			}
+			cmd.Printf("backupmeta repaired, %d files removed, %d files added, "+
+				"please restore it with --checksum=false\n", len(report.Missing), len(report.Recovered))
+			return nil
+		},
+	}
+	repairCmd.Flags().Bool("dry-run", false, "only report the inconsistency without rewriting backupmeta")
+	return repairCmd
+}
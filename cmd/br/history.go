@@ -0,0 +1,77 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package main
+
+import (
+	"encoding/json"
+	"text/tabwriter"
+	"time"
+
+	"github.com/cheynewallace/tabby"
+	"github.com/pingcap/errors"
+	"github.com/spf13/cobra"
+
+	"github.com/pingcap/br/pkg/task"
+	"github.com/pingcap/br/pkg/utils"
+	"github.com/pingcap/br/pkg/version/build"
+)
+
+// NewHistoryCommand returns a subcommand listing the task history in PD.
+func NewHistoryCommand() *cobra.Command {
+	command := &cobra.Command{
+		Use:          "history",
+		Short:        "list the backup and restore tasks recorded with --record-history",
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		PersistentPreRunE: func(c *cobra.Command, args []string) error {
+			if err := Init(c); err != nil {
+				return errors.Trace(err)
+			}
+			build.LogInfo(build.BR)
+			utils.LogEnvVariables()
+			task.LogArguments(c)
+			return nil
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var cfg task.Config
+			if err := cfg.ParseFromFlags(cmd.Flags()); err != nil {
+				return errors.Trace(err)
+			}
+			limit, err := cmd.Flags().GetInt("limit")
+			if err != nil {
+				return errors.Trace(err)
+			}
+			asJSON, err := cmd.Flags().GetBool("json")
+			if err != nil {
+				return errors.Trace(err)
+			}
+			records, err := task.ListHistory(GetDefaultContext(), &cfg, limit)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			if asJSON {
+				data, err := json.MarshalIndent(records, "", "  ")
+				if err != nil {
+					return errors.Trace(err)
+				}
+				cmd.Println(string(data))
+				return nil
+			}
+			tub := tabby.NewCustom(tabwriter.NewWriter(cmd.OutOrStdout(), 0, 0, 2, ' ', 0))
+			tub.AddHeader("START TIME", "DURATION", "COMMAND", "STORAGE", "BACKUP TS", "RESULT")
+			for _, r := range records {
+				result := "success"
+				if !r.Success {
+					result = "failed: " + r.Error
+				}
+				tub.AddLine(r.StartTime.Format(time.RFC3339), r.EndTime.Sub(r.StartTime).Round(time.Second),
+					r.Command, r.Storage, r.BackupTS, result)
+			}
+			tub.Print()
+			return nil
+		},
+	}
+	command.Flags().Int("limit", 20, "the max number of the latest tasks to list, 0 to list all")
+	command.Flags().Bool("json", false, "print the records in JSON, including the checksums of the tables")
+	return command
+}
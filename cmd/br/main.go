@@ -48,6 +48,14 @@ func main() {
 		NewDebugCommand(),
 		NewBackupCommand(),
 		NewRestoreCommand(),
+		NewHistoryCommand(),
+		NewCompactCommand(),
+		NewCopyCommand(),
+		NewCopyClusterCommand(),
+		NewRestorePDConfigCommand(),
+		NewStreamCommand(),
+		NewValidateCommand(),
+		NewOperatorCommand(),
 	)
 	// Ouputs cmd.Print to stdout.
 	rootCmd.SetOut(os.Stdout)
@@ -0,0 +1,61 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package main
+
+import (
+	"github.com/pingcap/errors"
+	"github.com/pingcap/log"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+
+	"github.com/pingcap/br/pkg/gluetikv"
+	"github.com/pingcap/br/pkg/task"
+	"github.com/pingcap/br/pkg/utils"
+	"github.com/pingcap/br/pkg/version/build"
+)
+
+// NewOperatorCommand returns a subcommand operating the regions of the
+// cluster directly.
+func NewOperatorCommand() *cobra.Command {
+	command := &cobra.Command{
+		Use:          "operator",
+		Short:        "operate the regions of the cluster, e.g. to fix up after a restore",
+		SilenceUsage: true,
+		PersistentPreRunE: func(c *cobra.Command, args []string) error {
+			if err := Init(c); err != nil {
+				return errors.Trace(err)
+			}
+			build.LogInfo(build.BR)
+			utils.LogEnvVariables()
+			task.LogArguments(c)
+			return nil
+		},
+	}
+	command.AddCommand(newOperatorScatterCommand())
+	return command
+}
+
+func newOperatorScatterCommand() *cobra.Command {
+	command := &cobra.Command{
+		Use:   "scatter",
+		Short: "scatter the regions of a key range again",
+		Long: "scatter the regions in [--start-key, --end-key) and wait for them to be scattered, " +
+			"with the same retries as restore, e.g. when a restore finished with scattering timed out " +
+			"and the leaders are still clustered in a few stores",
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			var cfg task.OperatorScatterConfig
+			if err := cfg.ParseFromFlags(cmd.Flags()); err != nil {
+				cmd.SilenceUsage = false
+				return errors.Trace(err)
+			}
+			if err := task.RunOperatorScatter(GetDefaultContext(), gluetikv.Glue{}, "Scatter", &cfg); err != nil {
+				log.Error("failed to scatter the regions", zap.Error(err))
+				return errors.Trace(err)
+			}
+			return nil
+		},
+	}
+	task.DefineOperatorScatterFlags(command)
+	return command
+}
@@ -0,0 +1,62 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package main
+
+import (
+	"github.com/pingcap/errors"
+	"github.com/spf13/cobra"
+
+	"github.com/pingcap/br/pkg/task"
+	"github.com/pingcap/br/pkg/utils"
+	"github.com/pingcap/br/pkg/version/build"
+)
+
+// NewRestorePDConfigCommand returns a subcommand reverting the changes of PD
+// left by the crashed BR processes.
+func NewRestorePDConfigCommand() *cobra.Command {
+	command := &cobra.Command{
+		Use:   "restore-pd-config",
+		Short: "revert the changes of PD left by the crashed BR processes",
+		Long: "revert the schedulers, the schedule configs and the placement rules of PD changed by " +
+			"the BR processes which crashed before reverting them, newest first. " +
+			"The changes of the running BR processes are skipped, they are reverted by the processes themselves",
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		PersistentPreRunE: func(c *cobra.Command, args []string) error {
+			if err := Init(c); err != nil {
+				return errors.Trace(err)
+			}
+			build.LogInfo(build.BR)
+			utils.LogEnvVariables()
+			task.LogArguments(c)
+			return nil
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var cfg task.Config
+			if err := cfg.ParseFromFlags(cmd.Flags()); err != nil {
+				return errors.Trace(err)
+			}
+			dryRun, err := cmd.Flags().GetBool("dry-run")
+			if err != nil {
+				return errors.Trace(err)
+			}
+			ops, err := task.RunRestorePDConfig(GetDefaultContext(), &cfg, dryRun)
+			for _, op := range ops {
+				if dryRun {
+					cmd.Printf("would %s (%s, by %s)\n", op, op.ID, op.Command)
+				} else {
+					cmd.Printf("reverted: %s (%s, by %s)\n", op, op.ID, op.Command)
+				}
+			}
+			if err != nil {
+				return errors.Trace(err)
+			}
+			if len(ops) == 0 {
+				cmd.Println("no change of PD to revert")
+			}
+			return nil
+		},
+	}
+	command.Flags().Bool("dry-run", false, "only print the changes to revert")
+	return command
+}
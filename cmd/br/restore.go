@@ -3,6 +3,8 @@
 package main
 
 import (
+	"time"
+
 	"github.com/pingcap/errors"
 	"github.com/pingcap/log"
 	"github.com/pingcap/tidb/session"
@@ -31,7 +33,12 @@ func runRestoreCommand(command *cobra.Command, cmdName string) error {
 		ctx, store = trace.TracerStartSpan(ctx)
 		defer trace.TracerFinishSpan(ctx, store)
 	}
-	if err := task.RunRestore(GetDefaultContext(), tidbGlue, cmdName, &cfg); err != nil {
+	start := time.Now()
+	finishMetrics := task.StartMetricsPusher(GetDefaultContext(), &cfg.Config, cmdName)
+	err := task.RunRestore(GetDefaultContext(), tidbGlue, cmdName, &cfg)
+	finishMetrics(err)
+	task.RecordHistory(GetDefaultContext(), &cfg.Config, cmdName, start, err)
+	if err != nil {
 		log.Error("failed to restore", zap.Error(err))
 		return errors.Trace(err)
 	}
@@ -58,6 +65,33 @@ func runLogRestoreCommand(command *cobra.Command) error {
 	return nil
 }
 
+func runPointRestoreCommand(command *cobra.Command, cmdName string) error {
+	cfg := task.PointRestoreConfig{
+		RestoreConfig: task.RestoreConfig{Config: task.Config{LogProgress: HasLogFile()}},
+	}
+	if err := cfg.ParseFromFlags(command.Flags()); err != nil {
+		command.SilenceUsage = false
+		return errors.Trace(err)
+	}
+
+	ctx := GetDefaultContext()
+	if cfg.EnableOpenTracing {
+		var store *appdash.MemoryStore
+		ctx, store = trace.TracerStartSpan(ctx)
+		defer trace.TracerFinishSpan(ctx, store)
+	}
+	start := time.Now()
+	finishMetrics := task.StartMetricsPusher(GetDefaultContext(), &cfg.Config, cmdName)
+	err := task.RunPointRestore(GetDefaultContext(), tidbGlue, cmdName, &cfg)
+	finishMetrics(err)
+	task.RecordHistory(GetDefaultContext(), &cfg.Config, cmdName, start, err)
+	if err != nil {
+		log.Error("failed to restore to the point", zap.Error(err))
+		return errors.Trace(err)
+	}
+	return nil
+}
+
 func runRestoreRawCommand(command *cobra.Command, cmdName string) error {
 	cfg := task.RestoreRawConfig{
 		RawKvConfig: task.RawKvConfig{Config: task.Config{LogProgress: HasLogFile()}},
@@ -73,7 +107,12 @@ func runRestoreRawCommand(command *cobra.Command, cmdName string) error {
 		ctx, store = trace.TracerStartSpan(ctx)
 		defer trace.TracerFinishSpan(ctx, store)
 	}
-	if err := task.RunRestoreRaw(GetDefaultContext(), gluetikv.Glue{}, cmdName, &cfg); err != nil {
+	start := time.Now()
+	finishMetrics := task.StartMetricsPusher(GetDefaultContext(), &cfg.Config, cmdName)
+	err := task.RunRestoreRaw(GetDefaultContext(), gluetikv.Glue{}, cmdName, &cfg)
+	finishMetrics(err)
+	task.RecordHistory(GetDefaultContext(), &cfg.Config, cmdName, start, err)
+	if err != nil {
 		log.Error("failed to restore raw kv", zap.Error(err))
 		return errors.Trace(err)
 	}
@@ -104,7 +143,9 @@ func NewRestoreCommand() *cobra.Command {
 		newDBRestoreCommand(),
 		newTableRestoreCommand(),
 		newLogRestoreCommand(),
+		newPointRestoreCommand(),
 		newRawRestoreCommand(),
+		newRestoreAbortCommand(),
 	)
 	task.DefineRestoreFlags(command.PersistentFlags())
 
@@ -164,6 +205,22 @@ func newLogRestoreCommand() *cobra.Command {
 	return command
 }
 
+func newPointRestoreCommand() *cobra.Command {
+	command := &cobra.Command{
+		Use:   "point",
+		Short: "(experimental) restore a snapshot backup and replay the log backup up to a TSO",
+		Long: "restore a snapshot backup and replay the log backup of TiCDC or of a log backup task of `br stream` " +
+			"up to a TSO. The DDLs in the log files of `br stream` are not replayed",
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			return runPointRestoreCommand(cmd, "Point restore")
+		},
+	}
+	task.DefineFilterFlags(command, filterOutSysAndMemTables)
+	task.DefinePointRestoreFlags(command)
+	return command
+}
+
 func newRawRestoreCommand() *cobra.Command {
 	command := &cobra.Command{
 		Use:   "raw",
@@ -177,3 +234,37 @@ func newRawRestoreCommand() *cobra.Command {
 	task.DefineRawRestoreFlags(command)
 	return command
 }
+
+func newRestoreAbortCommand() *cobra.Command {
+	command := &cobra.Command{
+		Use:   "abort",
+		Short: "abort a running restore task through the status server of its BR process",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			var tls task.TLSConfig
+			if err := tls.ParseFromFlags(cmd.Flags()); err != nil {
+				return errors.Trace(err)
+			}
+			taskID, err := cmd.Flags().GetString("task-id")
+			if err != nil {
+				return errors.Trace(err)
+			}
+			addr, err := cmd.Flags().GetString("addr")
+			if err != nil {
+				return errors.Trace(err)
+			}
+			if err := task.AbortRestore(GetDefaultContext(), addr, taskID, &tls); err != nil {
+				log.Error("failed to abort restore", zap.Error(err))
+				return errors.Trace(err)
+			}
+			cmd.Printf("restore task %s is aborting\n", taskID)
+			return nil
+		},
+	}
+	command.Flags().String("task-id", "", "the ID of the restore task, which is logged when the task starts")
+	command.Flags().String("addr", "", "the --status-addr of the BR process running the restore task, "+
+		"which accepts the requests from the local host, or the clients with a certificate verified by its TLS")
+	_ = command.MarkFlagRequired("task-id")
+	_ = command.MarkFlagRequired("addr")
+	return command
+}
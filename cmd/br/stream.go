@@ -0,0 +1,192 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package main
+
+import (
+	"encoding/json"
+	"text/tabwriter"
+
+	"github.com/cheynewallace/tabby"
+	"github.com/pingcap/errors"
+	"github.com/pingcap/log"
+	"github.com/spf13/cobra"
+	"github.com/tikv/client-go/v2/oracle"
+	"go.uber.org/zap"
+
+	"github.com/pingcap/br/pkg/storage"
+	"github.com/pingcap/br/pkg/task"
+	"github.com/pingcap/br/pkg/utils"
+	"github.com/pingcap/br/pkg/version/build"
+)
+
+// NewStreamCommand returns a subcommand managing the log backup tasks.
+func NewStreamCommand() *cobra.Command {
+	command := &cobra.Command{
+		Use:          "log",
+		Short:        "(experimental) manage the tasks continuously backing up the changes of the cluster",
+		SilenceUsage: true,
+		PersistentPreRunE: func(c *cobra.Command, args []string) error {
+			if err := Init(c); err != nil {
+				return errors.Trace(err)
+			}
+			build.LogInfo(build.BR)
+			utils.LogEnvVariables()
+			task.LogArguments(c)
+			return nil
+		},
+	}
+	command.AddCommand(
+		newStreamStartCommand(),
+		newStreamStopCommand(),
+		newStreamPauseCommand(),
+		newStreamResumeCommand(),
+		newStreamStatusCommand(),
+	)
+	return command
+}
+
+func parseStreamConfig(command *cobra.Command) (*task.StreamConfig, error) {
+	cfg := &task.StreamConfig{}
+	if err := cfg.ParseFromFlags(command.Flags()); err != nil {
+		command.SilenceUsage = false
+		return nil, errors.Trace(err)
+	}
+	return cfg, nil
+}
+
+func newStreamStartCommand() *cobra.Command {
+	command := &cobra.Command{
+		Use:   "start",
+		Short: "start a task backing up the changes of the cluster into --storage, requires TiKV v6.2.0 or later",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			cfg, err := parseStreamConfig(cmd)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			info, err := task.RunStreamStart(GetDefaultContext(), cfg)
+			if err != nil {
+				log.Error("failed to start the log backup task", zap.Error(err))
+				return errors.Trace(err)
+			}
+			cmd.Printf("log backup task %s started at %d\n", info.Name, info.StartTs)
+			return nil
+		},
+	}
+	task.DefineFilterFlags(command, acceptAllTables)
+	task.DefineStreamStartFlags(command)
+	return command
+}
+
+func newStreamStopCommand() *cobra.Command {
+	command := &cobra.Command{
+		Use:   "stop",
+		Short: "stop a log backup task and record the TS its log files cover up to",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			cfg, err := parseStreamConfig(cmd)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			status, err := task.RunStreamStop(GetDefaultContext(), cfg)
+			if err != nil {
+				log.Error("failed to stop the log backup task", zap.Error(err))
+				return errors.Trace(err)
+			}
+			cmd.Printf("log backup task %s stopped at %d\n", cfg.TaskName, status.GlobalCheckpoint())
+			return nil
+		},
+	}
+	task.DefineStreamTaskNameFlag(command, true)
+	return command
+}
+
+func newStreamPauseCommand() *cobra.Command {
+	command := &cobra.Command{
+		Use:   "pause",
+		Short: "pause a log backup task",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			cfg, err := parseStreamConfig(cmd)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			if err = task.RunStreamPause(GetDefaultContext(), cfg); err != nil {
+				log.Error("failed to pause the log backup task", zap.Error(err))
+				return errors.Trace(err)
+			}
+			return nil
+		},
+	}
+	task.DefineStreamTaskNameFlag(command, true)
+	return command
+}
+
+func newStreamResumeCommand() *cobra.Command {
+	command := &cobra.Command{
+		Use:   "resume",
+		Short: "resume a paused log backup task",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			cfg, err := parseStreamConfig(cmd)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			if err = task.RunStreamResume(GetDefaultContext(), cfg); err != nil {
+				log.Error("failed to resume the log backup task", zap.Error(err))
+				return errors.Trace(err)
+			}
+			return nil
+		},
+	}
+	task.DefineStreamTaskNameFlag(command, true)
+	return command
+}
+
+func newStreamStatusCommand() *cobra.Command {
+	command := &cobra.Command{
+		Use:   "status",
+		Short: "show the status of a log backup task, or of all the tasks if --task-name isn't set",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			cfg, err := parseStreamConfig(cmd)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			asJSON, err := cmd.Flags().GetBool("json")
+			if err != nil {
+				return errors.Trace(err)
+			}
+			statuses, err := task.RunStreamStatus(GetDefaultContext(), cfg)
+			if err != nil {
+				log.Error("failed to get the status of the log backup tasks", zap.Error(err))
+				return errors.Trace(err)
+			}
+			if asJSON {
+				data, err := json.MarshalIndent(statuses, "", "  ")
+				if err != nil {
+					return errors.Trace(err)
+				}
+				cmd.Println(string(data))
+				return nil
+			}
+			tub := tabby.NewCustom(tabwriter.NewWriter(cmd.OutOrStdout(), 0, 0, 2, ' ', 0))
+			tub.AddHeader("NAME", "STATUS", "STORAGE", "START TS", "CHECKPOINT TS", "CHECKPOINT TIME")
+			for _, s := range statuses {
+				state := "running"
+				if s.Paused {
+					state = "paused"
+				}
+				checkpoint := s.GlobalCheckpoint()
+				u := storage.FormatBackendURL(s.Info.Storage)
+				tub.AddLine(s.Info.Name, state, u.String(), s.Info.StartTs, checkpoint,
+					oracle.GetTimeFromTS(checkpoint).Format("2006-01-02 15:04:05"))
+			}
+			tub.Print()
+			return nil
+		},
+	}
+	task.DefineStreamTaskNameFlag(command, false)
+	command.Flags().Bool("json", false, "print the status in JSON, including the checkpoints of the stores")
+	return command
+}
@@ -0,0 +1,59 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package main
+
+import (
+	"github.com/pingcap/errors"
+	"github.com/pingcap/log"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+
+	"github.com/pingcap/br/pkg/gluetikv"
+	"github.com/pingcap/br/pkg/task"
+	"github.com/pingcap/br/pkg/utils"
+	"github.com/pingcap/br/pkg/version/build"
+)
+
+// NewValidateCommand returns a subcommand verifying the backups.
+func NewValidateCommand() *cobra.Command {
+	command := &cobra.Command{
+		Use:          "validate",
+		Short:        "verify the backup in --storage without a cluster",
+		SilenceUsage: true,
+		PersistentPreRunE: func(c *cobra.Command, args []string) error {
+			if err := Init(c); err != nil {
+				return errors.Trace(err)
+			}
+			build.LogInfo(build.BR)
+			utils.LogEnvVariables()
+			task.LogArguments(c)
+			return nil
+		},
+	}
+	command.AddCommand(newValidateChecksumCommand())
+	return command
+}
+
+func newValidateChecksumCommand() *cobra.Command {
+	command := &cobra.Command{
+		Use:   "checksum",
+		Short: "verify every data file against the backupmeta",
+		Long: "read every data file in the backupmeta, and verify its size, sha256, key range, kv count, " +
+			"bytes and crc64 against the backupmeta. It fails with the missing or corrupted files",
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			var cfg task.Config
+			if err := cfg.ParseFromFlags(cmd.Flags()); err != nil {
+				cmd.SilenceUsage = false
+				return errors.Trace(err)
+			}
+			if err := task.RunValidateChecksum(GetDefaultContext(), gluetikv.Glue{}, "Validate checksum", &cfg); err != nil {
+				log.Error("failed to validate the backup", zap.Error(err))
+				return errors.Trace(err)
+			}
+			cmd.Println("the backup data is valid")
+			return nil
+		},
+	}
+	return command
+}
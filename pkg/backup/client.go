@@ -84,9 +84,28 @@ type Client struct {
 	clusterID uint64
 
 	storage storage.ExternalStorage
-	backend *backuppb.StorageBackend
+	// dataStorage is the storage of the SST files written by TiKV, which are
+	// encrypted by TiKV with cipher rather than BR, see EnableEncryption.
+	dataStorage storage.ExternalStorage
+	backend     *backuppb.StorageBackend
+	cipher      *backuppb.CipherInfo
 
 	gcTTL int64
+	// resume indicates whether the backup is resumable, see EnableResume.
+	resume bool
+	// shared indicates whether the storage is shared by a backup group, see
+	// EnableShared.
+	shared bool
+	// rateLimit overrides the rate limit of each range if it isn't nil, see
+	// SetRateLimitFunc.
+	rateLimit         func() uint64
+	rateLimitWatchers rateLimitWatchers
+	// bandwidthProbe measures the throughput of the ranges if it isn't nil,
+	// see SetBandwidthProbe.
+	bandwidthProbe *utils.BandwidthProbe
+	// metaStorageClass is the storage class of the metadata files written by
+	// the client, see SetMetaStorageClass.
+	metaStorageClass string
 }
 
 // NewBackupClient returns a new backup client.
@@ -154,6 +173,19 @@ func (bc *Client) SetGCTTL(ttl int64) {
 	bc.gcTTL = ttl
 }
 
+// SetRateLimitFunc makes each range read its rate limit from the function
+// when it starts, instead of using the rate limit of the request. The running
+// ranges read it again after NotifyRateLimitChanged.
+func (bc *Client) SetRateLimitFunc(f func() uint64) {
+	bc.rateLimit = f
+}
+
+// SetBandwidthProbe makes the client report the files and the duration of
+// each range backed up to the probe.
+func (bc *Client) SetBandwidthProbe(probe *utils.BandwidthProbe) {
+	bc.bandwidthProbe = probe
+}
+
 // GetGCTTL get gcTTL for this backup.
 func (bc *Client) GetGCTTL() int64 {
 	return bc.gcTTL
@@ -164,13 +196,21 @@ func (bc *Client) GetStorage() storage.ExternalStorage {
 	return bc.storage
 }
 
+// SetMetaStorageClass makes the metadata files written by the client use the
+// storage class, while the SST files written by TiKV use the storage class of
+// the backend. It must be called before SetStorage.
+func (bc *Client) SetMetaStorageClass(storageClass string) {
+	bc.metaStorageClass = storageClass
+}
+
 // SetStorage set ExternalStorage for client.
 func (bc *Client) SetStorage(ctx context.Context, backend *backuppb.StorageBackend, opts *storage.ExternalStorageOptions) error {
 	var err error
-	bc.storage, err = storage.New(ctx, backend, opts)
+	bc.storage, err = storage.New(ctx, storage.WithStorageClass(backend, bc.metaStorageClass), opts)
 	if err != nil {
 		return errors.Trace(err)
 	}
+	bc.dataStorage = bc.storage
 	// backupmeta already exists
 	exist, err := bc.storage.FileExists(ctx, metautil.MetaFile)
 	if err != nil {
@@ -185,7 +225,9 @@ func (bc *Client) SetStorage(ctx context.Context, backend *backuppb.StorageBacke
 	if err != nil {
 		return errors.Annotatef(err, "error occurred when checking %s file", metautil.LockFile)
 	}
-	if exist {
+	// a resumable backup continues the backup in the path locked by itself,
+	// and the members of a backup group back up into the same path.
+	if exist && !bc.resume && !bc.shared {
 		return errors.Annotatef(berrors.ErrInvalidArgument, "backup lock file exists in %v, "+
 			"there may be some backup files in the path already, "+
 			"please specify a correct backup directory!", bc.storage.URI()+"/"+metautil.LockFile)
@@ -447,20 +489,44 @@ func (bc *Client) BackupRange(
 	metaWriter *metautil.MetaWriter,
 	progressCallBack func(ProgressUnit),
 ) (err error) {
+	ctx, _ = logutil.ContextWithFileTaskID(ctx)
 	start := time.Now()
 	defer func() {
 		elapsed := time.Since(start)
 		logutil.CL(ctx).Info("backup range finished", zap.Duration("take", elapsed))
+		backupRangeHistogram.Observe(elapsed.Seconds())
 		key := "range start:" + hex.EncodeToString(startKey) + " end:" + hex.EncodeToString(endKey)
 		if err != nil {
 			summary.CollectFailureUnit(key, err)
 		}
 	}()
+	if bc.rateLimit != nil {
+		req.RateLimit = bc.rateLimit()
+	}
 	logutil.CL(ctx).Info("backup started",
 		logutil.Key("startKey", startKey), logutil.Key("endKey", endKey),
 		zap.Uint64("rateLimit", req.RateLimit),
 		zap.Uint32("concurrency", req.Concurrency))
 
+	if bc.resume {
+		files, ok, err := bc.loadRangeMarker(ctx, startKey, endKey, &req)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if ok {
+			logutil.CL(ctx).Info("range has been backed up, skip it", zap.Int("file-count", len(files)))
+			for _, f := range files {
+				summary.CollectSuccessUnit(summary.TotalKV, 1, f.TotalKvs)
+				summary.CollectSuccessUnit(summary.TotalBytes, 1, f.TotalBytes)
+			}
+			if err := metaWriter.Send(files, metautil.AppendDataFile); err != nil {
+				return errors.Trace(err)
+			}
+			progressCallBack(RangeUnit)
+			return nil
+		}
+	}
+
 	var allStores []*metapb.Store
 	allStores, err = conn.GetAllTiKVStores(ctx, bc.mgr.GetPDClient(), conn.SkipTiFlash)
 	if err != nil {
@@ -469,16 +535,44 @@ func (bc *Client) BackupRange(
 
 	req.StartKey = startKey
 	req.EndKey = endKey
-	req.StorageBackend = bc.backend
-
-	push := newPushDown(bc.mgr, len(allStores))
-
-	var results rtree.RangeTree
-	results, err = push.pushBackup(ctx, req, allStores, progressCallBack)
+	req.StorageBackend, err = storage.WithFreshCredentials(bc.backend, bc.storage)
 	if err != nil {
 		return errors.Trace(err)
 	}
-	logutil.CL(ctx).Info("finish backup push down", zap.Int("small-range-count", results.Len()))
+
+	var results rtree.RangeTree
+	resumed := false
+	throughput := newRangeThroughput(bc.bandwidthProbe, start)
+	if bc.resume {
+		results, resumed, err = bc.loadPartialRangeMarker(ctx, startKey, endKey, &req)
+		if err != nil {
+			return errors.Trace(err)
+		}
+	}
+	if resumed {
+		// The rest of the range is backed up by the fine-grained backup.
+		logutil.CL(ctx).Info("resume the partially backed up range", zap.Int("small-range-count", results.Len()))
+	} else {
+		var saver *partialRangeSaver
+		if bc.resume {
+			saver = bc.startPartialRangeSaver(ctx, startKey, endKey, &req)
+		}
+		results, err = bc.pushDownRange(ctx, req, allStores, func() *pushDown {
+			push := newPushDown(bc.mgr, len(allStores))
+			push.onFiles = throughput.observe
+			if saver != nil {
+				push.onProgress = saver.Save
+			}
+			return push
+		}, progressCallBack)
+		if saver != nil {
+			saver.Close()
+		}
+		if err != nil {
+			return errors.Trace(err)
+		}
+		logutil.CL(ctx).Info("finish backup push down", zap.Int("small-range-count", results.Len()))
+	}
 
 	// Find and backup remaining ranges.
 	// TODO: test fine grained backup.
@@ -504,11 +598,18 @@ func (bc *Client) BackupRange(
 	}
 
 	var ascendErr error
+	var rangeFiles []*backuppb.File
+	var storageBytes, kvBytes uint64
 	results.Ascend(func(i btree.Item) bool {
 		r := i.(*rtree.Range)
+		if bc.resume {
+			rangeFiles = append(rangeFiles, r.Files...)
+		}
 		for _, f := range r.Files {
 			summary.CollectSuccessUnit(summary.TotalKV, 1, f.TotalKvs)
 			summary.CollectSuccessUnit(summary.TotalBytes, 1, f.TotalBytes)
+			storageBytes += f.Size_
+			kvBytes += f.TotalBytes
 		}
 		// we need keep the files in order after we support multi_ingest sst.
 		// default_sst and write_sst need to be together.
@@ -524,10 +625,60 @@ func (bc *Client) BackupRange(
 
 	// Check if there are duplicated files.
 	checkDupFiles(&results)
+	backupBytesCounter.WithLabelValues("kv").Add(float64(kvBytes))
+	backupBytesCounter.WithLabelValues("storage").Add(float64(storageBytes))
+	// The files of the fine-grained backup are observed at last.
+	throughput.finish(storageBytes, kvBytes)
 
+	if bc.resume {
+		return errors.Trace(bc.saveRangeMarker(ctx, startKey, endKey, &req, rangeFiles))
+	}
 	return nil
 }
 
+// rangeThroughput reports the files of a range to the bandwidth probe once
+// they're backed up, instead of after the whole range, so the throughput of a
+// long range is measured in the windows it's transferred.
+type rangeThroughput struct {
+	probe        *utils.BandwidthProbe
+	last         time.Time
+	storageBytes uint64
+	kvBytes      uint64
+}
+
+func newRangeThroughput(probe *utils.BandwidthProbe, start time.Time) *rangeThroughput {
+	return &rangeThroughput{probe: probe, last: start}
+}
+
+// observe reports the files backed up since the last observation.
+func (t *rangeThroughput) observe(files []*backuppb.File) {
+	var storageBytes, kvBytes uint64
+	for _, f := range files {
+		storageBytes += f.Size_
+		kvBytes += f.TotalBytes
+	}
+	t.report(storageBytes, kvBytes)
+}
+
+// finish reports the rest of the total bytes of the range not observed yet.
+func (t *rangeThroughput) finish(storageBytes, kvBytes uint64) {
+	if storageBytes < t.storageBytes || kvBytes < t.kvBytes {
+		storageBytes, kvBytes = t.storageBytes, t.kvBytes
+	}
+	t.report(storageBytes-t.storageBytes, kvBytes-t.kvBytes)
+}
+
+func (t *rangeThroughput) report(storageBytes, kvBytes uint64) {
+	if t.probe == nil {
+		return
+	}
+	now := time.Now()
+	t.probe.Observe(storageBytes, kvBytes, now.Sub(t.last))
+	t.last = now
+	t.storageBytes += storageBytes
+	t.kvBytes += kvBytes
+}
+
 func (bc *Client) findRegionLeader(ctx context.Context, key []byte) (*metapb.Peer, error) {
 	// Keys are saved in encoded format in TiKV, so the key must be encoded
 	// in order to find the correct region.
@@ -612,7 +763,7 @@ func (bc *Client) fineGrainedBackup(
 				for rg := range retry {
 					backoffMs, err :=
 						bc.handleFineGrained(ctx, boFork, rg, lastBackupTS, backupTS,
-							compressType, compressLevel, rateLimit, concurrency, respCh)
+							compressType, compressLevel, bc.currentRateLimit(rateLimit), concurrency, respCh)
 					if err != nil {
 						errCh <- err
 						return
@@ -764,6 +915,11 @@ func (bc *Client) handleFineGrained(
 		return 0, errors.Trace(pderr)
 	}
 	storeID := leader.GetStoreId()
+	// The credentials may expire during the retries of a long backup.
+	backend, err := storage.WithFreshCredentials(bc.backend, bc.storage)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
 
 	req := backuppb.BackupRequest{
 		ClusterId:        bc.clusterID,
@@ -771,11 +927,12 @@ func (bc *Client) handleFineGrained(
 		EndKey:           rg.EndKey,
 		StartVersion:     lastBackupTS,
 		EndVersion:       backupTS,
-		StorageBackend:   bc.backend,
+		StorageBackend:   backend,
 		RateLimit:        rateLimit,
 		Concurrency:      concurrency,
 		CompressionType:  compressType,
 		CompressionLevel: compressionLevel,
+		CipherInfo:       bc.cipher,
 	}
 	lockResolver := bc.mgr.GetLockResolver()
 	client, err := bc.mgr.GetBackupClient(ctx, storeID)
@@ -792,6 +949,16 @@ func (bc *Client) handleFineGrained(
 	}
 	hasProgress := false
 	backoffMill := 0
+	start := time.Now()
+	defer func() {
+		logutil.CL(ctx).Info("fine grained backup attempt finished",
+			logutil.Key("startKey", rg.StartKey),
+			logutil.Key("endKey", rg.EndKey),
+			zap.Uint64("store-id", storeID),
+			zap.Duration("take", time.Since(start)),
+			zap.Int("backoff-ms", backoffMill),
+			zap.Error(err))
+	}()
 	err = SendBackup(
 		ctx, storeID, client, req,
 		// Handle responses with the same backoffer.
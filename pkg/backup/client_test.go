@@ -9,6 +9,7 @@ import (
 	"time"
 
 	. "github.com/pingcap/check"
+	"github.com/pingcap/errors"
 	backuppb "github.com/pingcap/kvproto/pkg/backup"
 	"github.com/pingcap/kvproto/pkg/errorpb"
 	"github.com/pingcap/parser/model"
@@ -24,7 +25,9 @@ import (
 
 	"github.com/pingcap/br/pkg/backup"
 	"github.com/pingcap/br/pkg/conn"
+	berrors "github.com/pingcap/br/pkg/errors"
 	"github.com/pingcap/br/pkg/pdutil"
+	"github.com/pingcap/br/pkg/rtree"
 	"github.com/pingcap/br/pkg/storage"
 )
 
@@ -270,3 +273,135 @@ func (r *testBackup) TestSendCreds(c *C) {
 	secret_access_key = backend.GetS3().SecretAccessKey
 	c.Assert(secret_access_key, Equals, "")
 }
+
+func (r *testBackup) TestResumeBackup(c *C) {
+	mockMgr := &conn.Mgr{PdController: &pdutil.PdController{}}
+	mockMgr.SetPDClient(r.mockPDClient)
+	mockMgr.SetHTTP([]string{"test"}, nil)
+	backend, err := storage.ParseBackend(c.MkDir(), nil)
+	c.Assert(err, IsNil)
+
+	client, err := backup.NewBackupClient(r.ctx, mockMgr)
+	c.Assert(err, IsNil)
+	client.EnableResume()
+	c.Assert(client.IsResumable(), IsTrue)
+	c.Assert(client.SetStorage(r.ctx, backend, &storage.ExternalStorageOptions{}), IsNil)
+	c.Assert(client.SetLockFile(r.ctx), IsNil)
+
+	startVersion, endVersion, err := client.LoadResumeTS(r.ctx)
+	c.Assert(err, IsNil)
+	c.Assert(startVersion, Equals, uint64(0))
+	c.Assert(endVersion, Equals, uint64(0))
+	c.Assert(client.SaveResumeTS(r.ctx, 1, 42), IsNil)
+
+	// a non-resumable backup refuses the locked path.
+	client, err = backup.NewBackupClient(r.ctx, mockMgr)
+	c.Assert(err, IsNil)
+	err = client.SetStorage(r.ctx, backend, &storage.ExternalStorageOptions{})
+	c.Assert(err, ErrorMatches, ".*backup lock file exists.*")
+
+	// a resumed backup continues with the recorded snapshot.
+	client, err = backup.NewBackupClient(r.ctx, mockMgr)
+	c.Assert(err, IsNil)
+	client.EnableResume()
+	c.Assert(client.SetStorage(r.ctx, backend, &storage.ExternalStorageOptions{}), IsNil)
+	startVersion, endVersion, err = client.LoadResumeTS(r.ctx)
+	c.Assert(err, IsNil)
+	c.Assert(startVersion, Equals, uint64(1))
+	c.Assert(endVersion, Equals, uint64(42))
+}
+
+type constResolvedTS struct {
+	ts  uint64
+	err error
+}
+
+func (g constResolvedTS) GetMinResolvedTS(context.Context) (uint64, error) {
+	return g.ts, g.err
+}
+
+func (r *testBackup) TestWaitResolvedTS(c *C) {
+	ts, err := backup.WaitResolvedTS(r.ctx, constResolvedTS{ts: 50}, 42, time.Minute)
+	c.Assert(err, IsNil)
+	c.Assert(ts, Equals, uint64(50))
+
+	_, err = backup.WaitResolvedTS(r.ctx, constResolvedTS{ts: 40}, 42, 10*time.Millisecond)
+	c.Assert(berrors.Is(err, berrors.ErrBackupResolvedTSLag), IsTrue)
+
+	_, err = backup.WaitResolvedTS(r.ctx, constResolvedTS{err: berrors.ErrPDInvalidResponse}, 42, time.Minute)
+	c.Assert(berrors.Is(err, berrors.ErrPDInvalidResponse), IsTrue)
+}
+
+func (r *testBackup) TestEncryptionAtRestMeta(c *C) {
+	meta := backup.NewEncryptionAtRestMeta(map[uint64]pdutil.EncryptionAtRest{
+		1: {Method: "aes256-ctr", MasterKeyType: "kms"},
+		2: {Method: "plaintext"},
+		3: {},
+		4: {Err: errors.New("connection refused")},
+	})
+	c.Assert(meta.Methods, DeepEquals, []string{"aes256-ctr", "plaintext"})
+	c.Assert(meta.Encrypted(), IsTrue)
+
+	plain := backup.NewEncryptionAtRestMeta(map[uint64]pdutil.EncryptionAtRest{1: {Method: "plaintext"}})
+	c.Assert(plain.Encrypted(), IsFalse)
+}
+
+func (r *testBackup) TestExtension(c *C) {
+	s, err := storage.NewLocalStorage(c.MkDir())
+	c.Assert(err, IsNil)
+	// The backups without the extension record nothing.
+	ext, err := backup.LoadExtension(r.ctx, s)
+	c.Assert(err, IsNil)
+	c.Assert(ext, DeepEquals, &backup.Extension{})
+
+	saved := &backup.Extension{
+		EncryptionAtRest: &backup.EncryptionAtRestMeta{Methods: []string{"aes256-ctr"}},
+		ResolvedTS:       &backup.ResolvedTS{BackupTS: 42, MaxResolvedTS: 50},
+		Keyspace:         &backup.KeyspaceMeta{ID: 1, StartKey: []byte("a")},
+	}
+	c.Assert(backup.SaveExtension(r.ctx, s, saved), IsNil)
+	ext, err = backup.LoadExtension(r.ctx, s)
+	c.Assert(err, IsNil)
+	c.Assert(ext.Version, Equals, backup.ExtensionVersion)
+	c.Assert(ext, DeepEquals, saved)
+
+	// The extension of a newer BR is refused.
+	c.Assert(s.WriteFile(r.ctx, backup.ExtensionFile, []byte(`{"version":2}`)), IsNil)
+	_, err = backup.LoadExtension(r.ctx, s)
+	c.Assert(err, ErrorMatches, ".*please upgrade BR.*")
+	c.Assert(s.WriteFile(r.ctx, backup.ExtensionFile, []byte(`{`)), IsNil)
+	_, err = backup.LoadExtension(r.ctx, s)
+	c.Assert(berrors.ErrInvalidMetaFile.Equal(err), IsTrue)
+}
+
+func (r *testBackup) TestShardRanges(c *C) {
+	ranges := make([]rtree.Range, 0, 10)
+	for i := 0; i < 10; i++ {
+		ranges = append(ranges, rtree.Range{StartKey: []byte{byte(i)}, EndKey: []byte{byte(i + 1)}})
+	}
+	shards := backup.ShardRanges(ranges, 4)
+	c.Assert(shards, HasLen, 4)
+	lens := make([]int, 0, len(shards))
+	joined := make([]rtree.Range, 0, len(ranges))
+	for _, shard := range shards {
+		lens = append(lens, len(shard))
+		joined = append(joined, shard...)
+	}
+	c.Assert(lens, DeepEquals, []int{3, 3, 2, 2})
+	c.Assert(joined, DeepEquals, ranges)
+	c.Assert(backup.ShardRanges(ranges[:2], 4), HasLen, 2)
+
+	digest := backup.RangesDigest(ranges)
+	c.Assert(backup.RangesDigest(ranges), Equals, digest)
+	c.Assert(backup.RangesDigest(ranges[1:]), Not(Equals), digest)
+
+	s, err := storage.NewLocalStorage(c.MkDir())
+	c.Assert(err, IsNil)
+	files := []*backuppb.File{{Name: "1.sst", TotalKvs: 10}, {Name: "2.sst", TotalKvs: 20}}
+	c.Assert(backup.WriteShardFiles(r.ctx, s, 3, files), IsNil)
+	read, err := backup.ReadShardFiles(r.ctx, s, 3)
+	c.Assert(err, IsNil)
+	c.Assert(read, DeepEquals, files)
+	_, err = backup.ReadShardFiles(r.ctx, s, 4)
+	c.Assert(err, NotNil)
+}
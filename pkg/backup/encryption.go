@@ -0,0 +1,340 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package backup
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/pingcap/errors"
+	backuppb "github.com/pingcap/kvproto/pkg/backup"
+	"github.com/pingcap/kvproto/pkg/encryptionpb"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+	"google.golang.org/api/cloudkms/v1"
+
+	berrors "github.com/pingcap/br/pkg/errors"
+	"github.com/pingcap/br/pkg/storage"
+)
+
+const (
+	// EncryptionFile records how the files written by BR are encrypted. It's
+	// saved beside the backupmeta in plaintext, since it's needed to decrypt
+	// the backupmeta.
+	EncryptionFile = "backupmeta.encryption"
+	// EncryptionMethodAES256 is the only supported encryption method, the
+	// files written by BR are encrypted by AES-256-GCM, and the SST files are
+	// encrypted by TiKV with AES-256-CTR, both with the same data key.
+	EncryptionMethodAES256 = "aes256"
+
+	dataKeyLen = 32
+
+	masterKeyFile   = "file"
+	masterKeyAWSKMS = "aws-kms"
+	masterKeyGCPKMS = "gcp-kms"
+)
+
+// EncryptionMeta is the content of EncryptionFile.
+type EncryptionMeta struct {
+	Method string `json:"method"`
+	// MasterKey is the URI of the master key encrypting the data key, see
+	// NewMasterKey. It doesn't contain the master key itself.
+	MasterKey string `json:"master-key"`
+	// EncryptedDataKey is the data key of the files encrypted by the master
+	// key.
+	EncryptedDataKey []byte `json:"encrypted-data-key"`
+}
+
+// MasterKey encrypts and decrypts the data keys of the backups.
+type MasterKey interface {
+	Encrypt(ctx context.Context, plaintext []byte) ([]byte, error)
+	Decrypt(ctx context.Context, ciphertext []byte) ([]byte, error)
+}
+
+// NewMasterKey creates the master key by the URI, one of
+//   - file:<path>, the file contains the hex of a 32-byte key;
+//   - aws-kms:<key-id>[?region=<region>&endpoint=<endpoint>];
+//   - gcp-kms:projects/<project>/locations/<location>/keyRings/<ring>/cryptoKeys/<key>.
+//
+// The credentials of KMS are loaded from the environment.
+func NewMasterKey(ctx context.Context, uri string) (MasterKey, error) {
+	kind := strings.SplitN(uri, ":", 2)
+	if len(kind) != 2 || len(kind[1]) == 0 {
+		return nil, errors.Annotatef(berrors.ErrInvalidArgument,
+			"invalid master key %s, should be file:<path>, aws-kms:<key-id> or gcp-kms:<key-name>", uri)
+	}
+	switch kind[0] {
+	case masterKeyFile:
+		return newFileMasterKey(kind[1])
+	case masterKeyAWSKMS:
+		return newAWSMasterKey(kind[1])
+	case masterKeyGCPKMS:
+		return newGCPMasterKey(ctx, kind[1])
+	default:
+		return nil, errors.Annotatef(berrors.ErrInvalidArgument, "unknown master key type %s", kind[0])
+	}
+}
+
+// NewEncryptionMeta generates a data key and encrypts it by the master key.
+// It returns the data key along with the EncryptionMeta to save.
+func NewEncryptionMeta(ctx context.Context, masterKeyURI string) (*EncryptionMeta, []byte, error) {
+	masterKey, err := NewMasterKey(ctx, masterKeyURI)
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+	dataKey := make([]byte, dataKeyLen)
+	if _, err = io.ReadFull(rand.Reader, dataKey); err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+	encrypted, err := masterKey.Encrypt(ctx, dataKey)
+	if err != nil {
+		return nil, nil, errors.Annotate(err, "failed to encrypt the data key")
+	}
+	return &EncryptionMeta{
+		Method:           EncryptionMethodAES256,
+		MasterKey:        masterKeyURI,
+		EncryptedDataKey: encrypted,
+	}, dataKey, nil
+}
+
+// DataKey decrypts the data key by the master key. If masterKeyURI is empty,
+// the master key recorded in the meta is used.
+func (m *EncryptionMeta) DataKey(ctx context.Context, masterKeyURI string) ([]byte, error) {
+	if m.Method != EncryptionMethodAES256 {
+		return nil, errors.Annotatef(berrors.ErrInvalidArgument, "unknown encryption method %s", m.Method)
+	}
+	if len(masterKeyURI) == 0 {
+		masterKeyURI = m.MasterKey
+	}
+	masterKey, err := NewMasterKey(ctx, masterKeyURI)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	dataKey, err := masterKey.Decrypt(ctx, m.EncryptedDataKey)
+	if err != nil {
+		return nil, errors.Annotatef(err, "failed to decrypt the data key by %s", masterKeyURI)
+	}
+	if len(dataKey) != dataKeyLen {
+		return nil, errors.Annotatef(berrors.ErrInvalidArgument,
+			"the data key decrypted by %s should be %d bytes, got %d bytes", masterKeyURI, dataKeyLen, len(dataKey))
+	}
+	return dataKey, nil
+}
+
+// SaveEncryptionMeta records how the backup is encrypted in the storage. The
+// storage shouldn't be encrypted.
+func SaveEncryptionMeta(ctx context.Context, s storage.ExternalStorage, meta *EncryptionMeta) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(s.WriteFile(ctx, EncryptionFile, data))
+}
+
+// LoadEncryptionMeta reads how the backup is encrypted. It returns nil if the
+// backup isn't encrypted.
+func LoadEncryptionMeta(ctx context.Context, s storage.ExternalStorage) (*EncryptionMeta, error) {
+	exists, err := s.FileExists(ctx, EncryptionFile)
+	if err != nil || !exists {
+		return nil, errors.Trace(err)
+	}
+	data, err := s.ReadFile(ctx, EncryptionFile)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	meta := &EncryptionMeta{}
+	if err = json.Unmarshal(data, meta); err != nil {
+		return nil, errors.Annotatef(err, "invalid %s", EncryptionFile)
+	}
+	return meta, nil
+}
+
+// EnableEncryption encrypts the files written by BR through the storage of
+// the client by a new data key, which is encrypted by the master key and
+// saved beside the backupmeta. The data key is also sent to TiKV in the
+// backup requests, so the SST files are encrypted by TiKV. It should be
+// called after SetStorage.
+func (bc *Client) EnableEncryption(ctx context.Context, masterKeyURI string) error {
+	// A resumed backup continues with the data key of the files written.
+	meta, err := LoadEncryptionMeta(ctx, bc.storage)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	var dataKey []byte
+	if meta != nil {
+		dataKey, err = meta.DataKey(ctx, masterKeyURI)
+	} else {
+		meta, dataKey, err = NewEncryptionMeta(ctx, masterKeyURI)
+		if err == nil {
+			err = SaveEncryptionMeta(ctx, bc.storage, meta)
+		}
+	}
+	if err != nil {
+		return errors.Trace(err)
+	}
+	encrypted, err := storage.WithEncryption(bc.storage, dataKey, EncryptionFile)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	bc.storage = encrypted
+	bc.cipher = NewCipherInfo(dataKey)
+	log.Info("the files written by BR are encrypted",
+		zap.String("method", meta.Method), zap.String("master-key", masterKeyURI))
+	return nil
+}
+
+// NewCipherInfo returns the cipher of the SST files encrypted by TiKV with the
+// data key.
+func NewCipherInfo(dataKey []byte) *backuppb.CipherInfo {
+	return &backuppb.CipherInfo{
+		CipherType: encryptionpb.EncryptionMethod_AES256_CTR,
+		CipherKey:  dataKey,
+	}
+}
+
+// fileMasterKey encrypts the data keys by AES-256-GCM with the key in a local
+// file, the nonce is prepended to the ciphertext.
+type fileMasterKey struct {
+	aead cipher.AEAD
+}
+
+func newFileMasterKey(path string) (MasterKey, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Annotatef(err, "failed to read the master key file %s", path)
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(content)))
+	if err != nil || len(key) != dataKeyLen {
+		return nil, errors.Annotatef(berrors.ErrInvalidArgument,
+			"the master key file %s should contain the hex of a %d-byte key", path, dataKeyLen)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return &fileMasterKey{aead: aead}, nil
+}
+
+func (k *fileMasterKey) Encrypt(_ context.Context, plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, k.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return k.aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func (k *fileMasterKey) Decrypt(_ context.Context, ciphertext []byte) ([]byte, error) {
+	if len(ciphertext) < k.aead.NonceSize() {
+		return nil, errors.Annotate(berrors.ErrInvalidArgument, "the encrypted data key is truncated")
+	}
+	nonce := ciphertext[:k.aead.NonceSize()]
+	plaintext, err := k.aead.Open(nil, nonce, ciphertext[len(nonce):], nil)
+	if err != nil {
+		return nil, errors.Annotate(berrors.ErrInvalidArgument, "the master key doesn't match the backup")
+	}
+	return plaintext, nil
+}
+
+type awsMasterKey struct {
+	client *kms.KMS
+	keyID  string
+}
+
+func newAWSMasterKey(s string) (MasterKey, error) {
+	keyID, rawQuery := s, ""
+	if i := strings.IndexByte(s, '?'); i >= 0 {
+		keyID, rawQuery = s[:i], s[i+1:]
+	}
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return nil, errors.Annotatef(berrors.ErrInvalidArgument, "invalid options of AWS KMS %s", rawQuery)
+	}
+	cfg := aws.NewConfig()
+	if region := query.Get("region"); len(region) > 0 {
+		cfg = cfg.WithRegion(region)
+	}
+	if endpoint := query.Get("endpoint"); len(endpoint) > 0 {
+		cfg = cfg.WithEndpoint(endpoint)
+	}
+	ses, err := session.NewSessionWithOptions(session.Options{
+		Config:            *cfg,
+		SharedConfigState: session.SharedConfigEnable,
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return &awsMasterKey{client: kms.New(ses), keyID: keyID}, nil
+}
+
+func (k *awsMasterKey) Encrypt(ctx context.Context, plaintext []byte) ([]byte, error) {
+	resp, err := k.client.EncryptWithContext(ctx, &kms.EncryptInput{
+		KeyId:     aws.String(k.keyID),
+		Plaintext: plaintext,
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return resp.CiphertextBlob, nil
+}
+
+func (k *awsMasterKey) Decrypt(ctx context.Context, ciphertext []byte) ([]byte, error) {
+	resp, err := k.client.DecryptWithContext(ctx, &kms.DecryptInput{
+		KeyId:          aws.String(k.keyID),
+		CiphertextBlob: ciphertext,
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return resp.Plaintext, nil
+}
+
+type gcpMasterKey struct {
+	keys *cloudkms.ProjectsLocationsKeyRingsCryptoKeysService
+	name string
+}
+
+func newGCPMasterKey(ctx context.Context, name string) (MasterKey, error) {
+	service, err := cloudkms.NewService(ctx)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return &gcpMasterKey{keys: service.Projects.Locations.KeyRings.CryptoKeys, name: name}, nil
+}
+
+func (k *gcpMasterKey) Encrypt(ctx context.Context, plaintext []byte) ([]byte, error) {
+	resp, err := k.keys.Encrypt(k.name, &cloudkms.EncryptRequest{
+		Plaintext: base64.StdEncoding.EncodeToString(plaintext),
+	}).Context(ctx).Do()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	decoded, err := base64.StdEncoding.DecodeString(resp.Ciphertext)
+	return decoded, errors.Trace(err)
+}
+
+func (k *gcpMasterKey) Decrypt(ctx context.Context, ciphertext []byte) ([]byte, error) {
+	resp, err := k.keys.Decrypt(k.name, &cloudkms.DecryptRequest{
+		Ciphertext: base64.StdEncoding.EncodeToString(ciphertext),
+	}).Context(ctx).Do()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	decoded, err := base64.StdEncoding.DecodeString(resp.Plaintext)
+	return decoded, errors.Trace(err)
+}
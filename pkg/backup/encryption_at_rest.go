@@ -0,0 +1,53 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package backup
+
+import (
+	"sort"
+
+	"github.com/pingcap/br/pkg/pdutil"
+)
+
+// EncryptionAtRestMeta is the encryption at rest of the TiKV stores of the
+// backed up cluster, recorded in the Extension. TiKV decrypts the data by its
+// own keys when backing up, so the SST files are never encrypted by them, but
+// the restore checks the data isn't restored into the stores without
+// encryption at rest.
+type EncryptionAtRestMeta struct {
+	// Methods are the distinct data encryption methods of the stores, in
+	// alphabetical order.
+	Methods []string `json:"methods"`
+}
+
+// NewEncryptionAtRestMeta returns the EncryptionAtRestMeta of the stores. The
+// stores whose config can't be read are omitted.
+func NewEncryptionAtRestMeta(stores map[uint64]pdutil.EncryptionAtRest) EncryptionAtRestMeta {
+	seen := make(map[string]struct{})
+	meta := EncryptionAtRestMeta{Methods: make([]string, 0, 1)}
+	for _, store := range stores {
+		if store.Err != nil {
+			continue
+		}
+		method := store.Method
+		if !store.Enabled() {
+			method = "plaintext"
+		}
+		if _, ok := seen[method]; !ok {
+			seen[method] = struct{}{}
+			meta.Methods = append(meta.Methods, method)
+		}
+	}
+	sort.Strings(meta.Methods)
+	return meta
+}
+
+// Encrypted checks whether any store of the backed up cluster encrypts the
+// data at rest.
+func (m *EncryptionAtRestMeta) Encrypted() bool {
+	for _, method := range m.Methods {
+		if method != "plaintext" {
+			return true
+		}
+	}
+	return false
+}
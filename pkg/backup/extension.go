@@ -0,0 +1,67 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package backup
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/pingcap/errors"
+
+	berrors "github.com/pingcap/br/pkg/errors"
+	"github.com/pingcap/br/pkg/storage"
+)
+
+const (
+	// ExtensionFile records the facts of the backup that the backupmeta of
+	// this kvproto has no fields for. It's written once after the backupmeta
+	// and before the finish marker, so a complete backup always has it.
+	ExtensionFile = "backupmeta.ext"
+	// ExtensionVersion is the version of the Extension written by this BR.
+	// The fields added later are optional, so a BR reads the extensions of
+	// the versions up to its own.
+	ExtensionVersion = 1
+)
+
+// Extension is the content of ExtensionFile. The absent fields aren't
+// recorded by the backup.
+type Extension struct {
+	Version          int                   `json:"version"`
+	EncryptionAtRest *EncryptionAtRestMeta `json:"encryption-at-rest,omitempty"`
+	ResolvedTS       *ResolvedTS           `json:"resolved-ts,omitempty"`
+	Keyspace         *KeyspaceMeta         `json:"keyspace,omitempty"`
+}
+
+// SaveExtension records the extension of the backup in the storage.
+func SaveExtension(ctx context.Context, s storage.ExternalStorage, ext *Extension) error {
+	ext.Version = ExtensionVersion
+	data, err := json.Marshal(ext)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(s.WriteFile(ctx, ExtensionFile, data))
+}
+
+// LoadExtension reads the extension recorded by the backup. It returns an
+// empty Extension if the backup didn't record it, and refuses the extension
+// of a newer version, whose fields may change how the backup is restored.
+func LoadExtension(ctx context.Context, s storage.ExternalStorage) (*Extension, error) {
+	ext := &Extension{}
+	exists, err := s.FileExists(ctx, ExtensionFile)
+	if err != nil || !exists {
+		return ext, errors.Trace(err)
+	}
+	data, err := s.ReadFile(ctx, ExtensionFile)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if err = json.Unmarshal(data, ext); err != nil {
+		return nil, errors.Annotatef(berrors.ErrInvalidMetaFile, "invalid %s: %v", ExtensionFile, err)
+	}
+	if ext.Version > ExtensionVersion {
+		return nil, errors.Annotatef(berrors.ErrInvalidMetaFile,
+			"%s of version %d is newer than version %d of this BR, please upgrade BR",
+			ExtensionFile, ext.Version, ExtensionVersion)
+	}
+	return ext, nil
+}
@@ -0,0 +1,13 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package backup
+
+// KeyspaceMeta is the keyspace of the raw backup of an API V2 cluster,
+// recorded in the Extension.
+type KeyspaceMeta struct {
+	ID uint32 `json:"id"`
+	// StartKey and EndKey are the range of the user keys in the keyspace,
+	// without the prefix of the keyspace.
+	StartKey []byte `json:"start-key,omitempty"`
+	EndKey   []byte `json:"end-key,omitempty"`
+}
@@ -23,9 +23,38 @@ var (
 			Help:      "Backup region latency distributions.",
 			Buckets:   prometheus.ExponentialBuckets(0.05, 2, 16),
 		})
+
+	backupBytesCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "br",
+			Subsystem: "backup",
+			Name:      "bytes_total",
+			Help:      "The KV bytes backed up and the bytes of the SST files written into the storage.",
+		}, []string{"type"})
+
+	backupRangeHistogram = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Namespace: "br",
+			Subsystem: "backup",
+			Name:      "range_seconds",
+			Help:      "The latency of backing up a range.",
+			Buckets:   prometheus.ExponentialBuckets(0.05, 2, 16),
+		})
+
+	backupChecksumHistogram = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Namespace: "br",
+			Subsystem: "backup",
+			Name:      "checksum_seconds",
+			Help:      "The latency of checksumming a table.",
+			Buckets:   prometheus.ExponentialBuckets(0.1, 2, 16),
+		})
 )
 
 func init() { // nolint:gochecknoinits
 	prometheus.MustRegister(backupRegionCounters)
 	prometheus.MustRegister(backupRegionHistogram)
+	prometheus.MustRegister(backupBytesCounter)
+	prometheus.MustRegister(backupRangeHistogram)
+	prometheus.MustRegister(backupChecksumHistogram)
 }
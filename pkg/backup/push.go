@@ -26,6 +26,15 @@ type pushDown struct {
 	mgr    ClientMgr
 	respCh chan responseAndStore
 	errCh  chan error
+	// onProgress is called with the ranges backed up so far after each
+	// successful response if it isn't nil.
+	onProgress func(rtree.RangeTree)
+	// onFiles is called with the files of each successful response if it
+	// isn't nil.
+	onFiles func([]*backuppb.File)
+	// results are the ranges backed up, which the successful responses are
+	// put into. It's a new tree unless it's replaced before pushing.
+	results rtree.RangeTree
 }
 
 type responseAndStore struct {
@@ -44,9 +53,10 @@ func (r responseAndStore) GetStore() *metapb.Store {
 // newPushDown creates a push down backup.
 func newPushDown(mgr ClientMgr, cap int) *pushDown {
 	return &pushDown{
-		mgr:    mgr,
-		respCh: make(chan responseAndStore, cap),
-		errCh:  make(chan error, cap),
+		mgr:     mgr,
+		respCh:  make(chan responseAndStore, cap),
+		errCh:   make(chan error, cap),
+		results: rtree.NewRangeTree(),
 	}
 }
 
@@ -64,7 +74,7 @@ func (push *pushDown) pushBackup(
 	}
 
 	// Push down backup tasks to all tikv instances.
-	res := rtree.NewRangeTree()
+	res := push.results
 	failpoint.Inject("noop-backup", func(_ failpoint.Value) {
 		logutil.CL(ctx).Warn("skipping normal backup, jump to fine-grained backup, meow :3", logutil.Key("start-key", req.StartKey), logutil.Key("end-key", req.EndKey))
 		failpoint.Return(res, nil)
@@ -116,6 +126,15 @@ func (push *pushDown) pushBackup(
 		// TODO: test concurrent receive response and close channel.
 		close(push.respCh)
 	}()
+	// The stores may still be sending responses if it returns early, e.g.
+	// canceled by the change of the rate limit, drain them so the senders
+	// don't block forever.
+	defer func() {
+		go func() {
+			for range push.respCh {
+			}
+		}()
+	}()
 
 	for {
 		select {
@@ -144,6 +163,12 @@ func (push *pushDown) pushBackup(
 				// None error means range has been backuped successfully.
 				res.Put(
 					resp.GetStartKey(), resp.GetEndKey(), resp.GetFiles())
+				if push.onProgress != nil {
+					push.onProgress(res)
+				}
+				if push.onFiles != nil {
+					push.onFiles(resp.GetFiles())
+				}
 
 				// Update progress
 				progressCallBack(RegionUnit)
@@ -0,0 +1,114 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package backup
+
+import (
+	"context"
+	"sync"
+
+	backuppb "github.com/pingcap/kvproto/pkg/backup"
+	"github.com/pingcap/kvproto/pkg/metapb"
+	"go.uber.org/zap"
+
+	"github.com/pingcap/br/pkg/logutil"
+	"github.com/pingcap/br/pkg/rtree"
+)
+
+// rateLimitWatchers are the push downs of the running ranges, which are
+// canceled once the rate limit changes, see NotifyRateLimitChanged.
+type rateLimitWatchers struct {
+	mu       sync.Mutex
+	watchers map[*rateLimitWatcher]struct{}
+}
+
+type rateLimitWatcher struct {
+	cancel  context.CancelFunc
+	changed bool
+}
+
+// watch returns the context canceled once the rate limit changes, and the
+// function to stop watching, which returns whether the rate limit changed.
+func (ws *rateLimitWatchers) watch(ctx context.Context) (context.Context, func() bool) {
+	ctx, cancel := context.WithCancel(ctx)
+	w := &rateLimitWatcher{cancel: cancel}
+	ws.mu.Lock()
+	if ws.watchers == nil {
+		ws.watchers = make(map[*rateLimitWatcher]struct{})
+	}
+	ws.watchers[w] = struct{}{}
+	ws.mu.Unlock()
+	return ctx, func() bool {
+		ws.mu.Lock()
+		delete(ws.watchers, w)
+		changed := w.changed
+		ws.mu.Unlock()
+		cancel()
+		return changed
+	}
+}
+
+func (ws *rateLimitWatchers) notify() {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	for w := range ws.watchers {
+		w.changed = true
+		w.cancel()
+	}
+}
+
+// NotifyRateLimitChanged makes the running ranges use the rate limit returned
+// by the function of SetRateLimitFunc now. TiKV fixes the rate limit of a
+// backup request once it's sent, so the push downs of the running ranges are
+// canceled, and the parts not backed up yet are pushed down again with the
+// new rate limit.
+func (bc *Client) NotifyRateLimitChanged() {
+	bc.rateLimitWatchers.notify()
+}
+
+// currentRateLimit returns the rate limit of the function of SetRateLimitFunc
+// if any, otherwise the rate limit of the request.
+func (bc *Client) currentRateLimit(rateLimit uint64) uint64 {
+	if bc.rateLimit != nil {
+		return bc.rateLimit()
+	}
+	return rateLimit
+}
+
+// pushDownRange pushes the backup of the range down to the stores, and pushes
+// the rest of the range down again whenever the rate limit changes.
+func (bc *Client) pushDownRange(
+	ctx context.Context,
+	req backuppb.BackupRequest,
+	stores []*metapb.Store,
+	newPush func() *pushDown,
+	progressCallBack func(ProgressUnit),
+) (rtree.RangeTree, error) {
+	results := rtree.NewRangeTree()
+	pending := []rtree.Range{{StartKey: req.StartKey, EndKey: req.EndKey}}
+	for len(pending) > 0 {
+		rg := pending[0]
+		pending = pending[1:]
+		req.RateLimit = bc.currentRateLimit(req.RateLimit)
+		req.StartKey, req.EndKey = rg.StartKey, rg.EndKey
+		push := newPush()
+		push.results = results
+		pushCtx, stop := bc.rateLimitWatchers.watch(ctx)
+		_, err := push.pushBackup(pushCtx, req, stores, progressCallBack)
+		changed := stop()
+		if ctx.Err() != nil {
+			return results, ctx.Err()
+		}
+		if !changed {
+			if err != nil {
+				return results, err
+			}
+			continue
+		}
+		rest := results.GetIncompleteRange(rg.StartKey, rg.EndKey)
+		logutil.CL(ctx).Info("rate limit changed, push down the rest of the range again",
+			logutil.Key("start-key", rg.StartKey), logutil.Key("end-key", rg.EndKey),
+			zap.Int("rest-ranges", len(rest)), zap.Error(err))
+		pending = append(pending, rest...)
+	}
+	return results, nil
+}
@@ -0,0 +1,39 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package backup
+
+import (
+	"context"
+	"sync/atomic"
+
+	. "github.com/pingcap/check"
+)
+
+type testRateLimitSuite struct{}
+
+var _ = Suite(&testRateLimitSuite{})
+
+func (s *testRateLimitSuite) TestNotifyRateLimitChanged(c *C) {
+	var rateLimit uint64 = 10
+	bc := &Client{}
+	c.Assert(bc.currentRateLimit(5), Equals, uint64(5))
+	bc.SetRateLimitFunc(func() uint64 { return atomic.LoadUint64(&rateLimit) })
+	c.Assert(bc.currentRateLimit(5), Equals, uint64(10))
+
+	ctx := context.Background()
+	running, stopRunning := bc.rateLimitWatchers.watch(ctx)
+	finished, stopFinished := bc.rateLimitWatchers.watch(ctx)
+	c.Assert(stopFinished(), IsFalse)
+	c.Assert(finished.Err(), NotNil)
+
+	atomic.StoreUint64(&rateLimit, 20)
+	bc.NotifyRateLimitChanged()
+	c.Assert(running.Err(), Equals, context.Canceled)
+	c.Assert(stopRunning(), IsTrue)
+	c.Assert(bc.currentRateLimit(5), Equals, uint64(20))
+
+	// The ranges started after the change aren't affected.
+	later, stopLater := bc.rateLimitWatchers.watch(ctx)
+	c.Assert(later.Err(), IsNil)
+	c.Assert(stopLater(), IsFalse)
+}
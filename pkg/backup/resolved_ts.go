@@ -0,0 +1,79 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package backup
+
+import (
+	"context"
+	"time"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+
+	berrors "github.com/pingcap/br/pkg/errors"
+)
+
+const resolvedTSCheckInterval = time.Second
+
+// ResolvedTS is the resolved ts confirmed by all the stores when the backup
+// finished, recorded in the Extension.
+type ResolvedTS struct {
+	BackupTS uint64 `json:"backup-ts"`
+	// MaxResolvedTS is the min resolved ts of the stores observed after the
+	// backup, which is not less than BackupTS. All transactions committed
+	// before it are visible to the backup or to the following incremental
+	// backups and log backups.
+	MaxResolvedTS uint64 `json:"max-resolved-ts"`
+}
+
+// MinResolvedTSGetter gets the min resolved ts of all the stores.
+type MinResolvedTSGetter interface {
+	GetMinResolvedTS(ctx context.Context) (uint64, error)
+}
+
+// WaitResolvedTS waits until all the stores have resolved past the backup ts,
+// that is, there are no pending transactions whose commit ts may be less than
+// the backup ts. The locks met in the backup ranges have been resolved during
+// the backup. It returns the min resolved ts of the stores.
+func WaitResolvedTS(
+	ctx context.Context, getter MinResolvedTSGetter, backupTS uint64, timeout time.Duration,
+) (uint64, error) {
+	return waitResolvedTS(ctx, getter, backupTS, timeout, resolvedTSCheckInterval)
+}
+
+func waitResolvedTS(
+	ctx context.Context, getter MinResolvedTSGetter, backupTS uint64, timeout, interval time.Duration,
+) (uint64, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var resolvedTS uint64
+	var lastErr error
+	for {
+		ts, err := getter.GetMinResolvedTS(ctx)
+		if err == nil {
+			resolvedTS = ts
+			if resolvedTS >= backupTS {
+				log.Info("stores have resolved past the backup ts",
+					zap.Uint64("backup-ts", backupTS), zap.Uint64("resolved-ts", resolvedTS))
+				return resolvedTS, nil
+			}
+		} else if berrors.Is(err, berrors.ErrPDInvalidResponse) {
+			// The min resolved ts isn't supported or enabled.
+			return 0, errors.Trace(err)
+		} else {
+			lastErr = err
+			log.Warn("failed to get min resolved ts, retrying", zap.Error(err))
+		}
+		select {
+		case <-ctx.Done():
+			if lastErr != nil && resolvedTS == 0 {
+				return 0, errors.Trace(lastErr)
+			}
+			return 0, errors.Annotatef(berrors.ErrBackupResolvedTSLag,
+				"resolved ts %d is still less than backup ts %d after %s", resolvedTS, backupTS, timeout)
+		case <-ticker.C:
+		}
+	}
+}
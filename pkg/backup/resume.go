@@ -0,0 +1,424 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package backup
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/pingcap/errors"
+	backuppb "github.com/pingcap/kvproto/pkg/backup"
+	"go.uber.org/zap"
+
+	"github.com/pingcap/br/pkg/logutil"
+	"github.com/pingcap/br/pkg/rtree"
+	"github.com/pingcap/br/pkg/storage"
+)
+
+const (
+	// ResumeMarkerPrefix is the name prefix of the progress markers of a
+	// resumable backup.
+	ResumeMarkerPrefix = "backup.resume."
+	// resumeMetaFile records the timestamps of the resumable backup, so a
+	// resumed backup would use the same snapshot.
+	resumeMetaFile = ResumeMarkerPrefix + "meta"
+	// checksumMarkerPrefix is the name prefix of the markers of the tables
+	// whose checksums have been calculated.
+	checksumMarkerPrefix = ResumeMarkerPrefix + "checksum."
+	// partialMarkerPrefix is the name prefix of the progress markers of the
+	// ranges being backed up.
+	partialMarkerPrefix = ResumeMarkerPrefix + "partial."
+	// partialMarkerInterval is the min interval of saving the progress of a
+	// range being backed up.
+	partialMarkerInterval = 30 * time.Second
+)
+
+// EnableResume makes the backup resumable: a marker object is written to the
+// storage after each range is backed up, and the ranges whose markers exist
+// are skipped. It must be called before SetStorage.
+func (bc *Client) EnableResume() {
+	bc.resume = true
+}
+
+// IsResumable returns whether the backup is resumable.
+func (bc *Client) IsResumable() bool {
+	return bc.resume
+}
+
+// rangeMarkerName returns the name of the marker object of the range.
+func rangeMarkerName(startKey, endKey []byte) string {
+	hash := sha256.Sum256([]byte(hex.EncodeToString(startKey) + "-" + hex.EncodeToString(endKey)))
+	return ResumeMarkerPrefix + hex.EncodeToString(hash[:])
+}
+
+// LoadResumeTS returns the start and end version recorded by the previous run
+// of the resumable backup. Both are zero if there is no previous run.
+func (bc *Client) LoadResumeTS(ctx context.Context) (startVersion, endVersion uint64, err error) {
+	name := resumeMetaFile
+	exists, err := bc.storage.FileExists(ctx, name)
+	if err != nil || !exists {
+		return 0, 0, errors.Trace(err)
+	}
+	data, err := bc.storage.ReadFile(ctx, name)
+	if err != nil {
+		return 0, 0, errors.Trace(err)
+	}
+	meta := &backuppb.BackupMeta{}
+	if err = proto.Unmarshal(data, meta); err != nil {
+		return 0, 0, errors.Annotatef(err, "invalid resume meta %s", name)
+	}
+	return meta.StartVersion, meta.EndVersion, nil
+}
+
+// SaveResumeTS records the start and end version of the resumable backup.
+func (bc *Client) SaveResumeTS(ctx context.Context, startVersion, endVersion uint64) error {
+	data, err := proto.Marshal(&backuppb.BackupMeta{StartVersion: startVersion, EndVersion: endVersion})
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(bc.storage.WriteFile(ctx, resumeMetaFile, data))
+}
+
+// checkMarkedFile checks the SST file recorded by the marker still exists
+// with the size and the sha256 recorded, a file missing or overwritten since
+// the previous run makes the range backed up again.
+func (bc *Client) checkMarkedFile(ctx context.Context, marker string, f *backuppb.File) (bool, error) {
+	exists, err := bc.dataStorage.FileExists(ctx, f.Name)
+	if err != nil {
+		return false, errors.Trace(err)
+	}
+	if !exists {
+		logutil.CL(ctx).Warn("sst file of the marker is missing, backup the range again",
+			zap.String("marker", marker), zap.String("file", f.Name))
+		return false, nil
+	}
+	if f.Size_ == 0 && len(f.Sha256) == 0 {
+		return true, nil
+	}
+	var size int64
+	var sum []byte
+	if bc.cipher != nil {
+		// The size and sha256 recorded by TiKV are of the plaintext.
+		var data []byte
+		var release func()
+		data, release, err = storage.ReadDataFileMapped(ctx, bc.storage, f.Name, f.CipherIv)
+		if err != nil {
+			return false, errors.Trace(err)
+		}
+		checksum := sha256.Sum256(data)
+		size, sum = int64(len(data)), checksum[:]
+		release()
+	} else {
+		size, sum, err = storage.FileSha256(ctx, bc.dataStorage, f.Name)
+		if err != nil {
+			return false, errors.Trace(err)
+		}
+	}
+	if (f.Size_ > 0 && uint64(size) != f.Size_) || (len(f.Sha256) > 0 && !bytes.Equal(sum, f.Sha256)) {
+		logutil.CL(ctx).Warn("sst file of the marker mismatches, backup the range again",
+			zap.String("marker", marker), zap.String("file", f.Name),
+			zap.Int64("size", size), zap.Uint64("marked-size", f.Size_),
+			zap.String("sha256", hex.EncodeToString(sum)), zap.String("marked-sha256", hex.EncodeToString(f.Sha256)))
+		return false, nil
+	}
+	return true, nil
+}
+
+// loadRangeMarker returns the files of the range backed up by the previous
+// run. It returns false if the range needs to be backed up again, e.g. the
+// marker does not exist, belongs to another snapshot, or some of the SST
+// files are missing or mismatch the recorded size and sha256.
+func (bc *Client) loadRangeMarker(
+	ctx context.Context, startKey, endKey []byte, req *backuppb.BackupRequest,
+) ([]*backuppb.File, bool, error) {
+	name := rangeMarkerName(startKey, endKey)
+	exists, err := bc.storage.FileExists(ctx, name)
+	if err != nil || !exists {
+		return nil, false, errors.Trace(err)
+	}
+	data, err := bc.storage.ReadFile(ctx, name)
+	if err != nil {
+		return nil, false, errors.Trace(err)
+	}
+	marker := &backuppb.BackupMeta{}
+	if err = proto.Unmarshal(data, marker); err != nil {
+		logutil.CL(ctx).Warn("invalid range marker, backup the range again", zap.String("marker", name), zap.Error(err))
+		return nil, false, nil
+	}
+	if marker.StartVersion != req.StartVersion || marker.EndVersion != req.EndVersion {
+		logutil.CL(ctx).Warn("range marker belongs to another snapshot, backup the range again",
+			zap.String("marker", name),
+			zap.Uint64("marker-end-version", marker.EndVersion),
+			zap.Uint64("end-version", req.EndVersion))
+		return nil, false, nil
+	}
+	for _, f := range marker.Files {
+		ok, err := bc.checkMarkedFile(ctx, name, f)
+		if err != nil || !ok {
+			return nil, false, errors.Trace(err)
+		}
+	}
+	return marker.Files, true, nil
+}
+
+// saveRangeMarker records the files of a finished range.
+func (bc *Client) saveRangeMarker(
+	ctx context.Context, startKey, endKey []byte, req *backuppb.BackupRequest, files []*backuppb.File,
+) error {
+	data, err := proto.Marshal(&backuppb.BackupMeta{
+		StartVersion: req.StartVersion,
+		EndVersion:   req.EndVersion,
+		Files:        files,
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+	name := rangeMarkerName(startKey, endKey)
+	if err = bc.storage.WriteFile(ctx, name, data); err != nil {
+		return errors.Annotatef(err, "failed to write range marker %s", name)
+	}
+	return nil
+}
+
+// partialMarkerName returns the name of the progress marker of the range.
+func partialMarkerName(startKey, endKey []byte) string {
+	return partialMarkerPrefix + rangeMarkerName(startKey, endKey)[len(ResumeMarkerPrefix):]
+}
+
+// loadPartialRangeMarker returns the sub-ranges of the range backed up by the
+// previous run before it was interrupted. It returns false if there is no
+// usable progress, the same as loadRangeMarker.
+func (bc *Client) loadPartialRangeMarker(
+	ctx context.Context, startKey, endKey []byte, req *backuppb.BackupRequest,
+) (rtree.RangeTree, bool, error) {
+	name := partialMarkerName(startKey, endKey)
+	res := rtree.NewRangeTree()
+	exists, err := bc.storage.FileExists(ctx, name)
+	if err != nil || !exists {
+		return res, false, errors.Trace(err)
+	}
+	data, err := bc.storage.ReadFile(ctx, name)
+	if err != nil {
+		return res, false, errors.Trace(err)
+	}
+	marker := &backuppb.BackupMeta{}
+	if err = proto.Unmarshal(data, marker); err != nil || marker.FileIndex == nil {
+		logutil.CL(ctx).Warn("invalid progress marker, backup the range again", zap.String("marker", name), zap.Error(err))
+		return res, false, nil
+	}
+	if marker.StartVersion != req.StartVersion || marker.EndVersion != req.EndVersion {
+		logutil.CL(ctx).Warn("progress marker belongs to another snapshot, backup the range again",
+			zap.String("marker", name),
+			zap.Uint64("marker-end-version", marker.EndVersion),
+			zap.Uint64("end-version", req.EndVersion))
+		return res, false, nil
+	}
+	// Each sub-range is a leaf of the file index, with the range and its files.
+	for _, sub := range marker.FileIndex.MetaFiles {
+		if len(sub.RawRanges) != 1 {
+			logutil.CL(ctx).Warn("invalid progress marker, backup the range again", zap.String("marker", name))
+			return rtree.NewRangeTree(), false, nil
+		}
+		for _, f := range sub.DataFiles {
+			ok, err := bc.checkMarkedFile(ctx, name, f)
+			if err != nil {
+				return res, false, errors.Trace(err)
+			}
+			if !ok {
+				return rtree.NewRangeTree(), false, nil
+			}
+		}
+		res.Put(sub.RawRanges[0].StartKey, sub.RawRanges[0].EndKey, sub.DataFiles)
+	}
+	return res, true, nil
+}
+
+// savePartialRangeMarker records the sub-ranges of the range backed up so far.
+func (bc *Client) savePartialRangeMarker(
+	ctx context.Context, startKey, endKey []byte, req *backuppb.BackupRequest, ranges []rtree.Range,
+) error {
+	index := &backuppb.MetaFile{}
+	for _, r := range ranges {
+		index.MetaFiles = append(index.MetaFiles, &backuppb.MetaFile{
+			RawRanges: []*backuppb.RawRange{{StartKey: r.StartKey, EndKey: r.EndKey}},
+			DataFiles: r.Files,
+		})
+	}
+	data, err := proto.Marshal(&backuppb.BackupMeta{
+		StartVersion: req.StartVersion,
+		EndVersion:   req.EndVersion,
+		FileIndex:    index,
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+	name := partialMarkerName(startKey, endKey)
+	if err = bc.storage.WriteFile(ctx, name, data); err != nil {
+		return errors.Annotatef(err, "failed to write progress marker %s", name)
+	}
+	return nil
+}
+
+// partialRangeSaver saves the progress of a range in the background, so the
+// loop receiving the backup responses never waits for the storage.
+type partialRangeSaver struct {
+	bc       *Client
+	startKey []byte
+	endKey   []byte
+	req      *backuppb.BackupRequest
+
+	interval  time.Duration
+	lastSaved time.Time
+	pending   chan []rtree.Range
+	done      chan struct{}
+}
+
+// startPartialRangeSaver starts saving the progress of the range, it must be
+// closed after the push down backup. Failing to save the progress only makes
+// the resumed backup redo more work, so the errors are logged only.
+func (bc *Client) startPartialRangeSaver(
+	ctx context.Context, startKey, endKey []byte, req *backuppb.BackupRequest,
+) *partialRangeSaver {
+	s := &partialRangeSaver{
+		bc:        bc,
+		startKey:  startKey,
+		endKey:    endKey,
+		req:       req,
+		interval:  partialMarkerInterval,
+		lastSaved: time.Now(),
+		pending:   make(chan []rtree.Range, 1),
+		done:      make(chan struct{}),
+	}
+	go func() {
+		defer close(s.done)
+		for ranges := range s.pending {
+			if err := bc.savePartialRangeMarker(ctx, startKey, endKey, req, ranges); err != nil {
+				logutil.CL(ctx).Warn("failed to save the progress of the range", zap.Error(err))
+			}
+		}
+	}()
+	return s
+}
+
+// Save takes a snapshot of the ranges backed up so far at most once per
+// interval, and hands it to the background saver without blocking. The
+// snapshot is skipped if the previous one is still being saved.
+func (s *partialRangeSaver) Save(res rtree.RangeTree) {
+	if time.Since(s.lastSaved) < s.interval {
+		return
+	}
+	select {
+	case s.pending <- res.GetSortedRanges():
+		s.lastSaved = time.Now()
+	default:
+	}
+}
+
+// Close waits for the pending progress to be saved.
+func (s *partialRangeSaver) Close() {
+	close(s.pending)
+	<-s.done
+}
+
+// CleanResumeMarkers deletes the markers of the resumable backup, which are
+// useless once the backupmeta is written. The markers are kept if the
+// storage can't delete files.
+func (bc *Client) CleanResumeMarkers(ctx context.Context) error {
+	var names []string
+	err := bc.storage.WalkDir(ctx, &storage.WalkOption{}, func(path string, _ int64) error {
+		// The listed names may start with a slash if the prefix of the
+		// storage doesn't end with one.
+		name := strings.TrimPrefix(path, "/")
+		if strings.HasPrefix(name, ResumeMarkerPrefix) {
+			names = append(names, name)
+		}
+		return nil
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+	for _, name := range names {
+		ok, err := storage.DeleteFile(ctx, bc.storage, name)
+		if err != nil {
+			return errors.Annotatef(err, "failed to delete resume marker %s", name)
+		}
+		if !ok {
+			logutil.CL(ctx).Warn("the storage can't delete files, the resume markers are kept",
+				zap.Int("count", len(names)))
+			return nil
+		}
+	}
+	logutil.CL(ctx).Info("resume markers deleted", zap.Int("count", len(names)))
+	return nil
+}
+
+// EnableChecksumResume makes the checksums resumable: a marker object is
+// written to the storage after the checksum of each table is calculated, and
+// the tables whose markers exist reuse the recorded checksums.
+func (ss *Schemas) EnableChecksumResume(s storage.ExternalStorage) {
+	ss.resumeStorage = s
+}
+
+// checksumMarkerName returns the name of the checksum marker of the table.
+func checksumMarkerName(table string) string {
+	hash := sha256.Sum256([]byte(table))
+	return checksumMarkerPrefix + hex.EncodeToString(hash[:])
+}
+
+// loadChecksumMarker returns the checksum of the table calculated by the
+// previous run at the same backup ts, if any.
+func loadChecksumMarker(
+	ctx context.Context, s storage.ExternalStorage, table string, backupTS uint64,
+) (*backuppb.Schema, bool, error) {
+	name := checksumMarkerName(table)
+	exists, err := s.FileExists(ctx, name)
+	if err != nil || !exists {
+		return nil, false, errors.Trace(err)
+	}
+	data, err := s.ReadFile(ctx, name)
+	if err != nil {
+		return nil, false, errors.Trace(err)
+	}
+	marker := &backuppb.BackupMeta{}
+	if err = proto.Unmarshal(data, marker); err != nil || len(marker.Schemas) != 1 {
+		logutil.CL(ctx).Warn("invalid checksum marker, calculate the checksum again",
+			zap.String("marker", name), zap.Error(err))
+		return nil, false, nil
+	}
+	if marker.EndVersion != backupTS || string(marker.Schemas[0].Table) != table {
+		logutil.CL(ctx).Warn("checksum marker belongs to another snapshot or table, calculate the checksum again",
+			zap.String("marker", name),
+			zap.Uint64("marker-end-version", marker.EndVersion),
+			zap.Uint64("end-version", backupTS))
+		return nil, false, nil
+	}
+	return marker.Schemas[0], true, nil
+}
+
+// saveChecksumMarker records the checksum of the table.
+func saveChecksumMarker(
+	ctx context.Context, s storage.ExternalStorage, table string, backupTS uint64, checksum *backuppb.Schema,
+) error {
+	data, err := proto.Marshal(&backuppb.BackupMeta{
+		EndVersion: backupTS,
+		Schemas: []*backuppb.Schema{{
+			Table:      []byte(table),
+			Crc64Xor:   checksum.Crc64Xor,
+			TotalKvs:   checksum.TotalKvs,
+			TotalBytes: checksum.TotalBytes,
+		}},
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+	name := checksumMarkerName(table)
+	if err = s.WriteFile(ctx, name, data); err != nil {
+		return errors.Annotatef(err, "failed to write checksum marker %s", name)
+	}
+	return nil
+}
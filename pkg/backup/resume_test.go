@@ -0,0 +1,174 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package backup
+
+import (
+	"context"
+	"crypto/sha256"
+
+	. "github.com/pingcap/check"
+	backuppb "github.com/pingcap/kvproto/pkg/backup"
+
+	"github.com/pingcap/br/pkg/rtree"
+	"github.com/pingcap/br/pkg/storage"
+)
+
+type testResumeSuite struct{}
+
+var _ = Suite(&testResumeSuite{})
+
+func newResumeClient(c *C) *Client {
+	s, err := storage.NewLocalStorage(c.MkDir())
+	c.Assert(err, IsNil)
+	return &Client{storage: s, dataStorage: s, resume: true}
+}
+
+// writeSST writes the content as an SST file and returns the file recorded
+// in the markers.
+func writeSST(c *C, bc *Client, name, content string) *backuppb.File {
+	c.Assert(bc.dataStorage.WriteFile(context.Background(), name, []byte(content)), IsNil)
+	sum := sha256.Sum256([]byte(content))
+	return &backuppb.File{Name: name, Size_: uint64(len(content)), Sha256: sum[:]}
+}
+
+func (s *testResumeSuite) TestLoadRangeMarker(c *C) {
+	ctx := context.Background()
+	bc := newResumeClient(c)
+	req := &backuppb.BackupRequest{StartVersion: 1, EndVersion: 42}
+	start, end := []byte("a"), []byte("b")
+
+	_, ok, err := bc.loadRangeMarker(ctx, start, end, req)
+	c.Assert(err, IsNil)
+	c.Assert(ok, IsFalse)
+
+	files := []*backuppb.File{writeSST(c, bc, "1.sst", "content-1"), writeSST(c, bc, "2.sst", "content-2")}
+	c.Assert(bc.saveRangeMarker(ctx, start, end, req, files), IsNil)
+	loaded, ok, err := bc.loadRangeMarker(ctx, start, end, req)
+	c.Assert(err, IsNil)
+	c.Assert(ok, IsTrue)
+	c.Assert(loaded, HasLen, 2)
+
+	// The marker of another snapshot isn't used.
+	_, ok, err = bc.loadRangeMarker(ctx, start, end, &backuppb.BackupRequest{StartVersion: 1, EndVersion: 43})
+	c.Assert(err, IsNil)
+	c.Assert(ok, IsFalse)
+
+	// The file overwritten with the same size mismatches the sha256.
+	c.Assert(bc.dataStorage.WriteFile(ctx, "2.sst", []byte("content-X")), IsNil)
+	_, ok, err = bc.loadRangeMarker(ctx, start, end, req)
+	c.Assert(err, IsNil)
+	c.Assert(ok, IsFalse)
+
+	// The truncated file mismatches the size.
+	c.Assert(bc.dataStorage.WriteFile(ctx, "2.sst", []byte("content")), IsNil)
+	_, ok, err = bc.loadRangeMarker(ctx, start, end, req)
+	c.Assert(err, IsNil)
+	c.Assert(ok, IsFalse)
+
+	// The missing file.
+	_, err = storage.DeleteFile(ctx, bc.dataStorage, "2.sst")
+	c.Assert(err, IsNil)
+	_, ok, err = bc.loadRangeMarker(ctx, start, end, req)
+	c.Assert(err, IsNil)
+	c.Assert(ok, IsFalse)
+}
+
+func (s *testResumeSuite) TestCleanResumeMarkers(c *C) {
+	ctx := context.Background()
+	bc := newResumeClient(c)
+	req := &backuppb.BackupRequest{StartVersion: 1, EndVersion: 42}
+
+	file := writeSST(c, bc, "1.sst", "content-1")
+	c.Assert(bc.SaveResumeTS(ctx, 1, 42), IsNil)
+	c.Assert(bc.saveRangeMarker(ctx, []byte("a"), []byte("b"), req, []*backuppb.File{file}), IsNil)
+	c.Assert(bc.storage.WriteFile(ctx, "backupmeta", []byte("meta")), IsNil)
+
+	c.Assert(bc.CleanResumeMarkers(ctx), IsNil)
+	exists, err := bc.storage.FileExists(ctx, resumeMetaFile)
+	c.Assert(err, IsNil)
+	c.Assert(exists, IsFalse)
+	exists, err = bc.storage.FileExists(ctx, rangeMarkerName([]byte("a"), []byte("b")))
+	c.Assert(err, IsNil)
+	c.Assert(exists, IsFalse)
+	// The data files and the backupmeta are kept.
+	for _, name := range []string{"1.sst", "backupmeta"} {
+		exists, err = bc.storage.FileExists(ctx, name)
+		c.Assert(err, IsNil)
+		c.Assert(exists, IsTrue)
+	}
+}
+
+func (s *testResumeSuite) TestPartialRangeMarker(c *C) {
+	ctx := context.Background()
+	bc := newResumeClient(c)
+	req := &backuppb.BackupRequest{StartVersion: 1, EndVersion: 42}
+	start, end := []byte("a"), []byte("z")
+
+	res, ok, err := bc.loadPartialRangeMarker(ctx, start, end, req)
+	c.Assert(err, IsNil)
+	c.Assert(ok, IsFalse)
+	c.Assert(res.Len(), Equals, 0)
+
+	saved := []rtree.Range{
+		{StartKey: []byte("a"), EndKey: []byte("c"), Files: []*backuppb.File{writeSST(c, bc, "1.sst", "content-1")}},
+		{StartKey: []byte("m"), EndKey: []byte("p"), Files: []*backuppb.File{writeSST(c, bc, "2.sst", "content-2")}},
+	}
+	c.Assert(bc.savePartialRangeMarker(ctx, start, end, req, saved), IsNil)
+
+	// The resumed backup continues with the saved sub-ranges, the rest of the
+	// range is left to the fine-grained backup.
+	res, ok, err = bc.loadPartialRangeMarker(ctx, start, end, req)
+	c.Assert(err, IsNil)
+	c.Assert(ok, IsTrue)
+	loaded := res.GetSortedRanges()
+	c.Assert(loaded, HasLen, 2)
+	for i := range saved {
+		c.Assert(loaded[i].StartKey, DeepEquals, saved[i].StartKey)
+		c.Assert(loaded[i].EndKey, DeepEquals, saved[i].EndKey)
+		c.Assert(loaded[i].Files[0].Name, Equals, saved[i].Files[0].Name)
+	}
+	incomplete := res.GetIncompleteRange(start, end)
+	c.Assert(incomplete, HasLen, 2)
+	c.Assert(incomplete[0].StartKey, DeepEquals, []byte("c"))
+	c.Assert(incomplete[0].EndKey, DeepEquals, []byte("m"))
+
+	// The marker of another snapshot isn't used.
+	_, ok, err = bc.loadPartialRangeMarker(ctx, start, end, &backuppb.BackupRequest{StartVersion: 1, EndVersion: 43})
+	c.Assert(err, IsNil)
+	c.Assert(ok, IsFalse)
+
+	// A mismatched file discards the whole progress.
+	c.Assert(bc.dataStorage.WriteFile(ctx, "2.sst", []byte("content-X")), IsNil)
+	res, ok, err = bc.loadPartialRangeMarker(ctx, start, end, req)
+	c.Assert(err, IsNil)
+	c.Assert(ok, IsFalse)
+	c.Assert(res.Len(), Equals, 0)
+}
+
+func (s *testResumeSuite) TestPartialRangeSaver(c *C) {
+	ctx := context.Background()
+	bc := newResumeClient(c)
+	req := &backuppb.BackupRequest{StartVersion: 1, EndVersion: 42}
+	start, end := []byte("a"), []byte("z")
+	res := rtree.NewRangeTree()
+	res.Put([]byte("a"), []byte("c"), []*backuppb.File{writeSST(c, bc, "1.sst", "content-1")})
+
+	// Nothing is saved within the interval.
+	saver := bc.startPartialRangeSaver(ctx, start, end, req)
+	saver.Save(res)
+	saver.Close()
+	_, ok, err := bc.loadPartialRangeMarker(ctx, start, end, req)
+	c.Assert(err, IsNil)
+	c.Assert(ok, IsFalse)
+
+	saver = bc.startPartialRangeSaver(ctx, start, end, req)
+	saver.interval = 0
+	saver.Save(res)
+	// The snapshot is taken when saving, the later changes are not saved.
+	res.Put([]byte("m"), []byte("p"), nil)
+	saver.Close()
+	loaded, ok, err := bc.loadPartialRangeMarker(ctx, start, end, req)
+	c.Assert(err, IsNil)
+	c.Assert(ok, IsTrue)
+	c.Assert(loaded.Len(), Equals, 1)
+}
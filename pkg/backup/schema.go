@@ -6,6 +6,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"sort"
 	"time"
 
 	"github.com/opentracing/opentracing-go"
@@ -23,6 +24,7 @@ import (
 	"github.com/pingcap/br/pkg/glue"
 	"github.com/pingcap/br/pkg/logutil"
 	"github.com/pingcap/br/pkg/metautil"
+	"github.com/pingcap/br/pkg/storage"
 	"github.com/pingcap/br/pkg/summary"
 	"github.com/pingcap/br/pkg/utils"
 )
@@ -46,6 +48,9 @@ type scheamInfo struct {
 type Schemas struct {
 	// name -> schema
 	schemas map[string]*scheamInfo
+	// resumeStorage persists the checksums if not nil, see
+	// EnableChecksumResume.
+	resumeStorage storage.ExternalStorage
 }
 
 func newBackupSchemas() *Schemas {
@@ -88,8 +93,8 @@ func (ss *Schemas) BackupSchemas(
 	startAll := time.Now()
 	op := metautil.AppendSchema
 	metaWriter.StartWriteMetasAsync(ctx, op)
-	for _, s := range ss.schemas {
-		schema := s
+	for n, s := range ss.schemas {
+		name, schema := n, s
 		workerPool.ApplyOnErrorGroup(errg, func() error {
 			if utils.IsSysDB(schema.dbInfo.Name.L) {
 				schema.dbInfo.Name = utils.TemporaryDBName(schema.dbInfo.Name.O)
@@ -100,21 +105,9 @@ func (ss *Schemas) BackupSchemas(
 			)
 
 			if !skipChecksum {
-				logger.Info("table checksum start")
-				start := time.Now()
-				checksumResp, err := calculateChecksum(
-					ectx, schema.tableInfo, store.GetClient(), backupTS, copConcurrency)
-				if err != nil {
+				if err := ss.checksumTable(ectx, name, schema, store, backupTS, copConcurrency, logger); err != nil {
 					return errors.Trace(err)
 				}
-				schema.crc64xor = checksumResp.Checksum
-				schema.totalKvs = checksumResp.TotalKvs
-				schema.totalBytes = checksumResp.TotalBytes
-				logger.Info("table checksum finished",
-					zap.Uint64("Crc64Xor", checksumResp.Checksum),
-					zap.Uint64("TotalKvs", checksumResp.TotalKvs),
-					zap.Uint64("TotalBytes", checksumResp.TotalBytes),
-					zap.Duration("take", time.Since(start)))
 			}
 			if statsHandle != nil {
 				jsonTable, err := statsHandle.DumpStatsToJSON(
@@ -148,6 +141,9 @@ func (ss *Schemas) BackupSchemas(
 				TotalBytes: schema.totalBytes,
 				Stats:      statsBytes,
 			}
+			if replica := schema.tableInfo.TiFlashReplica; replica != nil {
+				s.TiflashReplicas = uint32(replica.Count)
+			}
 
 			if err := metaWriter.Send(s, op); err != nil {
 				return errors.Trace(err)
@@ -164,11 +160,88 @@ func (ss *Schemas) BackupSchemas(
 	return metaWriter.FinishWriteMetas(ctx, op)
 }
 
+// checksumTable calculates the checksum of the table, or reuses the checksum
+// recorded by the previous run if the checksums are resumable.
+func (ss *Schemas) checksumTable(
+	ctx context.Context,
+	name string,
+	schema *scheamInfo,
+	store kv.Storage,
+	backupTS uint64,
+	copConcurrency uint,
+	logger *zap.Logger,
+) error {
+	if ss.resumeStorage != nil {
+		marker, ok, err := loadChecksumMarker(ctx, ss.resumeStorage, name, backupTS)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if ok {
+			schema.crc64xor = marker.Crc64Xor
+			schema.totalKvs = marker.TotalKvs
+			schema.totalBytes = marker.TotalBytes
+			logger.Info("table checksum has been calculated, skip it",
+				zap.Uint64("Crc64Xor", marker.Crc64Xor),
+				zap.Uint64("TotalKvs", marker.TotalKvs),
+				zap.Uint64("TotalBytes", marker.TotalBytes))
+			return nil
+		}
+	}
+
+	logger.Info("table checksum start")
+	start := time.Now()
+	checksumResp, err := calculateChecksum(
+		ctx, schema.tableInfo, store.GetClient(), backupTS, copConcurrency)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	schema.crc64xor = checksumResp.Checksum
+	schema.totalKvs = checksumResp.TotalKvs
+	schema.totalBytes = checksumResp.TotalBytes
+	logger.Info("table checksum finished",
+		zap.Uint64("Crc64Xor", checksumResp.Checksum),
+		zap.Uint64("TotalKvs", checksumResp.TotalKvs),
+		zap.Uint64("TotalBytes", checksumResp.TotalBytes),
+		zap.Duration("take", time.Since(start)))
+	backupChecksumHistogram.Observe(time.Since(start).Seconds())
+
+	if ss.resumeStorage != nil {
+		err = saveChecksumMarker(ctx, ss.resumeStorage, name, backupTS, &backuppb.Schema{
+			Crc64Xor:   schema.crc64xor,
+			TotalKvs:   schema.totalKvs,
+			TotalBytes: schema.totalBytes,
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
+
 // Len returns the number of schemas.
 func (ss *Schemas) Len() int {
 	return len(ss.schemas)
 }
 
+// Tables returns the tables of the schemas without the checksums and the
+// stats, in the order of the names.
+func (ss *Schemas) Tables() []*metautil.Table {
+	names := make([]string, 0, len(ss.schemas))
+	for name := range ss.schemas {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	tables := make([]*metautil.Table, 0, len(names))
+	for _, name := range names {
+		schema := ss.schemas[name]
+		tables = append(tables, &metautil.Table{
+			DB:   schema.dbInfo,
+			Info: schema.tableInfo,
+		})
+	}
+	return tables
+}
+
 func calculateChecksum(
 	ctx context.Context,
 	table *model.TableInfo,
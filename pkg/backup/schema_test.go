@@ -5,6 +5,7 @@ package backup_test
 import (
 	"context"
 	"math"
+	"strings"
 	"sync/atomic"
 
 	"github.com/golang/protobuf/proto"
@@ -172,6 +173,52 @@ func (s *testBackupSchemaSuite) TestBuildBackupRangeAndSchema(c *C) {
 	c.Assert(schemas[1].TotalBytes, Not(Equals), 0, Commentf("%v", schemas[1]))
 }
 
+func (s *testBackupSchemaSuite) TestResumeChecksum(c *C) {
+	tk := testkit.NewTestKit(c, s.mock.Storage)
+	tk.MustExec("use test")
+	tk.MustExec("drop table if exists t1;")
+	tk.MustExec("create table t1 (a int);")
+	tk.MustExec("insert into t1 values (10);")
+
+	testFilter, err := filter.Parse([]string{"test.t1"})
+	c.Assert(err, IsNil)
+	ctx := context.Background()
+	es := s.GetRandomStorage(c)
+	backupSchemas := func() []*metautil.Table {
+		_, schemas, err := backup.BuildBackupRangeAndSchema(s.mock.Storage, testFilter, math.MaxUint64)
+		c.Assert(err, IsNil)
+		schemas.EnableChecksumResume(es)
+		metaWriter := metautil.NewMetaWriter(es, metautil.MetaFileSize, false)
+		err = schemas.BackupSchemas(
+			ctx, metaWriter, s.mock.Storage, nil, math.MaxUint64, 1, variable.DefChecksumTableConcurrency, false, new(simpleProgress))
+		c.Assert(err, IsNil)
+		return s.GetSchemasFromMeta(c, es)
+	}
+
+	// The checksum is recorded.
+	c.Assert(backupSchemas(), HasLen, 1)
+	var markers []string
+	err = es.WalkDir(ctx, &storage.WalkOption{}, func(name string, _ int64) error {
+		if strings.HasPrefix(name, backup.ResumeMarkerPrefix+"checksum.") {
+			markers = append(markers, name)
+		}
+		return nil
+	})
+	c.Assert(err, IsNil)
+	c.Assert(markers, HasLen, 1)
+
+	// The recorded checksum is reused.
+	data, err := proto.Marshal(&backuppb.BackupMeta{
+		EndVersion: math.MaxUint64,
+		Schemas:    []*backuppb.Schema{{Table: []byte("`test`.`t1`"), Crc64Xor: 42, TotalKvs: 1, TotalBytes: 1}},
+	})
+	c.Assert(err, IsNil)
+	c.Assert(es.WriteFile(ctx, markers[0], data), IsNil)
+	schemas := backupSchemas()
+	c.Assert(schemas, HasLen, 1)
+	c.Assert(schemas[0].Crc64Xor, Equals, uint64(42))
+}
+
 func (s *testBackupSchemaSuite) TestBuildBackupRangeAndSchemaWithBrokenStats(c *C) {
 	tk := testkit.NewTestKit(c, s.mock.Storage)
 	tk.MustExec("use test")
@@ -0,0 +1,90 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package backup
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/pingcap/errors"
+	backuppb "github.com/pingcap/kvproto/pkg/backup"
+
+	"github.com/pingcap/br/pkg/rtree"
+	"github.com/pingcap/br/pkg/storage"
+)
+
+// shardMetaPrefix is the name prefix of the files listing the data files of
+// the shards backed up by the members of a backup group.
+const shardMetaPrefix = "backupmeta.shard."
+
+// EnableShared makes the client back up into the path locked by the other
+// members of its backup group. It must be called before SetStorage.
+func (bc *Client) EnableShared() {
+	bc.shared = true
+}
+
+// ShardRanges splits the ranges into at most n shards of contiguous ranges,
+// the numbers of the ranges in the shards differ by at most one.
+func ShardRanges(ranges []rtree.Range, n int) [][]rtree.Range {
+	if n > len(ranges) {
+		n = len(ranges)
+	}
+	shards := make([][]rtree.Range, 0, n)
+	start := 0
+	for i := 0; i < n; i++ {
+		end := start + len(ranges)/n
+		if i < len(ranges)%n {
+			end++
+		}
+		shards = append(shards, ranges[start:end])
+		start = end
+	}
+	return shards
+}
+
+// RangesDigest returns the digest of the ranges, the members of a backup
+// group check they back up the same ranges by it.
+func RangesDigest(ranges []rtree.Range) string {
+	h := sha256.New()
+	var length [8]byte
+	for _, r := range ranges {
+		for _, key := range [][]byte{r.StartKey, r.EndKey} {
+			binary.BigEndian.PutUint64(length[:], uint64(len(key)))
+			h.Write(length[:])
+			h.Write(key)
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func shardMetaFile(shard int) string {
+	return fmt.Sprintf("%s%06d", shardMetaPrefix, shard)
+}
+
+// WriteShardFiles records the data files of the shard backed up by a member
+// of the backup group.
+func WriteShardFiles(ctx context.Context, s storage.ExternalStorage, shard int, files []*backuppb.File) error {
+	data, err := proto.Marshal(&backuppb.BackupMeta{Files: files})
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(s.WriteFile(ctx, shardMetaFile(shard), data))
+}
+
+// ReadShardFiles reads the data files of the shard recorded by
+// WriteShardFiles.
+func ReadShardFiles(ctx context.Context, s storage.ExternalStorage, shard int) ([]*backuppb.File, error) {
+	data, err := s.ReadFile(ctx, shardMetaFile(shard))
+	if err != nil {
+		return nil, errors.Annotatef(err, "failed to read the files of shard %d", shard)
+	}
+	meta := &backuppb.BackupMeta{}
+	if err = proto.Unmarshal(data, meta); err != nil {
+		return nil, errors.Annotatef(err, "invalid %s", shardMetaFile(shard))
+	}
+	return meta.Files, nil
+}
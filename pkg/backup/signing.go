@@ -0,0 +1,331 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package backup
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"net/url"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/pingcap/errors"
+	"google.golang.org/api/cloudkms/v1"
+
+	berrors "github.com/pingcap/br/pkg/errors"
+	"github.com/pingcap/br/pkg/metautil"
+)
+
+const (
+	signatureEd25519     = "ed25519"
+	signatureECDSASHA256 = "ecdsa-sha256"
+	signatureRSASHA256   = "rsa-pkcs1-sha256"
+)
+
+// NewSigner creates the signer of the backup by the URI of the private key,
+// one of file:<path of the PKCS #8 PEM>, aws-kms:<key-id>[?region=<region>&
+// algorithm=<signing algorithm>] and gcp-kms:<crypto key version name>. The
+// keys of ed25519, ECDSA and RSA are supported, and the digests are sha256.
+func NewSigner(ctx context.Context, uri string) (metautil.Signer, error) {
+	kind := strings.SplitN(uri, ":", 2)
+	if len(kind) != 2 || len(kind[1]) == 0 {
+		return nil, errors.Annotatef(berrors.ErrInvalidArgument,
+			"invalid signing key %s, should be file:<path>, aws-kms:<key-id> or gcp-kms:<key-version-name>", uri)
+	}
+	switch kind[0] {
+	case masterKeyFile:
+		return newFileSigner(kind[1])
+	case masterKeyAWSKMS:
+		return newAWSSigningKey(kind[1])
+	case masterKeyGCPKMS:
+		return newGCPSigningKey(ctx, kind[1])
+	default:
+		return nil, errors.Annotatef(berrors.ErrInvalidArgument, "unknown signing key type %s", kind[0])
+	}
+}
+
+// NewVerifier creates the verifier of the backup signature by the URI of the
+// key, see NewSigner. The file may contain the PKIX public key instead of the
+// private key.
+func NewVerifier(ctx context.Context, uri string) (metautil.Verifier, error) {
+	kind := strings.SplitN(uri, ":", 2)
+	if len(kind) != 2 || len(kind[1]) == 0 {
+		return nil, errors.Annotatef(berrors.ErrInvalidArgument,
+			"invalid signing key %s, should be file:<path>, aws-kms:<key-id> or gcp-kms:<key-version-name>", uri)
+	}
+	switch kind[0] {
+	case masterKeyFile:
+		return newFileVerifier(kind[1])
+	case masterKeyAWSKMS:
+		return newAWSSigningKey(kind[1])
+	case masterKeyGCPKMS:
+		return newGCPSigningKey(ctx, kind[1])
+	default:
+		return nil, errors.Annotatef(berrors.ErrInvalidArgument, "unknown signing key type %s", kind[0])
+	}
+}
+
+func readPEM(path string) (*pem.Block, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Annotatef(err, "failed to read the signing key file %s", path)
+	}
+	block, _ := pem.Decode(content)
+	if block == nil {
+		return nil, errors.Annotatef(berrors.ErrInvalidArgument, "the signing key file %s isn't PEM encoded", path)
+	}
+	return block, nil
+}
+
+// signatureAlgorithm returns the algorithm signing by the key.
+func signatureAlgorithm(key crypto.PublicKey) (string, error) {
+	switch key.(type) {
+	case ed25519.PublicKey:
+		return signatureEd25519, nil
+	case *ecdsa.PublicKey:
+		return signatureECDSASHA256, nil
+	case *rsa.PublicKey:
+		return signatureRSASHA256, nil
+	default:
+		return "", errors.Annotatef(berrors.ErrInvalidArgument, "unsupported signing key %T", key)
+	}
+}
+
+// verifyDigest verifies the signature of the digest by the public key locally,
+// pss is for the RSA signatures with the PSS padding.
+func verifyDigest(key crypto.PublicKey, pss bool, digest, signature []byte) error {
+	switch pub := key.(type) {
+	case ed25519.PublicKey:
+		if !ed25519.Verify(pub, digest, signature) {
+			return errors.New("ed25519 verification failed")
+		}
+		return nil
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(pub, digest, signature) {
+			return errors.New("ecdsa verification failed")
+		}
+		return nil
+	case *rsa.PublicKey:
+		if pss {
+			return errors.Trace(rsa.VerifyPSS(pub, crypto.SHA256, digest, signature, nil))
+		}
+		return errors.Trace(rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest, signature))
+	default:
+		return errors.Annotatef(berrors.ErrInvalidArgument, "unsupported signing key %T", key)
+	}
+}
+
+// fileSigner signs by the private key in a local PEM file.
+type fileSigner struct {
+	key       crypto.Signer
+	algorithm string
+}
+
+func newFileSigner(path string) (metautil.Signer, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, errors.Annotatef(berrors.ErrInvalidArgument,
+			"the signing key file %s should contain a PKCS #8 private key: %s", path, err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, errors.Annotatef(berrors.ErrInvalidArgument, "unsupported signing key %T", key)
+	}
+	algorithm, err := signatureAlgorithm(signer.Public())
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return &fileSigner{key: signer, algorithm: algorithm}, nil
+}
+
+func (s *fileSigner) Algorithm() string {
+	return s.algorithm
+}
+
+func (s *fileSigner) Sign(_ context.Context, digest []byte) ([]byte, error) {
+	// ed25519 signs the digest as the message, the others sign the digest.
+	var opts crypto.SignerOpts = crypto.SHA256
+	if s.algorithm == signatureEd25519 {
+		opts = crypto.Hash(0)
+	}
+	signature, err := s.key.Sign(rand.Reader, digest, opts)
+	return signature, errors.Trace(err)
+}
+
+// fileVerifier verifies by the public key, or the public part of the private
+// key, in a local PEM file.
+type fileVerifier struct {
+	key       crypto.PublicKey
+	algorithm string
+}
+
+func newFileVerifier(path string) (metautil.Verifier, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	var key crypto.PublicKey
+	if block.Type == "PUBLIC KEY" {
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
+	} else {
+		var private interface{}
+		if private, err = x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+			signer, ok := private.(crypto.Signer)
+			if !ok {
+				return nil, errors.Annotatef(berrors.ErrInvalidArgument, "unsupported signing key %T", private)
+			}
+			key = signer.Public()
+		}
+	}
+	if err != nil {
+		return nil, errors.Annotatef(berrors.ErrInvalidArgument,
+			"the signing key file %s should contain a PKIX public key or a PKCS #8 private key: %s", path, err)
+	}
+	algorithm, err := signatureAlgorithm(key)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return &fileVerifier{key: key, algorithm: algorithm}, nil
+}
+
+func (v *fileVerifier) Verify(_ context.Context, algorithm string, digest, signature []byte) error {
+	if algorithm != v.algorithm {
+		return errors.Errorf("the backup is signed by %s, but the key is for %s", algorithm, v.algorithm)
+	}
+	return verifyDigest(v.key, false, digest, signature)
+}
+
+// awsSigningKey signs and verifies by an asymmetric key of AWS KMS.
+type awsSigningKey struct {
+	client    *kms.KMS
+	keyID     string
+	algorithm string
+}
+
+func newAWSSigningKey(s string) (*awsSigningKey, error) {
+	keyID, rawQuery := s, ""
+	if i := strings.IndexByte(s, '?'); i >= 0 {
+		keyID, rawQuery = s[:i], s[i+1:]
+	}
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return nil, errors.Annotatef(berrors.ErrInvalidArgument, "invalid options of AWS KMS %s", rawQuery)
+	}
+	cfg := aws.NewConfig()
+	if region := query.Get("region"); len(region) > 0 {
+		cfg = cfg.WithRegion(region)
+	}
+	if endpoint := query.Get("endpoint"); len(endpoint) > 0 {
+		cfg = cfg.WithEndpoint(endpoint)
+	}
+	algorithm := query.Get("algorithm")
+	if len(algorithm) == 0 {
+		algorithm = kms.SigningAlgorithmSpecEcdsaSha256
+	}
+	ses, err := session.NewSessionWithOptions(session.Options{
+		Config:            *cfg,
+		SharedConfigState: session.SharedConfigEnable,
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return &awsSigningKey{client: kms.New(ses), keyID: keyID, algorithm: algorithm}, nil
+}
+
+func (k *awsSigningKey) Algorithm() string {
+	return k.algorithm
+}
+
+func (k *awsSigningKey) Sign(ctx context.Context, digest []byte) ([]byte, error) {
+	resp, err := k.client.SignWithContext(ctx, &kms.SignInput{
+		KeyId:            aws.String(k.keyID),
+		Message:          digest,
+		MessageType:      aws.String(kms.MessageTypeDigest),
+		SigningAlgorithm: aws.String(k.algorithm),
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return resp.Signature, nil
+}
+
+func (k *awsSigningKey) Verify(ctx context.Context, algorithm string, digest, signature []byte) error {
+	resp, err := k.client.VerifyWithContext(ctx, &kms.VerifyInput{
+		KeyId:            aws.String(k.keyID),
+		Message:          digest,
+		MessageType:      aws.String(kms.MessageTypeDigest),
+		Signature:        signature,
+		SigningAlgorithm: aws.String(algorithm),
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if !aws.BoolValue(resp.SignatureValid) {
+		return errors.New("AWS KMS verification failed")
+	}
+	return nil
+}
+
+// gcpSigningKey signs by an asymmetric key version of Cloud KMS, and verifies
+// by its public key locally, as Cloud KMS doesn't verify the signatures.
+type gcpSigningKey struct {
+	versions *cloudkms.ProjectsLocationsKeyRingsCryptoKeysCryptoKeyVersionsService
+	name     string
+}
+
+func newGCPSigningKey(ctx context.Context, name string) (*gcpSigningKey, error) {
+	service, err := cloudkms.NewService(ctx)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return &gcpSigningKey{versions: service.Projects.Locations.KeyRings.CryptoKeys.CryptoKeyVersions, name: name}, nil
+}
+
+func (k *gcpSigningKey) Algorithm() string {
+	// The algorithm is bound to the key version.
+	return masterKeyGCPKMS
+}
+
+func (k *gcpSigningKey) Sign(ctx context.Context, digest []byte) ([]byte, error) {
+	resp, err := k.versions.AsymmetricSign(k.name, &cloudkms.AsymmetricSignRequest{
+		Digest: &cloudkms.Digest{Sha256: base64.StdEncoding.EncodeToString(digest)},
+	}).Context(ctx).Do()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	decoded, err := base64.StdEncoding.DecodeString(resp.Signature)
+	return decoded, errors.Trace(err)
+}
+
+func (k *gcpSigningKey) Verify(ctx context.Context, algorithm string, digest, signature []byte) error {
+	if algorithm != masterKeyGCPKMS {
+		return errors.Errorf("the backup is signed by %s, but the key is of Cloud KMS", algorithm)
+	}
+	resp, err := k.versions.GetPublicKey(k.name).Context(ctx).Do()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	block, _ := pem.Decode([]byte(resp.Pem))
+	if block == nil {
+		return errors.Annotatef(berrors.ErrInvalidArgument, "invalid public key of %s", k.name)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return verifyDigest(key, strings.Contains(resp.Algorithm, "PSS"), digest, signature)
+}
@@ -0,0 +1,106 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package backup_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"path/filepath"
+
+	. "github.com/pingcap/check"
+	backuppb "github.com/pingcap/kvproto/pkg/backup"
+
+	"github.com/pingcap/br/pkg/backup"
+	"github.com/pingcap/br/pkg/metautil"
+	"github.com/pingcap/br/pkg/storage"
+)
+
+var _ = Suite(&testSigningSuite{})
+
+type testSigningSuite struct{}
+
+func writePEM(c *C, path, typ string, der []byte) string {
+	c.Assert(ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0o600), IsNil)
+	return "file:" + path
+}
+
+func (s *testSigningSuite) TestSignAndVerify(c *C) {
+	ctx := context.Background()
+	dir := c.MkDir()
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	c.Assert(err, IsNil)
+	der, err := x509.MarshalPKCS8PrivateKey(edKey)
+	c.Assert(err, IsNil)
+	privateKey := writePEM(c, filepath.Join(dir, "ed25519.pem"), "PRIVATE KEY", der)
+	der, err = x509.MarshalPKIXPublicKey(edKey.Public())
+	c.Assert(err, IsNil)
+	publicKey := writePEM(c, filepath.Join(dir, "ed25519.pub"), "PUBLIC KEY", der)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, IsNil)
+	der, err = x509.MarshalPKCS8PrivateKey(ecKey)
+	c.Assert(err, IsNil)
+	otherKey := writePEM(c, filepath.Join(dir, "ecdsa.pem"), "PRIVATE KEY", der)
+
+	store, err := storage.NewLocalStorage(c.MkDir())
+	c.Assert(err, IsNil)
+	signer, err := backup.NewSigner(ctx, privateKey)
+	c.Assert(err, IsNil)
+	writer := metautil.NewMetaWriter(store, metautil.MetaFileSize, true)
+	writer.SetSigner(signer, privateKey)
+	writer.StartWriteMetasAsync(ctx, metautil.AppendDataFile)
+	c.Assert(writer.Send([]*backuppb.File{{Name: "1.sst"}}, metautil.AppendDataFile), IsNil)
+	c.Assert(writer.FinishWriteMetas(ctx, metautil.AppendDataFile), IsNil)
+	c.Assert(backup.SaveExtension(ctx, store, &backup.Extension{ResolvedTS: &backup.ResolvedTS{}}), IsNil)
+	c.Assert(writer.WriteFinishMarker(ctx), IsNil)
+
+	// Both the private key and the public key verify the signature.
+	for _, key := range []string{privateKey, publicKey} {
+		verifier, err := backup.NewVerifier(ctx, key)
+		c.Assert(err, IsNil)
+		sig, err := metautil.VerifySignature(ctx, store, verifier)
+		c.Assert(err, IsNil)
+		c.Assert(sig.Algorithm, Equals, "ed25519")
+		c.Assert(sig.Key, Equals, privateKey)
+	}
+
+	// A different key doesn't verify the signature.
+	verifier, err := backup.NewVerifier(ctx, otherKey)
+	c.Assert(err, IsNil)
+	_, err = metautil.VerifySignature(ctx, store, verifier)
+	c.Assert(err, ErrorMatches, ".*backup signature mismatch.*")
+
+	// The sidecars are signed.
+	c.Assert(metautil.SignedSidecars, DeepEquals, []string{backup.ExtensionFile, backup.EncryptionFile})
+	verifier, err = backup.NewVerifier(ctx, publicKey)
+	c.Assert(err, IsNil)
+	extension, err := store.ReadFile(ctx, backup.ExtensionFile)
+	c.Assert(err, IsNil)
+	c.Assert(store.WriteFile(ctx, backup.ExtensionFile, []byte(`{"version":1}`)), IsNil)
+	_, err = metautil.VerifySignature(ctx, store, verifier)
+	c.Assert(err, ErrorMatches, ".*backupmeta.ext doesn't match the signed sidecars.*")
+	c.Assert(store.WriteFile(ctx, backup.ExtensionFile, extension), IsNil)
+	c.Assert(store.WriteFile(ctx, backup.EncryptionFile, []byte("{}")), IsNil)
+	_, err = metautil.VerifySignature(ctx, store, verifier)
+	c.Assert(err, ErrorMatches, ".*backupmeta.encryption doesn't match the signed sidecars.*")
+	_, err = storage.DeleteFile(ctx, store, backup.EncryptionFile)
+	c.Assert(err, IsNil)
+	_, err = metautil.VerifySignature(ctx, store, verifier)
+	c.Assert(err, IsNil)
+
+	// The tampered backupmeta doesn't match the signature.
+	c.Assert(store.WriteFile(ctx, metautil.MetaFile, []byte("tampered")), IsNil)
+	_, err = metautil.VerifySignature(ctx, store, verifier)
+	c.Assert(err, ErrorMatches, ".*the signature of backupmeta is invalid.*")
+
+	// The unsigned backup is refused.
+	unsigned, err := storage.NewLocalStorage(c.MkDir())
+	c.Assert(err, IsNil)
+	_, err = metautil.VerifySignature(ctx, unsigned, verifier)
+	c.Assert(err, ErrorMatches, ".*the backup isn't signed.*")
+}
@@ -3,12 +3,16 @@
 package checksum
 
 import (
+	"bytes"
 	"context"
+	"sort"
+	"sync"
 
 	"github.com/pingcap/br/pkg/metautil"
 
 	"github.com/gogo/protobuf/proto"
 	"github.com/pingcap/errors"
+	backuppb "github.com/pingcap/kvproto/pkg/backup"
 	"github.com/pingcap/log"
 	"github.com/pingcap/parser/model"
 	"github.com/pingcap/tidb/distsql"
@@ -18,6 +22,7 @@ import (
 	"github.com/pingcap/tidb/util/ranger"
 	"github.com/pingcap/tipb/go-tipb"
 	"go.uber.org/zap"
+	"golang.org/x/sync/errgroup"
 )
 
 // ExecutorBuilder is used to build a "kv.Request".
@@ -28,6 +33,8 @@ type ExecutorBuilder struct {
 	oldTable *metautil.Table
 
 	concurrency uint
+	parallelism uint
+	shards      uint
 }
 
 // NewExecutorBuilder returns a new executor builder.
@@ -37,6 +44,7 @@ func NewExecutorBuilder(table *model.TableInfo, ts uint64) *ExecutorBuilder {
 		ts:    ts,
 
 		concurrency: variable.DefDistSQLScanConcurrency,
+		parallelism: 1,
 	}
 }
 
@@ -52,13 +60,35 @@ func (builder *ExecutorBuilder) SetConcurrency(conc uint) *ExecutorBuilder {
 	return builder
 }
 
+// SetParallelism set how many checksum requests may be sent at the same time.
+// Requests of different partitions and indices are independent, so a
+// partitioned table can be checksummed partition by partition in parallel.
+func (builder *ExecutorBuilder) SetParallelism(parallelism uint) *ExecutorBuilder {
+	if parallelism == 0 {
+		parallelism = 1
+	}
+	builder.parallelism = parallelism
+	return builder
+}
+
+// SetRecordShards sets the max number of the requests the record scan of each
+// physical table is split into. The requests are balanced by the key counts of
+// the backed up files of the old table, so it takes effect only if the old
+// table is set. Use it along with SetParallelism to checksum a large table by
+// concurrent requests.
+func (builder *ExecutorBuilder) SetRecordShards(shards uint) *ExecutorBuilder {
+	builder.shards = shards
+	return builder
+}
+
 // Build builds a checksum executor.
 func (builder *ExecutorBuilder) Build() (*Executor, error) {
-	reqs, err := buildChecksumRequest(builder.table, builder.oldTable, builder.ts, builder.concurrency)
+	reqs, err := buildChecksumRequest(
+		builder.table, builder.oldTable, builder.ts, builder.concurrency, builder.shards)
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
-	return &Executor{reqs: reqs}, nil
+	return &Executor{reqs: reqs, parallelism: builder.parallelism}, nil
 }
 
 func buildChecksumRequest(
@@ -66,6 +96,7 @@ func buildChecksumRequest(
 	oldTable *metautil.Table,
 	startTS uint64,
 	concurrency uint,
+	shards uint,
 ) ([]*kv.Request, error) {
 	var partDefs []model.PartitionDefinition
 	if part := newTable.Partition; part != nil {
@@ -77,7 +108,7 @@ func buildChecksumRequest(
 	if oldTable != nil {
 		oldTableID = oldTable.Info.ID
 	}
-	rs, err := buildRequest(newTable, newTable.ID, oldTable, oldTableID, startTS, concurrency)
+	rs, err := buildRequest(newTable, newTable.ID, oldTable, oldTableID, startTS, concurrency, shards)
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
@@ -92,7 +123,7 @@ func buildChecksumRequest(
 				}
 			}
 		}
-		rs, err := buildRequest(newTable, partDef.ID, oldTable, oldPartID, startTS, concurrency)
+		rs, err := buildRequest(newTable, partDef.ID, oldTable, oldPartID, startTS, concurrency, shards)
 		if err != nil {
 			return nil, errors.Trace(err)
 		}
@@ -109,13 +140,28 @@ func buildRequest(
 	oldTableID int64,
 	startTS uint64,
 	concurrency uint,
+	shards uint,
 ) ([]*kv.Request, error) {
 	reqs := make([]*kv.Request, 0)
-	req, err := buildTableRequest(tableInfo, tableID, oldTable, oldTableID, startTS, concurrency)
-	if err != nil {
-		return nil, errors.Trace(err)
+	var files []*backuppb.File
+	if oldTable != nil {
+		files = oldTable.Files
+	}
+	if keyRanges := splitRecordRange(files, oldTableID, tableID, shards); len(keyRanges) > 1 {
+		for _, keyRange := range keyRanges {
+			req, err := buildTableRangeRequest(tableID, oldTable, oldTableID, keyRange, startTS, concurrency)
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+			reqs = append(reqs, req)
+		}
+	} else {
+		req, err := buildTableRequest(tableInfo, tableID, oldTable, oldTableID, startTS, concurrency)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		reqs = append(reqs, req)
 	}
-	reqs = append(reqs, req)
 
 	for _, indexInfo := range tableInfo.Indices {
 		if indexInfo.State != model.StatePublic {
@@ -139,7 +185,7 @@ func buildRequest(
 					zap.Stringer("index name", indexInfo.Name))
 			}
 		}
-		req, err = buildIndexRequest(
+		req, err := buildIndexRequest(
 			tableID, indexInfo, oldTableID, oldIndexInfo, startTS, concurrency)
 		if err != nil {
 			return nil, errors.Trace(err)
@@ -158,19 +204,7 @@ func buildTableRequest(
 	startTS uint64,
 	concurrency uint,
 ) (*kv.Request, error) {
-	var rule *tipb.ChecksumRewriteRule
-	if oldTable != nil {
-		rule = &tipb.ChecksumRewriteRule{
-			OldPrefix: tablecodec.GenTableRecordPrefix(oldTableID),
-			NewPrefix: tablecodec.GenTableRecordPrefix(tableID),
-		}
-	}
-
-	checksum := &tipb.ChecksumRequest{
-		ScanOn:    tipb.ChecksumScanOn_Table,
-		Algorithm: tipb.ChecksumAlgorithm_Crc64_Xor,
-		Rule:      rule,
-	}
+	checksum := tableChecksumRequest(tableID, oldTable, oldTableID)
 
 	var ranges []*ranger.Range
 	if tableInfo.IsCommonHandle {
@@ -189,6 +223,98 @@ func buildTableRequest(
 		Build()
 }
 
+// buildTableRangeRequest builds the request of the record scan in the key
+// range of the table.
+func buildTableRangeRequest(
+	tableID int64,
+	oldTable *metautil.Table,
+	oldTableID int64,
+	keyRange kv.KeyRange,
+	startTS uint64,
+	concurrency uint,
+) (*kv.Request, error) {
+	var builder distsql.RequestBuilder
+	// Use low priority to reducing impact to other requests.
+	builder.Request.Priority = kv.PriorityLow
+	return builder.SetKeyRanges([]kv.KeyRange{keyRange}).
+		SetStartTS(startTS).
+		SetChecksumRequest(tableChecksumRequest(tableID, oldTable, oldTableID)).
+		SetConcurrency(int(concurrency)).
+		Build()
+}
+
+func tableChecksumRequest(tableID int64, oldTable *metautil.Table, oldTableID int64) *tipb.ChecksumRequest {
+	var rule *tipb.ChecksumRewriteRule
+	if oldTable != nil {
+		rule = &tipb.ChecksumRewriteRule{
+			OldPrefix: tablecodec.GenTableRecordPrefix(oldTableID),
+			NewPrefix: tablecodec.GenTableRecordPrefix(tableID),
+		}
+	}
+	return &tipb.ChecksumRequest{
+		ScanOn:    tipb.ChecksumScanOn_Table,
+		Algorithm: tipb.ChecksumAlgorithm_Crc64_Xor,
+		Rule:      rule,
+	}
+}
+
+// splitRecordRange splits the record range of the new table into at most
+// `shards` key ranges, with the balanced key counts estimated by the backed up
+// files of the old table. It returns nil if the range isn't split.
+func splitRecordRange(files []*backuppb.File, oldTableID, newTableID int64, shards uint) []kv.KeyRange {
+	if shards <= 1 || oldTableID == 0 {
+		return nil
+	}
+	oldPrefix := tablecodec.GenTableRecordPrefix(oldTableID)
+	// The files of different column families of a region share the same
+	// range, count the keys of the range once.
+	byRange := make(map[string]*backuppb.File)
+	for _, f := range files {
+		if !bytes.HasPrefix(f.GetStartKey(), oldPrefix) {
+			continue
+		}
+		key := string(f.GetStartKey()) + "/" + string(f.GetEndKey())
+		if prev, ok := byRange[key]; !ok || prev.GetTotalKvs() < f.GetTotalKvs() {
+			byRange[key] = f
+		}
+	}
+	recordFiles := make([]*backuppb.File, 0, len(byRange))
+	total := uint64(0)
+	for _, f := range byRange {
+		recordFiles = append(recordFiles, f)
+		total += f.GetTotalKvs()
+	}
+	if len(recordFiles) < 2 || total == 0 {
+		return nil
+	}
+	sort.Slice(recordFiles, func(i, j int) bool {
+		return bytes.Compare(recordFiles[i].GetStartKey(), recordFiles[j].GetStartKey()) < 0
+	})
+
+	newPrefix := tablecodec.GenTableRecordPrefix(newTableID)
+	target := total / uint64(shards)
+	ranges := make([]kv.KeyRange, 0, shards)
+	start := newPrefix
+	kvs := uint64(0)
+	for _, f := range recordFiles[:len(recordFiles)-1] {
+		kvs += f.GetTotalKvs()
+		if kvs < target || len(ranges) == int(shards)-1 || !bytes.HasPrefix(f.GetEndKey(), oldPrefix) {
+			continue
+		}
+		end := append(append(kv.Key{}, newPrefix...), f.GetEndKey()[len(oldPrefix):]...)
+		if bytes.Compare(end, start) <= 0 {
+			continue
+		}
+		ranges = append(ranges, kv.KeyRange{StartKey: start, EndKey: end})
+		start = end
+		kvs = 0
+	}
+	if len(ranges) == 0 {
+		return nil
+	}
+	return append(ranges, kv.KeyRange{StartKey: start, EndKey: newPrefix.PrefixNext()})
+}
+
 func buildIndexRequest(
 	tableID int64,
 	indexInfo *model.IndexInfo,
@@ -263,7 +389,8 @@ func updateChecksumResponse(resp, update *tipb.ChecksumResponse) {
 
 // Executor is a checksum executor.
 type Executor struct {
-	reqs []*kv.Request
+	reqs        []*kv.Request
+	parallelism uint
 }
 
 // Len returns the total number of checksum requests.
@@ -302,6 +429,9 @@ func (exec *Executor) Execute(
 	client kv.Client,
 	updateFn func(),
 ) (*tipb.ChecksumResponse, error) {
+	if exec.parallelism > 1 && len(exec.reqs) > 1 {
+		return exec.executeParallel(ctx, client, updateFn)
+	}
 	checksumResp := &tipb.ChecksumResponse{}
 	for _, req := range exec.reqs {
 		// Pointer to SessionVars.Killed
@@ -318,3 +448,47 @@ func (exec *Executor) Execute(
 	}
 	return checksumResp, nil
 }
+
+// executeParallel sends at most `parallelism` requests at the same time.
+// The checksum response is order-independent (xor and sum), so responses are
+// merged as soon as they arrive.
+func (exec *Executor) executeParallel(
+	ctx context.Context,
+	client kv.Client,
+	updateFn func(),
+) (*tipb.ChecksumResponse, error) {
+	var mu sync.Mutex
+	checksumResp := &tipb.ChecksumResponse{}
+	workers := make(chan struct{}, exec.parallelism)
+	eg, ectx := errgroup.WithContext(ctx)
+	for _, req := range exec.reqs {
+		req := req
+		select {
+		case workers <- struct{}{}:
+		case <-ectx.Done():
+		}
+		if ectx.Err() != nil {
+			break
+		}
+		eg.Go(func() error {
+			defer func() { <-workers }()
+			killed := uint32(0)
+			resp, err := sendChecksumRequest(ectx, client, req, kv.NewVariables(&killed))
+			if err != nil {
+				return errors.Trace(err)
+			}
+			mu.Lock()
+			updateChecksumResponse(checksumResp, resp)
+			updateFn()
+			mu.Unlock()
+			return nil
+		})
+	}
+	if err := eg.Wait(); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return checksumResp, nil
+}
@@ -10,9 +10,11 @@ import (
 	"github.com/pingcap/br/pkg/metautil"
 
 	. "github.com/pingcap/check"
+	backuppb "github.com/pingcap/kvproto/pkg/backup"
 	"github.com/pingcap/parser/model"
 	"github.com/pingcap/tidb/kv"
 	"github.com/pingcap/tidb/sessionctx/variable"
+	"github.com/pingcap/tidb/tablecodec"
 	"github.com/pingcap/tidb/util/testkit"
 	"github.com/pingcap/tidb/util/testleak"
 
@@ -111,6 +113,24 @@ func (s *testChecksumSuite) TestChecksum(c *C) {
 	c.Assert(err, IsNil)
 	c.Assert(resp2, NotNil)
 
+	// Test partitions in parallel
+	tk.MustExec("drop table if exists t4;")
+	tk.MustExec("create table t4 (a int) partition by hash(a) partitions 4;")
+	tk.MustExec("insert into t4 values (1), (2), (3), (4);")
+	tableInfo4 := s.getTableInfo(c, "test", "t4")
+	exe4, err := checksum.NewExecutorBuilder(tableInfo4, math.MaxUint64).
+		SetParallelism(4).
+		Build()
+	c.Assert(err, IsNil)
+	c.Assert(exe4.Len(), Equals, 5)
+	updated := 0
+	resp4, err := exe4.Execute(context.TODO(), s.mock.Storage.GetClient(), func() { updated++ })
+	c.Assert(err, IsNil)
+	c.Assert(updated, Equals, 5)
+	c.Assert(resp4.Checksum, Equals, uint64(1), Commentf("%v", resp4))
+	c.Assert(resp4.TotalKvs, Equals, uint64(5), Commentf("%v", resp4))
+	c.Assert(resp4.TotalBytes, Equals, uint64(5), Commentf("%v", resp4))
+
 	// Test commonHandle ranges
 
 	tk.MustExec("drop table if exists t3;")
@@ -130,3 +150,42 @@ func (s *testChecksumSuite) TestChecksum(c *C) {
 		return nil
 	}), IsNil)
 }
+
+func (s *testChecksumSuite) TestRecordShards(c *C) {
+	rowKey := func(tableID, handle int64) []byte {
+		return tablecodec.EncodeRowKeyWithHandle(tableID, kv.IntHandle(handle))
+	}
+	files := []*backuppb.File{
+		{Cf: "write", StartKey: rowKey(1, 0), EndKey: rowKey(1, 100), TotalKvs: 100},
+		{Cf: "default", StartKey: rowKey(1, 0), EndKey: rowKey(1, 100), TotalKvs: 10},
+		{Cf: "write", StartKey: rowKey(1, 300), EndKey: tablecodec.GenTableRecordPrefix(1).PrefixNext(), TotalKvs: 100},
+		{Cf: "write", StartKey: rowKey(1, 100), EndKey: rowKey(1, 200), TotalKvs: 100},
+		{Cf: "write", StartKey: rowKey(1, 200), EndKey: rowKey(1, 300), TotalKvs: 100},
+	}
+	oldTable := &metautil.Table{Info: &model.TableInfo{ID: 1}, Files: files}
+	newTable := &model.TableInfo{ID: 2}
+
+	exe, err := checksum.NewExecutorBuilder(newTable, math.MaxUint64).
+		SetOldTable(oldTable).
+		SetRecordShards(2).
+		Build()
+	c.Assert(err, IsNil)
+	c.Assert(exe.Len(), Equals, 2)
+	ranges := make([]kv.KeyRange, 0, 2)
+	c.Assert(exe.Each(func(r *kv.Request) error {
+		ranges = append(ranges, r.KeyRanges...)
+		return nil
+	}), IsNil)
+	prefix := tablecodec.GenTableRecordPrefix(2)
+	c.Assert(ranges, DeepEquals, []kv.KeyRange{
+		{StartKey: prefix, EndKey: rowKey(2, 200)},
+		{StartKey: rowKey(2, 200), EndKey: prefix.PrefixNext()},
+	})
+
+	// The record scan isn't split without the old table.
+	exe, err = checksum.NewExecutorBuilder(newTable, math.MaxUint64).
+		SetRecordShards(2).
+		Build()
+	c.Assert(err, IsNil)
+	c.Assert(exe.Len(), Equals, 1)
+}
@@ -31,6 +31,7 @@ import (
 	"github.com/pingcap/br/pkg/glue"
 	"github.com/pingcap/br/pkg/logutil"
 	"github.com/pingcap/br/pkg/pdutil"
+	"github.com/pingcap/br/pkg/storage"
 	"github.com/pingcap/br/pkg/version"
 )
 
@@ -102,6 +103,7 @@ func NewConnPool(cap int, newConn func(ctx context.Context) (*grpc.ClientConn, e
 type Mgr struct {
 	*pdutil.PdController
 	tlsConf   *tls.Config
+	pdTLSConf *tls.Config
 	dom       *domain.Domain
 	storage   kv.Storage   // Used to access SQL related interfaces.
 	tikvStore tikv.Storage // Used to access TiKV specific interfaces.
@@ -174,6 +176,7 @@ func NewMgr(
 	pdAddrs string,
 	storage kv.Storage,
 	tlsConf *tls.Config,
+	pdTLSConf *tls.Config,
 	securityOption pd.SecurityOption,
 	keepalive keepalive.ClientParameters,
 	storeBehavior StoreBehavior,
@@ -191,7 +194,7 @@ func NewMgr(
 		return nil, berrors.ErrKVNotTiKV
 	}
 
-	controller, err := pdutil.NewPdController(ctx, pdAddrs, tlsConf, securityOption)
+	controller, err := pdutil.NewPdController(ctx, pdAddrs, pdTLSConf, securityOption)
 	if err != nil {
 		log.Error("fail to create pd controller", zap.Error(err))
 		return nil, errors.Trace(err)
@@ -233,6 +236,7 @@ func NewMgr(
 		tikvStore:    tikvStorage,
 		dom:          dom,
 		tlsConf:      tlsConf,
+		pdTLSConf:    pdTLSConf,
 		ownsStorage:  g.OwnsStorage(),
 	}
 	mgr.grpcClis.clis = make(map[uint64]*grpc.ClientConn)
@@ -357,6 +361,11 @@ func (mgr *Mgr) GetTLSConfig() *tls.Config {
 	return mgr.tlsConf
 }
 
+// GetPDTLSConfig returns the tls config for the HTTP API of PD.
+func (mgr *Mgr) GetPDTLSConfig() *tls.Config {
+	return mgr.pdTLSConf
+}
+
 // GetLockResolver gets the LockResolver.
 func (mgr *Mgr) GetLockResolver() *txnlock.LockResolver {
 	return mgr.tikvStore.GetLockResolver()
@@ -390,3 +399,26 @@ func (mgr *Mgr) Close() {
 
 	mgr.PdController.Close()
 }
+
+// ReadOnlyMgr manages the access of the operations only reading the backup,
+// e.g. validating the backupmeta. It needs the external storage only, so
+// neither the cluster nor the permissions to change it are required.
+type ReadOnlyMgr struct {
+	backend *backuppb.StorageBackend
+	storage storage.ExternalStorage
+}
+
+// NewReadOnlyMgr creates a new ReadOnlyMgr on the external storage.
+func NewReadOnlyMgr(backend *backuppb.StorageBackend, s storage.ExternalStorage) *ReadOnlyMgr {
+	return &ReadOnlyMgr{backend: backend, storage: s}
+}
+
+// GetBackend returns the backend of the external storage.
+func (mgr *ReadOnlyMgr) GetBackend() *backuppb.StorageBackend {
+	return mgr.backend
+}
+
+// GetExternalStorage returns the external storage of the backup.
+func (mgr *ReadOnlyMgr) GetExternalStorage() storage.ExternalStorage {
+	return mgr.storage
+}
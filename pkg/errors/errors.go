@@ -23,38 +23,65 @@ var (
 	ErrVersionMismatch           = errors.Normalize("version mismatch", errors.RFCCodeText("BR:Common:ErrVersionMismatch"))
 	ErrFailedToConnect           = errors.Normalize("failed to make gRPC channels", errors.RFCCodeText("BR:Common:ErrFailedToConnect"))
 	ErrInvalidMetaFile           = errors.Normalize("invalid metafile", errors.RFCCodeText("BR:Common:ErrInvalidMetaFile"))
+	ErrClockSkewTooLarge         = errors.Normalize("clock skew too large", errors.RFCCodeText("BR:Common:ErrClockSkewTooLarge"))
+	ErrUnsupportedSST            = errors.Normalize("unsupported SST file", errors.RFCCodeText("BR:Common:ErrUnsupportedSST"))
 
 	ErrPDUpdateFailed    = errors.Normalize("failed to update PD", errors.RFCCodeText("BR:PD:ErrPDUpdateFailed"))
 	ErrPDLeaderNotFound  = errors.Normalize("PD leader not found", errors.RFCCodeText("BR:PD:ErrPDLeaderNotFound"))
 	ErrPDInvalidResponse = errors.Normalize("PD invalid response", errors.RFCCodeText("BR:PD:ErrPDInvalidResponse"))
+	ErrPDBatchScanRegion = errors.Normalize("batch scan region from PD is inconsistent", errors.RFCCodeText("BR:PD:ErrPDBatchScanRegion"))
+	ErrPDBatchScatter    = errors.Normalize("PD doesn't support scattering regions in batch", errors.RFCCodeText("BR:PD:ErrPDBatchScatter"))
+	ErrPDScatterPartial  = errors.Normalize("PD scattered only part of the regions", errors.RFCCodeText("BR:PD:ErrPDScatterPartial"))
 
 	ErrBackupChecksumMismatch    = errors.Normalize("backup checksum mismatch", errors.RFCCodeText("BR:Backup:ErrBackupChecksumMismatch"))
 	ErrBackupInvalidRange        = errors.Normalize("backup range invalid", errors.RFCCodeText("BR:Backup:ErrBackupInvalidRange"))
 	ErrBackupNoLeader            = errors.Normalize("backup no leader", errors.RFCCodeText("BR:Backup:ErrBackupNoLeader"))
 	ErrBackupGCSafepointExceeded = errors.Normalize("backup GC safepoint exceeded", errors.RFCCodeText("BR:Backup:ErrBackupGCSafepointExceeded"))
+	ErrBackupResolvedTSLag       = errors.Normalize("resolved ts of stores lags behind the backup ts", errors.RFCCodeText("BR:Backup:ErrBackupResolvedTSLag"))
+	ErrBackupInvalidChain        = errors.Normalize("invalid chain of the full and incremental backups", errors.RFCCodeText("BR:Backup:ErrBackupInvalidChain"))
+	ErrBackupSignatureMismatch   = errors.Normalize("backup signature mismatch", errors.RFCCodeText("BR:Backup:ErrBackupSignatureMismatch"))
 
-	ErrRestoreModeMismatch     = errors.Normalize("restore mode mismatch", errors.RFCCodeText("BR:Restore:ErrRestoreModeMismatch"))
-	ErrRestoreRangeMismatch    = errors.Normalize("restore range mismatch", errors.RFCCodeText("BR:Restore:ErrRestoreRangeMismatch"))
-	ErrRestoreChecksumMismatch = errors.Normalize("restore checksum mismatch", errors.RFCCodeText("BR:Restore:ErrRestoreChecksumMismatch"))
-	ErrRestoreTableIDMismatch  = errors.Normalize("restore table ID mismatch", errors.RFCCodeText("BR:Restore:ErrRestoreTableIDMismatch"))
-	ErrRestoreRejectStore      = errors.Normalize("failed to restore remove rejected store", errors.RFCCodeText("BR:Restore:ErrRestoreRejectStore"))
-	ErrRestoreNoPeer           = errors.Normalize("region does not have peer", errors.RFCCodeText("BR:Restore:ErrRestoreNoPeer"))
-	ErrRestoreSplitFailed      = errors.Normalize("fail to split region", errors.RFCCodeText("BR:Restore:ErrRestoreSplitFailed"))
-	ErrRestoreInvalidRewrite   = errors.Normalize("invalid rewrite rule", errors.RFCCodeText("BR:Restore:ErrRestoreInvalidRewrite"))
-	ErrRestoreInvalidBackup    = errors.Normalize("invalid backup", errors.RFCCodeText("BR:Restore:ErrRestoreInvalidBackup"))
-	ErrRestoreInvalidRange     = errors.Normalize("invalid restore range", errors.RFCCodeText("BR:Restore:ErrRestoreInvalidRange"))
-	ErrRestoreWriteAndIngest   = errors.Normalize("failed to write and ingest", errors.RFCCodeText("BR:Restore:ErrRestoreWriteAndIngest"))
-	ErrRestoreSchemaNotExists  = errors.Normalize("schema not exists", errors.RFCCodeText("BR:Restore:ErrRestoreSchemaNotExists"))
-	ErrUnsupportedSystemTable  = errors.Normalize("the system table isn't supported for restoring yet", errors.RFCCodeText("BR:Restore:ErrUnsupportedSysTable"))
+	ErrRestoreModeMismatch       = errors.Normalize("restore mode mismatch", errors.RFCCodeText("BR:Restore:ErrRestoreModeMismatch"))
+	ErrRestoreRangeMismatch      = errors.Normalize("restore range mismatch", errors.RFCCodeText("BR:Restore:ErrRestoreRangeMismatch"))
+	ErrRestoreChecksumMismatch   = errors.Normalize("restore checksum mismatch", errors.RFCCodeText("BR:Restore:ErrRestoreChecksumMismatch"))
+	ErrRestoreTableIDMismatch    = errors.Normalize("restore table ID mismatch", errors.RFCCodeText("BR:Restore:ErrRestoreTableIDMismatch"))
+	ErrRestoreRejectStore        = errors.Normalize("failed to restore remove rejected store", errors.RFCCodeText("BR:Restore:ErrRestoreRejectStore"))
+	ErrRestoreNoPeer             = errors.Normalize("region does not have peer", errors.RFCCodeText("BR:Restore:ErrRestoreNoPeer"))
+	ErrRestoreSplitFailed        = errors.Normalize("fail to split region", errors.RFCCodeText("BR:Restore:ErrRestoreSplitFailed"))
+	ErrRestoreSplitNoValidKey    = errors.Normalize("split keys are not valid for the region", errors.RFCCodeText("BR:Restore:ErrRestoreSplitNoValidKey"))
+	ErrRestoreInvalidRewrite     = errors.Normalize("invalid rewrite rule", errors.RFCCodeText("BR:Restore:ErrRestoreInvalidRewrite"))
+	ErrRestoreInvalidBackup      = errors.Normalize("invalid backup", errors.RFCCodeText("BR:Restore:ErrRestoreInvalidBackup"))
+	ErrRestoreInvalidRange       = errors.Normalize("invalid restore range", errors.RFCCodeText("BR:Restore:ErrRestoreInvalidRange"))
+	ErrRestoreWriteAndIngest     = errors.Normalize("failed to write and ingest", errors.RFCCodeText("BR:Restore:ErrRestoreWriteAndIngest"))
+	ErrRestoreSchemaNotExists    = errors.Normalize("schema not exists", errors.RFCCodeText("BR:Restore:ErrRestoreSchemaNotExists"))
+	ErrRestoreArchiveOverlap     = errors.Normalize("key ranges of archives overlap", errors.RFCCodeText("BR:Restore:ErrRestoreArchiveOverlap"))
+	ErrRestoreSchemaIncompatible = errors.Normalize("existing table schema incompatible with the backup", errors.RFCCodeText("BR:Restore:ErrRestoreSchemaIncompatible"))
+	ErrRestoreLockCFFiles        = errors.Normalize("backup archive contains lock CF files", errors.RFCCodeText("BR:Restore:ErrRestoreLockCFFiles"))
+	ErrRestoreCFNotAtomic        = errors.Normalize("cannot restore the column families atomically", errors.RFCCodeText("BR:Restore:ErrRestoreCFNotAtomic"))
+	ErrRestoreIncompleteBackup   = errors.Normalize("backup archive is incomplete", errors.RFCCodeText("BR:Restore:ErrRestoreIncompleteBackup"))
+	ErrRestoreDatabaseFailed     = errors.Normalize("failed to restore the schemas of databases", errors.RFCCodeText("BR:Restore:ErrRestoreDatabaseFailed"))
+	ErrRestoreTooManyRegions     = errors.Normalize("too many regions after splitting", errors.RFCCodeText("BR:Restore:ErrRestoreTooManyRegions"))
+	ErrRestoreEncryptionAtRest   = errors.Normalize("cannot restore into the stores without encryption at rest", errors.RFCCodeText("BR:Restore:ErrRestoreEncryptionAtRest"))
+	ErrRestorePlacementTimeout   = errors.Normalize("timeout waiting for the placement schedule", errors.RFCCodeText("BR:Restore:ErrRestorePlacementTimeout"))
+	ErrRestoreNotInitialized     = errors.Normalize("restore client not initialized", errors.RFCCodeText("BR:Restore:ErrRestoreNotInitialized"))
+	ErrUnsupportedSystemTable    = errors.Normalize("the system table isn't supported for restoring yet", errors.RFCCodeText("BR:Restore:ErrUnsupportedSysTable"))
 
 	// TODO maybe it belongs to PiTR.
 	ErrRestoreRTsConstrain = errors.Normalize("resolved ts constrain violation", errors.RFCCodeText("BR:Restore:ErrRestoreResolvedTsConstrain"))
 
 	ErrPiTRInvalidCDCLogFormat = errors.Normalize("invalid cdc log format", errors.RFCCodeText("BR:PiTR:ErrPiTRInvalidCDCLogFormat"))
 
+	ErrStreamTaskExists   = errors.Normalize("log backup task already exists", errors.RFCCodeText("BR:Stream:ErrStreamTaskExists"))
+	ErrStreamTaskNotFound = errors.Normalize("log backup task not found", errors.RFCCodeText("BR:Stream:ErrStreamTaskNotFound"))
+
 	ErrStorageUnknown           = errors.Normalize("unknown external storage error", errors.RFCCodeText("BR:ExternalStorage:ErrStorageUnknown"))
 	ErrStorageInvalidConfig     = errors.Normalize("invalid external storage config", errors.RFCCodeText("BR:ExternalStorage:ErrStorageInvalidConfig"))
 	ErrStorageInvalidPermission = errors.Normalize("external storage permission", errors.RFCCodeText("BR:ExternalStorage:ErrStorageInvalidPermission"))
+	ErrStorageNotFound          = errors.Normalize("external storage object not found", errors.RFCCodeText("BR:ExternalStorage:ErrStorageNotFound"))
+	ErrStorageDecryption        = errors.Normalize("failed to decrypt the file", errors.RFCCodeText("BR:ExternalStorage:ErrStorageDecryption"))
+	// ErrStorageTransient is the error raised when the external storage failed
+	// temporarily, e.g. server errors, timeouts or throttling. This error is retryable.
+	ErrStorageTransient = errors.Normalize("transient external storage error", errors.RFCCodeText("BR:ExternalStorage:ErrStorageTransient"))
 
 	// Errors reported from TiKV.
 	ErrKVStorage           = errors.Normalize("tikv storage occur I/O error", errors.RFCCodeText("BR:KV:ErrKVStorage"))
@@ -80,4 +107,9 @@ var (
 	ErrKVDownloadFailed = errors.Normalize("download sst failed", errors.RFCCodeText("BR:KV:ErrKVDownloadFailed"))
 	// ErrKVIngestFailed indicates a generic, retryable ingest error.
 	ErrKVIngestFailed = errors.Normalize("ingest sst failed", errors.RFCCodeText("BR:KV:ErrKVIngestFailed"))
+	// ErrKVDownloadRangeMismatch is the error raised when the range or the
+	// column family of the downloaded SST mismatches the request, which would
+	// be rejected by ingesting. This error cannot be retried.
+	ErrKVDownloadRangeMismatch = errors.Normalize("downloaded sst mismatches the request",
+		errors.RFCCodeText("BR:KV:ErrKVDownloadRangeMismatch"))
 )
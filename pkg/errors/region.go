@@ -0,0 +1,67 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package errors
+
+import (
+	"fmt"
+
+	"github.com/pingcap/errors"
+
+	"github.com/pingcap/br/pkg/redact"
+)
+
+// RegionError carries the context of a failure on a region, e.g. splitting
+// or ingesting, so the callers can inspect the region, the key range and the
+// store by errors.As or FindRegionError instead of parsing the message. The
+// cause is kept, so Is and errors.Cause see through it.
+type RegionError struct {
+	Err      error
+	RegionID uint64
+	StartKey []byte
+	EndKey   []byte
+	// StoreID is the store the failed request was sent to, zero if unknown.
+	StoreID uint64
+}
+
+// WithRegion annotates the error with the region context. It returns nil if
+// err is nil.
+func WithRegion(err error, regionID uint64, startKey, endKey []byte, storeID uint64) error {
+	if err == nil {
+		return nil
+	}
+	return &RegionError{
+		Err:      err,
+		RegionID: regionID,
+		StartKey: startKey,
+		EndKey:   endKey,
+		StoreID:  storeID,
+	}
+}
+
+// Error implements error.
+func (e *RegionError) Error() string {
+	return fmt.Sprintf("%s: region %d [%s, %s) on store %d",
+		e.Err.Error(), e.RegionID, redact.Key(e.StartKey), redact.Key(e.EndKey), e.StoreID)
+}
+
+// Cause returns the annotated error, for errors.Cause.
+func (e *RegionError) Cause() error {
+	return e.Err
+}
+
+// Unwrap returns the annotated error, for errors.As and errors.Is.
+func (e *RegionError) Unwrap() error {
+	return e.Err
+}
+
+// FindRegionError returns the outermost RegionError in the chain of err.
+func FindRegionError(err error) (*RegionError, bool) {
+	found := errors.Find(err, func(e error) bool {
+		_, ok := e.(*RegionError)
+		return ok
+	})
+	if found == nil {
+		return nil, false
+	}
+	return found.(*RegionError), true
+}
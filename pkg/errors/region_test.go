@@ -0,0 +1,45 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package errors_test
+
+import (
+	goerrors "errors"
+	"testing"
+
+	. "github.com/pingcap/check"
+	"github.com/pingcap/errors"
+	"go.uber.org/multierr"
+
+	berrors "github.com/pingcap/br/pkg/errors"
+)
+
+func TestT(t *testing.T) {
+	TestingT(t)
+}
+
+var _ = Suite(&testRegionErrorSuite{})
+
+type testRegionErrorSuite struct{}
+
+func (s *testRegionErrorSuite) TestRegionError(c *C) {
+	c.Assert(berrors.WithRegion(nil, 1, nil, nil, 0), IsNil)
+
+	cause := errors.Annotate(berrors.ErrRestoreSplitNoValidKey, "no valid key")
+	err := errors.Trace(berrors.WithRegion(multierr.Append(errors.New("busy"), cause), 42, []byte("a"), []byte("b"), 7))
+	c.Assert(err, ErrorMatches, ".*busy; .*no valid key.*: region 42 \\[61, 62\\) on store 7")
+	c.Assert(berrors.Is(err, berrors.ErrRestoreSplitNoValidKey), IsTrue)
+
+	regionErr, ok := berrors.FindRegionError(err)
+	c.Assert(ok, IsTrue)
+	c.Assert(regionErr.RegionID, Equals, uint64(42))
+	c.Assert(regionErr.StartKey, DeepEquals, []byte("a"))
+	c.Assert(regionErr.EndKey, DeepEquals, []byte("b"))
+	c.Assert(regionErr.StoreID, Equals, uint64(7))
+
+	var asErr *berrors.RegionError
+	c.Assert(goerrors.As(err, &asErr), IsTrue)
+	c.Assert(asErr, Equals, regionErr)
+
+	_, ok = berrors.FindRegionError(cause)
+	c.Assert(ok, IsFalse)
+}
@@ -233,6 +233,14 @@ func (c *testClient) ScatterRegion(ctx context.Context, regionInfo *restore.Regi
 	return nil
 }
 
+func (c *testClient) ScatterRegions(ctx context.Context, regionInfos []*restore.RegionInfo) error {
+	return nil
+}
+
+func (c *testClient) TransferLeader(ctx context.Context, regionID, toStoreID uint64) error {
+	return nil
+}
+
 func (c *testClient) GetOperator(ctx context.Context, regionID uint64) (*pdpb.GetOperatorResponse, error) {
 	return &pdpb.GetOperatorResponse{
 		Header: new(pdpb.ResponseHeader),
@@ -276,6 +284,14 @@ func (c *testClient) SetStoresLabel(ctx context.Context, stores []uint64, labelK
 	return nil
 }
 
+func (c *testClient) GetRegionApproximateSize(ctx context.Context, regionID uint64) (uint64, error) {
+	return 0, nil
+}
+
+func (c *testClient) SplitRegionByApproximateSize(ctx context.Context, regionID uint64) error {
+	return nil
+}
+
 func cloneRegion(region *restore.RegionInfo) *restore.RegionInfo {
 	r := &metapb.Region{}
 	if region.Region != nil {
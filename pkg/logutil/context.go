@@ -5,6 +5,7 @@ package logutil
 import (
 	"context"
 
+	"github.com/google/uuid"
 	"github.com/pingcap/log"
 	"go.uber.org/zap"
 )
@@ -32,6 +33,14 @@ func ContextWithField(c context.Context, fields ...zap.Field) context.Context {
 	return context.WithValue(c, keyLogger, logger)
 }
 
+// ContextWithFileTaskID wraps a context with a logger carrying a new ID of the
+// file task, so the logs of every attempt of backing up or restoring the
+// files can be correlated by the ID.
+func ContextWithFileTaskID(c context.Context) (context.Context, string) {
+	id := uuid.New().String()
+	return ContextWithField(c, zap.String("file-task-id", id)), id
+}
+
 // LoggerFromContext returns the contextual logger via the context.
 // If there isn't a logger in the context, returns the global logger.
 func LoggerFromContext(c context.Context) *zap.Logger {
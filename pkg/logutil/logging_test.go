@@ -251,6 +251,23 @@ func (s *testLoggingSuite) TestContextual(c *C) {
 		"let's go!", zap.Strings("firends", []string{"firo", "seren", "black"}), zap.String("character", "solte"))
 }
 
+func (s *testLoggingSuite) TestFileTaskID(c *C) {
+	testCore, logs := observer.New(zap.InfoLevel)
+	logutil.ResetGlobalLogger(zap.New(testCore))
+
+	ctx1, id1 := logutil.ContextWithFileTaskID(context.Background())
+	ctx2, id2 := logutil.ContextWithFileTaskID(context.Background())
+	c.Assert(id1, Not(Equals), id2)
+	logutil.CL(ctx1).Info("attempt", zap.Int("attempt", 1))
+	logutil.CL(ctx2).Info("attempt", zap.Int("attempt", 1))
+	logutil.CL(ctx1).Info("attempt", zap.Int("attempt", 2))
+
+	observedLogs := logs.TakeAll()
+	checkLog(c, observedLogs[0], "attempt", zap.String("file-task-id", id1), zap.Int("attempt", 1))
+	checkLog(c, observedLogs[1], "attempt", zap.String("file-task-id", id2), zap.Int("attempt", 1))
+	checkLog(c, observedLogs[2], "attempt", zap.String("file-task-id", id1), zap.Int("attempt", 2))
+}
+
 func checkLog(c *C, actual observer.LoggedEntry, message string, fields ...zap.Field) {
 	c.Assert(message, Equals, actual.Message)
 	for i, f := range fields {
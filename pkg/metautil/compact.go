@@ -0,0 +1,526 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package metautil
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/cockroachdb/pebble/sstable"
+	"github.com/gogo/protobuf/proto"
+	"github.com/pingcap/errors"
+	backuppb "github.com/pingcap/kvproto/pkg/backup"
+	"github.com/pingcap/log"
+	"github.com/pingcap/parser/model"
+	"github.com/pingcap/tidb/tablecodec"
+	"github.com/pingcap/tidb/util/codec"
+	"go.uber.org/zap"
+
+	berrors "github.com/pingcap/br/pkg/errors"
+	"github.com/pingcap/br/pkg/logutil"
+	"github.com/pingcap/br/pkg/storage"
+)
+
+const compactedFilePrefix = "compacted"
+
+// Archive is a backup archive, i.e. the backupmeta and the storage of it.
+type Archive struct {
+	Storage storage.ExternalStorage
+	Meta    *backuppb.BackupMeta
+}
+
+// CompactReport is the result of CompactBackupChain.
+type CompactReport struct {
+	// Copied is the number of the data files copied as is.
+	Copied int
+	// Merged is the number of the data files merged into the new files.
+	Merged int
+	// Written is the number of the new data files.
+	Written int
+	// Dropped is the number of the data files of the tables which don't
+	// exist at the end of the chain.
+	Dropped int
+}
+
+// compactFile is a data file of an archive in the chain.
+type compactFile struct {
+	*backuppb.File
+	archive int
+}
+
+// CompactBackupChain merges a full backup and its incremental backups into a
+// new full backup in the target storage, which restores the same data as
+// restoring the chain one by one, so the restore doesn't need the chain any
+// more. The archives must be in the order of the backup ts.
+//
+// The data files overlapping with the files of other archives are merged into
+// new SST files, the others are copied as is. The schemas are the ones of the
+// last archive, their checksums are recomputed from the KV pairs visible at
+// the end of the chain, as the checksums of the incremental backups are of
+// the whole tables rather than the compacted data. The returned backupmeta
+// isn't saved.
+func CompactBackupChain(
+	ctx context.Context, chain []Archive, target storage.ExternalStorage,
+) (*backuppb.BackupMeta, *CompactReport, error) {
+	if err := checkBackupChain(chain); err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+	last := chain[len(chain)-1]
+	schemas, tableIDs, err := readCompactSchemas(ctx, last)
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+
+	report := &CompactReport{}
+	digests := make(map[int64]*fileDigest)
+	files := make([]compactFile, 0)
+	for i, archive := range chain {
+		err := NewMetaReader(archive.Meta, archive.Storage).readDataFiles(ctx, func(f *backuppb.File) {
+			if _, ok := tableIDs[tablecodec.DecodeTableID(f.GetStartKey())]; !ok {
+				report.Dropped++
+				return
+			}
+			files = append(files, compactFile{File: f, archive: i})
+		})
+		if err != nil {
+			return nil, nil, errors.Trace(err)
+		}
+	}
+
+	compacted := make([]*backuppb.File, 0, len(files))
+	mergedGroups := 0
+	for _, group := range groupOverlappedFiles(files) {
+		writeDigest, defaultDigest, err := digestGroup(ctx, chain, group, digests)
+		if err != nil {
+			return nil, nil, errors.Trace(err)
+		}
+		if isSingleArchive(group) {
+			for _, f := range group {
+				copied, err := copyDataFile(ctx, chain[f.archive].Storage, target, f)
+				if err != nil {
+					return nil, nil, errors.Trace(err)
+				}
+				compacted = append(compacted, copied)
+			}
+			report.Copied += len(group)
+			continue
+		}
+		mergedGroups++
+		merged, err := mergeDataFiles(ctx, chain, target, group, mergedGroups)
+		if err != nil {
+			return nil, nil, errors.Trace(err)
+		}
+		for _, f := range merged {
+			digest := writeDigest
+			if f.Cf == "default" {
+				digest = defaultDigest
+			}
+			f.TotalKvs, f.TotalBytes, f.Crc64Xor = digest.kvs, digest.bytes, digest.checksum
+		}
+		compacted = append(compacted, merged...)
+		report.Merged += len(group)
+		report.Written += len(merged)
+	}
+
+	for id, digest := range digests {
+		i, ok := tableIDs[id]
+		if !ok {
+			continue
+		}
+		s := schemas[i]
+		s.Crc64Xor ^= digest.checksum
+		s.TotalKvs += digest.kvs
+		s.TotalBytes += digest.bytes
+	}
+
+	result := proto.Clone(last.Meta).(*backuppb.BackupMeta)
+	result.StartVersion = 0
+	result.Files = compacted
+	result.Schemas = schemas
+	// The DDLs are only executed by the incremental restore.
+	result.Ddls = []byte("[]")
+	result.FileIndex = nil
+	result.SchemaIndex = nil
+	result.DdlIndexes = nil
+	result.Version = MetaV1
+	log.Info("backup chain compacted",
+		zap.Int("archives", len(chain)),
+		zap.Int("copied", report.Copied),
+		zap.Int("merged", report.Merged),
+		zap.Int("written", report.Written),
+		zap.Int("dropped", report.Dropped))
+	return result, report, nil
+}
+
+// checkBackupChain checks that the chain starts with a full backup, and each
+// incremental backup starts at the end of the previous one.
+func checkBackupChain(chain []Archive) error {
+	if len(chain) == 0 {
+		return errors.Annotate(berrors.ErrBackupInvalidChain, "no archive to compact")
+	}
+	if chain[0].Meta.StartVersion != 0 {
+		return errors.Annotatef(berrors.ErrBackupInvalidChain,
+			"the first archive is an incremental backup since %d", chain[0].Meta.StartVersion)
+	}
+	for i, archive := range chain {
+		if archive.Meta.IsRawKv {
+			return errors.Annotatef(berrors.ErrBackupInvalidChain, "archive %d is a raw kv backup", i)
+		}
+		if i == 0 {
+			continue
+		}
+		prev := chain[i-1].Meta
+		if archive.Meta.ClusterId != prev.ClusterId {
+			return errors.Annotatef(berrors.ErrBackupInvalidChain,
+				"archive %d is from cluster %d, but archive %d is from cluster %d",
+				i, archive.Meta.ClusterId, i-1, prev.ClusterId)
+		}
+		if archive.Meta.StartVersion != prev.EndVersion {
+			return errors.Annotatef(berrors.ErrBackupInvalidChain,
+				"archive %d starts at %d, but archive %d ends at %d",
+				i, archive.Meta.StartVersion, i-1, prev.EndVersion)
+		}
+	}
+	return nil
+}
+
+// readCompactSchemas reads the schemas of the archive without checksums, and
+// the indexes of the schemas by the IDs of the tables and partitions.
+func readCompactSchemas(ctx context.Context, archive Archive) ([]*backuppb.Schema, map[int64]int, error) {
+	schemas := make([]*backuppb.Schema, 0)
+	err := NewMetaReader(archive.Meta, archive.Storage).readSchemas(ctx, func(s *backuppb.Schema) {
+		schemas = append(schemas, s)
+	})
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+	tableIDs := make(map[int64]int, len(schemas))
+	for i, s := range schemas {
+		s = proto.Clone(s).(*backuppb.Schema)
+		s.Crc64Xor, s.TotalKvs, s.TotalBytes = 0, 0, 0
+		schemas[i] = s
+		if s.Table == nil {
+			continue
+		}
+		tableInfo := &model.TableInfo{}
+		if err := json.Unmarshal(s.Table, tableInfo); err != nil {
+			return nil, nil, errors.Trace(err)
+		}
+		tableIDs[tableInfo.ID] = i
+		if tableInfo.Partition != nil {
+			for _, p := range tableInfo.Partition.Definitions {
+				tableIDs[p.ID] = i
+			}
+		}
+	}
+	return schemas, tableIDs, nil
+}
+
+// groupOverlappedFiles groups the files whose ranges overlap directly or
+// transitively, the groups are in the order of the ranges.
+func groupOverlappedFiles(files []compactFile) [][]compactFile {
+	sort.SliceStable(files, func(i, j int) bool {
+		return bytes.Compare(files[i].StartKey, files[j].StartKey) < 0
+	})
+	groups := make([][]compactFile, 0)
+	var groupEnd []byte
+	for _, f := range files {
+		n := len(groups)
+		if n > 0 && (len(groupEnd) == 0 || bytes.Compare(f.StartKey, groupEnd) < 0) {
+			groups[n-1] = append(groups[n-1], f)
+		} else {
+			groups = append(groups, []compactFile{f})
+			groupEnd = f.EndKey
+			continue
+		}
+		if len(groupEnd) != 0 && (len(f.EndKey) == 0 || bytes.Compare(f.EndKey, groupEnd) > 0) {
+			groupEnd = f.EndKey
+		}
+	}
+	return groups
+}
+
+func isSingleArchive(group []compactFile) bool {
+	for _, f := range group[1:] {
+		if f.archive != group[0].archive {
+			return false
+		}
+	}
+	return true
+}
+
+// copyDataFile copies the data file into the target storage. The files of the
+// incremental backups are renamed, as they may have the same names as the
+// files of the other archives.
+func copyDataFile(
+	ctx context.Context, s, target storage.ExternalStorage, f compactFile,
+) (*backuppb.File, error) {
+	data, err := s.ReadFile(ctx, f.Name)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	copied := proto.Clone(f.File).(*backuppb.File)
+	if f.archive > 0 {
+		copied.Name = fmt.Sprintf("incr%d_%s", f.archive, f.Name)
+	}
+	if err = target.WriteFile(ctx, copied.Name, data); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return copied, nil
+}
+
+// mergeDataFiles merges the files of each column family in the group into a
+// new SST file covering the range of the group. The files of the group share
+// the sequence in their names, so they are verified together.
+func mergeDataFiles(
+	ctx context.Context, chain []Archive, target storage.ExternalStorage, group []compactFile, seq int,
+) ([]*backuppb.File, error) {
+	startKey, endKey := group[0].StartKey, group[0].EndKey
+	cfFiles := make(map[string][]compactFile)
+	cfs := make([]string, 0, 2)
+	for _, f := range group {
+		if len(endKey) != 0 && (len(f.EndKey) == 0 || bytes.Compare(f.EndKey, endKey) > 0) {
+			endKey = f.EndKey
+		}
+		cf := f.Cf
+		if cf == "" {
+			cf = cfOfFile(f.Name)
+		}
+		if _, ok := cfFiles[cf]; !ok {
+			cfs = append(cfs, cf)
+		}
+		cfFiles[cf] = append(cfFiles[cf], f)
+	}
+	sort.Strings(cfs)
+
+	merged := make([]*backuppb.File, 0, len(cfs))
+	for _, cf := range cfs {
+		name := fmt.Sprintf("%s_%d_%s%s", compactedFilePrefix, seq, cf, sstFileSuffix)
+		file, err := mergeSSTFiles(ctx, chain, target, cfFiles[cf], name)
+		if err != nil {
+			return nil, errors.Annotatef(err, "failed to merge the %s files %s", cf, name)
+		}
+		file.StartKey, file.EndKey = startKey, endKey
+		file.Cf = cf
+		merged = append(merged, file)
+		log.Debug("data files merged", zap.Int("files", len(cfFiles[cf])), logutil.File(file))
+	}
+	return merged, nil
+}
+
+// sstSource is the iterator of an SST file being merged.
+type sstSource struct {
+	iter  sstable.Iterator
+	key   *sstable.InternalKey
+	value []byte
+}
+
+// mergeSSTFiles merges the SST files into a new SST file, in which the keys
+// are in order. The keys are the MVCC keys with the commit ts, so the same
+// key in different archives is the same version, only one of them is kept.
+func mergeSSTFiles(
+	ctx context.Context, chain []Archive, target storage.ExternalStorage, files []compactFile, name string,
+) (*backuppb.File, error) {
+	sources := make([]*sstSource, 0, len(files))
+	defer func() {
+		for _, src := range sources {
+			src.iter.Close()
+		}
+	}()
+	startVersion, endVersion := files[0].StartVersion, files[0].EndVersion
+	for _, f := range files {
+		data, err := chain[f.archive].Storage.ReadFile(ctx, f.Name)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		reader, closeReader, err := openSSTData(data)
+		if err != nil {
+			return nil, errors.Annotatef(err, "failed to open %s", f.Name)
+		}
+		defer closeReader()
+		iter, err := reader.NewIter(nil, nil)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		src := &sstSource{iter: iter}
+		src.key, src.value = iter.First()
+		sources = append(sources, src)
+		if f.StartVersion < startVersion {
+			startVersion = f.StartVersion
+		}
+		if f.EndVersion > endVersion {
+			endVersion = f.EndVersion
+		}
+	}
+
+	tmp, err := os.CreateTemp("", "br-compact-*"+sstFileSuffix)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer os.Remove(tmp.Name())
+	writer := sstable.NewWriter(tmp, sstable.WriterOptions{})
+	var lastKey []byte
+	for {
+		var next *sstSource
+		for _, src := range sources {
+			if src.key != nil && (next == nil || bytes.Compare(src.key.UserKey, next.key.UserKey) < 0) {
+				next = src
+			}
+		}
+		if next == nil {
+			break
+		}
+		if lastKey == nil || !bytes.Equal(next.key.UserKey, lastKey) {
+			if err := writer.Set(next.key.UserKey, next.value); err != nil {
+				writer.Close()
+				return nil, errors.Trace(err)
+			}
+			lastKey = append(lastKey[:0], next.key.UserKey...)
+		}
+		next.key, next.value = next.iter.Next()
+	}
+	for _, src := range sources {
+		if err := src.iter.Error(); err != nil {
+			writer.Close()
+			return nil, errors.Trace(err)
+		}
+	}
+	// Closing the writer closes the temporary file.
+	if err := writer.Close(); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	data, err := os.ReadFile(tmp.Name())
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if err := target.WriteFile(ctx, name, data); err != nil {
+		return nil, errors.Trace(err)
+	}
+	checksum := sha256.Sum256(data)
+	return &backuppb.File{
+		Name:         name,
+		Sha256:       checksum[:],
+		StartVersion: startVersion,
+		EndVersion:   endVersion,
+		Size_:        uint64(len(data)),
+	}, nil
+}
+
+// digestGroup computes the digests of the write and default CF files merged
+// from the group, in the same way as verifyWriteSST does. It also adds the
+// digests of the KV pairs visible at the end of the chain to the digests of
+// their tables, that is the latest put of each key unless it's deleted later,
+// in the same way as the admin checksum does.
+func digestGroup(
+	ctx context.Context, chain []Archive, group []compactFile, tables map[int64]*fileDigest,
+) (writeDigest, defaultDigest *fileDigest, err error) {
+	values := make(map[string][]byte)
+	sources := make([]*sstSource, 0, len(group))
+	defer func() {
+		for _, src := range sources {
+			src.iter.Close()
+		}
+	}()
+	for _, f := range group {
+		data, err := chain[f.archive].Storage.ReadFile(ctx, f.Name)
+		if err != nil {
+			return nil, nil, errors.Trace(err)
+		}
+		reader, closeReader, err := openSSTData(data)
+		if err != nil {
+			return nil, nil, errors.Annotatef(err, "failed to open %s", f.Name)
+		}
+		defer closeReader()
+		iter, err := reader.NewIter(nil, nil)
+		if err != nil {
+			return nil, nil, errors.Trace(err)
+		}
+		src := &sstSource{iter: iter}
+		sources = append(sources, src)
+		cf := f.Cf
+		if cf == "" {
+			cf = cfOfFile(f.Name)
+		}
+		if cf != "default" {
+			src.key, src.value = iter.First()
+			continue
+		}
+		for k, v := iter.First(); k != nil; k, v = iter.Next() {
+			values[string(k.UserKey)] = append([]byte{}, v...)
+		}
+		if err = iter.Error(); err != nil {
+			return nil, nil, errors.Trace(err)
+		}
+	}
+
+	writeDigest, defaultDigest = &fileDigest{}, &fileDigest{}
+	var lastKey, lastUserKey []byte
+	resolved := false
+	for {
+		var next *sstSource
+		for _, src := range sources {
+			if src.key != nil && (next == nil || bytes.Compare(src.key.UserKey, next.key.UserKey) < 0) {
+				next = src
+			}
+		}
+		if next == nil {
+			break
+		}
+		k, v := next.key.UserKey, next.value
+		// The same version in different archives is counted once.
+		if lastKey == nil || !bytes.Equal(k, lastKey) {
+			lastKey = append(lastKey[:0], k...)
+			key, err := decodeSSTKey(k, false)
+			if err != nil {
+				return nil, nil, errors.Trace(err)
+			}
+			if len(k) < 8 || len(v) < 1 {
+				return nil, nil, errors.Annotatef(berrors.ErrInvalidMetaFile, "invalid write record of key %x", key)
+			}
+			startTS, value, hasShortValue, err := decodeWriteRecord(v)
+			if err != nil {
+				return nil, nil, errors.Annotatef(berrors.ErrInvalidMetaFile, "invalid write record of key %x: %v", key, err)
+			}
+			if !hasShortValue {
+				defaultKey := codec.EncodeUintDesc(append([]byte{}, k[:len(k)-8]...), startTS)
+				var ok bool
+				if value, ok = values[string(defaultKey)]; ok {
+					defaultDigest.update(key, value)
+				} else if v[0] == writeTypePut {
+					return nil, nil, errors.Annotatef(berrors.ErrInvalidMetaFile,
+						"the value of key %x at %d is missing in the default CF", key, startTS)
+				}
+			}
+			writeDigest.update(key, value)
+
+			// The versions of a key are in the descending order of the commit
+			// ts, the first put or delete decides the visible value.
+			if !bytes.Equal(key, lastUserKey) {
+				lastUserKey, resolved = key, false
+			}
+			if !resolved && (v[0] == writeTypePut || v[0] == writeTypeDelete) {
+				resolved = true
+				if v[0] == writeTypePut {
+					tableID := tablecodec.DecodeTableID(key)
+					if tables[tableID] == nil {
+						tables[tableID] = &fileDigest{}
+					}
+					tables[tableID].update(key, value)
+				}
+			}
+		}
+		next.key, next.value = next.iter.Next()
+	}
+	for _, src := range sources {
+		if err := src.iter.Error(); err != nil {
+			return nil, nil, errors.Trace(err)
+		}
+	}
+	return writeDigest, defaultDigest, nil
+}
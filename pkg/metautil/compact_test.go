@@ -0,0 +1,148 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package metautil
+
+import (
+	"context"
+	"encoding/json"
+
+	. "github.com/pingcap/check"
+	backuppb "github.com/pingcap/kvproto/pkg/backup"
+	"github.com/pingcap/parser/model"
+	"github.com/pingcap/tidb/tablecodec"
+	"github.com/pingcap/tidb/util/codec"
+
+	"github.com/pingcap/br/pkg/storage"
+)
+
+func readTestKeys(c *C, s storage.ExternalStorage, name string) [][]byte {
+	data, err := s.ReadFile(context.Background(), name)
+	c.Assert(err, IsNil)
+	reader, closeReader, err := openSSTData(data)
+	c.Assert(err, IsNil)
+	defer closeReader()
+	iter, err := reader.NewIter(nil, nil)
+	c.Assert(err, IsNil)
+	defer iter.Close()
+	keys := make([][]byte, 0)
+	for key, _ := iter.First(); key != nil; key, _ = iter.Next() {
+		keys = append(keys, append([]byte{}, key.UserKey...))
+	}
+	return keys
+}
+
+// writeRecord returns the write record of TiKV with the short value, or
+// refers to the value in the default CF if the short value is nil.
+func writeRecord(writeType byte, startTS uint64, shortValue []byte) []byte {
+	record := codec.EncodeUvarint([]byte{writeType}, startTS)
+	if shortValue != nil {
+		record = append(record, shortValuePrefix, byte(len(shortValue)))
+		record = append(record, shortValue...)
+	}
+	return record
+}
+
+func tableKey(tableID int64, suffix string) []byte {
+	return append(tablecodec.EncodeTablePrefix(tableID), suffix...)
+}
+
+func (m *metaSuit) TestCompactBackupChain(c *C) {
+	ctx := context.Background()
+	full, err := storage.NewLocalStorage(c.MkDir())
+	c.Assert(err, IsNil)
+	incr, err := storage.NewLocalStorage(c.MkDir())
+	c.Assert(err, IsNil)
+	target, err := storage.NewLocalStorage(c.MkDir())
+	c.Assert(err, IsNil)
+
+	r1, r2, r3, r4, r8 := tableKey(1, "_r1"), tableKey(1, "_r2"), tableKey(1, "_r3"), tableKey(1, "_r4"), tableKey(1, "_r8")
+	writeTestKVs(c, full, "1_write.sst",
+		mvccKey(r1, 6), writeRecord(writeTypePut, 5, []byte("a")),
+		mvccKey(r3, 6), writeRecord(writeTypePut, 5, []byte("c")))
+	writeTestKVs(c, full, "2_write.sst",
+		mvccKey(tableKey(2, "_r9"), 6), writeRecord(writeTypePut, 5, []byte("i")))
+	// r3 is deleted in the incremental backup, and its version in the full
+	// backup is backed up again.
+	writeTestKVs(c, incr, "1_write.sst",
+		mvccKey(r2, 15), writeRecord(writeTypePut, 14, []byte("b")),
+		mvccKey(r3, 15), writeRecord(writeTypeDelete, 14, nil),
+		mvccKey(r3, 6), writeRecord(writeTypePut, 5, []byte("c")),
+		mvccKey(r4, 12), writeRecord(writeTypePut, 11, nil))
+	writeTestKVs(c, incr, "1_default.sst", mvccKey(r4, 11), []byte("value4"))
+	writeTestKVs(c, incr, "3_write.sst", mvccKey(r8, 15), writeRecord(writeTypePut, 14, []byte("h")))
+	tableInfo, err := json.Marshal(&model.TableInfo{ID: 1})
+	c.Assert(err, IsNil)
+	fullMeta := &backuppb.BackupMeta{
+		ClusterId:  7,
+		EndVersion: 10,
+		Files: []*backuppb.File{
+			{Name: "1_write.sst", StartKey: r1, EndKey: tableKey(1, "_r4"), EndVersion: 10, Cf: "write"},
+			// The table 2 is dropped in the incremental backup.
+			{Name: "2_write.sst", StartKey: tableKey(2, "_r"), EndKey: tableKey(2, "_s"), EndVersion: 10, Cf: "write"},
+		},
+	}
+	incrMeta := &backuppb.BackupMeta{
+		ClusterId:    7,
+		StartVersion: 10,
+		EndVersion:   20,
+		Files: []*backuppb.File{
+			{Name: "1_write.sst", StartKey: r2, EndKey: tableKey(1, "_r5"),
+				StartVersion: 10, EndVersion: 20, Cf: "write"},
+			{Name: "1_default.sst", StartKey: r2, EndKey: tableKey(1, "_r5"),
+				StartVersion: 10, EndVersion: 20, Cf: "default"},
+			{Name: "3_write.sst", StartKey: r8, EndKey: tableKey(1, "_r9"),
+				StartVersion: 10, EndVersion: 20, Cf: "write", TotalKvs: 1},
+		},
+		Schemas: []*backuppb.Schema{{Table: tableInfo, Crc64Xor: 1, TotalKvs: 2, TotalBytes: 3}},
+		Ddls:    []byte(`[{"id":1}]`),
+	}
+	chain := []Archive{{Storage: full, Meta: fullMeta}, {Storage: incr, Meta: incrMeta}}
+
+	compacted, report, err := CompactBackupChain(ctx, chain, target)
+	c.Assert(err, IsNil)
+	c.Assert(report, DeepEquals, &CompactReport{Copied: 1, Merged: 3, Written: 2, Dropped: 1})
+	c.Assert(compacted.StartVersion, Equals, uint64(0))
+	c.Assert(compacted.EndVersion, Equals, uint64(20))
+	c.Assert(compacted.Ddls, DeepEquals, []byte("[]"))
+	c.Assert(incrMeta.Schemas[0].Crc64Xor, Equals, uint64(1))
+
+	// The checksum of the table covers the KV pairs visible at the end of
+	// the chain, the deleted r3 isn't counted.
+	visible := &fileDigest{}
+	visible.update(r1, []byte("a"))
+	visible.update(r2, []byte("b"))
+	visible.update(r4, []byte("value4"))
+	visible.update(r8, []byte("h"))
+	c.Assert(compacted.Schemas, HasLen, 1)
+	c.Assert(compacted.Schemas[0].Crc64Xor, Equals, visible.checksum)
+	c.Assert(compacted.Schemas[0].TotalKvs, Equals, uint64(4))
+	c.Assert(compacted.Schemas[0].TotalBytes, Equals, visible.bytes)
+
+	c.Assert(compacted.Files, HasLen, 3)
+	c.Assert(compacted.Files[0].Name, Equals, "compacted_1_default.sst")
+	c.Assert(compacted.Files[0].TotalKvs, Equals, uint64(1))
+	merged := compacted.Files[1]
+	c.Assert(merged.Name, Equals, "compacted_1_write.sst")
+	c.Assert(merged.StartKey, DeepEquals, r1)
+	c.Assert(merged.EndKey, DeepEquals, tableKey(1, "_r5"))
+	c.Assert(merged.StartVersion, Equals, uint64(0))
+	c.Assert(merged.EndVersion, Equals, uint64(20))
+	c.Assert(merged.TotalKvs, Equals, uint64(5))
+	c.Assert(readTestKeys(c, target, merged.Name), DeepEquals, [][]byte{
+		mvccKey(r1, 6), mvccKey(r2, 15), mvccKey(r3, 15), mvccKey(r3, 6), mvccKey(r4, 12),
+	})
+	c.Assert(compacted.Files[2].Name, Equals, "incr1_3_write.sst")
+	c.Assert(readTestKeys(c, target, "incr1_3_write.sst"), DeepEquals, [][]byte{mvccKey(r8, 15)})
+
+	// The stats of the merged files match their content.
+	verifyReport, err := VerifyDataFiles(ctx, target, compacted.Files, false, 1, func() {})
+	c.Assert(err, IsNil)
+	c.Assert(verifyReport.OK(), IsTrue)
+
+	// The incremental backup must follow the full backup.
+	incrMeta.StartVersion = 9
+	_, _, err = CompactBackupChain(ctx, chain, target)
+	c.Assert(err, ErrorMatches, ".*archive 1 starts at 9, but archive 0 ends at 10.*")
+	_, _, err = CompactBackupChain(ctx, chain[1:], target)
+	c.Assert(err, ErrorMatches, ".*the first archive is an incremental backup.*")
+}
@@ -0,0 +1,133 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package metautil
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pingcap/errors"
+	backuppb "github.com/pingcap/kvproto/pkg/backup"
+
+	berrors "github.com/pingcap/br/pkg/errors"
+)
+
+// zstdMagic is the magic number at the beginning of a zstd frame. A
+// marshaled backupmeta or metafile never starts with it in practice, since
+// the first field of them is never the 5th one with such a large value.
+var zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+// schemaBlobRefPrefix marks a schema blob which refers to an identical blob
+// appeared before in the backupmeta, it's followed by the hex sha256 of the
+// blob. A JSON blob never starts with it.
+const schemaBlobRefPrefix = "\x00blobref:"
+
+// compressMeta compresses the content of the backupmeta or a metafile.
+func compressMeta(content []byte) ([]byte, error) {
+	encoder, err := zstd.NewWriter(nil)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer encoder.Close()
+	return encoder.EncodeAll(content, make([]byte, 0, len(content)/4)), nil
+}
+
+// DecodeMetaContent returns the decompressed content of the backupmeta or a
+// metafile written with compression, or the content itself otherwise.
+func DecodeMetaContent(content []byte) ([]byte, error) {
+	if !bytes.HasPrefix(content, zstdMagic) {
+		return content, nil
+	}
+	decoder, err := zstd.NewReader(nil)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer decoder.Close()
+	decoded, err := decoder.DecodeAll(content, nil)
+	if err != nil {
+		return nil, errors.Annotate(berrors.ErrInvalidMetaFile, err.Error())
+	}
+	return decoded, nil
+}
+
+func schemaBlobHash(blob []byte) string {
+	hash := sha256.Sum256(blob)
+	return hex.EncodeToString(hash[:])
+}
+
+// schemaDeduper replaces the schema blobs identical to an earlier one with
+// references, e.g. the database info shared by all the tables of it.
+type schemaDeduper struct {
+	seen map[string]struct{}
+}
+
+func newSchemaDeduper() *schemaDeduper {
+	return &schemaDeduper{seen: make(map[string]struct{})}
+}
+
+func (d *schemaDeduper) dedupBlob(blob []byte) []byte {
+	if len(blob) == 0 {
+		return blob
+	}
+	hash := schemaBlobHash(blob)
+	if _, ok := d.seen[hash]; ok {
+		return []byte(schemaBlobRefPrefix + hash)
+	}
+	d.seen[hash] = struct{}{}
+	return blob
+}
+
+// dedup returns a copy of the schema with the duplicated blobs replaced.
+func (d *schemaDeduper) dedup(s *backuppb.Schema) *backuppb.Schema {
+	deduped := *s
+	deduped.Db = d.dedupBlob(s.Db)
+	deduped.Table = d.dedupBlob(s.Table)
+	return &deduped
+}
+
+// schemaResolver resolves the references written by schemaDeduper. The
+// schemas must be resolved in the order they were written.
+type schemaResolver struct {
+	blobs map[string][]byte
+}
+
+func newSchemaResolver() *schemaResolver {
+	return &schemaResolver{blobs: make(map[string][]byte)}
+}
+
+func (r *schemaResolver) resolveBlob(blob []byte) ([]byte, error) {
+	if !bytes.HasPrefix(blob, []byte(schemaBlobRefPrefix)) {
+		if len(blob) > 0 {
+			r.blobs[schemaBlobHash(blob)] = blob
+		}
+		return blob, nil
+	}
+	hash := string(blob[len(schemaBlobRefPrefix):])
+	resolved, ok := r.blobs[hash]
+	if !ok {
+		return nil, errors.Annotatef(berrors.ErrInvalidMetaFile, "schema blob %s not found", hash)
+	}
+	return resolved, nil
+}
+
+// resolve returns the schema itself if it has no references, or a copy of
+// it with the references resolved.
+func (r *schemaResolver) resolve(s *backuppb.Schema) (*backuppb.Schema, error) {
+	db, err := r.resolveBlob(s.Db)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	table, err := r.resolveBlob(s.Table)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if bytes.Equal(db, s.Db) && bytes.Equal(table, s.Table) {
+		return s, nil
+	}
+	resolved := *s
+	resolved.Db = db
+	resolved.Table = table
+	return &resolved, nil
+}
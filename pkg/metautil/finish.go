@@ -0,0 +1,84 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package metautil
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+
+	berrors "github.com/pingcap/br/pkg/errors"
+	"github.com/pingcap/br/pkg/storage"
+)
+
+// FinishMarkerFile is the name of the marker written after all the other
+// files of the backup, an archive without it may be partially written.
+const FinishMarkerFile = "backup.finish"
+
+// FinishMarker is the content of FinishMarkerFile.
+type FinishMarker struct {
+	// BackupMetaSha256 is the hex sha256 of the backupmeta file, which
+	// references all the other files of the archive.
+	BackupMetaSha256 string `json:"backupmeta-sha256"`
+	// FileCount is the number of the data files.
+	FileCount int `json:"file-count"`
+}
+
+// NewFinishMarker returns the marker of the archive with the content of the
+// backupmeta file.
+func NewFinishMarker(backupMetaData []byte, fileCount int) *FinishMarker {
+	hash := sha256.Sum256(backupMetaData)
+	return &FinishMarker{
+		BackupMetaSha256: hex.EncodeToString(hash[:]),
+		FileCount:        fileCount,
+	}
+}
+
+// WriteFinishMarker writes the marker into the storage, it must be the last
+// file written into the archive.
+func WriteFinishMarker(ctx context.Context, s storage.ExternalStorage, marker *FinishMarker) error {
+	data, err := json.Marshal(marker)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	log.Info("write the finish marker",
+		zap.String("backupmeta-sha256", marker.BackupMetaSha256), zap.Int("file-count", marker.FileCount))
+	return errors.Trace(s.WriteFile(ctx, FinishMarkerFile, data))
+}
+
+// CheckFinishMarker checks the archive in the storage is completely written,
+// i.e. the finish marker exists and matches the backupmeta file.
+func CheckFinishMarker(ctx context.Context, s storage.ExternalStorage) (*FinishMarker, error) {
+	exists, err := s.FileExists(ctx, FinishMarkerFile)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if !exists {
+		return nil, errors.Annotatef(berrors.ErrRestoreIncompleteBackup,
+			"%s not found, the backup may be unfinished or written by an older BR", FinishMarkerFile)
+	}
+	data, err := s.ReadFile(ctx, FinishMarkerFile)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	marker := &FinishMarker{}
+	if err = json.Unmarshal(data, marker); err != nil {
+		return nil, errors.Annotatef(berrors.ErrRestoreIncompleteBackup, "invalid %s: %s", FinishMarkerFile, err)
+	}
+	backupMetaData, err := s.ReadFile(ctx, MetaFile)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	hash := sha256.Sum256(backupMetaData)
+	if actual := hex.EncodeToString(hash[:]); actual != marker.BackupMetaSha256 {
+		return nil, errors.Annotatef(berrors.ErrRestoreIncompleteBackup,
+			"sha256 of %s is %s, but %s is expected by %s, the backupmeta may be overwritten",
+			MetaFile, actual, marker.BackupMetaSha256, FinishMarkerFile)
+	}
+	return marker, nil
+}
@@ -61,6 +61,9 @@ func walkLeafMetaFile(
 		return nil
 	}
 	for _, node := range file.MetaFiles {
+		if err := ctx.Err(); err != nil {
+			return errors.Trace(err)
+		}
 		content, err := storage.ReadFile(ctx, node.Name)
 		if err != nil {
 			return errors.Trace(err)
@@ -70,6 +73,9 @@ func walkLeafMetaFile(
 			return errors.Annotatef(berrors.ErrInvalidMetaFile,
 				"checksum mismatch expect %x, got %x", node.Sha256, checksum[:])
 		}
+		if content, err = DecodeMetaContent(content); err != nil {
+			return errors.Annotatef(err, "invalid metafile %s", node.Name)
+		}
 		child := &backuppb.MetaFile{}
 		if err = proto.Unmarshal(content, child); err != nil {
 			return errors.Trace(err)
@@ -129,17 +135,34 @@ func (reader *MetaReader) readDDLs(ctx context.Context, output func([]byte)) err
 }
 
 func (reader *MetaReader) readSchemas(ctx context.Context, output func(*backuppb.Schema)) error {
+	// The schemas may refer to the identical blobs before them.
+	resolver := newSchemaResolver()
+	var resolveErr error
+	outputSchema := func(s *backuppb.Schema) {
+		if resolveErr != nil {
+			return
+		}
+		resolved, err := resolver.resolve(s)
+		if err != nil {
+			resolveErr = err
+			return
+		}
+		output(resolved)
+	}
 	// Read backupmeta v1 metafiles.
 	for _, s := range reader.backupMeta.Schemas {
-		output(s)
+		outputSchema(s)
 	}
 	// Read backupmeta v2 metafiles.
 	outputFn := func(m *backuppb.MetaFile) {
 		for _, s := range m.Schemas {
-			output(s)
+			outputSchema(s)
 		}
 	}
-	return walkLeafMetaFile(ctx, reader.storage, reader.backupMeta.SchemaIndex, outputFn)
+	if err := walkLeafMetaFile(ctx, reader.storage, reader.backupMeta.SchemaIndex, outputFn); err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(resolveErr)
 }
 
 func (reader *MetaReader) readDataFiles(ctx context.Context, output func(*backuppb.File)) error {
@@ -156,6 +179,58 @@ func (reader *MetaReader) readDataFiles(ctx context.Context, output func(*backup
 	return walkLeafMetaFile(ctx, reader.storage, reader.backupMeta.FileIndex, outputFn)
 }
 
+// ReadDataFiles reads all the data files from the backupmeta.
+// This function is compatible with the old backupmeta.
+func (reader *MetaReader) ReadDataFiles(ctx context.Context) ([]*backuppb.File, error) {
+	files := make([]*backuppb.File, 0, len(reader.backupMeta.Files))
+	if err := reader.readDataFiles(ctx, func(f *backuppb.File) { files = append(files, f) }); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return files, nil
+}
+
+// ReadDataFilesInPages reads the data files from the backupmeta and outputs
+// them in pages of at most pageSize files, so only one page of the files and
+// one metafile are in memory at a time. It stops at the first error of output.
+func (reader *MetaReader) ReadDataFilesInPages(
+	ctx context.Context, pageSize int, output func([]*backuppb.File) error,
+) error {
+	if pageSize <= 0 {
+		return errors.Annotatef(berrors.ErrInvalidArgument, "invalid page size %d", pageSize)
+	}
+	// Cancel the walk once output fails, so the rest metafiles aren't read.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var outputErr error
+	page := make([]*backuppb.File, 0, pageSize)
+	flush := func() {
+		if outputErr != nil || len(page) == 0 {
+			return
+		}
+		if outputErr = output(page); outputErr != nil {
+			cancel()
+		}
+		page = make([]*backuppb.File, 0, pageSize)
+	}
+	err := reader.readDataFiles(ctx, func(f *backuppb.File) {
+		if outputErr != nil {
+			return
+		}
+		page = append(page, f)
+		if len(page) >= pageSize {
+			flush()
+		}
+	})
+	if outputErr != nil {
+		return errors.Trace(outputErr)
+	}
+	if err != nil {
+		return errors.Trace(err)
+	}
+	flush()
+	return errors.Trace(outputErr)
+}
+
 // ArchiveSize return the size of Archive data
 func (reader *MetaReader) ArchiveSize(ctx context.Context, files []*backuppb.File) uint64 {
 	total := uint64(0)
@@ -413,7 +488,10 @@ type MetaWriter struct {
 	storage           storage.ExternalStorage
 	metafileSizeLimit int
 	// a flag to control whether we generate v1 or v2 meta.
-	useV2Meta  bool
+	useV2Meta bool
+	// compress and deduper are set by EnableCompression.
+	compress   bool
+	deduper    *schemaDeduper
 	backupMeta *backuppb.BackupMeta
 	// used to generate MetaFile name.
 	metafileSizes  map[string]int
@@ -430,6 +508,14 @@ type MetaWriter struct {
 
 	// records the total item of in one write meta job.
 	flushedItemNum int
+	// dataFileNum is the number of the data files flushed, and
+	// backupMetaData is the content of the backupmeta file flushed last,
+	// they are recorded by the finish marker.
+	dataFileNum    int
+	backupMetaData []byte
+	// signer signs the backupmeta and the finish marker if it's set.
+	signer     Signer
+	signingKey string
 }
 
 // NewMetaWriter creates MetaWriter.
@@ -448,6 +534,18 @@ func NewMetaWriter(storage storage.ExternalStorage, metafileSizeLimit int, useV2
 	}
 }
 
+// EnableCompression makes the writer compress the backupmeta and the
+// metafiles with zstd, which cannot be read by the BR without this feature.
+// For the v2 meta, the schema blobs identical to an earlier one are also
+// replaced by references, e.g. the database info of every table. It isn't
+// applied to the v1 meta, whose schemas are read directly by some tools.
+func (writer *MetaWriter) EnableCompression() {
+	writer.compress = true
+	if writer.useV2Meta {
+		writer.deduper = newSchemaDeduper()
+	}
+}
+
 func (writer *MetaWriter) reset() {
 	writer.metasCh = make(chan interface{}, MaxBatchSize)
 	writer.errCh = make(chan error)
@@ -504,6 +602,9 @@ func (writer *MetaWriter) StartWriteMetasAsync(ctx context.Context, op AppendOp)
 					log.Info("write metas finished", zap.String("type", op.name()))
 					return
 				}
+				if op == AppendSchema && writer.deduper != nil {
+					meta = writer.deduper.dedup(meta.(*backuppb.Schema))
+				}
 				needFlush := writer.metafiles.append(meta, op)
 				if writer.useV2Meta && needFlush {
 					err := writer.flushMetasV2(ctx, op)
@@ -560,8 +661,34 @@ func (writer *MetaWriter) flushBackupMeta(ctx context.Context) error {
 		return errors.Trace(err)
 	}
 	log.Debug("backup meta", zap.Reflect("meta", writer.backupMeta))
+	if writer.compress {
+		if backupMetaData, err = compressMeta(backupMetaData); err != nil {
+			return errors.Trace(err)
+		}
+	}
 	log.Info("save backup meta", zap.Int("size", len(backupMetaData)))
-	return writer.storage.WriteFile(ctx, MetaFile, backupMetaData)
+	if err = writer.storage.WriteFile(ctx, MetaFile, backupMetaData); err != nil {
+		return errors.Trace(err)
+	}
+	writer.backupMetaData = backupMetaData
+	return nil
+}
+
+// WriteFinishMarker writes the finish marker of the backupmeta flushed last,
+// it should be called after all the other files of the backup are written.
+// The signature is written before the marker if the writer has a signer.
+func (writer *MetaWriter) WriteFinishMarker(ctx context.Context) error {
+	if writer.backupMetaData == nil {
+		return errors.Annotate(berrors.ErrInvalidMetaFile, "the backupmeta hasn't been written")
+	}
+	marker := NewFinishMarker(writer.backupMetaData, writer.dataFileNum)
+	if writer.signer != nil {
+		err := writeSignature(ctx, writer.storage, writer.signer, writer.signingKey, writer.backupMetaData, marker)
+		if err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return WriteFinishMarker(ctx, writer.storage, marker)
 }
 
 // flushMetasV1 keep the compatibility for old version.
@@ -569,6 +696,7 @@ func (writer *MetaWriter) flushMetasV1(ctx context.Context, op AppendOp) error {
 	switch op {
 	case AppendDataFile:
 		writer.backupMeta.Files = writer.metafiles.root.DataFiles
+		writer.dataFileNum = len(writer.backupMeta.Files)
 	case AppendSchema:
 		writer.backupMeta.Schemas = writer.metafiles.root.Schemas
 	case AppendDDL:
@@ -614,6 +742,11 @@ func (writer *MetaWriter) flushMetasV2(ctx context.Context, op AppendOp) error {
 	if err != nil {
 		return errors.Trace(err)
 	}
+	if writer.compress {
+		if content, err = compressMeta(content); err != nil {
+			return errors.Trace(err)
+		}
+	}
 
 	name := op.name()
 	writer.metafileSizes[name] += writer.metafiles.size
@@ -632,6 +765,7 @@ func (writer *MetaWriter) flushMetasV2(ctx context.Context, op AppendOp) error {
 
 	index.MetaFiles = append(index.MetaFiles, file)
 	writer.flushedItemNum += writer.metafiles.itemNum
+	writer.dataFileNum += len(writer.metafiles.root.DataFiles)
 	writer.metafiles = NewSizedMetaFile(writer.metafiles.sizeLimit)
 	return nil
 }
@@ -3,15 +3,19 @@
 package metautil
 
 import (
+	"bytes"
 	"context"
 	"crypto/sha256"
 	"testing"
 
+	"github.com/gogo/protobuf/proto"
 	"github.com/golang/mock/gomock"
 	. "github.com/pingcap/check"
+	"github.com/pingcap/errors"
 	backuppb "github.com/pingcap/kvproto/pkg/backup"
 
 	mockstorage "github.com/pingcap/br/pkg/mock/storage"
+	"github.com/pingcap/br/pkg/storage"
 )
 
 type metaSuit struct{}
@@ -133,3 +137,122 @@ func (m *metaSuit) TestWalkMetaFile(c *C) {
 		c.Assert(files[i], DeepEquals, expect[i])
 	}
 }
+
+func (m *metaSuit) TestReadDataFilesInPages(c *C) {
+	controller := gomock.NewController(c)
+	defer controller.Finish()
+	mockStorage := mockstorage.NewMockExternalStorage(controller)
+
+	ctx := context.Background()
+	leaf1 := &backuppb.MetaFile{DataFiles: []*backuppb.File{{Name: "f2"}, {Name: "f3"}, {Name: "f4"}}}
+	leaf2 := &backuppb.MetaFile{DataFiles: []*backuppb.File{{Name: "f5"}}}
+	meta := &backuppb.BackupMeta{
+		Files: []*backuppb.File{{Name: "f1"}},
+		FileIndex: &backuppb.MetaFile{MetaFiles: []*backuppb.File{
+			{Name: "leaf1", Sha256: checksum(leaf1)},
+			{Name: "leaf2", Sha256: checksum(leaf2)},
+		}},
+	}
+	reader := NewMetaReader(meta, mockStorage)
+
+	// The v1 files are followed by the v2 files, the last page is partial.
+	mockStorage.EXPECT().ReadFile(gomock.Any(), "leaf1").Return(leaf1.Marshal())
+	mockStorage.EXPECT().ReadFile(gomock.Any(), "leaf2").Return(leaf2.Marshal())
+	pages := make([][]string, 0, 3)
+	err := reader.ReadDataFilesInPages(ctx, 2, func(page []*backuppb.File) error {
+		names := make([]string, 0, len(page))
+		for _, f := range page {
+			names = append(names, f.Name)
+		}
+		pages = append(pages, names)
+		return nil
+	})
+	c.Assert(err, IsNil)
+	c.Assert(pages, DeepEquals, [][]string{{"f1", "f2"}, {"f3", "f4"}, {"f5"}})
+
+	// The walk stops at the first error of the output, the leaf2 isn't read.
+	mockStorage.EXPECT().ReadFile(gomock.Any(), "leaf1").Return(leaf1.Marshal())
+	outputs := 0
+	err = reader.ReadDataFilesInPages(ctx, 2, func(page []*backuppb.File) error {
+		outputs++
+		return errors.New("output failed")
+	})
+	c.Assert(err, ErrorMatches, "output failed")
+	c.Assert(outputs, Equals, 1)
+
+	err = reader.ReadDataFilesInPages(ctx, 0, func([]*backuppb.File) error { return nil })
+	c.Assert(err, ErrorMatches, ".*invalid page size 0.*")
+}
+
+func (m *metaSuit) TestCompressedMeta(c *C) {
+	ctx := context.Background()
+	s, err := storage.NewLocalStorage(c.MkDir())
+	c.Assert(err, IsNil)
+	schemas := []*backuppb.Schema{
+		{Db: []byte(`{"id":1}`), Table: []byte(`{"id":2}`), TotalKvs: 1},
+		{Db: []byte(`{"id":1}`), Table: []byte(`{"id":3}`), TotalKvs: 2},
+		{Db: []byte(`{"id":1}`), Table: []byte(`{"id":3}`), TotalKvs: 3},
+	}
+	writer := NewMetaWriter(s, MetaFileSize, true)
+	writer.EnableCompression()
+	writer.StartWriteMetasAsync(ctx, AppendSchema)
+	for _, schema := range schemas {
+		c.Assert(writer.Send(schema, AppendSchema), IsNil)
+	}
+	c.Assert(writer.FinishWriteMetas(ctx, AppendSchema), IsNil)
+
+	data, err := s.ReadFile(ctx, MetaFile)
+	c.Assert(err, IsNil)
+	c.Assert(bytes.HasPrefix(data, zstdMagic), IsTrue)
+	data, err = DecodeMetaContent(data)
+	c.Assert(err, IsNil)
+	backupMeta := &backuppb.BackupMeta{}
+	c.Assert(proto.Unmarshal(data, backupMeta), IsNil)
+	c.Assert(backupMeta.SchemaIndex.MetaFiles, HasLen, 1)
+
+	// The duplicated blobs are stored as references.
+	data, err = s.ReadFile(ctx, backupMeta.SchemaIndex.MetaFiles[0].Name)
+	c.Assert(err, IsNil)
+	data, err = DecodeMetaContent(data)
+	c.Assert(err, IsNil)
+	metaFile := &backuppb.MetaFile{}
+	c.Assert(proto.Unmarshal(data, metaFile), IsNil)
+	c.Assert(metaFile.Schemas, HasLen, 3)
+	c.Assert(bytes.HasPrefix(metaFile.Schemas[1].Db, []byte(schemaBlobRefPrefix)), IsTrue)
+	c.Assert(metaFile.Schemas[1].Table, DeepEquals, []byte(`{"id":3}`))
+	c.Assert(bytes.HasPrefix(metaFile.Schemas[2].Table, []byte(schemaBlobRefPrefix)), IsTrue)
+
+	read := make([]*backuppb.Schema, 0, len(schemas))
+	err = NewMetaReader(backupMeta, s).readSchemas(ctx, func(schema *backuppb.Schema) { read = append(read, schema) })
+	c.Assert(err, IsNil)
+	c.Assert(read, DeepEquals, schemas)
+
+	// The uncompressed content is returned as is.
+	data, err = DecodeMetaContent([]byte("plain"))
+	c.Assert(err, IsNil)
+	c.Assert(data, DeepEquals, []byte("plain"))
+}
+
+func (m *metaSuit) TestFinishMarker(c *C) {
+	ctx := context.Background()
+	s, err := storage.NewLocalStorage(c.MkDir())
+	c.Assert(err, IsNil)
+	writer := NewMetaWriter(s, MetaFileSize, true)
+	c.Assert(writer.WriteFinishMarker(ctx), NotNil)
+
+	writer.StartWriteMetasAsync(ctx, AppendDataFile)
+	c.Assert(writer.Send([]*backuppb.File{{Name: "1.sst"}, {Name: "2.sst"}}, AppendDataFile), IsNil)
+	c.Assert(writer.FinishWriteMetas(ctx, AppendDataFile), IsNil)
+	_, err = CheckFinishMarker(ctx, s)
+	c.Assert(err, ErrorMatches, ".*backup.finish not found.*")
+
+	c.Assert(writer.WriteFinishMarker(ctx), IsNil)
+	marker, err := CheckFinishMarker(ctx, s)
+	c.Assert(err, IsNil)
+	c.Assert(marker.FileCount, Equals, 2)
+
+	// The backupmeta is overwritten after the marker is written.
+	c.Assert(s.WriteFile(ctx, MetaFile, []byte("overwritten")), IsNil)
+	_, err = CheckFinishMarker(ctx, s)
+	c.Assert(err, ErrorMatches, ".*the backupmeta may be overwritten.*")
+}
@@ -0,0 +1,297 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package metautil
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"sort"
+	"strings"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/pingcap/errors"
+	backuppb "github.com/pingcap/kvproto/pkg/backup"
+	"github.com/pingcap/log"
+	"github.com/pingcap/tidb/util/codec"
+	"go.uber.org/zap"
+
+	berrors "github.com/pingcap/br/pkg/errors"
+	"github.com/pingcap/br/pkg/storage"
+)
+
+const (
+	sstFileSuffix = ".sst"
+	// dataKeyPrefix is the prefix of the keys in the SST files generated by TiKV.
+	dataKeyPrefix = 'z'
+)
+
+// RepairReport is the result of RepairBackupMeta.
+type RepairReport struct {
+	// Missing are the files in the backupmeta which are not in the storage,
+	// they are removed from the backupmeta.
+	Missing []string
+	// Recovered are the SST files in the storage which are not in the
+	// backupmeta, they are added to the backupmeta with the ranges derived
+	// from their content.
+	Recovered []string
+	// Unrecoverable are the SST files in the storage which are not in the
+	// backupmeta, and their ranges cannot be derived.
+	Unrecoverable []string
+}
+
+// Changed checks whether the backupmeta is changed by the repair.
+func (r *RepairReport) Changed() bool {
+	return len(r.Missing) > 0 || len(r.Recovered) > 0
+}
+
+// deriveFileFunc derives the file meta of the SST file from its content.
+type deriveFileFunc func(ctx context.Context, s storage.ExternalStorage, name string, meta *backuppb.BackupMeta) (*backuppb.File, error)
+
+// RepairBackupMeta reconciles the data files in the backupmeta with the SST
+// files in the storage, and returns the corrected backupmeta, which recovers
+// the archive whose backupmeta write was interrupted. The data files of the
+// returned backupmeta are all in the `Files` field.
+//
+// Note that the checksum of the tables is not updated, so the restore should
+// skip the checksum if any file is missing or recovered.
+func RepairBackupMeta(
+	ctx context.Context, s storage.ExternalStorage, meta *backuppb.BackupMeta,
+) (*backuppb.BackupMeta, *RepairReport, error) {
+	return repairBackupMeta(ctx, s, meta, deriveFileFromSST)
+}
+
+func repairBackupMeta(
+	ctx context.Context, s storage.ExternalStorage, meta *backuppb.BackupMeta, derive deriveFileFunc,
+) (*backuppb.BackupMeta, *RepairReport, error) {
+	files := make([]*backuppb.File, 0, len(meta.Files))
+	reader := NewMetaReader(meta, s)
+	if err := reader.readDataFiles(ctx, func(f *backuppb.File) { files = append(files, f) }); err != nil {
+		// The file index may be partially written, recover its files from the storage.
+		log.Warn("failed to read data files of backupmeta, recover them from the storage", zap.Error(err))
+	}
+
+	objects := make(map[string]struct{})
+	err := s.WalkDir(ctx, &storage.WalkOption{}, func(path string, size int64) error {
+		if strings.HasSuffix(path, sstFileSuffix) {
+			objects[path] = struct{}{}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+
+	report := &RepairReport{}
+	repaired := make([]*backuppb.File, 0, len(files))
+	referenced := make(map[string]struct{}, len(files))
+	for _, f := range files {
+		if _, ok := referenced[f.Name]; ok {
+			continue
+		}
+		referenced[f.Name] = struct{}{}
+		if _, ok := objects[f.Name]; !ok {
+			report.Missing = append(report.Missing, f.Name)
+			continue
+		}
+		repaired = append(repaired, f)
+	}
+
+	unreferenced := make([]string, 0)
+	for name := range objects {
+		if _, ok := referenced[name]; !ok {
+			unreferenced = append(unreferenced, name)
+		}
+	}
+	sort.Strings(unreferenced)
+	recovered := make([]*backuppb.File, 0, len(unreferenced))
+	for _, name := range unreferenced {
+		f, err := derive(ctx, s, name, meta)
+		if err != nil {
+			log.Warn("failed to recover the sst file", zap.String("file", name), zap.Error(err))
+			report.Unrecoverable = append(report.Unrecoverable, name)
+			continue
+		}
+		report.Recovered = append(report.Recovered, name)
+		recovered = append(recovered, f)
+	}
+	pairRecoveredFiles(recovered)
+	repaired = append(repaired, recovered...)
+	sort.SliceStable(repaired, func(i, j int) bool {
+		return bytes.Compare(repaired[i].StartKey, repaired[j].StartKey) < 0
+	})
+
+	result := proto.Clone(meta).(*backuppb.BackupMeta)
+	result.Files = repaired
+	result.FileIndex = nil
+	return result, report, nil
+}
+
+// WriteRepairedBackupMeta replaces the backupmeta in the storage with the
+// repaired one, and rewrites the finish marker for it. The backupmeta is
+// compressed if the original one is, and the original one is kept as
+// MetaFile+"_before_repair".
+//
+// The archive is signed again by the signer if it's not nil. Otherwise the
+// stale signature, which can't be verified any more, is deleted, and the
+// returned bool is true. Nothing is written if the storage can't delete the
+// stale signature.
+func WriteRepairedBackupMeta(
+	ctx context.Context, s storage.ExternalStorage, repaired *backuppb.BackupMeta, signer Signer, keyURI string,
+) (bool, error) {
+	signed, err := s.FileExists(ctx, SignatureFile)
+	if err != nil {
+		return false, errors.Trace(err)
+	}
+	if signed && signer == nil && !storage.CanDeleteFile(s) {
+		return false, errors.Annotatef(berrors.ErrInvalidArgument,
+			"the storage can't delete the stale %s, please provide the signing key to sign the repaired backupmeta",
+			SignatureFile)
+	}
+	origin, err := s.ReadFile(ctx, MetaFile)
+	if err != nil {
+		return false, errors.Trace(err)
+	}
+	if err = s.WriteFile(ctx, MetaFile+"_before_repair", origin); err != nil {
+		return false, errors.Trace(err)
+	}
+	data, err := proto.Marshal(repaired)
+	if err != nil {
+		return false, errors.Trace(err)
+	}
+	if bytes.HasPrefix(origin, zstdMagic) {
+		if data, err = compressMeta(data); err != nil {
+			return false, errors.Trace(err)
+		}
+	}
+	if err = s.WriteFile(ctx, MetaFile, data); err != nil {
+		return false, errors.Trace(err)
+	}
+	// The marker of the original backupmeta doesn't match the repaired one.
+	marker := NewFinishMarker(data, len(repaired.Files))
+	signatureRemoved := false
+	switch {
+	case signer != nil:
+		if err = writeSignature(ctx, s, signer, keyURI, data, marker); err != nil {
+			return false, errors.Trace(err)
+		}
+	case signed:
+		if _, err = storage.DeleteFile(ctx, s, SignatureFile); err != nil {
+			return false, errors.Trace(err)
+		}
+		signatureRemoved = true
+	}
+	return signatureRemoved, errors.Trace(WriteFinishMarker(ctx, s, marker))
+}
+
+// pairRecoveredFiles makes the write and default CF files of the same region
+// cover the same range, which is the union of their ranges, as the files of
+// a backup range are expected to be paired.
+func pairRecoveredFiles(files []*backuppb.File) {
+	groups := make(map[string][]*backuppb.File)
+	for _, f := range files {
+		prefix := f.Name
+		for _, cf := range []string{"_write" + sstFileSuffix, "_default" + sstFileSuffix} {
+			prefix = strings.TrimSuffix(prefix, cf)
+		}
+		groups[prefix] = append(groups[prefix], f)
+	}
+	for _, group := range groups {
+		startKey, endKey := group[0].StartKey, group[0].EndKey
+		for _, f := range group[1:] {
+			if bytes.Compare(f.StartKey, startKey) < 0 {
+				startKey = f.StartKey
+			}
+			if bytes.Compare(f.EndKey, endKey) > 0 {
+				endKey = f.EndKey
+			}
+		}
+		for _, f := range group {
+			f.StartKey, f.EndKey = startKey, endKey
+		}
+	}
+}
+
+// deriveFileFromSST derives the file meta from the properties and the first
+// and last keys of the SST file.
+func deriveFileFromSST(
+	ctx context.Context, s storage.ExternalStorage, name string, meta *backuppb.BackupMeta,
+) (*backuppb.File, error) {
+	// The IVs of the files encrypted by TiKV are lost along with the
+	// backupmeta, so such files are refused and left unrecoverable.
+	data, release, err := storage.ReadDataFileMapped(ctx, s, name, nil)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer release()
+	reader, closeReader, err := openSSTData(data)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer closeReader()
+	iter, err := reader.NewIter(nil, nil)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer iter.Close()
+	first, _ := iter.First()
+	if first == nil {
+		return nil, errors.Annotatef(berrors.ErrInvalidMetaFile, "sst file %s is empty", name)
+	}
+	startKey, err := decodeSSTKey(first.UserKey, meta.IsRawKv)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	last, _ := iter.Last()
+	lastKey, err := decodeSSTKey(last.UserKey, meta.IsRawKv)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if err = iter.Error(); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	checksum := sha256.Sum256(data)
+	props := reader.Properties
+	return &backuppb.File{
+		Name:         name,
+		Sha256:       checksum[:],
+		StartKey:     startKey,
+		EndKey:       append(lastKey, 0),
+		StartVersion: meta.StartVersion,
+		EndVersion:   meta.EndVersion,
+		TotalKvs:     props.NumEntries,
+		TotalBytes:   props.RawKeySize + props.RawValueSize,
+		Cf:           cfOfFile(name),
+		Size_:        uint64(len(data)),
+	}, nil
+}
+
+// decodeSSTKey decodes the key in the SST file generated by TiKV, which is
+// the data key prefix followed by the raw key, or the memcomparable encoded
+// key with a timestamp suffix for transactional data.
+func decodeSSTKey(key []byte, isRawKv bool) ([]byte, error) {
+	if len(key) == 0 || key[0] != dataKeyPrefix {
+		return nil, errors.Annotatef(berrors.ErrInvalidMetaFile, "invalid data key %x", key)
+	}
+	key = key[1:]
+	if isRawKv {
+		return key, nil
+	}
+	_, decoded, err := codec.DecodeBytes(key, nil)
+	if err != nil {
+		return nil, errors.Annotatef(berrors.ErrInvalidMetaFile, "invalid data key %x: %v", key, err)
+	}
+	return decoded, nil
+}
+
+func cfOfFile(name string) string {
+	switch {
+	case strings.HasSuffix(name, "_write"+sstFileSuffix):
+		return "write"
+	case strings.HasSuffix(name, "_default"+sstFileSuffix):
+		return "default"
+	default:
+		return ""
+	}
+}
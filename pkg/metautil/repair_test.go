@@ -0,0 +1,183 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package metautil
+
+import (
+	"bytes"
+	"context"
+
+	"github.com/gogo/protobuf/proto"
+	. "github.com/pingcap/check"
+	"github.com/pingcap/errors"
+	backuppb "github.com/pingcap/kvproto/pkg/backup"
+	"github.com/pingcap/tidb/util/codec"
+
+	"github.com/pingcap/br/pkg/storage"
+)
+
+func (m *metaSuit) TestRepairBackupMeta(c *C) {
+	ctx := context.Background()
+	s, err := storage.NewLocalStorage(c.MkDir())
+	c.Assert(err, IsNil)
+	for _, name := range []string{"1_write.sst", "2_write.sst", "2_default.sst", "3_write.sst", "lock"} {
+		c.Assert(s.WriteFile(ctx, name, []byte(name)), IsNil)
+	}
+	meta := &backuppb.BackupMeta{
+		EndVersion: 42,
+		Files: []*backuppb.File{
+			{Name: "1_write.sst", StartKey: []byte("a"), EndKey: []byte("b")},
+			{Name: "0_write.sst", StartKey: []byte("0"), EndKey: []byte("a")},
+		},
+	}
+	derive := func(ctx context.Context, s storage.ExternalStorage, name string, meta *backuppb.BackupMeta) (*backuppb.File, error) {
+		switch name {
+		case "2_write.sst":
+			return &backuppb.File{Name: name, StartKey: []byte("b"), EndKey: []byte("c1")}, nil
+		case "2_default.sst":
+			return &backuppb.File{Name: name, StartKey: []byte("b1"), EndKey: []byte("c")}, nil
+		default:
+			return nil, errors.New("unsupported compression")
+		}
+	}
+
+	repaired, report, err := repairBackupMeta(ctx, s, meta, derive)
+	c.Assert(err, IsNil)
+	c.Assert(report.Changed(), IsTrue)
+	c.Assert(report.Missing, DeepEquals, []string{"0_write.sst"})
+	c.Assert(report.Recovered, DeepEquals, []string{"2_default.sst", "2_write.sst"})
+	c.Assert(report.Unrecoverable, DeepEquals, []string{"3_write.sst"})
+
+	c.Assert(repaired.EndVersion, Equals, uint64(42))
+	c.Assert(repaired.Files, HasLen, 3)
+	c.Assert(repaired.Files[0].Name, Equals, "1_write.sst")
+	for _, f := range repaired.Files[1:] {
+		c.Assert(f.StartKey, DeepEquals, []byte("b"))
+		c.Assert(f.EndKey, DeepEquals, []byte("c1"))
+	}
+	// The origin backupmeta is not modified.
+	c.Assert(meta.Files, HasLen, 2)
+}
+
+func (m *metaSuit) TestWriteRepairedBackupMeta(c *C) {
+	ctx := context.Background()
+	s, err := storage.NewLocalStorage(c.MkDir())
+	c.Assert(err, IsNil)
+	origin, err := proto.Marshal(&backuppb.BackupMeta{EndVersion: 42})
+	c.Assert(err, IsNil)
+	origin, err = compressMeta(origin)
+	c.Assert(err, IsNil)
+	c.Assert(s.WriteFile(ctx, MetaFile, origin), IsNil)
+	c.Assert(WriteFinishMarker(ctx, s, NewFinishMarker(origin, 0)), IsNil)
+
+	repaired := &backuppb.BackupMeta{
+		EndVersion: 42,
+		Files:      []*backuppb.File{{Name: "1_write.sst"}, {Name: "1_default.sst"}},
+	}
+	removed, err := WriteRepairedBackupMeta(ctx, s, repaired, nil, "")
+	c.Assert(err, IsNil)
+	c.Assert(removed, IsFalse)
+
+	before, err := s.ReadFile(ctx, MetaFile+"_before_repair")
+	c.Assert(err, IsNil)
+	c.Assert(before, DeepEquals, origin)
+	// The repaired backupmeta keeps the compression.
+	data, err := s.ReadFile(ctx, MetaFile)
+	c.Assert(err, IsNil)
+	c.Assert(bytes.HasPrefix(data, zstdMagic), IsTrue)
+	decoded, err := DecodeMetaContent(data)
+	c.Assert(err, IsNil)
+	meta := &backuppb.BackupMeta{}
+	c.Assert(proto.Unmarshal(decoded, meta), IsNil)
+	c.Assert(meta.Files, HasLen, 2)
+	// The finish marker matches the repaired backupmeta.
+	marker, err := CheckFinishMarker(ctx, s)
+	c.Assert(err, IsNil)
+	c.Assert(marker.FileCount, Equals, 2)
+}
+
+// digestSigner signs the digests by prefixing them with the key.
+type digestSigner struct {
+	key string
+}
+
+func (s digestSigner) Algorithm() string {
+	return "digest"
+}
+
+func (s digestSigner) Sign(_ context.Context, digest []byte) ([]byte, error) {
+	return append([]byte(s.key), digest...), nil
+}
+
+func (s digestSigner) Verify(_ context.Context, _ string, digest, signature []byte) error {
+	if !bytes.Equal(signature, append([]byte(s.key), digest...)) {
+		return errors.New("invalid signature")
+	}
+	return nil
+}
+
+// noDeleteStorage is a storage which can't delete files.
+type noDeleteStorage struct {
+	storage.ExternalStorage
+}
+
+func (m *metaSuit) TestWriteRepairedBackupMetaSigned(c *C) {
+	ctx := context.Background()
+	s, err := storage.NewLocalStorage(c.MkDir())
+	c.Assert(err, IsNil)
+	signer := digestSigner{key: "key"}
+	origin, err := proto.Marshal(&backuppb.BackupMeta{EndVersion: 42})
+	c.Assert(err, IsNil)
+	c.Assert(s.WriteFile(ctx, MetaFile, origin), IsNil)
+	marker := NewFinishMarker(origin, 0)
+	c.Assert(writeSignature(ctx, s, signer, "file:key", origin, marker), IsNil)
+	c.Assert(WriteFinishMarker(ctx, s, marker), IsNil)
+	_, err = VerifySignature(ctx, s, signer)
+	c.Assert(err, IsNil)
+
+	// The repaired backupmeta is signed again by the key.
+	repaired := &backuppb.BackupMeta{EndVersion: 42, Files: []*backuppb.File{{Name: "1_write.sst"}}}
+	removed, err := WriteRepairedBackupMeta(ctx, s, repaired, signer, "file:key")
+	c.Assert(err, IsNil)
+	c.Assert(removed, IsFalse)
+	data, err := s.ReadFile(ctx, MetaFile)
+	c.Assert(err, IsNil)
+	c.Assert(bytes.HasPrefix(data, zstdMagic), IsFalse)
+	sig, err := VerifySignature(ctx, s, signer)
+	c.Assert(err, IsNil)
+	c.Assert(sig.Key, Equals, "file:key")
+
+	// Nothing is written if the stale signature can't be removed.
+	_, err = WriteRepairedBackupMeta(ctx, noDeleteStorage{s}, &backuppb.BackupMeta{}, nil, "")
+	c.Assert(err, ErrorMatches, ".*can't delete the stale.*")
+	after, err := s.ReadFile(ctx, MetaFile)
+	c.Assert(err, IsNil)
+	c.Assert(after, DeepEquals, data)
+	_, err = VerifySignature(ctx, s, signer)
+	c.Assert(err, IsNil)
+
+	// The stale signature is removed without the key.
+	repaired.Files = nil
+	removed, err = WriteRepairedBackupMeta(ctx, s, repaired, nil, "")
+	c.Assert(err, IsNil)
+	c.Assert(removed, IsTrue)
+	exists, err := s.FileExists(ctx, SignatureFile)
+	c.Assert(err, IsNil)
+	c.Assert(exists, IsFalse)
+	_, err = CheckFinishMarker(ctx, s)
+	c.Assert(err, IsNil)
+}
+
+func (m *metaSuit) TestDecodeSSTKey(c *C) {
+	key, err := decodeSSTKey([]byte("zraw"), true)
+	c.Assert(err, IsNil)
+	c.Assert(key, DeepEquals, []byte("raw"))
+
+	encoded := append([]byte{'z'}, codec.EncodeBytes(nil, []byte("txn"))...)
+	encoded = codec.EncodeUintDesc(encoded, 42)
+	key, err = decodeSSTKey(encoded, false)
+	c.Assert(err, IsNil)
+	c.Assert(key, DeepEquals, []byte("txn"))
+
+	_, err = decodeSSTKey([]byte("raw"), true)
+	c.Assert(err, ErrorMatches, ".*invalid data key.*")
+}
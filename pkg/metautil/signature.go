@@ -0,0 +1,192 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package metautil
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+
+	berrors "github.com/pingcap/br/pkg/errors"
+	"github.com/pingcap/br/pkg/storage"
+)
+
+// SignatureFile is the signature of the backupmeta, the finish marker and the
+// sidecars. It's written right before the finish marker, so the archive is
+// signed once it's completely written.
+const SignatureFile = "backupmeta.sig"
+
+// SignedSidecars are the files beside the backupmeta which decide how the
+// backup is restored, i.e. backup.ExtensionFile and backup.EncryptionFile.
+// Their digests are signed in a manifest, so none of them can be replaced,
+// added or removed unnoticed.
+var SignedSidecars = []string{"backupmeta.ext", "backupmeta.encryption"}
+
+// Signer signs the sha256 digests of the files of the archive.
+type Signer interface {
+	// Algorithm is the name of the signature algorithm, e.g. ed25519.
+	Algorithm() string
+	Sign(ctx context.Context, digest []byte) ([]byte, error)
+}
+
+// Verifier verifies the signatures made by the Signer of the same key.
+type Verifier interface {
+	// Verify returns an error if the signature of the digest is invalid.
+	Verify(ctx context.Context, algorithm string, digest, signature []byte) error
+}
+
+// Signature is the content of SignatureFile.
+type Signature struct {
+	Algorithm string `json:"algorithm"`
+	// Key is the URI of the signing key, it doesn't contain the key itself.
+	Key string `json:"key"`
+	// BackupMeta and FinishMarker are the signatures of the sha256 of the
+	// backupmeta file and of the finish marker file.
+	BackupMeta   []byte `json:"backupmeta"`
+	FinishMarker []byte `json:"finish-marker"`
+	// Sidecars maps the SignedSidecars in the archive to the hex sha256 of
+	// their contents, and SidecarsSignature is the signature of the sha256 of
+	// the JSON of the map.
+	Sidecars          map[string]string `json:"sidecars"`
+	SidecarsSignature []byte            `json:"sidecars-signature"`
+}
+
+// readSidecarManifest returns the hex sha256 of the contents of the
+// SignedSidecars in the storage, and the sha256 of the JSON of them.
+func readSidecarManifest(ctx context.Context, s storage.ExternalStorage) (map[string]string, []byte, error) {
+	manifest := make(map[string]string, len(SignedSidecars))
+	for _, name := range SignedSidecars {
+		exists, err := s.FileExists(ctx, name)
+		if err != nil {
+			return nil, nil, errors.Trace(err)
+		}
+		if !exists {
+			continue
+		}
+		content, err := s.ReadFile(ctx, name)
+		if err != nil {
+			return nil, nil, errors.Trace(err)
+		}
+		digest := sha256.Sum256(content)
+		manifest[name] = hex.EncodeToString(digest[:])
+	}
+	digest, err := manifestDigest(manifest)
+	return manifest, digest, errors.Trace(err)
+}
+
+// manifestDigest returns the sha256 of the JSON of the manifest, whose keys
+// are sorted by encoding/json.
+func manifestDigest(manifest map[string]string) ([]byte, error) {
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	digest := sha256.Sum256(data)
+	return digest[:], nil
+}
+
+// SetSigner makes the writer sign the backupmeta, the finish marker and the
+// sidecars when writing the finish marker. keyURI is recorded in the signature for
+// reference.
+func (writer *MetaWriter) SetSigner(signer Signer, keyURI string) {
+	writer.signer = signer
+	writer.signingKey = keyURI
+}
+
+// writeSignature signs the backupmeta, the finish marker and the manifest of
+// the sidecars in the storage, and writes the signature into the storage.
+func writeSignature(
+	ctx context.Context, s storage.ExternalStorage, signer Signer, keyURI string, backupMetaData []byte, marker *FinishMarker,
+) error {
+	markerData, err := json.Marshal(marker)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	sig := &Signature{Algorithm: signer.Algorithm(), Key: keyURI}
+	metaDigest := sha256.Sum256(backupMetaData)
+	if sig.BackupMeta, err = signer.Sign(ctx, metaDigest[:]); err != nil {
+		return errors.Annotatef(err, "failed to sign %s by %s", MetaFile, keyURI)
+	}
+	markerDigest := sha256.Sum256(markerData)
+	if sig.FinishMarker, err = signer.Sign(ctx, markerDigest[:]); err != nil {
+		return errors.Annotatef(err, "failed to sign %s by %s", FinishMarkerFile, keyURI)
+	}
+	var sidecarsDigest []byte
+	if sig.Sidecars, sidecarsDigest, err = readSidecarManifest(ctx, s); err != nil {
+		return errors.Trace(err)
+	}
+	if sig.SidecarsSignature, err = signer.Sign(ctx, sidecarsDigest); err != nil {
+		return errors.Annotatef(err, "failed to sign the sidecars by %s", keyURI)
+	}
+	data, err := json.Marshal(sig)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	log.Info("write the signature of the backup", zap.String("algorithm", sig.Algorithm), zap.String("key", keyURI),
+		zap.Int("sidecars", len(sig.Sidecars)))
+	return errors.Trace(s.WriteFile(ctx, SignatureFile, data))
+}
+
+// VerifySignature verifies the backupmeta, the finish marker and the sidecars
+// in the storage are signed by the key of the verifier, so the archive in a
+// shared storage isn't tampered with.
+func VerifySignature(ctx context.Context, s storage.ExternalStorage, verifier Verifier) (*Signature, error) {
+	exists, err := s.FileExists(ctx, SignatureFile)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if !exists {
+		return nil, errors.Annotatef(berrors.ErrBackupSignatureMismatch,
+			"%s not found, the backup isn't signed", SignatureFile)
+	}
+	data, err := s.ReadFile(ctx, SignatureFile)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	sig := &Signature{}
+	if err = json.Unmarshal(data, sig); err != nil {
+		return nil, errors.Annotatef(berrors.ErrBackupSignatureMismatch, "invalid %s: %s", SignatureFile, err)
+	}
+	for _, signed := range []struct {
+		name      string
+		signature []byte
+	}{
+		{name: MetaFile, signature: sig.BackupMeta},
+		{name: FinishMarkerFile, signature: sig.FinishMarker},
+	} {
+		content, err := s.ReadFile(ctx, signed.name)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		digest := sha256.Sum256(content)
+		if err = verifier.Verify(ctx, sig.Algorithm, digest[:], signed.signature); err != nil {
+			return nil, errors.Annotatef(berrors.ErrBackupSignatureMismatch,
+				"the signature of %s is invalid, the backup may be tampered with: %s", signed.name, err)
+		}
+	}
+
+	signedDigest, err := manifestDigest(sig.Sidecars)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if err = verifier.Verify(ctx, sig.Algorithm, signedDigest, sig.SidecarsSignature); err != nil {
+		return nil, errors.Annotatef(berrors.ErrBackupSignatureMismatch,
+			"the signature of the sidecars is invalid, the backup may be tampered with: %s", err)
+	}
+	manifest, _, err := readSidecarManifest(ctx, s)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	for _, name := range SignedSidecars {
+		if manifest[name] != sig.Sidecars[name] {
+			return nil, errors.Annotatef(berrors.ErrBackupSignatureMismatch,
+				"%s doesn't match the signed sidecars, the backup may be tampered with", name)
+		}
+	}
+	return sig, nil
+}
@@ -0,0 +1,351 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package metautil
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"os"
+
+	"github.com/cockroachdb/pebble/sstable"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pingcap/errors"
+
+	berrors "github.com/pingcap/br/pkg/errors"
+)
+
+// The layout of the block-based table of RocksDB, which is the format of the
+// SST files generated by TiKV.
+// See https://github.com/facebook/rocksdb/wiki/Rocksdb-BlockBasedTable-Format
+const (
+	legacyFooterLen   = 48
+	rocksDBFooterLen  = 53
+	legacyTableMagic  = 0xdb4775248b80fb57
+	rocksDBTableMagic = 0x88e241b785f4cff7
+	blockTrailerLen   = 5
+	blockHandlesLen   = 40
+
+	checksumCRC32C = 1
+
+	noCompression       = 0
+	snappyCompression   = 1
+	zstdCompression     = 7
+	zstdNotFinalization = 0x40
+)
+
+var sstCompressionNames = map[byte]string{
+	noCompression:       "none",
+	snappyCompression:   "snappy",
+	2:                   "zlib",
+	3:                   "bzip2",
+	4:                   "lz4",
+	5:                   "lz4hc",
+	6:                   "xpress",
+	zstdCompression:     "zstd",
+	zstdNotFinalization: "zstd",
+}
+
+func compressionName(compression byte) string {
+	if name, ok := sstCompressionNames[compression]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown(%d)", compression)
+}
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// openSSTData opens the content of an SST file. The sstable reader needs a
+// local file, so the content is written into a temporary file, which is
+// removed by the returned function along with closing the reader.
+func openSSTData(data []byte) (*sstable.Reader, func(), error) {
+	data, err := decodeSSTData(data)
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+	tmp, err := os.CreateTemp("", "br-sst-*"+sstFileSuffix)
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return nil, nil, errors.Trace(err)
+	}
+
+	f, err := os.Open(tmp.Name())
+	if err != nil {
+		os.Remove(tmp.Name())
+		return nil, nil, errors.Trace(err)
+	}
+	reader, err := sstable.NewReader(f, sstable.ReaderOptions{})
+	if err != nil {
+		f.Close()
+		os.Remove(tmp.Name())
+		return nil, nil, errors.Trace(err)
+	}
+	return reader, func() {
+		reader.Close()
+		os.Remove(tmp.Name())
+	}, nil
+}
+
+// decodeSSTData returns the content of the SST file which the sstable reader
+// can read. The reader only supports the uncompressed and snappy blocks, so
+// the SST file with zstd blocks, which is the default of TiKV, is rewritten
+// with the blocks uncompressed. The other compressions are refused.
+func decodeSSTData(data []byte) ([]byte, error) {
+	table, err := parseBlockBasedTable(data)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	indexType, err := table.blockCompression(table.index)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	switch indexType {
+	case snappyCompression:
+		return data, nil
+	case noCompression:
+		first, err := table.firstDataBlock()
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		dataType, err := table.blockCompression(first)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		if dataType == noCompression || dataType == snappyCompression {
+			return data, nil
+		}
+	}
+	return table.rewriteUncompressed()
+}
+
+type blockHandle struct {
+	offset, size uint64
+}
+
+func decodeBlockHandle(buf []byte) (blockHandle, int) {
+	offset, n := binary.Uvarint(buf)
+	if n <= 0 {
+		return blockHandle{}, 0
+	}
+	size, m := binary.Uvarint(buf[n:])
+	if m <= 0 {
+		return blockHandle{}, 0
+	}
+	return blockHandle{offset: offset, size: size}, n + m
+}
+
+// blockBasedTable is a minimal reader of the block-based table, which reads
+// the data blocks through the index block.
+type blockBasedTable struct {
+	data         []byte
+	checksumType byte
+	version      uint32
+	index        blockHandle
+}
+
+func corruptedSST(format string, args ...interface{}) error {
+	return errors.Annotatef(berrors.ErrInvalidMetaFile, "corrupted sst file: "+format, args...)
+}
+
+func parseBlockBasedTable(data []byte) (*blockBasedTable, error) {
+	if len(data) < legacyFooterLen {
+		return nil, corruptedSST("file too small")
+	}
+	table := &blockBasedTable{data: data}
+	var handles []byte
+	switch binary.LittleEndian.Uint64(data[len(data)-8:]) {
+	case legacyTableMagic:
+		footer := data[len(data)-legacyFooterLen:]
+		table.checksumType = checksumCRC32C
+		handles = footer[:blockHandlesLen]
+	case rocksDBTableMagic:
+		if len(data) < rocksDBFooterLen {
+			return nil, corruptedSST("file too small")
+		}
+		footer := data[len(data)-rocksDBFooterLen:]
+		table.checksumType = footer[0]
+		handles = footer[1 : 1+blockHandlesLen]
+		table.version = binary.LittleEndian.Uint32(footer[1+blockHandlesLen:])
+	default:
+		return nil, errors.Annotate(berrors.ErrUnsupportedSST, "not a block-based table")
+	}
+	// The first handle is the metaindex block, which is not needed.
+	_, n := decodeBlockHandle(handles)
+	if n == 0 {
+		return nil, corruptedSST("invalid metaindex handle")
+	}
+	if table.index, n = decodeBlockHandle(handles[n:]); n == 0 {
+		return nil, corruptedSST("invalid index handle")
+	}
+	return table, nil
+}
+
+func (t *blockBasedTable) blockCompression(h blockHandle) (byte, error) {
+	end := h.offset + h.size + blockTrailerLen
+	if end < h.offset || end > uint64(len(t.data)) {
+		return 0, corruptedSST("block [%d, %d) out of the file", h.offset, end)
+	}
+	return t.data[h.offset+h.size], nil
+}
+
+// readBlock returns the uncompressed content of the block.
+func (t *blockBasedTable) readBlock(h blockHandle, decoder *zstd.Decoder) ([]byte, error) {
+	compression, err := t.blockCompression(h)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	block := t.data[h.offset : h.offset+h.size]
+	if t.checksumType == checksumCRC32C {
+		expected := binary.LittleEndian.Uint32(t.data[h.offset+h.size+1:])
+		checksum := crc32.Update(crc32.Checksum(block, crc32cTable), crc32cTable, []byte{compression})
+		// The checksum is masked, see util/crc32c.h of RocksDB.
+		if ((checksum>>15)|(checksum<<17))+0xa282ead8 != expected {
+			return nil, corruptedSST("checksum mismatch of block at %d", h.offset)
+		}
+	}
+	switch compression {
+	case noCompression:
+		return block, nil
+	case zstdCompression, zstdNotFinalization:
+		// Since the format version 2, the compressed block is prefixed by
+		// the length of the uncompressed content.
+		if t.version >= 2 {
+			_, n := binary.Uvarint(block)
+			if n <= 0 {
+				return nil, corruptedSST("invalid length of block at %d", h.offset)
+			}
+			block = block[n:]
+		}
+		decoded, err := decoder.DecodeAll(block, nil)
+		if err != nil {
+			return nil, corruptedSST("block at %d: %v", h.offset, err)
+		}
+		return decoded, nil
+	default:
+		return nil, errors.Annotatef(berrors.ErrUnsupportedSST,
+			"%s compression of the block at %d, only the uncompressed, snappy and zstd SST files are supported",
+			compressionName(compression), h.offset)
+	}
+}
+
+// iterateBlock calls fn with the entries of the block in order. The key
+// passed to fn isn't modified later.
+func iterateBlock(block []byte, fn func(key, value []byte) error) error {
+	if len(block) < 4 {
+		return corruptedSST("block too small")
+	}
+	numRestarts := int(binary.LittleEndian.Uint32(block[len(block)-4:]))
+	end := len(block) - 4 - 4*numRestarts
+	if end < 0 {
+		return corruptedSST("invalid restart points")
+	}
+	var key []byte
+	for offset := 0; offset < end; {
+		var header [3]uint64
+		for i := range header {
+			v, n := binary.Uvarint(block[offset:end])
+			if n <= 0 {
+				return corruptedSST("invalid block entry at %d", offset)
+			}
+			header[i] = v
+			offset += n
+		}
+		shared, unshared, valueLen := header[0], header[1], header[2]
+		if shared > uint64(len(key)) || unshared+valueLen > uint64(end-offset) {
+			return corruptedSST("invalid block entry at %d", offset)
+		}
+		key = append(key[:shared:shared], block[offset:offset+int(unshared)]...)
+		offset += int(unshared)
+		value := block[offset : offset+int(valueLen)]
+		offset += int(valueLen)
+		if err := fn(key, value); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
+
+func (t *blockBasedTable) firstDataBlock() (blockHandle, error) {
+	index, err := t.readBlock(t.index, nil)
+	if err != nil {
+		return blockHandle{}, errors.Trace(err)
+	}
+	first := blockHandle{}
+	err = iterateBlock(index, func(_, value []byte) error {
+		if first.size != 0 {
+			return nil
+		}
+		var n int
+		if first, n = decodeBlockHandle(value); n == 0 {
+			return corruptedSST("invalid data block handle")
+		}
+		return nil
+	})
+	return first, errors.Trace(err)
+}
+
+// memSSTFile is the in-memory file written by the sstable writer.
+type memSSTFile struct {
+	bytes.Buffer
+}
+
+func (f *memSSTFile) Close() error { return nil }
+
+func (f *memSSTFile) Sync() error { return nil }
+
+// rewriteUncompressed rewrites the entries of the table into a new SST file
+// with the blocks uncompressed.
+func (t *blockBasedTable) rewriteUncompressed() ([]byte, error) {
+	// The index values are delta encoded since the format version 4.
+	if t.version >= 4 {
+		return nil, errors.Annotatef(berrors.ErrUnsupportedSST, "format version %d", t.version)
+	}
+	decoder, err := zstd.NewReader(nil)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer decoder.Close()
+	index, err := t.readBlock(t.index, decoder)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	out := &memSSTFile{}
+	out.Grow(len(t.data))
+	writer := sstable.NewWriter(out, sstable.WriterOptions{})
+	err = iterateBlock(index, func(_, value []byte) error {
+		h, n := decodeBlockHandle(value)
+		if n == 0 {
+			return corruptedSST("invalid data block handle")
+		}
+		block, err := t.readBlock(h, decoder)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		return iterateBlock(block, func(key, value []byte) error {
+			if len(key) < 8 {
+				return corruptedSST("invalid internal key %x", key)
+			}
+			return writer.Add(sstable.InternalKey{
+				UserKey: key[:len(key)-8],
+				Trailer: binary.LittleEndian.Uint64(key[len(key)-8:]),
+			}, value)
+		})
+	})
+	if err != nil {
+		writer.Close()
+		return nil, errors.Trace(err)
+	}
+	if err = writer.Close(); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return out.Bytes(), nil
+}
@@ -0,0 +1,133 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package metautil
+
+import (
+	"context"
+	"encoding/binary"
+	"hash/crc32"
+
+	"github.com/klauspost/compress/zstd"
+	. "github.com/pingcap/check"
+	"github.com/pingcap/errors"
+	backuppb "github.com/pingcap/kvproto/pkg/backup"
+
+	berrors "github.com/pingcap/br/pkg/errors"
+	"github.com/pingcap/br/pkg/storage"
+)
+
+func appendUvarint(buf []byte, v uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], v)
+	return append(buf, tmp[:n]...)
+}
+
+// buildTestBlock builds a block without the shared key prefixes and with
+// only one restart point.
+func buildTestBlock(kvs ...[]byte) []byte {
+	var block []byte
+	for i := 0; i < len(kvs); i += 2 {
+		block = appendUvarint(block, 0)
+		block = appendUvarint(block, uint64(len(kvs[i])))
+		block = appendUvarint(block, uint64(len(kvs[i+1])))
+		block = append(block, kvs[i]...)
+		block = append(block, kvs[i+1]...)
+	}
+	var restarts [8]byte
+	binary.LittleEndian.PutUint32(restarts[4:], 1)
+	return append(block, restarts[:]...)
+}
+
+// tikvSSTBuilder builds the SST file in the format of the ones generated by
+// TiKV, that is the block-based table of format version 2.
+type tikvSSTBuilder struct {
+	compression byte
+	data        []byte
+}
+
+func (b *tikvSSTBuilder) appendBlock(c *C, block []byte, compression byte) []byte {
+	if compression == zstdCompression {
+		encoder, err := zstd.NewWriter(nil)
+		c.Assert(err, IsNil)
+		compressed := appendUvarint(nil, uint64(len(block)))
+		block = encoder.EncodeAll(block, compressed)
+		c.Assert(encoder.Close(), IsNil)
+	}
+	handle := appendUvarint(appendUvarint(nil, uint64(len(b.data))), uint64(len(block)))
+	checksum := crc32.Update(crc32.Checksum(block, crc32cTable), crc32cTable, []byte{compression})
+	var trailer [blockTrailerLen]byte
+	trailer[0] = compression
+	binary.LittleEndian.PutUint32(trailer[1:], ((checksum>>15)|(checksum<<17))+0xa282ead8)
+	b.data = append(b.data, block...)
+	b.data = append(b.data, trailer[:]...)
+	return handle
+}
+
+func (b *tikvSSTBuilder) build(c *C, keys ...string) []byte {
+	var lastKey []byte
+	kvs := make([][]byte, 0, 2*len(keys))
+	for i, key := range keys {
+		var trailer [8]byte
+		// The sequence number is 0 and the kind is set.
+		binary.LittleEndian.PutUint64(trailer[:], 1)
+		lastKey = append([]byte{dataKeyPrefix}, key...)
+		lastKey = append(lastKey, trailer[:]...)
+		kvs = append(kvs, lastKey, []byte{byte(i)})
+	}
+	dataHandle := b.appendBlock(c, buildTestBlock(kvs...), b.compression)
+	indexHandle := b.appendBlock(c, buildTestBlock(lastKey, dataHandle), b.compression)
+	metaindexHandle := b.appendBlock(c, buildTestBlock(), noCompression)
+
+	footer := []byte{checksumCRC32C}
+	footer = append(footer, metaindexHandle...)
+	footer = append(footer, indexHandle...)
+	footer = append(footer, make([]byte, 1+blockHandlesLen-len(footer))...)
+	var tail [12]byte
+	binary.LittleEndian.PutUint32(tail[:4], 2)
+	binary.LittleEndian.PutUint64(tail[4:], rocksDBTableMagic)
+	footer = append(footer, tail[:]...)
+	return append(b.data, footer...)
+}
+
+func (m *metaSuit) TestDeriveFileFromZstdSST(c *C) {
+	ctx := context.Background()
+	s, err := storage.NewLocalStorage(c.MkDir())
+	c.Assert(err, IsNil)
+	builder := &tikvSSTBuilder{compression: zstdCompression}
+	c.Assert(s.WriteFile(ctx, "1_default.sst", builder.build(c, "a", "b", "c")), IsNil)
+
+	meta := &backuppb.BackupMeta{IsRawKv: true, EndVersion: 42}
+	file, err := deriveFileFromSST(ctx, s, "1_default.sst", meta)
+	c.Assert(err, IsNil)
+	c.Assert(file.StartKey, DeepEquals, []byte("a"))
+	c.Assert(file.EndKey, DeepEquals, []byte("c\x00"))
+	c.Assert(file.TotalKvs, Equals, uint64(3))
+	c.Assert(file.Cf, Equals, "default")
+
+	data, err := s.ReadFile(ctx, "1_default.sst")
+	c.Assert(err, IsNil)
+	reader, closeReader, err := openSSTData(data)
+	c.Assert(err, IsNil)
+	defer closeReader()
+	iter, err := reader.NewIter(nil, nil)
+	c.Assert(err, IsNil)
+	defer iter.Close()
+	values := make([]byte, 0)
+	for key, value := iter.First(); key != nil; key, value = iter.Next() {
+		values = append(values, value...)
+	}
+	c.Assert(values, DeepEquals, []byte{0, 1, 2})
+}
+
+func (m *metaSuit) TestOpenUnsupportedSST(c *C) {
+	builder := &tikvSSTBuilder{compression: 4}
+	_, _, err := openSSTData(builder.build(c, "a"))
+	c.Assert(errors.Cause(err), Equals, berrors.ErrUnsupportedSST)
+	c.Assert(err, ErrorMatches, ".*lz4 compression.*")
+
+	data := (&tikvSSTBuilder{compression: zstdCompression}).build(c, "a")
+	// Corrupt the data block.
+	data[0] ^= 0xff
+	_, _, err = openSSTData(data)
+	c.Assert(errors.Cause(err), Equals, berrors.ErrInvalidMetaFile)
+}
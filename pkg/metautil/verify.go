@@ -0,0 +1,428 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package metautil
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"hash/crc64"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/cockroachdb/pebble/sstable"
+	"github.com/pingcap/errors"
+	backuppb "github.com/pingcap/kvproto/pkg/backup"
+	"github.com/pingcap/log"
+	"github.com/pingcap/tidb/util/codec"
+	"go.uber.org/zap"
+	"golang.org/x/sync/errgroup"
+
+	berrors "github.com/pingcap/br/pkg/errors"
+	"github.com/pingcap/br/pkg/storage"
+)
+
+const (
+	// writeTypePut is the type of the write record of a put.
+	writeTypePut = 'P'
+	// writeTypeDelete is the type of the write record of a delete.
+	writeTypeDelete = 'D'
+	// shortValuePrefix is the flag of the value inlined in a write record.
+	shortValuePrefix = 'v'
+)
+
+var crc64Table = crc64.MakeTable(crc64.ECMA)
+
+// CorruptedFile is a data file whose content doesn't match the backupmeta.
+type CorruptedFile struct {
+	Name   string
+	Reason string
+}
+
+// VerifyReport is the result of VerifyDataFiles.
+type VerifyReport struct {
+	// Verified is the number of the files matching the backupmeta.
+	Verified int
+	// Missing are the files in the backupmeta which are not in the storage.
+	Missing []string
+	// Corrupted are the files whose content doesn't match the backupmeta.
+	Corrupted []CorruptedFile
+	// ChecksumOnly are the files whose content can't be decoded, e.g. the SST
+	// files in an unsupported compression, and the files verified along with
+	// them. Only their sizes and sha256 are verified, so they aren't counted
+	// as verified, nor as corrupted.
+	ChecksumOnly []string
+}
+
+// OK checks whether all the files match the backupmeta.
+func (r *VerifyReport) OK() bool {
+	return len(r.Missing) == 0 && len(r.Corrupted) == 0
+}
+
+// VerifyDataFiles reads the data files of the backupmeta in the storage, and
+// checks their sizes, sha256, key ranges, KV counts, bytes and CRC64 against
+// the backupmeta, which finds the corrupted or missing files without
+// restoring them. The write and default CF files of a range are verified
+// together, as the values not inlined in the write CF are in the default CF.
+// The files which can't be decoded are only checked by their sizes and sha256,
+// see VerifyReport.ChecksumOnly. onFile is called after each file is verified.
+func VerifyDataFiles(
+	ctx context.Context, s storage.ExternalStorage, files []*backuppb.File, isRawKv bool,
+	concurrency uint, onFile func(),
+) (*VerifyReport, error) {
+	groups := groupFilesByRange(files)
+
+	report := &VerifyReport{}
+	var mu sync.Mutex
+	if concurrency == 0 {
+		concurrency = 1
+	}
+	sem := make(chan struct{}, concurrency)
+	eg, ectx := errgroup.WithContext(ctx)
+	for _, group := range groups {
+		group := group
+		select {
+		case sem <- struct{}{}:
+		case <-ectx.Done():
+		}
+		if ectx.Err() != nil {
+			break
+		}
+		eg.Go(func() error {
+			defer func() { <-sem }()
+			missing, corrupted, checksumOnly, err := verifyFileGroup(ectx, s, group, isRawKv)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			mu.Lock()
+			report.Missing = append(report.Missing, missing...)
+			report.Corrupted = append(report.Corrupted, corrupted...)
+			report.ChecksumOnly = append(report.ChecksumOnly, checksumOnly...)
+			report.Verified += len(group) - len(missing) - len(corrupted) - len(checksumOnly)
+			mu.Unlock()
+			for range group {
+				onFile()
+			}
+			return nil
+		})
+	}
+	if err := eg.Wait(); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, errors.Trace(err)
+	}
+	sort.Strings(report.Missing)
+	sort.Strings(report.ChecksumOnly)
+	sort.Slice(report.Corrupted, func(i, j int) bool { return report.Corrupted[i].Name < report.Corrupted[j].Name })
+	return report, nil
+}
+
+// groupFilesByRange groups the write and default CF files of the same range
+// by their names, in the order of the files.
+func groupFilesByRange(files []*backuppb.File) [][]*backuppb.File {
+	index := make(map[string]int)
+	groups := make([][]*backuppb.File, 0, len(files))
+	for _, f := range files {
+		prefix := f.Name
+		for _, cf := range []string{"_write" + sstFileSuffix, "_default" + sstFileSuffix} {
+			prefix = strings.TrimSuffix(prefix, cf)
+		}
+		i, ok := index[prefix]
+		if !ok {
+			i = len(groups)
+			index[prefix] = i
+			groups = append(groups, nil)
+		}
+		groups[i] = append(groups[i], f)
+	}
+	return groups
+}
+
+// fileDigest is the KV count, bytes and CRC64 of the KV pairs of a file,
+// computed in the same way as TiKV does when backing up.
+type fileDigest struct {
+	kvs      uint64
+	bytes    uint64
+	checksum uint64
+}
+
+func (d *fileDigest) update(key, value []byte) {
+	sum := crc64.Update(0, crc64Table, key)
+	sum = crc64.Update(sum, crc64Table, value)
+	d.kvs++
+	d.bytes += uint64(len(key) + len(value))
+	d.checksum ^= sum
+}
+
+// matches checks the digest against the file. The bytes and CRC64 of the
+// file are zero if the backup skipped the checksum, they are not verified
+// then.
+func (d *fileDigest) matches(f *backuppb.File) string {
+	if d.kvs != f.GetTotalKvs() {
+		return fmt.Sprintf("total kvs %d mismatches %d in backupmeta", d.kvs, f.GetTotalKvs())
+	}
+	if f.GetCrc64Xor() == 0 && f.GetTotalBytes() == 0 {
+		return ""
+	}
+	if d.bytes != f.GetTotalBytes() {
+		return fmt.Sprintf("total bytes %d mismatches %d in backupmeta", d.bytes, f.GetTotalBytes())
+	}
+	if d.checksum != f.GetCrc64Xor() {
+		return fmt.Sprintf("crc64xor %d mismatches %d in backupmeta", d.checksum, f.GetCrc64Xor())
+	}
+	return ""
+}
+
+// sstContent is the content of a data file read from the storage.
+type sstContent struct {
+	file   *backuppb.File
+	reader *sstable.Reader
+}
+
+// verifyFileGroup verifies the files of the same range, it returns the
+// missing and corrupted files, and the files only verified by their sizes and
+// sha256.
+func verifyFileGroup(
+	ctx context.Context, s storage.ExternalStorage, group []*backuppb.File, isRawKv bool,
+) (missing []string, corrupted []CorruptedFile, checksumOnly []string, err error) {
+	corrupt := func(f *backuppb.File, format string, args ...interface{}) {
+		reason := fmt.Sprintf(format, args...)
+		log.Warn("corrupted data file", zap.String("file", f.GetName()), zap.String("reason", reason))
+		corrupted = append(corrupted, CorruptedFile{Name: f.GetName(), Reason: reason})
+	}
+
+	contents := make([]sstContent, 0, len(group))
+	for _, f := range group {
+		exists, err := s.FileExists(ctx, f.GetName())
+		if err != nil {
+			return nil, nil, nil, errors.Trace(err)
+		}
+		if !exists {
+			log.Warn("missing data file", zap.String("file", f.GetName()))
+			missing = append(missing, f.GetName())
+			continue
+		}
+		data, release, err := storage.ReadDataFileMapped(ctx, s, f.GetName(), f.GetCipherIv())
+		if berrors.Is(err, berrors.ErrStorageDecryption) {
+			corrupt(f, "%v", err)
+			continue
+		}
+		if err != nil {
+			return nil, nil, nil, errors.Trace(err)
+		}
+		if f.GetSize_() != 0 && uint64(len(data)) != f.GetSize_() {
+			release()
+			corrupt(f, "size %d mismatches %d in backupmeta", len(data), f.GetSize_())
+			continue
+		}
+		if len(f.GetSha256()) > 0 {
+			if checksum := sha256.Sum256(data); !bytes.Equal(checksum[:], f.GetSha256()) {
+				release()
+				corrupt(f, "sha256 %x mismatches %x in backupmeta", checksum, f.GetSha256())
+				continue
+			}
+		}
+		reader, closeReader, err := openSSTData(data)
+		release()
+		if errors.Cause(err) == berrors.ErrUnsupportedSST {
+			log.Warn("cannot decode the data file, only its size and sha256 are verified",
+				zap.String("file", f.GetName()), zap.Error(err))
+			checksumOnly = append(checksumOnly, f.GetName())
+			continue
+		}
+		if err != nil {
+			corrupt(f, "failed to open the sst: %v", err)
+			continue
+		}
+		defer closeReader()
+		contents = append(contents, sstContent{file: f, reader: reader})
+	}
+
+	if isRawKv {
+		for _, c := range contents {
+			if reason := verifyRawSST(c); reason != "" {
+				corrupt(c.file, "%s", reason)
+			}
+		}
+		return missing, corrupted, checksumOnly, nil
+	}
+	// The files of the range are verified together, so none of them can be
+	// verified by the content if any of them can't be decoded.
+	if len(checksumOnly) > 0 {
+		for _, c := range contents {
+			checksumOnly = append(checksumOnly, c.file.GetName())
+		}
+		return missing, corrupted, checksumOnly, nil
+	}
+
+	var writeCF, defaultCF *sstContent
+	for i := range contents {
+		switch cfOfFile(contents[i].file.GetName()) {
+		case "write":
+			writeCF = &contents[i]
+		case "default":
+			defaultCF = &contents[i]
+		}
+	}
+	if writeCF == nil {
+		// The default CF file is verified along with the write CF file, and
+		// it can't be restored without the write CF file either.
+		if defaultCF != nil {
+			corrupt(defaultCF.file, "the write CF file of the range is missing or corrupted")
+		}
+		return missing, corrupted, checksumOnly, nil
+	}
+	var values map[string][]byte
+	if defaultCF != nil {
+		var reason string
+		if values, reason = loadDefaultSST(*defaultCF); reason != "" {
+			corrupt(defaultCF.file, "%s", reason)
+			defaultCF = nil
+		}
+	}
+	writeDigest, defaultDigest, reason := verifyWriteSST(*writeCF, values)
+	if reason != "" {
+		corrupt(writeCF.file, "%s", reason)
+		return missing, corrupted, checksumOnly, nil
+	}
+	if reason = writeDigest.matches(writeCF.file); reason != "" {
+		corrupt(writeCF.file, "%s", reason)
+	}
+	if defaultCF != nil {
+		f := defaultCF.file
+		// Some versions of TiKV don't count the KV pairs in the default CF
+		// file, whose values are counted in the write CF file.
+		counted := f.GetTotalKvs() != 0 || f.GetCrc64Xor() != 0
+		if reason = defaultDigest.matches(f); counted && reason != "" {
+			corrupt(f, "%s", reason)
+		} else if defaultDigest.kvs != uint64(len(values)) {
+			corrupt(f, "%d values are not referenced by the write CF", uint64(len(values))-defaultDigest.kvs)
+		}
+	}
+	return missing, corrupted, checksumOnly, nil
+}
+
+// checkKeyInFile checks the key decoded from the SST is in the range of the
+// file. The end key of the file is exclusive.
+func checkKeyInFile(f *backuppb.File, key []byte) string {
+	if bytes.Compare(key, f.GetStartKey()) < 0 ||
+		(len(f.GetEndKey()) > 0 && bytes.Compare(key, f.GetEndKey()) >= 0) {
+		return fmt.Sprintf("key %x is out of the range [%x, %x)", key, f.GetStartKey(), f.GetEndKey())
+	}
+	return ""
+}
+
+func verifyRawSST(c sstContent) string {
+	iter, err := c.reader.NewIter(nil, nil)
+	if err != nil {
+		return fmt.Sprintf("failed to read the sst: %v", err)
+	}
+	defer iter.Close()
+	digest := &fileDigest{}
+	for k, v := iter.First(); k != nil; k, v = iter.Next() {
+		key, err := decodeSSTKey(k.UserKey, true)
+		if err != nil {
+			return err.Error()
+		}
+		if reason := checkKeyInFile(c.file, key); reason != "" {
+			return reason
+		}
+		digest.update(key, v)
+	}
+	if err = iter.Error(); err != nil {
+		return fmt.Sprintf("failed to read the sst: %v", err)
+	}
+	return digest.matches(c.file)
+}
+
+// loadDefaultSST reads the values in the default CF file, by the MVCC keys
+// with the start ts.
+func loadDefaultSST(c sstContent) (map[string][]byte, string) {
+	iter, err := c.reader.NewIter(nil, nil)
+	if err != nil {
+		return nil, fmt.Sprintf("failed to read the sst: %v", err)
+	}
+	defer iter.Close()
+	values := make(map[string][]byte)
+	for k, v := iter.First(); k != nil; k, v = iter.Next() {
+		key, err := decodeSSTKey(k.UserKey, false)
+		if err != nil {
+			return nil, err.Error()
+		}
+		if reason := checkKeyInFile(c.file, key); reason != "" {
+			return nil, reason
+		}
+		values[string(k.UserKey)] = append([]byte{}, v...)
+	}
+	if err = iter.Error(); err != nil {
+		return nil, fmt.Sprintf("failed to read the sst: %v", err)
+	}
+	return values, ""
+}
+
+// verifyWriteSST computes the digest of the KV pairs in the write CF file,
+// whose values are inlined in the write records or in the default CF. It
+// also returns the digest of the KV pairs whose values are in the default CF.
+func verifyWriteSST(c sstContent, values map[string][]byte) (writeDigest, defaultDigest *fileDigest, reason string) {
+	iter, err := c.reader.NewIter(nil, nil)
+	if err != nil {
+		return nil, nil, fmt.Sprintf("failed to read the sst: %v", err)
+	}
+	defer iter.Close()
+	writeDigest, defaultDigest = &fileDigest{}, &fileDigest{}
+	for k, v := iter.First(); k != nil; k, v = iter.Next() {
+		key, err := decodeSSTKey(k.UserKey, false)
+		if err != nil {
+			return nil, nil, err.Error()
+		}
+		if msg := checkKeyInFile(c.file, key); msg != "" {
+			return nil, nil, msg
+		}
+		if len(k.UserKey) < 8 || len(v) < 1 {
+			return nil, nil, fmt.Sprintf("invalid write record of key %x", key)
+		}
+		writeType := v[0]
+		startTS, shortValue, hasShortValue, err := decodeWriteRecord(v)
+		if err != nil {
+			return nil, nil, fmt.Sprintf("invalid write record of key %x: %v", key, err)
+		}
+		if hasShortValue {
+			writeDigest.update(key, shortValue)
+			continue
+		}
+		defaultKey := codec.EncodeUintDesc(append([]byte{}, k.UserKey[:len(k.UserKey)-8]...), startTS)
+		value, ok := values[string(defaultKey)]
+		if !ok {
+			if writeType == writeTypePut {
+				return nil, nil, fmt.Sprintf("the value of key %x at %d is missing in the default CF", key, startTS)
+			}
+			writeDigest.update(key, nil)
+			continue
+		}
+		writeDigest.update(key, value)
+		defaultDigest.update(key, value)
+	}
+	if err = iter.Error(); err != nil {
+		return nil, nil, fmt.Sprintf("failed to read the sst: %v", err)
+	}
+	return writeDigest, defaultDigest, ""
+}
+
+// decodeWriteRecord decodes the write record of TiKV, which is the write
+// type, the start ts in varint, and then the optional short value.
+func decodeWriteRecord(v []byte) (startTS uint64, shortValue []byte, hasShortValue bool, err error) {
+	rest, startTS, err := codec.DecodeUvarint(v[1:])
+	if err != nil {
+		return 0, nil, false, errors.Trace(err)
+	}
+	if len(rest) == 0 || rest[0] != shortValuePrefix {
+		return startTS, nil, false, nil
+	}
+	if len(rest) < 2 || len(rest) < 2+int(rest[1]) {
+		return 0, nil, false, errors.Errorf("short value of length %d is truncated", len(rest))
+	}
+	return startTS, rest[2 : 2+int(rest[1])], true, nil
+}
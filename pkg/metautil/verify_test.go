@@ -0,0 +1,141 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package metautil
+
+import (
+	"context"
+	"crypto/sha256"
+	"os"
+
+	"github.com/cockroachdb/pebble/sstable"
+	. "github.com/pingcap/check"
+	backuppb "github.com/pingcap/kvproto/pkg/backup"
+	"github.com/pingcap/tidb/util/codec"
+
+	"github.com/pingcap/br/pkg/storage"
+)
+
+// mvccKey returns the key of the key at the ts in the SST files of TiKV.
+func mvccKey(key []byte, ts uint64) []byte {
+	return codec.EncodeUintDesc(append([]byte{dataKeyPrefix}, codec.EncodeBytes(nil, key)...), ts)
+}
+
+func writeTestKVs(c *C, s storage.ExternalStorage, name string, kvs ...[]byte) {
+	path := c.MkDir() + "/" + name
+	f, err := os.Create(path)
+	c.Assert(err, IsNil)
+	writer := sstable.NewWriter(f, sstable.WriterOptions{})
+	for i := 0; i < len(kvs); i += 2 {
+		c.Assert(writer.Set(kvs[i], kvs[i+1]), IsNil)
+	}
+	c.Assert(writer.Close(), IsNil)
+	data, err := os.ReadFile(path)
+	c.Assert(err, IsNil)
+	c.Assert(s.WriteFile(context.Background(), name, data), IsNil)
+}
+
+func (m *metaSuit) TestVerifyDataFiles(c *C) {
+	ctx := context.Background()
+	s, err := storage.NewLocalStorage(c.MkDir())
+	c.Assert(err, IsNil)
+
+	// k1 has a short value, the value of k2 is in the default CF.
+	k1, k2 := tableKey(1, "_r1"), tableKey(1, "_r2")
+	shortValue := append(codec.EncodeUvarint([]byte{writeTypePut}, 5), shortValuePrefix, 2, 'v', '1')
+	writeTestKVs(c, s, "1_write.sst",
+		mvccKey(k1, 6), shortValue,
+		mvccKey(k2, 8), codec.EncodeUvarint([]byte{writeTypePut}, 7))
+	writeTestKVs(c, s, "1_default.sst", mvccKey(k2, 7), []byte("value2"))
+
+	digest := &fileDigest{}
+	digest.update(k1, []byte("v1"))
+	digest.update(k2, []byte("value2"))
+	files := []*backuppb.File{
+		{Name: "1_write.sst", StartKey: tableKey(1, "_r"), EndKey: tableKey(1, "_s"),
+			TotalKvs: digest.kvs, TotalBytes: digest.bytes, Crc64Xor: digest.checksum, Cf: "write"},
+		{Name: "1_default.sst", StartKey: tableKey(1, "_r"), EndKey: tableKey(1, "_s"), Cf: "default"},
+	}
+	verified := 0
+	report, err := VerifyDataFiles(ctx, s, files, false, 2, func() { verified++ })
+	c.Assert(err, IsNil)
+	c.Assert(report.OK(), IsTrue)
+	c.Assert(report.Verified, Equals, 2)
+	c.Assert(verified, Equals, 2)
+
+	// The mismatched checksum and the keys out of the range are reported.
+	files[0].Crc64Xor++
+	files[1].EndKey = tableKey(1, "_r2")
+	report, err = VerifyDataFiles(ctx, s, files, false, 1, func() {})
+	c.Assert(err, IsNil)
+	c.Assert(report.OK(), IsFalse)
+	c.Assert(report.Corrupted, HasLen, 2)
+	c.Assert(report.Corrupted[0].Name, Equals, "1_default.sst")
+	c.Assert(report.Corrupted[0].Reason, Matches, "key .* is out of the range .*")
+	c.Assert(report.Corrupted[1].Name, Equals, "1_write.sst")
+	c.Assert(report.Corrupted[1].Reason, Matches, "the value of key .* is missing in the default CF")
+
+	// The missing files are reported.
+	files[0].Crc64Xor--
+	files[1].EndKey = tableKey(1, "_s")
+	files = append(files, &backuppb.File{Name: "2_write.sst", StartKey: tableKey(2, "_r"), Cf: "write"})
+	report, err = VerifyDataFiles(ctx, s, files, false, 1, func() {})
+	c.Assert(err, IsNil)
+	c.Assert(report.Missing, DeepEquals, []string{"2_write.sst"})
+	c.Assert(report.Corrupted, HasLen, 0)
+	c.Assert(report.Verified, Equals, 2)
+
+	// The raw files are verified alone.
+	writeTestKVs(c, s, "3_default.sst", []byte("zk1"), []byte("v1"))
+	digest = &fileDigest{}
+	digest.update([]byte("k1"), []byte("v1"))
+	raw := []*backuppb.File{{Name: "3_default.sst", StartKey: []byte("k"), TotalKvs: 2, Cf: "default"}}
+	report, err = VerifyDataFiles(ctx, s, raw, true, 1, func() {})
+	c.Assert(err, IsNil)
+	c.Assert(report.Corrupted, HasLen, 1)
+	c.Assert(report.Corrupted[0].Reason, Equals, "total kvs 1 mismatches 2 in backupmeta")
+	raw[0].TotalKvs = 1
+	raw[0].TotalBytes, raw[0].Crc64Xor = digest.bytes, digest.checksum
+	report, err = VerifyDataFiles(ctx, s, raw, true, 1, func() {})
+	c.Assert(err, IsNil)
+	c.Assert(report.OK(), IsTrue)
+}
+
+func (m *metaSuit) TestVerifyUndecodableFiles(c *C) {
+	ctx := context.Background()
+	s, err := storage.NewLocalStorage(c.MkDir())
+	c.Assert(err, IsNil)
+
+	// The zstd files of TiKV are verified by the content.
+	zstdData := (&tikvSSTBuilder{compression: zstdCompression}).build(c, "k1")
+	c.Assert(s.WriteFile(ctx, "1_default.sst", zstdData), IsNil)
+	// The lz4 write CF file and its default CF file are only verified by
+	// their sizes and sha256.
+	lz4Data := (&tikvSSTBuilder{compression: 4}).build(c, "k2")
+	c.Assert(s.WriteFile(ctx, "2_write.sst", lz4Data), IsNil)
+	writeTestKVs(c, s, "2_default.sst", []byte("zk2"), []byte("v2"))
+	checksum := sha256.Sum256(lz4Data)
+	files := []*backuppb.File{
+		{Name: "1_default.sst", StartKey: []byte("k1"), TotalKvs: 1, Cf: "default"},
+		{Name: "2_write.sst", StartKey: []byte("k2"), Sha256: checksum[:], Size_: uint64(len(lz4Data)), Cf: "write"},
+		{Name: "2_default.sst", StartKey: []byte("k2"), Cf: "default"},
+	}
+	report, err := VerifyDataFiles(ctx, s, files[:1], true, 1, func() {})
+	c.Assert(err, IsNil)
+	c.Assert(report.OK(), IsTrue)
+	c.Assert(report.Verified, Equals, 1)
+
+	report, err = VerifyDataFiles(ctx, s, files[1:], false, 1, func() {})
+	c.Assert(err, IsNil)
+	c.Assert(report.OK(), IsTrue)
+	c.Assert(report.Verified, Equals, 0)
+	c.Assert(report.ChecksumOnly, DeepEquals, []string{"2_default.sst", "2_write.sst"})
+
+	// The sha256 is still verified.
+	files[1].Sha256[0]++
+	report, err = VerifyDataFiles(ctx, s, files[1:], false, 1, func() {})
+	c.Assert(err, IsNil)
+	c.Assert(report.Corrupted, HasLen, 2)
+	c.Assert(report.Corrupted[1].Name, Equals, "2_write.sst")
+	c.Assert(report.Corrupted[1].Reason, Matches, "sha256 .* mismatches .*")
+	c.Assert(report.ChecksumOnly, HasLen, 0)
+}
@@ -0,0 +1,102 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package pdutil
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+
+	berrors "github.com/pingcap/br/pkg/errors"
+	"github.com/pingcap/br/pkg/httputil"
+)
+
+const (
+	// SRVScheme is the scheme of the PD address discovered by the DNS SRV
+	// records, e.g. srv://_pd._tcp.cluster.local.
+	SRVScheme = "srv://"
+
+	defaultPDPort = "2379"
+)
+
+// lookupSRV looks up the DNS SRV records of the name, it's a variable for
+// testing.
+var lookupSRV = func(ctx context.Context, name string) ([]*net.SRV, error) {
+	_, addrs, err := net.DefaultResolver.LookupSRV(ctx, "", "", name)
+	return addrs, err
+}
+
+// normalizeAddr adds the brackets and the default port to a bare IPv6
+// literal, e.g. `fd00::1` becomes `[fd00::1]:2379`.
+func normalizeAddr(addr string) string {
+	scheme := ""
+	for _, s := range []string{"http://", "https://"} {
+		if strings.HasPrefix(addr, s) {
+			scheme, addr = s, strings.TrimPrefix(addr, s)
+			break
+		}
+	}
+	ip := net.ParseIP(strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]"))
+	if ip != nil && ip.To4() == nil {
+		addr = net.JoinHostPort(ip.String(), defaultPDPort)
+	}
+	return scheme + addr
+}
+
+// DiscoverAddrs resolves the PD addresses. The IPv6 literals are normalized,
+// and the `srv://` addresses are replaced by the healthy endpoints of their
+// DNS SRV records.
+func DiscoverAddrs(ctx context.Context, addrs []string, tlsConf *tls.Config) ([]string, error) {
+	cli := httputil.NewClient(tlsConf)
+	scheme := "http://"
+	if tlsConf != nil {
+		scheme = "https://"
+	}
+	return discoverAddrs(ctx, addrs, func(ctx context.Context, addr string) error {
+		_, err := pdRequest(ctx, scheme+addr, clusterVersionPrefix, cli, http.MethodGet, nil)
+		return errors.Trace(err)
+	})
+}
+
+func discoverAddrs(
+	ctx context.Context, addrs []string, healthCheck func(context.Context, string) error,
+) ([]string, error) {
+	resolved := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		addr = strings.TrimSpace(addr)
+		if !strings.HasPrefix(addr, SRVScheme) {
+			resolved = append(resolved, normalizeAddr(addr))
+			continue
+		}
+
+		name := strings.TrimPrefix(addr, SRVScheme)
+		records, err := lookupSRV(ctx, name)
+		if err != nil {
+			return nil, errors.Annotatef(berrors.ErrInvalidArgument, "failed to look up SRV records of %s: %v", name, err)
+		}
+		healthy := 0
+		for _, record := range records {
+			endpoint := net.JoinHostPort(strings.TrimSuffix(record.Target, "."), strconv.Itoa(int(record.Port)))
+			if err := healthCheck(ctx, endpoint); err != nil {
+				log.Warn("skip unhealthy pd endpoint discovered by SRV records",
+					zap.String("name", name), zap.String("endpoint", endpoint), zap.Error(err))
+				continue
+			}
+			resolved = append(resolved, endpoint)
+			healthy++
+		}
+		if healthy == 0 {
+			return nil, errors.Annotatef(berrors.ErrPDUpdateFailed,
+				"no healthy pd endpoint in the %d SRV records of %s", len(records), name)
+		}
+		log.Info("discover pd endpoints by SRV records", zap.String("name", name), zap.Int("endpoints", healthy))
+	}
+	return resolved, nil
+}
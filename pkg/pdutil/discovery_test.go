@@ -0,0 +1,55 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package pdutil
+
+import (
+	"context"
+	"errors"
+	"net"
+
+	. "github.com/pingcap/check"
+)
+
+func (s *testPDControllerSuite) TestNormalizeAddr(c *C) {
+	c.Assert(normalizeAddr("127.0.0.1:2379"), Equals, "127.0.0.1:2379")
+	c.Assert(normalizeAddr("pd:2379"), Equals, "pd:2379")
+	c.Assert(normalizeAddr("fd00::1"), Equals, "[fd00::1]:2379")
+	c.Assert(normalizeAddr("[fd00::1]"), Equals, "[fd00::1]:2379")
+	c.Assert(normalizeAddr("[fd00::1]:12379"), Equals, "[fd00::1]:12379")
+	c.Assert(normalizeAddr("https://fd00::1"), Equals, "https://[fd00::1]:2379")
+}
+
+func (s *testPDControllerSuite) TestDiscoverAddrs(c *C) {
+	origin := lookupSRV
+	defer func() { lookupSRV = origin }()
+	lookupSRV = func(ctx context.Context, name string) ([]*net.SRV, error) {
+		switch name {
+		case "_pd._tcp.cluster.local":
+			return []*net.SRV{
+				{Target: "pd-0.cluster.local.", Port: 2379},
+				{Target: "pd-1.cluster.local.", Port: 2379},
+				{Target: "pd-2.cluster.local.", Port: 2379},
+			}, nil
+		case "_pd._tcp.down.local":
+			return []*net.SRV{{Target: "pd-1.cluster.local.", Port: 2379}}, nil
+		default:
+			return nil, errors.New("no such host")
+		}
+	}
+	healthCheck := func(ctx context.Context, addr string) error {
+		if addr == "pd-1.cluster.local:2379" {
+			return errors.New("connection refused")
+		}
+		return nil
+	}
+
+	ctx := context.Background()
+	addrs, err := discoverAddrs(ctx, []string{"srv://_pd._tcp.cluster.local", "fd00::1"}, healthCheck)
+	c.Assert(err, IsNil)
+	c.Assert(addrs, DeepEquals, []string{"pd-0.cluster.local:2379", "pd-2.cluster.local:2379", "[fd00::1]:2379"})
+
+	_, err = discoverAddrs(ctx, []string{"srv://_pd._tcp.down.local"}, healthCheck)
+	c.Assert(err, ErrorMatches, ".*no healthy pd endpoint.*")
+	_, err = discoverAddrs(ctx, []string{"srv://_pd._tcp.unknown.local"}, healthCheck)
+	c.Assert(err, ErrorMatches, ".*failed to look up SRV records.*")
+}
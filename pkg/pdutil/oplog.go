@@ -0,0 +1,197 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package pdutil
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+
+	berrors "github.com/pingcap/br/pkg/errors"
+)
+
+const placementRulePrefix = "pd/api/v1/config/rule"
+
+// OpKind is the kind of a change of PD made by BR.
+type OpKind string
+
+const (
+	// OpRemoveSchedulers is removing the schedulers and pausing the schedule
+	// configs, Origin is the removed schedulers and the original configs.
+	OpRemoveSchedulers OpKind = "remove-schedulers"
+	// OpAccelerateMerge is relaxing the region merge limits, Origin is the
+	// original schedule configs.
+	OpAccelerateMerge OpKind = "accelerate-merge"
+	// OpPlacementRules is adding the placement rules RuleIDs of RuleGroup.
+	OpPlacementRules OpKind = "placement-rules"
+)
+
+// Op is a change of PD made by BR, with the state to revert it.
+type Op struct {
+	ID      string    `json:"id"`
+	Kind    OpKind    `json:"kind"`
+	Command string    `json:"command"`
+	Time    time.Time `json:"time"`
+	// Owner identifies the BR process made the op in the op-log, e.g. its
+	// lease, so the op isn't reverted while the process is running.
+	Owner int64 `json:"owner,omitempty"`
+
+	Origin    ClusterConfig `json:"origin"`
+	RuleGroup string        `json:"rule-group,omitempty"`
+	RuleIDs   []string      `json:"rule-ids,omitempty"`
+}
+
+// String implements fmt.Stringer.
+func (op *Op) String() string {
+	switch op.Kind {
+	case OpRemoveSchedulers:
+		return fmt.Sprintf("add back schedulers %v and restore schedule config %v",
+			op.Origin.Schedulers, op.Origin.ScheduleCfg)
+	case OpAccelerateMerge:
+		return fmt.Sprintf("restore region merge config %v", op.Origin.ScheduleCfg)
+	case OpPlacementRules:
+		return fmt.Sprintf("delete placement rules %v of group %s", op.RuleIDs, op.RuleGroup)
+	default:
+		return fmt.Sprintf("unknown op %s", op.Kind)
+	}
+}
+
+// OpLog persists the changes of PD made by BR, so they can be reverted by
+// another BR process if the process made them crashes.
+type OpLog interface {
+	// Record persists the op.
+	Record(ctx context.Context, op *Op) error
+	// Done removes the op once it's reverted.
+	Done(ctx context.Context, id string) error
+	// List returns the ops not reverted yet.
+	List(ctx context.Context) ([]*Op, error)
+	// OwnerAlive returns whether the BR process made the op is running, which
+	// reverts the op by itself.
+	OwnerAlive(ctx context.Context, op *Op) (bool, error)
+}
+
+// SetOpLog makes the controller record the changes of PD into the op-log
+// before returning their UndoFuncs. The command is recorded along with the
+// changes for inspecting.
+func (p *PdController) SetOpLog(opLog OpLog, command string) {
+	p.opLog = opLog
+	p.opCommand = command
+}
+
+// RecordOp records the op made by the caller into the op-log, and returns the
+// UndoFunc which runs undo and marks the op done. It's best-effort, failing
+// to record only logs a warning.
+func (p *PdController) RecordOp(ctx context.Context, op *Op, undo UndoFunc) UndoFunc {
+	if p.opLog == nil {
+		return undo
+	}
+	op.Time = time.Now()
+	op.Command = p.opCommand
+	op.ID = fmt.Sprintf("%020d-%d-%s", op.Time.UnixNano(), os.Getpid(), op.Kind)
+	if err := p.opLog.Record(ctx, op); err != nil {
+		log.Warn("failed to record the change of PD, it won't be reverted if BR crashes",
+			zap.Stringer("op", op), zap.Error(err))
+		return undo
+	}
+	log.Info("recorded the change of PD", zap.String("id", op.ID), zap.Stringer("op", op))
+	return func(ctx context.Context) error {
+		if err := undo(ctx); err != nil {
+			return errors.Trace(err)
+		}
+		if err := p.opLog.Done(ctx, op.ID); err != nil {
+			log.Warn("failed to remove the reverted change of PD from the op-log",
+				zap.String("id", op.ID), zap.Error(err))
+		}
+		return nil
+	}
+}
+
+// RevertOps reverts the ops not reverted yet in the op-log, newest first, and
+// returns the reverted ops. The ops of the running BR processes are skipped.
+// If dryRun is true, the ops are only returned.
+func (p *PdController) RevertOps(ctx context.Context, opLog OpLog, dryRun bool) ([]*Op, error) {
+	return p.revertOpsWith(ctx, opLog, dryRun, pdRequest)
+}
+
+func (p *PdController) revertOpsWith(
+	ctx context.Context, opLog OpLog, dryRun bool, req pdHTTPRequest,
+) ([]*Op, error) {
+	listed, err := opLog.List(ctx)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	ops := listed[:0]
+	for _, op := range listed {
+		alive, err := opLog.OwnerAlive(ctx, op)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		if alive {
+			log.Info("skip the change of PD made by a running BR process",
+				zap.String("id", op.ID), zap.Stringer("op", op))
+			continue
+		}
+		ops = append(ops, op)
+	}
+	// The later changes may be based on the earlier ones, revert them first.
+	sort.Slice(ops, func(i, j int) bool {
+		return ops[i].ID > ops[j].ID
+	})
+	if dryRun {
+		return ops, nil
+	}
+	for i, op := range ops {
+		log.Info("reverting the change of PD", zap.String("id", op.ID), zap.Stringer("op", op))
+		if err := p.revertOpWith(ctx, op, req); err != nil {
+			return ops[:i], errors.Annotatef(err, "failed to revert %s", op.ID)
+		}
+		if err := opLog.Done(ctx, op.ID); err != nil {
+			return ops[:i], errors.Trace(err)
+		}
+	}
+	return ops, nil
+}
+
+func (p *PdController) revertOpWith(ctx context.Context, op *Op, req pdHTTPRequest) error {
+	switch op.Kind {
+	case OpRemoveSchedulers:
+		// No goroutine pauses the schedulers in this process, drain the
+		// signal of stopping it sent by the previous op.
+		select {
+		case <-p.schedulerPauseCh:
+		default:
+		}
+		return errors.Trace(restoreSchedulers(ctx, p, op.Origin))
+	case OpAccelerateMerge:
+		return errors.Trace(p.doUpdatePDScheduleConfig(ctx, op.Origin.ScheduleCfg, req))
+	case OpPlacementRules:
+		for _, id := range op.RuleIDs {
+			if err := p.deletePlacementRuleWith(ctx, op.RuleGroup, id, req); err != nil {
+				return errors.Trace(err)
+			}
+		}
+		return nil
+	default:
+		return errors.Annotatef(berrors.ErrInvalidArgument, "unknown op kind %s", op.Kind)
+	}
+}
+
+func (p *PdController) deletePlacementRuleWith(
+	ctx context.Context, groupID, ruleID string, req pdHTTPRequest,
+) error {
+	var err error
+	for _, addr := range p.addrs {
+		prefix := fmt.Sprintf("%s/%s/%s", placementRulePrefix, groupID, ruleID)
+		if _, err = req(ctx, addr, prefix, p.cli, http.MethodDelete, nil); err == nil {
+			return nil
+		}
+	}
+	return errors.Trace(err)
+}
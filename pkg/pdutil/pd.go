@@ -30,6 +30,7 @@ import (
 	berrors "github.com/pingcap/br/pkg/errors"
 	"github.com/pingcap/br/pkg/httputil"
 	"github.com/pingcap/br/pkg/lightning/common"
+	"github.com/pingcap/br/pkg/version"
 )
 
 const (
@@ -39,6 +40,10 @@ const (
 	schedulerPrefix      = "pd/api/v1/schedulers"
 	maxMsgSize           = int(128 * units.MiB) // pd.ScanRegion may return a large response
 	scheduleConfigPrefix = "pd/api/v1/config/schedule"
+	tikvConfigPrefix     = "config"
+	minResolvedTSPrefix  = "pd/api/v1/min-resolved-ts"
+	replicaConfigPrefix  = "pd/api/v1/config/replicate"
+	hotStoresPrefix      = "pd/api/v1/hotspot/stores"
 	pauseTimeout         = 5 * time.Minute
 
 	// pd request retry time when connection fail
@@ -118,6 +123,14 @@ var (
 		"max-pending-peer-count":      constConfigGeneratorBuilder(maxPendingPeerUnlimited),
 	}
 
+	// accelerateMergeCfg relaxes the region merge limits, so the small regions
+	// created by restore can be merged quickly.
+	accelerateMergeCfg = map[string]pauseConfigGenerator{
+		"merge-schedule-limit": pauseConfigMulStores,
+		// by default, PD won't merge a region split within 1 hour.
+		"split-merge-interval": constConfigGeneratorBuilder("1s"),
+	}
+
 	// defaultPDCfg find by https://github.com/tikv/pd/blob/master/conf/config.toml.
 	defaultPDCfg = map[string]interface{}{
 		"max-merge-region-keys":       200000,
@@ -186,6 +199,10 @@ type PdController struct {
 
 	// control the pause schedulers goroutine
 	schedulerPauseCh chan struct{}
+
+	// opLog records the changes of PD, see SetOpLog.
+	opLog     OpLog
+	opCommand string
 }
 
 // NewPdController creates a new PdController.
@@ -210,6 +227,8 @@ func NewPdController(
 			}
 		}
 		processedAddrs = append(processedAddrs, addr)
+	}
+	for _, addr := range processedAddrs {
 		versionBytes, failure = pdRequest(ctx, addr, clusterVersionPrefix, cli, http.MethodGet, nil)
 		if failure == nil {
 			break
@@ -220,15 +239,7 @@ func NewPdController(
 	}
 
 	version := parseVersion(versionBytes)
-	maxCallMsgSize := []grpc.DialOption{
-		grpc.WithDefaultCallOptions(grpc.MaxCallRecvMsgSize(maxMsgSize)),
-		grpc.WithDefaultCallOptions(grpc.MaxCallSendMsgSize(maxMsgSize)),
-	}
-	pdClient, err := pd.NewClientWithContext(
-		ctx, addrs, securityOption,
-		pd.WithGRPCDialOptions(maxCallMsgSize...),
-		pd.WithCustomTimeoutOption(10*time.Second),
-	)
+	pdClient, err := NewPDClient(ctx, addrs, securityOption)
 	if err != nil {
 		log.Error("fail to create pd client", zap.Error(err))
 		return nil, errors.Trace(err)
@@ -245,6 +256,20 @@ func NewPdController(
 	}, nil
 }
 
+// NewPDClient creates a PD client with the options used by BR.
+func NewPDClient(ctx context.Context, addrs []string, securityOption pd.SecurityOption) (pd.Client, error) {
+	maxCallMsgSize := []grpc.DialOption{
+		grpc.WithDefaultCallOptions(grpc.MaxCallRecvMsgSize(maxMsgSize)),
+		grpc.WithDefaultCallOptions(grpc.MaxCallSendMsgSize(maxMsgSize)),
+	}
+	pdClient, err := pd.NewClientWithContext(
+		ctx, addrs, securityOption,
+		pd.WithGRPCDialOptions(maxCallMsgSize...),
+		pd.WithCustomTimeoutOption(10*time.Second),
+	)
+	return pdClient, errors.Trace(err)
+}
+
 func parseVersion(versionBytes []byte) *semver.Version {
 	// we need trim space or semver will parse failed
 	v := strings.TrimSpace(string(versionBytes))
@@ -280,6 +305,17 @@ func (p *PdController) SetPDClient(pdClient pd.Client) {
 	p.pdClient = pdClient
 }
 
+// GetPDAddrs returns the addresses of PD without the scheme.
+func (p *PdController) GetPDAddrs() []string {
+	addrs := make([]string, 0, len(p.addrs))
+	for _, addr := range p.addrs {
+		addr = strings.TrimPrefix(addr, "http://")
+		addr = strings.TrimPrefix(addr, "https://")
+		addrs = append(addrs, addr)
+	}
+	return addrs
+}
+
 // GetPDClient set pd addrs and cli for test.
 func (p *PdController) GetPDClient() pd.Client {
 	return p.pdClient
@@ -365,6 +401,272 @@ func (p *PdController) getStoreInfoWith(
 	return nil, errors.Trace(err)
 }
 
+// GetMinResolvedTS returns the min resolved ts of all TiKV stores, which is
+// reported to PD by the stores periodically.
+func (p *PdController) GetMinResolvedTS(ctx context.Context) (uint64, error) {
+	return p.getMinResolvedTSWith(ctx, pdRequest)
+}
+
+func (p *PdController) getMinResolvedTSWith(ctx context.Context, get pdHTTPRequest) (uint64, error) {
+	var err error
+	for _, addr := range p.addrs {
+		v, e := get(ctx, addr, minResolvedTSPrefix, p.cli, http.MethodGet, nil)
+		if e != nil {
+			err = e
+			continue
+		}
+		resp := struct {
+			MinResolvedTS uint64 `json:"min_resolved_ts"`
+			IsRealTime    bool   `json:"is_real_time"`
+		}{}
+		if err = json.Unmarshal(v, &resp); err != nil {
+			return 0, errors.Trace(err)
+		}
+		if !resp.IsRealTime {
+			return 0, errors.Annotate(berrors.ErrPDInvalidResponse,
+				"min resolved ts isn't reported by the stores, please enable it in PD")
+		}
+		return resp.MinResolvedTS, nil
+	}
+	return 0, errors.Trace(err)
+}
+
+// GetStoresLoad returns the bytes per second read and written by the
+// foreground traffic of each TiKV store, which is reported to PD by the store
+// heartbeats. The SST files ingested aren't counted, as they aren't written
+// through the raft log.
+func (p *PdController) GetStoresLoad(ctx context.Context) (map[uint64]float64, error) {
+	return p.getStoresLoadWith(ctx, pdRequest)
+}
+
+func (p *PdController) getStoresLoadWith(ctx context.Context, get pdHTTPRequest) (map[uint64]float64, error) {
+	var err error
+	for _, addr := range p.addrs {
+		v, e := get(ctx, addr, hotStoresPrefix, p.cli, http.MethodGet, nil)
+		if e != nil {
+			err = e
+			continue
+		}
+		resp := struct {
+			BytesWriteStats map[uint64]float64 `json:"bytes-write-rate"`
+			BytesReadStats  map[uint64]float64 `json:"bytes-read-rate"`
+		}{}
+		if err = json.Unmarshal(v, &resp); err != nil {
+			return nil, errors.Trace(err)
+		}
+		load := make(map[uint64]float64, len(resp.BytesReadStats))
+		for storeID, rate := range resp.BytesReadStats {
+			load[storeID] += rate
+		}
+		for storeID, rate := range resp.BytesWriteStats {
+			load[storeID] += rate
+		}
+		return load, nil
+	}
+	return nil, errors.Trace(err)
+}
+
+// GetMaxReplicas returns the number of the replicas of a region configured in
+// PD, i.e. the max-replicas of the replication config.
+func (p *PdController) GetMaxReplicas(ctx context.Context) (int, error) {
+	return p.getMaxReplicasWith(ctx, pdRequest)
+}
+
+func (p *PdController) getMaxReplicasWith(ctx context.Context, get pdHTTPRequest) (int, error) {
+	var err error
+	for _, addr := range p.addrs {
+		v, e := get(ctx, addr, replicaConfigPrefix, p.cli, http.MethodGet, nil)
+		if e != nil {
+			err = e
+			continue
+		}
+		cfg := struct {
+			MaxReplicas int `json:"max-replicas"`
+		}{}
+		if err = json.Unmarshal(v, &cfg); err != nil {
+			return 0, errors.Trace(err)
+		}
+		if cfg.MaxReplicas <= 0 {
+			return 0, errors.Annotatef(berrors.ErrPDInvalidResponse, "invalid max-replicas %d", cfg.MaxReplicas)
+		}
+		return cfg.MaxReplicas, nil
+	}
+	return 0, errors.Trace(err)
+}
+
+// GetRegionHeartbeatInterval returns the interval at which TiKV reports the
+// regions to PD. PD doesn't keep it in its own config, so it's read from the
+// config of the TiKV stores registered in PD.
+func (p *PdController) GetRegionHeartbeatInterval(ctx context.Context) (time.Duration, error) {
+	stores, err := p.tikvStatusAddrs(ctx)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	statusAddrs := make([]string, 0, len(stores))
+	for _, store := range stores {
+		statusAddrs = append(statusAddrs, store.addr)
+	}
+	return p.getRegionHeartbeatIntervalWith(ctx, pdRequest, statusAddrs)
+}
+
+// storeStatusAddr is the URL of the status server of a TiKV store.
+type storeStatusAddr struct {
+	id   uint64
+	addr string
+}
+
+// tikvStatusAddrs returns the URLs of the status servers of the TiKV stores,
+// with the scheme of the PD addresses.
+func (p *PdController) tikvStatusAddrs(ctx context.Context) ([]storeStatusAddr, error) {
+	stores, err := p.pdClient.GetAllStores(ctx, pd.WithExcludeTombstone())
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	scheme := "http"
+	if len(p.addrs) > 0 {
+		if u, err := url.Parse(p.addrs[0]); err == nil && len(u.Scheme) > 0 {
+			scheme = u.Scheme
+		}
+	}
+	statusAddrs := make([]storeStatusAddr, 0, len(stores))
+	for _, store := range stores {
+		if version.IsTiFlash(store) || len(store.GetStatusAddress()) == 0 {
+			continue
+		}
+		statusAddrs = append(statusAddrs, storeStatusAddr{
+			id:   store.GetId(),
+			addr: fmt.Sprintf("%s://%s", scheme, store.GetStatusAddress()),
+		})
+	}
+	return statusAddrs, nil
+}
+
+// EncryptionAtRest is the encryption at rest of a TiKV store.
+type EncryptionAtRest struct {
+	// Method is the data encryption method, "plaintext" means the data isn't
+	// encrypted.
+	Method string
+	// MasterKeyType is the type of the master key encrypting the data keys,
+	// e.g. file or kms.
+	MasterKeyType string
+	// Err is the error of reading the config of the store, the fields above
+	// are empty if it isn't nil.
+	Err error
+}
+
+// Enabled checks whether the store encrypts the data at rest.
+func (e EncryptionAtRest) Enabled() bool {
+	return e.Err == nil && len(e.Method) > 0 && e.Method != "plaintext"
+}
+
+// GetStoresEncryptionAtRest returns the encryption at rest of the TiKV stores
+// by their IDs, read from the config of the stores. The stores without a
+// status address are absent.
+func (p *PdController) GetStoresEncryptionAtRest(ctx context.Context) (map[uint64]EncryptionAtRest, error) {
+	stores, err := p.tikvStatusAddrs(ctx)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return p.getStoresEncryptionAtRestWith(ctx, pdRequest, stores), nil
+}
+
+func (p *PdController) getStoresEncryptionAtRestWith(
+	ctx context.Context, get pdHTTPRequest, stores []storeStatusAddr,
+) map[uint64]EncryptionAtRest {
+	result := make(map[uint64]EncryptionAtRest, len(stores))
+	for _, store := range stores {
+		v, err := get(ctx, store.addr, tikvConfigPrefix, p.cli, http.MethodGet, nil)
+		if err != nil {
+			result[store.id] = EncryptionAtRest{Err: errors.Trace(err)}
+			continue
+		}
+		cfg := struct {
+			Security struct {
+				Encryption struct {
+					DataEncryptionMethod string `json:"data-encryption-method"`
+					MasterKey            struct {
+						Type string `json:"type"`
+					} `json:"master-key"`
+				} `json:"encryption"`
+			} `json:"security"`
+		}{}
+		if err = json.Unmarshal(v, &cfg); err != nil {
+			result[store.id] = EncryptionAtRest{Err: errors.Annotatef(berrors.ErrPDInvalidResponse,
+				"invalid config of %s: %s", store.addr, err)}
+			continue
+		}
+		result[store.id] = EncryptionAtRest{
+			Method:        cfg.Security.Encryption.DataEncryptionMethod,
+			MasterKeyType: cfg.Security.Encryption.MasterKey.Type,
+		}
+	}
+	return result
+}
+
+// GetStoresAPIVersion returns the API version of the TiKV stores by their
+// IDs, read from the config of the stores. The stores not configuring it run
+// API V1. The stores without a status address are absent.
+func (p *PdController) GetStoresAPIVersion(ctx context.Context) (map[uint64]int, error) {
+	stores, err := p.tikvStatusAddrs(ctx)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return p.getStoresAPIVersionWith(ctx, pdRequest, stores)
+}
+
+func (p *PdController) getStoresAPIVersionWith(
+	ctx context.Context, get pdHTTPRequest, stores []storeStatusAddr,
+) (map[uint64]int, error) {
+	result := make(map[uint64]int, len(stores))
+	for _, store := range stores {
+		v, err := get(ctx, store.addr, tikvConfigPrefix, p.cli, http.MethodGet, nil)
+		if err != nil {
+			return nil, errors.Annotatef(err, "failed to read the config of %s", store.addr)
+		}
+		cfg := struct {
+			Storage struct {
+				APIVersion int `json:"api-version"`
+			} `json:"storage"`
+		}{}
+		if err = json.Unmarshal(v, &cfg); err != nil {
+			return nil, errors.Annotatef(berrors.ErrPDInvalidResponse, "invalid config of %s: %s", store.addr, err)
+		}
+		if cfg.Storage.APIVersion == 0 {
+			cfg.Storage.APIVersion = 1
+		}
+		result[store.id] = cfg.Storage.APIVersion
+	}
+	return result, nil
+}
+
+func (p *PdController) getRegionHeartbeatIntervalWith(
+	ctx context.Context, get pdHTTPRequest, statusAddrs []string,
+) (time.Duration, error) {
+	err := errors.Annotate(berrors.ErrPDInvalidResponse, "no TiKV store with a status address")
+	for _, addr := range statusAddrs {
+		v, e := get(ctx, addr, tikvConfigPrefix, p.cli, http.MethodGet, nil)
+		if e != nil {
+			err = e
+			continue
+		}
+		cfg := struct {
+			Raftstore struct {
+				PdHeartbeatTickInterval string `json:"pd-heartbeat-tick-interval"`
+			} `json:"raftstore"`
+		}{}
+		if err = json.Unmarshal(v, &cfg); err != nil {
+			return 0, errors.Trace(err)
+		}
+		interval, err := time.ParseDuration(cfg.Raftstore.PdHeartbeatTickInterval)
+		if err != nil {
+			return 0, errors.Annotatef(berrors.ErrPDInvalidResponse,
+				"invalid pd-heartbeat-tick-interval %q of %s", cfg.Raftstore.PdHeartbeatTickInterval, addr)
+		}
+		return interval, nil
+	}
+	return 0, errors.Trace(err)
+}
+
 func (p *PdController) doPauseSchedulers(ctx context.Context, schedulers []string, post pdHTTPRequest) ([]string, error) {
 	// pause this scheduler with 300 seconds
 	body, err := json.Marshal(pauseSchedulerBody{Delay: int64(pauseTimeout)})
@@ -600,7 +902,8 @@ func (p *PdController) RemoveSchedulers(ctx context.Context) (undo UndoFunc, err
 		return
 	}
 
-	undo = p.MakeUndoFunctionByConfig(ClusterConfig{Schedulers: origin.Schedulers, ScheduleCfg: origin.ScheduleCfg})
+	originCfg := ClusterConfig{Schedulers: origin.Schedulers, ScheduleCfg: origin.ScheduleCfg}
+	undo = p.RecordOp(ctx, &Op{Kind: OpRemoveSchedulers, Origin: originCfg}, p.MakeUndoFunctionByConfig(originCfg))
 	return undo, errors.Trace(err)
 }
 
@@ -689,6 +992,63 @@ func (p *PdController) doRemoveSchedulersWith(
 	return removedSchedulers, err
 }
 
+// AccelerateRegionMerge relaxes the region merge limits of PD, so the small
+// regions left by restore would be merged quickly. The returned UndoFunc
+// restores the original config.
+func (p *PdController) AccelerateRegionMerge(ctx context.Context) (UndoFunc, error) {
+	stores, err := p.pdClient.GetAllStores(ctx)
+	if err != nil {
+		return Nop, errors.Trace(err)
+	}
+	return p.accelerateRegionMergeWith(ctx, len(stores), pdRequest)
+}
+
+func (p *PdController) accelerateRegionMergeWith(
+	ctx context.Context, storeCount int, req pdHTTPRequest,
+) (UndoFunc, error) {
+	var scheduleCfg map[string]interface{}
+	var err error
+	for _, addr := range p.addrs {
+		v, e := req(ctx, addr, scheduleConfigPrefix, p.cli, http.MethodGet, nil)
+		if e != nil {
+			err = e
+			continue
+		}
+		scheduleCfg = make(map[string]interface{})
+		if err = json.Unmarshal(v, &scheduleCfg); err != nil {
+			return Nop, errors.Trace(err)
+		}
+		break
+	}
+	if scheduleCfg == nil {
+		return Nop, errors.Trace(err)
+	}
+
+	originCfg := make(map[string]interface{}, len(accelerateMergeCfg))
+	relaxedCfg := make(map[string]interface{}, len(accelerateMergeCfg))
+	for cfgKey, cfgValFunc := range accelerateMergeCfg {
+		value, ok := scheduleCfg[cfgKey]
+		if !ok {
+			// Ignore non-exist config.
+			continue
+		}
+		originCfg[cfgKey] = value
+		relaxedCfg[cfgKey] = cfgValFunc(storeCount, value)
+	}
+	if len(relaxedCfg) == 0 {
+		return Nop, nil
+	}
+	log.Info("accelerate region merge", zap.Any("cfg", relaxedCfg))
+	if err := p.doUpdatePDScheduleConfig(ctx, relaxedCfg, req); err != nil {
+		return Nop, errors.Trace(err)
+	}
+	undo := func(ctx context.Context) error {
+		log.Info("restoring region merge config", zap.Any("cfg", originCfg))
+		return errors.Trace(p.doUpdatePDScheduleConfig(ctx, originCfg, req))
+	}
+	return p.RecordOp(ctx, &Op{Kind: OpAccelerateMerge, Origin: ClusterConfig{ScheduleCfg: originCfg}}, undo), nil
+}
+
 // Close close the connection to pd.
 func (p *PdController) Close() {
 	p.pdClient.Close()
@@ -13,6 +13,7 @@ import (
 	"net/http/httptest"
 	"net/url"
 	"testing"
+	"time"
 
 	"github.com/coreos/go-semver/semver"
 	. "github.com/pingcap/check"
@@ -163,6 +164,131 @@ func (s *testPDControllerSuite) TestRegionCount(c *C) {
 	c.Assert(resp, Equals, 2)
 }
 
+func (s *testPDControllerSuite) TestAccelerateRegionMerge(c *C) {
+	var updates []map[string]interface{}
+	mock := func(
+		_ context.Context, _ string, _ string, _ *http.Client, method string, body io.Reader,
+	) ([]byte, error) {
+		if method == http.MethodGet {
+			return []byte(`{"merge-schedule-limit": 8, "split-merge-interval": "1h0m0s", "max-merge-region-keys": 200000}`), nil
+		}
+		cfg := make(map[string]interface{})
+		c.Assert(json.NewDecoder(body).Decode(&cfg), IsNil)
+		updates = append(updates, cfg)
+		return nil, nil
+	}
+
+	pdController := &PdController{addrs: []string{"http://mock"}}
+	ctx := context.Background()
+	undo, err := pdController.accelerateRegionMergeWith(ctx, 3, mock)
+	c.Assert(err, IsNil)
+	c.Assert(updates, HasLen, 1)
+	c.Assert(updates[0], DeepEquals, map[string]interface{}{
+		"merge-schedule-limit": float64(24),
+		"split-merge-interval": "1s",
+	})
+
+	c.Assert(undo(ctx), IsNil)
+	c.Assert(updates, HasLen, 2)
+	c.Assert(updates[1], DeepEquals, map[string]interface{}{
+		"merge-schedule-limit": float64(8),
+		"split-merge-interval": "1h0m0s",
+	})
+}
+
+type mockOpLog struct {
+	ops   map[string]*Op
+	alive map[string]bool
+}
+
+func (l *mockOpLog) Record(_ context.Context, op *Op) error {
+	l.ops[op.ID] = op
+	return nil
+}
+
+func (l *mockOpLog) Done(_ context.Context, id string) error {
+	delete(l.ops, id)
+	return nil
+}
+
+func (l *mockOpLog) List(context.Context) ([]*Op, error) {
+	ops := make([]*Op, 0, len(l.ops))
+	for _, op := range l.ops {
+		ops = append(ops, op)
+	}
+	return ops, nil
+}
+
+func (l *mockOpLog) OwnerAlive(_ context.Context, op *Op) (bool, error) {
+	return l.alive[op.Command], nil
+}
+
+func (s *testPDControllerSuite) TestOpLog(c *C) {
+	var requests []string
+	mock := func(
+		_ context.Context, _ string, prefix string, _ *http.Client, method string, body io.Reader,
+	) ([]byte, error) {
+		if method == http.MethodGet {
+			return []byte(`{"merge-schedule-limit": 8}`), nil
+		}
+		requests = append(requests, method+" "+prefix)
+		return nil, nil
+	}
+
+	opLog := &mockOpLog{ops: make(map[string]*Op)}
+	pdController := &PdController{addrs: []string{"http://mock"}}
+	pdController.SetOpLog(opLog, "Restore")
+	ctx := context.Background()
+
+	// The op is done once undone.
+	undo, err := pdController.accelerateRegionMergeWith(ctx, 3, mock)
+	c.Assert(err, IsNil)
+	c.Assert(opLog.ops, HasLen, 1)
+	c.Assert(undo(ctx), IsNil)
+	c.Assert(opLog.ops, HasLen, 0)
+
+	// The ops left by a crash are reverted newest first.
+	_, err = pdController.accelerateRegionMergeWith(ctx, 3, mock)
+	c.Assert(err, IsNil)
+	pdController.RecordOp(ctx, &Op{Kind: OpPlacementRules, RuleGroup: "pd", RuleIDs: []string{"restore-raw"}}, Nop)
+	c.Assert(opLog.ops, HasLen, 2)
+	for _, op := range opLog.ops {
+		c.Assert(op.Command, Equals, "Restore")
+	}
+	requests = nil
+
+	ops, err := pdController.revertOpsWith(ctx, opLog, true, mock)
+	c.Assert(err, IsNil)
+	c.Assert(ops, HasLen, 2)
+	c.Assert(requests, HasLen, 0)
+	c.Assert(opLog.ops, HasLen, 2)
+
+	ops, err = pdController.revertOpsWith(ctx, opLog, false, mock)
+	c.Assert(err, IsNil)
+	c.Assert(ops, HasLen, 2)
+	c.Assert(ops[0].Kind, Equals, OpPlacementRules)
+	c.Assert(ops[1].Kind, Equals, OpAccelerateMerge)
+	c.Assert(requests, DeepEquals, []string{
+		"DELETE pd/api/v1/config/rule/pd/restore-raw",
+		"POST " + scheduleConfigPrefix,
+	})
+	c.Assert(opLog.ops, HasLen, 0)
+
+	// The ops of the running processes are skipped.
+	_, err = pdController.accelerateRegionMergeWith(ctx, 3, mock)
+	c.Assert(err, IsNil)
+	pdController.SetOpLog(opLog, "Running")
+	pdController.RecordOp(ctx, &Op{Kind: OpPlacementRules, RuleGroup: "pd", RuleIDs: []string{"restore-raw"}}, Nop)
+	opLog.alive = map[string]bool{"Running": true}
+	requests = nil
+	ops, err = pdController.revertOpsWith(ctx, opLog, false, mock)
+	c.Assert(err, IsNil)
+	c.Assert(ops, HasLen, 1)
+	c.Assert(ops[0].Kind, Equals, OpAccelerateMerge)
+	c.Assert(requests, DeepEquals, []string{"POST " + scheduleConfigPrefix})
+	c.Assert(opLog.ops, HasLen, 1)
+}
+
 func (s *testPDControllerSuite) TestPDVersion(c *C) {
 	v := []byte("\"v4.1.0-alpha1\"\n")
 	r := parseVersion(v)
@@ -232,3 +358,155 @@ func (s *testPDControllerSuite) TestStoreInfo(c *C) {
 	c.Assert(resp.Store.StateName, Equals, "Tombstone")
 	c.Assert(uint64(resp.Status.Available), Equals, uint64(1024))
 }
+
+func (s *testPDControllerSuite) TestRegionHeartbeatInterval(c *C) {
+	mock := func(
+		_ context.Context, addr string, prefix string, _ *http.Client, _ string, _ io.Reader,
+	) ([]byte, error) {
+		if addr == "http://down" {
+			return nil, errors.New("connection refused")
+		}
+		c.Assert(fmt.Sprintf("%s/%s", addr, prefix), Equals, "http://tikv/config")
+		return []byte(`{"raftstore":{"pd-heartbeat-tick-interval":"10s"}}`), nil
+	}
+
+	pdController := &PdController{addrs: []string{"http://mock"}}
+	ctx := context.Background()
+	interval, err := pdController.getRegionHeartbeatIntervalWith(ctx, mock, []string{"http://down", "http://tikv"})
+	c.Assert(err, IsNil)
+	c.Assert(interval, Equals, 10*time.Second)
+
+	_, err = pdController.getRegionHeartbeatIntervalWith(ctx, mock, []string{"http://down"})
+	c.Assert(err, ErrorMatches, ".*connection refused.*")
+	_, err = pdController.getRegionHeartbeatIntervalWith(ctx, mock, nil)
+	c.Assert(err, NotNil)
+}
+
+func (s *testPDControllerSuite) TestMinResolvedTS(c *C) {
+	realTime := true
+	mock := func(
+		_ context.Context, addr string, prefix string, _ *http.Client, _ string, _ io.Reader,
+	) ([]byte, error) {
+		if addr == "http://down" {
+			return nil, errors.New("connection refused")
+		}
+		c.Assert(fmt.Sprintf("%s/%s", addr, prefix), Equals, "http://mock/pd/api/v1/min-resolved-ts")
+		return []byte(fmt.Sprintf(`{"min_resolved_ts":42,"is_real_time":%v,"persist_interval":"1s"}`, realTime)), nil
+	}
+
+	pdController := &PdController{addrs: []string{"http://down", "http://mock"}}
+	ctx := context.Background()
+	ts, err := pdController.getMinResolvedTSWith(ctx, mock)
+	c.Assert(err, IsNil)
+	c.Assert(ts, Equals, uint64(42))
+
+	realTime = false
+	_, err = pdController.getMinResolvedTSWith(ctx, mock)
+	c.Assert(err, ErrorMatches, ".*min resolved ts isn't reported.*")
+}
+
+func (s *testPDControllerSuite) TestStoresLoad(c *C) {
+	mock := func(
+		_ context.Context, addr string, prefix string, _ *http.Client, _ string, _ io.Reader,
+	) ([]byte, error) {
+		c.Assert(fmt.Sprintf("%s/%s", addr, prefix), Equals, "http://mock/pd/api/v1/hotspot/stores")
+		return []byte(`{"bytes-write-rate":{"1":100,"2":50.5},"bytes-read-rate":{"1":20,"3":7},` +
+			`"keys-write-rate":{"1":3}}`), nil
+	}
+
+	pdController := &PdController{addrs: []string{"http://mock"}}
+	load, err := pdController.getStoresLoadWith(context.Background(), mock)
+	c.Assert(err, IsNil)
+	c.Assert(load, DeepEquals, map[uint64]float64{1: 120, 2: 50.5, 3: 7})
+}
+
+func (s *testPDControllerSuite) TestGetMaxReplicas(c *C) {
+	maxReplicas := 3
+	mock := func(
+		_ context.Context, addr string, prefix string, _ *http.Client, _ string, _ io.Reader,
+	) ([]byte, error) {
+		if addr == "http://down" {
+			return nil, errors.New("connection refused")
+		}
+		c.Assert(fmt.Sprintf("%s/%s", addr, prefix), Equals, "http://mock/pd/api/v1/config/replicate")
+		return []byte(fmt.Sprintf(`{"max-replicas":%d,"location-labels":""}`, maxReplicas)), nil
+	}
+
+	pdController := &PdController{addrs: []string{"http://down", "http://mock"}}
+	ctx := context.Background()
+	replicas, err := pdController.getMaxReplicasWith(ctx, mock)
+	c.Assert(err, IsNil)
+	c.Assert(replicas, Equals, 3)
+
+	maxReplicas = 0
+	_, err = pdController.getMaxReplicasWith(ctx, mock)
+	c.Assert(err, ErrorMatches, ".*invalid max-replicas 0.*")
+}
+
+func (s *testPDControllerSuite) TestStoresEncryptionAtRest(c *C) {
+	mock := func(
+		_ context.Context, addr string, prefix string, _ *http.Client, _ string, _ io.Reader,
+	) ([]byte, error) {
+		c.Assert(prefix, Equals, "config")
+		switch addr {
+		case "http://tikv1":
+			return []byte(`{"security":{"encryption":{"data-encryption-method":"aes256-ctr",` +
+				`"master-key":{"type":"kms"}}}}`), nil
+		case "http://tikv2":
+			return []byte(`{"security":{"encryption":{"data-encryption-method":"plaintext",` +
+				`"master-key":{"type":"plaintext"}}}}`), nil
+		case "http://tikv3":
+			return []byte(`not json`), nil
+		}
+		return nil, errors.New("connection refused")
+	}
+
+	pdController := &PdController{addrs: []string{"http://mock"}}
+	result := pdController.getStoresEncryptionAtRestWith(context.Background(), mock, []storeStatusAddr{
+		{id: 1, addr: "http://tikv1"},
+		{id: 2, addr: "http://tikv2"},
+		{id: 3, addr: "http://tikv3"},
+		{id: 4, addr: "http://down"},
+	})
+	c.Assert(result, HasLen, 4)
+	c.Assert(result[1], DeepEquals, EncryptionAtRest{Method: "aes256-ctr", MasterKeyType: "kms"})
+	c.Assert(result[1].Enabled(), IsTrue)
+	c.Assert(result[2].Enabled(), IsFalse)
+	c.Assert(result[3].Err, ErrorMatches, ".*invalid config of http://tikv3.*")
+	c.Assert(result[3].Enabled(), IsFalse)
+	c.Assert(result[4].Err, ErrorMatches, ".*connection refused.*")
+}
+
+func (s *testPDControllerSuite) TestStoresAPIVersion(c *C) {
+	mock := func(
+		_ context.Context, addr string, prefix string, _ *http.Client, _ string, _ io.Reader,
+	) ([]byte, error) {
+		c.Assert(prefix, Equals, "config")
+		switch addr {
+		case "http://tikv1":
+			return []byte(`{"storage":{"api-version":2}}`), nil
+		case "http://tikv2":
+			return []byte(`{"storage":{}}`), nil
+		case "http://tikv3":
+			return []byte(`not json`), nil
+		}
+		return nil, errors.New("connection refused")
+	}
+
+	pdController := &PdController{addrs: []string{"http://mock"}}
+	result, err := pdController.getStoresAPIVersionWith(context.Background(), mock, []storeStatusAddr{
+		{id: 1, addr: "http://tikv1"},
+		{id: 2, addr: "http://tikv2"},
+	})
+	c.Assert(err, IsNil)
+	c.Assert(result, DeepEquals, map[uint64]int{1: 2, 2: 1})
+
+	_, err = pdController.getStoresAPIVersionWith(context.Background(), mock, []storeStatusAddr{
+		{id: 3, addr: "http://tikv3"},
+	})
+	c.Assert(err, ErrorMatches, ".*invalid config of http://tikv3.*")
+	_, err = pdController.getStoresAPIVersionWith(context.Background(), mock, []storeStatusAddr{
+		{id: 4, addr: "http://down"},
+	})
+	c.Assert(err, ErrorMatches, ".*connection refused.*")
+}
@@ -12,6 +12,8 @@ import (
 	"google.golang.org/grpc/status"
 
 	berrors "github.com/pingcap/br/pkg/errors"
+	"github.com/pingcap/br/pkg/storage"
+	"github.com/pingcap/br/pkg/summary"
 	"github.com/pingcap/br/pkg/utils"
 )
 
@@ -33,6 +35,8 @@ type importerBackoffer struct {
 	attempt      int
 	delayTime    time.Duration
 	maxDelayTime time.Duration
+	// retryCategory is the category collected by summary.CollectRetry.
+	retryCategory string
 }
 
 // NewBackoffer creates a new controller regulating a truncated exponential backoff.
@@ -45,17 +49,34 @@ func NewBackoffer(attempt int, delayTime, maxDelayTime time.Duration) utils.Back
 }
 
 func newImportSSTBackoffer() utils.Backoffer {
-	return NewBackoffer(importSSTRetryTimes, importSSTWaitInterval, importSSTMaxWaitInterval)
+	return &importerBackoffer{
+		attempt:       importSSTRetryTimes,
+		delayTime:     importSSTWaitInterval,
+		maxDelayTime:  importSSTMaxWaitInterval,
+		retryCategory: summary.RetryIngest,
+	}
 }
 
 func newDownloadSSTBackoffer() utils.Backoffer {
-	return NewBackoffer(downloadSSTRetryTimes, downloadSSTWaitInterval, downloadSSTMaxWaitInterval)
+	return &importerBackoffer{
+		attempt:       downloadSSTRetryTimes,
+		delayTime:     downloadSSTWaitInterval,
+		maxDelayTime:  downloadSSTMaxWaitInterval,
+		retryCategory: summary.RetryDownload,
+	}
 }
 
 func (bo *importerBackoffer) NextBackoff(err error) time.Duration {
-	if utils.MessageIsRetryableStorageError(err.Error()) {
+	retryCategory := bo.retryCategory
+	if utils.MessageIsRetryableStorageError(err.Error()) || storage.IsRetryableError(err) {
 		bo.delayTime = 2 * bo.delayTime
 		bo.attempt--
+		retryCategory = summary.RetryStorage
+	} else if isPermanentStorageError(err) {
+		// Retrying cannot fix a missing file or a denied access, fail fast.
+		bo.delayTime = 0
+		bo.attempt = 0
+		log.Warn("permanent storage error, stop to retry", zap.Error(err))
 	} else {
 		switch errors.Cause(err) { // nolint:errorlint
 		case berrors.ErrKVEpochNotMatch, berrors.ErrKVDownloadFailed, berrors.ErrKVIngestFailed:
@@ -65,6 +86,11 @@ func (bo *importerBackoffer) NextBackoff(err error) time.Duration {
 			// Excepted error, finish the operation
 			bo.delayTime = 0
 			bo.attempt = 0
+		case berrors.ErrKVDownloadRangeMismatch:
+			// Downloading again gets the same SST, fail fast.
+			bo.delayTime = 0
+			bo.attempt = 0
+			log.Warn("downloaded sst mismatches the request, stop to retry", zap.Error(err))
 		default:
 			switch status.Code(err) {
 			case codes.Unavailable, codes.Aborted:
@@ -78,6 +104,9 @@ func (bo *importerBackoffer) NextBackoff(err error) time.Duration {
 			}
 		}
 	}
+	if bo.attempt > 0 && retryCategory != "" {
+		summary.CollectRetry(retryCategory)
+	}
 	if bo.delayTime > bo.maxDelayTime {
 		return bo.maxDelayTime
 	}
@@ -88,29 +117,15 @@ func (bo *importerBackoffer) Attempt() int {
 	return bo.attempt
 }
 
-type pdReqBackoffer struct {
-	attempt      int
-	delayTime    time.Duration
-	maxDelayTime time.Duration
+// isPermanentStorageError checks whether the error is a permanent storage
+// error, either raised by BR itself or reported by TiKV.
+func isPermanentStorageError(err error) bool {
+	msg := err.Error()
+	return storage.IsPermanentError(err) ||
+		utils.MessageIsNotFoundStorageError(msg) ||
+		utils.MessageIsPermissionDeniedStorageError(msg)
 }
 
 func newPDReqBackoffer() utils.Backoffer {
-	return &pdReqBackoffer{
-		attempt:      resetTSRetryTime,
-		delayTime:    resetTSWaitInterval,
-		maxDelayTime: resetTSMaxWaitInterval,
-	}
-}
-
-func (bo *pdReqBackoffer) NextBackoff(err error) time.Duration {
-	bo.delayTime = 2 * bo.delayTime
-	bo.attempt--
-	if bo.delayTime > bo.maxDelayTime {
-		return bo.maxDelayTime
-	}
-	return bo.delayTime
-}
-
-func (bo *pdReqBackoffer) Attempt() int {
-	return bo.attempt
+	return utils.NewExponentialBackoffer(resetTSRetryTime, resetTSWaitInterval, resetTSMaxWaitInterval)
 }
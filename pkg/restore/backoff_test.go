@@ -7,6 +7,7 @@ import (
 	"time"
 
 	. "github.com/pingcap/check"
+	"github.com/pingcap/errors"
 	"github.com/pingcap/tidb/util/testleak"
 	"go.uber.org/multierr"
 	"google.golang.org/grpc/codes"
@@ -115,3 +116,32 @@ func (s *testBackofferSuite) TestBackoffWithRetryableError(c *C) {
 		berrors.ErrKVEpochNotMatch,
 	})
 }
+
+func (s *testBackofferSuite) TestBackoffWithStorageError(c *C) {
+	var counter int
+	backoffer := restore.NewBackoffer(10, time.Nanosecond, time.Nanosecond)
+	err := utils.WithRetry(context.Background(), func() error {
+		defer func() { counter++ }()
+		switch counter {
+		case 0:
+			return berrors.ErrStorageTransient
+		case 1:
+			return berrors.ErrStorageNotFound
+		}
+		return nil
+	}, backoffer)
+	c.Assert(counter, Equals, 2)
+	c.Assert(multierr.Errors(err), DeepEquals, []error{
+		berrors.ErrStorageTransient,
+		berrors.ErrStorageNotFound,
+	})
+
+	counter = 0
+	backoffer = restore.NewBackoffer(10, time.Nanosecond, time.Nanosecond)
+	err = utils.WithRetry(context.Background(), func() error {
+		defer func() { counter++ }()
+		return errors.Annotate(berrors.ErrKVDownloadFailed, "Io(Custom { kind: PermissionDenied })")
+	}, backoffer)
+	c.Assert(counter, Equals, 1)
+	c.Assert(err, NotNil)
+}
@@ -55,6 +55,14 @@ type Batcher struct {
 	manager            ContextManager
 	batchSizeThreshold int
 	size               int32
+
+	// batchBytesThreshold and batchKeysThreshold bound the total bytes and
+	// keys of the ranges of a batch as well, so the batches take similar time
+	// when the sizes of the ranges vary a lot. Zero means unlimited.
+	batchBytesThreshold uint64
+	batchKeysThreshold  uint64
+	sizeBytes           uint64
+	sizeKeys            uint64
 }
 
 // Len calculate the current size of this batcher.
@@ -62,6 +70,21 @@ func (b *Batcher) Len() int {
 	return int(atomic.LoadInt32(&b.size))
 }
 
+// overflow checks whether the pending ranges exceed any threshold of a batch.
+// If orEqual is true, reaching the threshold is considered as exceeding too.
+func (b *Batcher) overflow(orEqual bool) bool {
+	exceed := func(size, threshold uint64) bool {
+		return size > threshold || (orEqual && size == threshold)
+	}
+	if exceed(uint64(b.Len()), uint64(b.batchSizeThreshold)) {
+		return true
+	}
+	if b.batchBytesThreshold > 0 && exceed(atomic.LoadUint64(&b.sizeBytes), b.batchBytesThreshold) {
+		return true
+	}
+	return b.batchKeysThreshold > 0 && exceed(atomic.LoadUint64(&b.sizeKeys), b.batchKeysThreshold)
+}
+
 // contextCleaner is the worker goroutine that cleaning the 'context'
 // (e.g. make regions leave restore mode).
 func (b *Batcher) contextCleaner(ctx context.Context, tables <-chan []CreatedTable) {
@@ -165,8 +188,8 @@ func (b *Batcher) joinAutoCommitWorker() {
 // sendWorker is the 'worker' that send all ranges to TiKV.
 // TODO since all operations are asynchronous now, it's possible to remove this worker.
 func (b *Batcher) sendWorker(ctx context.Context, send <-chan SendType) {
-	sendUntil := func(lessOrEqual int) {
-		for b.Len() > lessOrEqual {
+	sendAll := func() {
+		for b.Len() > 0 {
 			b.Send(ctx)
 		}
 	}
@@ -174,11 +197,13 @@ func (b *Batcher) sendWorker(ctx context.Context, send <-chan SendType) {
 	for sendType := range send {
 		switch sendType {
 		case SendUntilLessThanBatch:
-			sendUntil(b.batchSizeThreshold)
+			for b.Len() > 0 && b.overflow(false) {
+				b.Send(ctx)
+			}
 		case SendAll:
-			sendUntil(0)
+			sendAll()
 		case SendAllThenClose:
-			sendUntil(0)
+			sendAll()
 			b.sender.Close()
 			b.everythingIsDone.Done()
 			return
@@ -259,12 +284,16 @@ func newDrainResult() DrainResult {
 // |--|-------|
 // |t2|t3     |
 // as you can see, all restored ranges would be removed.
+//
+// the batch is bounded by batchBytesThreshold and batchKeysThreshold in the
+// same way, except that a batch has one range at least.
 func (b *Batcher) drainRanges() DrainResult {
 	result := newDrainResult()
 
 	b.cachedTablesMu.Lock()
 	defer b.cachedTablesMu.Unlock()
 
+	var collectedBytes, collectedKeys uint64
 	for offset, thisTable := range b.cachedTables {
 		thisTableLen := len(thisTable.Range)
 		collected := len(result.Ranges)
@@ -272,11 +301,16 @@ func (b *Batcher) drainRanges() DrainResult {
 		result.RewriteRules.Append(*thisTable.RewriteRule)
 		result.TablesToSend = append(result.TablesToSend, thisTable.CreatedTable)
 
+		drainSize, drainBytes, drainKeys := b.rangesToDrain(thisTable.Range, collected, collectedBytes, collectedKeys)
+		collectedBytes += drainBytes
+		collectedKeys += drainKeys
+		atomic.AddUint64(&b.sizeBytes, ^(drainBytes - 1))
+		atomic.AddUint64(&b.sizeKeys, ^(drainKeys - 1))
+
 		// the batch is full, we should stop here!
-		// we use strictly greater than because when we send a batch at equal, the offset should plus one.
+		// we stop only when the table doesn't fit because when the table fits at equal, the offset should plus one.
 		// (because the last table is sent, we should put it in emptyTables), and this will introduce extra complex.
-		if thisTableLen+collected > b.batchSizeThreshold {
-			drainSize := b.batchSizeThreshold - collected
+		if drainSize < thisTableLen {
 			thisTableRanges := thisTable.Range
 
 			var drained []rtree.Range
@@ -311,6 +345,28 @@ func (b *Batcher) drainRanges() DrainResult {
 	return result
 }
 
+// rangesToDrain returns the number, the bytes and the keys of the leading
+// ranges which fit in the batch that has collected ranges of bytes and keys.
+func (b *Batcher) rangesToDrain(
+	ranges []rtree.Range, collected int, bytes, keys uint64,
+) (n int, drainBytes, drainKeys uint64) {
+	limit := len(ranges)
+	if collected+limit > b.batchSizeThreshold {
+		limit = b.batchSizeThreshold - collected
+	}
+	for ; n < limit; n++ {
+		rb, rk := ranges[n].BytesAndKeys()
+		if collected+n > 0 &&
+			((b.batchBytesThreshold > 0 && bytes+drainBytes+rb > b.batchBytesThreshold) ||
+				(b.batchKeysThreshold > 0 && keys+drainKeys+rk > b.batchKeysThreshold)) {
+			break
+		}
+		drainBytes += rb
+		drainKeys += rk
+	}
+	return n, drainBytes, drainKeys
+}
+
 // Send sends all pending requests in the batcher.
 // returns tables sent FULLY in the current batch.
 func (b *Batcher) Send(ctx context.Context) {
@@ -333,7 +389,7 @@ func (b *Batcher) Send(ctx context.Context) {
 }
 
 func (b *Batcher) sendIfFull() {
-	if b.Len() >= b.batchSizeThreshold {
+	if b.overflow(true) {
 		log.Debug("sending batch because batcher is full", zap.Int("size", b.Len()))
 		b.asyncSend(SendUntilLessThanBatch)
 	}
@@ -353,6 +409,11 @@ func (b *Batcher) Add(tbs TableWithRange) {
 	b.cachedTables = append(b.cachedTables, tbs)
 	b.rewriteRules.Append(*tbs.RewriteRule)
 	atomic.AddInt32(&b.size, int32(len(tbs.Range)))
+	for _, rg := range tbs.Range {
+		bytes, keys := rg.BytesAndKeys()
+		atomic.AddUint64(&b.sizeBytes, bytes)
+		atomic.AddUint64(&b.sizeKeys, keys)
+	}
 	b.cachedTablesMu.Unlock()
 
 	b.sendIfFull()
@@ -373,3 +434,11 @@ func (b *Batcher) Close() {
 func (b *Batcher) SetThreshold(newThreshold int) {
 	b.batchSizeThreshold = newThreshold
 }
+
+// SetSizeThreshold sets the thresholds of the total bytes and keys of the
+// ranges of a batch, zero means unlimited. Like SetThreshold, set them before
+// anything starts.
+func (b *Batcher) SetSizeThreshold(bytes, keys uint64) {
+	b.batchBytesThreshold = bytes
+	b.batchKeysThreshold = keys
+}
@@ -10,6 +10,7 @@ import (
 
 	"github.com/pingcap/br/pkg/metautil"
 
+	backuppb "github.com/pingcap/kvproto/pkg/backup"
 	"github.com/pingcap/kvproto/pkg/import_sstpb"
 	"github.com/pingcap/log"
 	"go.uber.org/zap"
@@ -293,6 +294,41 @@ func (*testBatcherSuite) TestSplitRangeOnSameTable(c *C) {
 	}
 }
 
+func (*testBatcherSuite) TestSplitRangeBySize(c *C) {
+	ctx := context.Background()
+	errCh := make(chan error, 8)
+	sender := newDrySender()
+	manager := newMockManager()
+	batcher, _ := restore.NewBatcher(ctx, sender, manager, errCh)
+	batcher.SetThreshold(1024)
+	batcher.SetSizeThreshold(100, 0)
+
+	sizedRange := func(startKey, endKey string, size uint64) rtree.Range {
+		rg := fakeRange(startKey, endKey)
+		rg.Files = []*backuppb.File{{TotalBytes: size, TotalKvs: 1}}
+		return rg
+	}
+	simpleTable := fakeTableWithRange(1, []rtree.Range{
+		sizedRange("caa", "cab", 10), sizedRange("cac", "cad", 10),
+		// a range larger than the threshold makes up a batch alone.
+		sizedRange("cae", "caf", 200),
+		sizedRange("cag", "cai", 50), sizedRange("caj", "cak", 60),
+		sizedRange("cal", "cam", 30),
+	})
+
+	batcher.Add(simpleTable)
+	batcher.Close()
+	c.Assert(sender.BatchCount(), Equals, 4)
+
+	rngs := sender.Ranges()
+	c.Assert(rngs, DeepEquals, simpleTable.Range)
+	select {
+	case err := <-errCh:
+		c.Fatal(errors.Trace(err))
+	default:
+	}
+}
+
 func (*testBatcherSuite) TestRewriteRules(c *C) {
 	tableRanges := [][]rtree.Range{
 		{fakeRange("aaa", "aab")},
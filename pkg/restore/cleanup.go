@@ -0,0 +1,123 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package restore
+
+import (
+	"context"
+	"sync"
+
+	"github.com/google/uuid"
+	"github.com/pingcap/errors"
+	"github.com/pingcap/kvproto/pkg/import_sstpb"
+	"github.com/pingcap/kvproto/pkg/metapb"
+	"github.com/pingcap/log"
+	"go.uber.org/multierr"
+	"go.uber.org/zap"
+
+	berrors "github.com/pingcap/br/pkg/errors"
+)
+
+// downloadedSSTs records the UUIDs of the SST files downloaded into the
+// stores but not ingested yet, by the store IDs. TiKV removes a file once it's
+// ingested, while the files of the failed or aborted ingestions are left in
+// its import directory.
+type downloadedSSTs struct {
+	mu    sync.Mutex
+	files map[uint64]map[uuid.UUID]struct{}
+}
+
+func newDownloadedSSTs() *downloadedSSTs {
+	return &downloadedSSTs{files: make(map[uint64]map[uuid.UUID]struct{})}
+}
+
+// add records the file is being downloaded into the store. It's recorded
+// before downloading, as a failed download may leave the file.
+func (d *downloadedSSTs) add(storeID uint64, id uuid.UUID) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	files, ok := d.files[storeID]
+	if !ok {
+		files = make(map[uuid.UUID]struct{})
+		d.files[storeID] = files
+	}
+	files[id] = struct{}{}
+}
+
+// ingested removes the files ingested into the region from all its peers.
+func (d *downloadedSSTs) ingested(metas []*import_sstpb.SSTMeta, region *metapb.Region) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, peer := range region.GetPeers() {
+		files := d.files[peer.GetStoreId()]
+		for _, meta := range metas {
+			id, err := uuid.FromBytes(meta.GetUuid())
+			if err != nil {
+				continue
+			}
+			delete(files, id)
+		}
+	}
+}
+
+// drain returns the recorded files and clears them.
+func (d *downloadedSSTs) drain() map[uint64][]uuid.UUID {
+	if d == nil {
+		return nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	drained := make(map[uint64][]uuid.UUID, len(d.files))
+	for storeID, files := range d.files {
+		if len(files) == 0 {
+			continue
+		}
+		ids := make([]uuid.UUID, 0, len(files))
+		for id := range files {
+			ids = append(ids, id)
+		}
+		drained[storeID] = ids
+	}
+	d.files = make(map[uint64]map[uuid.UUID]struct{})
+	return drained
+}
+
+// CleanupDownloadedSSTs asks the import service of the stores to remove the
+// SST files downloaded but not ingested, e.g. after the restore is aborted.
+// The files are named by their UUIDs in the import directory of TiKV, so
+// they are cleared by the prefixes of the UUIDs. All the stores are tried
+// even if some fail.
+func (rc *Client) CleanupDownloadedSSTs(ctx context.Context) error {
+	drained := rc.downloadedSSTs.drain()
+	if len(drained) == 0 || rc.importClient == nil {
+		return nil
+	}
+	var errs error
+	for storeID, ids := range drained {
+		client, err := rc.importClient.GetImportClient(ctx, storeID)
+		if err != nil {
+			errs = multierr.Append(errs, errors.Annotatef(err, "store %d", storeID))
+			continue
+		}
+		cleared := 0
+		for _, id := range ids {
+			resp, err := client.ClearFiles(ctx, &import_sstpb.ClearRequest{Prefix: id.String()})
+			if err == nil && resp.GetError() != nil {
+				err = errors.Annotate(berrors.ErrKVUnknown, resp.GetError().GetMessage())
+			}
+			if err != nil {
+				errs = multierr.Append(errs, errors.Annotatef(err, "store %d, file %s", storeID, id))
+				continue
+			}
+			cleared++
+		}
+		log.Info("cleared the downloaded SST files not ingested",
+			zap.Uint64("store-id", storeID), zap.Int("cleared", cleared), zap.Int("files", len(ids)))
+	}
+	return errors.Trace(errs)
+}
@@ -0,0 +1,64 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package restore
+
+import (
+	"context"
+	"sort"
+
+	"github.com/google/uuid"
+	. "github.com/pingcap/check"
+	"github.com/pingcap/kvproto/pkg/import_sstpb"
+	"github.com/pingcap/kvproto/pkg/metapb"
+	"google.golang.org/grpc"
+)
+
+type fakeImportSSTClient struct {
+	import_sstpb.ImportSSTClient
+	cleared []string
+}
+
+func (f *fakeImportSSTClient) ClearFiles(
+	_ context.Context, req *import_sstpb.ClearRequest, _ ...grpc.CallOption,
+) (*import_sstpb.ClearResponse, error) {
+	f.cleared = append(f.cleared, req.GetPrefix())
+	return &import_sstpb.ClearResponse{}, nil
+}
+
+type fakeCleanupImporterClient struct {
+	ImporterClient
+	stores map[uint64]*fakeImportSSTClient
+}
+
+func (f *fakeCleanupImporterClient) GetImportClient(
+	_ context.Context, storeID uint64,
+) (import_sstpb.ImportSSTClient, error) {
+	return f.stores[storeID], nil
+}
+
+func (s *testImportSuite) TestCleanupDownloadedSSTs(c *C) {
+	downloaded := newDownloadedSSTs()
+	ingested, left := uuid.New(), uuid.New()
+	region := &metapb.Region{Peers: []*metapb.Peer{{StoreId: 1}, {StoreId: 2}}}
+	for _, peer := range region.Peers {
+		downloaded.add(peer.StoreId, ingested)
+		downloaded.add(peer.StoreId, left)
+	}
+	downloaded.ingested([]*import_sstpb.SSTMeta{{Uuid: ingested[:]}}, region)
+
+	importClient := &fakeCleanupImporterClient{stores: map[uint64]*fakeImportSSTClient{1: {}, 2: {}}}
+	rc := &Client{importClient: importClient, downloadedSSTs: downloaded}
+	c.Assert(rc.CleanupDownloadedSSTs(context.Background()), IsNil)
+	for _, store := range importClient.stores {
+		c.Assert(store.cleared, DeepEquals, []string{left.String()})
+	}
+
+	// The cleared files aren't cleared again.
+	c.Assert(rc.CleanupDownloadedSSTs(context.Background()), IsNil)
+	cleared := make([]string, 0, 2)
+	for _, store := range importClient.stores {
+		cleared = append(cleared, store.cleared...)
+	}
+	sort.Strings(cleared)
+	c.Assert(cleared, DeepEquals, []string{left.String(), left.String()})
+}
@@ -3,7 +3,6 @@
 package restore
 
 import (
-	"bytes"
 	"context"
 	"crypto/tls"
 	"encoding/hex"
@@ -28,7 +27,6 @@ import (
 	"github.com/pingcap/tidb/statistics/handle"
 	"github.com/pingcap/tidb/tablecodec"
 	"github.com/pingcap/tidb/util/codec"
-	"github.com/tikv/client-go/v2/oracle"
 	pd "github.com/tikv/pd/client"
 	"github.com/tikv/pd/server/schedule/placement"
 	"go.uber.org/zap"
@@ -44,7 +42,6 @@ import (
 	"github.com/pingcap/br/pkg/glue"
 	"github.com/pingcap/br/pkg/logutil"
 	"github.com/pingcap/br/pkg/pdutil"
-	"github.com/pingcap/br/pkg/redact"
 	"github.com/pingcap/br/pkg/storage"
 	"github.com/pingcap/br/pkg/summary"
 	"github.com/pingcap/br/pkg/utils"
@@ -54,13 +51,32 @@ import (
 // checksum tasks.
 const defaultChecksumConcurrency = 64
 
+// partitionChecksumParallelism is the number of the checksum requests sent at
+// the same time for a partitioned table, whose partitions have been split into
+// their own regions.
+const partitionChecksumParallelism = 4
+
+const (
+	// checksumShardKVs is the approximate number of the keys checksummed by
+	// each request of the record scan of a large table.
+	checksumShardKVs = 4 * 1024 * 1024
+	// maxChecksumShards is the max number of the requests the record scan of
+	// a table is split into, which are sent at the same time.
+	maxChecksumShards = 16
+)
+
 // Client sends requests to restore files.
 type Client struct {
-	pdClient      pd.Client
-	toolClient    SplitClient
-	fileImporter  FileImporter
+	pdClient     pd.Client
+	toolClient   SplitClient
+	fileImporter FileImporter
+	// importClient is shared by the file importers of all the backupmetas,
+	// it's created by the first InitBackupMeta and never replaced, so the
+	// speed limits can be set in background while the archives change.
+	importClient  ImporterClient
 	workerPool    *utils.WorkerPool
 	tlsConf       *tls.Config
+	pdTLSConf     *tls.Config
 	keepaliveConf keepalive.ClientParameters
 
 	databases  map[string]*utils.Database
@@ -80,13 +96,94 @@ type Client struct {
 	isOnline        bool
 	noSchema        bool
 	hasSpeedLimited bool
+	// dataOnly checks the existing tables are compatible with the backup
+	// when the tables are not created.
+	dataOnly bool
+	// splitWithoutScatter makes SplitRanges scatter the new regions after all
+	// regions are split.
+	splitWithoutScatter bool
+	// rawKVSplitCheck makes SplitRanges check whether the TiKV can split the
+	// regions by the raw keys.
+	rawKVSplitCheck bool
+	// failureDomainLabel is the label key of the failure domains verified
+	// after scattering, empty disables the verification.
+	failureDomainLabel string
+	rescatterViolating bool
+	// scatterLeader balances the leaders of the scattered regions.
+	scatterLeader bool
+	// skipScatter makes SplitRanges neither scatter the new regions nor wait
+	// for scattering.
+	skipScatter bool
+	// splitTargetSize is the size of the data each new region holds about
+	// when coalescing the split keys, 0 splits at every range.
+	splitTargetSize uint64
+	// regionNotFoundGrace is the duration of tolerating REGION_NOT_FOUND of
+	// the scattering regions.
+	regionNotFoundGrace time.Duration
+	// scatterWaitConcurrency and scatterWaitTimeout bound waiting for the
+	// scattering regions, the zero values keep the defaults.
+	scatterWaitConcurrency int
+	scatterWaitTimeout     time.Duration
+	// backoffPolicy is the policy of retrying split, scatter and the region
+	// scans, nil means utils.DefaultBackoffPolicy.
+	backoffPolicy utils.BackoffPolicy
+	// regionHeartbeatInterval is the region heartbeat interval of the
+	// cluster, which the polling intervals of SplitRanges are derived from.
+	regionHeartbeatInterval time.Duration
+	// splitCheckpoint records the split keys for resuming.
+	splitCheckpoint *SplitCheckpoint
+	// keyCodec encodes the keys of ranges into the keys of regions when
+	// splitting, nil means DefaultKeyCodec.
+	keyCodec KeyCodec
+	// quarantine records the tables failed to validate checksum if enabled.
+	quarantine *quarantinedTables
+	// failedDBs records the databases failed in DDLs if the isolation is
+	// enabled.
+	failedDBs *failedDatabases
+	// ddlBatchSize is the max number of the tables of a database created
+	// through one session in a batch.
+	ddlBatchSize uint
+	// throughput observes the restored batches if the ranges are merged
+	// dynamically.
+	throughput *ThroughputEstimator
+	// bandwidthProbe measures the throughput of the import workers if it
+	// isn't nil.
+	bandwidthProbe *utils.BandwidthProbe
+	// memory accounts the memory usage of the phases and sheds the
+	// concurrency of the import workers if it isn't nil.
+	memory *MemoryTracker
+	// hedgePDClient is the secondary PD client of the hedged reads if enabled.
+	hedgePDClient pd.Client
+	hedgeDelay    time.Duration
+	// grpcCompressor is the gRPC compressor of the Write requests carrying
+	// the KV pairs of CopyRanges.
+	grpcCompressor string
+	// storeAddressMap translates the advertised addresses of the stores when
+	// dialing them for importing.
+	storeAddressMap map[string]string
 
 	restoreStores []uint64
+	// tableRateLimiters are the bandwidth limiters of tables, keyed by the
+	// table ID in the backup.
+	tableRateLimiters map[int64]*throughputLimiter
+	// ingestedKVs counts the KV pairs of the ingested files for verifying
+	// the restored tables without the checksum.
+	ingestedKVs *ingestedKVCounter
+	// downloadedSSTs records the SST files downloaded but not ingested, see
+	// CleanupDownloadedSSTs.
+	downloadedSSTs *downloadedSSTs
+	// atomicCFIngest makes the raw restore ingest the files of different
+	// column families covering the same keys together.
+	atomicCFIngest bool
 
 	storage            storage.ExternalStorage
 	backend            *backuppb.StorageBackend
+	metaReader         *metautil.MetaReader
 	switchModeInterval time.Duration
 	switchCh           chan struct{}
+	// cipher decrypts the SST files of the encrypted backup, see
+	// EnableDecryption.
+	cipher *backuppb.CipherInfo
 
 	// statHandler and dom are used for analyze table after restore.
 	// it will backup stats with #dump.DumpStatsToJSON
@@ -123,10 +220,14 @@ func NewRestoreClient(
 		toolClient:    NewSplitClient(pdClient, tlsConf),
 		db:            db,
 		tlsConf:       tlsConf,
+		pdTLSConf:     tlsConf,
 		keepaliveConf: keepaliveConf,
 		switchCh:      make(chan struct{}),
 		dom:           dom,
 		statsHandler:  statsHandle,
+
+		regionNotFoundGrace: RegionNotFoundGracePeriod,
+		downloadedSSTs:      newDownloadedSSTs(),
 	}, nil
 }
 
@@ -194,11 +295,19 @@ func (rc *Client) InitBackupMeta(c context.Context, backupMeta *backuppb.BackupM
 		rc.ddlJobs = ddlJobs
 	}
 	rc.backupMeta = backupMeta
+	rc.metaReader = reader
 	log.Info("load backupmeta", zap.Int("databases", len(rc.databases)), zap.Int("jobs", len(rc.ddlJobs)))
 
-	metaClient := NewSplitClient(rc.pdClient, rc.tlsConf)
-	importCli := NewImportClient(metaClient, rc.tlsConf, rc.keepaliveConf)
-	rc.fileImporter = NewFileImporter(metaClient, importCli, backend, rc.backupMeta.IsRawKv, rc.rateLimit)
+	metaClient := rc.newSplitClient()
+	if rc.importClient == nil {
+		rc.importClient = newImportClient(metaClient, rc.tlsConf, rc.keepaliveConf, rc.storeAddressMap)
+	}
+	rc.fileImporter = NewFileImporter(metaClient, rc.importClient, backend, rc.backupMeta.IsRawKv, rc.rateLimit)
+	rc.fileImporter.ingestedKVs = rc.ingestedKVs
+	rc.fileImporter.atomicCF = rc.atomicCFIngest
+	rc.fileImporter.keyCodec = rc.keyCodec
+	rc.fileImporter.cipher = rc.cipher
+	rc.fileImporter.downloaded = rc.downloadedSSTs
 	return rc.fileImporter.CheckMultiIngestSupport(c, rc.pdClient)
 }
 
@@ -207,70 +316,147 @@ func (rc *Client) IsRawKvMode() bool {
 	return rc.backupMeta.IsRawKv
 }
 
-// GetFilesInRawRange gets all files that are in the given range or intersects with the given range.
-func (rc *Client) GetFilesInRawRange(startKey []byte, endKey []byte, cf string) ([]*backuppb.File, error) {
-	if !rc.IsRawKvMode() {
-		return nil, errors.Annotate(berrors.ErrRestoreModeMismatch, "the backup data is not in raw kv mode")
+// SetConcurrency sets the concurrency of dbs tables files.
+func (rc *Client) SetConcurrency(c uint) {
+	rc.workerPool = utils.NewWorkerPool(c, "file")
+}
+
+// EnableOnline sets the mode of restore to online.
+func (rc *Client) EnableOnline() {
+	rc.isOnline = true
+}
+
+// SetSplitCheckpoint sets the checkpoint of splitting regions, the ranges
+// recorded in it are not split again.
+func (rc *Client) SetSplitCheckpoint(cp *SplitCheckpoint) {
+	rc.splitCheckpoint = cp
+}
+
+// SetGRPCCompressor sets the gRPC compressor of the Write requests sending
+// the KV pairs of CopyRanges to TiKV, the name is returned by
+// ParseGRPCCompression. The Download and Ingest requests of the restore only
+// carry the metadata of the files, so they are never compressed.
+func (rc *Client) SetGRPCCompressor(compressor string) {
+	rc.grpcCompressor = compressor
+}
+
+// SetStoreAddressMap sets the map from the advertised addresses of the stores
+// to the addresses dialed for importing and splitting, the map is returned by
+// ParseStoreAddressMap. It should be called before InitBackupMeta.
+func (rc *Client) SetStoreAddressMap(addressMap map[string]string) {
+	rc.storeAddressMap = addressMap
+	rc.toolClient = rc.newToolClient()
+}
+
+// SetKeyCodec sets the codec encoding the keys into the keys of regions, for
+// the RawKV users whose keys are not encoded in the default memcomparable
+// format. It's used by SplitRanges, the rewrite of the keys and the placement
+// rules, and should be called before InitBackupMeta.
+func (rc *Client) SetKeyCodec(codec KeyCodec) {
+	rc.keyCodec = codec
+}
+
+// getKeyCodec returns the codec of the keys of regions.
+func (rc *Client) getKeyCodec() KeyCodec {
+	if rc.keyCodec == nil {
+		return DefaultKeyCodec
 	}
+	return rc.keyCodec
+}
 
-	for _, rawRange := range rc.backupMeta.RawRanges {
-		// First check whether the given range is backup-ed. If not, we cannot perform the restore.
-		if rawRange.Cf != cf {
-			continue
-		}
+// SetThroughputEstimator sets the estimator which observes the throughput of
+// RestoreFiles.
+func (rc *Client) SetThroughputEstimator(estimator *ThroughputEstimator) {
+	rc.throughput = estimator
+}
 
-		if (len(rawRange.EndKey) > 0 && bytes.Compare(startKey, rawRange.EndKey) >= 0) ||
-			(len(endKey) > 0 && bytes.Compare(rawRange.StartKey, endKey) >= 0) {
-			// The restoring range is totally out of the current range. Skip it.
-			continue
-		}
+// SetMemoryTracker makes the client account the memory of the batches and
+// the scanned regions, and serialize the import workers while the soft
+// limit of the tracker is exceeded.
+func (rc *Client) SetMemoryTracker(tracker *MemoryTracker) {
+	rc.memory = tracker
+}
 
-		if bytes.Compare(startKey, rawRange.StartKey) < 0 ||
-			utils.CompareEndKey(endKey, rawRange.EndKey) > 0 {
-			// Only partial of the restoring range is in the current backup-ed range. So the given range can't be fully
-			// restored.
-			return nil, errors.Annotatef(berrors.ErrRestoreRangeMismatch,
-				"the given range to restore [%s, %s) is not fully covered by the range that was backed up [%s, %s)",
-				redact.Key(startKey), redact.Key(endKey), redact.Key(rawRange.StartKey), redact.Key(rawRange.EndKey),
-			)
-		}
+// SetBandwidthProbe makes RestoreFiles report the files and the duration of
+// each import to the probe.
+func (rc *Client) SetBandwidthProbe(probe *utils.BandwidthProbe) {
+	rc.bandwidthProbe = probe
+}
 
-		// We have found the range that contains the given range. Find all necessary files.
-		files := make([]*backuppb.File, 0)
+// EnableAtomicCFIngest makes RestoreRaw ingest the files of the default and
+// write CF covering the same keys in a single request for each region, for
+// the RawKV users storing data in the TxnKV layout. So a crash or failure
+// never leaves the write CF records without their values in the default CF,
+// and a range is reported done only after both CFs are ingested. It should
+// be called before InitBackupMeta.
+func (rc *Client) EnableAtomicCFIngest() {
+	rc.atomicCFIngest = true
+}
 
-		for _, file := range rc.backupMeta.Files {
-			if file.Cf != cf {
-				continue
-			}
+// EnableRawKVSplitCheck makes SplitRanges check whether the TiKV can split
+// the regions by the raw keys, and split them by the memcomparable keys as
+// before if it can't, see RegionSplitter.SetRawKVSplitCheck.
+func (rc *Client) EnableRawKVSplitCheck() {
+	rc.rawKVSplitCheck = true
+}
 
-			if len(file.EndKey) > 0 && bytes.Compare(file.EndKey, startKey) < 0 {
-				// The file is before the range to be restored.
-				continue
-			}
-			if len(endKey) > 0 && bytes.Compare(endKey, file.StartKey) <= 0 {
-				// The file is after the range to be restored.
-				// The specified endKey is exclusive, so when it equals to a file's startKey, the file is still skipped.
-				continue
-			}
+// EnableSplitWithoutScatter makes SplitRanges split all regions first, then
+// scatter them in a single pass.
+func (rc *Client) EnableSplitWithoutScatter() {
+	rc.splitWithoutScatter = true
+}
 
-			files = append(files, file)
-		}
+// EnableFailureDomainCheck makes SplitRanges verify that the voters of the
+// scattered regions are placed in the stores with distinct values of the
+// label, and scatter the violating regions again if rescatter is true.
+func (rc *Client) EnableFailureDomainCheck(labelKey string, rescatter bool) {
+	rc.failureDomainLabel = labelKey
+	rc.rescatterViolating = rescatter
+}
 
-		// There should be at most one backed up range that covers the restoring range.
-		return files, nil
-	}
+// EnableScatterLeader makes SplitRanges balance the leaders of the new
+// regions over the stores of their voters after scattering.
+func (rc *Client) EnableScatterLeader() {
+	rc.scatterLeader = true
+}
 
-	return nil, errors.Annotate(berrors.ErrRestoreRangeMismatch, "no backup data in the range")
+// DisableScatter makes SplitRanges skip scattering the new regions, which
+// can never succeed when the cluster has no more stores than the replicas of
+// a region.
+func (rc *Client) DisableScatter() {
+	rc.skipScatter = true
 }
 
-// SetConcurrency sets the concurrency of dbs tables files.
-func (rc *Client) SetConcurrency(c uint) {
-	rc.workerPool = utils.NewWorkerPool(c, "file")
+// SetRegionNotFoundGrace sets the duration SplitRanges tolerates PD reporting
+// REGION_NOT_FOUND for a scattering region, before resolving the region
+// covering it. Zero treats REGION_NOT_FOUND as scattered at once.
+func (rc *Client) SetRegionNotFoundGrace(grace time.Duration) {
+	rc.regionNotFoundGrace = grace
 }
 
-// EnableOnline sets the mode of restore to online.
-func (rc *Client) EnableOnline() {
-	rc.isOnline = true
+// SetScatterWait sets the max number of concurrent operator queries and the
+// deadline shared by all the regions of waiting for scattering in SplitRanges.
+func (rc *Client) SetScatterWait(concurrency int, timeout time.Duration) {
+	rc.scatterWaitConcurrency = concurrency
+	rc.scatterWaitTimeout = timeout
+}
+
+// SetSplitTargetSize makes SplitRanges coalesce the split keys of the small
+// ranges, so that each new region holds about the size of the data.
+func (rc *Client) SetSplitTargetSize(size uint64) {
+	rc.splitTargetSize = size
+}
+
+// SetBackoffPolicy sets the policy of retrying split, scatter and the region
+// scans in SplitRanges.
+func (rc *Client) SetBackoffPolicy(policy utils.BackoffPolicy) {
+	rc.backoffPolicy = policy
+}
+
+// SetRegionHeartbeatInterval makes SplitRanges derive the polling intervals
+// of waiting for split and scatter from the region heartbeat interval.
+func (rc *Client) SetRegionHeartbeatInterval(interval time.Duration) {
+	rc.regionHeartbeatInterval = interval
 }
 
 // GetTLSConfig returns the tls config.
@@ -278,14 +464,11 @@ func (rc *Client) GetTLSConfig() *tls.Config {
 	return rc.tlsConf
 }
 
-// GetTS gets a new timestamp from PD.
-func (rc *Client) GetTS(ctx context.Context) (uint64, error) {
-	p, l, err := rc.pdClient.GetTS(ctx)
-	if err != nil {
-		return 0, errors.Trace(err)
-	}
-	restoreTS := oracle.ComposeTS(p, l)
-	return restoreTS, nil
+// SetPDTLSConfig sets the tls config for the HTTP API of PD, which is the same
+// as the one for TiKV by default. It should be called before InitBackupMeta.
+func (rc *Client) SetPDTLSConfig(pdTLSConf *tls.Config) {
+	rc.pdTLSConf = pdTLSConf
+	rc.toolClient = rc.newToolClient()
 }
 
 // ResetTS resets the timestamp of PD to a bigger value.
@@ -296,7 +479,7 @@ func (rc *Client) ResetTS(ctx context.Context, pdAddrs []string) error {
 	return utils.WithRetry(ctx, func() error {
 		idx := i % len(pdAddrs)
 		i++
-		return pdutil.ResetTS(ctx, pdAddrs[idx], restoreTS, rc.tlsConf)
+		return pdutil.ResetTS(ctx, pdAddrs[idx], restoreTS, rc.pdTLSConf)
 	}, newPDReqBackoffer())
 }
 
@@ -308,7 +491,7 @@ func (rc *Client) GetPlacementRules(ctx context.Context, pdAddrs []string) ([]pl
 		var err error
 		idx := i % len(pdAddrs)
 		i++
-		placementRules, err = pdutil.GetPlacementRules(ctx, pdAddrs[idx], rc.tlsConf)
+		placementRules, err = pdutil.GetPlacementRules(ctx, pdAddrs[idx], rc.pdTLSConf)
 		return errors.Trace(err)
 	}, newPDReqBackoffer())
 	return placementRules, errors.Trace(errRetry)
@@ -353,7 +536,7 @@ func (rc *Client) CreateDatabase(ctx context.Context, db *model.DBInfo) error {
 		log.Info("skip create database", zap.Stringer("database", db.Name))
 		return nil
 	}
-	return rc.db.CreateDatabase(ctx, db)
+	return rc.isolateDDLFailure(db.Name.O, rc.db.CreateDatabase(ctx, db))
 }
 
 // CreateTables creates multiple tables, and returns their rewrite rules.
@@ -411,12 +594,15 @@ func (rc *Client) createTable(
 	if err != nil {
 		return CreatedTable{}, errors.Trace(err)
 	}
-	if newTableInfo.IsCommonHandle != table.Info.IsCommonHandle {
+	if mismatch := clusteredIndexMismatch(table.Info, newTableInfo); len(mismatch) > 0 {
 		return CreatedTable{}, errors.Annotatef(berrors.ErrRestoreModeMismatch,
-			"Clustered index option mismatch. Restored cluster's @@tidb_enable_clustered_index should be %v (backup table = %v, created table = %v).",
-			transferBoolToValue(table.Info.IsCommonHandle),
-			table.Info.IsCommonHandle,
-			newTableInfo.IsCommonHandle)
+			"Clustered index option mismatch of table %s.%s. %s.",
+			utils.EncloseName(table.DB.Name.O), utils.EncloseName(table.Info.Name.O), mismatch)
+	}
+	if rc.dataOnly {
+		if err = CheckTableSchemaCompatible(table.Info, newTableInfo); err != nil {
+			return CreatedTable{}, errors.Trace(err)
+		}
 	}
 	rules := GetRewriteRules(newTableInfo, table.Info, newTS)
 	et := CreatedTable{
@@ -454,13 +640,19 @@ func (rc *Client) GoCreateTables(
 			return c.Err()
 		default:
 		}
+		if rc.isDatabaseFailed(t.DB.Name.O) {
+			log.Warn("skip create table of the failed database",
+				zap.Stringer("db", t.DB.Name),
+				zap.Stringer("table", t.Info.Name))
+			return nil
+		}
 		rt, err := rc.createTable(c, db, dom, t, newTS)
 		if err != nil {
 			log.Error("create table failed",
 				zap.Error(err),
 				zap.Stringer("db", t.DB.Name),
 				zap.Stringer("table", t.Info.Name))
-			return errors.Trace(err)
+			return rc.isolateDDLFailure(t.DB.Name.O, errors.Trace(err))
 		}
 		log.Debug("table created and send to next",
 			zap.Int("output chan size", len(outCh)),
@@ -505,11 +697,16 @@ func (rc *Client) createTablesWithDBPool(ctx context.Context,
 	tables []*metautil.Table, dbPool []*DB) error {
 	eg, ectx := errgroup.WithContext(ctx)
 	workers := utils.NewWorkerPool(uint(len(dbPool)), "DDL workers")
-	for _, t := range tables {
-		table := t
+	for _, b := range batchTablesByDatabase(tables, rc.ddlBatchSize) {
+		batch := b
 		workers.ApplyWithIDInErrorGroup(eg, func(id uint64) error {
 			db := dbPool[id%uint64(len(dbPool))]
-			return createOneTable(ectx, db, table)
+			for _, table := range batch {
+				if err := createOneTable(ectx, db, table); err != nil {
+					return errors.Trace(err)
+				}
+			}
+			return nil
 		})
 	}
 	return eg.Wait()
@@ -537,21 +734,41 @@ func (rc *Client) ExecDDLs(ctx context.Context, ddlJobs []*model.Job) error {
 
 func (rc *Client) setSpeedLimit(ctx context.Context) error {
 	if !rc.hasSpeedLimited && rc.rateLimit != 0 {
-		stores, err := conn.GetAllTiKVStores(ctx, rc.pdClient, conn.SkipTiFlash)
-		if err != nil {
+		if err := rc.SetDownloadSpeedLimit(ctx, rc.rateLimit); err != nil {
 			return errors.Trace(err)
 		}
-		for _, store := range stores {
-			err = rc.fileImporter.setDownloadSpeedLimit(ctx, store.GetId())
-			if err != nil {
-				return errors.Trace(err)
-			}
-		}
 		rc.hasSpeedLimited = true
 	}
 	return nil
 }
 
+// SetDownloadSpeedLimit sets the download speed limit of all TiKV stores,
+// e.g. to the rate limit tuned during restoring.
+func (rc *Client) SetDownloadSpeedLimit(ctx context.Context, rateLimit uint64) error {
+	stores, err := conn.GetAllTiKVStores(ctx, rc.pdClient, conn.SkipTiFlash)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	for _, store := range stores {
+		err = rc.fileImporter.setDownloadSpeedLimit(ctx, store.GetId(), rateLimit)
+		if err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
+
+// SetStoreDownloadSpeedLimit sets the download speed limit of a TiKV store,
+// e.g. by the AutoRateLimiter. It fails before InitBackupMeta.
+func (rc *Client) SetStoreDownloadSpeedLimit(ctx context.Context, storeID, rateLimit uint64) error {
+	if rc.importClient == nil {
+		return errors.Annotate(berrors.ErrRestoreNotInitialized, "the backupmeta isn't loaded")
+	}
+	req := &import_sstpb.SetDownloadSpeedLimitRequest{SpeedLimit: rateLimit}
+	_, err := rc.importClient.SetDownloadSpeedLimit(ctx, storeID, req)
+	return errors.Trace(err)
+}
+
 // isFilesBelongToSameRange check whether two files are belong to the same range with different cf.
 func isFilesBelongToSameRange(f1, f2 string) bool {
 	// the backup date file pattern is `{store_id}_{region_id}_{epoch_version}_{key}_{ts}_{cf}.sst`
@@ -584,6 +801,24 @@ func drainFilesByRange(files []*backuppb.File, supportMulti bool) ([]*backuppb.F
 	return files[:idx], files[idx:]
 }
 
+// importFiles imports the files, and reports them to the bandwidth probe if
+// any.
+func (rc *Client) importFiles(ctx context.Context, files []*backuppb.File, rewriteRules *RewriteRules) error {
+	start := time.Now()
+	if err := rc.fileImporter.Import(ctx, files, rewriteRules); err != nil {
+		return errors.Trace(err)
+	}
+	if rc.bandwidthProbe != nil {
+		var storageBytes, kvBytes uint64
+		for _, f := range files {
+			storageBytes += f.Size_
+			kvBytes += f.TotalBytes
+		}
+		rc.bandwidthProbe.Observe(storageBytes, kvBytes, time.Since(start))
+	}
+	return nil
+}
+
 // RestoreFiles tries to restore the files.
 func (rc *Client) RestoreFiles(
 	ctx context.Context,
@@ -597,6 +832,9 @@ func (rc *Client) RestoreFiles(
 		if err == nil {
 			log.Info("Restore files", zap.Duration("take", elapsed), logutil.Files(files))
 			summary.CollectSuccessUnit("files", len(files), elapsed)
+			if rc.throughput != nil {
+				rc.throughput.Observe(files, elapsed)
+			}
 		}
 	}()
 
@@ -626,7 +864,15 @@ func (rc *Client) RestoreFiles(
 						zap.Duration("take", time.Since(fileStart)))
 					updateCh.Inc()
 				}()
-				return rc.fileImporter.Import(ectx, filesReplica, rewriteRules)
+				release, errAcquire := rc.memory.Acquire(ectx)
+				if errAcquire != nil {
+					return errors.Trace(errAcquire)
+				}
+				defer release()
+				if err := rc.waitTableRateLimit(ectx, filesReplica); err != nil {
+					return errors.Trace(err)
+				}
+				return rc.importFiles(ectx, filesReplica, rewriteRules)
 			})
 	}
 
@@ -643,7 +889,7 @@ func (rc *Client) RestoreFiles(
 
 // RestoreRaw tries to restore raw keys in the specified range.
 func (rc *Client) RestoreRaw(
-	ctx context.Context, startKey []byte, endKey []byte, files []*backuppb.File, updateCh glue.Progress,
+	ctx context.Context, startKey []byte, endKey []byte, files []*backuppb.File, progress *BytesProgress,
 ) error {
 	start := time.Now()
 	defer func() {
@@ -662,12 +908,31 @@ func (rc *Client) RestoreRaw(
 		return errors.Trace(err)
 	}
 
-	for _, file := range files {
-		fileReplica := file
+	// The files of different column families in the same range, e.g. the
+	// write and default CF, are imported together to keep them paired.
+	groups := groupFilesByRange(files)
+	if rc.atomicCFIngest {
+		if !rc.fileImporter.supportMultiIngest {
+			return errors.Annotate(berrors.ErrRestoreCFNotAtomic,
+				"the TiKV stores don't support ingesting multiple SST files in one request")
+		}
+		// The files of different column families may have different ranges.
+		groups = groupFilesByOverlap(files)
+	}
+	for _, group := range groups {
+		groupReplica := group
 		rc.workerPool.ApplyOnErrorGroup(eg,
 			func() error {
-				defer updateCh.Inc()
-				return rc.fileImporter.Import(ectx, []*backuppb.File{fileReplica}, EmptyRewriteRule())
+				release, errAcquire := rc.memory.Acquire(ectx)
+				if errAcquire != nil {
+					return errors.Trace(errAcquire)
+				}
+				defer release()
+				if err := rc.importFiles(ectx, groupReplica, EmptyRewriteRule()); err != nil {
+					return errors.Trace(err)
+				}
+				progress.Add(FilesSize(groupReplica))
+				return nil
 			})
 	}
 	if err := eg.Wait(); err != nil {
@@ -683,6 +948,7 @@ func (rc *Client) RestoreRaw(
 		"finish to restore raw range",
 		logutil.Key("startKey", startKey),
 		logutil.Key("endKey", endKey),
+		zap.Uint64("bytes", progress.Done()),
 	)
 	return nil
 }
@@ -804,9 +1070,10 @@ func (rc *Client) GoValidateChecksum(
 					defer func() {
 						elapsed := time.Since(start)
 						summary.CollectDuration("restore checksum", elapsed)
+						restoreChecksumHistogram.Observe(elapsed.Seconds())
 						summary.CollectSuccessUnit("table checksum", 1, elapsed)
 					}()
-					err := rc.execChecksum(ectx, tbl, kvClient, concurrency)
+					err := rc.quarantineMismatch(tbl, rc.execChecksum(ectx, tbl, kvClient, concurrency))
 					if err != nil {
 						return errors.Trace(err)
 					}
@@ -840,10 +1107,23 @@ func (rc *Client) execChecksum(ctx context.Context, tbl CreatedTable, kvClient k
 	if err != nil {
 		return errors.Trace(err)
 	}
-	exe, err := checksum.NewExecutorBuilder(tbl.Table, startTS).
+	builder := checksum.NewExecutorBuilder(tbl.Table, startTS).
 		SetOldTable(tbl.OldTable).
-		SetConcurrency(concurrency).
-		Build()
+		SetConcurrency(concurrency)
+	parallelism := uint(1)
+	if tbl.Table.Partition != nil {
+		parallelism = partitionChecksumParallelism
+	}
+	// Split the record scan of a large table by the key counts of its backed
+	// up files, so it isn't checksummed by a single request.
+	if shards := checksumShards(tbl.OldTable.TotalKvs); shards > 1 {
+		builder.SetRecordShards(shards)
+		if shards > parallelism {
+			parallelism = shards
+		}
+	}
+	builder.SetParallelism(parallelism)
+	exe, err := builder.Build()
 	if err != nil {
 		return errors.Trace(err)
 	}
@@ -880,9 +1160,22 @@ func (rc *Client) execChecksum(ctx context.Context, tbl CreatedTable, kvClient k
 	return nil
 }
 
+// checksumShards returns the number of the requests the record scan of the
+// table with totalKvs keys is split into.
+func checksumShards(totalKvs uint64) uint {
+	shards := (totalKvs + checksumShardKVs - 1) / checksumShardKVs
+	if shards > maxChecksumShards {
+		shards = maxChecksumShards
+	}
+	return uint(shards)
+}
+
 const (
 	restoreLabelKey   = "exclusive"
 	restoreLabelValue = "restore"
+	// RawRestoreRuleID is the ID of the placement rule in the group pd,
+	// which places the raw range to restore on the restore stores.
+	RawRestoreRuleID = "restore-raw"
 )
 
 // LoadRestoreStores loads the stores used to restore data.
@@ -917,7 +1210,7 @@ func (rc *Client) LoadRestoreStores(ctx context.Context) error {
 
 // ResetRestoreLabels removes the exclusive labels of the restore stores.
 func (rc *Client) ResetRestoreLabels(ctx context.Context) error {
-	if !rc.isOnline {
+	if len(rc.restoreStores) == 0 {
 		return nil
 	}
 	log.Info("start reseting store labels")
@@ -930,17 +1223,10 @@ func (rc *Client) SetupPlacementRules(ctx context.Context, tables []*model.Table
 		return nil
 	}
 	log.Info("start setting placement rules")
-	rule, err := rc.toolClient.GetPlacementRule(ctx, "pd", "default")
+	rule, err := rc.newRestorePlacementRule(ctx)
 	if err != nil {
 		return errors.Trace(err)
 	}
-	rule.Index = 100
-	rule.Override = true
-	rule.LabelConstraints = append(rule.LabelConstraints, placement.LabelConstraint{
-		Key:    restoreLabelKey,
-		Op:     "in",
-		Values: []string{restoreLabelValue},
-	})
 	for _, t := range tables {
 		rule.ID = rc.getRuleID(t.ID)
 		rule.StartKeyHex = hex.EncodeToString(codec.EncodeBytes([]byte{}, tablecodec.EncodeTablePrefix(t.ID)))
@@ -954,6 +1240,23 @@ func (rc *Client) SetupPlacementRules(ctx context.Context, tables []*model.Table
 	return nil
 }
 
+// newRestorePlacementRule creates a placement rule based on the default rule,
+// which only places the peers on the restore stores.
+func (rc *Client) newRestorePlacementRule(ctx context.Context) (placement.Rule, error) {
+	rule, err := rc.toolClient.GetPlacementRule(ctx, "pd", "default")
+	if err != nil {
+		return rule, errors.Trace(err)
+	}
+	rule.Index = 100
+	rule.Override = true
+	rule.LabelConstraints = append(rule.LabelConstraints, placement.LabelConstraint{
+		Key:    restoreLabelKey,
+		Op:     "in",
+		Values: []string{restoreLabelValue},
+	})
+	return rule, nil
+}
+
 // WaitPlacementSchedule waits PD to move tables to restore stores.
 func (rc *Client) WaitPlacementSchedule(ctx context.Context, tables []*model.TableInfo) error {
 	if !rc.isOnline || len(rc.restoreStores) == 0 {
@@ -1038,6 +1341,172 @@ func (rc *Client) getRuleID(tableID int64) string {
 	return "restore-t" + strconv.FormatInt(tableID, 10)
 }
 
+// LoadRawRestoreStores selects the stores which receive the restored raw kv
+// data, and labels them as the restore stores. Each selector is either a store
+// ID, or a store label in the form of `key=value`.
+func (rc *Client) LoadRawRestoreStores(ctx context.Context, selectors []string) error {
+	if len(selectors) == 0 {
+		return nil
+	}
+	stores, err := conn.GetAllTiKVStores(ctx, rc.pdClient, conn.SkipTiFlash)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	selected, err := selectStores(stores, selectors)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	rc.restoreStores = selected
+	log.Info("load raw restore stores", zap.Uint64s("store-ids", rc.restoreStores))
+	return rc.toolClient.SetStoresLabel(ctx, rc.restoreStores, restoreLabelKey, restoreLabelValue)
+}
+
+// selectStores returns the IDs of the up stores matching any of the selectors.
+// It fails if some selector matches nothing, which is likely a typo.
+func selectStores(stores []*metapb.Store, selectors []string) ([]uint64, error) {
+	matched := make(map[uint64]struct{})
+	for _, selector := range selectors {
+		found := false
+		labelKey, labelValue, isLabel := parseStoreLabel(selector)
+		var storeID uint64
+		if !isLabel {
+			id, err := strconv.ParseUint(selector, 10, 64)
+			if err != nil {
+				return nil, errors.Annotatef(berrors.ErrInvalidArgument,
+					"invalid store selector '%s', expect a store ID or a label like 'key=value'", selector)
+			}
+			storeID = id
+		}
+		for _, s := range stores {
+			if s.GetState() != metapb.StoreState_Up {
+				continue
+			}
+			if isLabel {
+				for _, l := range s.GetLabels() {
+					if l.GetKey() == labelKey && l.GetValue() == labelValue {
+						matched[s.GetId()] = struct{}{}
+						found = true
+						break
+					}
+				}
+			} else if s.GetId() == storeID {
+				matched[s.GetId()] = struct{}{}
+				found = true
+			}
+		}
+		if !found {
+			return nil, errors.Annotatef(berrors.ErrInvalidArgument, "no up TiKV store matches '%s'", selector)
+		}
+	}
+	ids := make([]uint64, 0, len(matched))
+	for id := range matched {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids, nil
+}
+
+func parseStoreLabel(selector string) (key, value string, ok bool) {
+	parts := strings.SplitN(selector, "=", 2)
+	if len(parts) != 2 {
+		return "", "", false
+	}
+	return strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]), true
+}
+
+// rawRangeKeyHex returns the hex of the raw key encoded by the codec, an
+// empty end key stays empty to represent +inf.
+func rawRangeKeyHex(keyCodec KeyCodec, key []byte, isEnd bool) string {
+	if isEnd && len(key) == 0 {
+		return ""
+	}
+	return hex.EncodeToString(keyCodec.EncodeKey(key))
+}
+
+// SetupRawPlacementRule sets the rule placing the regions of the raw range
+// onto the restore stores.
+func (rc *Client) SetupRawPlacementRule(ctx context.Context, startKey, endKey []byte) error {
+	if len(rc.restoreStores) == 0 {
+		return nil
+	}
+	log.Info("start setting placement rule for raw range")
+	rule, err := rc.newRestorePlacementRule(ctx)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if err = checkStoresForRule(len(rc.restoreStores), rule); err != nil {
+		return errors.Trace(err)
+	}
+	rule.ID = RawRestoreRuleID
+	rule.StartKeyHex = rawRangeKeyHex(rc.getKeyCodec(), startKey, false)
+	rule.EndKeyHex = rawRangeKeyHex(rc.getKeyCodec(), endKey, true)
+	return errors.Trace(rc.toolClient.SetPlacementRule(ctx, rule))
+}
+
+// checkStoresForRule checks there are enough restore stores to place all the
+// replicas of the rule, otherwise PD can never finish the schedule.
+func checkStoresForRule(storeCount int, rule placement.Rule) error {
+	if storeCount < rule.Count {
+		return errors.Annotatef(berrors.ErrInvalidArgument,
+			"only %d restore stores are selected, but the placement rule needs %d replicas", storeCount, rule.Count)
+	}
+	return nil
+}
+
+// WaitRawPlacementSchedule waits PD to move the raw range to restore stores.
+// It fails if the schedule isn't finished in the timeout, a non-positive
+// timeout waits until the context is done.
+func (rc *Client) WaitRawPlacementSchedule(ctx context.Context, startKey, endKey []byte, timeout time.Duration) error {
+	if len(rc.restoreStores) == 0 {
+		return nil
+	}
+	log.Info("start waiting placement schedule for raw range", zap.Duration("timeout", timeout))
+	start := rc.getKeyCodec().EncodeKey(startKey)
+	var end []byte
+	if len(endKey) > 0 {
+		end = rc.getKeyCodec().EncodeKey(endKey)
+	}
+	var deadline <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+	ticker := time.NewTicker(time.Second * 10)
+	defer ticker.Stop()
+	progress := "not checked"
+	for {
+		select {
+		case <-ticker.C:
+			ok, p, err := rc.checkRange(ctx, start, end)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			if ok {
+				log.Info("finish waiting placement schedule for raw range")
+				return nil
+			}
+			progress = p
+			log.Info("placement schedule progress: " + progress)
+		case <-deadline:
+			return errors.Annotatef(berrors.ErrRestorePlacementTimeout,
+				"the raw range isn't moved to the restore stores %v in %s, progress: %s",
+				rc.restoreStores, timeout, progress)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// ResetRawPlacementRule removes the placement rule for the raw range.
+func (rc *Client) ResetRawPlacementRule(ctx context.Context) error {
+	if len(rc.restoreStores) == 0 {
+		return nil
+	}
+	log.Info("start reseting placement rule for raw range")
+	return errors.Trace(rc.toolClient.DeletePlacementRule(ctx, "pd", RawRestoreRuleID))
+}
+
 // IsIncremental returns whether this backup is incremental.
 func (rc *Client) IsIncremental() bool {
 	return !(rc.backupMeta.StartVersion == rc.backupMeta.EndVersion ||
@@ -1049,6 +1518,14 @@ func (rc *Client) EnableSkipCreateSQL() {
 	rc.noSchema = true
 }
 
+// EnableDataOnly skips creating schemas and tables, and restores the data
+// into the existing tables after checking their schemas are compatible with
+// the backup.
+func (rc *Client) EnableDataOnly() {
+	rc.noSchema = true
+	rc.dataOnly = true
+}
+
 // IsSkipCreateSQL returns whether we need skip create schema and tables in restore.
 func (rc *Client) IsSkipCreateSQL() bool {
 	return rc.noSchema
@@ -1071,50 +1548,77 @@ func (rc *Client) PreCheckTableTiFlashReplica(
 			// see details at https://github.com/pingcap/br/issues/931
 			table.Info.TiFlashReplica = nil
 		}
+		if table.TiFlashReplicas > tiFlashStoreCount {
+			table.TiFlashReplicas = 0
+		}
 	}
 	return nil
 }
 
 // PreCheckTableClusterIndex checks whether backup tables and existed tables have different cluster index options。
+// The rows can't be converted between clustered and non-clustered primary
+// keys, so all the mismatched tables are reported at once before restoring.
 func (rc *Client) PreCheckTableClusterIndex(
 	tables []*metautil.Table,
 	ddlJobs []*model.Job,
 	dom *domain.Domain,
 ) error {
-	for _, table := range tables {
-		oldTableInfo, err := rc.GetTableSchema(dom, table.DB.Name, table.Info.Name)
+	var mismatches []string
+	check := func(dbName model.CIStr, tableInfo *model.TableInfo) {
+		oldTableInfo, err := rc.GetTableSchema(dom, dbName, tableInfo.Name)
 		// table exists in database
-		if err == nil {
-			if table.Info.IsCommonHandle != oldTableInfo.IsCommonHandle {
-				return errors.Annotatef(berrors.ErrRestoreModeMismatch,
-					"Clustered index option mismatch. Restored cluster's @@tidb_enable_clustered_index should be %v (backup table = %v, created table = %v).",
-					transferBoolToValue(table.Info.IsCommonHandle),
-					table.Info.IsCommonHandle,
-					oldTableInfo.IsCommonHandle)
-			}
+		if err != nil {
+			return
+		}
+		if mismatch := clusteredIndexMismatch(tableInfo, oldTableInfo); len(mismatch) > 0 {
+			name := utils.EncloseName(dbName.O) + "." + utils.EncloseName(tableInfo.Name.O)
+			log.Warn("clustered index option mismatch", zap.String("table", name), zap.String("detail", mismatch))
+			mismatches = append(mismatches, name+": "+mismatch)
 		}
 	}
+	for _, table := range tables {
+		check(table.DB.Name, table.Info)
+	}
 	for _, job := range ddlJobs {
 		if job.Type == model.ActionCreateTable {
 			tableInfo := job.BinlogInfo.TableInfo
 			if tableInfo != nil {
-				oldTableInfo, err := rc.GetTableSchema(dom, model.NewCIStr(job.SchemaName), tableInfo.Name)
-				// table exists in database
-				if err == nil {
-					if tableInfo.IsCommonHandle != oldTableInfo.IsCommonHandle {
-						return errors.Annotatef(berrors.ErrRestoreModeMismatch,
-							"Clustered index option mismatch. Restored cluster's @@tidb_enable_clustered_index should be %v (backup table = %v, created table = %v).",
-							transferBoolToValue(tableInfo.IsCommonHandle),
-							tableInfo.IsCommonHandle,
-							oldTableInfo.IsCommonHandle)
-					}
-				}
+				check(model.NewCIStr(job.SchemaName), tableInfo)
 			}
 		}
 	}
+	if len(mismatches) > 0 {
+		return errors.Annotatef(berrors.ErrRestoreModeMismatch,
+			"Clustered index option mismatch of %d tables, the rows can't be converted between "+
+				"clustered and non-clustered primary keys. %s.",
+			len(mismatches), strings.Join(mismatches, "; "))
+	}
 	return nil
 }
 
+// clusteredIndexMismatch returns the details if the backup table and the
+// existing table encode the handles of the rows differently, empty if they
+// are the same.
+func clusteredIndexMismatch(backup, existing *model.TableInfo) string {
+	if backup.IsCommonHandle != existing.IsCommonHandle {
+		return fmt.Sprintf("Restored cluster's @@tidb_enable_clustered_index should be %v (backup table = %v, created table = %v)",
+			transferBoolToValue(backup.IsCommonHandle),
+			backup.IsCommonHandle,
+			existing.IsCommonHandle)
+	}
+	if backup.PKIsHandle != existing.PKIsHandle {
+		kind := "NONCLUSTERED"
+		if backup.PKIsHandle {
+			kind = "CLUSTERED"
+		}
+		return fmt.Sprintf("The integer primary key should be %s (backup table = %v, created table = %v)",
+			kind,
+			backup.PKIsHandle,
+			existing.PKIsHandle)
+	}
+	return ""
+}
+
 func transferBoolToValue(enable bool) string {
 	if enable {
 		return "ON"
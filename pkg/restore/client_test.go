@@ -6,6 +6,7 @@ import (
 	"context"
 	"math"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/pingcap/br/pkg/metautil"
@@ -16,6 +17,7 @@ import (
 	"github.com/pingcap/parser/mysql"
 	"github.com/pingcap/parser/types"
 	"github.com/pingcap/tidb/tablecodec"
+	"github.com/pingcap/tidb/util/testkit"
 	"github.com/pingcap/tidb/util/testleak"
 	pd "github.com/tikv/pd/client"
 	"google.golang.org/grpc/keepalive"
@@ -23,6 +25,7 @@ import (
 	"github.com/pingcap/br/pkg/gluetidb"
 	"github.com/pingcap/br/pkg/mock"
 	"github.com/pingcap/br/pkg/restore"
+	"github.com/pingcap/br/pkg/utils"
 )
 
 var _ = Suite(&testRestoreClientSuite{})
@@ -103,6 +106,48 @@ func (s *testRestoreClientSuite) TestCreateTables(c *C) {
 	}
 }
 
+func (s *testRestoreClientSuite) TestIsolateDDLFailures(c *C) {
+	c.Assert(s.mock.Start(), IsNil)
+	defer s.mock.Stop()
+	client, err := restore.NewRestoreClient(gluetidb.New(), s.mock.PDClient, s.mock.Storage, nil, defaultKeepaliveCfg)
+	c.Assert(err, IsNil)
+	client.EnableDDLFailureIsolation()
+
+	info, err := s.mock.Domain.GetSnapshotInfoSchema(math.MaxUint64)
+	c.Assert(err, IsNil)
+	dbSchema, isExist := info.SchemaByName(model.NewCIStr("test"))
+	c.Assert(isExist, IsTrue)
+	// The database isn't created, so creating its tables fails.
+	missing := &model.DBInfo{Name: model.NewCIStr("missing")}
+
+	intField := types.NewFieldType(mysql.TypeLong)
+	intField.Charset = "binary"
+	tables := make([]*metautil.Table, 0, 4)
+	for i, db := range []*model.DBInfo{missing, dbSchema, missing, dbSchema} {
+		tables = append(tables, &metautil.Table{
+			DB: db,
+			Info: &model.TableInfo{
+				ID:   int64(i),
+				Name: model.NewCIStr("isolated" + strconv.Itoa(i)),
+				Columns: []*model.ColumnInfo{{
+					ID:        1,
+					Name:      model.NewCIStr("id"),
+					FieldType: *intField,
+					State:     model.StatePublic,
+				}},
+				Charset: "utf8mb4",
+				Collate: "utf8mb4_bin",
+			},
+		})
+	}
+	_, newTables, err := client.CreateTables(s.mock.Domain, tables, 0)
+	c.Assert(err, IsNil)
+	c.Assert(newTables, HasLen, 2)
+	c.Assert(newTables[0].Name.O, Equals, "isolated1")
+	c.Assert(newTables[1].Name.O, Equals, "isolated3")
+	c.Assert(client.FailedDatabases(), DeepEquals, []string{"`missing`"})
+}
+
 func (s *testRestoreClientSuite) TestIsOnline(c *C) {
 	c.Assert(s.mock.Start(), IsNil)
 	defer s.mock.Stop()
@@ -171,8 +216,15 @@ func (s *testRestoreClientSuite) TestPreCheckTableClusterIndex(c *C) {
 	c.Assert(client.PreCheckTableClusterIndex(nil, jobs, s.mock.Domain),
 		ErrorMatches, `.*@@tidb_enable_clustered_index should be ON \(backup table = true, created table = false\).*`)
 
+	// all the mismatched tables are reported
+	tables[2].Info.PKIsHandle = true
+	c.Assert(client.PreCheckTableClusterIndex(tables, nil, s.mock.Domain), ErrorMatches,
+		".*mismatch of 2 tables.*`test`.`test1`: .*should be ON.*`test`.`test2`: .*should be CLUSTERED "+
+			`\(backup table = true, created table = false\).*`)
+
 	// should pass pre-check cluster index
 	tables[1].Info.IsCommonHandle = false
+	tables[2].Info.PKIsHandle = false
 	jobs[0].BinlogInfo.TableInfo.IsCommonHandle = false
 	c.Assert(client.PreCheckTableClusterIndex(tables, jobs, s.mock.Domain), IsNil)
 }
@@ -247,3 +299,148 @@ func (s *testRestoreClientSuite) TestPreCheckTableTiFlashReplicas(c *C) {
 		}
 	}
 }
+
+func (s *testRestoreClientSuite) TestStashTiFlashReplicas(c *C) {
+	db := &model.DBInfo{Name: model.NewCIStr("db")}
+	tables := []*metautil.Table{
+		{DB: db, Info: &model.TableInfo{Name: model.NewCIStr("t0")}},
+		{DB: db, Info: &model.TableInfo{
+			Name:           model.NewCIStr("t1"),
+			TiFlashReplica: &model.TiFlashReplicaInfo{Count: 2, LocationLabels: []string{"zone", "rack"}},
+		}},
+		// the backups of the old versions only record the count in backupmeta.
+		{DB: db, Info: &model.TableInfo{Name: model.NewCIStr("t2")}, TiFlashReplicas: 1},
+	}
+	replicas := restore.StashTiFlashReplicas(tables)
+	c.Assert(replicas, HasLen, 2)
+	c.Assert(tables[1].Info.TiFlashReplica, IsNil)
+	c.Assert(replicas[0].AlterSQL(), Equals,
+		"ALTER TABLE `db`.`t1` SET TIFLASH REPLICA 2 LOCATION LABELS \"zone\", \"rack\"")
+	c.Assert(replicas[1].AlterSQL(), Equals, "ALTER TABLE `db`.`t2` SET TIFLASH REPLICA 1")
+}
+
+type constMangler string
+
+func (m constMangler) MangleTableName(_, _ string) string {
+	return string(m)
+}
+
+func (s *testRestoreClientSuite) TestMangleTableNames(c *C) {
+	db := &model.DBInfo{Name: model.NewCIStr("db")}
+	sysDB := &model.DBInfo{Name: utils.TemporaryDBName("mysql")}
+	newTables := func() []*metautil.Table {
+		return []*metautil.Table{
+			{DB: db, Info: &model.TableInfo{Name: model.NewCIStr("t")}},
+			{DB: db, Info: &model.TableInfo{Name: model.NewCIStr("t_restored")}},
+			{DB: sysDB, Info: &model.TableInfo{Name: model.NewCIStr("user")}},
+		}
+	}
+	mangler := restore.AffixMangler{Prefix: "new_", Suffix: "_restored"}
+
+	tables := newTables()
+	c.Assert(restore.MangleTableNames(tables, nil, mangler), IsNil)
+	c.Assert(tables[0].Info.Name.O, Equals, "new_t_restored")
+	c.Assert(tables[1].Info.Name.O, Equals, "new_t_restored_restored")
+	c.Assert(tables[2].Info.Name.O, Equals, "user")
+
+	// the names conflict, none of the tables is renamed.
+	tables = newTables()
+	err := restore.MangleTableNames(tables, nil, constMangler("t"))
+	c.Assert(err, ErrorMatches, ".*conflicts with another table.*")
+	c.Assert(tables[0].Info.Name.O, Equals, "t")
+
+	tables = append(newTables(), &metautil.Table{
+		DB: db, Info: &model.TableInfo{Name: model.NewCIStr("v"), View: &model.ViewInfo{}},
+	})
+	c.Assert(restore.MangleTableNames(tables, nil, mangler), ErrorMatches, ".*can't rename the view.*")
+	c.Assert(restore.MangleTableNames(newTables(), []*model.Job{{}}, mangler), ErrorMatches, ".*ddl jobs.*")
+}
+
+func (s *testRestoreClientSuite) TestLoadRawRestoreStoresWithInvalidSelectors(c *C) {
+	c.Assert(s.mock.Start(), IsNil)
+	defer s.mock.Stop()
+
+	mockStores := []*metapb.Store{
+		{
+			Id:     1,
+			State:  metapb.StoreState_Up,
+			Labels: []*metapb.StoreLabel{{Key: "zone", Value: "z1"}},
+		},
+		{
+			Id:     2,
+			State:  metapb.StoreState_Offline,
+			Labels: []*metapb.StoreLabel{{Key: "zone", Value: "z2"}},
+		},
+	}
+	client, err := restore.NewRestoreClient(gluetidb.New(), fakePDClient{
+		stores: mockStores,
+	}, s.mock.Storage, nil, defaultKeepaliveCfg)
+	c.Assert(err, IsNil)
+
+	ctx := context.Background()
+	c.Assert(client.LoadRawRestoreStores(ctx, nil), IsNil)
+	c.Assert(client.LoadRawRestoreStores(ctx, []string{"store-1"}), ErrorMatches, ".*invalid store selector.*")
+	c.Assert(client.LoadRawRestoreStores(ctx, []string{"3"}), ErrorMatches, ".*no up TiKV store matches '3'.*")
+	c.Assert(client.LoadRawRestoreStores(ctx, []string{"zone=z2"}), ErrorMatches, ".*no up TiKV store matches 'zone=z2'.*")
+}
+
+func (s *testRestoreClientSuite) TestSetTableRateLimits(c *C) {
+	c.Assert(s.mock.Start(), IsNil)
+	defer s.mock.Stop()
+
+	client, err := restore.NewRestoreClient(gluetidb.New(), fakePDClient{}, s.mock.Storage, nil, defaultKeepaliveCfg)
+	c.Assert(err, IsNil)
+
+	c.Assert(client.SetTableRateLimits(nil), IsNil)
+	c.Assert(client.SetTableRateLimits(map[string]uint64{"test.t": 0}), ErrorMatches, ".*must be positive.*")
+	c.Assert(client.SetTableRateLimits(map[string]uint64{"test.t": 1024}), ErrorMatches, ".*test.t with rate limit is not found.*")
+}
+
+func (s *testRestoreClientSuite) TestQuarantineMismatchedTables(c *C) {
+	c.Assert(s.mock.Start(), IsNil)
+	defer s.mock.Stop()
+
+	client, err := restore.NewRestoreClient(gluetidb.New(), fakePDClient{}, s.mock.Storage, nil, defaultKeepaliveCfg)
+	c.Assert(err, IsNil)
+	client.EnableKVCountVerification()
+	client.EnableChecksumQuarantine()
+
+	tables := make(chan restore.CreatedTable, 2)
+	for _, name := range []string{"t2", "t1"} {
+		tables <- restore.CreatedTable{OldTable: &metautil.Table{
+			DB:       &model.DBInfo{Name: model.NewCIStr("test")},
+			Info:     &model.TableInfo{ID: 1, Name: model.NewCIStr(name)},
+			TotalKvs: 10,
+		}}
+	}
+	close(tables)
+	errCh := make(chan error, 2)
+	<-client.GoValidateKVCount(context.Background(), tables, errCh, &countProgress{})
+	c.Assert(errCh, HasLen, 0)
+	c.Assert(client.QuarantinedTables(), DeepEquals, []restore.QuarantinedTable{
+		{DB: "test", Table: "t1"}, {DB: "test", Table: "t2"},
+	})
+
+	// The quarantined tables are moved out of their database.
+	tk := testkit.NewTestKit(c, s.mock.Storage)
+	tk.MustExec("create database if not exists test")
+	tk.MustExec("create table test.t1 (a int)")
+	tk.MustExec("create table test.t2 (a int)")
+	tk.MustExec("create table test.t3 (a int)")
+	c.Assert(client.QuarantineTables(context.Background()), IsNil)
+	tk.MustQuery("show tables in test").Check(testkit.Rows("t3"))
+	tk.MustQuery("show tables in " + restore.QuarantineSchema).Check(testkit.Rows("test__t1", "test__t2"))
+}
+
+func (s *testRestoreClientSuite) TestQuarantinedName(c *C) {
+	t := restore.QuarantinedTable{DB: "db", Table: "t"}
+	c.Assert(t.String(), Equals, "`db`.`t`")
+	c.Assert(t.QuarantinedName(), Equals, "db__t")
+
+	long := restore.QuarantinedTable{DB: strings.Repeat("d", 40), Table: strings.Repeat("t", 40)}
+	name := long.QuarantinedName()
+	c.Assert(name, HasLen, mysql.MaxTableNameLength)
+	c.Assert(strings.HasPrefix(name, strings.Repeat("d", 40)+"__"), IsTrue)
+	other := restore.QuarantinedTable{DB: long.DB, Table: long.Table + "2"}
+	c.Assert(other.QuarantinedName(), Not(Equals), name)
+}
@@ -0,0 +1,231 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package restore
+
+import (
+	"bytes"
+	"context"
+	"sort"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/log"
+	tidbkv "github.com/pingcap/tidb/kv"
+	"github.com/pingcap/tipb/go-tipb"
+	"go.uber.org/zap"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/pingcap/br/pkg/checksum"
+	berrors "github.com/pingcap/br/pkg/errors"
+	"github.com/pingcap/br/pkg/glue"
+	"github.com/pingcap/br/pkg/kv"
+	"github.com/pingcap/br/pkg/logutil"
+	"github.com/pingcap/br/pkg/metautil"
+	"github.com/pingcap/br/pkg/redact"
+	"github.com/pingcap/br/pkg/rtree"
+	"github.com/pingcap/br/pkg/utils"
+)
+
+const (
+	// copyBatchPairs and copyBatchSize bound the KV pairs scanned from the
+	// source cluster before writing them into the destination cluster.
+	copyBatchPairs = 40960
+	copyBatchSize  = 64 * 1024 * 1024
+	// copyWriteKVPairs is the count of the KV pairs sent by one Write request.
+	copyWriteKVPairs = 1280
+)
+
+// CopyRanges copies the KV pairs of the ranges in the source cluster at
+// backupTS into this cluster, with the keys rewritten by the rewrite rules.
+// BR scans the source cluster and writes the pairs into TiKV by the Write and
+// Ingest RPCs of ImportSST, so the data never lands in external storage.
+func (rc *Client) CopyRanges(
+	ctx context.Context,
+	source tidbkv.Storage,
+	ranges []rtree.Range,
+	backupTS uint64,
+	rewriteRules *RewriteRules,
+	concurrency uint,
+	updateCh glue.Progress,
+) error {
+	commitTS, err := rc.GetTS(ctx)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	cfg := concurrencyCfg{
+		Concurrency:       concurrency,
+		BatchWriteKVPairs: copyWriteKVPairs,
+		IngestConcurrency: concurrency * 16,
+		TCPConcurrency:    int(concurrency) * 16,
+	}
+	ingester := NewIngester(rc.newSplitClient(), cfg, commitTS, rc.tlsConf)
+	ingester.SetGRPCCompressor(rc.grpcCompressor)
+	defer ingester.conns.Close()
+
+	snapshot := source.GetSnapshot(tidbkv.NewVersion(backupTS))
+	workerPool := utils.NewWorkerPool(concurrency, "copy")
+	eg, ectx := errgroup.WithContext(ctx)
+	for _, r := range ranges {
+		rg := r
+		workerPool.ApplyOnErrorGroup(eg, func() error {
+			if err := copyRange(ectx, snapshot, ingester.WriteAndIngest, rg, rewriteRules); err != nil {
+				return errors.Annotatef(err, "failed to copy range [%s, %s)",
+					redact.Key(rg.StartKey), redact.Key(rg.EndKey))
+			}
+			updateCh.Inc()
+			return nil
+		})
+	}
+	return errors.Trace(eg.Wait())
+}
+
+// copyRange scans the range in batches, and writes each batch of the sorted
+// pairs by write.
+func copyRange(
+	ctx context.Context,
+	snapshot tidbkv.Snapshot,
+	write func(context.Context, kv.Pairs) error,
+	rg rtree.Range,
+	rewriteRules *RewriteRules,
+) error {
+	iter, err := snapshot.Iter(rg.StartKey, rg.EndKey)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer iter.Close()
+
+	pairs := make(kv.Pairs, 0, copyBatchPairs)
+	size := 0
+	total := 0
+	flush := func() error {
+		if len(pairs) == 0 {
+			return nil
+		}
+		// The keys of a range share the table prefix, the sorting only
+		// guards the rules mapping the prefixes out of order.
+		sort.Slice(pairs, func(i, j int) bool {
+			return bytes.Compare(pairs[i].Key, pairs[j].Key) < 0
+		})
+		if err := write(ctx, pairs); err != nil {
+			return errors.Trace(err)
+		}
+		total += len(pairs)
+		pairs = make(kv.Pairs, 0, copyBatchPairs)
+		size = 0
+		return nil
+	}
+	for iter.Valid() {
+		key, err := rewriteCopiedKey(iter.Key(), rewriteRules)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		pairs = append(pairs, kv.Pair{Key: key, Val: append([]byte{}, iter.Value()...)})
+		size += len(key) + len(iter.Value())
+		if len(pairs) >= copyBatchPairs || size >= copyBatchSize {
+			if err = flush(); err != nil {
+				return errors.Trace(err)
+			}
+		}
+		if err = iter.Next(); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	if err = flush(); err != nil {
+		return errors.Trace(err)
+	}
+	log.Info("range copied", logutil.Key("startKey", rg.StartKey),
+		logutil.Key("endKey", rg.EndKey), zap.Int("pairs", total))
+	return nil
+}
+
+// ChecksumCopiedTables compares the admin checksums of the tables in the
+// source cluster at backupTS with the ones of the copied tables in this
+// cluster, which are scanned by the target client.
+func (rc *Client) ChecksumCopiedTables(
+	ctx context.Context,
+	source tidbkv.Storage,
+	target tidbkv.Client,
+	tables []*metautil.Table,
+	backupTS uint64,
+	concurrency uint,
+	updateCh glue.Progress,
+) error {
+	targetTS, err := rc.GetTS(ctx)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	workerPool := utils.NewWorkerPool(concurrency, "copy checksum")
+	eg, ectx := errgroup.WithContext(ctx)
+	for _, t := range tables {
+		table := t
+		workerPool.ApplyOnErrorGroup(eg, func() error {
+			defer updateCh.Inc()
+			// The views have no data.
+			if table.Info.IsView() {
+				return nil
+			}
+			newTable, err := rc.GetTableSchema(rc.dom, table.DB.Name, table.Info.Name)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			sourceResp, err := executeChecksum(ectx, checksum.NewExecutorBuilder(table.Info, backupTS), source.GetClient())
+			if err != nil {
+				return errors.Annotate(err, "checksum the source table failed")
+			}
+			targetResp, err := executeChecksum(ectx,
+				checksum.NewExecutorBuilder(newTable, targetTS).SetOldTable(table), target)
+			if err != nil {
+				return errors.Annotate(err, "checksum the copied table failed")
+			}
+			return errors.Trace(checkCopiedChecksum(table, sourceResp, targetResp))
+		})
+	}
+	return errors.Trace(eg.Wait())
+}
+
+func executeChecksum(
+	ctx context.Context, builder *checksum.ExecutorBuilder, client tidbkv.Client,
+) (*tipb.ChecksumResponse, error) {
+	exe, err := builder.Build()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	resp, err := exe.Execute(ctx, client, func() {})
+	return resp, errors.Trace(err)
+}
+
+// checkCopiedChecksum checks the checksum of the copied table against the
+// one of the source table.
+func checkCopiedChecksum(table *metautil.Table, source, target *tipb.ChecksumResponse) error {
+	if source.Checksum != target.Checksum ||
+		source.TotalKvs != target.TotalKvs ||
+		source.TotalBytes != target.TotalBytes {
+		log.Error("failed in validate checksum of the copied table",
+			zap.Stringer("db", table.DB.Name),
+			zap.Stringer("table", table.Info.Name),
+			zap.Uint64("source crc64", source.Checksum),
+			zap.Uint64("copied crc64", target.Checksum),
+			zap.Uint64("source total kvs", source.TotalKvs),
+			zap.Uint64("copied total kvs", target.TotalKvs),
+			zap.Uint64("source total bytes", source.TotalBytes),
+			zap.Uint64("copied total bytes", target.TotalBytes),
+		)
+		return errors.Annotatef(berrors.ErrRestoreChecksumMismatch, "failed to validate checksum of the copied table %s",
+			utils.EncloseDBAndTable(table.DB.Name.O, table.Info.Name.O))
+	}
+	return nil
+}
+
+// rewriteCopiedKey rewrites the key scanned from the source cluster into the
+// key of the destination cluster, the key is always copied.
+func rewriteCopiedKey(key []byte, rewriteRules *RewriteRules) ([]byte, error) {
+	if rewriteRules == nil {
+		return append([]byte{}, key...), nil
+	}
+	rule := matchOldPrefix(key, rewriteRules)
+	if rule == nil {
+		return nil, errors.Annotatef(berrors.ErrKVRewriteRuleNotFound, "key %s", redact.Key(key))
+	}
+	newKey := make([]byte, 0, len(key)-len(rule.GetOldKeyPrefix())+len(rule.GetNewKeyPrefix()))
+	newKey = append(newKey, rule.GetNewKeyPrefix()...)
+	return append(newKey, key[len(rule.GetOldKeyPrefix()):]...), nil
+}
@@ -0,0 +1,148 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package restore
+
+import (
+	"bytes"
+	"context"
+	"sort"
+
+	. "github.com/pingcap/check"
+	"github.com/pingcap/kvproto/pkg/import_sstpb"
+	"github.com/pingcap/parser/model"
+	"github.com/pingcap/tidb/kv"
+	"github.com/pingcap/tidb/tablecodec"
+	"github.com/pingcap/tipb/go-tipb"
+
+	berrors "github.com/pingcap/br/pkg/errors"
+	brkv "github.com/pingcap/br/pkg/kv"
+	"github.com/pingcap/br/pkg/metautil"
+	"github.com/pingcap/br/pkg/rtree"
+)
+
+type testCopyClusterSuite struct{}
+
+var _ = Suite(&testCopyClusterSuite{})
+
+func (s *testCopyClusterSuite) TestRewriteCopiedKey(c *C) {
+	rules := &RewriteRules{Data: []*import_sstpb.RewriteRule{
+		{
+			OldKeyPrefix: append(tablecodec.EncodeTablePrefix(1), recordPrefixSep...),
+			NewKeyPrefix: append(tablecodec.EncodeTablePrefix(2), recordPrefixSep...),
+		},
+		{
+			OldKeyPrefix: tablecodec.EncodeTableIndexPrefix(1, 1),
+			NewKeyPrefix: tablecodec.EncodeTableIndexPrefix(2, 3),
+		},
+	}}
+
+	record := tablecodec.EncodeRowKeyWithHandle(1, kv.IntHandle(42))
+	key, err := rewriteCopiedKey(record, rules)
+	c.Assert(err, IsNil)
+	c.Assert(key, DeepEquals, []byte(tablecodec.EncodeRowKeyWithHandle(2, kv.IntHandle(42))))
+
+	index := append(tablecodec.EncodeTableIndexPrefix(1, 1), 'v')
+	key, err = rewriteCopiedKey(index, rules)
+	c.Assert(err, IsNil)
+	c.Assert(key, DeepEquals, append(tablecodec.EncodeTableIndexPrefix(2, 3), 'v'))
+	// The scanned key isn't modified.
+	c.Assert(index, DeepEquals, append(tablecodec.EncodeTableIndexPrefix(1, 1), 'v'))
+
+	_, err = rewriteCopiedKey(tablecodec.EncodeRowKeyWithHandle(3, kv.IntHandle(1)), rules)
+	c.Assert(berrors.ErrKVRewriteRuleNotFound.Equal(err), IsTrue)
+
+	// The keys are copied without the rules.
+	key, err = rewriteCopiedKey(index, nil)
+	c.Assert(err, IsNil)
+	c.Assert(key, DeepEquals, index)
+	key[0] = 'x'
+	c.Assert(index[0], Equals, byte('t'))
+}
+
+// fakeSnapshot scans the sorted pairs in memory.
+type fakeSnapshot struct {
+	kv.Snapshot
+	pairs brkv.Pairs
+}
+
+func (s *fakeSnapshot) Iter(k kv.Key, upperBound kv.Key) (kv.Iterator, error) {
+	iter := &fakeIterator{}
+	for _, p := range s.pairs {
+		if bytes.Compare(p.Key, k) >= 0 && (len(upperBound) == 0 || bytes.Compare(p.Key, upperBound) < 0) {
+			iter.pairs = append(iter.pairs, p)
+		}
+	}
+	return iter, nil
+}
+
+type fakeIterator struct {
+	pairs brkv.Pairs
+}
+
+func (i *fakeIterator) Valid() bool   { return len(i.pairs) > 0 }
+func (i *fakeIterator) Key() kv.Key   { return i.pairs[0].Key }
+func (i *fakeIterator) Value() []byte { return i.pairs[0].Val }
+func (i *fakeIterator) Close()        {}
+
+func (i *fakeIterator) Next() error {
+	i.pairs = i.pairs[1:]
+	return nil
+}
+
+func (s *testCopyClusterSuite) TestCopyRange(c *C) {
+	rules := &RewriteRules{Data: []*import_sstpb.RewriteRule{{
+		OldKeyPrefix: tablecodec.EncodeTablePrefix(1),
+		NewKeyPrefix: tablecodec.EncodeTablePrefix(2),
+	}}}
+	snapshot := &fakeSnapshot{}
+	for i := 0; i < 5; i++ {
+		snapshot.pairs = append(snapshot.pairs, brkv.Pair{
+			Key: tablecodec.EncodeRowKeyWithHandle(1, kv.IntHandle(i)),
+			Val: []byte{byte(i)},
+		})
+	}
+	// The table 3 isn't in the range.
+	snapshot.pairs = append(snapshot.pairs, brkv.Pair{Key: tablecodec.EncodeRowKeyWithHandle(3, kv.IntHandle(1))})
+
+	var written brkv.Pairs
+	write := func(_ context.Context, pairs brkv.Pairs) error {
+		c.Assert(sort.SliceIsSorted(pairs, func(i, j int) bool {
+			return bytes.Compare(pairs[i].Key, pairs[j].Key) < 0
+		}), IsTrue)
+		written = append(written, pairs...)
+		return nil
+	}
+	rg := rtree.Range{
+		StartKey: tablecodec.EncodeRowKeyWithHandle(1, kv.IntHandle(1)),
+		EndKey:   tablecodec.EncodeTablePrefix(2),
+	}
+	c.Assert(copyRange(context.Background(), snapshot, write, rg, rules), IsNil)
+	c.Assert(written, HasLen, 4)
+	for i, p := range written {
+		c.Assert(p.Key, DeepEquals, []byte(tablecodec.EncodeRowKeyWithHandle(2, kv.IntHandle(i+1))))
+		c.Assert(p.Val, DeepEquals, []byte{byte(i + 1)})
+	}
+
+	// The keys out of the rules fail the copy rather than being dropped.
+	written = nil
+	rg.EndKey = nil
+	err := copyRange(context.Background(), snapshot, write, rg, rules)
+	c.Assert(berrors.ErrKVRewriteRuleNotFound.Equal(err), IsTrue)
+}
+
+func (s *testCopyClusterSuite) TestCheckCopiedChecksum(c *C) {
+	table := &metautil.Table{
+		DB:   &model.DBInfo{Name: model.NewCIStr("test")},
+		Info: &model.TableInfo{Name: model.NewCIStr("t")},
+	}
+	source := &tipb.ChecksumResponse{Checksum: 1, TotalKvs: 2, TotalBytes: 3}
+	c.Assert(checkCopiedChecksum(table, source, &tipb.ChecksumResponse{Checksum: 1, TotalKvs: 2, TotalBytes: 3}), IsNil)
+	for _, target := range []*tipb.ChecksumResponse{
+		{Checksum: 4, TotalKvs: 2, TotalBytes: 3},
+		{Checksum: 1, TotalKvs: 1, TotalBytes: 3},
+		{Checksum: 1, TotalKvs: 2, TotalBytes: 4},
+	} {
+		err := checkCopiedChecksum(table, source, target)
+		c.Assert(berrors.ErrRestoreChecksumMismatch.Equal(err), IsTrue)
+	}
+}
@@ -203,6 +203,20 @@ func (db *DB) CreateTable(ctx context.Context, table *metautil.Table) error {
 	return errors.Trace(err)
 }
 
+// SetTiFlashReplica executes an ALTER TABLE SET TIFLASH REPLICA SQL.
+func (db *DB) SetTiFlashReplica(ctx context.Context, replica TiFlashReplica) error {
+	sql := replica.AlterSQL()
+	err := db.se.Execute(ctx, sql)
+	if err != nil {
+		log.Error("set tiflash replica failed",
+			zap.String("query", sql),
+			zap.Stringer("db", replica.DB),
+			zap.Stringer("table", replica.Table),
+			zap.Error(err))
+	}
+	return errors.Trace(err)
+}
+
 // Close closes the connection.
 func (db *DB) Close() {
 	db.se.Close()
@@ -0,0 +1,114 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package restore
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+
+	"github.com/pingcap/br/pkg/metautil"
+	"github.com/pingcap/br/pkg/utils"
+)
+
+// failedDatabases records the databases failed to create or to create some
+// of their tables.
+type failedDatabases struct {
+	mu  sync.Mutex
+	dbs map[string]error
+}
+
+// EnableDDLFailureIsolation makes a DDL failure skip the rest tables of its
+// database only, instead of failing the whole restore, so the other databases
+// are restored. The failed databases are returned by FailedDatabases.
+func (rc *Client) EnableDDLFailureIsolation() {
+	rc.failedDBs = &failedDatabases{dbs: make(map[string]error)}
+}
+
+// SetDDLBatchSize makes GoCreateTables send the DDLs of at most size tables of
+// the same database through one session in a batch, so the databases with many
+// small tables aren't scheduled table by table.
+func (rc *Client) SetDDLBatchSize(size uint) {
+	if size == 0 {
+		size = 1
+	}
+	rc.ddlBatchSize = size
+}
+
+// FailedDatabases returns the sorted names of the failed databases.
+func (rc *Client) FailedDatabases() []string {
+	if rc.failedDBs == nil {
+		return nil
+	}
+	rc.failedDBs.mu.Lock()
+	defer rc.failedDBs.mu.Unlock()
+	dbs := make([]string, 0, len(rc.failedDBs.dbs))
+	for db := range rc.failedDBs.dbs {
+		dbs = append(dbs, db)
+	}
+	sort.Strings(dbs)
+	return dbs
+}
+
+// isolateDDLFailure records the database as failed and swallows the error if
+// the isolation is enabled. Otherwise, the error is returned as is.
+func (rc *Client) isolateDDLFailure(dbName string, err error) error {
+	if err == nil || rc.failedDBs == nil || errors.Cause(err) == context.Canceled {
+		return err
+	}
+	name := utils.EncloseName(dbName)
+	log.Error("isolate the database failed to restore the schemas", zap.String("database", name), zap.Error(err))
+	rc.failedDBs.mu.Lock()
+	if _, ok := rc.failedDBs.dbs[name]; !ok {
+		rc.failedDBs.dbs[name] = err
+	}
+	rc.failedDBs.mu.Unlock()
+	return nil
+}
+
+// isDatabaseFailed returns whether the database has been isolated.
+func (rc *Client) isDatabaseFailed(dbName string) bool {
+	if rc.failedDBs == nil {
+		return false
+	}
+	rc.failedDBs.mu.Lock()
+	defer rc.failedDBs.mu.Unlock()
+	_, ok := rc.failedDBs.dbs[utils.EncloseName(dbName)]
+	return ok
+}
+
+// batchTablesByDatabase splits the tables into batches of at most size tables
+// of the same database, the batches are in the order of the first tables of
+// their databases.
+func batchTablesByDatabase(tables []*metautil.Table, size uint) [][]*metautil.Table {
+	if size <= 1 {
+		batches := make([][]*metautil.Table, 0, len(tables))
+		for _, t := range tables {
+			batches = append(batches, []*metautil.Table{t})
+		}
+		return batches
+	}
+	var dbs []string
+	tablesOfDB := make(map[string][]*metautil.Table)
+	for _, t := range tables {
+		name := t.DB.Name.L
+		if _, ok := tablesOfDB[name]; !ok {
+			dbs = append(dbs, name)
+		}
+		tablesOfDB[name] = append(tablesOfDB[name], t)
+	}
+	batches := make([][]*metautil.Table, 0, len(tables)/int(size)+len(dbs))
+	for _, db := range dbs {
+		dbTables := tablesOfDB[db]
+		for len(dbTables) > 0 {
+			n := utils.MinInt(len(dbTables), int(size))
+			batches = append(batches, dbTables[:n])
+			dbTables = dbTables[n:]
+		}
+	}
+	return batches
+}
@@ -0,0 +1,63 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package restore
+
+import (
+	"context"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+
+	"github.com/pingcap/br/pkg/backup"
+	"github.com/pingcap/br/pkg/storage"
+)
+
+// DecryptStorage returns the storage decrypting the files written by BR if
+// the backup is encrypted, or the storage itself otherwise. If masterKeyURI
+// is empty, the master key recorded by the backup is used.
+func DecryptStorage(
+	ctx context.Context, s storage.ExternalStorage, masterKeyURI string,
+) (storage.ExternalStorage, error) {
+	s, _, err := decryptStorage(ctx, s, masterKeyURI)
+	return s, errors.Trace(err)
+}
+
+// decryptStorage is DecryptStorage which also returns the data key, or nil
+// if the backup isn't encrypted.
+func decryptStorage(
+	ctx context.Context, s storage.ExternalStorage, masterKeyURI string,
+) (storage.ExternalStorage, []byte, error) {
+	meta, err := backup.LoadEncryptionMeta(ctx, s)
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+	if meta == nil {
+		return s, nil, nil
+	}
+	dataKey, err := meta.DataKey(ctx, masterKeyURI)
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+	log.Info("the backup is encrypted", zap.String("method", meta.Method), zap.String("master-key", meta.MasterKey))
+	decrypted, err := storage.WithEncryption(s, dataKey, backup.EncryptionFile)
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+	return decrypted, dataKey, nil
+}
+
+// EnableDecryption decrypts the files written by BR read through the storage
+// of the client if the backup is encrypted, and passes the data key to TiKV
+// to decrypt the SST files. It should be called after SetStorage.
+func (rc *Client) EnableDecryption(ctx context.Context, masterKeyURI string) error {
+	s, dataKey, err := decryptStorage(ctx, rc.storage, masterKeyURI)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	rc.storage = s
+	if dataKey != nil {
+		rc.cipher = backup.NewCipherInfo(dataKey)
+	}
+	return nil
+}
@@ -0,0 +1,198 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package restore
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+// The phases of a restore in the estimate, in the order they finish. The
+// phases overlap in the pipeline of restore, so a phase is considered
+// finished only when its last batch finishes.
+const (
+	PhaseCreateTables = "create-tables"
+	PhaseSplit        = "split-scatter"
+	PhaseDownload     = "download"
+	PhaseIngest       = "ingest"
+	PhaseChecksum     = "checksum"
+)
+
+// The rough costs of the phases on a typical cluster, which are corrected by
+// the elapsed time of the finished phases during the restore.
+const (
+	estimateCreateTableCost = 100 * time.Millisecond
+	estimateDDLConcurrency  = 16
+	estimateSplitRangeCost  = 20 * time.Millisecond
+	// estimateStoreDownloadSpeed is the download speed of a store when the
+	// rate limit and the network bandwidth are unlimited.
+	estimateStoreDownloadSpeed = 200 * 1024 * 1024
+	estimateStoreIngestSpeed   = 300 * 1024 * 1024
+	estimateStoreChecksumSpeed = 500 * 1024 * 1024
+	// estimateReplicas is the replica count of the regions, every replica
+	// downloads the files.
+	estimateReplicas = 3
+)
+
+// RestoreEstimateConfig is the facts of the cluster and the network the
+// estimate is based on.
+type RestoreEstimateConfig struct {
+	// ArchiveSize is the size of the files to download.
+	ArchiveSize uint64
+	// Stores is the count of the TiKV stores.
+	Stores int
+	// RateLimit is the download rate limit of each store, zero means
+	// unlimited.
+	RateLimit uint64
+	// Bandwidth is the total network bandwidth between the storage and the
+	// cluster in bytes per second, zero means unknown.
+	Bandwidth uint64
+	// Checksum is whether the checksum phase runs.
+	Checksum bool
+}
+
+// RestorePhaseEstimate is the estimated duration of a phase.
+type RestorePhaseEstimate struct {
+	Phase    string
+	Duration time.Duration
+}
+
+// RestoreEstimate is the estimated duration of a restore broken down by
+// phase.
+type RestoreEstimate struct {
+	Phases []RestorePhaseEstimate
+	Total  time.Duration
+}
+
+func durationOf(size uint64, speed float64) time.Duration {
+	if speed <= 0 {
+		return 0
+	}
+	return time.Duration(float64(size) / speed * float64(time.Second))
+}
+
+// EstimateRestore estimates the duration of restoring the plan. It's a coarse
+// cost model: the tables are created by a pool of sessions, the ranges are
+// split one by one, and the downloading is bound by the rate limit of the
+// stores and the network bandwidth, which is shared by all the replicas.
+func EstimateRestore(plan *RestorePlan, cfg RestoreEstimateConfig) *RestoreEstimate {
+	stores := cfg.Stores
+	if stores <= 0 {
+		stores = 1
+	}
+	tableRounds := (len(plan.Tables) + estimateDDLConcurrency - 1) / estimateDDLConcurrency
+	storeDownloadSpeed := float64(estimateStoreDownloadSpeed)
+	if cfg.RateLimit > 0 && float64(cfg.RateLimit) < storeDownloadSpeed {
+		storeDownloadSpeed = float64(cfg.RateLimit)
+	}
+	downloadSpeed := storeDownloadSpeed * float64(stores)
+	if cfg.Bandwidth > 0 && float64(cfg.Bandwidth) < downloadSpeed {
+		downloadSpeed = float64(cfg.Bandwidth)
+	}
+
+	estimate := &RestoreEstimate{Phases: []RestorePhaseEstimate{
+		{Phase: PhaseCreateTables, Duration: time.Duration(tableRounds) * estimateCreateTableCost},
+		{Phase: PhaseSplit, Duration: time.Duration(plan.TotalRanges) * estimateSplitRangeCost},
+		{Phase: PhaseDownload, Duration: durationOf(cfg.ArchiveSize*estimateReplicas, downloadSpeed)},
+		{Phase: PhaseIngest, Duration: durationOf(plan.TotalBytes, float64(estimateStoreIngestSpeed)*float64(stores))},
+	}}
+	if cfg.Checksum {
+		estimate.Phases = append(estimate.Phases, RestorePhaseEstimate{
+			Phase:    PhaseChecksum,
+			Duration: durationOf(plan.TotalBytes, float64(estimateStoreChecksumSpeed)*float64(stores)),
+		})
+	}
+	for _, phase := range estimate.Phases {
+		estimate.Total += phase.Duration
+	}
+	return estimate
+}
+
+// ZapFields returns the fields to log the estimate.
+func (e *RestoreEstimate) ZapFields() []zap.Field {
+	fields := make([]zap.Field, 0, len(e.Phases)+1)
+	fields = append(fields, zap.Duration("total", e.Total))
+	for _, phase := range e.Phases {
+		fields = append(fields, zap.Duration(phase.Phase, phase.Duration))
+	}
+	return fields
+}
+
+// RestoreETA refines the estimate as the phases finish. The elapsed time of
+// the finished phases is compared with their estimate, and the rest phases
+// are scaled by the ratio.
+type RestoreETA struct {
+	mu       sync.Mutex
+	estimate *RestoreEstimate
+	start    time.Time
+	// finished is the count of the finished phases.
+	finished int
+	// refined is the remaining duration refined when the last phase
+	// finished at refinedAt.
+	refined   time.Duration
+	refinedAt time.Time
+}
+
+// NewRestoreETA logs the estimate and starts tracking the restore.
+func NewRestoreETA(estimate *RestoreEstimate) *RestoreETA {
+	log.Info("estimated restore duration", estimate.ZapFields()...)
+	now := time.Now()
+	return &RestoreETA{estimate: estimate, start: now, refined: estimate.Total, refinedAt: now}
+}
+
+// PhaseDone marks the phase and the phases before it finished, and logs the
+// refined remaining duration.
+func (t *RestoreETA) PhaseDone(phase string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i := t.finished; i < len(t.estimate.Phases); i++ {
+		if t.estimate.Phases[i].Phase == phase {
+			t.finished = i + 1
+			t.refinedAt = time.Now()
+			t.refined = t.remaining(t.refinedAt.Sub(t.start))
+			log.Info("restore phase finished, refined the estimate",
+				zap.String("phase", phase),
+				zap.Duration("elapsed", t.refinedAt.Sub(t.start)),
+				zap.Duration("remaining", t.refined))
+			return
+		}
+	}
+}
+
+// Remaining returns the remaining duration of the restore, which is the
+// refined estimate counted down since the last phase finished. It returns
+// false if the restore isn't estimated.
+func (t *RestoreETA) Remaining() (time.Duration, bool) {
+	if t == nil {
+		return 0, false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	remaining := t.refined - time.Since(t.refinedAt)
+	if remaining < 0 {
+		remaining = 0
+	}
+	return remaining, true
+}
+
+// remaining returns the remaining duration of the unfinished phases.
+func (t *RestoreETA) remaining(elapsed time.Duration) time.Duration {
+	var expected, rest time.Duration
+	for i, phase := range t.estimate.Phases {
+		if i < t.finished {
+			expected += phase.Duration
+		} else {
+			rest += phase.Duration
+		}
+	}
+	if expected <= 0 {
+		return rest
+	}
+	return time.Duration(float64(rest) * float64(elapsed) / float64(expected))
+}
@@ -0,0 +1,109 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package restore
+
+import (
+	"context"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/kvproto/pkg/metapb"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+
+	"github.com/pingcap/br/pkg/logutil"
+)
+
+// SetFailureDomainCheck makes the splitter verify that the voters of each
+// scattered region are placed in distinct failure domains, i.e. the stores
+// with distinct values of the label. If rescatter is true, the violating
+// regions are scattered once more.
+func (rs *RegionSplitter) SetFailureDomainCheck(labelKey string, rescatter bool) {
+	rs.failureDomainLabel = labelKey
+	rs.rescatterViolating = rescatter
+}
+
+// storeLabel returns the value of the label of the store, or empty if the
+// store doesn't have the label.
+func storeLabel(store *metapb.Store, labelKey string) string {
+	for _, label := range store.GetLabels() {
+		if label.GetKey() == labelKey {
+			return label.GetValue()
+		}
+	}
+	return ""
+}
+
+// violatesFailureDomain checks whether two voters of the region are placed in
+// the same failure domain. The stores without the label are considered in the
+// same failure domain.
+func (rs *RegionSplitter) violatesFailureDomain(ctx context.Context, region *metapb.Region) (bool, error) {
+	domains := make(map[string]struct{}, len(region.GetPeers()))
+	for _, peer := range region.GetPeers() {
+		if peer.GetRole() == metapb.PeerRole_Learner {
+			continue
+		}
+		store, err := rs.client.GetStore(ctx, peer.GetStoreId())
+		if err != nil {
+			return false, errors.Trace(err)
+		}
+		domain := storeLabel(store, rs.failureDomainLabel)
+		if _, ok := domains[domain]; ok {
+			return true, nil
+		}
+		domains[domain] = struct{}{}
+	}
+	return false, nil
+}
+
+// findFailureDomainViolations returns the regions whose voters are not placed
+// in distinct failure domains, the regions are reloaded to get their peers
+// after scattering.
+func (rs *RegionSplitter) findFailureDomainViolations(ctx context.Context, regions []*RegionInfo) []*RegionInfo {
+	violating := make([]*RegionInfo, 0)
+	for _, region := range regions {
+		current, err := rs.client.GetRegionByID(ctx, region.Region.GetId())
+		if err != nil || current == nil {
+			log.Warn("failed to get the region to verify the failure domains, skip it",
+				logutil.Region(region.Region), zap.Error(err))
+			continue
+		}
+		ok, err := rs.violatesFailureDomain(ctx, current.Region)
+		if err != nil {
+			log.Warn("failed to verify the failure domains of the region, skip it",
+				logutil.Region(current.Region), zap.Error(err))
+			continue
+		}
+		if ok {
+			violating = append(violating, current)
+		}
+	}
+	return violating
+}
+
+// verifyFailureDomains verifies the failure domains of the scattered regions
+// and scatters the violating regions once more if rescatterViolating is set.
+// It only logs the violations, since PD eventually fixes the placement.
+func (rs *RegionSplitter) verifyFailureDomains(ctx context.Context, regions []*RegionInfo) {
+	violating := rs.findFailureDomainViolations(ctx, regions)
+	if len(violating) > 0 && rs.rescatterViolating {
+		log.Info("scatter the regions violating the failure domains again",
+			zap.String("label", rs.failureDomainLabel), zap.Int("regions", len(violating)))
+		rs.ScatterRegions(ctx, violating)
+		rs.waitForScatterRegions(ctx, violating)
+		violating = rs.findFailureDomainViolations(ctx, violating)
+	}
+	if len(violating) == 0 {
+		log.Info("the regions are placed in distinct failure domains",
+			zap.String("label", rs.failureDomainLabel), zap.Int("regions", len(regions)))
+		return
+	}
+	for _, region := range violating {
+		log.Warn("region violates the failure domains",
+			zap.String("label", rs.failureDomainLabel), logutil.Region(region.Region))
+	}
+	log.Warn("some regions are not placed in distinct failure domains, "+
+		"they are not fault tolerant until PD moves their peers",
+		zap.String("label", rs.failureDomainLabel),
+		zap.Int("violating", len(violating)),
+		zap.Int("regions", len(regions)))
+}
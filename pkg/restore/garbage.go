@@ -0,0 +1,121 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package restore
+
+import (
+	"bytes"
+	"sync/atomic"
+
+	backuppb "github.com/pingcap/kvproto/pkg/backup"
+	"github.com/pingcap/kvproto/pkg/import_sstpb"
+	"github.com/pingcap/log"
+	"github.com/pingcap/tidb/kv"
+
+	"github.com/pingcap/br/pkg/logutil"
+)
+
+// GarbageKeyFilter drops the keys of the files which no rewrite rule covers,
+// e.g. the orphan keys of the dropped indexes left in some old backups.
+// Without it, such keys fail the validation of the rewrite rules. The files
+// are trimmed to the old key ranges of the rules before merging the ranges,
+// and the files having no key in the ranges are dropped, so the keys out of
+// the ranges are never downloaded.
+type GarbageKeyFilter struct {
+	droppedFiles uint64
+	droppedKVs   uint64
+	trimmedFiles uint64
+}
+
+// NewGarbageKeyFilter returns a GarbageKeyFilter.
+func NewGarbageKeyFilter() *GarbageKeyFilter {
+	return &GarbageKeyFilter{}
+}
+
+// DroppedFiles returns the number of the files dropped as a whole.
+func (f *GarbageKeyFilter) DroppedFiles() uint64 {
+	return atomic.LoadUint64(&f.droppedFiles)
+}
+
+// DroppedKVs returns the number of the KV pairs of the dropped files.
+func (f *GarbageKeyFilter) DroppedKVs() uint64 {
+	return atomic.LoadUint64(&f.droppedKVs)
+}
+
+// TrimmedFiles returns the number of the files whose ranges are trimmed.
+func (f *GarbageKeyFilter) TrimmedFiles() uint64 {
+	return atomic.LoadUint64(&f.trimmedFiles)
+}
+
+// Filter returns the files trimmed to the old key ranges of the rewrite
+// rules. The files are copied before trimming, the input isn't modified.
+func (f *GarbageKeyFilter) Filter(files []*backuppb.File, rewriteRules *RewriteRules) []*backuppb.File {
+	if rewriteRules == nil {
+		return files
+	}
+	filtered := make([]*backuppb.File, 0, len(files))
+	for _, file := range files {
+		trimmed, ok := trimFileToRules(file, rewriteRules.Data)
+		if !ok {
+			atomic.AddUint64(&f.droppedFiles, 1)
+			atomic.AddUint64(&f.droppedKVs, file.GetTotalKvs())
+			log.Warn("drop the file having no key covered by the rewrite rules", logutil.File(file))
+			continue
+		}
+		if trimmed != file {
+			atomic.AddUint64(&f.trimmedFiles, 1)
+			log.Warn("trim the keys not covered by the rewrite rules",
+				logutil.File(file),
+				logutil.Key("trimmedStartKey", trimmed.GetStartKey()),
+				logutil.Key("trimmedEndKey", trimmed.GetEndKey()))
+		}
+		filtered = append(filtered, trimmed)
+	}
+	return filtered
+}
+
+// ruleEndSuffix is appended to the old key prefix of a rule as the trimmed
+// end key, which is still covered by the rule, like GetSSTMetaFromFile does.
+var ruleEndSuffix = []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+
+// trimFileToRules trims the range of the file to the smallest range covering
+// the intersections of the range with the old key ranges of the rules. It
+// returns the file itself if it needn't trimming, and false if there is no
+// intersection.
+func trimFileToRules(file *backuppb.File, rules []*import_sstpb.RewriteRule) (*backuppb.File, bool) {
+	fileStart, fileEnd := file.GetStartKey(), file.GetEndKey()
+	var start, end []byte
+	found := false
+	for _, rule := range rules {
+		ruleStart := rule.GetOldKeyPrefix()
+		ruleEnd := kv.Key(ruleStart).PrefixNext()
+		// The end key of the file is inclusive.
+		if (len(fileEnd) > 0 && bytes.Compare(fileEnd, ruleStart) < 0) || bytes.Compare(fileStart, ruleEnd) >= 0 {
+			continue
+		}
+		s := fileStart
+		if bytes.Compare(s, ruleStart) < 0 {
+			s = ruleStart
+		}
+		e := fileEnd
+		if len(e) == 0 || bytes.Compare(e, ruleEnd) >= 0 {
+			e = append(append([]byte{}, ruleStart...), ruleEndSuffix...)
+		}
+		if !found || bytes.Compare(s, start) < 0 {
+			start = s
+		}
+		if !found || bytes.Compare(e, end) > 0 {
+			end = e
+		}
+		found = true
+	}
+	if !found {
+		return nil, false
+	}
+	if bytes.Equal(start, fileStart) && bytes.Equal(end, fileEnd) {
+		return file, true
+	}
+	trimmed := *file
+	trimmed.StartKey = start
+	trimmed.EndKey = end
+	return &trimmed, true
+}
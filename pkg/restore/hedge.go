@@ -0,0 +1,153 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package restore
+
+import (
+	"context"
+	"time"
+
+	"github.com/pingcap/kvproto/pkg/pdpb"
+	"github.com/pingcap/log"
+	pd "github.com/tikv/pd/client"
+	"go.uber.org/zap"
+)
+
+// hedgedSplitClient sends the read requests of regions and operators to the
+// secondary client if the primary client doesn't respond in the delay or
+// fails, and takes the first successful response. It reduces the tail latency
+// of split and scatter on flaky networks. The other requests are sent to the
+// primary client only.
+type hedgedSplitClient struct {
+	SplitClient
+	secondary SplitClient
+	delay     time.Duration
+}
+
+// NewHedgedSplitClient returns a SplitClient which hedges GetRegionByID,
+// ScanRegions and GetOperator to the secondary client after the delay.
+func NewHedgedSplitClient(primary, secondary SplitClient, delay time.Duration) SplitClient {
+	return &hedgedSplitClient{
+		SplitClient: primary,
+		secondary:   secondary,
+		delay:       delay,
+	}
+}
+
+type hedgedResult struct {
+	value interface{}
+	err   error
+}
+
+// hedge calls the primary client, and then the secondary client if the
+// primary one doesn't return in the delay or returns an error. The error of
+// the primary client is returned if both of them fail.
+func (c *hedgedSplitClient) hedge(
+	ctx context.Context,
+	method string,
+	call func(ctx context.Context, cli SplitClient) (interface{}, error),
+) (interface{}, error) {
+	// Cancel the slower request once we have the result.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// The channel is buffered so the slower request doesn't leak.
+	results := make(chan hedgedResult, 2)
+	send := func(cli SplitClient) {
+		go func() {
+			value, err := call(ctx, cli)
+			results <- hedgedResult{value: value, err: err}
+		}()
+	}
+	send(c.SplitClient)
+	pending := 1
+	hedged := false
+	hedgeOnce := func(reason string) {
+		if hedged {
+			return
+		}
+		hedged = true
+		pending++
+		log.Debug("send hedged request to pd", zap.String("method", method), zap.String("reason", reason))
+		send(c.secondary)
+	}
+
+	timer := time.NewTimer(c.delay)
+	defer timer.Stop()
+	var firstErr error
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-timer.C:
+			hedgeOnce("timeout")
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				return res.value, nil
+			}
+			if firstErr == nil {
+				firstErr = res.err
+			}
+			hedgeOnce("error")
+			if pending == 0 {
+				return nil, firstErr
+			}
+		}
+	}
+}
+
+func (c *hedgedSplitClient) GetRegionByID(ctx context.Context, regionID uint64) (*RegionInfo, error) {
+	value, err := c.hedge(ctx, "GetRegionByID", func(ctx context.Context, cli SplitClient) (interface{}, error) {
+		return cli.GetRegionByID(ctx, regionID)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return value.(*RegionInfo), nil
+}
+
+func (c *hedgedSplitClient) GetOperator(ctx context.Context, regionID uint64) (*pdpb.GetOperatorResponse, error) {
+	value, err := c.hedge(ctx, "GetOperator", func(ctx context.Context, cli SplitClient) (interface{}, error) {
+		return cli.GetOperator(ctx, regionID)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return value.(*pdpb.GetOperatorResponse), nil
+}
+
+func (c *hedgedSplitClient) ScanRegions(ctx context.Context, key, endKey []byte, limit int) ([]*RegionInfo, error) {
+	value, err := c.hedge(ctx, "ScanRegions", func(ctx context.Context, cli SplitClient) (interface{}, error) {
+		return cli.ScanRegions(ctx, key, endKey, limit)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return value.([]*RegionInfo), nil
+}
+
+// EnableHedgedPDReads makes the region and operator reads of split, scatter
+// and import hedged to the secondary PD client after the delay. It should be
+// called before InitBackupMeta.
+func (rc *Client) EnableHedgedPDReads(secondary pd.Client, delay time.Duration) {
+	rc.hedgePDClient = secondary
+	rc.hedgeDelay = delay
+	rc.toolClient = rc.newToolClient()
+}
+
+// newSplitClient returns the SplitClient of the PD client, hedged if enabled.
+func (rc *Client) newSplitClient() SplitClient {
+	var cli SplitClient = newPDSplitClient(rc.pdClient, rc.tlsConf, rc.pdTLSConf, rc.storeAddressMap)
+	if rc.hedgePDClient != nil {
+		hedge := newPDSplitClient(rc.hedgePDClient, rc.tlsConf, rc.pdTLSConf, rc.storeAddressMap)
+		cli = NewHedgedSplitClient(cli, hedge, rc.hedgeDelay)
+	}
+	return cli
+}
+
+// newToolClient returns the SplitClient for the single requests to PD out of
+// split, scatter and import, which retries them on the transfer of the PD
+// leader.
+func (rc *Client) newToolClient() SplitClient {
+	return NewPDLeaderRetrySplitClient(rc.newSplitClient())
+}
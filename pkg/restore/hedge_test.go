@@ -0,0 +1,119 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package restore_test
+
+import (
+	"context"
+	"time"
+
+	. "github.com/pingcap/check"
+	"github.com/pingcap/errors"
+	"github.com/pingcap/kvproto/pkg/metapb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	berrors "github.com/pingcap/br/pkg/errors"
+	"github.com/pingcap/br/pkg/restore"
+)
+
+type testHedgeSuite struct{}
+
+// errClientGetLeader is the error of the PD client failing to get the leader.
+var errClientGetLeader = errors.Normalize("get leader from %v error", errors.RFCCodeText("PD:client:ErrClientGetLeader"))
+
+var _ = Suite(&testHedgeSuite{})
+
+// regionClient returns the region after the delay, or the error.
+type regionClient struct {
+	restore.SplitClient
+	id    uint64
+	delay time.Duration
+	err   error
+}
+
+func (c *regionClient) GetRegionByID(ctx context.Context, regionID uint64) (*restore.RegionInfo, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-time.After(c.delay):
+	}
+	if c.err != nil {
+		return nil, c.err
+	}
+	return &restore.RegionInfo{Region: &metapb.Region{Id: c.id}}, nil
+}
+
+func (s *testHedgeSuite) TestHedgedSplitClient(c *C) {
+	ctx := context.Background()
+	fast := &regionClient{id: 1}
+	slow := &regionClient{id: 2, delay: time.Minute}
+	failed := &regionClient{id: 3, err: errors.New("connection reset")}
+
+	// The primary client responds in the delay.
+	cli := restore.NewHedgedSplitClient(fast, slow, time.Second)
+	region, err := cli.GetRegionByID(ctx, 1)
+	c.Assert(err, IsNil)
+	c.Assert(region.Region.Id, Equals, uint64(1))
+
+	// The primary client is slow.
+	cli = restore.NewHedgedSplitClient(slow, fast, 10*time.Millisecond)
+	region, err = cli.GetRegionByID(ctx, 1)
+	c.Assert(err, IsNil)
+	c.Assert(region.Region.Id, Equals, uint64(1))
+
+	// The primary client fails, the secondary client is sent without waiting.
+	cli = restore.NewHedgedSplitClient(failed, fast, time.Minute)
+	region, err = cli.GetRegionByID(ctx, 1)
+	c.Assert(err, IsNil)
+	c.Assert(region.Region.Id, Equals, uint64(1))
+
+	// Both fail.
+	cli = restore.NewHedgedSplitClient(failed, &regionClient{err: errors.New("timeout")}, time.Minute)
+	_, err = cli.GetRegionByID(ctx, 1)
+	c.Assert(err, ErrorMatches, "connection reset")
+}
+
+// leaderChangingClient fails with the errors in order, then returns the region.
+type leaderChangingClient struct {
+	restore.SplitClient
+	errs  []error
+	calls int
+}
+
+func (c *leaderChangingClient) GetRegionByID(ctx context.Context, regionID uint64) (*restore.RegionInfo, error) {
+	c.calls++
+	if len(c.errs) > 0 {
+		err := c.errs[0]
+		c.errs = c.errs[1:]
+		return nil, err
+	}
+	return &restore.RegionInfo{Region: &metapb.Region{Id: regionID}}, nil
+}
+
+func (s *testHedgeSuite) TestPDLeaderRetrySplitClient(c *C) {
+	ctx := context.Background()
+	// The errors returned by PD while the leader is being transferred.
+	inner := &leaderChangingClient{errs: []error{
+		status.Error(codes.Unavailable, "not leader"),
+		errClientGetLeader.GenWithStackByArgs("[http://pd-0:2379]"),
+	}}
+	cli := restore.NewPDLeaderRetrySplitClient(inner)
+	region, err := cli.GetRegionByID(ctx, 42)
+	c.Assert(err, IsNil)
+	c.Assert(region.Region.Id, Equals, uint64(42))
+	c.Assert(inner.calls, Equals, 3)
+
+	// Other errors are returned at once.
+	inner = &leaderChangingClient{errs: []error{errors.Annotate(berrors.ErrPDInvalidResponse, "bad")}}
+	cli = restore.NewPDLeaderRetrySplitClient(inner)
+	_, err = cli.GetRegionByID(ctx, 42)
+	c.Assert(berrors.Is(err, berrors.ErrPDInvalidResponse), IsTrue)
+	c.Assert(inner.calls, Equals, 1)
+
+	// The leader changes are detected by the codes rather than the messages.
+	inner = &leaderChangingClient{errs: []error{errors.New("the store is not leader of the region")}}
+	cli = restore.NewPDLeaderRetrySplitClient(inner)
+	_, err = cli.GetRegionByID(ctx, 42)
+	c.Assert(err, ErrorMatches, ".*not leader.*")
+	c.Assert(inner.calls, Equals, 1)
+}
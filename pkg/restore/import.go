@@ -6,6 +6,8 @@ import (
 	"bytes"
 	"context"
 	"crypto/tls"
+	"net"
+	"strings"
 	"sync"
 	"time"
 
@@ -17,7 +19,6 @@ import (
 	"github.com/pingcap/kvproto/pkg/kvrpcpb"
 	"github.com/pingcap/log"
 	pd "github.com/tikv/pd/client"
-	"github.com/tikv/pd/pkg/codec"
 	"go.uber.org/multierr"
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
@@ -30,6 +31,7 @@ import (
 	"github.com/pingcap/br/pkg/conn"
 	berrors "github.com/pingcap/br/pkg/errors"
 	"github.com/pingcap/br/pkg/logutil"
+	"github.com/pingcap/br/pkg/redact"
 	"github.com/pingcap/br/pkg/summary"
 	"github.com/pingcap/br/pkg/utils"
 )
@@ -39,6 +41,28 @@ const (
 	gRPCBackOffMaxDelay  = 3 * time.Second
 )
 
+// ParseStoreAddressMap parses the rules of translating the addresses of the
+// stores advertised to PD into the addresses reachable by BR, each rule is
+// like "tikv-0.tikv:20160=10.0.1.10:30160".
+func ParseStoreAddressMap(rules []string) (map[string]string, error) {
+	if len(rules) == 0 {
+		return nil, nil
+	}
+	addressMap := make(map[string]string, len(rules))
+	for _, rule := range rules {
+		items := strings.Split(rule, "=")
+		if len(items) != 2 || len(items[0]) == 0 || len(items[1]) == 0 {
+			return nil, errors.Annotatef(berrors.ErrInvalidArgument,
+				"invalid store address rule '%s', it should be like 'advertised-host:port=reachable-host:port'", rule)
+		}
+		if _, ok := addressMap[items[0]]; ok {
+			return nil, errors.Annotatef(berrors.ErrInvalidArgument, "duplicated store address %s", items[0])
+		}
+		addressMap[items[0]] = items[1]
+	}
+	return addressMap, nil
+}
+
 // ImporterClient is used to import a file to TiKV.
 type ImporterClient interface {
 	DownloadSST(
@@ -72,21 +96,65 @@ type ImporterClient interface {
 	SupportMultiIngest(ctx context.Context, stores []uint64) (bool, error)
 }
 
+// storeDialTarget returns the address dialing the store advertising addr,
+// translated by the address map, and the TLS config of it. The certificate of
+// the store is issued for the advertised host, so the TLS server name is set
+// to the advertised host when the address is translated.
+func storeDialTarget(storeID uint64, addr string, addressMap map[string]string, tlsConf *tls.Config) (string, *tls.Config) {
+	mapped, ok := addressMap[addr]
+	if !ok {
+		return addr, tlsConf
+	}
+	log.Info("dial the store by the mapped address",
+		zap.Uint64("store", storeID), zap.String("advertised", addr), zap.String("address", mapped))
+	if tlsConf == nil || len(tlsConf.ServerName) != 0 {
+		return mapped, tlsConf
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	conf := tlsConf.Clone()
+	conf.ServerName = host
+	return mapped, conf
+}
+
+// transportOption returns the dial option of the transport credentials.
+func transportOption(tlsConf *tls.Config) grpc.DialOption {
+	if tlsConf == nil {
+		return grpc.WithInsecure()
+	}
+	return grpc.WithTransportCredentials(credentials.NewTLS(tlsConf))
+}
+
 type importClient struct {
 	mu         sync.Mutex
 	metaClient SplitClient
 	clients    map[uint64]import_sstpb.ImportSSTClient
 	tlsConf    *tls.Config
+	// addressMap translates the advertised addresses of the stores into the
+	// addresses dialed, e.g. when BR is outside of the network of TiKV.
+	addressMap map[string]string
 
 	keepaliveConf keepalive.ClientParameters
 }
 
 // NewImportClient returns a new ImporterClient.
 func NewImportClient(metaClient SplitClient, tlsConf *tls.Config, keepaliveConf keepalive.ClientParameters) ImporterClient {
+	return newImportClient(metaClient, tlsConf, keepaliveConf, nil)
+}
+
+func newImportClient(
+	metaClient SplitClient,
+	tlsConf *tls.Config,
+	keepaliveConf keepalive.ClientParameters,
+	addressMap map[string]string,
+) *importClient {
 	return &importClient{
 		metaClient:    metaClient,
 		clients:       make(map[uint64]import_sstpb.ImportSSTClient),
 		tlsConf:       tlsConf,
+		addressMap:    addressMap,
 		keepaliveConf: keepaliveConf,
 	}
 }
@@ -153,20 +221,17 @@ func (ic *importClient) GetImportClient(
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
-	opt := grpc.WithInsecure()
-	if ic.tlsConf != nil {
-		opt = grpc.WithTransportCredentials(credentials.NewTLS(ic.tlsConf))
-	}
 	addr := store.GetPeerAddress()
 	if addr == "" {
 		addr = store.GetAddress()
 	}
+	addr, tlsConf := storeDialTarget(storeID, addr, ic.addressMap, ic.tlsConf)
 	bfConf := backoff.DefaultConfig
 	bfConf.MaxDelay = gRPCBackOffMaxDelay
 	conn, err := grpc.DialContext(
 		ctx,
 		addr,
-		opt,
+		transportOption(tlsConf),
 		grpc.WithConnectParams(grpc.ConnectParams{Backoff: bfConf}),
 		grpc.WithKeepaliveParams(ic.keepaliveConf),
 	)
@@ -204,6 +269,21 @@ type FileImporter struct {
 	rawStartKey        []byte
 	rawEndKey          []byte
 	supportMultiIngest bool
+	// atomicCF makes the files of a region which have no keys in the region
+	// skipped alone, instead of skipping the region, so the other files are
+	// still ingested together. See Client.EnableAtomicCFIngest.
+	atomicCF bool
+	// keyCodec encodes the keys into the keys of regions, nil means
+	// DefaultKeyCodec. See Client.SetKeyCodec.
+	keyCodec KeyCodec
+	// cipher decrypts the SST files if they are encrypted.
+	cipher *backuppb.CipherInfo
+
+	// ingestedKVs counts the KV pairs of the ingested files if it's not nil.
+	ingestedKVs *ingestedKVCounter
+	// downloaded records the files downloaded but not ingested if it's not
+	// nil.
+	downloaded *downloadedSSTs
 }
 
 // NewFileImporter returns a new file importClient.
@@ -223,6 +303,14 @@ func NewFileImporter(
 	}
 }
 
+// getKeyCodec returns the codec of the keys of regions.
+func (importer *FileImporter) getKeyCodec() KeyCodec {
+	if importer.keyCodec == nil {
+		return DefaultKeyCodec
+	}
+	return importer.keyCodec
+}
+
 // CheckMultiIngestSupport checks whether all stores support multi-ingest
 func (importer *FileImporter) CheckMultiIngestSupport(ctx context.Context, pdClient pd.Client) error {
 	allStores, err := conn.GetAllTiKVStores(ctx, pdClient, conn.SkipTiFlash)
@@ -260,15 +348,25 @@ func (importer *FileImporter) Import(
 	files []*backuppb.File,
 	rewriteRules *RewriteRules,
 ) error {
-	log.Debug("import file", logutil.Files(files))
+	ctx, _ = logutil.ContextWithFileTaskID(ctx)
+	logutil.CL(ctx).Debug("import file", logutil.Files(files))
 	// Rewrite the start key and end key of file to scan regions
 	var startKey, endKey []byte
 	if importer.isRawKvMode {
-		startKey = files[0].StartKey
-		endKey = files[0].EndKey
+		// The files of different column families may have different ranges,
+		// scan the regions covered by any of them.
+		startKey, endKey = files[0].StartKey, files[0].EndKey
+		for _, f := range files[1:] {
+			if bytes.Compare(f.StartKey, startKey) < 0 {
+				startKey = f.StartKey
+			}
+			if len(endKey) != 0 && (len(f.EndKey) == 0 || bytes.Compare(f.EndKey, endKey) > 0) {
+				endKey = f.EndKey
+			}
+		}
 	} else {
 		for _, f := range files {
-			start, end, err := rewriteFileKeys(f, rewriteRules)
+			start, end, err := rewriteFileKeys(importer.getKeyCodec(), f, rewriteRules)
 			if err != nil {
 				return errors.Trace(err)
 			}
@@ -281,12 +379,25 @@ func (importer *FileImporter) Import(
 		}
 	}
 
-	log.Debug("rewrite file keys",
+	logutil.CL(ctx).Debug("rewrite file keys",
 		logutil.Files(files),
 		logutil.Key("startKey", startKey),
 		logutil.Key("endKey", endKey))
 
-	err := utils.WithRetry(ctx, func() error {
+	attempt := 0
+	err := utils.WithRetry(ctx, func() (err error) {
+		attempt++
+		start := time.Now()
+		defer func() {
+			if err != nil {
+				logutil.CL(ctx).Warn("import file attempt failed",
+					zap.Int("attempt", attempt),
+					zap.Duration("take", time.Since(start)),
+					logutil.ShortError(err))
+			}
+		}()
+		// ingestedKVs are the KV pairs of the files ingested into each region.
+		ingestedKVs := make([]*regionKVs, 0, 1)
 		tctx, cancel := context.WithTimeout(ctx, importScanRegionTime)
 		defer cancel()
 		// Scan regions covered by the file range
@@ -296,13 +407,16 @@ func (importer *FileImporter) Import(
 			return errors.Trace(errScanRegion)
 		}
 
-		log.Debug("scan regions", logutil.Files(files), zap.Int("count", len(regionInfos)))
+		logutil.CL(ctx).Debug("scan regions", logutil.Files(files),
+			zap.Int("attempt", attempt), zap.Int("count", len(regionInfos)))
 		// Try to download and ingest the file in every region
 	regionLoop:
 		for _, regionInfo := range regionInfos {
 			info := regionInfo
 			// Try to download file.
 			downloadMetas := make([]*import_sstpb.SSTMeta, 0, len(files))
+			downloadFiles := make([]*backuppb.File, 0, len(files))
+			downloadKVs := &regionKVs{}
 			remainFiles := files
 			errDownload := utils.WithRetry(ctx, func() error {
 				var e error
@@ -311,18 +425,29 @@ func (importer *FileImporter) Import(
 					if importer.isRawKvMode {
 						downloadMeta, e = importer.downloadRawKVSST(ctx, info, f)
 					} else {
-						downloadMeta, e = importer.downloadSST(ctx, info, f, rewriteRules)
+						var resp *import_sstpb.DownloadResponse
+						downloadMeta, resp, e = importer.downloadSST(ctx, info, f, rewriteRules)
+						if e == nil {
+							downloadKVs.add(f, resp)
+						}
 					}
 					failpoint.Inject("restore-storage-error", func(val failpoint.Value) {
 						msg := val.(string)
 						log.Debug("failpoint restore-storage-error injected.", zap.String("msg", msg))
 						e = errors.Annotate(e, msg)
 					})
+					if e != nil && importer.atomicCF && berrors.Is(e, berrors.ErrKVRangeIsEmpty) {
+						// The region has no keys of this file but may have
+						// keys of the files of the other column families.
+						e = nil
+						continue
+					}
 					if e != nil {
 						remainFiles = remainFiles[i:]
 						return errors.Trace(e)
 					}
 					downloadMetas = append(downloadMetas, downloadMeta)
+					downloadFiles = append(downloadFiles, f)
 				}
 
 				return nil
@@ -332,7 +457,7 @@ func (importer *FileImporter) Import(
 					switch errors.Cause(e) { // nolint:errorlint
 					case berrors.ErrKVRewriteRuleNotFound, berrors.ErrKVRangeIsEmpty:
 						// Skip this region
-						log.Warn("download file skipped",
+						logutil.CL(ctx).Warn("download file skipped",
 							logutil.Files(files),
 							logutil.Region(info.Region),
 							logutil.Key("startKey", startKey),
@@ -341,15 +466,24 @@ func (importer *FileImporter) Import(
 						continue regionLoop
 					}
 				}
-				log.Error("download file failed",
+				logutil.CL(ctx).Error("download file failed",
 					logutil.Files(files),
 					logutil.Region(info.Region),
 					logutil.Key("startKey", startKey),
 					logutil.Key("endKey", endKey),
 					logutil.ShortError(errDownload))
-				return errors.Trace(errDownload)
+				return berrors.WithRegion(errors.Trace(errDownload), info.Region.GetId(),
+					info.Region.GetStartKey(), info.Region.GetEndKey(), info.Leader.GetStoreId())
 			}
 
+			if len(downloadMetas) == 0 {
+				logutil.CL(ctx).Warn("download file skipped, the region has no keys of the files",
+					logutil.Files(files), logutil.Region(info.Region))
+				continue regionLoop
+			}
+			for _, f := range downloadFiles {
+				restoreBytesCounter.WithLabelValues("download").Add(float64(f.GetSize_()))
+			}
 			ingestResp, errIngest := importer.ingestSSTs(ctx, downloadMetas, info)
 		ingestRetry:
 			for errIngest == nil {
@@ -376,12 +510,12 @@ func (importer *FileImporter) Import(
 						}
 						// do not get region info, wait a second and continue
 						if newInfo == nil {
-							log.Warn("get region by key return nil", logutil.Region(info.Region))
+							logutil.CL(ctx).Warn("get region by key return nil", logutil.Region(info.Region))
 							time.Sleep(time.Second)
 							continue
 						}
 					}
-					log.Debug("ingest sst returns not leader error, retry it",
+					logutil.CL(ctx).Debug("ingest sst returns not leader error, retry it",
 						logutil.Region(info.Region),
 						zap.Stringer("newLeader", newInfo.Leader))
 
@@ -407,17 +541,26 @@ func (importer *FileImporter) Import(
 			}
 
 			if errIngest != nil {
-				log.Error("ingest file failed",
+				logutil.CL(ctx).Error("ingest file failed",
 					logutil.Files(files),
 					logutil.SSTMetas(downloadMetas),
 					logutil.Region(info.Region),
 					zap.Error(errIngest))
-				return errors.Trace(errIngest)
+				return berrors.WithRegion(errors.Trace(errIngest), info.Region.GetId(),
+					info.Region.GetStartKey(), info.Region.GetEndKey(), info.Leader.GetStoreId())
 			}
+			importer.downloaded.ingested(downloadMetas, info.Region)
+			ingestedKVs = append(ingestedKVs, downloadKVs)
 		}
 		for _, f := range files {
 			summary.CollectSuccessUnit(summary.TotalKV, 1, f.TotalKvs)
 			summary.CollectSuccessUnit(summary.TotalBytes, 1, f.TotalBytes)
+			restoreBytesCounter.WithLabelValues("ingest").Add(float64(f.TotalBytes))
+		}
+		if importer.ingestedKVs != nil {
+			for _, kvs := range ingestedKVs {
+				importer.ingestedKVs.add(kvs)
+			}
 		}
 
 		return nil
@@ -425,9 +568,9 @@ func (importer *FileImporter) Import(
 	return errors.Trace(err)
 }
 
-func (importer *FileImporter) setDownloadSpeedLimit(ctx context.Context, storeID uint64) error {
+func (importer *FileImporter) setDownloadSpeedLimit(ctx context.Context, storeID, rateLimit uint64) error {
 	req := &import_sstpb.SetDownloadSpeedLimitRequest{
-		SpeedLimit: importer.rateLimit,
+		SpeedLimit: rateLimit,
 	}
 	_, err := importer.importClient.SetDownloadSpeedLimit(ctx, storeID, req)
 	return errors.Trace(err)
@@ -438,17 +581,17 @@ func (importer *FileImporter) downloadSST(
 	regionInfo *RegionInfo,
 	file *backuppb.File,
 	rewriteRules *RewriteRules,
-) (*import_sstpb.SSTMeta, error) {
+) (*import_sstpb.SSTMeta, *import_sstpb.DownloadResponse, error) {
 	uid := uuid.New()
 	id := uid[:]
 	// Assume one region reflects to one rewrite rule
-	_, key, err := codec.DecodeBytes(regionInfo.Region.GetStartKey())
+	key, err := importer.getKeyCodec().DecodeKey(regionInfo.Region.GetStartKey())
 	if err != nil {
-		return nil, errors.Trace(err)
+		return nil, nil, errors.Trace(err)
 	}
 	regionRule := matchNewPrefix(key, rewriteRules)
 	if regionRule == nil {
-		return nil, errors.Trace(berrors.ErrKVRewriteRuleNotFound)
+		return nil, nil, errors.Trace(berrors.ErrKVRewriteRuleNotFound)
 	}
 	rule := import_sstpb.RewriteRule{
 		OldKeyPrefix: encodeKeyPrefix(regionRule.GetOldKeyPrefix()),
@@ -461,28 +604,36 @@ func (importer *FileImporter) downloadSST(
 		StorageBackend: importer.backend,
 		Name:           file.GetName(),
 		RewriteRule:    rule,
+		CipherInfo:     importer.cipher,
 	}
-	log.Debug("download SST",
+	logutil.CL(ctx).Debug("download SST",
 		logutil.SSTMeta(&sstMeta),
 		logutil.File(file),
 		logutil.Region(regionInfo.Region),
 	)
 	var resp *import_sstpb.DownloadResponse
 	for _, peer := range regionInfo.Region.GetPeers() {
-		resp, err = importer.importClient.DownloadSST(ctx, peer.GetStoreId(), req)
+		importer.downloaded.add(peer.GetStoreId(), uid)
+		resp, err = importer.downloadFromStore(ctx, peer.GetStoreId(), req)
 		if err != nil {
-			return nil, errors.Trace(err)
+			return nil, nil, errors.Trace(err)
 		}
 		if resp.GetError() != nil {
-			return nil, errors.Annotate(berrors.ErrKVDownloadFailed, resp.GetError().GetMessage())
+			return nil, nil, errors.Annotate(berrors.ErrKVDownloadFailed, resp.GetError().GetMessage())
 		}
 		if resp.GetIsEmpty() {
-			return nil, errors.Trace(berrors.ErrKVRangeIsEmpty)
+			return nil, nil, errors.Trace(berrors.ErrKVRangeIsEmpty)
 		}
 	}
-	sstMeta.Range.Start = truncateTS(resp.Range.GetStart())
-	sstMeta.Range.End = truncateTS(resp.Range.GetEnd())
-	return &sstMeta, nil
+	respRange := &import_sstpb.Range{
+		Start: truncateTS(resp.Range.GetStart()),
+		End:   truncateTS(resp.Range.GetEnd()),
+	}
+	if err = checkDownloadedRange(&sstMeta, respRange, regionInfo.Region.GetEndKey(), rule.GetNewKeyPrefix(), file); err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+	sstMeta.Range = respRange
+	return &sstMeta, resp, nil
 }
 
 func (importer *FileImporter) downloadRawKVSST(
@@ -515,12 +666,14 @@ func (importer *FileImporter) downloadRawKVSST(
 		Name:           file.GetName(),
 		RewriteRule:    rule,
 		IsRawKv:        true,
+		CipherInfo:     importer.cipher,
 	}
-	log.Debug("download SST", logutil.SSTMeta(&sstMeta), logutil.Region(regionInfo.Region))
+	logutil.CL(ctx).Debug("download SST", logutil.SSTMeta(&sstMeta), logutil.Region(regionInfo.Region))
 	var err error
 	var resp *import_sstpb.DownloadResponse
 	for _, peer := range regionInfo.Region.GetPeers() {
-		resp, err = importer.importClient.DownloadSST(ctx, peer.GetStoreId(), req)
+		importer.downloaded.add(peer.GetStoreId(), uid)
+		resp, err = importer.downloadFromStore(ctx, peer.GetStoreId(), req)
 		if err != nil {
 			return nil, errors.Trace(err)
 		}
@@ -531,11 +684,73 @@ func (importer *FileImporter) downloadRawKVSST(
 			return nil, errors.Trace(berrors.ErrKVRangeIsEmpty)
 		}
 	}
-	sstMeta.Range.Start = resp.Range.GetStart()
-	sstMeta.Range.End = resp.Range.GetEnd()
+	respRange := &import_sstpb.Range{
+		Start: resp.Range.GetStart(),
+		End:   resp.Range.GetEnd(),
+	}
+	if err = checkDownloadedRange(&sstMeta, respRange, regionInfo.Region.GetEndKey(), nil, file); err != nil {
+		return nil, errors.Trace(err)
+	}
+	sstMeta.Range = respRange
 	return &sstMeta, nil
 }
 
+// checkDownloadedRange verifies the range of the downloaded SST falls within
+// the requested range, which is inside the region, and has the new prefix of
+// the rewrite rule, and the SST has a column family. Otherwise ingesting the
+// SST fails with a vague error, e.g. epoch not match, so fail fast with the
+// details instead.
+func checkDownloadedRange(
+	req *import_sstpb.SSTMeta, resp *import_sstpb.Range, regionEnd, newPrefix []byte, file *backuppb.File,
+) error {
+	mismatch := func(reason string) error {
+		return errors.Annotatef(berrors.ErrKVDownloadRangeMismatch,
+			"%s, file %s, cf %s, region %d, requested range [%s, %s], downloaded range [%s, %s]",
+			reason, file.GetName(), req.GetCfName(), req.GetRegionId(),
+			redact.Key(req.GetRange().GetStart()), redact.Key(req.GetRange().GetEnd()),
+			redact.Key(resp.GetStart()), redact.Key(resp.GetEnd()))
+	}
+	if len(req.GetCfName()) == 0 {
+		return mismatch("the column family is unknown")
+	}
+	if len(resp.GetEnd()) > 0 && bytes.Compare(resp.GetStart(), resp.GetEnd()) > 0 {
+		return mismatch("the downloaded range is reversed")
+	}
+	if bytes.Compare(resp.GetStart(), req.GetRange().GetStart()) < 0 {
+		return mismatch("the downloaded range starts before the requested range")
+	}
+	// The end key of the downloaded range is inclusive, while the requested
+	// end key is exclusive if it's the end of the region.
+	reqEnd := req.GetRange().GetEnd()
+	if len(reqEnd) > 0 {
+		exclusive := req.GetEndKeyExclusive() || bytes.Equal(reqEnd, regionEnd)
+		if cmp := bytes.Compare(resp.GetEnd(), reqEnd); cmp > 0 || (cmp == 0 && exclusive) {
+			return mismatch("the downloaded range ends after the requested range")
+		}
+	}
+	if len(newPrefix) > 0 && (!bytes.HasPrefix(resp.GetStart(), newPrefix) || !bytes.HasPrefix(resp.GetEnd(), newPrefix)) {
+		return mismatch("the downloaded keys aren't rewritten by the rewrite rule")
+	}
+	return nil
+}
+
+// downloadFromStore sends the download request to the store, and logs the
+// store, duration and error of the request with the file task ID.
+func (importer *FileImporter) downloadFromStore(
+	ctx context.Context, storeID uint64, req *import_sstpb.DownloadRequest,
+) (*import_sstpb.DownloadResponse, error) {
+	start := time.Now()
+	resp, err := importer.importClient.DownloadSST(ctx, storeID, req)
+	restoreImportHistogram.WithLabelValues("download").Observe(time.Since(start).Seconds())
+	logutil.CL(ctx).Debug("download SST from store",
+		zap.String("file", req.GetName()),
+		zap.Uint64("store-id", storeID),
+		zap.Duration("take", time.Since(start)),
+		zap.String("resp-error", resp.GetError().GetMessage()),
+		zap.Error(err))
+	return resp, errors.Trace(err)
+}
+
 func (importer *FileImporter) ingestSSTs(
 	ctx context.Context,
 	sstMetas []*import_sstpb.SSTMeta,
@@ -560,8 +775,10 @@ func (importer *FileImporter) ingestSSTs(
 			Context: reqCtx,
 			Sst:     sstMetas[0],
 		}
-		log.Debug("ingest SST", logutil.SSTMeta(sstMetas[0]), logutil.Leader(leader))
+		logutil.CL(ctx).Debug("ingest SST", logutil.SSTMeta(sstMetas[0]), logutil.Leader(leader))
+		start := time.Now()
 		resp, err := importer.importClient.IngestSST(ctx, leader.GetStoreId(), req)
+		logIngest(ctx, leader.GetStoreId(), start, resp, err)
 		return resp, errors.Trace(err)
 	}
 
@@ -569,7 +786,24 @@ func (importer *FileImporter) ingestSSTs(
 		Context: reqCtx,
 		Ssts:    sstMetas,
 	}
-	log.Debug("ingest SSTs", logutil.SSTMetas(sstMetas), logutil.Leader(leader))
+	logutil.CL(ctx).Debug("ingest SSTs", logutil.SSTMetas(sstMetas), logutil.Leader(leader))
+	start := time.Now()
 	resp, err := importer.importClient.MultiIngest(ctx, leader.GetStoreId(), req)
+	logIngest(ctx, leader.GetStoreId(), start, resp, err)
 	return resp, errors.Trace(err)
 }
+
+// logIngest logs the store, duration and error of the ingest request with the
+// file task ID, and observes the duration.
+func logIngest(ctx context.Context, storeID uint64, start time.Time, resp *import_sstpb.IngestResponse, err error) {
+	restoreImportHistogram.WithLabelValues("ingest").Observe(time.Since(start).Seconds())
+	fields := []zap.Field{
+		zap.Uint64("store-id", storeID),
+		zap.Duration("take", time.Since(start)),
+		zap.Error(err),
+	}
+	if respErr := resp.GetError(); respErr != nil {
+		fields = append(fields, zap.Stringer("resp-error", respErr))
+	}
+	logutil.CL(ctx).Debug("ingest SSTs to store", fields...)
+}
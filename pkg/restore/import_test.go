@@ -0,0 +1,95 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package restore
+
+import (
+	"crypto/tls"
+
+	. "github.com/pingcap/check"
+	backuppb "github.com/pingcap/kvproto/pkg/backup"
+	"github.com/pingcap/kvproto/pkg/import_sstpb"
+)
+
+type testImportSuite struct{}
+
+var _ = Suite(&testImportSuite{})
+
+func (s *testImportSuite) TestCheckDownloadedRange(c *C) {
+	file := &backuppb.File{Name: "1.sst"}
+	cases := []struct {
+		name       string
+		unbounded  bool
+		exclusive  bool
+		regionEnd  string
+		newPrefix  string
+		noCF       bool
+		start, end string
+		err        string
+	}{
+		{name: "inside", start: "b", end: "c"},
+		{name: "empty inside", start: "c", end: "c"},
+		{name: "inclusive end", start: "b", end: "d"},
+		{name: "exclusive end", start: "b", end: "d", exclusive: true, err: ".*ends after the requested range.*"},
+		{name: "region end", start: "b", end: "d", regionEnd: "d", err: ".*ends after the requested range.*"},
+		{name: "unbounded", unbounded: true, start: "c", end: "zz"},
+		{name: "partially before", start: "a", end: "c", err: ".*starts before the requested range.*"},
+		{name: "partially after", start: "c", end: "e", err: ".*ends after the requested range.*"},
+		{name: "fully before", start: "0", end: "a", err: ".*starts before the requested range.*"},
+		{name: "fully after", start: "x", end: "y", err: ".*ends after the requested range.*"},
+		{name: "empty outside", start: "x", end: "x", err: ".*ends after the requested range.*"},
+		{name: "reversed", start: "c", end: "b", err: ".*the downloaded range is reversed.*"},
+		{name: "unknown cf", noCF: true, start: "b", end: "c", err: ".*the column family is unknown.*"},
+		{name: "rewritten", newPrefix: "b", start: "b1", end: "b2"},
+		{name: "not rewritten", newPrefix: "b", start: "b1", end: "c", err: ".*aren't rewritten by the rewrite rule.*"},
+	}
+	for _, cs := range cases {
+		// The requested range is [b, d) of the region [a, z) by default.
+		req := &import_sstpb.SSTMeta{
+			Range:           &import_sstpb.Range{Start: []byte("b"), End: []byte("d")},
+			CfName:          "default",
+			RegionId:        1,
+			EndKeyExclusive: cs.exclusive,
+		}
+		if cs.unbounded {
+			req.Range.End = nil
+		}
+		if cs.noCF {
+			req.CfName = ""
+		}
+		regionEnd := []byte("z")
+		if cs.regionEnd != "" {
+			regionEnd = []byte(cs.regionEnd)
+		}
+		var newPrefix []byte
+		if cs.newPrefix != "" {
+			newPrefix = []byte(cs.newPrefix)
+		}
+		resp := &import_sstpb.Range{Start: []byte(cs.start), End: []byte(cs.end)}
+		err := checkDownloadedRange(req, resp, regionEnd, newPrefix, file)
+		comment := Commentf("case %s", cs.name)
+		if cs.err == "" {
+			c.Assert(err, IsNil, comment)
+		} else {
+			c.Assert(err, ErrorMatches, cs.err, comment)
+		}
+	}
+}
+
+func (s *testImportSuite) TestStoreDialTarget(c *C) {
+	addressMap := map[string]string{"tikv-0.tikv:20160": "10.0.1.10:30160"}
+	tlsConf := &tls.Config{}
+
+	addr, conf := storeDialTarget(1, "tikv-1.tikv:20160", addressMap, tlsConf)
+	c.Assert(addr, Equals, "tikv-1.tikv:20160")
+	c.Assert(conf, Equals, tlsConf)
+
+	// The certificate is verified against the advertised host.
+	addr, conf = storeDialTarget(1, "tikv-0.tikv:20160", addressMap, tlsConf)
+	c.Assert(addr, Equals, "10.0.1.10:30160")
+	c.Assert(conf.ServerName, Equals, "tikv-0.tikv")
+	c.Assert(tlsConf.ServerName, Equals, "")
+
+	addr, conf = storeDialTarget(1, "tikv-0.tikv:20160", addressMap, nil)
+	c.Assert(addr, Equals, "10.0.1.10:30160")
+	c.Assert(conf, IsNil)
+}
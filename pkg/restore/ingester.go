@@ -31,9 +31,11 @@ import (
 	"github.com/pingcap/log"
 	"github.com/tikv/pd/pkg/codec"
 	"go.uber.org/zap"
+	"golang.org/x/sync/errgroup"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/backoff"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/encoding/gzip"
 	"google.golang.org/grpc/keepalive"
 
 	"github.com/pingcap/br/pkg/conn"
@@ -56,6 +58,26 @@ const (
 	defaultSplitSize = 96 * 1024 * 1024
 )
 
+// The names of the gRPC compression of the Write requests.
+const (
+	GRPCCompressionNone = "none"
+	GRPCCompressionGzip = "gzip"
+)
+
+// ParseGRPCCompression returns the name of the gRPC compressor, empty for no
+// compression.
+func ParseGRPCCompression(name string) (string, error) {
+	switch strings.ToLower(name) {
+	case "", GRPCCompressionNone:
+		return "", nil
+	case GRPCCompressionGzip:
+		return gzip.Name, nil
+	default:
+		return "", errors.Annotatef(berrors.ErrInvalidArgument,
+			"unknown grpc compression %s, should be one of %s, %s", name, GRPCCompressionNone, GRPCCompressionGzip)
+	}
+}
+
 type retryType int
 
 const (
@@ -87,6 +109,8 @@ type Ingester struct {
 
 	tlsConf *tls.Config
 	conns   gRPCConns
+	// compressor is the name of the gRPC compressor, empty for no compression.
+	compressor string
 
 	splitCli   SplitClient
 	WorkerPool *utils.WorkerPool
@@ -114,6 +138,14 @@ func NewIngester(
 	}
 }
 
+// SetGRPCCompressor compresses the requests to TiKV by the compressor returned
+// by ParseGRPCCompression. The Write requests carry the KV pairs, so it saves
+// the bandwidth between BR and TiKV at the cost of CPU. It should be called
+// before writing.
+func (i *Ingester) SetGRPCCompressor(compressor string) {
+	i.compressor = compressor
+}
+
 func (i *Ingester) makeConn(ctx context.Context, storeID uint64) (*grpc.ClientConn, error) {
 	store, err := i.splitCli.GetStore(ctx, storeID)
 	if err != nil {
@@ -132,9 +164,7 @@ func (i *Ingester) makeConn(ctx context.Context, storeID uint64) (*grpc.ClientCo
 	if addr == "" {
 		addr = store.GetAddress()
 	}
-	grpcConn, err := grpc.DialContext(
-		ctx,
-		addr,
+	opts := []grpc.DialOption{
 		opt,
 		grpc.WithConnectParams(grpc.ConnectParams{Backoff: bfConf}),
 		grpc.WithKeepaliveParams(keepalive.ClientParameters{
@@ -142,7 +172,11 @@ func (i *Ingester) makeConn(ctx context.Context, storeID uint64) (*grpc.ClientCo
 			Timeout:             gRPCKeepAliveTimeout,
 			PermitWithoutStream: true,
 		}),
-	)
+	}
+	if len(i.compressor) > 0 {
+		opts = append(opts, grpc.WithDefaultCallOptions(grpc.UseCompressor(i.compressor)))
+	}
+	grpcConn, err := grpc.DialContext(ctx, addr, opts...)
 	cancel()
 	if err != nil {
 		return nil, errors.Trace(err)
@@ -150,6 +184,42 @@ func (i *Ingester) makeConn(ctx context.Context, storeID uint64) (*grpc.ClientCo
 	return grpcConn, nil
 }
 
+// WriteAndIngest writes the sorted pairs without duplicated keys into TiKV,
+// and ingests them at the commit ts of the ingester.
+func (i *Ingester) WriteAndIngest(ctx context.Context, pairs kv.Pairs) error {
+	if len(pairs) == 0 {
+		return nil
+	}
+	remainRange := newSyncdRanges()
+	remainRange.add(Range{
+		Start: pairs[0].Key,
+		End:   kv.NextKey(pairs[len(pairs)-1].Key),
+	})
+	iterProducer := kv.NewSimpleKVIterProducer(pairs)
+	for {
+		remain := remainRange.take()
+		if len(remain) == 0 {
+			return nil
+		}
+		eg, ectx := errgroup.WithContext(ctx)
+		for _, r := range remain {
+			rangeReplica := r
+			i.WorkerPool.ApplyOnErrorGroup(eg, func() error {
+				err := i.writeAndIngestByRange(ectx, iterProducer, rangeReplica.Start, rangeReplica.End, remainRange)
+				if err != nil {
+					log.Warn("write and ingest failed with range", zap.Any("range", rangeReplica), zap.Error(err))
+					return errors.Trace(err)
+				}
+				return nil
+			})
+		}
+		if err := eg.Wait(); err != nil {
+			return errors.Trace(err)
+		}
+		log.Info("ranges unfinished, retry it", zap.Int("remain ranges", len(remain)))
+	}
+}
+
 // write [start, end) kv in to tikv.
 func (i *Ingester) writeAndIngestByRange(
 	ctxt context.Context,
@@ -400,6 +470,7 @@ func (i *Ingester) writeToTiKV(
 		} else {
 			pairs[count].Key = bytesBuf.AddBytes(iter.Key())
 			pairs[count].Value = bytesBuf.AddBytes(iter.Value())
+			pairs[count].Op = iter.OpType()
 		}
 		count++
 		totalCount++
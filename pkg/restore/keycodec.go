@@ -0,0 +1,68 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package restore
+
+import (
+	"strings"
+
+	"github.com/pingcap/errors"
+	"github.com/tikv/pd/pkg/codec"
+
+	berrors "github.com/pingcap/br/pkg/errors"
+)
+
+// KeyCodec converts between the keys in the backup and the keys of the TiKV
+// regions. It's used by the region split and the range math of restore.
+type KeyCodec interface {
+	// EncodeKey encodes the key into the key of regions.
+	EncodeKey(key []byte) []byte
+	// DecodeKey decodes the key of regions.
+	DecodeKey(key []byte) ([]byte, error)
+}
+
+// The names of the built-in key codecs.
+const (
+	// KeyCodecMemComparable is the memcomparable format used by TiDB and the
+	// API V1 of RawKV, it's the default codec.
+	KeyCodecMemComparable = "memcomparable"
+	// KeyCodecIdentity keeps the keys as is, for the keys which have been
+	// encoded by the users.
+	KeyCodecIdentity = "identity"
+)
+
+type memComparableCodec struct{}
+
+func (memComparableCodec) EncodeKey(key []byte) []byte {
+	return codec.EncodeBytes(key)
+}
+
+func (memComparableCodec) DecodeKey(key []byte) ([]byte, error) {
+	_, decoded, err := codec.DecodeBytes(key)
+	return decoded, errors.Trace(err)
+}
+
+type identityCodec struct{}
+
+func (identityCodec) EncodeKey(key []byte) []byte {
+	return key
+}
+
+func (identityCodec) DecodeKey(key []byte) ([]byte, error) {
+	return key, nil
+}
+
+// DefaultKeyCodec is the key codec used if not specified.
+var DefaultKeyCodec KeyCodec = memComparableCodec{}
+
+// ParseKeyCodec returns the built-in key codec of the name.
+func ParseKeyCodec(name string) (KeyCodec, error) {
+	switch strings.ToLower(name) {
+	case "", KeyCodecMemComparable:
+		return memComparableCodec{}, nil
+	case KeyCodecIdentity:
+		return identityCodec{}, nil
+	default:
+		return nil, errors.Annotatef(berrors.ErrInvalidArgument,
+			"unknown key codec %s, should be one of %s, %s", name, KeyCodecMemComparable, KeyCodecIdentity)
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package restore
+
+import (
+	"context"
+	"encoding/hex"
+
+	. "github.com/pingcap/check"
+	"github.com/pingcap/errors"
+	"github.com/pingcap/kvproto/pkg/import_sstpb"
+	"github.com/pingcap/kvproto/pkg/metapb"
+	"github.com/tikv/pd/pkg/codec"
+
+	berrors "github.com/pingcap/br/pkg/errors"
+)
+
+type testKeyCodecSuite struct{}
+
+var _ = Suite(&testKeyCodecSuite{})
+
+// TestIdentityCodecConsistent checks the split, the rewrite and the placement
+// rules agree on the keys of regions with the identity codec.
+func (s *testKeyCodecSuite) TestIdentityCodecConsistent(c *C) {
+	identity, err := ParseKeyCodec(KeyCodecIdentity)
+	c.Assert(err, IsNil)
+
+	// The placement rule starts at the rewritten key.
+	startHex := rawRangeKeyHex(identity, []byte("r2-key"), false)
+	c.Assert(startHex, Equals, hex.EncodeToString([]byte("r2-key")))
+	c.Assert(rawRangeKeyHex(identity, nil, true), Equals, "")
+	endHex := rawRangeKeyHex(identity, []byte("r3"), true)
+	start, err := hex.DecodeString(startHex)
+	c.Assert(err, IsNil)
+	end, err := hex.DecodeString(endHex)
+	c.Assert(err, IsNil)
+	region := &RegionInfo{Region: &metapb.Region{Id: 1, StartKey: start, EndKey: end}}
+
+	rules := &RewriteRules{Data: []*import_sstpb.RewriteRule{
+		{OldKeyPrefix: []byte("r0"), NewKeyPrefix: []byte("r2")},
+	}}
+	rewritten, rule := rewriteRawKey(identity, []byte("r0-key"), rules)
+	c.Assert(rule, NotNil)
+	c.Assert(rewritten, DeepEquals, start)
+
+	// The region split at the start of the rule needn't be split again.
+	index := newRegionIndex([]*RegionInfo{region})
+	c.Assert(index.needSplit(identity, []byte("r2-key")), IsNil)
+	c.Assert(index.needSplit(identity, []byte("r2-key2")), Equals, region)
+	// The memcomparable encoded key doesn't match the boundary.
+	c.Assert(index.needSplit(DefaultKeyCodec, []byte("r2-key")), Equals, region)
+
+	key, err := identity.DecodeKey(rewritten)
+	c.Assert(err, IsNil)
+	c.Assert(key, DeepEquals, []byte("r2-key"))
+}
+
+func (s *testKeyCodecSuite) TestRawKVSplitCheck(c *C) {
+	ctx := context.Background()
+	identity, err := ParseKeyCodec(KeyCodecIdentity)
+	c.Assert(err, IsNil)
+
+	// The TiKV supporting the raw key splits keeps the codec.
+	splitter := NewRegionSplitter(nil)
+	splitter.SetKeyCodec(identity)
+	checked := 0
+	splitter.SetRawKVSplitCheck(func(context.Context) error {
+		checked++
+		return nil
+	})
+	splitter.checkRawKVSplit(ctx)
+	splitter.checkRawKVSplit(ctx)
+	c.Assert(checked, Equals, 1)
+	c.Assert(splitter.codec, Equals, identity)
+
+	// The older TiKV splits by the memcomparable keys as before.
+	splitter = NewRegionSplitter(nil)
+	splitter.SetKeyCodec(identity)
+	splitter.SetRawKVSplitCheck(func(context.Context) error {
+		return errors.Annotate(berrors.ErrVersionMismatch, "TiKV v5.0.0")
+	})
+	splitter.checkRawKVSplit(ctx)
+	c.Assert(splitter.codec, Equals, DefaultKeyCodec)
+	c.Assert(splitter.codec.EncodeKey([]byte("r")), DeepEquals, codec.EncodeBytes([]byte("r")))
+}
@@ -0,0 +1,111 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package restore
+
+import (
+	"bytes"
+	"encoding/hex"
+	"sort"
+	"time"
+
+	"github.com/pingcap/errors"
+	backuppb "github.com/pingcap/kvproto/pkg/backup"
+
+	"github.com/pingcap/br/pkg/metautil"
+	"github.com/pingcap/br/pkg/rtree"
+)
+
+// The tags of the data of KeyVizMatrix, named after the tags of the key
+// visualizer.
+const (
+	KeyVizTagWrittenBytes = "written_bytes"
+	KeyVizTagWrittenKeys  = "written_keys"
+)
+
+// KeyVizKey is a boundary of the key axis of KeyVizMatrix.
+type KeyVizKey struct {
+	// Key is the hex encoded key.
+	Key string `json:"key"`
+	// Labels are the database and the table of the range starting from the
+	// key, empty for the gaps between the tables.
+	Labels []string `json:"labels"`
+}
+
+// KeyVizMatrix is the planned split map of a restore, in the matrix format
+// of the key visualizer of TiDB Dashboard, so it can be rendered as a
+// heatmap. The key axis is the boundaries of the ranges to split, and the
+// time axis is a single slot, thus Data[tag][0][i] is the value of the range
+// between KeyAxis[i] and KeyAxis[i+1].
+type KeyVizMatrix struct {
+	KeyAxis  []KeyVizKey           `json:"keyAxis"`
+	TimeAxis []int64               `json:"timeAxis"`
+	Data     map[string][][]uint64 `json:"data"`
+}
+
+type labeledRange struct {
+	rtree.Range
+	labels []string
+}
+
+// BuildKeyVizMatrix builds the split map of restoring the files of the
+// tables. The ranges are merged like restoring, but the keys are the keys in
+// the backup, since the table IDs are rewritten only after creating the
+// tables.
+func BuildKeyVizMatrix(
+	tables []*metautil.Table,
+	files []*backuppb.File,
+	splitSizeBytes, splitKeyCount uint64,
+	at time.Time,
+) (*KeyVizMatrix, error) {
+	restored := make(map[*backuppb.File]struct{}, len(files))
+	for _, f := range files {
+		restored[f] = struct{}{}
+	}
+	ranges := make([]labeledRange, 0, len(tables))
+	for _, tbl := range tables {
+		tableFiles := make([]*backuppb.File, 0, len(tbl.Files))
+		for _, f := range tbl.Files {
+			if _, ok := restored[f]; ok {
+				tableFiles = append(tableFiles, f)
+			}
+		}
+		tableRanges, _, err := MergeFileRanges(tableFiles, splitSizeBytes, splitKeyCount)
+		if err != nil {
+			return nil, errors.Annotatef(err, "failed to plan table %s.%s", tbl.DB.Name, tbl.Info.Name)
+		}
+		for _, rg := range tableRanges {
+			ranges = append(ranges, labeledRange{Range: rg, labels: []string{tbl.DB.Name.O, tbl.Info.Name.O}})
+		}
+	}
+	sort.Slice(ranges, func(i, j int) bool {
+		return bytes.Compare(ranges[i].StartKey, ranges[j].StartKey) < 0
+	})
+
+	matrix := &KeyVizMatrix{
+		KeyAxis:  make([]KeyVizKey, 0, len(ranges)+1),
+		TimeAxis: []int64{at.Unix(), at.Unix() + 1},
+		Data: map[string][][]uint64{
+			KeyVizTagWrittenBytes: {make([]uint64, 0, len(ranges))},
+			KeyVizTagWrittenKeys:  {make([]uint64, 0, len(ranges))},
+		},
+	}
+	appendRange := func(startKey []byte, labels []string, size, kvs uint64) {
+		matrix.KeyAxis = append(matrix.KeyAxis, KeyVizKey{Key: hex.EncodeToString(startKey), Labels: labels})
+		matrix.Data[KeyVizTagWrittenBytes][0] = append(matrix.Data[KeyVizTagWrittenBytes][0], size)
+		matrix.Data[KeyVizTagWrittenKeys][0] = append(matrix.Data[KeyVizTagWrittenKeys][0], kvs)
+	}
+	var lastEndKey []byte
+	for i, rg := range ranges {
+		if i > 0 && !bytes.Equal(rg.StartKey, lastEndKey) {
+			// the gap between the ranges, no data is restored into it.
+			appendRange(lastEndKey, []string{}, 0, 0)
+		}
+		size, kvs := rg.BytesAndKeys()
+		appendRange(rg.StartKey, rg.labels, size, kvs)
+		lastEndKey = rg.EndKey
+	}
+	if len(ranges) > 0 {
+		matrix.KeyAxis = append(matrix.KeyAxis, KeyVizKey{Key: hex.EncodeToString(lastEndKey), Labels: []string{}})
+	}
+	return matrix, nil
+}
@@ -0,0 +1,156 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package restore
+
+import (
+	"context"
+	"sync"
+
+	"github.com/pingcap/errors"
+	backuppb "github.com/pingcap/kvproto/pkg/backup"
+	"github.com/pingcap/kvproto/pkg/import_sstpb"
+	"github.com/pingcap/log"
+	"github.com/pingcap/tidb/tablecodec"
+	"go.uber.org/zap"
+
+	berrors "github.com/pingcap/br/pkg/errors"
+	"github.com/pingcap/br/pkg/glue"
+)
+
+// ingestedKVCounter counts the KV pairs TiKV reports in the responses of
+// downloading the ingested files, by the table ID in the backup. Only the
+// write CF is counted, which has a KV pair for each row and index entry, as
+// the checksum does.
+type ingestedKVCounter struct {
+	mu  sync.Mutex
+	kvs map[int64]uint64
+	// unreported is set once TiKV doesn't report the KV count of a file it
+	// downloaded, which the older TiKV doesn't.
+	unreported bool
+}
+
+func newIngestedKVCounter() *ingestedKVCounter {
+	return &ingestedKVCounter{kvs: make(map[int64]uint64)}
+}
+
+// regionKVs are the KV pairs of the files downloaded into a region, which are
+// added into the counter once the files are ingested.
+type regionKVs struct {
+	kvs        map[int64]uint64
+	unreported bool
+}
+
+// add records the KV count of the download response of the file.
+func (r *regionKVs) add(file *backuppb.File, resp *import_sstpb.DownloadResponse) {
+	if file.GetCf() != writeCFName {
+		return
+	}
+	if resp.GetTotalKvs() == 0 {
+		// The empty responses are skipped, so a file downloaded has keys.
+		r.unreported = true
+		return
+	}
+	if r.kvs == nil {
+		r.kvs = make(map[int64]uint64)
+	}
+	r.kvs[tablecodec.DecodeTableID(file.GetStartKey())] += resp.GetTotalKvs()
+}
+
+func (c *ingestedKVCounter) add(r *regionKVs) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for tableID, kvs := range r.kvs {
+		c.kvs[tableID] += kvs
+	}
+	c.unreported = c.unreported || r.unreported
+}
+
+func (c *ingestedKVCounter) get(tableIDs ...int64) (kvs uint64, reported bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, id := range tableIDs {
+		kvs += c.kvs[id]
+	}
+	return kvs, !c.unreported
+}
+
+// EnableKVCountVerification makes the client count the KV pairs of the
+// ingested files, so GoValidateKVCount can verify the restored tables without
+// the checksum. It must be called before InitBackupMeta.
+func (rc *Client) EnableKVCountVerification() {
+	rc.ingestedKVs = newIngestedKVCounter()
+}
+
+// GoValidateKVCount is a lightweight alternative of GoValidateChecksum. It
+// verifies the KV count TiKV reports for the files ingested of each table
+// equals to the KV count of the table recorded in the backupmeta, which
+// detects the data that is missing or ingested into nowhere, but not the
+// corrupted data.
+func (rc *Client) GoValidateKVCount(
+	ctx context.Context,
+	tableStream <-chan CreatedTable,
+	errCh chan<- error,
+	updateCh glue.Progress,
+) <-chan struct{} {
+	log.Info("Start to validate kv count")
+	outCh := make(chan struct{}, 1)
+	go func() {
+		defer func() {
+			log.Info("all kv count validation ended")
+			outCh <- struct{}{}
+			close(outCh)
+		}()
+		for {
+			select {
+			case <-ctx.Done():
+				errCh <- ctx.Err()
+				return
+			case tbl, ok := <-tableStream:
+				if !ok {
+					return
+				}
+				if err := rc.quarantineMismatch(tbl, rc.validateKVCount(tbl)); err != nil {
+					errCh <- err
+					return
+				}
+				updateCh.Inc()
+			}
+		}
+	}()
+	return outCh
+}
+
+func (rc *Client) validateKVCount(tbl CreatedTable) error {
+	table := tbl.OldTable
+	logger := log.With(
+		zap.String("db", table.DB.Name.O),
+		zap.String("table", table.Info.Name.O),
+	)
+	if table.NoChecksum() {
+		logger.Warn("table has no checksum, skipping kv count validation")
+		return nil
+	}
+	if rc.ingestedKVs == nil {
+		return errors.Annotate(berrors.ErrInvalidArgument, "kv count verification is not enabled")
+	}
+
+	tableIDs := []int64{table.Info.ID}
+	if table.Info.Partition != nil {
+		for _, def := range table.Info.Partition.Definitions {
+			tableIDs = append(tableIDs, def.ID)
+		}
+	}
+	ingested, reported := rc.ingestedKVs.get(tableIDs...)
+	if !reported {
+		return errors.Annotate(berrors.ErrVersionMismatch,
+			"TiKV doesn't report the kv count of the downloaded files, please verify the data by the checksum instead")
+	}
+	if ingested != table.TotalKvs {
+		logger.Error("failed in validate kv count",
+			zap.Uint64("origin tidb total kvs", table.TotalKvs),
+			zap.Uint64("ingested total kvs", ingested))
+		return errors.Annotatef(berrors.ErrRestoreChecksumMismatch,
+			"failed to validate kv count of table %s.%s", table.DB.Name.O, table.Info.Name.O)
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package restore
+
+import (
+	. "github.com/pingcap/check"
+	backuppb "github.com/pingcap/kvproto/pkg/backup"
+	"github.com/pingcap/kvproto/pkg/import_sstpb"
+	"github.com/pingcap/tidb/tablecodec"
+)
+
+func (s *testImportSuite) TestIngestedKVCounter(c *C) {
+	writeFile := &backuppb.File{Name: "1_write.sst", Cf: writeCFName, StartKey: tablecodec.EncodeTablePrefix(1), TotalKvs: 100}
+	defaultFile := &backuppb.File{Name: "1_default.sst", Cf: defaultCFName, StartKey: tablecodec.EncodeTablePrefix(1)}
+	otherFile := &backuppb.File{Name: "2_write.sst", Cf: writeCFName, StartKey: tablecodec.EncodeTablePrefix(2)}
+
+	counter := newIngestedKVCounter()
+	// The write file is split into 2 regions, only the KV pairs TiKV reports
+	// are counted rather than the ones of the backupmeta.
+	for _, kvs := range []uint64{30, 40} {
+		region := &regionKVs{}
+		region.add(writeFile, &import_sstpb.DownloadResponse{TotalKvs: kvs})
+		region.add(defaultFile, &import_sstpb.DownloadResponse{TotalKvs: 1000})
+		counter.add(region)
+	}
+	region := &regionKVs{}
+	region.add(otherFile, &import_sstpb.DownloadResponse{TotalKvs: 5})
+	counter.add(region)
+
+	kvs, reported := counter.get(1)
+	c.Assert(reported, IsTrue)
+	c.Assert(kvs, Equals, uint64(70))
+	kvs, _ = counter.get(1, 2, 3)
+	c.Assert(kvs, Equals, uint64(75))
+
+	// The older TiKV doesn't report the KV count.
+	region = &regionKVs{}
+	region.add(otherFile, &import_sstpb.DownloadResponse{})
+	counter.add(region)
+	_, reported = counter.get(1)
+	c.Assert(reported, IsFalse)
+}
@@ -61,6 +61,20 @@ type LogMeta struct {
 	GlobalResolvedTS uint64           `json:"global_resolved_ts"`
 }
 
+// ReadLogMeta reads the log.meta of the cdc log backup in the storage.
+func ReadLogMeta(ctx context.Context, s storage.ExternalStorage) (*LogMeta, error) {
+	data, err := s.ReadFile(ctx, metaFile)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	meta := new(LogMeta)
+	if err = json.Unmarshal(data, meta); err != nil {
+		return nil, errors.Trace(err)
+	}
+	log.Info("get meta from storage", zap.Binary("data", data))
+	return meta, nil
+}
+
 // LogClient sends requests to restore files.
 type LogClient struct {
 	// lock DDL execution
@@ -114,7 +128,7 @@ func NewLogRestoreClient(
 	}
 
 	tlsConf := restoreClient.GetTLSConfig()
-	splitClient := NewSplitClient(restoreClient.GetPDClient(), tlsConf)
+	splitClient := NewSplitClientWithPDTLS(restoreClient.GetPDClient(), tlsConf, restoreClient.pdTLSConf)
 	importClient := NewImportClient(splitClient, tlsConf, restoreClient.keepaliveConf)
 
 	cfg := concurrencyCfg{
@@ -403,35 +417,10 @@ func (l *LogClient) writeRows(ctx context.Context, kvs kv.Pairs) error {
 		newKvs = append(newKvs, kvs[i])
 	}
 
-	remainRange := newSyncdRanges()
-	remainRange.add(Range{
-		Start: newKvs[0].Key,
-		End:   kv.NextKey(newKvs[len(newKvs)-1].Key),
-	})
-	iterProducer := kv.NewSimpleKVIterProducer(newKvs)
-	for {
-		remain := remainRange.take()
-		if len(remain) == 0 {
-			log.Info("writeRows finish")
-			break
-		}
-		eg, ectx := errgroup.WithContext(ctx)
-		for _, r := range remain {
-			rangeReplica := r
-			l.ingester.WorkerPool.ApplyOnErrorGroup(eg, func() error {
-				err := l.ingester.writeAndIngestByRange(ectx, iterProducer, rangeReplica.Start, rangeReplica.End, remainRange)
-				if err != nil {
-					log.Warn("writeRows failed with range", zap.Any("range", rangeReplica), zap.Error(err))
-					return errors.Trace(err)
-				}
-				return nil
-			})
-		}
-		if err := eg.Wait(); err != nil {
-			return errors.Trace(err)
-		}
-		log.Info("writeRows ranges unfinished, retry it", zap.Int("remain ranges", len(remain)))
+	if err := l.ingester.WriteAndIngest(ctx, newKvs); err != nil {
+		return errors.Trace(err)
 	}
+	log.Info("writeRows finish")
 	return nil
 }
 
@@ -681,15 +670,11 @@ func (l *LogClient) RestoreLogData(ctx context.Context, dom *domain.Domain) erro
 	// 3. Encode and ingest data to tikv
 
 	// parse meta file
-	data, err := l.restoreClient.storage.ReadFile(ctx, metaFile)
+	meta, err := ReadLogMeta(ctx, l.restoreClient.storage)
 	if err != nil {
 		return errors.Trace(err)
 	}
-	err = json.Unmarshal(data, l.meta)
-	if err != nil {
-		return errors.Trace(err)
-	}
-	log.Info("get meta from storage", zap.Binary("data", data))
+	l.meta = meta
 
 	if l.startTS > l.meta.GlobalResolvedTS {
 		return errors.Annotatef(berrors.ErrRestoreRTsConstrain,
@@ -0,0 +1,94 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package restore
+
+import (
+	"github.com/pingcap/errors"
+	"github.com/pingcap/log"
+	"github.com/pingcap/parser/model"
+	"github.com/pingcap/parser/mysql"
+	"go.uber.org/zap"
+
+	berrors "github.com/pingcap/br/pkg/errors"
+	"github.com/pingcap/br/pkg/metautil"
+	"github.com/pingcap/br/pkg/utils"
+)
+
+// TableNameMangler decides the names of the restored tables, e.g. to restore
+// the tables into a staging environment under other names.
+type TableNameMangler interface {
+	// MangleTableName returns the name to restore the table of the database
+	// as.
+	MangleTableName(db, table string) string
+}
+
+// AffixMangler restores the tables with the prefix and the suffix added to
+// their names.
+type AffixMangler struct {
+	Prefix string
+	Suffix string
+}
+
+// MangleTableName implements TableNameMangler.
+func (m AffixMangler) MangleTableName(_, table string) string {
+	return m.Prefix + table + m.Suffix
+}
+
+// MangleTableNames renames the tables to restore by the mangler. All the
+// tables are validated before any of them is renamed, so either all tables or
+// none of them are restored under the new names. The rewrite rules are built
+// from the table IDs, hence the new names only take effect in the DDLs. The
+// views are rejected since their definitions refer to the tables by the
+// original names, as well as the DDL jobs of the incremental backups. The
+// system tables are always restored under their original names.
+func MangleTableNames(tables []*metautil.Table, ddlJobs []*model.Job, mangler TableNameMangler) error {
+	if len(ddlJobs) > 0 {
+		return errors.Annotatef(berrors.ErrInvalidArgument,
+			"can't rename the tables when restoring %d ddl jobs of the incremental backup", len(ddlJobs))
+	}
+	names := make(map[string]map[string]struct{})
+	newNames := make([]model.CIStr, len(tables))
+	for i, table := range tables {
+		if _, isSysDB := utils.GetSysDBName(table.DB.Name); isSysDB {
+			continue
+		}
+		if table.Info.IsView() {
+			return errors.Annotatef(berrors.ErrInvalidArgument,
+				"can't rename the view %s, whose definition refers to the original table names",
+				utils.EncloseDBAndTable(table.DB.Name.O, table.Info.Name.O))
+		}
+		newName := mangler.MangleTableName(table.DB.Name.O, table.Info.Name.O)
+		if len(newName) == 0 || len(newName) > mysql.MaxTableNameLength {
+			return errors.Annotatef(berrors.ErrInvalidArgument,
+				"invalid new name %q of table %s", newName,
+				utils.EncloseDBAndTable(table.DB.Name.O, table.Info.Name.O))
+		}
+		newNames[i] = model.NewCIStr(newName)
+		dbNames, ok := names[table.DB.Name.L]
+		if !ok {
+			dbNames = make(map[string]struct{})
+			names[table.DB.Name.L] = dbNames
+		}
+		if _, dup := dbNames[newNames[i].L]; dup {
+			return errors.Annotatef(berrors.ErrInvalidArgument,
+				"the new name of table %s conflicts with another table",
+				utils.EncloseDBAndTable(table.DB.Name.O, table.Info.Name.O))
+		}
+		dbNames[newNames[i].L] = struct{}{}
+	}
+
+	for i, table := range tables {
+		if len(newNames[i].O) == 0 {
+			continue
+		}
+		log.Info("rename the restored table",
+			zap.Stringer("db", table.DB.Name),
+			zap.Stringer("table", table.Info.Name),
+			zap.Stringer("new-name", newNames[i]))
+		table.Info.Name = newNames[i]
+		if table.Stats != nil {
+			table.Stats.TableName = newNames[i].O
+		}
+	}
+	return nil
+}
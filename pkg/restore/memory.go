@@ -0,0 +1,182 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package restore
+
+import (
+	"context"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pingcap/errors"
+	backuppb "github.com/pingcap/kvproto/pkg/backup"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+
+	"github.com/pingcap/br/pkg/rtree"
+)
+
+// MemoryPhase is a phase of restore whose memory usage is accounted.
+type MemoryPhase string
+
+const (
+	// MemoryPhasePlan accounts the files planned to restore.
+	MemoryPhasePlan MemoryPhase = "plan"
+	// MemoryPhaseBatch accounts the ranges and files of the batches buffered
+	// in the split and ingest pipeline.
+	MemoryPhaseBatch MemoryPhase = "batch"
+	// MemoryPhaseRegion accounts the regions scanned for splitting.
+	MemoryPhaseRegion MemoryPhase = "region"
+)
+
+var memoryPhases = []MemoryPhase{MemoryPhasePlan, MemoryPhaseBatch, MemoryPhaseRegion}
+
+const (
+	// memorySampleInterval is the min interval of reading the memory usage
+	// of the process, which stops the world briefly.
+	memorySampleInterval = time.Second
+
+	// the estimated sizes of the structs besides the bytes they refer to.
+	fileMemOverhead   = 256
+	rangeMemOverhead  = 64
+	regionMemOverhead = 256
+	peerMemSize       = 48
+)
+
+// MemoryTracker accounts the estimated memory usage of the phases of
+// restore, and exposes them by the metrics. With a soft limit of the memory
+// in use by the heap and the stacks, the tasks acquiring the tracker are
+// serialized once the limit is exceeded, so the concurrency is shed until
+// the memory is released, rather than the process being killed for OOM. A
+// nil tracker tracks nothing and never limits.
+type MemoryTracker struct {
+	usage     map[MemoryPhase]*int64
+	softLimit uint64
+
+	mu        sync.Mutex
+	inuse     uint64
+	sampledAt time.Time
+	exceeded  bool
+
+	// shed is the only slot of the tasks while the limit is exceeded.
+	shed chan struct{}
+}
+
+// NewMemoryTracker creates a MemoryTracker, zero softLimit disables limiting.
+func NewMemoryTracker(softLimit uint64) *MemoryTracker {
+	t := &MemoryTracker{
+		usage:     make(map[MemoryPhase]*int64, len(memoryPhases)),
+		softLimit: softLimit,
+		shed:      make(chan struct{}, 1),
+	}
+	for _, phase := range memoryPhases {
+		t.usage[phase] = new(int64)
+	}
+	return t
+}
+
+// Track accounts the size of the memory used by the phase, it returns the
+// function to release it.
+func (t *MemoryTracker) Track(phase MemoryPhase, size uint64) (release func()) {
+	if t == nil || size == 0 {
+		return func() {}
+	}
+	counter := t.usage[phase]
+	restoreMemoryGauge.WithLabelValues(string(phase)).Set(float64(atomic.AddInt64(counter, int64(size))))
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			restoreMemoryGauge.WithLabelValues(string(phase)).Set(float64(atomic.AddInt64(counter, -int64(size))))
+		})
+	}
+}
+
+// Usage returns the memory used by the phase.
+func (t *MemoryTracker) Usage(phase MemoryPhase) uint64 {
+	if t == nil {
+		return 0
+	}
+	return uint64(atomic.LoadInt64(t.usage[phase]))
+}
+
+// Exceeded checks whether the memory in use by the heap and the stacks
+// exceeds the soft limit. The usage is sampled at most once per second. The
+// freed memory not returned to the OS yet isn't counted, since Go returns it
+// lazily, the limit would stay exceeded long after the usage drops.
+func (t *MemoryTracker) Exceeded() bool {
+	if t == nil || t.softLimit == 0 {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if time.Since(t.sampledAt) < memorySampleInterval {
+		return t.exceeded
+	}
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	t.inuse = stats.HeapInuse + stats.StackInuse
+	t.sampledAt = time.Now()
+	restoreMemoryInuseGauge.Set(float64(t.inuse))
+
+	exceeded := t.inuse > t.softLimit
+	if exceeded != t.exceeded {
+		fields := []zap.Field{zap.Uint64("inuse", t.inuse), zap.Uint64("soft-limit", t.softLimit)}
+		for _, phase := range memoryPhases {
+			fields = append(fields, zap.Int64(string(phase), atomic.LoadInt64(t.usage[phase])))
+		}
+		if exceeded {
+			log.Warn("memory soft limit exceeded, shed the concurrency of restore", fields...)
+		} else {
+			log.Info("memory usage is below the soft limit, restore the concurrency", fields...)
+		}
+	}
+	t.exceeded = exceeded
+	return exceeded
+}
+
+// Acquire is called by a task before running. It returns at once if the
+// soft limit isn't exceeded, or waits for the other tasks acquired while the
+// limit is exceeded to finish. The returned function must be called after
+// the task finishes.
+func (t *MemoryTracker) Acquire(ctx context.Context) (release func(), err error) {
+	if !t.Exceeded() {
+		return func() {}, nil
+	}
+	restoreMemoryShedCounter.Inc()
+	select {
+	case t.shed <- struct{}{}:
+		return func() { <-t.shed }, nil
+	case <-ctx.Done():
+		return nil, errors.Trace(ctx.Err())
+	}
+}
+
+// FilesMemSize estimates the memory used by the files.
+func FilesMemSize(files []*backuppb.File) uint64 {
+	var size uint64
+	for _, f := range files {
+		size += fileMemOverhead + uint64(len(f.GetName())+len(f.GetStartKey())+len(f.GetEndKey())+
+			len(f.GetSha256())+len(f.GetCf()))
+	}
+	return size
+}
+
+// RangesMemSize estimates the memory used by the ranges and their files.
+func RangesMemSize(ranges []rtree.Range) uint64 {
+	var size uint64
+	for _, rg := range ranges {
+		size += rangeMemOverhead + uint64(len(rg.StartKey)+len(rg.EndKey)) + FilesMemSize(rg.Files)
+	}
+	return size
+}
+
+// regionsMemSize estimates the memory used by the regions.
+func regionsMemSize(regions []*RegionInfo) uint64 {
+	var size uint64
+	for _, region := range regions {
+		size += regionMemOverhead + uint64(len(region.Region.GetStartKey())+len(region.Region.GetEndKey())+
+			len(region.Region.GetPeers())*peerMemSize)
+	}
+	return size
+}
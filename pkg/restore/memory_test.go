@@ -0,0 +1,76 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package restore_test
+
+import (
+	"context"
+	"time"
+
+	. "github.com/pingcap/check"
+	backuppb "github.com/pingcap/kvproto/pkg/backup"
+
+	"github.com/pingcap/br/pkg/restore"
+	"github.com/pingcap/br/pkg/rtree"
+)
+
+var _ = Suite(&testMemorySuite{})
+
+type testMemorySuite struct{}
+
+func (s *testMemorySuite) TestTrackMemory(c *C) {
+	tracker := restore.NewMemoryTracker(0)
+	ranges := []rtree.Range{{
+		StartKey: []byte("a"),
+		EndKey:   []byte("b"),
+		Files:    []*backuppb.File{{Name: "1.sst"}, {Name: "2.sst"}},
+	}}
+	size := restore.RangesMemSize(ranges)
+	c.Assert(size > restore.FilesMemSize(ranges[0].Files), IsTrue)
+
+	release1 := tracker.Track(restore.MemoryPhaseBatch, size)
+	release2 := tracker.Track(restore.MemoryPhaseBatch, size)
+	c.Assert(tracker.Usage(restore.MemoryPhaseBatch), Equals, 2*size)
+	c.Assert(tracker.Usage(restore.MemoryPhasePlan), Equals, uint64(0))
+	release1()
+	// Releasing twice does nothing.
+	release1()
+	c.Assert(tracker.Usage(restore.MemoryPhaseBatch), Equals, size)
+	release2()
+	c.Assert(tracker.Usage(restore.MemoryPhaseBatch), Equals, uint64(0))
+
+	// Without the limit, the tasks never wait.
+	c.Assert(tracker.Exceeded(), IsFalse)
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		_, err := tracker.Acquire(ctx)
+		c.Assert(err, IsNil)
+	}
+
+	// A nil tracker tracks nothing.
+	var nilTracker *restore.MemoryTracker
+	nilTracker.Track(restore.MemoryPhasePlan, size)()
+	c.Assert(nilTracker.Usage(restore.MemoryPhasePlan), Equals, uint64(0))
+	release, err := nilTracker.Acquire(ctx)
+	c.Assert(err, IsNil)
+	release()
+}
+
+func (s *testMemorySuite) TestShedConcurrency(c *C) {
+	// Any process exceeds the limit of 1 byte.
+	tracker := restore.NewMemoryTracker(1)
+	c.Assert(tracker.Exceeded(), IsTrue)
+
+	ctx := context.Background()
+	release, err := tracker.Acquire(ctx)
+	c.Assert(err, IsNil)
+
+	timeoutCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	_, err = tracker.Acquire(timeoutCtx)
+	c.Assert(err, NotNil)
+
+	release()
+	release, err = tracker.Acquire(ctx)
+	c.Assert(err, IsNil)
+	release()
+}
@@ -3,6 +3,8 @@
 package restore
 
 import (
+	"bytes"
+	"sort"
 	"strings"
 
 	"github.com/docker/go-units"
@@ -25,6 +27,7 @@ const (
 
 	writeCFName   = "write"
 	defaultCFName = "default"
+	lockCFName    = "lock"
 )
 
 // MergeRangesStat holds statistics for the MergeRanges.
@@ -153,3 +156,31 @@ func MergeFileRanges(
 		MergedRegionBytesAvg: int(mergedRegionBytesAvg),
 	}, nil
 }
+
+// MergeOverlappedRanges merges the overlapping ranges, e.g. the ranges of the
+// chained raw archives, whose files may cover the same keys. The adjacent
+// ranges are kept apart so that their boundaries are still split. An empty
+// end key means the range is unbounded.
+func MergeOverlappedRanges(ranges []rtree.Range) []rtree.Range {
+	if len(ranges) == 0 {
+		return ranges
+	}
+	sorted := make([]rtree.Range, len(ranges))
+	copy(sorted, ranges)
+	sort.Slice(sorted, func(i, j int) bool {
+		return bytes.Compare(sorted[i].StartKey, sorted[j].StartKey) < 0
+	})
+	merged := sorted[:1]
+	for _, rg := range sorted[1:] {
+		last := &merged[len(merged)-1]
+		if len(last.EndKey) != 0 && bytes.Compare(rg.StartKey, last.EndKey) >= 0 {
+			merged = append(merged, rg)
+			continue
+		}
+		if len(last.EndKey) != 0 && (len(rg.EndKey) == 0 || bytes.Compare(rg.EndKey, last.EndKey) > 0) {
+			last.EndKey = rg.EndKey
+		}
+		last.Files = append(last.Files, rg.Files...)
+	}
+	return merged
+}
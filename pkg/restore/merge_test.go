@@ -4,6 +4,7 @@ package restore_test
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"math"
 	"math/rand"
@@ -13,13 +14,16 @@ import (
 	. "github.com/pingcap/check"
 	"github.com/pingcap/errors"
 	backuppb "github.com/pingcap/kvproto/pkg/backup"
+	"github.com/pingcap/parser/model"
 	"github.com/pingcap/tidb/sessionctx/stmtctx"
 	"github.com/pingcap/tidb/tablecodec"
 	"github.com/pingcap/tidb/types"
 	"github.com/pingcap/tidb/util/codec"
 
 	berrors "github.com/pingcap/br/pkg/errors"
+	"github.com/pingcap/br/pkg/metautil"
 	"github.com/pingcap/br/pkg/restore"
+	"github.com/pingcap/br/pkg/rtree"
 )
 
 var _ = Suite(&testMergeRangesSuite{})
@@ -241,6 +245,43 @@ func (s *testMergeRangesSuite) TestMergeRawKVRanges(c *C) {
 	c.Assert(stat.MergedRegions, Equals, 1)
 }
 
+func (s *testMergeRangesSuite) TestMergeChainedRawKVRanges(c *C) {
+	rawFile := func(start, end string) *backuppb.File {
+		return &backuppb.File{
+			Name:       fmt.Sprintf("%s_%s_default.sst", start, end),
+			StartKey:   []byte(start),
+			EndKey:     []byte(end),
+			Cf:         "default",
+			TotalKvs:   1,
+			TotalBytes: 1,
+		}
+	}
+	// The incremental archive shares a start key with the full archive and
+	// covers keys across the ranges of it.
+	full := []*backuppb.File{rawFile("a", "c"), rawFile("e", "g"), rawFile("k", "m")}
+	incr := []*backuppb.File{rawFile("a", "b"), rawFile("b", "f"), rawFile("m", "")}
+
+	ranges := make([]rtree.Range, 0)
+	for _, files := range [][]*backuppb.File{full, incr} {
+		archiveRanges, _, err := restore.MergeFileRanges(files, 1, 1)
+		c.Assert(err, IsNil)
+		ranges = append(ranges, archiveRanges...)
+	}
+	_, err := restore.SortRanges(ranges, nil)
+	c.Assert(errors.Cause(err), Equals, berrors.ErrRestoreInvalidRange)
+
+	merged := restore.MergeOverlappedRanges(ranges)
+	sorted, err := restore.SortRanges(merged, nil)
+	c.Assert(err, IsNil)
+	c.Assert(sorted, HasLen, 3)
+	expected := [][2]string{{"a", "g"}, {"k", "m"}, {"m", ""}}
+	for i, rg := range sorted {
+		c.Assert(string(rg.StartKey), Equals, expected[i][0])
+		c.Assert(string(rg.EndKey), Equals, expected[i][1])
+	}
+	c.Assert(sorted[0].Files, HasLen, 4)
+}
+
 func (s *testMergeRangesSuite) TestInvalidRanges(c *C) {
 	files := make([]*backuppb.File, 0)
 	fb := fileBulder{}
@@ -253,6 +294,174 @@ func (s *testMergeRangesSuite) TestInvalidRanges(c *C) {
 	c.Assert(errors.Cause(err), Equals, berrors.ErrRestoreInvalidBackup)
 }
 
+func (s *testMergeRangesSuite) TestMergeSizer(c *C) {
+	const mb = 1024 * 1024
+	estimator := restore.NewThroughputEstimator()
+	sizer := restore.NewMergeSizer(estimator, 10*time.Second, 10, 96*mb, 960000)
+
+	// Use the fixed thresholds before observing any batch.
+	size, keys := sizer.Thresholds()
+	c.Assert(size, Equals, uint64(96*mb))
+	c.Assert(keys, Equals, uint64(960000))
+
+	// 48MB/s * 10s / 10 ranges = 48MB per range.
+	estimator.Observe([]*backuppb.File{{TotalBytes: 48 * mb}}, time.Second)
+	rate, ok := estimator.BytesPerSecond()
+	c.Assert(ok, IsTrue)
+	c.Assert(rate, Equals, float64(48*mb))
+	size, keys = sizer.Thresholds()
+	c.Assert(size, Equals, uint64(48*mb))
+	c.Assert(keys, Equals, uint64(480000))
+
+	// The throughput is smoothed, and the size is capped by the min size.
+	estimator.Observe([]*backuppb.File{{TotalBytes: 1}}, time.Hour)
+	rate, _ = estimator.BytesPerSecond()
+	c.Assert(rate < float64(48*mb) && rate > float64(32*mb), IsTrue)
+	for i := 0; i < 100; i++ {
+		estimator.Observe([]*backuppb.File{{TotalBytes: 1}}, time.Hour)
+	}
+	size, _ = sizer.Thresholds()
+	c.Assert(size, Equals, uint64(4*mb))
+
+	// The size is capped by the max size.
+	for i := 0; i < 100; i++ {
+		estimator.Observe([]*backuppb.File{{TotalBytes: 1024 * mb}}, time.Second)
+	}
+	size, keys = sizer.Thresholds()
+	c.Assert(size, Equals, uint64(96*mb))
+	c.Assert(keys, Equals, uint64(960000))
+}
+
+func (s *testMergeRangesSuite) TestGoValidateFileRangesWithSizer(c *C) {
+	const mb = 1024 * 1024
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	estimator := restore.NewThroughputEstimator()
+	sizer := restore.NewMergeSizer(estimator, 10*time.Second, 10, 96*mb, 960000)
+
+	fb := fileBulder{}
+	fileOfTable := make(map[int64][]*backuppb.File)
+	tables := make([]restore.CreatedTable, 0, 2)
+	for _, id := range []int64{1, 2} {
+		for i := 0; i < 4; i++ {
+			fileOfTable[id] = append(fileOfTable[id], fb.build(int(id), 0, 1, 3*mb, 1)...)
+		}
+		name := model.NewCIStr(fmt.Sprintf("t%d", id))
+		tables = append(tables, restore.CreatedTable{
+			Table: &model.TableInfo{ID: id, Name: name},
+			OldTable: &metautil.Table{
+				DB:   &model.DBInfo{Name: model.NewCIStr("test")},
+				Info: &model.TableInfo{ID: id, Name: name},
+			},
+		})
+	}
+
+	tableStream := make(chan restore.CreatedTable)
+	errCh := make(chan error, 1)
+	outCh := restore.GoValidateFileRangesWithSizer(ctx, tableStream, fileOfTable, sizer, nil, errCh)
+
+	// All the files are merged into a range before observing any batch.
+	tableStream <- tables[0]
+	first := <-outCh
+	c.Assert(first.Range, HasLen, 1)
+
+	// The slow restore lowers the thresholds of the following tables.
+	estimator.Observe([]*backuppb.File{{TotalBytes: 1}}, time.Hour)
+	tableStream <- tables[1]
+	second := <-outCh
+	c.Assert(second.Range, HasLen, 4)
+
+	close(tableStream)
+	_, ok := <-outCh
+	c.Assert(ok, IsFalse)
+	select {
+	case err := <-errCh:
+		c.Fatal(err)
+	default:
+	}
+}
+
+func (s *testMergeRangesSuite) TestBuildRestorePlan(c *C) {
+	fb := fileBulder{}
+	newTable := func(db, name string, files []*backuppb.File) *metautil.Table {
+		return &metautil.Table{
+			DB:    &model.DBInfo{Name: model.NewCIStr(db)},
+			Info:  &model.TableInfo{Name: model.NewCIStr(name)},
+			Files: files,
+		}
+	}
+	t1 := newTable("test", "t2", append(fb.build(1, 0, 2, 1, 1), fb.build(1, 0, 2, 1, 1)...))
+	t2 := newTable("test", "t1", fb.build(2, 0, 2, 10, 10))
+	t3 := newTable("a", "t1", fb.build(3, 0, 1, 1, 1))
+	cfg := restore.RestorePlanConfig{MergeRegionSizeBytes: 96, MergeRegionKeyCount: 960}
+	files := make([]*backuppb.File, 0)
+	for _, tbl := range []*metautil.Table{t1, t2, t3} {
+		files = append(files, tbl.Files...)
+	}
+	// The duplicated files are not restored.
+	files = files[1:]
+
+	plan, err := restore.BuildRestorePlan([]*metautil.Table{t1, t2, t3}, files, cfg)
+	c.Assert(err, IsNil)
+	c.Assert(plan.Version, Equals, restore.RestorePlanVersion)
+	c.Assert(plan.Config, DeepEquals, cfg)
+	c.Assert(plan.TotalFiles, Equals, 6)
+	c.Assert(plan.TotalKvs, Equals, uint64(13))
+	c.Assert(plan.TotalRanges, Equals, 3)
+	c.Assert(plan.Tables, HasLen, 3)
+	c.Assert(plan.Tables[0].Database+"."+plan.Tables[0].Table, Equals, "a.t1")
+	c.Assert(plan.Tables[1].Database+"."+plan.Tables[1].Table, Equals, "test.t1")
+	c.Assert(plan.Tables[2].Database+"."+plan.Tables[2].Table, Equals, "test.t2")
+	c.Assert(plan.Tables[2].Files, HasLen, 3)
+	for i := 1; i < len(plan.Tables[2].Files); i++ {
+		c.Assert(plan.Tables[2].Files[i-1] < plan.Tables[2].Files[i], IsTrue)
+	}
+
+	// The plan doesn't depend on the order of the tables.
+	other, err := restore.BuildRestorePlan([]*metautil.Table{t3, t1, t2}, files, cfg)
+	c.Assert(err, IsNil)
+	c.Assert(other, DeepEquals, plan)
+}
+
+func (s *testMergeRangesSuite) TestBuildKeyVizMatrix(c *C) {
+	fb := fileBulder{}
+	t1 := &metautil.Table{
+		DB:    &model.DBInfo{Name: model.NewCIStr("test")},
+		Info:  &model.TableInfo{Name: model.NewCIStr("t1")},
+		Files: fb.build(1, 0, 2, 1, 1),
+	}
+	t2 := &metautil.Table{
+		DB:    &model.DBInfo{Name: model.NewCIStr("test")},
+		Info:  &model.TableInfo{Name: model.NewCIStr("t2")},
+		Files: fb.build(2, 0, 2, 10, 10),
+	}
+	files := append(append([]*backuppb.File{}, t1.Files...), t2.Files...)
+	at := time.Unix(1600000000, 0)
+
+	matrix, err := restore.BuildKeyVizMatrix([]*metautil.Table{t2, t1}, files, 96, 960, at)
+	c.Assert(err, IsNil)
+	c.Assert(matrix.TimeAxis, DeepEquals, []int64{1600000000, 1600000001})
+	// t1, the gap between the tables, t2 and the end key.
+	c.Assert(matrix.KeyAxis, HasLen, 4)
+	for i := 1; i < len(matrix.KeyAxis); i++ {
+		c.Assert(matrix.KeyAxis[i-1].Key < matrix.KeyAxis[i].Key, IsTrue)
+	}
+	c.Assert(matrix.KeyAxis[0].Labels, DeepEquals, []string{"test", "t1"})
+	c.Assert(matrix.KeyAxis[1].Labels, HasLen, 0)
+	c.Assert(matrix.KeyAxis[2].Labels, DeepEquals, []string{"test", "t2"})
+	writtenBytes := matrix.Data[restore.KeyVizTagWrittenBytes]
+	c.Assert(writtenBytes, HasLen, 1)
+	c.Assert(writtenBytes[0], HasLen, 3)
+	c.Assert(writtenBytes[0][1], Equals, uint64(0))
+	c.Assert(writtenBytes[0][2] > writtenBytes[0][0], IsTrue)
+	c.Assert(matrix.Data[restore.KeyVizTagWrittenKeys][0], HasLen, 3)
+
+	// The files not restored are excluded.
+	matrix, err = restore.BuildKeyVizMatrix([]*metautil.Table{t1, t2}, t1.Files, 96, 960, at)
+	c.Assert(err, IsNil)
+	c.Assert(matrix.KeyAxis, HasLen, 2)
+}
+
 // Benchmark results on Intel(R) Xeon(R) CPU E5-2630 v4 @ 2.20GHz
 //
 // BenchmarkMergeRanges100-40          9676             114344 ns/op
@@ -295,3 +504,37 @@ func BenchmarkMergeRanges50k(b *testing.B) {
 func BenchmarkMergeRanges100k(b *testing.B) {
 	benchmarkMergeRanges(b, 100000)
 }
+
+func (s *testMergeRangesSuite) TestEstimateRestore(c *C) {
+	plan := &restore.RestorePlan{
+		TotalRanges: 100,
+		TotalBytes:  30 * 300 * 1024 * 1024,
+		Tables:      make([]*restore.RestorePlanTable, 20),
+	}
+	cfg := restore.RestoreEstimateConfig{
+		ArchiveSize: 10 * 200 * 1024 * 1024,
+		Stores:      3,
+		Checksum:    true,
+	}
+	estimate := restore.EstimateRestore(plan, cfg)
+	phases := make(map[string]time.Duration)
+	for _, phase := range estimate.Phases {
+		phases[phase.Phase] = phase.Duration
+	}
+	c.Assert(phases, DeepEquals, map[string]time.Duration{
+		restore.PhaseCreateTables: 200 * time.Millisecond,
+		restore.PhaseSplit:        2 * time.Second,
+		// every replica downloads the files.
+		restore.PhaseDownload: 10 * time.Second,
+		restore.PhaseIngest:   10 * time.Second,
+		restore.PhaseChecksum: 6 * time.Second,
+	})
+	c.Assert(estimate.Total, Equals, 28200*time.Millisecond)
+
+	// the download is bound by the network bandwidth.
+	cfg.Bandwidth = 100 * 1024 * 1024
+	cfg.Checksum = false
+	estimate = restore.EstimateRestore(plan, cfg)
+	c.Assert(estimate.Phases, HasLen, 4)
+	c.Assert(estimate.Phases[2].Duration, Equals, 60*time.Second)
+}
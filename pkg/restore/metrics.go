@@ -0,0 +1,87 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package restore
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	restoreMemoryGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "br",
+			Subsystem: "restore",
+			Name:      "memory_bytes",
+			Help:      "The estimated memory usage of the restore phases.",
+		}, []string{"phase"})
+
+	restoreMemoryInuseGauge = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "br",
+			Subsystem: "restore",
+			Name:      "memory_inuse_bytes",
+			Help:      "The memory in use by the heap and the stacks of the process.",
+		})
+
+	restoreMemoryShedCounter = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "br",
+			Subsystem: "restore",
+			Name:      "memory_shed_total",
+			Help:      "The number of the restore tasks serialized as the memory soft limit is exceeded.",
+		})
+
+	restoreSplitHistogram = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Namespace: "br",
+			Subsystem: "restore",
+			Name:      "split_region_seconds",
+			Help:      "The latency of splitting a region by the keys.",
+			Buckets:   prometheus.ExponentialBuckets(0.01, 2, 16),
+		})
+
+	restoreScatterRetryCounter = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "br",
+			Subsystem: "restore",
+			Name:      "scatter_retry_total",
+			Help:      "The number of the retries of scattering regions.",
+		})
+
+	restoreImportHistogram = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "br",
+			Subsystem: "restore",
+			Name:      "import_seconds",
+			Help:      "The latency of the download and ingest requests to the stores.",
+			Buckets:   prometheus.ExponentialBuckets(0.01, 2, 16),
+		}, []string{"type"})
+
+	restoreBytesCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "br",
+			Subsystem: "restore",
+			Name:      "bytes_total",
+			Help:      "The SST bytes downloaded by the regions and the KV bytes ingested.",
+		}, []string{"type"})
+
+	restoreChecksumHistogram = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Namespace: "br",
+			Subsystem: "restore",
+			Name:      "checksum_seconds",
+			Help:      "The latency of checksumming a restored table.",
+			Buckets:   prometheus.ExponentialBuckets(0.1, 2, 16),
+		})
+)
+
+func init() { // nolint:gochecknoinits
+	prometheus.MustRegister(restoreMemoryGauge)
+	prometheus.MustRegister(restoreMemoryInuseGauge)
+	prometheus.MustRegister(restoreMemoryShedCounter)
+	prometheus.MustRegister(restoreSplitHistogram)
+	prometheus.MustRegister(restoreScatterRetryCounter)
+	prometheus.MustRegister(restoreImportHistogram)
+	prometheus.MustRegister(restoreBytesCounter)
+	prometheus.MustRegister(restoreChecksumHistogram)
+}
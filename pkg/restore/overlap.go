@@ -0,0 +1,202 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package restore
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+
+	"github.com/pingcap/errors"
+	backuppb "github.com/pingcap/kvproto/pkg/backup"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+
+	berrors "github.com/pingcap/br/pkg/errors"
+	"github.com/pingcap/br/pkg/logutil"
+)
+
+// OverlapPolicy decides how to handle the files of different archives whose
+// key ranges overlap when restoring the archives together.
+type OverlapPolicy string
+
+const (
+	// OverlapPolicyNewestWins keeps the files of the archive with the newest
+	// backup ts, and drops the overlapping files of the older archives if the
+	// newer files cover them entirely. An SST file can't be partially
+	// restored, so a partial overlap fails the restore.
+	OverlapPolicyNewestWins OverlapPolicy = "newest-ts-wins"
+	// OverlapPolicyFail fails the restore if any files overlap.
+	OverlapPolicyFail OverlapPolicy = "fail"
+	// OverlapPolicySkip drops all the overlapping files.
+	OverlapPolicySkip OverlapPolicy = "skip"
+)
+
+// ParseOverlapPolicy parses the overlap policy.
+func ParseOverlapPolicy(s string) (OverlapPolicy, error) {
+	switch policy := OverlapPolicy(strings.ToLower(s)); policy {
+	case OverlapPolicyNewestWins, OverlapPolicyFail, OverlapPolicySkip:
+		return policy, nil
+	default:
+		return "", errors.Annotatef(berrors.ErrInvalidArgument,
+			"invalid overlap policy %s, should be one of %s, %s and %s",
+			s, OverlapPolicyNewestWins, OverlapPolicyFail, OverlapPolicySkip)
+	}
+}
+
+// Archive is the files to be restored from a backup archive.
+type Archive struct {
+	// Name identifies the archive in logs and errors, e.g. its storage URL.
+	Name string
+	// BackupTS is the end version of the backup.
+	BackupTS uint64
+	Files    []*backuppb.File
+}
+
+// archiveRange is the files of an archive sharing the same key range, e.g.
+// the default and write CF files of a range.
+type archiveRange struct {
+	archive   int
+	startKey  []byte
+	endKey    []byte
+	files     []*backuppb.File
+	conflicts []*archiveRange
+}
+
+func (r *archiveRange) overlaps(other *archiveRange) bool {
+	return (len(r.endKey) == 0 || bytes.Compare(other.startKey, r.endKey) < 0) &&
+		(len(other.endKey) == 0 || bytes.Compare(r.startKey, other.endKey) < 0)
+}
+
+// coveredBy checks whether the union of the ranges covers the range.
+func (r *archiveRange) coveredBy(ranges []*archiveRange) bool {
+	sorted := append([]*archiveRange(nil), ranges...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return bytes.Compare(sorted[i].startKey, sorted[j].startKey) < 0
+	})
+	// covered is the end of the covered prefix of the range.
+	covered := r.startKey
+	for _, other := range sorted {
+		if bytes.Compare(other.startKey, covered) > 0 {
+			return false
+		}
+		if len(other.endKey) == 0 {
+			return true
+		}
+		if bytes.Compare(other.endKey, covered) > 0 {
+			covered = other.endKey
+		}
+		if len(r.endKey) > 0 && bytes.Compare(covered, r.endKey) >= 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// groupArchiveRanges groups the files of the archives by their key ranges,
+// the result is sorted by the start key. The overlapping ranges of the same
+// archive, e.g. the default and write CF files with different ranges, are
+// merged into one range, so the column families are kept or dropped together.
+func groupArchiveRanges(archives []Archive) []*archiveRange {
+	ranges := make([]*archiveRange, 0)
+	for i, archive := range archives {
+		for _, files := range groupFilesByOverlap(archive.Files) {
+			rg := &archiveRange{archive: i, startKey: files[0].GetStartKey(), endKey: files[0].GetEndKey(), files: files}
+			for _, f := range files[1:] {
+				if len(rg.endKey) != 0 && (len(f.GetEndKey()) == 0 || bytes.Compare(f.GetEndKey(), rg.endKey) > 0) {
+					rg.endKey = f.GetEndKey()
+				}
+			}
+			ranges = append(ranges, rg)
+		}
+	}
+	sort.SliceStable(ranges, func(i, j int) bool {
+		return bytes.Compare(ranges[i].startKey, ranges[j].startKey) < 0
+	})
+	return ranges
+}
+
+// detectArchiveOverlaps records the ranges of other archives that overlap
+// with each range. The ranges must be sorted by the start key.
+func detectArchiveOverlaps(ranges []*archiveRange) {
+	active := make([]*archiveRange, 0)
+	for _, rg := range ranges {
+		alive := active[:0]
+		for _, prev := range active {
+			// prev ends before rg starts, so does it for the following ranges.
+			if len(prev.endKey) > 0 && bytes.Compare(prev.endKey, rg.startKey) <= 0 {
+				continue
+			}
+			alive = append(alive, prev)
+			if prev.archive != rg.archive && prev.overlaps(rg) {
+				prev.conflicts = append(prev.conflicts, rg)
+				rg.conflicts = append(rg.conflicts, prev)
+			}
+		}
+		active = append(alive, rg)
+	}
+}
+
+// MergeArchiveFiles merges the files of the archives into the files to be
+// restored. The files of different archives whose key ranges overlap are
+// handled by the policy at file granularity, so no conflicting SST files are
+// ingested. The overlapping files inside a single archive are handled as a
+// whole.
+func MergeArchiveFiles(archives []Archive, policy OverlapPolicy) ([]*backuppb.File, error) {
+	ranges := groupArchiveRanges(archives)
+	detectArchiveOverlaps(ranges)
+
+	files := make([]*backuppb.File, 0)
+	for _, rg := range ranges {
+		if len(rg.conflicts) == 0 {
+			files = append(files, rg.files...)
+			continue
+		}
+		other := rg.conflicts[0]
+		fields := []zap.Field{
+			zap.String("archive", archives[rg.archive].Name),
+			logutil.Key("startKey", rg.startKey),
+			logutil.Key("endKey", rg.endKey),
+			zap.String("overlapped-archive", archives[other.archive].Name),
+			logutil.Key("overlapped-startKey", other.startKey),
+			logutil.Key("overlapped-endKey", other.endKey),
+		}
+		switch policy {
+		case OverlapPolicyFail:
+			return nil, errors.Annotatef(berrors.ErrRestoreArchiveOverlap,
+				"range [%X, %X) of archive %s overlaps with range [%X, %X) of archive %s",
+				rg.startKey, rg.endKey, archives[rg.archive].Name,
+				other.startKey, other.endKey, archives[other.archive].Name)
+		case OverlapPolicySkip:
+			log.Warn("skip the files overlapping with other archives", fields...)
+		case OverlapPolicyNewestWins:
+			newer := make([]*archiveRange, 0, len(rg.conflicts))
+			for _, conflict := range rg.conflicts {
+				ts, conflictTS := archives[rg.archive].BackupTS, archives[conflict.archive].BackupTS
+				if ts == conflictTS {
+					return nil, errors.Annotatef(berrors.ErrRestoreArchiveOverlap,
+						"archive %s and %s have the same backup ts %d, cannot decide which one is newer",
+						archives[rg.archive].Name, archives[conflict.archive].Name, ts)
+				}
+				if ts < conflictTS {
+					newer = append(newer, conflict)
+				}
+			}
+			if len(newer) == 0 {
+				files = append(files, rg.files...)
+				continue
+			}
+			if !rg.coveredBy(newer) {
+				return nil, errors.Annotatef(berrors.ErrRestoreArchiveOverlap,
+					"range [%X, %X) of archive %s is partially covered by the newer archives, "+
+						"the older files can't be trimmed, e.g. range [%X, %X) of archive %s",
+					rg.startKey, rg.endKey, archives[rg.archive].Name,
+					newer[0].startKey, newer[0].endKey, archives[newer[0].archive].Name)
+			}
+			log.Warn("skip the files covered by newer archives", fields...)
+		default:
+			return nil, errors.Annotatef(berrors.ErrInvalidArgument, "unknown overlap policy %s", policy)
+		}
+	}
+	return files, nil
+}
@@ -0,0 +1,145 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package restore_test
+
+import (
+	. "github.com/pingcap/check"
+	backuppb "github.com/pingcap/kvproto/pkg/backup"
+
+	"github.com/pingcap/br/pkg/restore"
+)
+
+type testOverlapSuite struct{}
+
+var _ = Suite(&testOverlapSuite{})
+
+func newArchiveFile(name, startKey, endKey string) *backuppb.File {
+	return &backuppb.File{Name: name, StartKey: []byte(startKey), EndKey: []byte(endKey)}
+}
+
+func fileNames(files []*backuppb.File) []string {
+	names := make([]string, 0, len(files))
+	for _, f := range files {
+		names = append(names, f.Name)
+	}
+	return names
+}
+
+func (s *testOverlapSuite) TestMergeArchiveFiles(c *C) {
+	// a1: [a, c) [c, e) [x, )
+	// a2:   [b, c)        [f, g)
+	archives := []restore.Archive{
+		{
+			Name:     "a1",
+			BackupTS: 10,
+			Files: []*backuppb.File{
+				newArchiveFile("a1-1-default", "a", "c"),
+				newArchiveFile("a1-1-write", "a", "c"),
+				newArchiveFile("a1-2", "c", "e"),
+				newArchiveFile("a1-3", "x", ""),
+			},
+		},
+		{
+			Name:     "a2",
+			BackupTS: 20,
+			Files: []*backuppb.File{
+				newArchiveFile("a2-1", "b", "c"),
+				newArchiveFile("a2-2", "f", "g"),
+			},
+		},
+	}
+
+	// a2-1 covers a part of a1-1 only, which can't be trimmed.
+	_, err := restore.MergeArchiveFiles(archives, restore.OverlapPolicyNewestWins)
+	c.Assert(err, ErrorMatches, ".*archive a1 is partially covered by the newer archives.*archive a2.*")
+
+	files, err := restore.MergeArchiveFiles(archives, restore.OverlapPolicySkip)
+	c.Assert(err, IsNil)
+	c.Assert(fileNames(files), DeepEquals, []string{"a1-2", "a2-2", "a1-3"})
+
+	_, err = restore.MergeArchiveFiles(archives, restore.OverlapPolicyFail)
+	c.Assert(err, ErrorMatches, ".*archive a1 overlaps with range.*archive a2.*")
+
+	// The newer files cover the older ones entirely.
+	archives[1].Files[0] = newArchiveFile("a2-1", "a", "c")
+	archives[1].Files = append(archives[1].Files, newArchiveFile("a2-3", "x", ""))
+	files, err = restore.MergeArchiveFiles(archives, restore.OverlapPolicyNewestWins)
+	c.Assert(err, IsNil)
+	c.Assert(fileNames(files), DeepEquals, []string{"a2-1", "a1-2", "a2-2", "a2-3"})
+
+	archives[1].BackupTS = archives[0].BackupTS
+	_, err = restore.MergeArchiveFiles(archives, restore.OverlapPolicyNewestWins)
+	c.Assert(err, ErrorMatches, ".*have the same backup ts.*")
+}
+
+func (s *testOverlapSuite) TestMergeArchiveFilesCoveredByMany(c *C) {
+	// a1:  [a,      e)
+	// a2:  [a, c)
+	// a3:     [b,     f)
+	archives := []restore.Archive{
+		{Name: "a1", BackupTS: 10, Files: []*backuppb.File{newArchiveFile("a1-1", "a", "e")}},
+		{Name: "a2", BackupTS: 20, Files: []*backuppb.File{newArchiveFile("a2-1", "a", "c")}},
+		{Name: "a3", BackupTS: 30, Files: []*backuppb.File{newArchiveFile("a3-1", "b", "f")}},
+	}
+	// a2-1 is partially covered by a3-1.
+	_, err := restore.MergeArchiveFiles(archives, restore.OverlapPolicyNewestWins)
+	c.Assert(err, ErrorMatches, ".*archive a2 is partially covered.*")
+
+	// a1-1 is covered by the union of a2-1 and a3-1, and a2-1 is covered by
+	// a3-1 after moving a3-1.
+	archives[2].Files[0] = newArchiveFile("a3-1", "a", "f")
+	files, err := restore.MergeArchiveFiles(archives, restore.OverlapPolicyNewestWins)
+	c.Assert(err, IsNil)
+	c.Assert(fileNames(files), DeepEquals, []string{"a3-1"})
+
+	// A gap between the newer files.
+	archives = archives[:2]
+	archives = append(archives, restore.Archive{
+		Name: "a3", BackupTS: 30, Files: []*backuppb.File{newArchiveFile("a3-1", "d", "f")},
+	})
+	_, err = restore.MergeArchiveFiles(archives, restore.OverlapPolicyNewestWins)
+	c.Assert(err, ErrorMatches, ".*archive a1 is partially covered.*")
+}
+
+func (s *testOverlapSuite) TestMergeArchiveFilesKeepCFsTogether(c *C) {
+	// The default and write CF files of a1 cover different ranges, they must
+	// be kept or dropped together.
+	archives := []restore.Archive{
+		{
+			Name:     "a1",
+			BackupTS: 10,
+			Files: []*backuppb.File{
+				newArchiveFile("a1-1-default", "a", "b"),
+				newArchiveFile("a1-1-write", "a", "d"),
+				newArchiveFile("a1-2", "e", "f"),
+			},
+		},
+		{
+			Name:     "a2",
+			BackupTS: 20,
+			Files: []*backuppb.File{
+				newArchiveFile("a2-1", "a", "d"),
+			},
+		},
+	}
+	files, err := restore.MergeArchiveFiles(archives, restore.OverlapPolicyNewestWins)
+	c.Assert(err, IsNil)
+	c.Assert(fileNames(files), DeepEquals, []string{"a2-1", "a1-2"})
+
+	files, err = restore.MergeArchiveFiles(archives, restore.OverlapPolicySkip)
+	c.Assert(err, IsNil)
+	c.Assert(fileNames(files), DeepEquals, []string{"a1-2"})
+
+	archives[1].BackupTS = 5
+	files, err = restore.MergeArchiveFiles(archives, restore.OverlapPolicyNewestWins)
+	c.Assert(err, IsNil)
+	c.Assert(fileNames(files), DeepEquals, []string{"a1-1-default", "a1-1-write", "a1-2"})
+}
+
+func (s *testOverlapSuite) TestParseOverlapPolicy(c *C) {
+	policy, err := restore.ParseOverlapPolicy("Newest-TS-Wins")
+	c.Assert(err, IsNil)
+	c.Assert(policy, Equals, restore.OverlapPolicyNewestWins)
+	_, err = restore.ParseOverlapPolicy("oldest")
+	c.Assert(err, ErrorMatches, ".*invalid overlap policy.*")
+}
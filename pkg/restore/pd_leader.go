@@ -0,0 +1,214 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package restore
+
+import (
+	"context"
+	"time"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/kvproto/pkg/metapb"
+	"github.com/pingcap/kvproto/pkg/pdpb"
+	"github.com/pingcap/log"
+	"github.com/tikv/client-go/v2/oracle"
+	"github.com/tikv/pd/server/schedule/placement"
+	"go.uber.org/zap"
+
+	"github.com/pingcap/br/pkg/summary"
+	"github.com/pingcap/br/pkg/utils"
+)
+
+const (
+	pdLeaderRetryTimes       = 16
+	pdLeaderRetryInterval    = 100 * time.Millisecond
+	pdLeaderMaxRetryInterval = 3 * time.Second
+	// pdLeaderPhaseRetryDelay is the pause before retrying a phase failed on
+	// the transfer of the PD leader, which is long enough for the PD client
+	// to reconnect to the new leader.
+	pdLeaderPhaseRetryDelay = 3 * time.Second
+)
+
+// pdLeaderRetrySplitClient retries the requests to PD which fail while the PD
+// leader is being transferred, e.g. during a rolling upgrade of PD. The PD
+// client reconnects to the new leader in background, so the current phase of
+// restore goes on after a short pause instead of failing with "not leader".
+// The split requests are sent to TiKV and are not retried here.
+//
+// It's for the single requests out of split, scatter and import only. Those
+// phases send the requests in their own retry loops, so they use the client
+// without the retries, and the split and scatter phase is retried as a whole
+// by retryPhaseOnPDLeaderChange instead.
+type pdLeaderRetrySplitClient struct {
+	SplitClient
+}
+
+// NewPDLeaderRetrySplitClient returns a SplitClient retrying the requests to
+// PD on the transfer of the PD leader.
+func NewPDLeaderRetrySplitClient(cli SplitClient) SplitClient {
+	return &pdLeaderRetrySplitClient{SplitClient: cli}
+}
+
+func newPDLeaderBackoffer() utils.Backoffer {
+	return utils.NewExponentialBackoffer(pdLeaderRetryTimes, pdLeaderRetryInterval, pdLeaderMaxRetryInterval).
+		WithClassifier(isPDLeaderRetryable)
+}
+
+// isPDLeaderRetryable checks whether the request to PD is worth retrying. The
+// HTTP requests to the old leader may also be refused while it's restarting.
+func isPDLeaderRetryable(err error) bool {
+	return utils.IsPDLeaderChangedError(err) || utils.MessageIsRetryableStorageError(err.Error())
+}
+
+// retryOnPDLeaderChange calls the function until it succeeds, fails with an
+// error not caused by the leader transfer, or runs out of the attempts. The
+// last error is returned as is, so the callers can still check its cause.
+func retryOnPDLeaderChange(ctx context.Context, method string, fn func() error) error {
+	var lastErr error
+	err := utils.WithRetry(ctx, func() error {
+		lastErr = fn()
+		if lastErr != nil && isPDLeaderRetryable(lastErr) {
+			log.Warn("request to pd failed, maybe the pd leader changed, retrying",
+				zap.String("method", method), zap.Error(lastErr))
+			summary.CollectRetry(summary.RetryPDLeader)
+		}
+		return lastErr
+	}, newPDLeaderBackoffer())
+	if err != nil {
+		return lastErr
+	}
+	return nil
+}
+
+// retryPhaseOnPDLeaderChange runs the phase, and runs it once more if it
+// fails on the transfer of the PD leader. The phase must be idempotent, e.g.
+// splitting the regions already split is skipped.
+func retryPhaseOnPDLeaderChange(ctx context.Context, phase string, fn func() error) error {
+	err := fn()
+	if err == nil || !utils.IsPDLeaderChangedError(err) {
+		return err
+	}
+	log.Warn("phase failed, maybe the pd leader changed, retrying the phase",
+		zap.String("phase", phase), zap.Error(err))
+	summary.CollectRetry(summary.RetryPDLeader)
+	select {
+	case <-ctx.Done():
+		return errors.Trace(ctx.Err())
+	case <-time.After(pdLeaderPhaseRetryDelay):
+	}
+	return fn()
+}
+
+func (c *pdLeaderRetrySplitClient) GetStore(ctx context.Context, storeID uint64) (store *metapb.Store, err error) {
+	err = retryOnPDLeaderChange(ctx, "GetStore", func() error {
+		store, err = c.SplitClient.GetStore(ctx, storeID)
+		return err
+	})
+	return store, err
+}
+
+func (c *pdLeaderRetrySplitClient) GetRegion(ctx context.Context, key []byte) (region *RegionInfo, err error) {
+	err = retryOnPDLeaderChange(ctx, "GetRegion", func() error {
+		region, err = c.SplitClient.GetRegion(ctx, key)
+		return err
+	})
+	return region, err
+}
+
+func (c *pdLeaderRetrySplitClient) GetRegionByID(ctx context.Context, regionID uint64) (region *RegionInfo, err error) {
+	err = retryOnPDLeaderChange(ctx, "GetRegionByID", func() error {
+		region, err = c.SplitClient.GetRegionByID(ctx, regionID)
+		return err
+	})
+	return region, err
+}
+
+func (c *pdLeaderRetrySplitClient) ScatterRegion(ctx context.Context, regionInfo *RegionInfo) error {
+	return retryOnPDLeaderChange(ctx, "ScatterRegion", func() error {
+		return c.SplitClient.ScatterRegion(ctx, regionInfo)
+	})
+}
+
+func (c *pdLeaderRetrySplitClient) ScatterRegions(ctx context.Context, regionInfos []*RegionInfo) error {
+	return retryOnPDLeaderChange(ctx, "ScatterRegions", func() error {
+		return c.SplitClient.ScatterRegions(ctx, regionInfos)
+	})
+}
+
+func (c *pdLeaderRetrySplitClient) GetOperator(
+	ctx context.Context, regionID uint64,
+) (resp *pdpb.GetOperatorResponse, err error) {
+	err = retryOnPDLeaderChange(ctx, "GetOperator", func() error {
+		resp, err = c.SplitClient.GetOperator(ctx, regionID)
+		return err
+	})
+	return resp, err
+}
+
+func (c *pdLeaderRetrySplitClient) ScanRegions(
+	ctx context.Context, key, endKey []byte, limit int,
+) (regions []*RegionInfo, err error) {
+	err = retryOnPDLeaderChange(ctx, "ScanRegions", func() error {
+		regions, err = c.SplitClient.ScanRegions(ctx, key, endKey, limit)
+		return err
+	})
+	return regions, err
+}
+
+func (c *pdLeaderRetrySplitClient) GetPlacementRule(
+	ctx context.Context, groupID, ruleID string,
+) (rule placement.Rule, err error) {
+	err = retryOnPDLeaderChange(ctx, "GetPlacementRule", func() error {
+		rule, err = c.SplitClient.GetPlacementRule(ctx, groupID, ruleID)
+		return err
+	})
+	return rule, err
+}
+
+func (c *pdLeaderRetrySplitClient) SetPlacementRule(ctx context.Context, rule placement.Rule) error {
+	return retryOnPDLeaderChange(ctx, "SetPlacementRule", func() error {
+		return c.SplitClient.SetPlacementRule(ctx, rule)
+	})
+}
+
+func (c *pdLeaderRetrySplitClient) DeletePlacementRule(ctx context.Context, groupID, ruleID string) error {
+	return retryOnPDLeaderChange(ctx, "DeletePlacementRule", func() error {
+		return c.SplitClient.DeletePlacementRule(ctx, groupID, ruleID)
+	})
+}
+
+func (c *pdLeaderRetrySplitClient) SetStoresLabel(
+	ctx context.Context, stores []uint64, labelKey, labelValue string,
+) error {
+	return retryOnPDLeaderChange(ctx, "SetStoresLabel", func() error {
+		return c.SplitClient.SetStoresLabel(ctx, stores, labelKey, labelValue)
+	})
+}
+
+func (c *pdLeaderRetrySplitClient) GetRegionApproximateSize(
+	ctx context.Context, regionID uint64,
+) (size uint64, err error) {
+	err = retryOnPDLeaderChange(ctx, "GetRegionApproximateSize", func() error {
+		size, err = c.SplitClient.GetRegionApproximateSize(ctx, regionID)
+		return err
+	})
+	return size, err
+}
+
+func (c *pdLeaderRetrySplitClient) SplitRegionByApproximateSize(ctx context.Context, regionID uint64) error {
+	return retryOnPDLeaderChange(ctx, "SplitRegionByApproximateSize", func() error {
+		return c.SplitClient.SplitRegionByApproximateSize(ctx, regionID)
+	})
+}
+
+// GetTS gets a new timestamp from PD, retrying on the transfer of the PD leader.
+func (rc *Client) GetTS(ctx context.Context) (ts uint64, err error) {
+	err = retryOnPDLeaderChange(ctx, "GetTS", func() error {
+		p, l, err := rc.pdClient.GetTS(ctx)
+		if err != nil {
+			return err
+		}
+		ts = oracle.ComposeTS(p, l)
+		return nil
+	})
+	return ts, errors.Trace(err)
+}
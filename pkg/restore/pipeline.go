@@ -0,0 +1,205 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package restore
+
+import (
+	"context"
+	"sync"
+
+	"github.com/pingcap/errors"
+	backuppb "github.com/pingcap/kvproto/pkg/backup"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+
+	"github.com/pingcap/br/pkg/glue"
+	"github.com/pingcap/br/pkg/rtree"
+)
+
+// SplitStage is the first stage of the SplitAndScatterThenIngest pipeline.
+// It splits the regions at the boundaries of the (rewritten) ranges and
+// scatters the new regions.
+type SplitStage interface {
+	SplitAndScatter(ctx context.Context, ranges []rtree.Range, rewriteRules *RewriteRules) error
+}
+
+// IngestStage is the second stage of the SplitAndScatterThenIngest pipeline.
+// It downloads the data of the ranges into the regions which have been split
+// by the SplitStage, and ingests them.
+type IngestStage interface {
+	DownloadAndIngest(ctx context.Context, ranges []rtree.Range, rewriteRules *RewriteRules) error
+}
+
+// SplitStageFunc is an adapter to allow the use of ordinary functions as a SplitStage.
+type SplitStageFunc func(ctx context.Context, ranges []rtree.Range, rewriteRules *RewriteRules) error
+
+// SplitAndScatter implements SplitStage.
+func (f SplitStageFunc) SplitAndScatter(ctx context.Context, ranges []rtree.Range, rewriteRules *RewriteRules) error {
+	return f(ctx, ranges, rewriteRules)
+}
+
+// IngestStageFunc is an adapter to allow the use of ordinary functions as an IngestStage.
+type IngestStageFunc func(ctx context.Context, ranges []rtree.Range, rewriteRules *RewriteRules) error
+
+// DownloadAndIngest implements IngestStage.
+func (f IngestStageFunc) DownloadAndIngest(ctx context.Context, ranges []rtree.Range, rewriteRules *RewriteRules) error {
+	return f(ctx, ranges, rewriteRules)
+}
+
+// NewClientSplitStage returns the SplitStage used by BR, which splits and
+// scatters the regions with the settings of the client.
+func NewClientSplitStage(client *Client, updateCh glue.Progress) SplitStage {
+	return SplitStageFunc(func(ctx context.Context, ranges []rtree.Range, rewriteRules *RewriteRules) error {
+		return SplitRanges(ctx, client, ranges, rewriteRules, updateCh)
+	})
+}
+
+// NewClientIngestStage returns the IngestStage used by BR, which downloads the
+// backup files of the ranges from the external storage and ingests them.
+func NewClientIngestStage(client *Client, updateCh glue.Progress) IngestStage {
+	return IngestStageFunc(func(ctx context.Context, ranges []rtree.Range, rewriteRules *RewriteRules) error {
+		files := make([]*backuppb.File, 0, len(ranges)*2)
+		for _, rg := range ranges {
+			files = append(files, rg.Files...)
+		}
+		return client.RestoreFiles(ctx, files, rewriteRules, updateCh)
+	})
+}
+
+// PipelineBatch is a batch of ranges sent through the SplitAndScatterThenIngest pipeline.
+type PipelineBatch struct {
+	Ranges       []rtree.Range
+	RewriteRules *RewriteRules
+	// Done is called after the batch has been ingested, it may be nil.
+	Done func()
+}
+
+// SplitAndScatterThenIngest is the pipeline which restores the batches of
+// ranges: the regions of a batch are split and scattered, then the data of the
+// batch is downloaded and ingested. The two stages run concurrently, so the
+// next batch can be split while the current one is being ingested.
+//
+// The stages are interfaces, so tools other than BR (e.g. lightning or custom
+// importers) can reuse the pipeline with their own data sources.
+type SplitAndScatterThenIngest struct {
+	splitter SplitStage
+	ingester IngestStage
+	onError  func(error)
+
+	inCh chan PipelineBatch
+	done chan struct{}
+	wg   sync.WaitGroup
+
+	errOnce sync.Once
+	err     error
+}
+
+// NewSplitAndScatterThenIngest makes a pipeline and starts its workers.
+// The pipeline stops at the first error of the stages, which is reported by
+// onError (it may be nil) and returned by Close.
+func NewSplitAndScatterThenIngest(
+	ctx context.Context,
+	splitter SplitStage,
+	ingester IngestStage,
+	onError func(error),
+) *SplitAndScatterThenIngest {
+	p := &SplitAndScatterThenIngest{
+		splitter: splitter,
+		ingester: ingester,
+		onError:  onError,
+		inCh:     make(chan PipelineBatch, defaultChannelSize),
+		done:     make(chan struct{}),
+	}
+	midCh := make(chan PipelineBatch, defaultChannelSize)
+	p.wg.Add(2)
+	go p.splitWorker(ctx, midCh)
+	go p.ingestWorker(ctx, midCh)
+	return p
+}
+
+// Send sends a batch into the pipeline. It doesn't block once the pipeline
+// has stopped.
+func (p *SplitAndScatterThenIngest) Send(batch PipelineBatch) {
+	select {
+	case p.inCh <- batch:
+	case <-p.done:
+	}
+}
+
+// Done returns a channel which is closed when the pipeline has stopped, that
+// is, all batches have been ingested after Close, an error occurred, or the
+// context is done.
+func (p *SplitAndScatterThenIngest) Done() <-chan struct{} {
+	return p.done
+}
+
+// Close tells the pipeline there are no more batches, waits for the remaining
+// batches and returns the first error of the stages.
+func (p *SplitAndScatterThenIngest) Close() error {
+	close(p.inCh)
+	p.wg.Wait()
+	return p.err
+}
+
+func (p *SplitAndScatterThenIngest) emitError(err error) {
+	p.errOnce.Do(func() {
+		p.err = err
+		if p.onError != nil {
+			p.onError(err)
+		}
+	})
+}
+
+func (p *SplitAndScatterThenIngest) splitWorker(ctx context.Context, next chan<- PipelineBatch) {
+	defer log.Debug("split worker closed")
+	defer func() {
+		p.wg.Done()
+		close(next)
+	}()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case batch, ok := <-p.inCh:
+			if !ok {
+				return
+			}
+			if err := p.splitter.SplitAndScatter(ctx, batch.Ranges, batch.RewriteRules); err != nil {
+				log.Error("failed on split range", rtree.ZapRanges(batch.Ranges), zap.Error(err))
+				p.emitError(errors.Trace(err))
+				return
+			}
+			select {
+			case next <- batch:
+			case <-p.done:
+				return
+			}
+		}
+	}
+}
+
+func (p *SplitAndScatterThenIngest) ingestWorker(ctx context.Context, batches <-chan PipelineBatch) {
+	defer func() {
+		log.Debug("restore worker closed")
+		close(p.done)
+		p.wg.Done()
+	}()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case batch, ok := <-batches:
+			if !ok {
+				return
+			}
+			if err := p.ingester.DownloadAndIngest(ctx, batch.Ranges, batch.RewriteRules); err != nil {
+				p.emitError(errors.Trace(err))
+				return
+			}
+
+			log.Info("restore batch done", rtree.ZapRanges(batch.Ranges))
+			if batch.Done != nil {
+				batch.Done()
+			}
+		}
+	}
+}
@@ -177,11 +177,11 @@ type BatchSender interface {
 }
 
 type tikvSender struct {
-	client   *Client
-	updateCh glue.Progress
+	pipeline *SplitAndScatterThenIngest
+	// memory accounts the batches in the pipeline until they are ingested.
+	memory *MemoryTracker
 
 	sink TableSink
-	inCh chan<- DrainResult
 
 	wg *sync.WaitGroup
 }
@@ -193,7 +193,15 @@ func (b *tikvSender) PutSink(sink TableSink) {
 }
 
 func (b *tikvSender) RestoreBatch(ranges DrainResult) {
-	b.inCh <- ranges
+	release := b.memory.Track(MemoryPhaseBatch, RangesMemSize(ranges.Ranges))
+	b.pipeline.Send(PipelineBatch{
+		Ranges:       ranges.Ranges,
+		RewriteRules: ranges.RewriteRules,
+		Done: func() {
+			release()
+			b.sink.EmitTables(ranges.BlankTablesAfterSend...)
+		},
+	})
 }
 
 // NewTiKVSender make a sender that send restore requests to TiKV.
@@ -202,74 +210,28 @@ func NewTiKVSender(
 	cli *Client,
 	updateCh glue.Progress,
 ) (BatchSender, error) {
-	inCh := make(chan DrainResult, defaultChannelSize)
-	midCh := make(chan DrainResult, defaultChannelSize)
-
 	sender := &tikvSender{
-		client:   cli,
-		updateCh: updateCh,
-		inCh:     inCh,
-		wg:       new(sync.WaitGroup),
+		memory: cli.memory,
+		wg:     new(sync.WaitGroup),
 	}
-
-	sender.wg.Add(2)
-	go sender.splitWorker(ctx, inCh, midCh)
-	go sender.restoreWorker(ctx, midCh)
-	return sender, nil
-}
-
-func (b *tikvSender) splitWorker(ctx context.Context, ranges <-chan DrainResult, next chan<- DrainResult) {
-	defer log.Debug("split worker closed")
-	defer func() {
-		b.wg.Done()
-		close(next)
+	sender.pipeline = NewSplitAndScatterThenIngest(ctx,
+		NewClientSplitStage(cli, updateCh),
+		NewClientIngestStage(cli, updateCh),
+		func(err error) { sender.sink.EmitError(err) },
+	)
+
+	sender.wg.Add(1)
+	go func() {
+		defer sender.wg.Done()
+		<-sender.pipeline.Done()
+		sender.sink.Close()
 	}()
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		case result, ok := <-ranges:
-			if !ok {
-				return
-			}
-			if err := SplitRanges(ctx, b.client, result.Ranges, result.RewriteRules, b.updateCh); err != nil {
-				log.Error("failed on split range", rtree.ZapRanges(result.Ranges), zap.Error(err))
-				b.sink.EmitError(err)
-				return
-			}
-			next <- result
-		}
-	}
-}
-
-func (b *tikvSender) restoreWorker(ctx context.Context, ranges <-chan DrainResult) {
-	defer func() {
-		log.Debug("restore worker closed")
-		b.wg.Done()
-		b.sink.Close()
-	}()
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		case result, ok := <-ranges:
-			if !ok {
-				return
-			}
-			files := result.Files()
-			if err := b.client.RestoreFiles(ctx, files, result.RewriteRules, b.updateCh); err != nil {
-				b.sink.EmitError(err)
-				return
-			}
-
-			log.Info("restore batch done", rtree.ZapRanges(result.Ranges))
-			b.sink.EmitTables(result.BlankTablesAfterSend...)
-		}
-	}
+	return sender, nil
 }
 
 func (b *tikvSender) Close() {
-	close(b.inCh)
+	// The error has been emitted to the sink.
+	_ = b.pipeline.Close()
 	b.wg.Wait()
 	log.Debug("tikv sender closed")
 }
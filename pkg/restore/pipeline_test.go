@@ -0,0 +1,96 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package restore_test
+
+import (
+	"context"
+	"sync"
+
+	. "github.com/pingcap/check"
+	"github.com/pingcap/errors"
+
+	"github.com/pingcap/br/pkg/restore"
+	"github.com/pingcap/br/pkg/rtree"
+)
+
+type testPipelineSuite struct{}
+
+var _ = Suite(&testPipelineSuite{})
+
+// recordStages records the start keys of the ranges passed through each stage.
+type recordStages struct {
+	mu       sync.Mutex
+	split    []string
+	ingested []string
+	failOn   string
+}
+
+func (r *recordStages) SplitAndScatter(ctx context.Context, ranges []rtree.Range, _ *restore.RewriteRules) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, rg := range ranges {
+		if string(rg.StartKey) == r.failOn {
+			return errors.New("split failed")
+		}
+		r.split = append(r.split, string(rg.StartKey))
+	}
+	return nil
+}
+
+func (r *recordStages) DownloadAndIngest(ctx context.Context, ranges []rtree.Range, _ *restore.RewriteRules) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, rg := range ranges {
+		// Every range must be split before ingested.
+		found := false
+		for _, key := range r.split {
+			found = found || key == string(rg.StartKey)
+		}
+		if !found {
+			return errors.Errorf("range %s is ingested before split", rg.StartKey)
+		}
+		r.ingested = append(r.ingested, string(rg.StartKey))
+	}
+	return nil
+}
+
+func (s *testPipelineSuite) TestSplitAndScatterThenIngest(c *C) {
+	stages := &recordStages{}
+	var emitted []error
+	p := restore.NewSplitAndScatterThenIngest(context.Background(), stages, stages, func(err error) {
+		emitted = append(emitted, err)
+	})
+	done := 0
+	for _, key := range []string{"a", "b", "c"} {
+		p.Send(restore.PipelineBatch{
+			Ranges:       []rtree.Range{{StartKey: []byte(key), EndKey: []byte(key + "z")}},
+			RewriteRules: restore.EmptyRewriteRule(),
+			Done:         func() { done++ },
+		})
+	}
+	c.Assert(p.Close(), IsNil)
+	c.Assert(stages.ingested, DeepEquals, []string{"a", "b", "c"})
+	c.Assert(done, Equals, 3)
+	c.Assert(emitted, HasLen, 0)
+	<-p.Done()
+}
+
+func (s *testPipelineSuite) TestSplitAndScatterThenIngestError(c *C) {
+	stages := &recordStages{failOn: "b"}
+	var emitted []error
+	p := restore.NewSplitAndScatterThenIngest(context.Background(), stages, stages, func(err error) {
+		emitted = append(emitted, err)
+	})
+	for _, key := range []string{"a", "b", "c"} {
+		p.Send(restore.PipelineBatch{
+			Ranges:       []rtree.Range{{StartKey: []byte(key), EndKey: []byte(key + "z")}},
+			RewriteRules: restore.EmptyRewriteRule(),
+		})
+	}
+	<-p.Done()
+	// Sending to a stopped pipeline doesn't block.
+	p.Send(restore.PipelineBatch{})
+	c.Assert(p.Close(), ErrorMatches, "split failed")
+	c.Assert(emitted, HasLen, 1)
+	c.Assert(stages.ingested, DeepEquals, []string{"a"})
+}
@@ -0,0 +1,20 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package restore
+
+import (
+	. "github.com/pingcap/check"
+	"github.com/tikv/pd/server/schedule/placement"
+)
+
+type testPlacementSuite struct{}
+
+var _ = Suite(&testPlacementSuite{})
+
+func (s *testPlacementSuite) TestCheckStoresForRule(c *C) {
+	rule := placement.Rule{GroupID: "pd", ID: "default", Role: placement.Voter, Count: 3}
+	c.Assert(checkStoresForRule(3, rule), IsNil)
+	c.Assert(checkStoresForRule(4, rule), IsNil)
+	c.Assert(checkStoresForRule(2, rule), ErrorMatches, ".*only 2 restore stores are selected, but the placement rule needs 3 replicas.*")
+	c.Assert(checkStoresForRule(0, rule), ErrorMatches, ".*needs 3 replicas.*")
+}
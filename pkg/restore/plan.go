@@ -0,0 +1,107 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package restore
+
+import (
+	"sort"
+
+	"github.com/pingcap/errors"
+	backuppb "github.com/pingcap/kvproto/pkg/backup"
+
+	"github.com/pingcap/br/pkg/metautil"
+)
+
+// RestorePlanVersion is the version of the schema of RestorePlan. Bump it
+// when the meaning of any existing field changes, adding fields doesn't need.
+const RestorePlanVersion = 1
+
+// RestorePlanConfig is the part of the restore config which affects the plan.
+type RestorePlanConfig struct {
+	Concurrency          uint   `json:"concurrency"`
+	RateLimit            uint64 `json:"rate-limit"`
+	MergeRegionSizeBytes uint64 `json:"merge-region-size-bytes"`
+	MergeRegionKeyCount  uint64 `json:"merge-region-key-count"`
+	Online               bool   `json:"online"`
+	DataOnly             bool   `json:"data-only"`
+}
+
+// RestorePlanTable is the plan to restore a table.
+type RestorePlanTable struct {
+	Database   string   `json:"database"`
+	Table      string   `json:"table"`
+	Files      []string `json:"files"`
+	TotalKvs   uint64   `json:"total-kvs"`
+	TotalBytes uint64   `json:"total-bytes"`
+	// Ranges is the count of the ranges after merging the small ranges, i.e.
+	// the count of the regions split for the table.
+	Ranges int `json:"ranges"`
+}
+
+// RestorePlan is the output of the dry-run restore. It is deterministic for
+// the same backup and config: the tables are sorted by name and the files of
+// each table are sorted by name, so the plans generated by different
+// versions or configs can be diffed directly.
+type RestorePlan struct {
+	Version     int                 `json:"version"`
+	Config      RestorePlanConfig   `json:"config"`
+	TotalFiles  int                 `json:"total-files"`
+	TotalKvs    uint64              `json:"total-kvs"`
+	TotalBytes  uint64              `json:"total-bytes"`
+	TotalRanges int                 `json:"total-ranges"`
+	Tables      []*RestorePlanTable `json:"tables"`
+}
+
+// BuildRestorePlan builds the plan to restore the files of the tables. Files
+// of the tables not in files, e.g. the deduplicated ones, are not restored.
+func BuildRestorePlan(
+	tables []*metautil.Table,
+	files []*backuppb.File,
+	cfg RestorePlanConfig,
+) (*RestorePlan, error) {
+	restored := make(map[*backuppb.File]struct{}, len(files))
+	for _, f := range files {
+		restored[f] = struct{}{}
+	}
+
+	plan := &RestorePlan{
+		Version: RestorePlanVersion,
+		Config:  cfg,
+		Tables:  make([]*RestorePlanTable, 0, len(tables)),
+	}
+	for _, tbl := range tables {
+		tablePlan := &RestorePlanTable{
+			Database: tbl.DB.Name.O,
+			Table:    tbl.Info.Name.O,
+			Files:    make([]string, 0, len(tbl.Files)),
+		}
+		tableFiles := make([]*backuppb.File, 0, len(tbl.Files))
+		for _, f := range tbl.Files {
+			if _, ok := restored[f]; !ok {
+				continue
+			}
+			tableFiles = append(tableFiles, f)
+			tablePlan.Files = append(tablePlan.Files, f.GetName())
+			tablePlan.TotalKvs += f.GetTotalKvs()
+			tablePlan.TotalBytes += f.GetTotalBytes()
+		}
+		sort.Strings(tablePlan.Files)
+		ranges, _, err := MergeFileRanges(tableFiles, cfg.MergeRegionSizeBytes, cfg.MergeRegionKeyCount)
+		if err != nil {
+			return nil, errors.Annotatef(err, "failed to plan table %s.%s", tablePlan.Database, tablePlan.Table)
+		}
+		tablePlan.Ranges = len(ranges)
+
+		plan.TotalFiles += len(tablePlan.Files)
+		plan.TotalKvs += tablePlan.TotalKvs
+		plan.TotalBytes += tablePlan.TotalBytes
+		plan.TotalRanges += tablePlan.Ranges
+		plan.Tables = append(plan.Tables, tablePlan)
+	}
+	sort.Slice(plan.Tables, func(i, j int) bool {
+		if plan.Tables[i].Database != plan.Tables[j].Database {
+			return plan.Tables[i].Database < plan.Tables[j].Database
+		}
+		return plan.Tables[i].Table < plan.Tables[j].Table
+	})
+	return plan, nil
+}
@@ -0,0 +1,72 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package restore
+
+import (
+	"sync"
+
+	backuppb "github.com/pingcap/kvproto/pkg/backup"
+
+	"github.com/pingcap/br/pkg/glue"
+)
+
+// BytesProgressSteps is the total of a progress driven by BytesProgress.
+const BytesProgressSteps = 10000
+
+// BytesProgress reports the progress of restoring files by bytes. Since
+// glue.Progress can only be increased one by one, the bytes are divided into
+// BytesProgressSteps steps, the progress must be started with the total of
+// BytesProgressSteps.
+type BytesProgress struct {
+	mu       sync.Mutex
+	progress glue.Progress
+	total    uint64
+	done     uint64
+	reported int64
+}
+
+// NewBytesProgress returns a BytesProgress of `total` bytes reporting to the
+// progress.
+func NewBytesProgress(progress glue.Progress, total uint64) *BytesProgress {
+	return &BytesProgress{progress: progress, total: total}
+}
+
+// FileSize returns the bytes to read from the storage to restore the file.
+// The size of the SST file is used if it's recorded in the backupmeta,
+// otherwise falls back to the total bytes of the KV pairs.
+func FileSize(file *backuppb.File) uint64 {
+	if file.GetSize_() > 0 {
+		return file.GetSize_()
+	}
+	return file.GetTotalBytes()
+}
+
+// FilesSize returns the total FileSize of the files.
+func FilesSize(files []*backuppb.File) uint64 {
+	var size uint64
+	for _, f := range files {
+		size += FileSize(f)
+	}
+	return size
+}
+
+// Add marks `bytes` are restored. It is goroutine-safe.
+func (p *BytesProgress) Add(bytes uint64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.done += bytes
+	steps := int64(BytesProgressSteps)
+	if p.done < p.total {
+		steps = int64(float64(p.done) / float64(p.total) * BytesProgressSteps)
+	}
+	for ; p.reported < steps; p.reported++ {
+		p.progress.Inc()
+	}
+}
+
+// Done returns the restored bytes.
+func (p *BytesProgress) Done() uint64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.done
+}
@@ -0,0 +1,54 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package restore_test
+
+import (
+	"sync/atomic"
+
+	. "github.com/pingcap/check"
+	backuppb "github.com/pingcap/kvproto/pkg/backup"
+
+	"github.com/pingcap/br/pkg/restore"
+)
+
+type testProgressSuite struct{}
+
+var _ = Suite(&testProgressSuite{})
+
+type countProgress struct {
+	count int64
+}
+
+func (p *countProgress) Inc() {
+	atomic.AddInt64(&p.count, 1)
+}
+
+func (p *countProgress) Close() {}
+
+func (s *testProgressSuite) TestBytesProgress(c *C) {
+	files := []*backuppb.File{
+		{Name: "1.sst", Size_: 300, TotalBytes: 1000},
+		{Name: "2.sst", TotalBytes: 700},
+	}
+	c.Assert(restore.FileSize(files[0]), Equals, uint64(300))
+	c.Assert(restore.FileSize(files[1]), Equals, uint64(700))
+	total := restore.FilesSize(files)
+	c.Assert(total, Equals, uint64(1000))
+
+	counter := &countProgress{}
+	progress := restore.NewBytesProgress(counter, total)
+	progress.Add(restore.FileSize(files[0]))
+	c.Assert(counter.count, Equals, int64(restore.BytesProgressSteps*3/10))
+	progress.Add(restore.FileSize(files[1]))
+	c.Assert(counter.count, Equals, int64(restore.BytesProgressSteps))
+	c.Assert(progress.Done(), Equals, total)
+
+	// Never exceed the total steps.
+	progress.Add(100)
+	c.Assert(counter.count, Equals, int64(restore.BytesProgressSteps))
+
+	counter = &countProgress{}
+	progress = restore.NewBytesProgress(counter, 0)
+	progress.Add(0)
+	c.Assert(counter.count, Equals, int64(restore.BytesProgressSteps))
+}
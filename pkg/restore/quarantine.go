@@ -0,0 +1,119 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package restore
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/log"
+	"github.com/pingcap/parser/mysql"
+	"go.uber.org/zap"
+
+	berrors "github.com/pingcap/br/pkg/errors"
+	"github.com/pingcap/br/pkg/utils"
+)
+
+// QuarantineSchema is the database which the tables failed to validate
+// checksum are moved into, so they are never read as the restored tables.
+const QuarantineSchema = "__br_quarantine"
+
+// QuarantinedTable is a table failed to validate checksum.
+type QuarantinedTable struct {
+	DB    string
+	Table string
+}
+
+// String implements fmt.Stringer.
+func (t QuarantinedTable) String() string {
+	return utils.EncloseDBAndTable(t.DB, t.Table)
+}
+
+// QuarantinedName returns the name of the table in QuarantineSchema, which is
+// the database name and the table name joined by "__". A name longer than
+// the limit is truncated with the hash of the full name appended.
+func (t QuarantinedTable) QuarantinedName() string {
+	name := t.DB + "__" + t.Table
+	if len(name) <= mysql.MaxTableNameLength {
+		return name
+	}
+	hash := sha1.Sum([]byte(name))
+	suffix := "_" + hex.EncodeToString(hash[:4])
+	return name[:mysql.MaxTableNameLength-len(suffix)] + suffix
+}
+
+// quarantinedTables records the tables failed to validate checksum.
+type quarantinedTables struct {
+	mu     sync.Mutex
+	tables []QuarantinedTable
+}
+
+// EnableChecksumQuarantine makes GoValidateChecksum and GoValidateKVCount
+// quarantine the mismatched tables and continue validating the rest, instead
+// of failing at the first mismatched table. The quarantined tables are
+// returned by QuarantinedTables, and moved into QuarantineSchema by
+// QuarantineTables.
+func (rc *Client) EnableChecksumQuarantine() {
+	rc.quarantine = &quarantinedTables{}
+}
+
+// QuarantinedTables returns the quarantined tables sorted by name.
+func (rc *Client) QuarantinedTables() []QuarantinedTable {
+	if rc.quarantine == nil {
+		return nil
+	}
+	rc.quarantine.mu.Lock()
+	defer rc.quarantine.mu.Unlock()
+	tables := append([]QuarantinedTable{}, rc.quarantine.tables...)
+	sort.Slice(tables, func(i, j int) bool {
+		if tables[i].DB != tables[j].DB {
+			return tables[i].DB < tables[j].DB
+		}
+		return tables[i].Table < tables[j].Table
+	})
+	return tables
+}
+
+// QuarantineTables moves the quarantined tables into QuarantineSchema, named
+// by QuarantinedTable.QuarantinedName. It should be called after validating
+// the checksum of all the tables.
+func (rc *Client) QuarantineTables(ctx context.Context) error {
+	tables := rc.QuarantinedTables()
+	if len(tables) == 0 {
+		return nil
+	}
+	createSQL := fmt.Sprintf("CREATE DATABASE IF NOT EXISTS %s", utils.EncloseName(QuarantineSchema))
+	if err := rc.db.se.Execute(ctx, createSQL); err != nil {
+		return errors.Annotatef(err, "failed to create the quarantine database %s", QuarantineSchema)
+	}
+	for _, t := range tables {
+		renameSQL := fmt.Sprintf("RENAME TABLE %s TO %s",
+			t, utils.EncloseDBAndTable(QuarantineSchema, t.QuarantinedName()))
+		if err := rc.db.se.Execute(ctx, renameSQL); err != nil {
+			return errors.Annotatef(err, "failed to quarantine the table %s", t)
+		}
+		log.Warn("table quarantined", zap.Stringer("table", t),
+			zap.String("quarantined", utils.EncloseDBAndTable(QuarantineSchema, t.QuarantinedName())))
+	}
+	return nil
+}
+
+// quarantineMismatch quarantines the table if the validation error is a
+// checksum mismatch and the quarantine is enabled, then the error is
+// swallowed. Otherwise, the error is returned as is.
+func (rc *Client) quarantineMismatch(tbl CreatedTable, err error) error {
+	if err == nil || rc.quarantine == nil || !berrors.Is(err, berrors.ErrRestoreChecksumMismatch) {
+		return err
+	}
+	t := QuarantinedTable{DB: tbl.OldTable.DB.Name.O, Table: tbl.OldTable.Info.Name.O}
+	log.Error("quarantine the table failed to validate checksum", zap.Stringer("table", t), zap.Error(err))
+	rc.quarantine.mu.Lock()
+	rc.quarantine.tables = append(rc.quarantine.tables, t)
+	rc.quarantine.mu.Unlock()
+	return nil
+}
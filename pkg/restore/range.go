@@ -121,11 +121,15 @@ func (region *RegionInfo) ContainsInterior(key []byte) bool {
 // RewriteRules contains rules for rewriting keys of tables.
 type RewriteRules struct {
 	Data []*import_sstpb.RewriteRule
+	// SplitKeys are the extra keys (after rewriting) the regions must be split at,
+	// e.g. the boundaries of the partitions of a partitioned table.
+	SplitKeys [][]byte
 }
 
 // Append append its argument to this rewrite rules.
 func (r *RewriteRules) Append(other RewriteRules) {
 	r.Data = append(r.Data, other.Data...)
+	r.SplitKeys = append(r.SplitKeys, other.SplitKeys...)
 }
 
 // EmptyRewriteRule make a new, empty rewrite rule.
@@ -0,0 +1,129 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package restore
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pingcap/errors"
+	backuppb "github.com/pingcap/kvproto/pkg/backup"
+	"github.com/pingcap/log"
+	"github.com/pingcap/tidb/tablecodec"
+	"go.uber.org/zap"
+
+	berrors "github.com/pingcap/br/pkg/errors"
+)
+
+// throughputLimiter paces its callers so that the total bytes passing
+// through it don't exceed `rate` bytes per second.
+type throughputLimiter struct {
+	mu   sync.Mutex
+	rate uint64
+	// next is the earliest time the next caller may proceed.
+	next time.Time
+}
+
+func newThroughputLimiter(rate uint64) *throughputLimiter {
+	return &throughputLimiter{rate: rate}
+}
+
+// reserve reserves `n` bytes and returns how long the caller should wait
+// before sending them.
+func (l *throughputLimiter) reserve(now time.Time, n uint64) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	wait := l.next.Sub(now)
+	l.next = l.next.Add(time.Duration(float64(n) / float64(l.rate) * float64(time.Second)))
+	return wait
+}
+
+// wait blocks until `n` bytes are allowed to pass.
+func (l *throughputLimiter) wait(ctx context.Context, n uint64) error {
+	d := l.reserve(time.Now(), n)
+	if d <= 0 {
+		return nil
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(d):
+		return nil
+	}
+}
+
+// SetTableRateLimits sets the bandwidth caps (in bytes per second) for
+// restoring tables. The key of `limits` is either a database name `db`, or a
+// table name `db.table`. A table cap takes precedence over the cap of its
+// database, while the tables of a database share the database cap.
+// It must be called after InitBackupMeta.
+func (rc *Client) SetTableRateLimits(limits map[string]uint64) error {
+	if len(limits) == 0 {
+		return nil
+	}
+	normalized := make(map[string]uint64, len(limits))
+	for name, limit := range limits {
+		if limit == 0 {
+			return errors.Annotatef(berrors.ErrInvalidArgument, "the rate limit of %s must be positive", name)
+		}
+		normalized[strings.ToLower(name)] = limit
+	}
+
+	matched := make(map[string]struct{}, len(normalized))
+	rc.tableRateLimiters = make(map[int64]*throughputLimiter)
+	for _, db := range rc.databases {
+		dbName := db.Info.Name.L
+		var dbLimiter *throughputLimiter
+		if limit, ok := normalized[dbName]; ok {
+			matched[dbName] = struct{}{}
+			dbLimiter = newThroughputLimiter(limit)
+		}
+		for _, table := range db.Tables {
+			tableName := dbName + "." + table.Info.Name.L
+			limiter := dbLimiter
+			if limit, ok := normalized[tableName]; ok {
+				matched[tableName] = struct{}{}
+				limiter = newThroughputLimiter(limit)
+			}
+			if limiter == nil {
+				continue
+			}
+			rc.tableRateLimiters[table.Info.ID] = limiter
+			if table.Info.Partition != nil {
+				for _, def := range table.Info.Partition.Definitions {
+					rc.tableRateLimiters[def.ID] = limiter
+				}
+			}
+		}
+	}
+	for name := range normalized {
+		if _, ok := matched[name]; !ok {
+			return errors.Annotatef(berrors.ErrInvalidArgument,
+				"the database or table %s with rate limit is not found in the backup", name)
+		}
+	}
+	log.Info("set table rate limits", zap.Any("limits", limits))
+	return nil
+}
+
+// waitTableRateLimit blocks until the files are allowed to be restored by the
+// rate limit of their table.
+func (rc *Client) waitTableRateLimit(ctx context.Context, files []*backuppb.File) error {
+	if len(rc.tableRateLimiters) == 0 || len(files) == 0 {
+		return nil
+	}
+	limiter, ok := rc.tableRateLimiters[tablecodec.DecodeTableID(files[0].GetStartKey())]
+	if !ok {
+		return nil
+	}
+	var size uint64
+	for _, f := range files {
+		size += f.GetTotalBytes()
+	}
+	return errors.Trace(limiter.wait(ctx, size))
+}
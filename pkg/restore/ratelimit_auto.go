@@ -0,0 +1,130 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package restore
+
+import (
+	"context"
+	"time"
+
+	"github.com/docker/go-units"
+	"github.com/pingcap/errors"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+const (
+	// AutoRateLimitInterval is the interval of polling the load of the stores
+	// and tuning the rate limit.
+	AutoRateLimitInterval = 30 * time.Second
+	// AutoRateLimitMax and AutoRateLimitMin bound the download speed limit of
+	// each store tuned by the load.
+	AutoRateLimitMax = 256 * units.MiB
+	AutoRateLimitMin = 8 * units.MiB
+	// AutoRateLimitBusyLoad is the foreground bytes per second of a store over
+	// which the store is considered serving the foreground traffic, the rate
+	// limit is raised only if the load is below a quarter of it.
+	AutoRateLimitBusyLoad = 32 * units.MiB
+)
+
+// StoresLoadFunc returns the foreground load of the stores in bytes per
+// second by the store IDs, e.g. PdController.GetStoresLoad.
+type StoresLoadFunc func(ctx context.Context) (map[uint64]float64, error)
+
+// AutoRateLimiter tunes the download speed limit of each store by its
+// foreground load: the limit is halved while the store is busy, and raised
+// step by step while it's idle, so the restore backs off for the foreground
+// traffic and speeds up again after it.
+type AutoRateLimiter struct {
+	load  StoresLoadFunc
+	apply func(ctx context.Context, storeID, rateLimit uint64) error
+
+	min, max uint64
+	busyLoad float64
+	limits   map[uint64]uint64
+}
+
+// NewAutoRateLimiter creates the AutoRateLimiter, apply sets the rate limit of
+// a store, e.g. Client.SetStoreDownloadSpeedLimit.
+func NewAutoRateLimiter(load StoresLoadFunc, apply func(ctx context.Context, storeID, rateLimit uint64) error) *AutoRateLimiter {
+	return &AutoRateLimiter{
+		load:     load,
+		apply:    apply,
+		min:      AutoRateLimitMin,
+		max:      AutoRateLimitMax,
+		busyLoad: AutoRateLimitBusyLoad,
+		limits:   make(map[uint64]uint64),
+	}
+}
+
+// nextRateLimit returns the rate limit of a store with the load.
+func (l *AutoRateLimiter) nextRateLimit(current uint64, load float64) uint64 {
+	switch {
+	case load > l.busyLoad:
+		current /= 2
+	case load < l.busyLoad/4:
+		current += l.max / 8
+	}
+	if current < l.min {
+		return l.min
+	}
+	if current > l.max {
+		return l.max
+	}
+	return current
+}
+
+// Tune polls the load of the stores once and applies the changed rate limits.
+// A store starts at half of the max rate limit. It fails only if the load
+// can't be polled.
+func (l *AutoRateLimiter) Tune(ctx context.Context) error {
+	loads, err := l.load(ctx)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	for storeID, load := range loads {
+		current, ok := l.limits[storeID]
+		if !ok {
+			current = l.max / 2
+		}
+		next := l.nextRateLimit(current, load)
+		if ok && next == current {
+			continue
+		}
+		// The hot stores may include TiFlash, which can't be set, so a
+		// failed store is skipped and retried by the next round.
+		if err = l.apply(ctx, storeID, next); err != nil {
+			log.Warn("failed to set the download speed limit of the store",
+				zap.Uint64("store-id", storeID), zap.Error(err))
+			continue
+		}
+		l.limits[storeID] = next
+		log.Info("tuned the download speed limit by the load of the store",
+			zap.Uint64("store-id", storeID),
+			zap.String("load", units.HumanSize(load)+"/s"),
+			zap.String("ratelimit", units.HumanSize(float64(next))+"/s"))
+	}
+	return nil
+}
+
+// RateLimit returns the rate limit of the store applied last, zero if it's
+// never tuned.
+func (l *AutoRateLimiter) RateLimit(storeID uint64) uint64 {
+	return l.limits[storeID]
+}
+
+// Run tunes the rate limits by the interval until the context is done.
+// Failing to tune is logged only, the rate limits are kept.
+func (l *AutoRateLimiter) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := l.Tune(ctx); err != nil {
+			log.Warn("failed to tune the rate limit by the load of the stores", zap.Error(err))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,66 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package restore_test
+
+import (
+	"context"
+
+	"github.com/docker/go-units"
+	. "github.com/pingcap/check"
+	"github.com/pingcap/errors"
+
+	"github.com/pingcap/br/pkg/restore"
+)
+
+type testAutoRateLimitSuite struct{}
+
+var _ = Suite(&testAutoRateLimitSuite{})
+
+func (s *testAutoRateLimitSuite) TestTune(c *C) {
+	ctx := context.Background()
+	loads := map[uint64]float64{
+		1: 0,
+		2: 100 * units.MiB,
+		3: 16 * units.MiB,
+	}
+	var loadErr error
+	applied := make(map[uint64][]uint64)
+	limiter := restore.NewAutoRateLimiter(
+		func(context.Context) (map[uint64]float64, error) {
+			return loads, loadErr
+		},
+		func(_ context.Context, storeID, rateLimit uint64) error {
+			if storeID == 4 {
+				return errors.New("not a TiKV store")
+			}
+			applied[storeID] = append(applied[storeID], rateLimit)
+			return nil
+		})
+
+	// Each store starts at the half of the max rate limit.
+	c.Assert(limiter.Tune(ctx), IsNil)
+	c.Assert(limiter.RateLimit(1), Equals, uint64(160*units.MiB))
+	c.Assert(limiter.RateLimit(2), Equals, uint64(64*units.MiB))
+	c.Assert(limiter.RateLimit(3), Equals, uint64(128*units.MiB))
+
+	// The store which fails to be set is skipped.
+	loads[4] = 0
+	for i := 0; i < 4; i++ {
+		c.Assert(limiter.Tune(ctx), IsNil)
+	}
+	c.Assert(limiter.RateLimit(4), Equals, uint64(0))
+	// The rate limits are bounded, and applied only if they change.
+	c.Assert(applied[1], DeepEquals, []uint64{160 * units.MiB, 192 * units.MiB, 224 * units.MiB, 256 * units.MiB})
+	c.Assert(applied[2], DeepEquals, []uint64{64 * units.MiB, 32 * units.MiB, 16 * units.MiB, 8 * units.MiB})
+	c.Assert(applied[3], DeepEquals, []uint64{128 * units.MiB})
+
+	// The store serving the foreground traffic backs off.
+	loads[1] = 64 * units.MiB
+	c.Assert(limiter.Tune(ctx), IsNil)
+	c.Assert(limiter.RateLimit(1), Equals, uint64(128*units.MiB))
+
+	// The rate limits are kept if the load can't be polled.
+	loadErr = errors.New("PD unavailable")
+	c.Assert(limiter.Tune(ctx), NotNil)
+	c.Assert(limiter.RateLimit(1), Equals, uint64(128*units.MiB))
+}
@@ -0,0 +1,151 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package restore
+
+import (
+	"bytes"
+	"context"
+	"sort"
+
+	"github.com/pingcap/errors"
+	backuppb "github.com/pingcap/kvproto/pkg/backup"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+
+	berrors "github.com/pingcap/br/pkg/errors"
+	"github.com/pingcap/br/pkg/logutil"
+	"github.com/pingcap/br/pkg/redact"
+	"github.com/pingcap/br/pkg/rtree"
+	"github.com/pingcap/br/pkg/utils"
+)
+
+// RawFileFilter is the predicates of the files walked by WalkFilesInRawRange.
+type RawFileFilter struct {
+	// StartKey and EndKey is the range to restore, the files intersecting
+	// with it are walked. It must be fully backed up in every column family.
+	StartKey []byte
+	EndKey   []byte
+	// CFs is the column families to restore, at least one is required.
+	CFs []string
+	// MinSize and MaxSize filter the files by their size, zero MaxSize means
+	// no upper limit.
+	MinSize uint64
+	MaxSize uint64
+}
+
+func (f *RawFileFilter) match(file *backuppb.File, cfs map[string]struct{}) bool {
+	if _, ok := cfs[file.Cf]; !ok {
+		return false
+	}
+	if len(file.EndKey) > 0 && bytes.Compare(file.EndKey, f.StartKey) < 0 {
+		// The file is before the range to be restored.
+		return false
+	}
+	if len(f.EndKey) > 0 && bytes.Compare(f.EndKey, file.StartKey) <= 0 {
+		// The file is after the range to be restored.
+		// The specified endKey is exclusive, so when it equals to a file's startKey, the file is still skipped.
+		return false
+	}
+	if file.Size_ < f.MinSize || (f.MaxSize > 0 && file.Size_ > f.MaxSize) {
+		return false
+	}
+	return true
+}
+
+// WalkFilesInRawRange checks the range of the filter is backed up, then reads
+// the files of the raw kv backup from the metafiles lazily, and outputs the
+// ones matching the filter in pages of at most pageSize files, in the order
+// of the metafiles. Only a page of the files is in memory at a time.
+func (rc *Client) WalkFilesInRawRange(
+	ctx context.Context, filter RawFileFilter, pageSize int, output func([]*backuppb.File) error,
+) error {
+	if !rc.IsRawKvMode() {
+		return errors.Annotate(berrors.ErrRestoreModeMismatch, "the backup data is not in raw kv mode")
+	}
+	if len(filter.CFs) == 0 {
+		return errors.Annotate(berrors.ErrInvalidArgument, "no column family to restore")
+	}
+	if filter.MaxSize > 0 && filter.MinSize > filter.MaxSize {
+		return errors.Annotatef(berrors.ErrInvalidArgument,
+			"min size %d is greater than max size %d", filter.MinSize, filter.MaxSize)
+	}
+
+	cfs := make(map[string]struct{}, len(filter.CFs))
+	for _, cf := range filter.CFs {
+		if _, ok := cfs[cf]; ok {
+			continue
+		}
+		cfs[cf] = struct{}{}
+		if err := rc.checkRawRangeBackedUp(filter.StartKey, filter.EndKey, cf); err != nil {
+			return errors.Annotatef(err, "cf %s", cf)
+		}
+	}
+
+	page := make([]*backuppb.File, 0, pageSize)
+	err := rc.metaReader.ReadDataFilesInPages(ctx, pageSize, func(files []*backuppb.File) error {
+		for _, file := range files {
+			if !filter.match(file, cfs) {
+				continue
+			}
+			page = append(page, file)
+			if len(page) < pageSize {
+				continue
+			}
+			if err := output(page); err != nil {
+				return errors.Trace(err)
+			}
+			page = make([]*backuppb.File, 0, pageSize)
+		}
+		return nil
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if len(page) == 0 {
+		return nil
+	}
+	return errors.Trace(output(page))
+}
+
+func (rc *Client) checkRawRangeBackedUp(startKey []byte, endKey []byte, cf string) error {
+	// The raw ranges of a CF are disjoint, the gaps between them are the
+	// ranges excluded from the backup.
+	backedUp := make([]rtree.Range, 0, 1)
+	intersected := false
+	for _, rawRange := range rc.backupMeta.RawRanges {
+		if rawRange.Cf != cf {
+			continue
+		}
+		backedUp = append(backedUp, rtree.Range{StartKey: rawRange.StartKey, EndKey: rawRange.EndKey})
+		if (len(rawRange.EndKey) > 0 && bytes.Compare(startKey, rawRange.EndKey) >= 0) ||
+			(len(endKey) > 0 && bytes.Compare(rawRange.StartKey, endKey) >= 0) {
+			// The restoring range is totally out of the current range. Skip it.
+			continue
+		}
+		intersected = true
+	}
+	if !intersected {
+		return errors.Annotate(berrors.ErrRestoreRangeMismatch, "no backup data in the range")
+	}
+
+	// First check whether the given range is backup-ed. If not, we cannot perform the restore.
+	sort.Slice(backedUp, func(i, j int) bool {
+		return bytes.Compare(backedUp[i].StartKey, backedUp[j].StartKey) < 0
+	})
+	outerStart, outerEnd := backedUp[0].StartKey, backedUp[len(backedUp)-1].EndKey
+	if bytes.Compare(startKey, outerStart) < 0 || utils.CompareEndKey(endKey, outerEnd) > 0 {
+		// Only partial of the restoring range is in the backup-ed range. So the given range can't be fully
+		// restored.
+		return errors.Annotatef(berrors.ErrRestoreRangeMismatch,
+			"the given range to restore [%s, %s) is not fully covered by the range that was backed up [%s, %s)",
+			redact.Key(startKey), redact.Key(endKey), redact.Key(outerStart), redact.Key(outerEnd),
+		)
+	}
+	for _, excluded := range rtree.SubtractRanges(rtree.Range{StartKey: startKey, EndKey: endKey}, backedUp) {
+		log.Warn("the range is excluded from the backup, it won't be restored",
+			zap.String("cf", cf),
+			logutil.Key("startKey", excluded.StartKey),
+			logutil.Key("endKey", excluded.EndKey))
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package restore
+
+import (
+	"context"
+	"fmt"
+
+	. "github.com/pingcap/check"
+	"github.com/pingcap/errors"
+	backuppb "github.com/pingcap/kvproto/pkg/backup"
+
+	"github.com/pingcap/br/pkg/metautil"
+)
+
+type testRawFilesSuite struct{}
+
+var _ = Suite(&testRawFilesSuite{})
+
+// newRawFilesClient returns a client of a raw backup of [a, z) in the default
+// and write CF with the files.
+func newRawFilesClient(files ...*backuppb.File) *Client {
+	meta := &backuppb.BackupMeta{
+		IsRawKv: true,
+		RawRanges: []*backuppb.RawRange{
+			{StartKey: []byte("a"), EndKey: []byte("z"), Cf: "default"},
+			{StartKey: []byte("a"), EndKey: []byte("z"), Cf: "write"},
+		},
+		Files: files,
+	}
+	return &Client{backupMeta: meta, metaReader: metautil.NewMetaReader(meta, nil)}
+}
+
+func rawFile(name, cf, start, end string, size uint64) *backuppb.File {
+	return &backuppb.File{Name: name, Cf: cf, StartKey: []byte(start), EndKey: []byte(end), Size_: size}
+}
+
+func fileNames(files []*backuppb.File) []string {
+	names := make([]string, 0, len(files))
+	for _, f := range files {
+		names = append(names, f.Name)
+	}
+	return names
+}
+
+// walkRawFiles returns the names of the files of each page walked.
+func walkRawFiles(rc *Client, filter RawFileFilter, pageSize int) ([][]string, error) {
+	pages := make([][]string, 0)
+	err := rc.WalkFilesInRawRange(context.Background(), filter, pageSize, func(page []*backuppb.File) error {
+		pages = append(pages, fileNames(page))
+		return nil
+	})
+	return pages, err
+}
+
+func (s *testRawFilesSuite) TestWalkEmptyRange(c *C) {
+	rc := newRawFilesClient(rawFile("f1", "default", "a", "c", 1))
+
+	// The range is backed up, but no file intersects with it.
+	pages, err := walkRawFiles(rc, RawFileFilter{StartKey: []byte("x"), EndKey: []byte("y"), CFs: []string{"default"}}, 10)
+	c.Assert(err, IsNil)
+	c.Assert(pages, HasLen, 0)
+
+	// The backup has no file at all.
+	pages, err = walkRawFiles(newRawFilesClient(), RawFileFilter{CFs: []string{"default"}, StartKey: []byte("a"), EndKey: []byte("z")}, 10)
+	c.Assert(err, IsNil)
+	c.Assert(pages, HasLen, 0)
+
+	// The range out of the backup fails.
+	_, err = walkRawFiles(rc, RawFileFilter{StartKey: []byte("0"), EndKey: []byte("b"), CFs: []string{"default"}}, 10)
+	c.Assert(err, ErrorMatches, ".*not fully covered.*")
+}
+
+func (s *testRawFilesSuite) TestWalkPageBoundaries(c *C) {
+	files := make([]*backuppb.File, 0, 6)
+	for i := 0; i < 5; i++ {
+		key := string(rune('b' + i))
+		files = append(files, rawFile(fmt.Sprintf("f%d", i), "default", key, key+"\xff", uint64(i)))
+	}
+	// The filtered out files don't make a page short.
+	files = append(files[:2], append([]*backuppb.File{rawFile("w", "write", "b", "c", 1)}, files[2:]...)...)
+	rc := newRawFilesClient(files...)
+	filter := RawFileFilter{StartKey: []byte("a"), EndKey: []byte("z"), CFs: []string{"default"}}
+
+	pages, err := walkRawFiles(rc, filter, 2)
+	c.Assert(err, IsNil)
+	c.Assert(pages, DeepEquals, [][]string{{"f0", "f1"}, {"f2", "f3"}, {"f4"}})
+
+	// A page exactly as large as the files.
+	pages, err = walkRawFiles(rc, filter, 5)
+	c.Assert(err, IsNil)
+	c.Assert(pages, DeepEquals, [][]string{{"f0", "f1", "f2", "f3", "f4"}})
+
+	// A page larger than the files.
+	pages, err = walkRawFiles(rc, filter, 100)
+	c.Assert(err, IsNil)
+	c.Assert(pages, HasLen, 1)
+
+	// The walk stops at the first error of the output.
+	walked := 0
+	err = rc.WalkFilesInRawRange(context.Background(), filter, 2, func([]*backuppb.File) error {
+		walked++
+		return errors.New("output failed")
+	})
+	c.Assert(err, ErrorMatches, "output failed")
+	c.Assert(walked, Equals, 1)
+}
+
+func (s *testRawFilesSuite) TestWalkFilter(c *C) {
+	rc := newRawFilesClient(
+		rawFile("d1", "default", "a", "c", 10),
+		rawFile("w1", "write", "a", "c", 1),
+		rawFile("d2", "default", "c", "e", 100),
+		rawFile("w2", "write", "c", "e", 20),
+		rawFile("d3", "default", "e", "g", 30),
+	)
+	collect := func(filter RawFileFilter) []string {
+		pages, err := walkRawFiles(rc, filter, 100)
+		c.Assert(err, IsNil)
+		if len(pages) == 0 {
+			return nil
+		}
+		c.Assert(pages, HasLen, 1)
+		return pages[0]
+	}
+
+	// The files are walked in the order of the metafiles, and a duplicated CF
+	// is ignored.
+	c.Assert(collect(RawFileFilter{StartKey: []byte("a"), EndKey: []byte("z"), CFs: []string{"write", "default", "write"}}),
+		DeepEquals, []string{"d1", "w1", "d2", "w2", "d3"})
+	// The end key is exclusive.
+	c.Assert(collect(RawFileFilter{StartKey: []byte("b"), EndKey: []byte("c"), CFs: []string{"default"}}),
+		DeepEquals, []string{"d1"})
+	c.Assert(collect(RawFileFilter{StartKey: []byte("d"), EndKey: []byte("f"), CFs: []string{"default"}}),
+		DeepEquals, []string{"d2", "d3"})
+	// The size predicates.
+	c.Assert(collect(RawFileFilter{StartKey: []byte("a"), EndKey: []byte("z"), CFs: []string{"default"}, MinSize: 20}),
+		DeepEquals, []string{"d2", "d3"})
+	c.Assert(collect(RawFileFilter{StartKey: []byte("a"), EndKey: []byte("z"), CFs: []string{"default", "write"}, MinSize: 10, MaxSize: 30}),
+		DeepEquals, []string{"d1", "w2", "d3"})
+
+	_, err := walkRawFiles(rc, RawFileFilter{StartKey: []byte("a"), EndKey: []byte("z")}, 100)
+	c.Assert(err, ErrorMatches, ".*no column family to restore.*")
+	_, err = walkRawFiles(rc, RawFileFilter{StartKey: []byte("a"), EndKey: []byte("z"), CFs: []string{"default"}, MinSize: 2, MaxSize: 1}, 100)
+	c.Assert(err, ErrorMatches, ".*min size 2 is greater than max size 1.*")
+	_, err = walkRawFiles(&Client{backupMeta: &backuppb.BackupMeta{}}, RawFileFilter{CFs: []string{"default"}}, 100)
+	c.Assert(err, ErrorMatches, ".*not in raw kv mode.*")
+}
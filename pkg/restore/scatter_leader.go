@@ -0,0 +1,87 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package restore
+
+import (
+	"context"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/kvproto/pkg/metapb"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+
+	"github.com/pingcap/br/pkg/logutil"
+)
+
+// SetScatterLeader makes the splitter balance the leaders of the scattered
+// regions over the stores of their voters. Scattering only moves the peers,
+// so without it the leaders of the new regions may stay in the store of the
+// original region, which becomes the bottleneck of ingesting.
+func (rs *RegionSplitter) SetScatterLeader(scatter bool) {
+	rs.scatterLeader = scatter
+}
+
+// planLeaderTransfers returns the target store of the leader of each region
+// needs to be transferred, so that the leaders are spread evenly over the
+// stores. The regions are assigned greedily to the voter store with the fewest
+// leaders, and the current leader is kept on ties.
+func planLeaderTransfers(regions []*RegionInfo) map[uint64]uint64 {
+	leaders := make(map[uint64]int)
+	transfers := make(map[uint64]uint64)
+	for _, region := range regions {
+		current := region.Leader.GetStoreId()
+		target := current
+		for _, peer := range region.Region.GetPeers() {
+			if peer.GetRole() == metapb.PeerRole_Learner {
+				continue
+			}
+			if target == 0 || leaders[peer.GetStoreId()] < leaders[target] {
+				target = peer.GetStoreId()
+			}
+		}
+		if target == 0 {
+			continue
+		}
+		leaders[target]++
+		if target != current {
+			transfers[region.Region.GetId()] = target
+		}
+	}
+	return transfers
+}
+
+// scatterLeaders balances the leaders of the regions. It's best-effort, the
+// regions failed to transfer the leaders are only logged.
+func (rs *RegionSplitter) scatterLeaders(ctx context.Context, scatterRegions []*RegionInfo) {
+	regions := make([]*RegionInfo, 0, len(scatterRegions))
+	for _, region := range scatterRegions {
+		// reload the regions to get the peers after scattering.
+		latest, err := rs.client.GetRegionByID(ctx, region.Region.GetId())
+		if err != nil || latest == nil {
+			log.Warn("failed to get region, skip scattering its leader",
+				logutil.Region(region.Region), zap.Error(err))
+			continue
+		}
+		regions = append(regions, latest)
+	}
+	transfers := planLeaderTransfers(regions)
+	failed := 0
+	for _, region := range regions {
+		target, ok := transfers[region.Region.GetId()]
+		if !ok {
+			continue
+		}
+		if err := rs.client.TransferLeader(ctx, region.Region.GetId(), target); err != nil {
+			if errors.Cause(err) == context.Canceled { // nolint:errorlint
+				return
+			}
+			failed++
+			log.Warn("failed to transfer leader", logutil.Region(region.Region),
+				zap.Uint64("to-store", target), zap.Error(err))
+		}
+	}
+	log.Info("scatter leaders done",
+		zap.Int("regions", len(regions)),
+		zap.Int("transfers", len(transfers)),
+		zap.Int("failed", failed))
+}
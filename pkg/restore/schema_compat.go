@@ -0,0 +1,87 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package restore
+
+import (
+	"github.com/pingcap/errors"
+	"github.com/pingcap/parser/model"
+	"github.com/pingcap/parser/mysql"
+
+	berrors "github.com/pingcap/br/pkg/errors"
+)
+
+// CheckTableSchemaCompatible checks whether the data of the backup table can
+// be ingested into the existing table. The row data is encoded by the column
+// IDs, so the columns must have the same IDs and types, while the indexes are
+// rewritten by their names, so they must have the same columns.
+func CheckTableSchemaCompatible(backup, existing *model.TableInfo) error {
+	incompatible := func(format string, args ...interface{}) error {
+		return errors.Annotatef(berrors.ErrRestoreSchemaIncompatible,
+			"table %s: "+format, append([]interface{}{existing.Name}, args...)...)
+	}
+
+	if backup.PKIsHandle != existing.PKIsHandle || backup.IsCommonHandle != existing.IsCommonHandle {
+		return incompatible("the primary key is not the same kind of handle")
+	}
+
+	columns := make(map[string]*model.ColumnInfo, len(existing.Columns))
+	for _, col := range existing.Columns {
+		columns[col.Name.L] = col
+	}
+	if len(backup.Columns) != len(existing.Columns) {
+		return incompatible("%d columns in the backup, %d columns in the existing table",
+			len(backup.Columns), len(existing.Columns))
+	}
+	for _, col := range backup.Columns {
+		target, ok := columns[col.Name.L]
+		if !ok {
+			return incompatible("column %s doesn't exist", col.Name)
+		}
+		if target.ID != col.ID {
+			return incompatible("column %s has ID %d in the backup, %d in the existing table", col.Name, col.ID, target.ID)
+		}
+		if target.Tp != col.Tp || mysql.HasUnsignedFlag(target.Flag) != mysql.HasUnsignedFlag(col.Flag) {
+			return incompatible("column %s has type %s in the backup, %s in the existing table",
+				col.Name, col.FieldType.String(), target.FieldType.String())
+		}
+	}
+
+	indexes := make(map[string]*model.IndexInfo, len(existing.Indices))
+	for _, idx := range existing.Indices {
+		indexes[idx.Name.L] = idx
+	}
+	if len(backup.Indices) != len(existing.Indices) {
+		return incompatible("%d indexes in the backup, %d indexes in the existing table",
+			len(backup.Indices), len(existing.Indices))
+	}
+	for _, idx := range backup.Indices {
+		target, ok := indexes[idx.Name.L]
+		if !ok {
+			return incompatible("index %s doesn't exist", idx.Name)
+		}
+		if target.Unique != idx.Unique || target.Primary != idx.Primary || len(target.Columns) != len(idx.Columns) {
+			return incompatible("index %s is not the same", idx.Name)
+		}
+		for i, col := range idx.Columns {
+			if target.Columns[i].Name.L != col.Name.L || target.Columns[i].Length != col.Length {
+				return incompatible("index %s is not the same", idx.Name)
+			}
+		}
+	}
+
+	if backup.Partition != nil {
+		if existing.Partition == nil {
+			return incompatible("the existing table is not partitioned")
+		}
+		partitions := make(map[string]struct{}, len(existing.Partition.Definitions))
+		for _, def := range existing.Partition.Definitions {
+			partitions[def.Name.L] = struct{}{}
+		}
+		for _, def := range backup.Partition.Definitions {
+			if _, ok := partitions[def.Name.L]; !ok {
+				return incompatible("partition %s doesn't exist", def.Name)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package restore_test
+
+import (
+	. "github.com/pingcap/check"
+	"github.com/pingcap/parser/model"
+	"github.com/pingcap/parser/mysql"
+	"github.com/pingcap/tidb/types"
+
+	berrors "github.com/pingcap/br/pkg/errors"
+	"github.com/pingcap/br/pkg/restore"
+)
+
+type testSchemaCompatSuite struct{}
+
+var _ = Suite(&testSchemaCompatSuite{})
+
+func newCompatTable(id int64) *model.TableInfo {
+	return &model.TableInfo{
+		ID:   id,
+		Name: model.NewCIStr("t"),
+		Columns: []*model.ColumnInfo{
+			{ID: 1, Name: model.NewCIStr("id"), FieldType: *types.NewFieldType(mysql.TypeLong), State: model.StatePublic},
+			{ID: 2, Name: model.NewCIStr("name"), FieldType: *types.NewFieldType(mysql.TypeVarchar), State: model.StatePublic},
+		},
+		Indices: []*model.IndexInfo{{
+			ID:      1,
+			Name:    model.NewCIStr("idx_name"),
+			Columns: []*model.IndexColumn{{Name: model.NewCIStr("name"), Length: -1}},
+		}},
+	}
+}
+
+func (s *testSchemaCompatSuite) TestCheckTableSchemaCompatible(c *C) {
+	backup := newCompatTable(1)
+
+	// The table IDs and index IDs are rewritten.
+	existing := newCompatTable(100)
+	existing.Indices[0].ID = 5
+	c.Assert(restore.CheckTableSchemaCompatible(backup, existing), IsNil)
+
+	existing = newCompatTable(100)
+	existing.Columns[1].ID = 3
+	err := restore.CheckTableSchemaCompatible(backup, existing)
+	c.Assert(berrors.Is(err, berrors.ErrRestoreSchemaIncompatible), IsTrue)
+	c.Assert(err, ErrorMatches, ".*column name has ID 2 in the backup, 3 in the existing table.*")
+
+	existing = newCompatTable(100)
+	existing.Columns[0].FieldType = *types.NewFieldType(mysql.TypeLonglong)
+	err = restore.CheckTableSchemaCompatible(backup, existing)
+	c.Assert(err, ErrorMatches, ".*column id has type.*")
+
+	existing = newCompatTable(100)
+	existing.Indices[0].Columns[0].Name = model.NewCIStr("id")
+	err = restore.CheckTableSchemaCompatible(backup, existing)
+	c.Assert(err, ErrorMatches, ".*index idx_name is not the same.*")
+
+	existing = newCompatTable(100)
+	existing.Indices = nil
+	err = restore.CheckTableSchemaCompatible(backup, existing)
+	c.Assert(err, ErrorMatches, ".*1 indexes in the backup, 0 indexes in the existing table.*")
+
+	existing = newCompatTable(100)
+	existing.PKIsHandle = true
+	err = restore.CheckTableSchemaCompatible(backup, existing)
+	c.Assert(err, ErrorMatches, ".*primary key.*")
+}
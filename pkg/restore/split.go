@@ -6,7 +6,10 @@ import (
 	"bytes"
 	"context"
 	"encoding/hex"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/opentracing/opentracing-go"
@@ -21,6 +24,7 @@ import (
 	berrors "github.com/pingcap/br/pkg/errors"
 	"github.com/pingcap/br/pkg/logutil"
 	"github.com/pingcap/br/pkg/rtree"
+	"github.com/pingcap/br/pkg/summary"
 	"github.com/pingcap/br/pkg/utils"
 )
 
@@ -34,28 +38,229 @@ const (
 	SplitCheckInterval      = 8 * time.Millisecond
 	SplitMaxCheckInterval   = time.Second
 
+	// backoff about 6s, or we give up scattering a region.
+	ScatterRetryTimes       = 7
+	ScatterRetryInterval    = 50 * time.Millisecond
+	ScatterMaxRetryInterval = 3200 * time.Millisecond
+
 	ScatterWaitMaxRetryTimes = 64
 	ScatterWaitInterval      = 50 * time.Millisecond
 	ScatterMaxWaitInterval   = time.Second
 	ScatterWaitUpperInterval = 180 * time.Second
+	// DefaultScatterWaitConcurrency is the default max number of concurrent
+	// operator queries when waiting for scattering, see SetScatterWait.
+	DefaultScatterWaitConcurrency = 16
+	// RegionNotFoundGracePeriod is the default duration PD may report
+	// REGION_NOT_FOUND for a scattering region before the region is resolved
+	// again, see SetRegionNotFoundGrace.
+	RegionNotFoundGracePeriod = 10 * time.Second
 
 	ScanRegionPaginationLimit = 128
 
+	ScanRegionConsistencyRetryTimes   = 8
+	ScanRegionConsistencyWaitInterval = 50 * time.Millisecond
+	// scanRegionMaxProbes is the max number of the inconsistent spans whose
+	// regions are queried from PD before waiting.
+	scanRegionMaxProbes = 8
+
 	RejectStoreCheckRetryTimes  = 64
 	RejectStoreCheckInterval    = 100 * time.Millisecond
 	RejectStoreMaxCheckInterval = 2 * time.Second
+
+	// defaultRegionHeartbeatInterval is the default pd-heartbeat-tick-interval
+	// of TiKV, which the default split and scatter polling intervals suit.
+	defaultRegionHeartbeatInterval = time.Minute
 )
 
 // RegionSplitter is a executor of region split by rules.
 type RegionSplitter struct {
-	client SplitClient
+	client     SplitClient
+	checkpoint *SplitCheckpoint
+	codec      KeyCodec
+	// rawKVSplitCheck checks whether the TiKV can split the regions by the
+	// raw keys, see SetRawKVSplitCheck.
+	rawKVSplitCheck func(ctx context.Context) error
+
+	// failureDomainLabel is the label key of the failure domains to verify
+	// after scattering, see SetFailureDomainCheck.
+	failureDomainLabel string
+	rescatterViolating bool
+	// scatterLeader balances the leaders of the scattered regions, see
+	// SetScatterLeader.
+	scatterLeader bool
+	// skipScatter disables scattering, see SetSkipScatter.
+	skipScatter bool
+	// splitTargetSize coalesces the split keys of the small ranges, see
+	// SetSplitTargetSize.
+	splitTargetSize uint64
+	// memory accounts the scanned regions, see SetMemoryTracker.
+	memory *MemoryTracker
+
+	// the polling intervals of waiting for split and scatter, see
+	// SetRegionHeartbeatInterval.
+	splitCheckInterval     time.Duration
+	splitMaxCheckInterval  time.Duration
+	scatterWaitInterval    time.Duration
+	scatterMaxWaitInterval time.Duration
+	// regionNotFoundGrace is the duration of tolerating REGION_NOT_FOUND
+	// when waiting for scattering, see SetRegionNotFoundGrace.
+	regionNotFoundGrace time.Duration
+	// the worker pool size and the deadline shared by all the regions of
+	// waiting for scattering, see SetScatterWait.
+	scatterWaitConcurrency int
+	scatterWaitTimeout     time.Duration
+	// backoffPolicy creates the backoffers of retrying split, scatter and
+	// the region scans, see SetBackoffPolicy.
+	backoffPolicy utils.BackoffPolicy
+	// batchScatterUnsupported is set once PD is found not supporting
+	// scattering regions in batch.
+	batchScatterUnsupported int32
+	// the wait of the inconsistent region scans, see scanRegions.
+	scanWaitInterval time.Duration
+	regionHeartbeat  time.Duration
 }
 
 // NewRegionSplitter returns a new RegionSplitter.
 func NewRegionSplitter(client SplitClient) *RegionSplitter {
 	return &RegionSplitter{
-		client: client,
+		client:                 client,
+		codec:                  DefaultKeyCodec,
+		splitCheckInterval:     SplitCheckInterval,
+		splitMaxCheckInterval:  SplitMaxCheckInterval,
+		scatterWaitInterval:    ScatterWaitInterval,
+		scatterMaxWaitInterval: ScatterMaxWaitInterval,
+		scanWaitInterval:       ScanRegionConsistencyWaitInterval,
+		regionHeartbeat:        defaultRegionHeartbeatInterval,
+		regionNotFoundGrace:    RegionNotFoundGracePeriod,
+		scatterWaitConcurrency: DefaultScatterWaitConcurrency,
+		scatterWaitTimeout:     ScatterWaitUpperInterval,
+		backoffPolicy:          utils.DefaultBackoffPolicy,
+	}
+}
+
+// SetBackoffPolicy sets the policy of retrying split, scatter and the region
+// scans. The attempts and the delays of the retries are the constants of
+// them, the policy decides how the delays grow.
+func (rs *RegionSplitter) SetBackoffPolicy(policy utils.BackoffPolicy) {
+	if policy != nil {
+		rs.backoffPolicy = policy
+	}
+}
+
+// SetScatterWait sets the max number of concurrent operator queries and the
+// deadline of waiting for scattering. The deadline is shared by all the
+// regions of a batch rather than counted per region, so waiting for tens of
+// thousands of regions is bounded as well. The non-positive values keep the
+// defaults.
+func (rs *RegionSplitter) SetScatterWait(concurrency int, timeout time.Duration) {
+	if concurrency > 0 {
+		rs.scatterWaitConcurrency = concurrency
+	}
+	if timeout > 0 {
+		rs.scatterWaitTimeout = timeout
+	}
+}
+
+// SetRegionNotFoundGrace sets the duration of tolerating REGION_NOT_FOUND of
+// a scattering region. A new region is unknown to PD until its first
+// heartbeat, so PD reporting REGION_NOT_FOUND for a while is expected. But if
+// it lasts beyond the grace period, the region is likely merged away during
+// the restore, and the region covering it is scattered and waited for
+// instead. The ingesting locates the regions by the keys of the files, so it
+// follows the covering region as well.
+func (rs *RegionSplitter) SetRegionNotFoundGrace(grace time.Duration) {
+	rs.regionNotFoundGrace = grace
+}
+
+// SetRegionHeartbeatInterval derives the polling intervals of waiting for
+// split and scatter from the region heartbeat interval of the cluster. The
+// default intervals suit the default heartbeat interval, they are scaled in
+// proportion to the heartbeat interval, so the splitter neither polls PD in
+// vain on a cluster reporting slowly, nor waits too long on a fast one.
+func (rs *RegionSplitter) SetRegionHeartbeatInterval(heartbeat time.Duration) {
+	if heartbeat <= 0 {
+		return
+	}
+	scale := func(interval, lower, upper time.Duration) time.Duration {
+		scaled := time.Duration(float64(interval) * float64(heartbeat) / float64(defaultRegionHeartbeatInterval))
+		if scaled < lower {
+			return lower
+		}
+		if scaled > upper {
+			return upper
+		}
+		return scaled
+	}
+	rs.splitCheckInterval = scale(SplitCheckInterval, time.Millisecond, 500*time.Millisecond)
+	rs.splitMaxCheckInterval = scale(SplitMaxCheckInterval, 100*time.Millisecond, 10*time.Second)
+	rs.scatterWaitInterval = scale(ScatterWaitInterval, 5*time.Millisecond, 500*time.Millisecond)
+	rs.scatterMaxWaitInterval = scale(ScatterMaxWaitInterval, 100*time.Millisecond, 10*time.Second)
+	rs.scanWaitInterval = scale(ScanRegionConsistencyWaitInterval, 5*time.Millisecond, 500*time.Millisecond)
+	rs.regionHeartbeat = heartbeat
+	log.Info("derived the polling intervals from the region heartbeat interval",
+		zap.Duration("heartbeat", heartbeat),
+		zap.Duration("split-check", rs.splitCheckInterval),
+		zap.Duration("split-max-check", rs.splitMaxCheckInterval),
+		zap.Duration("scatter-wait", rs.scatterWaitInterval),
+		zap.Duration("scatter-max-wait", rs.scatterMaxWaitInterval))
+}
+
+// SetSkipScatter makes the splitter neither scatter the new regions nor wait
+// for scattering. On a cluster with no more stores than the replicas of a
+// region, every store already has a peer of each region, so scattering can
+// never move anything and waiting for it only burns time.
+func (rs *RegionSplitter) SetSkipScatter(skip bool) {
+	rs.skipScatter = skip
+}
+
+// SetKeyCodec sets the codec which encodes the keys of the ranges into the
+// keys of the regions.
+func (rs *RegionSplitter) SetKeyCodec(codec KeyCodec) {
+	rs.codec = codec
+}
+
+// SetRawKVSplitCheck makes the splitter check whether the TiKV can split the
+// regions by the raw keys before splitting. If it can't, e.g. the TiKV older
+// than v5.1.0, the keys are encoded by DefaultKeyCodec instead of the codec
+// set by SetKeyCodec, which is how the regions were split before.
+func (rs *RegionSplitter) SetRawKVSplitCheck(check func(ctx context.Context) error) {
+	rs.rawKVSplitCheck = check
+}
+
+// checkRawKVSplit runs the check set by SetRawKVSplitCheck once.
+func (rs *RegionSplitter) checkRawKVSplit(ctx context.Context) {
+	if rs.rawKVSplitCheck == nil {
+		return
+	}
+	if err := rs.rawKVSplitCheck(ctx); err != nil {
+		log.Warn("TiKV can't split the regions by raw keys, split them by the memcomparable keys",
+			zap.Error(err))
+		rs.codec = DefaultKeyCodec
 	}
+	rs.rawKVSplitCheck = nil
+}
+
+// SetSplitTargetSize makes the splitter coalesce the split keys of the ranges,
+// so that each new region holds about the target size of the data, counted
+// by the files of the ranges in the backupmeta. By default every range and
+// every new key prefix of the rewrite rules is split into a region, which
+// creates a flood of tiny regions when restoring many small tables. With the
+// target size, the adjacent small tables and indexes share a region, see
+// coalesceSplitKeys. Zero disables coalescing.
+func (rs *RegionSplitter) SetSplitTargetSize(size uint64) {
+	rs.splitTargetSize = size
+}
+
+// SetMemoryTracker makes the splitter account the memory of the scanned
+// regions by the tracker.
+func (rs *RegionSplitter) SetMemoryTracker(tracker *MemoryTracker) {
+	rs.memory = tracker
+}
+
+// SetCheckpoint makes the splitter skip the ranges whose end keys have been
+// split according to the checkpoint.
+func (rs *RegionSplitter) SetCheckpoint(cp *SplitCheckpoint) {
+	rs.checkpoint = cp
 }
 
 // OnSplitFunc is called before split a range.
@@ -72,10 +277,43 @@ func (rs *RegionSplitter) Split(
 	rewriteRules *RewriteRules,
 	onSplit OnSplitFunc,
 ) error {
+	startTime := time.Now()
+	scatterRegions, err := rs.split(ctx, ranges, rewriteRules, onSplit, true)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	log.Info("start to wait for scattering regions",
+		zap.Int("regions", len(scatterRegions)), zap.Duration("take", time.Since(startTime)))
+	rs.WaitForScatterRegions(ctx, scatterRegions)
+	return nil
+}
+
+// SplitWithoutScatter is like Split, but it doesn't scatter the new regions.
+// It returns the new regions, so the caller can perform all splits first and
+// scatter them in a single pass afterwards by ScatterRegions, which PD handles
+// more efficiently than scattering interleaved with splitting.
+func (rs *RegionSplitter) SplitWithoutScatter(
+	ctx context.Context,
+	ranges []rtree.Range,
+	rewriteRules *RewriteRules,
+	onSplit OnSplitFunc,
+) ([]*RegionInfo, error) {
+	newRegions, err := rs.split(ctx, ranges, rewriteRules, onSplit, false)
+	return newRegions, errors.Trace(err)
+}
+
+func (rs *RegionSplitter) split(
+	ctx context.Context,
+	ranges []rtree.Range,
+	rewriteRules *RewriteRules,
+	onSplit OnSplitFunc,
+	scatter bool,
+) ([]*RegionInfo, error) {
 	if len(ranges) == 0 {
 		log.Info("skip split regions, no range")
-		return nil
+		return nil, nil
 	}
+	rs.checkRawKVSplit(ctx)
 
 	if span := opentracing.SpanFromContext(ctx); span != nil && span.Tracer() != nil {
 		span1 := span.Tracer().StartSpan("RegionSplitter.Split", opentracing.ChildOf(span.Context()))
@@ -83,14 +321,19 @@ func (rs *RegionSplitter) Split(
 		ctx = opentracing.ContextWithSpan(ctx, span1)
 	}
 
-	startTime := time.Now()
 	// Sort the range for getting the min and max key of the ranges
 	sortedRanges, errSplit := SortRanges(ranges, rewriteRules)
 	if errSplit != nil {
-		return errors.Trace(errSplit)
+		return nil, errors.Trace(errSplit)
+	}
+	if rs.checkpoint != nil {
+		sortedRanges = rs.checkpoint.filterRanges(sortedRanges)
+		if len(sortedRanges) == 0 {
+			return nil, nil
+		}
 	}
-	minKey := codec.EncodeBytes(sortedRanges[0].StartKey)
-	maxKey := codec.EncodeBytes(sortedRanges[len(sortedRanges)-1].EndKey)
+	minKey := rs.codec.EncodeKey(sortedRanges[0].StartKey)
+	maxKey := rs.codec.EncodeKey(sortedRanges[len(sortedRanges)-1].EndKey)
 	for _, rule := range rewriteRules.Data {
 		if bytes.Compare(minKey, rule.GetNewKeyPrefix()) > 0 {
 			minKey = rule.GetNewKeyPrefix()
@@ -107,19 +350,87 @@ func (rs *RegionSplitter) Split(
 			maxKey = rule.GetNewKeyPrefix()
 		}
 	}
-	interval := SplitRetryInterval
+	for _, key := range rewriteRules.SplitKeys {
+		encoded := rs.codec.EncodeKey(key)
+		if bytes.Compare(minKey, encoded) > 0 {
+			minKey = encoded
+		}
+		if bytes.Compare(maxKey, encoded) < 0 {
+			maxKey = encoded
+		}
+	}
+	getKeys := func(regions []*RegionInfo) map[uint64][][]byte {
+		return getSplitKeys(rs.codec, rewriteRules, sortedRanges, regions, rs.splitTargetSize)
+	}
+	return rs.splitRegions(ctx, minKey, maxKey, getKeys, onSplit, scatter, rtree.ZapRanges(ranges))
+}
+
+// SplitByKeys splits the regions by the keys, then scatters the new regions
+// and waits for the scattering. Unlike Split, the keys are used as is without
+// rewriting or sorting, for the callers which have computed the exact split
+// keys. Like the keys of ranges in Split, the keys are encoded by the key
+// codec to locate the regions.
+func (rs *RegionSplitter) SplitByKeys(ctx context.Context, keys [][]byte) error {
+	var minKey, maxKey []byte
+	for _, key := range keys {
+		// The empty key is the max key, which never needs to split.
+		if len(key) == 0 {
+			continue
+		}
+		encoded := rs.codec.EncodeKey(key)
+		if minKey == nil || bytes.Compare(encoded, minKey) < 0 {
+			minKey = encoded
+		}
+		if maxKey == nil || bytes.Compare(encoded, maxKey) > 0 {
+			maxKey = encoded
+		}
+	}
+	if minKey == nil {
+		log.Info("skip split regions, no key")
+		return nil
+	}
+	getKeys := func(regions []*RegionInfo) map[uint64][][]byte {
+		return groupSplitKeys(rs.codec, keys, regions)
+	}
+	startTime := time.Now()
+	scatterRegions, err := rs.splitRegions(ctx, minKey, maxKey, getKeys, func([][]byte) {}, true, logutil.Keys(keys))
+	if err != nil {
+		return errors.Trace(err)
+	}
+	log.Info("start to wait for scattering regions",
+		zap.Int("regions", len(scatterRegions)), zap.Duration("take", time.Since(startTime)))
+	rs.WaitForScatterRegions(ctx, scatterRegions)
+	return nil
+}
+
+// splitRegions splits the regions in [minKey, maxKey] by the keys returned
+// by getKeys, which groups the split keys by the IDs of the scanned regions.
+func (rs *RegionSplitter) splitRegions(
+	ctx context.Context,
+	minKey, maxKey []byte,
+	getKeys func(regions []*RegionInfo) map[uint64][][]byte,
+	onSplit OnSplitFunc,
+	scatter bool,
+	zapKeys zap.Field,
+) ([]*RegionInfo, error) {
+	var errSplit error
+	bo := rs.backoffPolicy.NewBackoffer(SplitRetryTimes, SplitRetryInterval, SplitMaxRetryInterval)
 	scatterRegions := make([]*RegionInfo, 0)
+	releaseRegions := func() {}
+	defer func() { releaseRegions() }()
 SplitRegions:
 	for i := 0; i < SplitRetryTimes; i++ {
-		regions, errScan := PaginateScanRegion(ctx, rs.client, minKey, maxKey, ScanRegionPaginationLimit)
+		regions, errScan := rs.scanRegions(ctx, minKey, maxKey)
 		if errScan != nil {
-			return errors.Trace(errScan)
+			return nil, errors.Trace(errScan)
 		}
+		releaseRegions()
+		releaseRegions = rs.memory.Track(MemoryPhaseRegion, regionsMemSize(regions))
 		if len(regions) == 0 {
 			log.Warn("split regions cannot scan any region")
-			return nil
+			return nil, nil
 		}
-		splitKeyMap := getSplitKeys(rewriteRules, sortedRanges, regions)
+		splitKeyMap := getKeys(regions)
 		regionMap := make(map[uint64]*RegionInfo)
 		for _, region := range regions {
 			regionMap[region.Region.GetId()] = region
@@ -128,31 +439,38 @@ SplitRegions:
 			var newRegions []*RegionInfo
 			region := regionMap[regionID]
 			log.Info("split regions",
-				logutil.Region(region.Region), logutil.Keys(keys), rtree.ZapRanges(ranges))
-			newRegions, errSplit = rs.splitAndScatterRegions(ctx, region, keys)
+				logutil.Region(region.Region), logutil.Keys(keys), zapKeys)
+			start := time.Now()
+			if scatter {
+				newRegions, errSplit = rs.splitAndScatterRegions(ctx, region, keys)
+			} else {
+				newRegions, errSplit = rs.client.BatchSplitRegions(ctx, region, keys)
+			}
+			restoreSplitHistogram.Observe(time.Since(start).Seconds())
 			if errSplit != nil {
-				if strings.Contains(errSplit.Error(), "no valid key") {
+				if isNoValidKeyError(errSplit) {
 					for _, key := range keys {
 						// Region start/end keys are encoded. split_region RPC
 						// requires raw keys (without encoding).
 						log.Error("split regions no valid key",
 							logutil.Key("startKey", region.Region.StartKey),
 							logutil.Key("endKey", region.Region.EndKey),
-							logutil.Key("key", codec.EncodeBytes(key)),
-							rtree.ZapRanges(ranges))
+							logutil.Key("key", rs.codec.EncodeKey(key)),
+							zapKeys)
 					}
-					return errors.Trace(errSplit)
+					return nil, errors.Trace(errSplit)
 				}
-				interval = 2 * interval
-				if interval > SplitMaxRetryInterval {
-					interval = SplitMaxRetryInterval
+				interval := bo.NextBackoff(errSplit)
+				if bo.Attempt() <= 0 {
+					break SplitRegions
 				}
 				time.Sleep(interval)
+				summary.CollectRetry(summary.RetrySplit)
 				log.Warn("split regions failed, retry",
 					zap.Error(errSplit),
 					logutil.Region(region.Region),
 					logutil.Leader(region.Leader),
-					logutil.Keys(keys), rtree.ZapRanges(ranges))
+					logutil.Keys(keys), zapKeys)
 				continue SplitRegions
 			}
 			if len(newRegions) != len(keys) {
@@ -166,19 +484,66 @@ SplitRegions:
 		break
 	}
 	if errSplit != nil {
-		return errors.Trace(errSplit)
+		return nil, errors.Trace(errSplit)
 	}
-	log.Info("start to wait for scattering regions",
-		zap.Int("regions", len(scatterRegions)), zap.Duration("take", time.Since(startTime)))
-	startTime = time.Now()
-	scatterCount := 0
-	for _, region := range scatterRegions {
-		rs.waitForScatterRegion(ctx, region)
-		if time.Since(startTime) > ScatterWaitUpperInterval {
-			break
+	return scatterRegions, nil
+}
+
+// isNoValidKeyError checks whether the split keys are rejected by the region,
+// which is not retryable. The message is checked for the split clients not
+// classifying the error.
+func isNoValidKeyError(err error) bool {
+	return berrors.Is(err, berrors.ErrRestoreSplitNoValidKey) || strings.Contains(err.Error(), "no valid key")
+}
+
+// WaitForScatterRegions waits for the scattering of the regions to finish,
+// it gives up after the deadline set by SetScatterWait. The operators of the pending
+// regions are queried concurrently in rounds, instead of waiting for the
+// regions one by one. The failure domains of the regions are verified
+// afterwards if SetFailureDomainCheck is called, and the leaders of the
+// regions are balanced if SetScatterLeader is called.
+func (rs *RegionSplitter) WaitForScatterRegions(ctx context.Context, scatterRegions []*RegionInfo) {
+	// The leaders are still worth balancing without scattering, since the
+	// stores are equal in number to the replicas at most.
+	if !rs.skipScatter {
+		scatterRegions = rs.waitForScatterRegions(ctx, scatterRegions)
+		if len(rs.failureDomainLabel) > 0 && len(scatterRegions) > 0 && ctx.Err() == nil {
+			rs.verifyFailureDomains(ctx, scatterRegions)
 		}
-		scatterCount++
 	}
+	if rs.scatterLeader && len(scatterRegions) > 0 && ctx.Err() == nil {
+		rs.scatterLeaders(ctx, scatterRegions)
+	}
+}
+
+func (rs *RegionSplitter) waitForScatterRegions(ctx context.Context, scatterRegions []*RegionInfo) []*RegionInfo {
+	startTime := time.Now()
+	pending := scatterRegions
+	bo := rs.backoffPolicy.NewBackoffer(ScatterWaitMaxRetryTimes, rs.scatterWaitInterval, rs.scatterMaxWaitInterval)
+	w := &scatterWaiter{
+		notFoundSince: make(map[uint64]time.Time),
+		replaced:      make(map[uint64]*RegionInfo),
+		coverings:     make(map[uint64]struct{}),
+	}
+	for i := 0; len(pending) > 0; i++ {
+		if i > 0 {
+			remaining := rs.scatterWaitTimeout - time.Since(startTime)
+			wait := bo.NextBackoff(berrors.ErrRestoreSplitFailed)
+			if remaining <= 0 || bo.Attempt() <= 0 {
+				break
+			}
+			if wait > remaining {
+				wait = remaining
+			}
+			select {
+			case <-ctx.Done():
+				return scatterRegions
+			case <-time.After(wait):
+			}
+		}
+		pending = rs.pollScatterRegions(ctx, pending, i, w)
+	}
+	scatterCount := len(scatterRegions) - len(pending)
 	if scatterCount == len(scatterRegions) {
 		log.Info("waiting for scattering regions done",
 			zap.Int("regions", len(scatterRegions)), zap.Duration("take", time.Since(startTime)))
@@ -188,7 +553,135 @@ SplitRegions:
 			zap.Int("regions", len(scatterRegions)),
 			zap.Duration("take", time.Since(startTime)))
 	}
-	return nil
+	return w.resolve(scatterRegions)
+}
+
+// scatterWaiter is the state of waiting for a batch of scattering regions.
+type scatterWaiter struct {
+	// notFoundSince is the time PD starts to report REGION_NOT_FOUND for the
+	// regions.
+	notFoundSince map[uint64]time.Time
+	// replaced are the regions covering the regions merged away, by the IDs
+	// of the merged regions.
+	replaced map[uint64]*RegionInfo
+	// coverings are the IDs of the covering regions being waited for.
+	coverings map[uint64]struct{}
+}
+
+// resolve replaces the merged regions with the regions covering them, the
+// duplicated regions are removed.
+func (w *scatterWaiter) resolve(regions []*RegionInfo) []*RegionInfo {
+	if len(w.replaced) == 0 {
+		return regions
+	}
+	resolved := make([]*RegionInfo, 0, len(regions))
+	seen := make(map[uint64]struct{}, len(regions))
+	for _, region := range regions {
+		for {
+			covering, ok := w.replaced[region.Region.GetId()]
+			if !ok {
+				break
+			}
+			region = covering
+		}
+		if _, ok := seen[region.Region.GetId()]; !ok {
+			seen[region.Region.GetId()] = struct{}{}
+			resolved = append(resolved, region)
+		}
+	}
+	return resolved
+}
+
+type scatterState int
+
+const (
+	scatterRunning scatterState = iota
+	scatterFinished
+	scatterRegionNotFound
+)
+
+// pollScatterRegions queries the operators of the regions with at most
+// rs.scatterWaitConcurrency concurrent requests, and returns the regions whose
+// scattering is not finished.
+func (rs *RegionSplitter) pollScatterRegions(
+	ctx context.Context, regions []*RegionInfo, retry int, w *scatterWaiter,
+) []*RegionInfo {
+	ctx = context.WithValue(ctx, retryTimes, retry)
+	states := make([]scatterState, len(regions))
+	workers := make(chan struct{}, rs.scatterWaitConcurrency)
+	var wg sync.WaitGroup
+	for i, region := range regions {
+		i, region := i, region
+		workers <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-workers
+				wg.Done()
+			}()
+			state, err := rs.isScatterRegionFinished(ctx, region.Region.GetId())
+			if err != nil {
+				log.Warn("scatter region failed: do not have the region",
+					logutil.Region(region.Region), zap.Error(err))
+				// Stop waiting for the region.
+				state = scatterFinished
+			}
+			states[i] = state
+		}()
+	}
+	wg.Wait()
+
+	pending := make([]*RegionInfo, 0, len(regions))
+	for i, region := range regions {
+		switch states[i] {
+		case scatterRunning:
+			pending = append(pending, region)
+		case scatterRegionNotFound:
+			if covering := rs.resolveNotFoundRegion(ctx, region, w); covering != nil {
+				pending = append(pending, covering)
+			}
+		}
+	}
+	return pending
+}
+
+// resolveNotFoundRegion handles a region PD reports REGION_NOT_FOUND for, and
+// returns the region to wait for, or nil if the waiting is done. The region
+// is waited for during the grace period, then if PD still doesn't know the
+// region, the region covering its start key is scattered and waited for.
+func (rs *RegionSplitter) resolveNotFoundRegion(
+	ctx context.Context, region *RegionInfo, w *scatterWaiter,
+) *RegionInfo {
+	regionID := region.Region.GetId()
+	since, ok := w.notFoundSince[regionID]
+	if !ok {
+		w.notFoundSince[regionID] = time.Now()
+		return region
+	}
+	if time.Since(since) < rs.regionNotFoundGrace {
+		return region
+	}
+	delete(w.notFoundSince, regionID)
+	covering, err := rs.client.GetRegion(ctx, region.Region.GetStartKey())
+	if err != nil || covering == nil || covering.Region.GetId() == regionID {
+		// the region isn't merged, it's fine to consider the scattering done.
+		log.Warn("region not found in PD beyond the grace period, stop waiting for it",
+			logutil.Region(region.Region), zap.Duration("grace", rs.regionNotFoundGrace), zap.Error(err))
+		return nil
+	}
+	w.replaced[regionID] = covering
+	if _, ok := w.coverings[covering.Region.GetId()]; ok {
+		return nil
+	}
+	w.coverings[covering.Region.GetId()] = struct{}{}
+	log.Warn("region is merged during restore, scatter the region covering it instead",
+		logutil.Region(region.Region), zap.Uint64("covering-region", covering.Region.GetId()))
+	summary.CollectInt("merged regions during scatter", 1)
+	if err := rs.client.ScatterRegion(ctx, covering); err != nil {
+		log.Warn("failed to scatter the covering region", logutil.Region(covering.Region), zap.Error(err))
+		return nil
+	}
+	return covering
 }
 
 func (rs *RegionSplitter) hasRegion(ctx context.Context, regionID uint64) (bool, error) {
@@ -199,17 +692,20 @@ func (rs *RegionSplitter) hasRegion(ctx context.Context, regionID uint64) (bool,
 	return regionInfo != nil, nil
 }
 
-func (rs *RegionSplitter) isScatterRegionFinished(ctx context.Context, regionID uint64) (bool, error) {
+func (rs *RegionSplitter) isScatterRegionFinished(ctx context.Context, regionID uint64) (scatterState, error) {
 	resp, err := rs.client.GetOperator(ctx, regionID)
 	if err != nil {
-		return false, errors.Trace(err)
+		return scatterRunning, errors.Trace(err)
 	}
 	// Heartbeat may not be sent to PD
 	if respErr := resp.GetHeader().GetError(); respErr != nil {
 		if respErr.GetType() == pdpb.ErrorType_REGION_NOT_FOUND {
-			return true, nil
+			if rs.regionNotFoundGrace <= 0 {
+				return scatterFinished, nil
+			}
+			return scatterRegionNotFound, nil
 		}
-		return false, errors.Annotatef(berrors.ErrPDInvalidResponse, "get operator error: %s", respErr.GetType())
+		return scatterRunning, errors.Annotatef(berrors.ErrPDInvalidResponse, "get operator error: %s", respErr.GetType())
 	}
 	retryTimes := ctx.Value(retryTimes).(int)
 	if retryTimes > 3 {
@@ -217,12 +713,31 @@ func (rs *RegionSplitter) isScatterRegionFinished(ctx context.Context, regionID
 	}
 	// If the current operator of the region is not 'scatter-region', we could assume
 	// that 'scatter-operator' has finished or timeout
-	ok := string(resp.GetDesc()) != "scatter-region" || resp.GetStatus() != pdpb.OperatorStatus_RUNNING
-	return ok, nil
+	if string(resp.GetDesc()) != "scatter-region" || resp.GetStatus() != pdpb.OperatorStatus_RUNNING {
+		return scatterFinished, nil
+	}
+	return scatterRunning, nil
+}
+
+// unscatteredRegions returns the regions whose latest operator isn't a
+// scatter, which PD failed to scatter in the batch. PD only reports the
+// percentage of the scattered regions rather than which ones failed. A region
+// PD decided not to move has no scatter operator either, and scattering it
+// again is harmless.
+func (rs *RegionSplitter) unscatteredRegions(ctx context.Context, regions []*RegionInfo) []*RegionInfo {
+	unscattered := make([]*RegionInfo, 0, len(regions))
+	for _, region := range regions {
+		resp, err := rs.client.GetOperator(ctx, region.Region.GetId())
+		if err == nil && resp.GetHeader().GetError() == nil && string(resp.GetDesc()) == "scatter-region" {
+			continue
+		}
+		unscattered = append(unscattered, region)
+	}
+	return unscattered
 }
 
 func (rs *RegionSplitter) waitForSplit(ctx context.Context, regionID uint64) {
-	interval := SplitCheckInterval
+	interval := rs.splitCheckInterval
 	for i := 0; i < SplitCheckMaxRetryTimes; i++ {
 		ok, err := rs.hasRegion(ctx, regionID)
 		if err != nil {
@@ -233,8 +748,8 @@ func (rs *RegionSplitter) waitForSplit(ctx context.Context, regionID uint64) {
 			break
 		}
 		interval = 2 * interval
-		if interval > SplitMaxCheckInterval {
-			interval = SplitMaxCheckInterval
+		if interval > rs.splitMaxCheckInterval {
+			interval = rs.splitMaxCheckInterval
 		}
 		time.Sleep(interval)
 	}
@@ -244,28 +759,6 @@ type retryTimeKey struct{}
 
 var retryTimes = new(retryTimeKey)
 
-func (rs *RegionSplitter) waitForScatterRegion(ctx context.Context, regionInfo *RegionInfo) {
-	interval := ScatterWaitInterval
-	regionID := regionInfo.Region.GetId()
-	for i := 0; i < ScatterWaitMaxRetryTimes; i++ {
-		ctx1 := context.WithValue(ctx, retryTimes, i)
-		ok, err := rs.isScatterRegionFinished(ctx1, regionID)
-		if err != nil {
-			log.Warn("scatter region failed: do not have the region",
-				logutil.Region(regionInfo.Region))
-			return
-		}
-		if ok {
-			break
-		}
-		interval = 2 * interval
-		if interval > ScatterMaxWaitInterval {
-			interval = ScatterMaxWaitInterval
-		}
-		time.Sleep(interval)
-	}
-}
-
 func (rs *RegionSplitter) splitAndScatterRegions(
 	ctx context.Context, regionInfo *RegionInfo, keys [][]byte,
 ) ([]*RegionInfo, error) {
@@ -277,17 +770,69 @@ func (rs *RegionSplitter) splitAndScatterRegions(
 	return newRegions, nil
 }
 
-// ScatterRegions scatter the regions.
+// ScatterRange scatters the regions in the range of the keys before encoding,
+// and waits for them to be scattered. The empty keys are unbounded. It
+// returns the number of the regions.
+func (rs *RegionSplitter) ScatterRange(ctx context.Context, startKey, endKey []byte) (int, error) {
+	var start, end []byte
+	if len(startKey) > 0 {
+		start = rs.codec.EncodeKey(startKey)
+	}
+	if len(endKey) > 0 {
+		end = rs.codec.EncodeKey(endKey)
+	}
+	regions, err := PaginateScanRegion(ctx, rs.client, start, end, ScanRegionPaginationLimit)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	log.Info("start to scatter the regions in range",
+		logutil.Key("startKey", startKey), logutil.Key("endKey", endKey), zap.Int("regions", len(regions)))
+	rs.ScatterRegions(ctx, regions)
+	rs.WaitForScatterRegions(ctx, regions)
+	return len(regions), errors.Trace(ctx.Err())
+}
+
+// ScatterRegions scatter the regions. The regions are scattered in one
+// request if PD supports it, otherwise they are scattered one by one. If PD
+// scatters only part of the batch, the regions not being scattered are
+// scattered again one by one.
 func (rs *RegionSplitter) ScatterRegions(ctx context.Context, newRegions []*RegionInfo) {
+	if rs.skipScatter {
+		return
+	}
 	for _, region := range newRegions {
 		// Wait for a while until the regions successfully split.
 		rs.waitForSplit(ctx, region.Region.Id)
+	}
+	if len(newRegions) > 1 && atomic.LoadInt32(&rs.batchScatterUnsupported) == 0 {
+		err := utils.WithRetry(ctx,
+			func() error { return rs.client.ScatterRegions(ctx, newRegions) },
+			&scatterBackoffer{
+				Backoffer: rs.backoffPolicy.NewBackoffer(
+					ScatterRetryTimes, ScatterRetryInterval, ScatterMaxRetryInterval),
+			},
+		)
+		switch {
+		case err == nil:
+			return
+		case berrors.Is(err, berrors.ErrPDBatchScatter):
+			log.Warn("PD doesn't support scattering regions in batch, scatter them one by one", zap.Error(err))
+			atomic.StoreInt32(&rs.batchScatterUnsupported, 1)
+		case berrors.Is(err, berrors.ErrPDScatterPartial):
+			newRegions = rs.unscatteredRegions(ctx, newRegions)
+			log.Warn("PD scattered part of the regions, scatter the rest one by one",
+				zap.Int("rest", len(newRegions)), zap.Error(err))
+		default:
+			log.Warn("failed to scatter regions in batch, scatter them one by one",
+				zap.Int("regions", len(newRegions)), zap.Error(err))
+		}
+	}
+	for _, region := range newRegions {
 		if err := utils.WithRetry(ctx,
 			func() error { return rs.client.ScatterRegion(ctx, region) },
-			// backoff about 6s, or we give up scattering this region.
 			&scatterBackoffer{
-				attempt:     7,
-				baseBackoff: 100 * time.Millisecond,
+				Backoffer: rs.backoffPolicy.NewBackoffer(
+					ScatterRetryTimes, ScatterRetryInterval, ScatterMaxRetryInterval),
 			},
 		); err != nil {
 			log.Warn("scatter region failed, stop retry", logutil.Region(region.Region), zap.Error(err))
@@ -327,19 +872,161 @@ func PaginateScanRegion(
 	return regions, nil
 }
 
-// getSplitKeys checks if the regions should be split by the new prefix of the rewrites rule and the end key of
-// the ranges, groups the split keys by region id.
-func getSplitKeys(rewriteRules *RewriteRules, ranges []rtree.Range, regions []*RegionInfo) map[uint64][][]byte {
-	splitKeyMap := make(map[uint64][][]byte)
+// RegionGaps returns the spans in [startKey, endKey) where the regions are
+// inconsistent: the holes not covered by any region, and the overlaps of the
+// regions. The regions must be sorted by the start keys, as scanned from PD.
+func RegionGaps(startKey, endKey []byte, regions []*RegionInfo) []Range {
+	gaps := make([]Range, 0)
+	cur := startKey
+	for _, region := range regions {
+		regionStart := region.Region.GetStartKey()
+		switch cmp := bytes.Compare(regionStart, cur); {
+		case cmp > 0:
+			gaps = append(gaps, Range{Start: cur, End: regionStart})
+		case cmp < 0 && region != regions[0]:
+			gaps = append(gaps, Range{Start: regionStart, End: cur})
+		}
+		cur = region.Region.GetEndKey()
+		if len(cur) == 0 {
+			return gaps
+		}
+	}
+	if len(endKey) == 0 || bytes.Compare(cur, endKey) < 0 {
+		gaps = append(gaps, Range{Start: cur, End: endKey})
+	}
+	return gaps
+}
+
+// scanRegions scans the regions in [startKey, endKey) and checks that they are
+// consistent. After a burst of splits, PD only learns the new regions from
+// their heartbeats, so the scanned regions may have holes for a while. Rather
+// than retrying blindly, it asks PD for the regions of the gaps: if PD has
+// received their heartbeats the scan is retried at once, otherwise it waits in
+// proportion to the number of the pending gaps, but never longer than a
+// region heartbeat interval, in which every region reports itself.
+func (rs *RegionSplitter) scanRegions(ctx context.Context, startKey, endKey []byte) ([]*RegionInfo, error) {
+	var gaps []Range
+	scans := 0
+	bo := rs.backoffPolicy.NewBackoffer(ScanRegionConsistencyRetryTimes, rs.scanWaitInterval, rs.regionHeartbeat)
+	for bo.Attempt() > 0 {
+		scans++
+		regions, err := PaginateScanRegion(ctx, rs.client, startKey, endKey, ScanRegionPaginationLimit)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		if len(regions) == 0 {
+			return regions, nil
+		}
+		gaps = RegionGaps(startKey, endKey, regions)
+		if len(gaps) == 0 {
+			return regions, nil
+		}
+		pending := rs.pendingGaps(ctx, gaps)
+		wait := bo.NextBackoff(berrors.ErrPDBatchScanRegion) * time.Duration(pending)
+		// The policy may give up before the attempts run out, e.g. once its
+		// budget is spent, then rescanning at once would only hammer PD.
+		if bo.Attempt() <= 0 {
+			break
+		}
+		if wait > rs.regionHeartbeat {
+			wait = rs.regionHeartbeat
+		}
+		log.Warn("scanned regions are inconsistent, wait for the region heartbeats",
+			zap.Int("gaps", len(gaps)),
+			zap.Int("pending", pending),
+			logutil.Key("first-gap-start", gaps[0].Start),
+			logutil.Key("first-gap-end", gaps[0].End),
+			zap.Duration("wait", wait))
+		if wait > 0 {
+			select {
+			case <-ctx.Done():
+				return nil, errors.Trace(ctx.Err())
+			case <-time.After(wait):
+			}
+		}
+	}
+	return nil, errors.Annotatef(berrors.ErrPDBatchScanRegion,
+		"%d inconsistent spans in [%s, %s) after %d scans, the first is [%s, %s)",
+		len(gaps), hex.EncodeToString(startKey), hex.EncodeToString(endKey), scans,
+		hex.EncodeToString(gaps[0].Start), hex.EncodeToString(gaps[0].End))
+}
+
+// pendingGaps returns the number of the gaps whose regions haven't been
+// reported to PD yet. The gaps beyond the first few are considered pending
+// without asking PD.
+func (rs *RegionSplitter) pendingGaps(ctx context.Context, gaps []Range) int {
+	pending := 0
+	for i, gap := range gaps {
+		if i >= scanRegionMaxProbes {
+			pending += len(gaps) - i
+			break
+		}
+		region, err := rs.client.GetRegion(ctx, gap.Start)
+		reported := err == nil && region != nil &&
+			(bytes.Equal(region.Region.GetStartKey(), gap.Start) || region.ContainsInterior(gap.Start))
+		if !reported {
+			pending++
+		}
+	}
+	return pending
+}
+
+// getSplitKeys checks if the regions should be split by the new prefix of the rewrites rule, the extra split
+// keys of the rules (e.g. partition boundaries) and the end key of the ranges, groups the split keys by region id.
+// If targetSize is positive, the keys are coalesced by coalesceSplitKeys.
+func getSplitKeys(
+	keyCodec KeyCodec, rewriteRules *RewriteRules, ranges []rtree.Range, regions []*RegionInfo, targetSize uint64,
+) map[uint64][][]byte {
 	checkKeys := make([][]byte, 0)
 	for _, rule := range rewriteRules.Data {
 		checkKeys = append(checkKeys, rule.GetNewKeyPrefix())
 	}
-	for _, rg := range ranges {
-		checkKeys = append(checkKeys, rg.EndKey)
+	checkKeys = append(checkKeys, rewriteRules.SplitKeys...)
+	if targetSize == 0 {
+		for _, rg := range ranges {
+			checkKeys = append(checkKeys, rg.EndKey)
+		}
+		return groupSplitKeys(keyCodec, checkKeys, regions)
+	}
+	keys := coalesceSplitKeys(ranges, checkKeys, targetSize)
+	log.Info("coalesce the split keys of the ranges",
+		zap.Int("ranges", len(ranges)), zap.Int("boundaries", len(checkKeys)),
+		zap.Int("keys", len(keys)), zap.Uint64("target-size", targetSize))
+	return groupSplitKeys(keyCodec, keys, regions)
+}
+
+// coalesceSplitKeys returns the keys to split the sorted ranges at, so that
+// the ranges between two split keys hold about targetSize bytes. The sizes
+// are accumulated over the consecutive ranges across the boundaries, i.e. the
+// record and index prefixes of the tables and the partition boundaries, so
+// the adjacent small tables and indexes share a region. Only the lowest
+// boundary is kept, which separates the restored data from the keys before
+// it. The end key of the last range is always returned.
+func coalesceSplitKeys(ranges []rtree.Range, boundaries [][]byte, targetSize uint64) [][]byte {
+	keys := make([][]byte, 0)
+	for _, boundary := range boundaries {
+		if len(keys) == 0 || bytes.Compare(boundary, keys[0]) < 0 {
+			keys = append(keys[:0], boundary)
+		}
+	}
+	var size uint64
+	for i := range ranges {
+		rangeSize, _ := ranges[i].BytesAndKeys()
+		size += rangeSize
+		if i == len(ranges)-1 || size >= targetSize {
+			keys = append(keys, ranges[i].EndKey)
+			size = 0
+		}
 	}
+	return keys
+}
+
+// groupSplitKeys groups the keys which need to split by the region ids.
+func groupSplitKeys(keyCodec KeyCodec, checkKeys [][]byte, regions []*RegionInfo) map[uint64][][]byte {
+	splitKeyMap := make(map[uint64][][]byte)
+	index := newRegionIndex(regions)
 	for _, key := range checkKeys {
-		if region := NeedSplit(key, regions); region != nil {
+		if region := index.needSplit(keyCodec, key); region != nil {
 			splitKeys, ok := splitKeyMap[region.Region.GetId()]
 			if !ok {
 				splitKeys = make([][]byte, 0, 1)
@@ -356,20 +1043,51 @@ func getSplitKeys(rewriteRules *RewriteRules, ranges []rtree.Range, regions []*R
 
 // NeedSplit checks whether a key is necessary to split, if true returns the split region.
 func NeedSplit(splitKey []byte, regions []*RegionInfo) *RegionInfo {
+	return newRegionIndex(regions).needSplit(DefaultKeyCodec, splitKey)
+}
+
+// regionIndex finds the region containing a key by binary search over the
+// start keys of the regions, so planning the splits costs
+// O(keys * log(regions)) rather than O(keys * regions).
+type regionIndex struct {
+	// regions are sorted by the start key.
+	regions []*RegionInfo
+}
+
+func newRegionIndex(regions []*RegionInfo) regionIndex {
+	less := func(rs []*RegionInfo) func(i, j int) bool {
+		return func(i, j int) bool {
+			return bytes.Compare(rs[i].Region.GetStartKey(), rs[j].Region.GetStartKey()) < 0
+		}
+	}
+	// The scanned regions are sorted already, don't copy them then.
+	if !sort.SliceIsSorted(regions, less(regions)) {
+		sorted := append(make([]*RegionInfo, 0, len(regions)), regions...)
+		sort.SliceStable(sorted, less(sorted))
+		regions = sorted
+	}
+	return regionIndex{regions: regions}
+}
+
+// needSplit returns the region which contains the split key in its interior,
+// or nil if the key is the max key, a boundary of the regions, or out of the
+// regions.
+func (idx regionIndex) needSplit(keyCodec KeyCodec, splitKey []byte) *RegionInfo {
 	// If splitKey is the max key.
 	if len(splitKey) == 0 {
 		return nil
 	}
-	splitKey = codec.EncodeBytes(splitKey)
-	for _, region := range regions {
-		// If splitKey is the boundary of the region
-		if bytes.Equal(splitKey, region.Region.GetStartKey()) {
-			return nil
-		}
-		// If splitKey is in a region
-		if region.ContainsInterior(splitKey) {
-			return region
-		}
+	splitKey = keyCodec.EncodeKey(splitKey)
+	// The last region whose start key is not greater than the split key is the
+	// only one which may contain it.
+	i := sort.Search(len(idx.regions), func(i int) bool {
+		return bytes.Compare(idx.regions[i].Region.GetStartKey(), splitKey) > 0
+	})
+	if i == 0 {
+		return nil
+	}
+	if region := idx.regions[i-1]; region.ContainsInterior(splitKey) {
+		return region
 	}
 	return nil
 }
@@ -0,0 +1,128 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package restore
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+
+	"github.com/pingcap/br/pkg/rtree"
+	"github.com/pingcap/br/pkg/storage"
+)
+
+const (
+	// SplitCheckpointFile is the name of the split checkpoint file.
+	SplitCheckpointFile = "split.checkpoint"
+
+	// splitCheckpointFlushKeys is the number of new split keys that triggers
+	// persisting the checkpoint.
+	splitCheckpointFlushKeys = 4096
+)
+
+// splitCheckpointContent is the content of the split checkpoint file.
+type splitCheckpointContent struct {
+	Keys [][]byte `json:"keys"`
+}
+
+// SplitCheckpoint records the split keys in the external storage, so a
+// resumed restore can skip the ranges that have been split. Skipping a split
+// only affects the performance, so the checkpoint is persisted in best-effort.
+type SplitCheckpoint struct {
+	storage storage.ExternalStorage
+
+	mu      sync.Mutex
+	keys    map[string]struct{}
+	pending int
+}
+
+// NewSplitCheckpoint creates a SplitCheckpoint in the storage, the split keys
+// persisted by the previous run are loaded.
+func NewSplitCheckpoint(ctx context.Context, s storage.ExternalStorage) (*SplitCheckpoint, error) {
+	cp := &SplitCheckpoint{storage: s, keys: make(map[string]struct{})}
+	exists, err := s.FileExists(ctx, SplitCheckpointFile)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if !exists {
+		return cp, nil
+	}
+	data, err := s.ReadFile(ctx, SplitCheckpointFile)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	content := splitCheckpointContent{}
+	if err = json.Unmarshal(data, &content); err != nil {
+		return nil, errors.Annotatef(err, "invalid split checkpoint %s", SplitCheckpointFile)
+	}
+	for _, key := range content.Keys {
+		cp.keys[string(key)] = struct{}{}
+	}
+	log.Info("load split checkpoint", zap.Int("keys", len(cp.keys)))
+	return cp, nil
+}
+
+// IsSplit checks whether the key has been split.
+func (cp *SplitCheckpoint) IsSplit(key []byte) bool {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	_, ok := cp.keys[string(key)]
+	return ok
+}
+
+// filterRanges removes the ranges whose end keys have been split. The key
+// ranges must have been rewritten.
+func (cp *SplitCheckpoint) filterRanges(ranges []rtree.Range) []rtree.Range {
+	remain := make([]rtree.Range, 0, len(ranges))
+	for _, rg := range ranges {
+		if !cp.IsSplit(rg.EndKey) {
+			remain = append(remain, rg)
+		}
+	}
+	if skipped := len(ranges) - len(remain); skipped > 0 {
+		log.Info("skip split ranges in checkpoint", zap.Int("skipped", skipped), zap.Int("remain", len(remain)))
+	}
+	return remain
+}
+
+// OnSplit returns an OnSplitFunc which records the split keys in the
+// checkpoint, then calls `next`.
+func (cp *SplitCheckpoint) OnSplit(ctx context.Context, next OnSplitFunc) OnSplitFunc {
+	return func(keys [][]byte) {
+		cp.mu.Lock()
+		for _, key := range keys {
+			cp.keys[string(key)] = struct{}{}
+		}
+		cp.pending += len(keys)
+		flush := cp.pending >= splitCheckpointFlushKeys
+		cp.mu.Unlock()
+
+		if flush {
+			if err := cp.Flush(ctx); err != nil {
+				log.Warn("failed to persist split checkpoint", zap.Error(err))
+			}
+		}
+		next(keys)
+	}
+}
+
+// Flush persists the split keys.
+func (cp *SplitCheckpoint) Flush(ctx context.Context) error {
+	cp.mu.Lock()
+	content := splitCheckpointContent{Keys: make([][]byte, 0, len(cp.keys))}
+	for key := range cp.keys {
+		content.Keys = append(content.Keys, []byte(key))
+	}
+	cp.pending = 0
+	cp.mu.Unlock()
+
+	data, err := json.Marshal(&content)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(cp.storage.WriteFile(ctx, SplitCheckpointFile, data))
+}
@@ -16,6 +16,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/docker/go-units"
 	"github.com/pingcap/errors"
 	"github.com/pingcap/failpoint"
 	"github.com/pingcap/kvproto/pkg/errorpb"
@@ -29,12 +30,13 @@ import (
 	"go.uber.org/multierr"
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/status"
 
 	berrors "github.com/pingcap/br/pkg/errors"
 	"github.com/pingcap/br/pkg/httputil"
 	"github.com/pingcap/br/pkg/logutil"
+	"github.com/pingcap/br/pkg/summary"
+	"github.com/pingcap/br/pkg/utils"
 )
 
 const (
@@ -59,6 +61,13 @@ type SplitClient interface {
 	BatchSplitRegionsWithOrigin(ctx context.Context, regionInfo *RegionInfo, keys [][]byte) (*RegionInfo, []*RegionInfo, error)
 	// ScatterRegion scatters a specified region.
 	ScatterRegion(ctx context.Context, regionInfo *RegionInfo) error
+	// ScatterRegions scatters the regions in one request. It returns
+	// ErrPDBatchScatter if PD doesn't support it, and ErrPDScatterPartial if
+	// only part of the regions are scattered.
+	ScatterRegions(ctx context.Context, regionInfos []*RegionInfo) error
+	// TransferLeader transfers the leader of the region to the store, which
+	// must have a voter of the region.
+	TransferLeader(ctx context.Context, regionID, toStoreID uint64) error
 	// GetOperator gets the status of operator of the specified region.
 	GetOperator(ctx context.Context, regionID uint64) (*pdpb.GetOperatorResponse, error)
 	// ScanRegion gets a list of regions, starts from the region that contains key.
@@ -73,6 +82,13 @@ type SplitClient interface {
 	// SetStoreLabel add or update specified label of stores. If labelValue
 	// is empty, it clears the label.
 	SetStoresLabel(ctx context.Context, stores []uint64, labelKey, labelValue string) error
+	// GetRegionApproximateSize gets the approximate size in bytes of the
+	// region reported to PD.
+	GetRegionApproximateSize(ctx context.Context, regionID uint64) (uint64, error)
+	// SplitRegionByApproximateSize asks PD to split the region into halves by
+	// the approximate size, which TiKV computes from the SST properties
+	// rather than by the given keys.
+	SplitRegionByApproximateSize(ctx context.Context, regionID uint64) error
 }
 
 // pdClient is a wrapper of pd client, can be used by RegionSplitter.
@@ -80,15 +96,31 @@ type pdClient struct {
 	mu         sync.Mutex
 	client     pd.Client
 	tlsConf    *tls.Config
+	pdTLSConf  *tls.Config
 	storeCache map[uint64]*metapb.Store
+	// addressMap translates the advertised addresses of the stores when
+	// dialing them for splitting, see ParseStoreAddressMap.
+	addressMap map[string]string
 }
 
 // NewSplitClient returns a client used by RegionSplitter.
 func NewSplitClient(client pd.Client, tlsConf *tls.Config) SplitClient {
+	return NewSplitClientWithPDTLS(client, tlsConf, tlsConf)
+}
+
+// NewSplitClientWithPDTLS returns a client used by RegionSplitter, which
+// connects to TiKV with tlsConf and to the HTTP API of PD with pdTLSConf.
+func NewSplitClientWithPDTLS(client pd.Client, tlsConf, pdTLSConf *tls.Config) SplitClient {
+	return newPDSplitClient(client, tlsConf, pdTLSConf, nil)
+}
+
+func newPDSplitClient(client pd.Client, tlsConf, pdTLSConf *tls.Config, addressMap map[string]string) *pdClient {
 	return &pdClient{
 		client:     client,
 		tlsConf:    tlsConf,
+		pdTLSConf:  pdTLSConf,
 		storeCache: make(map[uint64]*metapb.Store),
+		addressMap: addressMap,
 	}
 }
 
@@ -150,7 +182,8 @@ func (c *pdClient) SplitRegion(ctx context.Context, regionInfo *RegionInfo, key
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
-	conn, err := grpc.Dial(store.GetAddress(), grpc.WithInsecure())
+	addr, tlsConf := storeDialTarget(storeID, store.GetAddress(), c.addressMap, c.tlsConf)
+	conn, err := grpc.Dial(addr, transportOption(tlsConf))
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
@@ -250,6 +283,11 @@ func (c *pdClient) sendSplitRegionRequest(
 	ctx context.Context, regionInfo *RegionInfo, keys [][]byte,
 ) (*kvrpcpb.SplitRegionResponse, error) {
 	var splitErrors error
+	var storeID uint64
+	withRegion := func(err error) error {
+		return berrors.WithRegion(err, regionInfo.Region.GetId(),
+			regionInfo.Region.GetStartKey(), regionInfo.Region.GetEndKey(), storeID)
+	}
 	for i := 0; i < splitRegionMaxRetryTime; i++ {
 		var peer *metapb.Peer
 		// scanRegions may return empty Leader in https://github.com/tikv/pd/blob/v4.0.8/server/grpc_service.go#L524
@@ -263,16 +301,13 @@ func (c *pdClient) sendSplitRegionRequest(
 			}
 			peer = regionInfo.Region.Peers[0]
 		}
-		storeID := peer.GetStoreId()
+		storeID = peer.GetStoreId()
 		store, err := c.GetStore(ctx, storeID)
 		if err != nil {
 			return nil, multierr.Append(splitErrors, err)
 		}
-		opt := grpc.WithInsecure()
-		if c.tlsConf != nil {
-			opt = grpc.WithTransportCredentials(credentials.NewTLS(c.tlsConf))
-		}
-		conn, err := grpc.Dial(store.GetAddress(), opt)
+		addr, tlsConf := storeDialTarget(storeID, store.GetAddress(), c.addressMap, c.tlsConf)
+		conn, err := grpc.Dial(addr, transportOption(tlsConf))
 		if err != nil {
 			return nil, multierr.Append(splitErrors, err)
 		}
@@ -286,8 +321,12 @@ func (c *pdClient) sendSplitRegionRequest(
 			log.Error("fail to split region",
 				logutil.Region(regionInfo.Region),
 				zap.Stringer("regionErr", resp.RegionError))
+			splitErr := berrors.ErrRestoreSplitFailed
+			if strings.Contains(resp.RegionError.GetMessage(), "no valid key") {
+				splitErr = berrors.ErrRestoreSplitNoValidKey
+			}
 			splitErrors = multierr.Append(splitErrors,
-				errors.Annotatef(berrors.ErrRestoreSplitFailed, "split region failed: err=%v", resp.RegionError))
+				errors.Annotatef(splitErr, "split region failed: err=%v", resp.RegionError))
 			if nl := resp.RegionError.NotLeader; nl != nil {
 				if leader := nl.GetLeader(); leader != nil {
 					regionInfo.Leader = leader
@@ -322,11 +361,11 @@ func (c *pdClient) sendSplitRegionRequest(
 				)
 				continue
 			}
-			return nil, errors.Trace(splitErrors)
+			return nil, withRegion(errors.Trace(splitErrors))
 		}
 		return resp, nil
 	}
-	return nil, errors.Trace(splitErrors)
+	return nil, withRegion(errors.Trace(splitErrors))
 }
 
 func (c *pdClient) BatchSplitRegionsWithOrigin(
@@ -379,6 +418,54 @@ func (c *pdClient) ScatterRegion(ctx context.Context, regionInfo *RegionInfo) er
 	return c.client.ScatterRegion(ctx, regionInfo.Region.GetId())
 }
 
+func (c *pdClient) ScatterRegions(ctx context.Context, regionInfos []*RegionInfo) error {
+	regionIDs := make([]uint64, 0, len(regionInfos))
+	for _, region := range regionInfos {
+		regionIDs = append(regionIDs, region.Region.GetId())
+	}
+	resp, err := c.client.ScatterRegions(ctx, regionIDs)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if pbErr := resp.GetHeader().GetError(); pbErr.GetType() != pdpb.ErrorType_OK {
+		// The batch is sent by the same RPC as a single region, and the older
+		// PD ignores the IDs of the batch and looks up the region 0 instead.
+		if pbErr.GetType() == pdpb.ErrorType_REGION_NOT_FOUND {
+			return errors.Annotate(berrors.ErrPDBatchScatter, pbErr.GetMessage())
+		}
+		return errors.Annotatef(berrors.ErrPDInvalidResponse,
+			"failed to scatter %d regions: %s", len(regionIDs), pbErr.GetMessage())
+	}
+	if finished := resp.GetFinishedPercentage(); finished < 100 {
+		return errors.Annotatef(berrors.ErrPDScatterPartial,
+			"%d%% of %d regions are scattered", finished, len(regionIDs))
+	}
+	return nil
+}
+
+func (c *pdClient) TransferLeader(ctx context.Context, regionID, toStoreID uint64) error {
+	addr := c.getPDAPIAddr()
+	if addr == "" {
+		return errors.Annotate(berrors.ErrPDLeaderNotFound, "failed to transfer leader")
+	}
+	b := []byte(fmt.Sprintf(`{"name": "transfer-leader", "region_id": %d, "to_store_id": %d}`, regionID, toStoreID))
+	req, err := http.NewRequestWithContext(ctx, "POST", addr+path.Join("/pd/api/v1/operators"), bytes.NewReader(b))
+	if err != nil {
+		return errors.Trace(err)
+	}
+	res, err := httputil.NewClient(c.pdTLSConf).Do(req)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(res.Body)
+		return errors.Annotatef(berrors.ErrPDInvalidResponse,
+			"failed to transfer leader of region %d to store %d: [%d] %s", regionID, toStoreID, res.StatusCode, msg)
+	}
+	return nil
+}
+
 func (c *pdClient) GetOperator(ctx context.Context, regionID uint64) (*pdpb.GetOperatorResponse, error) {
 	return c.client.GetOperator(ctx, regionID)
 }
@@ -408,7 +495,7 @@ func (c *pdClient) GetPlacementRule(ctx context.Context, groupID, ruleID string)
 	if err != nil {
 		return rule, errors.Trace(err)
 	}
-	res, err := httputil.NewClient(c.tlsConf).Do(req)
+	res, err := httputil.NewClient(c.pdTLSConf).Do(req)
 	if err != nil {
 		return rule, errors.Trace(err)
 	}
@@ -434,7 +521,7 @@ func (c *pdClient) SetPlacementRule(ctx context.Context, rule placement.Rule) er
 	if err != nil {
 		return errors.Trace(err)
 	}
-	res, err := httputil.NewClient(c.tlsConf).Do(req)
+	res, err := httputil.NewClient(c.pdTLSConf).Do(req)
 	if err != nil {
 		return errors.Trace(err)
 	}
@@ -450,7 +537,7 @@ func (c *pdClient) DeletePlacementRule(ctx context.Context, groupID, ruleID stri
 	if err != nil {
 		return errors.Trace(err)
 	}
-	res, err := httputil.NewClient(c.tlsConf).Do(req)
+	res, err := httputil.NewClient(c.pdTLSConf).Do(req)
 	if err != nil {
 		return errors.Trace(err)
 	}
@@ -465,7 +552,7 @@ func (c *pdClient) SetStoresLabel(
 	if addr == "" {
 		return errors.Annotate(berrors.ErrPDLeaderNotFound, "failed to add stores labels")
 	}
-	httpCli := httputil.NewClient(c.tlsConf)
+	httpCli := httputil.NewClient(c.pdTLSConf)
 	for _, id := range stores {
 		req, err := http.NewRequestWithContext(
 			ctx, "POST",
@@ -487,6 +574,67 @@ func (c *pdClient) SetStoresLabel(
 	return nil
 }
 
+func (c *pdClient) GetRegionApproximateSize(ctx context.Context, regionID uint64) (uint64, error) {
+	addr := c.getPDAPIAddr()
+	if addr == "" {
+		return 0, errors.Annotate(berrors.ErrPDLeaderNotFound, "failed to get the region size")
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s/pd/api/v1/region/id/%d", addr, regionID), nil)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	res, err := httputil.NewClient(c.pdTLSConf).Do(req)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	defer res.Body.Close()
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	if res.StatusCode != http.StatusOK {
+		return 0, errors.Annotatef(berrors.ErrPDInvalidResponse, "[%d] %s", res.StatusCode, b)
+	}
+	// PD reports the approximate size in MiB.
+	var region struct {
+		ApproximateSize int64 `json:"approximate_size"`
+	}
+	if err = json.Unmarshal(b, &region); err != nil {
+		return 0, errors.Trace(err)
+	}
+	if region.ApproximateSize <= 0 {
+		return 0, nil
+	}
+	return uint64(region.ApproximateSize) * units.MiB, nil
+}
+
+func (c *pdClient) SplitRegionByApproximateSize(ctx context.Context, regionID uint64) error {
+	addr := c.getPDAPIAddr()
+	if addr == "" {
+		return errors.Annotate(berrors.ErrPDLeaderNotFound, "failed to split the region by size")
+	}
+	m, _ := json.Marshal(map[string]interface{}{
+		"name":      "split-region",
+		"region_id": regionID,
+		"policy":    "approximate",
+	})
+	req, err := http.NewRequestWithContext(ctx, "POST", addr+"/pd/api/v1/operators", bytes.NewReader(m))
+	if err != nil {
+		return errors.Trace(err)
+	}
+	res, err := httputil.NewClient(c.pdTLSConf).Do(req)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(res.Body)
+		return errors.Annotatef(berrors.ErrRestoreSplitFailed, "failed to split region %d by size: [%d] %s",
+			regionID, res.StatusCode, b)
+	}
+	return nil
+}
+
 func (c *pdClient) getPDAPIAddr() string {
 	addr := c.client.GetLeaderAddr()
 	if addr != "" && !strings.HasPrefix(addr, "http") {
@@ -501,23 +649,21 @@ func checkRegionEpoch(new, old *RegionInfo) bool {
 		new.Region.GetRegionEpoch().GetConfVer() == old.Region.GetRegionEpoch().GetConfVer()
 }
 
+// scatterBackoffer retries scattering by the backoffer of the backoff policy
+// on the retryable errors only.
 type scatterBackoffer struct {
-	attempt     int
-	baseBackoff time.Duration
+	utils.Backoffer
+	gaveUp bool
 }
 
-func (b *scatterBackoffer) exponentialBackoff() time.Duration {
-	bo := b.baseBackoff
-	b.attempt--
-	if b.attempt == 0 {
-		return 0
-	}
-	b.baseBackoff *= 2
-	return bo
+func (b *scatterBackoffer) backoff(err error) time.Duration {
+	summary.CollectRetry(summary.RetryScatter)
+	restoreScatterRetryCounter.Inc()
+	return b.Backoffer.NextBackoff(err)
 }
 
 func (b *scatterBackoffer) giveUp() time.Duration {
-	b.attempt = 0
+	b.gaveUp = true
 	return 0
 }
 
@@ -535,17 +681,20 @@ func (b *scatterBackoffer) NextBackoff(err error) time.Duration {
 		return b.giveUp()
 	}
 	if strings.Contains(grpcErr.Message(), "is not fully replicated") {
-		log.Info("scatter region failed, retring", logutil.ShortError(err), zap.Int("attempt-remain", b.attempt))
-		return b.exponentialBackoff()
+		log.Info("scatter region failed, retring", logutil.ShortError(err), zap.Int("attempt-remain", b.Attempt()))
+		return b.backoff(err)
 	}
 	if strings.Contains(grpcErr.Message(), "has no leader") {
-		log.Info("scatter region failed, retring", logutil.ShortError(err), zap.Int("attempt-remain", b.attempt))
-		return b.exponentialBackoff()
+		log.Info("scatter region failed, retring", logutil.ShortError(err), zap.Int("attempt-remain", b.Attempt()))
+		return b.backoff(err)
 	}
 	return b.giveUp()
 }
 
 // Attempt returns the remain attempt times
 func (b *scatterBackoffer) Attempt() int {
-	return b.attempt
+	if b.gaveUp {
+		return 0
+	}
+	return b.Backoffer.Attempt()
 }
@@ -0,0 +1,77 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package restore
+
+import (
+	"context"
+	"time"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+
+	"github.com/pingcap/br/pkg/logutil"
+)
+
+// maxSizeSplitRounds bounds the rounds of halving the regions by size, a
+// region up to 256 times of the target size is split into the target size.
+const maxSizeSplitRounds = 8
+
+// SplitRangeBySize splits the regions in the range larger than targetSize
+// into halves by their approximate sizes, round by round until no region is
+// larger than targetSize. It's for the ranges whose split keys aren't known
+// precisely, e.g. the ranges of the raw files larger than the target size,
+// and it runs before the next files are ingested into the range, so they
+// needn't pile up onto the large regions until the split checks of TiKV. The keys are not encoded, like ScatterRange. It
+// returns the number of the requested splits.
+func (rs *RegionSplitter) SplitRangeBySize(ctx context.Context, startKey, endKey []byte, targetSize uint64) (int, error) {
+	if targetSize == 0 {
+		return 0, nil
+	}
+	var start, end []byte
+	if len(startKey) > 0 {
+		start = rs.codec.EncodeKey(startKey)
+	}
+	if len(endKey) > 0 {
+		end = rs.codec.EncodeKey(endKey)
+	}
+	splits := 0
+	for round := 0; round < maxSizeSplitRounds; round++ {
+		regions, err := PaginateScanRegion(ctx, rs.client, start, end, ScanRegionPaginationLimit)
+		if err != nil {
+			return splits, errors.Trace(err)
+		}
+		requested := 0
+		for _, region := range regions {
+			size, err := rs.client.GetRegionApproximateSize(ctx, region.Region.GetId())
+			if err != nil {
+				log.Warn("failed to get the region size, skip splitting it by size",
+					logutil.Region(region.Region), zap.Error(err))
+				continue
+			}
+			if size <= targetSize {
+				continue
+			}
+			if err = rs.client.SplitRegionByApproximateSize(ctx, region.Region.GetId()); err != nil {
+				log.Warn("failed to split the region by size",
+					logutil.Region(region.Region), zap.Uint64("size", size), zap.Error(err))
+				continue
+			}
+			requested++
+		}
+		if requested == 0 {
+			break
+		}
+		splits += requested
+		log.Info("requested splitting the regions by size",
+			logutil.Key("startKey", startKey), logutil.Key("endKey", endKey),
+			zap.Int("round", round), zap.Int("regions", len(regions)), zap.Int("splits", requested))
+		// The sizes of the new regions are reported by their heartbeats.
+		select {
+		case <-ctx.Done():
+			return splits, errors.Trace(ctx.Err())
+		case <-time.After(rs.regionHeartbeat):
+		}
+	}
+	return splits, nil
+}
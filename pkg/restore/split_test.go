@@ -5,21 +5,28 @@ package restore_test
 import (
 	"bytes"
 	"context"
+	"fmt"
 	"sync"
+	"time"
 
 	. "github.com/pingcap/check"
 	"github.com/pingcap/errors"
+	backuppb "github.com/pingcap/kvproto/pkg/backup"
 	"github.com/pingcap/kvproto/pkg/import_sstpb"
 	"github.com/pingcap/kvproto/pkg/metapb"
 	"github.com/pingcap/kvproto/pkg/pdpb"
 	"github.com/pingcap/tidb/util/codec"
+	pd "github.com/tikv/pd/client"
 	"github.com/tikv/pd/server/core"
 	"github.com/tikv/pd/server/schedule/placement"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 
+	berrors "github.com/pingcap/br/pkg/errors"
 	"github.com/pingcap/br/pkg/restore"
 	"github.com/pingcap/br/pkg/rtree"
+	"github.com/pingcap/br/pkg/storage"
+	"github.com/pingcap/br/pkg/utils"
 )
 
 type TestClient struct {
@@ -30,6 +37,17 @@ type TestClient struct {
 	nextRegionID uint64
 
 	scattered map[uint64]bool
+	// batchScatterUnsupported makes ScatterRegions fail like an older PD.
+	batchScatterUnsupported bool
+	// batchScatterPartial makes ScatterRegions scatter only every other
+	// region of the batch.
+	batchScatterPartial bool
+	batchScatterCount   int
+	singleScatterCount  int
+	// regionSizes are the approximate sizes of the regions, which are
+	// halved by SplitRegionByApproximateSize.
+	regionSizes map[uint64]uint64
+	sizeSplits  map[uint64]int
 }
 
 func NewTestClient(
@@ -170,13 +188,52 @@ func (c *TestClient) ScatterRegion(ctx context.Context, regionInfo *restore.Regi
 		return status.Errorf(codes.Unknown, "region %d is not fully replicated", regionInfo.Region.Id)
 	}
 	c.scattered[regionInfo.Region.Id] = true
+	c.singleScatterCount++
 	return nil
 }
 
+func (c *TestClient) ScatterRegions(ctx context.Context, regionInfos []*restore.RegionInfo) error {
+	if c.batchScatterUnsupported {
+		return errors.Annotate(berrors.ErrPDBatchScatter, "region 0 not found")
+	}
+	c.batchScatterCount++
+	for i, region := range regionInfos {
+		if c.batchScatterPartial && i%2 == 1 {
+			continue
+		}
+		c.scattered[region.Region.Id] = true
+	}
+	if c.batchScatterPartial {
+		return errors.Annotatef(berrors.ErrPDScatterPartial, "%d%% of the regions are scattered", 50)
+	}
+	return nil
+}
+
+func (c *TestClient) TransferLeader(ctx context.Context, regionID, toStoreID uint64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	region, ok := c.regions[regionID]
+	if !ok {
+		return errors.Errorf("region not found: id=%d", regionID)
+	}
+	for _, peer := range region.Region.GetPeers() {
+		if peer.GetStoreId() == toStoreID {
+			region.Leader = peer
+			return nil
+		}
+	}
+	return errors.Errorf("region %d has no peer in store %d", regionID, toStoreID)
+}
+
 func (c *TestClient) GetOperator(ctx context.Context, regionID uint64) (*pdpb.GetOperatorResponse, error) {
-	return &pdpb.GetOperatorResponse{
+	resp := &pdpb.GetOperatorResponse{
 		Header: new(pdpb.ResponseHeader),
-	}, nil
+	}
+	if c.scattered[regionID] {
+		resp.Desc = []byte("scatter-region")
+		resp.Status = pdpb.OperatorStatus_SUCCESS
+	}
+	return resp, nil
 }
 
 func (c *TestClient) ScanRegions(ctx context.Context, key, endKey []byte, limit int) ([]*restore.RegionInfo, error) {
@@ -207,6 +264,23 @@ func (c *TestClient) SetStoresLabel(ctx context.Context, stores []uint64, labelK
 	return nil
 }
 
+func (c *TestClient) GetRegionApproximateSize(ctx context.Context, regionID uint64) (uint64, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.regionSizes[regionID], nil
+}
+
+func (c *TestClient) SplitRegionByApproximateSize(ctx context.Context, regionID uint64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.sizeSplits == nil {
+		c.sizeSplits = make(map[uint64]int)
+	}
+	c.sizeSplits[regionID]++
+	c.regionSizes[regionID] /= 2
+	return nil
+}
+
 func (c *TestClient) checkScatter(check *C) {
 	regions := c.GetAllRegions()
 	for key := range regions {
@@ -249,6 +323,274 @@ func (s *testRangeSuite) TestSplitAndScatter(c *C) {
 	client.checkScatter(c)
 }
 
+func (s *testRangeSuite) TestSplitWithoutScatter(c *C) {
+	client := initTestClient()
+	ranges := initRanges()
+	rewriteRules := initRewriteRules()
+	regionSplitter := restore.NewRegionSplitter(client)
+
+	ctx := context.Background()
+	newRegions, err := regionSplitter.SplitWithoutScatter(ctx, ranges, rewriteRules, func(key [][]byte) {})
+	c.Assert(err, IsNil)
+	c.Assert(validateRegions(client.GetAllRegions()), IsTrue)
+	c.Assert(newRegions, HasLen, 6)
+	c.Assert(client.scattered, HasLen, 0)
+
+	regionSplitter.ScatterRegions(ctx, newRegions)
+	for _, region := range newRegions {
+		c.Assert(client.scattered[region.Region.Id], IsTrue)
+	}
+}
+
+func (s *testRangeSuite) TestScatterRegionsInBatch(c *C) {
+	client := initTestClient()
+	regionSplitter := restore.NewRegionSplitter(client)
+	ctx := context.Background()
+	newRegions, err := regionSplitter.SplitWithoutScatter(ctx, initRanges(), initRewriteRules(), func(key [][]byte) {})
+	c.Assert(err, IsNil)
+
+	regionSplitter.ScatterRegions(ctx, newRegions)
+	c.Assert(client.batchScatterCount, Equals, 1)
+	for _, region := range newRegions {
+		c.Assert(client.scattered[region.Region.Id], IsTrue)
+	}
+
+	// The older PD scatters the regions one by one.
+	client = initTestClient()
+	client.batchScatterUnsupported = true
+	regionSplitter = restore.NewRegionSplitter(client)
+	newRegions, err = regionSplitter.SplitWithoutScatter(ctx, initRanges(), initRewriteRules(), func(key [][]byte) {})
+	c.Assert(err, IsNil)
+	regionSplitter.ScatterRegions(ctx, newRegions)
+	c.Assert(client.batchScatterCount, Equals, 0)
+	for _, region := range newRegions {
+		c.Assert(client.scattered[region.Region.Id], IsTrue)
+	}
+
+	// The regions PD failed to scatter in the batch are scattered again.
+	client = initTestClient()
+	client.batchScatterPartial = true
+	regionSplitter = restore.NewRegionSplitter(client)
+	newRegions, err = regionSplitter.SplitWithoutScatter(ctx, initRanges(), initRewriteRules(), func(key [][]byte) {})
+	c.Assert(err, IsNil)
+	regionSplitter.ScatterRegions(ctx, newRegions)
+	c.Assert(client.batchScatterCount, Equals, 1)
+	c.Assert(client.singleScatterCount, Equals, len(newRegions)/2)
+	for _, region := range newRegions {
+		c.Assert(client.scattered[region.Region.Id], IsTrue)
+	}
+}
+
+type batchScatterPDClient struct {
+	pd.Client
+	resp *pdpb.ScatterRegionResponse
+}
+
+func (c *batchScatterPDClient) ScatterRegions(
+	context.Context, []uint64, ...pd.RegionsOption,
+) (*pdpb.ScatterRegionResponse, error) {
+	return c.resp, nil
+}
+
+func (s *testRangeSuite) TestPDClientScatterRegions(c *C) {
+	regions := []*restore.RegionInfo{{Region: &metapb.Region{Id: 2}}, {Region: &metapb.Region{Id: 3}}}
+	pdCli := &batchScatterPDClient{resp: &pdpb.ScatterRegionResponse{FinishedPercentage: 100}}
+	client := restore.NewSplitClient(pdCli, nil)
+	c.Assert(client.ScatterRegions(context.Background(), regions), IsNil)
+
+	// The older PD looks up the region 0 rather than the batch.
+	pdCli.resp = &pdpb.ScatterRegionResponse{Header: &pdpb.ResponseHeader{Error: &pdpb.Error{
+		Type:    pdpb.ErrorType_REGION_NOT_FOUND,
+		Message: "region 0 not found",
+	}}}
+	err := client.ScatterRegions(context.Background(), regions)
+	c.Assert(berrors.Is(err, berrors.ErrPDBatchScatter), IsTrue, Commentf("%v", err))
+
+	pdCli.resp = &pdpb.ScatterRegionResponse{FinishedPercentage: 50}
+	err = client.ScatterRegions(context.Background(), regions)
+	c.Assert(berrors.Is(err, berrors.ErrPDScatterPartial), IsTrue, Commentf("%v", err))
+}
+
+func (s *testRangeSuite) TestSplitWithSkipScatter(c *C) {
+	client := initTestClient()
+	regionSplitter := restore.NewRegionSplitter(client)
+	regionSplitter.SetSkipScatter(true)
+
+	ctx := context.Background()
+	err := regionSplitter.Split(ctx, initRanges(), initRewriteRules(), func(key [][]byte) {})
+	c.Assert(err, IsNil)
+	c.Assert(validateRegions(client.GetAllRegions()), IsTrue)
+	c.Assert(client.scattered, HasLen, 0)
+}
+
+func (s *testRangeSuite) TestScatterRange(c *C) {
+	client := initTestClient()
+	regionSplitter := restore.NewRegionSplitter(client)
+
+	// [bbb, bbz) is in the regions [bba, bbh) and [bbh, cca).
+	regions, err := regionSplitter.ScatterRange(context.Background(), []byte("bbb"), []byte("bbz"))
+	c.Assert(err, IsNil)
+	c.Assert(regions, Equals, 2)
+	c.Assert(client.scattered, DeepEquals, map[uint64]bool{3: true, 4: true})
+}
+
+// range: [aaa, aae), [aae, aaz), [ccd, ccf), [ccf, ccj) of 60 bytes each
+// rewrite rules: aa -> xx,  cc -> bb
+// expected regions after split with the target size of 100 bytes, [bbd, bbj)
+// and [xxa, xxz) are coalesced, and the prefix xx isn't split at:
+// [, aay), [aay, bb), [bb, bba), [bba, bbh), [bbh, bbj), [bbj, cca),
+// [cca, xxz), [xxz, )
+func (s *testRangeSuite) TestSplitWithTargetSize(c *C) {
+	client := initTestClient()
+	ranges := initRanges()
+	for i := range ranges {
+		ranges[i].Files = []*backuppb.File{{TotalBytes: 60}}
+	}
+	regionSplitter := restore.NewRegionSplitter(client)
+	regionSplitter.SetSplitTargetSize(100)
+
+	err := regionSplitter.Split(context.Background(), ranges, initRewriteRules(), func(key [][]byte) {})
+	c.Assert(err, IsNil)
+	checkRegionKeys(c, client, []string{"", "aay", "bb", "bba", "bbh", "bbj", "cca", "xxz", ""})
+}
+
+// The 10 tables of an index and a record range of 5 bytes each are coalesced
+// into the regions of 35 bytes, across the index and record prefixes and the
+// tables, rather than a region per range and prefix.
+func (s *testRangeSuite) TestSplitManySmallTables(c *C) {
+	peers := []*metapb.Peer{{Id: 1, StoreId: 1}}
+	regions := map[uint64]*restore.RegionInfo{
+		1: {Region: &metapb.Region{Id: 1, Peers: peers}},
+	}
+	client := NewTestClient(map[uint64]*metapb.Store{1: {Id: 1}}, regions, 2)
+
+	ranges := make([]rtree.Range, 0, 20)
+	rules := &restore.RewriteRules{}
+	for i := 1; i <= 10; i++ {
+		for _, kind := range []string{"i", "r"} {
+			oldPrefix, newPrefix := fmt.Sprintf("t%02d%s", i, kind), fmt.Sprintf("n%02d%s", i, kind)
+			ranges = append(ranges, rtree.Range{
+				StartKey: []byte(oldPrefix + "a"),
+				EndKey:   []byte(oldPrefix + "z"),
+				Files:    []*backuppb.File{{TotalBytes: 5}},
+			})
+			rules.Data = append(rules.Data, &import_sstpb.RewriteRule{
+				OldKeyPrefix: []byte(oldPrefix),
+				NewKeyPrefix: []byte(newPrefix),
+			})
+		}
+	}
+	regionSplitter := restore.NewRegionSplitter(client)
+	regionSplitter.SetSplitTargetSize(35)
+
+	err := regionSplitter.Split(context.Background(), ranges, rules, func(key [][]byte) {})
+	c.Assert(err, IsNil)
+	checkRegionKeys(c, client, []string{"", "n01i", "n04iz", "n07rz", "n10rz", ""})
+}
+
+// checkRegionKeys checks the regions of the client are split at the keys.
+func checkRegionKeys(c *C, client *TestClient, keys []string) {
+	c.Assert(client.GetAllRegions(), HasLen, len(keys)-1)
+	for i := 1; i < len(keys); i++ {
+		region, err := client.GetRegion(context.Background(), codec.EncodeBytes([]byte{}, []byte(keys[i-1])))
+		c.Assert(err, IsNil)
+		endKey := []byte(keys[i])
+		if len(endKey) != 0 {
+			endKey = codec.EncodeBytes([]byte{}, endKey)
+		}
+		c.Assert(region.Region.GetEndKey(), DeepEquals, endKey, Commentf("region starting at %s", keys[i-1]))
+	}
+}
+
+func (s *testRangeSuite) TestSplitRangeBySize(c *C) {
+	client := initTestClient()
+	client.regionSizes = map[uint64]uint64{2: 1000, 3: 300, 4: 100, 5: 1000}
+	regionSplitter := restore.NewRegionSplitter(client)
+	regionSplitter.SetRegionHeartbeatInterval(time.Millisecond)
+
+	// [bbb, bbz) is in the regions [bba, bbh) and [bbh, cca).
+	splits, err := regionSplitter.SplitRangeBySize(context.Background(), []byte("bbb"), []byte("bbz"), 96)
+	c.Assert(err, IsNil)
+	c.Assert(splits, Equals, 3)
+	c.Assert(client.sizeSplits, DeepEquals, map[uint64]int{3: 2, 4: 1})
+}
+
+// holeyScanClient drops the second region from the first scans, like PD
+// before receiving the heartbeat of a new region.
+type holeyScanClient struct {
+	*TestClient
+	holeyScans int
+	scans      int
+}
+
+func (c *holeyScanClient) ScanRegions(ctx context.Context, key, endKey []byte, limit int) ([]*restore.RegionInfo, error) {
+	regions, err := c.TestClient.ScanRegions(ctx, key, endKey, limit)
+	c.scans++
+	if err != nil || c.scans > c.holeyScans || len(regions) < 3 {
+		return regions, err
+	}
+	return append(regions[:1], regions[2:]...), nil
+}
+
+func (s *testRangeSuite) TestRegionGaps(c *C) {
+	regions := []*restore.RegionInfo{
+		{Region: &metapb.Region{StartKey: []byte(""), EndKey: []byte("b")}},
+		{Region: &metapb.Region{StartKey: []byte("c"), EndKey: []byte("e")}},
+		{Region: &metapb.Region{StartKey: []byte("d"), EndKey: []byte("f")}},
+	}
+	c.Assert(restore.RegionGaps([]byte("a"), []byte("f"), regions), DeepEquals, []restore.Range{
+		{Start: []byte("b"), End: []byte("c")},
+		{Start: []byte("d"), End: []byte("e")},
+	})
+	c.Assert(restore.RegionGaps([]byte("a"), []byte(""), regions), DeepEquals, []restore.Range{
+		{Start: []byte("b"), End: []byte("c")},
+		{Start: []byte("d"), End: []byte("e")},
+		{Start: []byte("f"), End: []byte("")},
+	})
+	c.Assert(restore.RegionGaps([]byte("a"), []byte("b"), regions[:1]), HasLen, 0)
+}
+
+func (s *testRangeSuite) TestSplitWithInconsistentScan(c *C) {
+	client := &holeyScanClient{TestClient: initTestClient(), holeyScans: 3}
+	regionSplitter := restore.NewRegionSplitter(client)
+	regionSplitter.SetRegionHeartbeatInterval(time.Millisecond)
+	keys := [][]byte{[]byte("bb"), []byte("bbj")}
+	c.Assert(regionSplitter.SplitByKeys(context.Background(), keys), IsNil)
+	c.Assert(validateRegions(client.GetAllRegions()), IsTrue)
+	c.Assert(client.scans > client.holeyScans, IsTrue)
+
+	client = &holeyScanClient{TestClient: initTestClient(), holeyScans: restore.ScanRegionConsistencyRetryTimes}
+	regionSplitter = restore.NewRegionSplitter(client)
+	regionSplitter.SetRegionHeartbeatInterval(time.Millisecond)
+	err := regionSplitter.SplitByKeys(context.Background(), keys)
+	c.Assert(berrors.Is(err, berrors.ErrPDBatchScanRegion), IsTrue, Commentf("%v", err))
+	c.Assert(client.scans, Equals, restore.ScanRegionConsistencyRetryTimes)
+
+	// Once the budget of the policy is spent, the scan gives up rather than
+	// rescanning without waiting.
+	client = &holeyScanClient{TestClient: initTestClient(), holeyScans: restore.ScanRegionConsistencyRetryTimes}
+	regionSplitter = restore.NewRegionSplitter(client)
+	regionSplitter.SetRegionHeartbeatInterval(time.Millisecond)
+	regionSplitter.SetBackoffPolicy(utils.BudgetBackoffPolicy{Budget: time.Nanosecond})
+	err = regionSplitter.SplitByKeys(context.Background(), keys)
+	c.Assert(berrors.Is(err, berrors.ErrPDBatchScanRegion), IsTrue, Commentf("%v", err))
+	c.Assert(client.scans, Equals, 1)
+}
+
+func (s *testRangeSuite) TestSplitByKeys(c *C) {
+	client := initTestClient()
+	regionSplitter := restore.NewRegionSplitter(client)
+
+	// The keys are neither rewritten nor sorted.
+	keys := [][]byte{[]byte("xxz"), []byte("bb"), []byte("bbj"), []byte("xx"), []byte("xxe"), []byte("bbf"), {}}
+	err := regionSplitter.SplitByKeys(context.Background(), keys)
+	c.Assert(err, IsNil)
+	c.Assert(validateRegions(client.GetAllRegions()), IsTrue)
+	c.Assert(client.scattered, HasLen, 6)
+
+	c.Assert(regionSplitter.SplitByKeys(context.Background(), nil), IsNil)
+}
+
 // region: [, aay), [aay, bba), [bba, bbh), [bbh, cca), [cca, )
 func initTestClient() *TestClient {
 	peers := make([]*metapb.Peer, 1)
@@ -370,4 +712,236 @@ func (s *testRangeSuite) TestNeedSplit(c *C) {
 	c.Assert(restore.NeedSplit([]byte("d"), regions), IsNil)
 	// Out of region
 	c.Assert(restore.NeedSplit([]byte("e"), regions), IsNil)
+
+	// Unsorted regions with a gap between "f" and "h".
+	encode := func(key string) []byte {
+		if key == "" {
+			return []byte{}
+		}
+		return codec.EncodeBytes([]byte{}, []byte(key))
+	}
+	regions = []*restore.RegionInfo{
+		{Region: &metapb.Region{Id: 3, StartKey: encode("h"), EndKey: encode("")}},
+		{Region: &metapb.Region{Id: 1, StartKey: encode(""), EndKey: encode("b")}},
+		{Region: &metapb.Region{Id: 2, StartKey: encode("b"), EndKey: encode("f")}},
+	}
+	for key, id := range map[string]uint64{"a": 1, "c": 2, "e": 2, "i": 3, "z": 3} {
+		region := restore.NeedSplit([]byte(key), regions)
+		c.Assert(region, NotNil, Commentf("key %s", key))
+		c.Assert(region.Region.Id, Equals, id, Commentf("key %s", key))
+	}
+	for _, key := range []string{"", "b", "f", "g", "h"} {
+		c.Assert(restore.NeedSplit([]byte(key), regions), IsNil, Commentf("key %s", key))
+	}
+	// The input is not reordered.
+	c.Assert(regions[0].Region.Id, Equals, uint64(3))
+}
+
+func (s *testRangeSuite) TestSplitCheckpoint(c *C) {
+	ctx := context.Background()
+	store, err := storage.NewLocalStorage(c.MkDir())
+	c.Assert(err, IsNil)
+
+	cp, err := restore.NewSplitCheckpoint(ctx, store)
+	c.Assert(err, IsNil)
+	var splitKeys [][]byte
+	onSplit := cp.OnSplit(ctx, func(keys [][]byte) { splitKeys = append(splitKeys, keys...) })
+
+	client := initTestClient()
+	regionSplitter := restore.NewRegionSplitter(client)
+	regionSplitter.SetCheckpoint(cp)
+	_, err = regionSplitter.SplitWithoutScatter(ctx, initRanges(), initRewriteRules(), onSplit)
+	c.Assert(err, IsNil)
+	c.Assert(splitKeys, HasLen, 6)
+	c.Assert(cp.Flush(ctx), IsNil)
+
+	// The resumed split skips all the ranges.
+	cp, err = restore.NewSplitCheckpoint(ctx, store)
+	c.Assert(err, IsNil)
+	for _, key := range splitKeys {
+		c.Assert(cp.IsSplit(key), IsTrue)
+	}
+	client = initTestClient()
+	regionSplitter = restore.NewRegionSplitter(client)
+	regionSplitter.SetCheckpoint(cp)
+	newRegions, err := regionSplitter.SplitWithoutScatter(ctx, initRanges(), initRewriteRules(), func([][]byte) {})
+	c.Assert(err, IsNil)
+	c.Assert(newRegions, HasLen, 0)
+	c.Assert(client.GetAllRegions(), HasLen, 5)
+}
+
+// scatteringClient reports the scattering of each region is running for the
+// first `rounds` queries.
+type scatteringClient struct {
+	*TestClient
+	rounds int
+
+	mu         sync.Mutex
+	queries    map[uint64]int
+	running    int
+	maxRunning int
+}
+
+func (c *scatteringClient) GetOperator(ctx context.Context, regionID uint64) (*pdpb.GetOperatorResponse, error) {
+	c.mu.Lock()
+	c.queries[regionID]++
+	queries := c.queries[regionID]
+	c.running++
+	if c.running > c.maxRunning {
+		c.maxRunning = c.running
+	}
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		c.running--
+		c.mu.Unlock()
+	}()
+
+	resp := &pdpb.GetOperatorResponse{Header: new(pdpb.ResponseHeader)}
+	if queries <= c.rounds {
+		resp.Desc = []byte("scatter-region")
+		resp.Status = pdpb.OperatorStatus_RUNNING
+	}
+	return resp, nil
+}
+
+func (s *testRangeSuite) TestWaitForScatterRegions(c *C) {
+	client := &scatteringClient{TestClient: initTestClient(), rounds: 2, queries: make(map[uint64]int)}
+	regions := make([]*restore.RegionInfo, 0, 40)
+	for i := 0; i < 40; i++ {
+		regions = append(regions, &restore.RegionInfo{Region: &metapb.Region{Id: uint64(i + 100)}})
+	}
+	restore.NewRegionSplitter(client).WaitForScatterRegions(context.Background(), regions)
+
+	c.Assert(client.queries, HasLen, 40)
+	for _, queries := range client.queries {
+		c.Assert(queries, Equals, 3)
+	}
+	c.Assert(client.maxRunning <= 16, IsTrue)
+}
+
+// mergedRegionClient reports REGION_NOT_FOUND for the operators of the
+// regions not in the TestClient, like the regions merged away.
+type mergedRegionClient struct {
+	*TestClient
+
+	mu        sync.Mutex
+	notFound  map[uint64]int
+	scattered []uint64
+}
+
+func (c *mergedRegionClient) GetOperator(ctx context.Context, regionID uint64) (*pdpb.GetOperatorResponse, error) {
+	resp := &pdpb.GetOperatorResponse{Header: new(pdpb.ResponseHeader)}
+	if _, ok := c.GetAllRegions()[regionID]; !ok {
+		c.mu.Lock()
+		c.notFound[regionID]++
+		c.mu.Unlock()
+		resp.Header.Error = &pdpb.Error{Type: pdpb.ErrorType_REGION_NOT_FOUND}
+	}
+	return resp, nil
+}
+
+func (c *mergedRegionClient) ScatterRegion(ctx context.Context, regionInfo *restore.RegionInfo) error {
+	c.scattered = append(c.scattered, regionInfo.Region.GetId())
+	return nil
+}
+
+func (s *testRangeSuite) TestWaitForMergedRegions(c *C) {
+	client := &mergedRegionClient{TestClient: initTestClient(), notFound: make(map[uint64]int)}
+	covering := client.GetAllRegions()[2]
+	merged := &restore.RegionInfo{Region: &metapb.Region{Id: 100, StartKey: covering.Region.StartKey}}
+	splitter := restore.NewRegionSplitter(client)
+	splitter.SetRegionHeartbeatInterval(time.Millisecond)
+	splitter.SetRegionNotFoundGrace(10 * time.Millisecond)
+	splitter.WaitForScatterRegions(context.Background(), []*restore.RegionInfo{merged, covering})
+	// the merged region is waited for during the grace period, then the
+	// covering region is scattered again.
+	c.Assert(client.notFound[100] > 1, IsTrue)
+	c.Assert(client.scattered, DeepEquals, []uint64{2})
+
+	// without the grace period, REGION_NOT_FOUND means scattered.
+	client = &mergedRegionClient{TestClient: initTestClient(), notFound: make(map[uint64]int)}
+	splitter = restore.NewRegionSplitter(client)
+	splitter.SetRegionNotFoundGrace(0)
+	splitter.WaitForScatterRegions(context.Background(), []*restore.RegionInfo{merged})
+	c.Assert(client.notFound[100], Equals, 1)
+	c.Assert(client.scattered, HasLen, 0)
+}
+
+func (s *testRangeSuite) TestVerifyFailureDomains(c *C) {
+	stores := make(map[uint64]*metapb.Store)
+	for i, zone := range []string{"z1", "z2", "z3", "z3"} {
+		id := uint64(i + 1)
+		stores[id] = &metapb.Store{Id: id, Labels: []*metapb.StoreLabel{{Key: "zone", Value: zone}}}
+	}
+	stores[5] = &metapb.Store{Id: 5}
+	newRegion := func(id uint64, storeIDs ...uint64) *restore.RegionInfo {
+		region := &metapb.Region{Id: id}
+		for _, storeID := range storeIDs {
+			region.Peers = append(region.Peers, &metapb.Peer{Id: id*10 + storeID, StoreId: storeID})
+		}
+		return &restore.RegionInfo{Region: region}
+	}
+	regions := map[uint64]*restore.RegionInfo{
+		1: newRegion(1, 1, 2, 3),
+		// Two voters in z3.
+		2: newRegion(2, 1, 3, 4),
+		// The learner doesn't count.
+		3: newRegion(3, 1, 2, 3),
+		// Store 5 doesn't have the label.
+		4: newRegion(4, 1, 5),
+	}
+	regions[3].Region.Peers = append(regions[3].Region.Peers,
+		&metapb.Peer{Id: 34, StoreId: 4, Role: metapb.PeerRole_Learner})
+	client := NewTestClient(stores, regions, 5)
+
+	splitter := restore.NewRegionSplitter(client)
+	splitter.SetFailureDomainCheck("zone", true)
+	scattered := []*restore.RegionInfo{regions[1], regions[2], regions[3]}
+	splitter.WaitForScatterRegions(context.Background(), scattered)
+	// Only the violating region is scattered again.
+	c.Assert(client.scattered, HasLen, 1)
+	_, ok := client.scattered[2]
+	c.Assert(ok, IsTrue)
+
+	client.scattered = map[uint64]bool{}
+	splitter.SetFailureDomainCheck("host", true)
+	splitter.WaitForScatterRegions(context.Background(), []*restore.RegionInfo{regions[4]})
+	_, ok = client.scattered[4]
+	c.Assert(ok, IsTrue)
+}
+
+func (s *testRangeSuite) TestScatterLeaders(c *C) {
+	stores := make(map[uint64]*metapb.Store)
+	for id := uint64(1); id <= 3; id++ {
+		stores[id] = &metapb.Store{Id: id}
+	}
+	regions := make(map[uint64]*restore.RegionInfo)
+	scattered := make([]*restore.RegionInfo, 0, 6)
+	for id := uint64(1); id <= 6; id++ {
+		region := &metapb.Region{Id: id}
+		for storeID := uint64(1); storeID <= 3; storeID++ {
+			region.Peers = append(region.Peers, &metapb.Peer{Id: id*10 + storeID, StoreId: storeID})
+		}
+		regions[id] = &restore.RegionInfo{Region: region, Leader: region.Peers[0]}
+		scattered = append(scattered, regions[id])
+	}
+	// The learner never becomes the leader.
+	regions[3].Region.Peers[2].Role = metapb.PeerRole_Learner
+	client := NewTestClient(stores, regions, 7)
+
+	splitter := restore.NewRegionSplitter(client)
+	splitter.WaitForScatterRegions(context.Background(), scattered)
+	for _, region := range regions {
+		c.Assert(region.Leader.GetStoreId(), Equals, uint64(1))
+	}
+
+	splitter.SetScatterLeader(true)
+	splitter.WaitForScatterRegions(context.Background(), scattered)
+	leaders := make(map[uint64]int)
+	for _, region := range regions {
+		leaders[region.Leader.GetStoreId()]++
+	}
+	c.Assert(leaders, DeepEquals, map[uint64]int{1: 2, 2: 2, 3: 2})
+	c.Assert(regions[3].Leader.GetStoreId(), Not(Equals), uint64(3))
 }
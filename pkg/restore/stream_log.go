@@ -0,0 +1,241 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package restore
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"sort"
+
+	"github.com/pingcap/errors"
+	backuppb "github.com/pingcap/kvproto/pkg/backup"
+	"github.com/pingcap/log"
+	"github.com/pingcap/tidb/tablecodec"
+	"github.com/pingcap/tidb/util/codec"
+	"go.uber.org/zap"
+
+	berrors "github.com/pingcap/br/pkg/errors"
+	"github.com/pingcap/br/pkg/kv"
+	"github.com/pingcap/br/pkg/logutil"
+	"github.com/pingcap/br/pkg/redact"
+	"github.com/pingcap/br/pkg/storage"
+	"github.com/pingcap/br/pkg/stream"
+)
+
+// The write types and the prefix of the short value of the write CF, see the
+// txn types of TiKV.
+const (
+	writeTypePut      = 'P'
+	writeTypeDelete   = 'D'
+	shortValuePrefix  = 'v'
+	tsSuffixLength    = 8
+	tablePrefixLength = 9
+)
+
+// mvccWrite is a value of the write CF.
+type mvccWrite struct {
+	writeType  byte
+	startTS    uint64
+	shortValue []byte
+}
+
+// parseWrite parses the value of the write CF, which is the write type, the
+// varint start ts, and the optional fields, the short value goes first of
+// them if any.
+func parseWrite(data []byte) (*mvccWrite, error) {
+	if len(data) == 0 {
+		return nil, errors.Annotate(berrors.ErrRestoreInvalidBackup, "empty write")
+	}
+	w := &mvccWrite{writeType: data[0]}
+	startTS, n := binary.Uvarint(data[1:])
+	if n <= 0 {
+		return nil, errors.Annotatef(berrors.ErrRestoreInvalidBackup, "invalid start ts of write %x", data)
+	}
+	w.startTS = startTS
+	rest := data[1+n:]
+	if len(rest) > 0 && rest[0] == shortValuePrefix {
+		if len(rest) < 2 || len(rest)-2 < int(rest[1]) {
+			return nil, errors.Annotatef(berrors.ErrRestoreInvalidBackup, "invalid short value of write %x", data)
+		}
+		w.shortValue = rest[2 : 2+int(rest[1])]
+	}
+	return w, nil
+}
+
+// StreamLogClient replays the log files of the log backup tasks of br stream
+// onto the tables restored from the snapshot backup. The latest change of
+// each key committed in the TS range is ingested at a new commit ts, like the
+// LogClient does for the log backup of TiCDC. The DDLs in the log files are
+// not replayed.
+type StreamLogClient struct {
+	storage  storage.ExternalStorage
+	ingester *Ingester
+	startTS  uint64
+	endTS    uint64
+	// tableIDs maps the IDs of the tables and partitions in the log files to
+	// the ones restored from the snapshot backup.
+	tableIDs map[int64]int64
+}
+
+// NewStreamLogClient returns a StreamLogClient replaying the changes
+// committed in [startTS, endTS] of the log files in the storage at commitTS.
+func NewStreamLogClient(
+	restoreClient *Client,
+	s storage.ExternalStorage,
+	startTS, endTS, commitTS uint64,
+	tableIDs map[int64]int64,
+	concurrency uint,
+	batchWriteKVPairs int,
+) *StreamLogClient {
+	tlsConf := restoreClient.GetTLSConfig()
+	splitClient := NewSplitClientWithPDTLS(restoreClient.GetPDClient(), tlsConf, restoreClient.pdTLSConf)
+	cfg := concurrencyCfg{
+		Concurrency:       concurrency,
+		BatchWriteKVPairs: batchWriteKVPairs,
+		IngestConcurrency: concurrency * 16,
+		TCPConcurrency:    int(concurrency) * 16,
+	}
+	return &StreamLogClient{
+		storage:  s,
+		ingester: NewIngester(splitClient, cfg, commitTS, tlsConf),
+		startTS:  startTS,
+		endTS:    endTS,
+		tableIDs: tableIDs,
+	}
+}
+
+// GroupFilesByTable groups the data files by the IDs of the tables in the
+// log files. The files of the meta keys, i.e. the DDLs, and of the tables not
+// restored from the snapshot backup are skipped.
+func (c *StreamLogClient) GroupFilesByTable(files []*backuppb.DataFileInfo) map[int64][]*backuppb.DataFileInfo {
+	groups := make(map[int64][]*backuppb.DataFileInfo)
+	skipped := 0
+	for _, f := range files {
+		if _, ok := c.tableIDs[f.TableId]; !ok || f.IsMeta {
+			skipped++
+			continue
+		}
+		groups[f.TableId] = append(groups[f.TableId], f)
+	}
+	if skipped > 0 {
+		log.Warn("skip the log files of the meta keys and the tables not restored from the snapshot backup",
+			zap.Int("skipped", skipped), zap.Int("files", len(files)))
+	}
+	return groups
+}
+
+// RestoreTable replays the changes of the table in the data files.
+func (c *StreamLogClient) RestoreTable(ctx context.Context, tableID int64, files []*backuppb.DataFileInfo) error {
+	writes := make([]stream.KVEvent, 0)
+	defaults := make(map[string][]byte)
+	for _, f := range files {
+		events, err := stream.ReadKVEvents(ctx, c.storage, f)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		switch f.Cf {
+		case writeCFName:
+			writes = append(writes, events...)
+		case defaultCFName, "":
+			for _, e := range events {
+				defaults[string(e.Key)] = e.Value
+			}
+		}
+	}
+	pairs, err := resolveStreamEvents(writes, defaults, c.startTS, c.endTS, c.rewriteKey)
+	if err != nil {
+		return errors.Annotatef(err, "table %d", tableID)
+	}
+	log.Info("replay the log files of table", zap.Int64("table", tableID),
+		zap.Int("files", len(files)), zap.Int("keys", len(pairs)))
+	return errors.Trace(c.ingester.WriteAndIngest(ctx, pairs))
+}
+
+// rewriteKey rewrites the table ID of the key to the restored one, it
+// returns nil if the table isn't restored.
+func (c *StreamLogClient) rewriteKey(key []byte) []byte {
+	newID, ok := c.tableIDs[tablecodec.DecodeTableID(key)]
+	if !ok || len(key) < tablePrefixLength {
+		return nil
+	}
+	return append(tablecodec.EncodeTablePrefix(newID), key[tablePrefixLength:]...)
+}
+
+// resolveStreamEvents returns the latest changes of the keys committed in
+// [startTS, endTS] of the events of the write CF, whose values are looked up
+// in the events of the default CF by the keys if not short. The keys are
+// rewritten by rewrite, and are skipped if it returns nil. The pairs are
+// sorted by the keys.
+func resolveStreamEvents(
+	writes []stream.KVEvent,
+	defaults map[string][]byte,
+	startTS, endTS uint64,
+	rewrite func([]byte) []byte,
+) (kv.Pairs, error) {
+	type change struct {
+		commitTS uint64
+		write    *mvccWrite
+	}
+	latest := make(map[string]change)
+	for _, e := range writes {
+		if len(e.Key) <= tsSuffixLength {
+			return nil, errors.Annotatef(berrors.ErrRestoreInvalidBackup, "invalid key %s of write", redact.Key(e.Key))
+		}
+		encoded := e.Key[:len(e.Key)-tsSuffixLength]
+		_, commitTS, err := codec.DecodeUintDesc(e.Key[len(e.Key)-tsSuffixLength:])
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		if commitTS < startTS || commitTS > endTS {
+			continue
+		}
+		w, err := parseWrite(e.Value)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		// The locks and rollbacks don't change the value.
+		if w.writeType != writeTypePut && w.writeType != writeTypeDelete {
+			continue
+		}
+		if old, ok := latest[string(encoded)]; ok && old.commitTS >= commitTS {
+			continue
+		}
+		latest[string(encoded)] = change{commitTS: commitTS, write: w}
+	}
+
+	pairs := make(kv.Pairs, 0, len(latest))
+	for encoded, ch := range latest {
+		_, userKey, err := codec.DecodeBytes([]byte(encoded), nil)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		key := rewrite(userKey)
+		if key == nil {
+			continue
+		}
+		if ch.write.writeType == writeTypeDelete {
+			pairs = append(pairs, kv.Pair{Key: key, IsDelete: true})
+			continue
+		}
+		value := ch.write.shortValue
+		if value == nil {
+			var ok bool
+			value, ok = defaults[string(codec.EncodeUintDesc([]byte(encoded), ch.write.startTS))]
+			if !ok {
+				return nil, errors.Annotatef(berrors.ErrRestoreInvalidBackup,
+					"the value of key %s committed at %d is not in the log files",
+					redact.Key(userKey), ch.commitTS)
+			}
+		}
+		pairs = append(pairs, kv.Pair{Key: key, Val: value})
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		return bytes.Compare(pairs[i].Key, pairs[j].Key) < 0
+	})
+	if len(pairs) > 0 {
+		log.Debug("resolve the changes of the log files", zap.Int("keys", len(pairs)),
+			logutil.Key("first", pairs[0].Key), logutil.Key("last", pairs[len(pairs)-1].Key))
+	}
+	return pairs, nil
+}
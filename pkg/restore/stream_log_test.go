@@ -0,0 +1,93 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package restore
+
+import (
+	"encoding/binary"
+
+	. "github.com/pingcap/check"
+	"github.com/pingcap/tidb/tablecodec"
+	"github.com/pingcap/tidb/util/codec"
+
+	berrors "github.com/pingcap/br/pkg/errors"
+	"github.com/pingcap/br/pkg/kv"
+	"github.com/pingcap/br/pkg/stream"
+)
+
+type testStreamLogSuite struct{}
+
+var _ = Suite(&testStreamLogSuite{})
+
+func encodeWrite(writeType byte, startTS uint64, shortValue []byte) []byte {
+	buf := make([]byte, binary.MaxVarintLen64)
+	data := append([]byte{writeType}, buf[:binary.PutUvarint(buf, startTS)]...)
+	if shortValue != nil {
+		data = append(data, shortValuePrefix, byte(len(shortValue)))
+		data = append(data, shortValue...)
+	}
+	return data
+}
+
+func encodeMVCCKey(key []byte, ts uint64) []byte {
+	return codec.EncodeUintDesc(codec.EncodeBytes(nil, key), ts)
+}
+
+func (s *testStreamLogSuite) TestParseWrite(c *C) {
+	w, err := parseWrite(encodeWrite(writeTypePut, 300, []byte("short")))
+	c.Assert(err, IsNil)
+	c.Assert(w.writeType, Equals, byte(writeTypePut))
+	c.Assert(w.startTS, Equals, uint64(300))
+	c.Assert(w.shortValue, DeepEquals, []byte("short"))
+
+	w, err = parseWrite(encodeWrite(writeTypeDelete, 1, nil))
+	c.Assert(err, IsNil)
+	c.Assert(w.writeType, Equals, byte(writeTypeDelete))
+	c.Assert(w.shortValue, IsNil)
+
+	_, err = parseWrite(nil)
+	c.Assert(berrors.ErrRestoreInvalidBackup.Equal(err), IsTrue)
+	data := encodeWrite(writeTypePut, 300, []byte("short"))
+	_, err = parseWrite(data[:len(data)-1])
+	c.Assert(berrors.ErrRestoreInvalidBackup.Equal(err), IsTrue)
+}
+
+func (s *testStreamLogSuite) TestResolveStreamEvents(c *C) {
+	key := func(tableID int64, suffix string) []byte {
+		return append(tablecodec.EncodeTablePrefix(tableID), suffix...)
+	}
+	rewrite := func(k []byte) []byte {
+		if tablecodec.DecodeTableID(k) != 1 {
+			return nil
+		}
+		return append(tablecodec.EncodeTablePrefix(10), k[tablePrefixLength:]...)
+	}
+	writes := []stream.KVEvent{
+		// The latest put of a is in the default CF.
+		{Key: encodeMVCCKey(key(1, "a"), 20), Value: encodeWrite(writeTypePut, 15, []byte("old"))},
+		{Key: encodeMVCCKey(key(1, "a"), 40), Value: encodeWrite(writeTypePut, 35, nil)},
+		// The lock doesn't change b.
+		{Key: encodeMVCCKey(key(1, "b"), 30), Value: encodeWrite(writeTypePut, 25, []byte("b"))},
+		{Key: encodeMVCCKey(key(1, "b"), 31), Value: encodeWrite('L', 31, nil)},
+		// c is deleted at last.
+		{Key: encodeMVCCKey(key(1, "c"), 50), Value: encodeWrite(writeTypeDelete, 45, nil)},
+		{Key: encodeMVCCKey(key(1, "c"), 20), Value: encodeWrite(writeTypePut, 18, []byte("c"))},
+		// d is committed out of the TS range.
+		{Key: encodeMVCCKey(key(1, "d"), 200), Value: encodeWrite(writeTypePut, 190, []byte("d"))},
+		// The table 2 isn't restored.
+		{Key: encodeMVCCKey(key(2, "a"), 20), Value: encodeWrite(writeTypePut, 15, []byte("x"))},
+	}
+	defaults := map[string][]byte{
+		string(encodeMVCCKey(key(1, "a"), 35)): []byte("new"),
+	}
+	pairs, err := resolveStreamEvents(writes, defaults, 10, 100, rewrite)
+	c.Assert(err, IsNil)
+	c.Assert(pairs, DeepEquals, kv.Pairs{
+		{Key: key(10, "a"), Val: []byte("new")},
+		{Key: key(10, "b"), Val: []byte("b")},
+		{Key: key(10, "c"), IsDelete: true},
+	})
+
+	// The value of a is missing.
+	_, err = resolveStreamEvents(writes, nil, 10, 100, rewrite)
+	c.Assert(berrors.ErrRestoreInvalidBackup.Equal(err), IsTrue)
+}
@@ -0,0 +1,114 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package restore
+
+import (
+	"sync"
+	"time"
+
+	"github.com/docker/go-units"
+	backuppb "github.com/pingcap/kvproto/pkg/backup"
+)
+
+const (
+	// throughputSmoothing is the weight of the latest observation in the
+	// moving average of the ingestion throughput.
+	throughputSmoothing = 0.3
+	// minMergeRegionSizeBytes is the lower bound of the dynamic merge size,
+	// to avoid splitting too many tiny regions when the cluster is slow.
+	minMergeRegionSizeBytes uint64 = 4 * units.MiB
+)
+
+// ThroughputEstimator estimates the ingestion throughput of restore by the
+// exponentially weighted moving average of the restored batches.
+type ThroughputEstimator struct {
+	mu sync.Mutex
+	// bytesPerSecond is zero before any batch is observed.
+	bytesPerSecond float64
+}
+
+// NewThroughputEstimator creates a ThroughputEstimator.
+func NewThroughputEstimator() *ThroughputEstimator {
+	return &ThroughputEstimator{}
+}
+
+// Observe records a batch of files restored in the duration.
+func (e *ThroughputEstimator) Observe(files []*backuppb.File, elapsed time.Duration) {
+	var size uint64
+	for _, f := range files {
+		size += f.GetTotalBytes()
+	}
+	if size == 0 || elapsed <= 0 {
+		return
+	}
+	rate := float64(size) / elapsed.Seconds()
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.bytesPerSecond == 0 {
+		e.bytesPerSecond = rate
+		return
+	}
+	e.bytesPerSecond = throughputSmoothing*rate + (1-throughputSmoothing)*e.bytesPerSecond
+}
+
+// BytesPerSecond returns the estimated throughput, false if no batch has
+// been observed.
+func (e *ThroughputEstimator) BytesPerSecond() (float64, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.bytesPerSecond, e.bytesPerSecond > 0
+}
+
+// MergeSizer decides the thresholds of merging small ranges by the observed
+// ingestion throughput, so each batch of ranges is restored in roughly the
+// target duration.
+type MergeSizer struct {
+	estimator      *ThroughputEstimator
+	targetDuration time.Duration
+	rangesPerBatch int
+	// maxSizeBytes and maxKeyCount are the thresholds used before any batch
+	// is observed, and the upper bound of the dynamic thresholds.
+	maxSizeBytes uint64
+	maxKeyCount  uint64
+}
+
+// NewMergeSizer creates a MergeSizer, the ranges are merged by the fixed
+// maxSizeBytes and maxKeyCount until the first batch is observed.
+func NewMergeSizer(
+	estimator *ThroughputEstimator,
+	targetDuration time.Duration,
+	rangesPerBatch int,
+	maxSizeBytes, maxKeyCount uint64,
+) *MergeSizer {
+	if rangesPerBatch <= 0 {
+		rangesPerBatch = 1
+	}
+	return &MergeSizer{
+		estimator:      estimator,
+		targetDuration: targetDuration,
+		rangesPerBatch: rangesPerBatch,
+		maxSizeBytes:   maxSizeBytes,
+		maxKeyCount:    maxKeyCount,
+	}
+}
+
+// Thresholds returns the current thresholds of merging small ranges. The key
+// count threshold is scaled in proportion to the size threshold.
+func (s *MergeSizer) Thresholds() (splitSizeBytes, splitKeyCount uint64) {
+	rate, ok := s.estimator.BytesPerSecond()
+	if !ok || s.targetDuration <= 0 {
+		return s.maxSizeBytes, s.maxKeyCount
+	}
+	size := uint64(rate * s.targetDuration.Seconds() / float64(s.rangesPerBatch))
+	if size < minMergeRegionSizeBytes {
+		size = minMergeRegionSizeBytes
+	}
+	if size >= s.maxSizeBytes {
+		return s.maxSizeBytes, s.maxKeyCount
+	}
+	keys := uint64(float64(s.maxKeyCount) * float64(size) / float64(s.maxSizeBytes))
+	if keys == 0 {
+		keys = 1
+	}
+	return size, keys
+}
@@ -0,0 +1,134 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package restore
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/log"
+	"github.com/pingcap/parser/model"
+	"go.uber.org/zap"
+
+	"github.com/pingcap/br/pkg/metautil"
+	"github.com/pingcap/br/pkg/summary"
+	"github.com/pingcap/br/pkg/utils"
+)
+
+// waitTiFlashReplicaInterval is the interval of checking whether the TiFlash
+// replicas are available.
+const waitTiFlashReplicaInterval = 10 * time.Second
+
+// TiFlashReplica is the TiFlash replica setting of a restored table.
+type TiFlashReplica struct {
+	DB             model.CIStr
+	Table          model.CIStr
+	Count          uint64
+	LocationLabels []string
+}
+
+// AlterSQL returns the DDL to set the TiFlash replica of the table.
+func (r TiFlashReplica) AlterSQL() string {
+	sql := fmt.Sprintf("ALTER TABLE %s.%s SET TIFLASH REPLICA %d",
+		utils.EncloseName(r.DB.O), utils.EncloseName(r.Table.O), r.Count)
+	if len(r.LocationLabels) == 0 {
+		return sql
+	}
+	labels := make([]string, 0, len(r.LocationLabels))
+	for _, label := range r.LocationLabels {
+		labels = append(labels, strconv.Quote(label))
+	}
+	return sql + " LOCATION LABELS " + strings.Join(labels, ", ")
+}
+
+// StashTiFlashReplicas clears the TiFlash replica settings of the tables and
+// returns them, so the tables are created without TiFlash replicas, the data
+// is only ingested into TiKV, and the replicas are re-created by
+// RestoreTiFlashReplicas afterwards. The backups of the old versions may only
+// record the replica count in the backupmeta.
+func StashTiFlashReplicas(tables []*metautil.Table) []TiFlashReplica {
+	replicas := make([]TiFlashReplica, 0)
+	for _, table := range tables {
+		replica := TiFlashReplica{DB: table.DB.Name, Table: table.Info.Name}
+		if info := table.Info.TiFlashReplica; info != nil {
+			replica.Count = info.Count
+			replica.LocationLabels = info.LocationLabels
+			table.Info.TiFlashReplica = nil
+		} else {
+			replica.Count = uint64(table.TiFlashReplicas)
+		}
+		if replica.Count > 0 {
+			replicas = append(replicas, replica)
+		}
+	}
+	return replicas
+}
+
+// RestoreTiFlashReplicas re-creates the TiFlash replicas of the restored
+// tables.
+func (rc *Client) RestoreTiFlashReplicas(ctx context.Context, replicas []TiFlashReplica) error {
+	if rc.db == nil || len(replicas) == 0 {
+		return nil
+	}
+	for _, replica := range replicas {
+		if err := rc.db.SetTiFlashReplica(ctx, replica); err != nil {
+			return errors.Annotatef(err, "failed to restore the tiflash replica of %s.%s",
+				replica.DB, replica.Table)
+		}
+	}
+	log.Info("tiflash replicas restored", zap.Int("tables", len(replicas)))
+	summary.CollectInt("tiflash replicas", len(replicas))
+	return nil
+}
+
+// WaitTiFlashReplicasReady waits until the TiFlash replicas of the tables are
+// available, or the timeout is reached. The replicas not ready in time are
+// only logged, since the data has been restored into TiKV.
+func (rc *Client) WaitTiFlashReplicasReady(
+	ctx context.Context, replicas []TiFlashReplica, timeout time.Duration,
+) error {
+	if rc.dom == nil || len(replicas) == 0 {
+		return nil
+	}
+	deadline := time.Now().Add(timeout)
+	pending := append([]TiFlashReplica{}, replicas...)
+	for {
+		if err := rc.dom.Reload(); err != nil {
+			return errors.Trace(err)
+		}
+		is := rc.dom.InfoSchema()
+		notReady := pending[:0]
+		for _, replica := range pending {
+			table, err := is.TableByName(replica.DB, replica.Table)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			if info := table.Meta().TiFlashReplica; info == nil || !info.Available {
+				notReady = append(notReady, replica)
+			}
+		}
+		pending = notReady
+		if len(pending) == 0 {
+			log.Info("tiflash replicas are available", zap.Int("tables", len(replicas)))
+			return nil
+		}
+		if time.Now().After(deadline) {
+			log.Warn("wait for tiflash replicas timeout, they will keep syncing in background",
+				zap.Int("not-ready", len(pending)),
+				zap.Stringer("first-db", pending[0].DB),
+				zap.Stringer("first-table", pending[0].Table))
+			summary.CollectInt("tiflash replicas not ready", len(pending))
+			return nil
+		}
+		log.Info("waiting for tiflash replicas", zap.Int("not-ready", len(pending)))
+		select {
+		case <-ctx.Done():
+			return errors.Trace(ctx.Err())
+		case <-time.After(waitTiFlashReplicaInterval):
+		}
+	}
+}
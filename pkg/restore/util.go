@@ -7,6 +7,7 @@ import (
 	"context"
 	"fmt"
 	"regexp"
+	"sort"
 	"strings"
 	"time"
 
@@ -28,6 +29,7 @@ import (
 	"github.com/pingcap/br/pkg/rtree"
 	"github.com/pingcap/br/pkg/summary"
 	"github.com/pingcap/br/pkg/utils"
+	"github.com/pingcap/br/pkg/version"
 )
 
 var (
@@ -76,10 +78,37 @@ func GetRewriteRules(
 	}
 
 	return &RewriteRules{
-		Data: dataRules,
+		Data:      dataRules,
+		SplitKeys: PartitionSplitKeys(newTable),
 	}
 }
 
+// PartitionSplitKeys returns the keys at the boundaries of every partition of
+// the table, so that each partition lands in its own regions even when the
+// backup file ranges span several partitions. It returns nil for a table
+// without partitions.
+func PartitionSplitKeys(table *model.TableInfo) [][]byte {
+	if table.Partition == nil || len(table.Partition.Definitions) == 0 {
+		return nil
+	}
+	keys := make([][]byte, 0, 2*len(table.Partition.Definitions))
+	for _, def := range table.Partition.Definitions {
+		keys = append(keys,
+			tablecodec.EncodeTablePrefix(def.ID),
+			tablecodec.EncodeTablePrefix(def.ID+1))
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return bytes.Compare(keys[i], keys[j]) < 0
+	})
+	uniq := keys[:1]
+	for _, key := range keys[1:] {
+		if !bytes.Equal(key, uniq[len(uniq)-1]) {
+			uniq = append(uniq, key)
+		}
+	}
+	return uniq
+}
+
 // GetSSTMetaFromFile compares the keys in file, region and rewrite rules, then returns a sst conn.
 // The range of the returned sst meta is [regionRule.NewKeyPrefix, append(regionRule.NewKeyPrefix, 0xff)].
 func GetSSTMetaFromFile(
@@ -94,6 +123,8 @@ func GetSSTMetaFromFile(
 		cfName = defaultCFName
 	} else if strings.Contains(file.GetName(), writeCFName) {
 		cfName = writeCFName
+	} else {
+		cfName = file.GetCf()
 	}
 	// Find the overlapped part between the file and the region.
 	// Here we rewrites the keys to compare with the keys of the region.
@@ -163,6 +194,31 @@ func EstimateRangeSize(files []*backuppb.File) int {
 	return result
 }
 
+// EstimateSplitKeys estimates the count of the keys to split at when the
+// files are restored, i.e. the count of the new regions, before the tables
+// are created. It counts the prefix of each table and the end keys of the
+// merged ranges, which are coalesced by targetSize the same as getSplitKeys.
+func EstimateSplitKeys(files []*backuppb.File, splitSizeBytes, splitKeyCount, targetSize uint64) (int, error) {
+	ranges, _, err := MergeFileRanges(files, splitSizeBytes, splitKeyCount)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	tables := make(map[int64]struct{})
+	prefixes := make([][]byte, 0)
+	for _, f := range files {
+		tableID := tablecodec.DecodeTableID(f.GetStartKey())
+		if _, ok := tables[tableID]; ok {
+			continue
+		}
+		tables[tableID] = struct{}{}
+		prefixes = append(prefixes, tablecodec.EncodeTablePrefix(tableID))
+	}
+	if targetSize == 0 {
+		return len(prefixes) + len(ranges), nil
+	}
+	return len(coalesceSplitKeys(ranges, prefixes, targetSize)), nil
+}
+
 // MapTableToFiles makes a map that mapping table ID to its backup files.
 // aware that one file can and only can hold one table.
 func MapTableToFiles(files []*backuppb.File) map[int64][]*backuppb.File {
@@ -189,15 +245,48 @@ func MapTableToFiles(files []*backuppb.File) map[int64][]*backuppb.File {
 
 // GoValidateFileRanges validate files by a stream of tables and yields
 // tables with range.
+// The files are filtered by the GarbageKeyFilter first if it isn't nil.
 func GoValidateFileRanges(
 	ctx context.Context,
 	tableStream <-chan CreatedTable,
 	fileOfTable map[int64][]*backuppb.File,
 	splitSizeBytes, splitKeyCount uint64,
+	filter *GarbageKeyFilter,
+	errCh chan<- error,
+) <-chan TableWithRange {
+	thresholds := func() (uint64, uint64) { return splitSizeBytes, splitKeyCount }
+	return goValidateFileRanges(ctx, tableStream, fileOfTable, thresholds, len(fileOfTable), filter, errCh)
+}
+
+// sizedRangesBufferSize is the count of the tables whose ranges are merged
+// ahead of the restore by the MergeSizer. It's small, so the ranges of most
+// tables are merged by the thresholds of the throughput observed by then.
+const sizedRangesBufferSize = 2
+
+// GoValidateFileRangesWithSizer is like GoValidateFileRanges, but merges the
+// small ranges of each table by the thresholds of the sizer at the time. Only
+// a few tables are merged ahead of the restore.
+func GoValidateFileRangesWithSizer(
+	ctx context.Context,
+	tableStream <-chan CreatedTable,
+	fileOfTable map[int64][]*backuppb.File,
+	sizer *MergeSizer,
+	filter *GarbageKeyFilter,
+	errCh chan<- error,
+) <-chan TableWithRange {
+	return goValidateFileRanges(ctx, tableStream, fileOfTable, sizer.Thresholds, sizedRangesBufferSize, filter, errCh)
+}
+
+func goValidateFileRanges(
+	ctx context.Context,
+	tableStream <-chan CreatedTable,
+	fileOfTable map[int64][]*backuppb.File,
+	thresholds func() (splitSizeBytes, splitKeyCount uint64),
+	outSize int,
+	filter *GarbageKeyFilter,
 	errCh chan<- error,
 ) <-chan TableWithRange {
-	// Could we have a smaller outCh size?
-	outCh := make(chan TableWithRange, len(fileOfTable))
+	outCh := make(chan TableWithRange, outSize)
 	go func() {
 		defer close(outCh)
 		defer log.Info("all range generated")
@@ -221,6 +310,9 @@ func GoValidateFileRanges(
 						files = append(files, fileOfTable[partition.ID]...)
 					}
 				}
+				if filter != nil {
+					files = filter.Filter(files, t.RewriteRule)
+				}
 				for _, file := range files {
 					err := ValidateFileRewriteRule(file, t.RewriteRule)
 					if err != nil {
@@ -229,6 +321,7 @@ func GoValidateFileRanges(
 					}
 				}
 				// Merge small ranges to reduce split and scatter regions.
+				splitSizeBytes, splitKeyCount := thresholds()
 				ranges, stat, err := MergeFileRanges(
 					files, splitSizeBytes, splitKeyCount)
 				if err != nil {
@@ -246,7 +339,8 @@ func GoValidateFileRanges(
 					zap.Int("Region(bytes avg)", stat.RegionBytesAvg),
 					zap.Int("Merged(regions)", stat.MergedRegions),
 					zap.Int("Merged(keys avg)", stat.MergedRegionKeysAvg),
-					zap.Int("Merged(bytes avg)", stat.MergedRegionBytesAvg))
+					zap.Int("Merged(bytes avg)", stat.MergedRegionBytesAvg),
+					zap.Uint64("Merge(size threshold)", splitSizeBytes))
 
 				tableWithRange := TableWithRange{
 					CreatedTable: t,
@@ -257,7 +351,12 @@ func GoValidateFileRanges(
 					zap.Int("files", len(files)),
 					zap.Int("range size", len(ranges)),
 					zap.Int("output channel size", len(outCh)))
-				outCh <- tableWithRange
+				select {
+				case <-ctx.Done():
+					errCh <- ctx.Err()
+					return
+				case outCh <- tableWithRange:
+				}
 			}
 		}
 	}()
@@ -267,7 +366,7 @@ func GoValidateFileRanges(
 // ValidateFileRewriteRule uses rewrite rules to validate the ranges of a file.
 func ValidateFileRewriteRule(file *backuppb.File, rewriteRules *RewriteRules) error {
 	// Check if the start key has a matched rewrite key
-	_, startRule := rewriteRawKey(file.GetStartKey(), rewriteRules)
+	_, startRule := rewriteRawKey(DefaultKeyCodec, file.GetStartKey(), rewriteRules)
 	if rewriteRules != nil && startRule == nil {
 		tableID := tablecodec.DecodeTableID(file.GetStartKey())
 		log.Error(
@@ -278,7 +377,7 @@ func ValidateFileRewriteRule(file *backuppb.File, rewriteRules *RewriteRules) er
 		return errors.Annotate(berrors.ErrRestoreInvalidRewrite, "cannot find rewrite rule")
 	}
 	// Check if the end key has a matched rewrite key
-	_, endRule := rewriteRawKey(file.GetEndKey(), rewriteRules)
+	_, endRule := rewriteRawKey(DefaultKeyCodec, file.GetEndKey(), rewriteRules)
 	if rewriteRules != nil && endRule == nil {
 		tableID := tablecodec.DecodeTableID(file.GetEndKey())
 		log.Error(
@@ -315,15 +414,16 @@ func ValidateFileRewriteRule(file *backuppb.File, rewriteRules *RewriteRules) er
 	return nil
 }
 
-// Rewrites a raw key and returns a encoded key.
-func rewriteRawKey(key []byte, rewriteRules *RewriteRules) ([]byte, *import_sstpb.RewriteRule) {
+// Rewrites a raw key and returns the key encoded by the codec, the same as
+// the keys of the regions split by the codec.
+func rewriteRawKey(keyCodec KeyCodec, key []byte, rewriteRules *RewriteRules) ([]byte, *import_sstpb.RewriteRule) {
 	if rewriteRules == nil {
-		return codec.EncodeBytes([]byte{}, key), nil
+		return keyCodec.EncodeKey(key), nil
 	}
 	if len(key) > 0 {
 		rule := matchOldPrefix(key, rewriteRules)
 		ret := bytes.Replace(key, rule.GetOldKeyPrefix(), rule.GetNewKeyPrefix(), 1)
-		return codec.EncodeBytes([]byte{}, ret), rule
+		return keyCodec.EncodeKey(ret), rule
 	}
 	return nil, nil
 }
@@ -353,6 +453,55 @@ func truncateTS(key []byte) []byte {
 	return key[:len(key)-8]
 }
 
+// newRegionSplitter returns a RegionSplitter configured by the client.
+func newRegionSplitter(client *Client) *RegionSplitter {
+	splitter := NewRegionSplitter(client.newSplitClient())
+	splitter.SetKeyCodec(client.getKeyCodec())
+	if client.rawKVSplitCheck {
+		splitter.SetRawKVSplitCheck(func(ctx context.Context) error {
+			return version.CheckClusterVersion(ctx, client.pdClient, version.CheckVersionForRawKVSplit)
+		})
+	}
+	if len(client.failureDomainLabel) > 0 {
+		splitter.SetFailureDomainCheck(client.failureDomainLabel, client.rescatterViolating)
+	}
+	splitter.SetScatterLeader(client.scatterLeader)
+	splitter.SetSkipScatter(client.skipScatter)
+	splitter.SetSplitTargetSize(client.splitTargetSize)
+	splitter.SetMemoryTracker(client.memory)
+	splitter.SetRegionNotFoundGrace(client.regionNotFoundGrace)
+	splitter.SetScatterWait(client.scatterWaitConcurrency, client.scatterWaitTimeout)
+	splitter.SetBackoffPolicy(client.backoffPolicy)
+	if client.regionHeartbeatInterval > 0 {
+		splitter.SetRegionHeartbeatInterval(client.regionHeartbeatInterval)
+	}
+	return splitter
+}
+
+// ScatterRange scatters the existing regions in the range again, with the
+// same retries and waits as scattering the new regions of restore. It's for
+// the restored ranges whose regions are left unscattered, e.g. scattering
+// timed out. It returns the number of the scattered regions.
+func ScatterRange(ctx context.Context, client *Client, startKey, endKey []byte) (scattered int, err error) {
+	splitter := newRegionSplitter(client)
+	err = retryPhaseOnPDLeaderChange(ctx, "scatter range", func() error {
+		scattered, err = splitter.ScatterRange(ctx, startKey, endKey)
+		return err
+	})
+	return scattered, err
+}
+
+// SplitRangeBySize splits the regions in the range larger than targetSize
+// by their approximate sizes, see RegionSplitter.SplitRangeBySize.
+func SplitRangeBySize(ctx context.Context, client *Client, startKey, endKey []byte, targetSize uint64) (split int, err error) {
+	splitter := newRegionSplitter(client)
+	err = retryPhaseOnPDLeaderChange(ctx, "split range by size", func() error {
+		split, err = splitter.SplitRangeBySize(ctx, startKey, endKey, targetSize)
+		return err
+	})
+	return split, err
+}
+
 // SplitRanges splits region by
 // 1. data range after rewrite.
 // 2. rewrite rules.
@@ -368,21 +517,45 @@ func SplitRanges(
 		elapsed := time.Since(start)
 		summary.CollectDuration("split region", elapsed)
 	}()
-	splitter := NewRegionSplitter(NewSplitClient(client.GetPDClient(), client.GetTLSConfig()))
-
-	return splitter.Split(ctx, ranges, rewriteRules, func(keys [][]byte) {
+	splitter := newRegionSplitter(client)
+	var onSplit OnSplitFunc = func(keys [][]byte) {
 		for range keys {
 			updateCh.Inc()
 		}
+	}
+	if cp := client.splitCheckpoint; cp != nil {
+		splitter.SetCheckpoint(cp)
+		onSplit = cp.OnSplit(ctx, onSplit)
+		defer func() {
+			if err := cp.Flush(ctx); err != nil {
+				log.Warn("failed to persist split checkpoint", zap.Error(err))
+			}
+		}()
+	}
+
+	return retryPhaseOnPDLeaderChange(ctx, "split and scatter", func() error {
+		if !client.splitWithoutScatter {
+			return splitter.Split(ctx, ranges, rewriteRules, onSplit)
+		}
+		newRegions, err := splitter.SplitWithoutScatter(ctx, ranges, rewriteRules, onSplit)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		log.Info("start to scatter regions", zap.Int("regions", len(newRegions)))
+		splitter.ScatterRegions(ctx, newRegions)
+		splitter.WaitForScatterRegions(ctx, newRegions)
+		return nil
 	})
 }
 
-func rewriteFileKeys(file *backuppb.File, rewriteRules *RewriteRules) (startKey, endKey []byte, err error) {
+func rewriteFileKeys(
+	keyCodec KeyCodec, file *backuppb.File, rewriteRules *RewriteRules,
+) (startKey, endKey []byte, err error) {
 	startID := tablecodec.DecodeTableID(file.GetStartKey())
 	endID := tablecodec.DecodeTableID(file.GetEndKey())
 	var rule *import_sstpb.RewriteRule
 	if startID == endID {
-		startKey, rule = rewriteRawKey(file.GetStartKey(), rewriteRules)
+		startKey, rule = rewriteRawKey(keyCodec, file.GetStartKey(), rewriteRules)
 		if rewriteRules != nil && rule == nil {
 			log.Error("cannot find rewrite rule",
 				logutil.Key("startKey", file.GetStartKey()),
@@ -390,7 +563,7 @@ func rewriteFileKeys(file *backuppb.File, rewriteRules *RewriteRules) (startKey,
 			err = errors.Annotate(berrors.ErrRestoreInvalidRewrite, "cannot find rewrite rule for start key")
 			return
 		}
-		endKey, rule = rewriteRawKey(file.GetEndKey(), rewriteRules)
+		endKey, rule = rewriteRawKey(keyCodec, file.GetEndKey(), rewriteRules)
 		if rewriteRules != nil && rule == nil {
 			err = errors.Annotate(berrors.ErrRestoreInvalidRewrite, "cannot find rewrite rule for end key")
 			return
@@ -446,3 +619,178 @@ func unQuoteName(name string) string {
 	name = strings.TrimPrefix(name, "`")
 	return strings.TrimSuffix(name, "`")
 }
+
+// The policies of handling the lock CF files found in a raw backup, see FilterLockCFFiles.
+const (
+	// LockCFFilesFail fails the restore with the list of the lock CF files.
+	LockCFFilesFail = "fail"
+	// LockCFFilesSkip skips the lock CF files with a warning.
+	LockCFFilesSkip = "skip"
+)
+
+// isLockCFFile checks whether the file contains the data of the lock CF,
+// either by its column family or by its name, which decides the CF of the SST
+// when ingesting (see GetSSTMetaFromFile).
+func isLockCFFile(file *backuppb.File) bool {
+	return file.GetCf() == lockCFName || strings.HasSuffix(file.GetName(), "_"+lockCFName+".sst")
+}
+
+// FilterLockCFFiles checks the files of a raw restore for the lock CF files,
+// which are never meant to be restored: the locks would block the reads and
+// writes of the restored keys. According to the policy, it either fails with
+// the list of them, or skips them with a warning.
+func FilterLockCFFiles(files []*backuppb.File, policy string) ([]*backuppb.File, error) {
+	if policy != LockCFFilesFail && policy != LockCFFilesSkip {
+		return nil, errors.Annotatef(berrors.ErrInvalidArgument,
+			"unknown policy %s for lock CF files, support %s|%s", policy, LockCFFilesFail, LockCFFilesSkip)
+	}
+	kept := make([]*backuppb.File, 0, len(files))
+	lockFiles := make([]string, 0)
+	for _, f := range files {
+		if isLockCFFile(f) {
+			lockFiles = append(lockFiles, f.GetName())
+			continue
+		}
+		kept = append(kept, f)
+	}
+	if len(lockFiles) == 0 {
+		return files, nil
+	}
+	if policy == LockCFFilesFail {
+		return nil, errors.Annotatef(berrors.ErrRestoreLockCFFiles,
+			"%d lock CF files: %s", len(lockFiles), strings.Join(lockFiles, ", "))
+	}
+	log.Warn("skip the lock CF files in the backup archive",
+		zap.Int("count", len(lockFiles)), zap.Strings("files", lockFiles))
+	summary.CollectInt("skipped lock cf files", len(lockFiles))
+	return kept, nil
+}
+
+// DedupFiles removes the duplicated files, i.e. the files with the same
+// content, column family and key range, so each of them is downloaded and
+// ingested only once. It returns the unique files in the original order.
+func DedupFiles(files []*backuppb.File) []*backuppb.File {
+	return NewFileDeduper().Dedup(files)
+}
+
+// FileDeduper removes the duplicated files across the pages of the files, see
+// DedupFiles. It only keeps the keys of the files seen.
+type FileDeduper struct {
+	seen map[fileKey]string
+}
+
+type fileKey struct {
+	sha256, cf, startKey, endKey string
+}
+
+// NewFileDeduper creates a FileDeduper.
+func NewFileDeduper() *FileDeduper {
+	return &FileDeduper{seen: make(map[fileKey]string)}
+}
+
+// Dedup returns the files not seen in the files passed before, in the
+// original order.
+func (d *FileDeduper) Dedup(files []*backuppb.File) []*backuppb.File {
+	unique := make([]*backuppb.File, 0, len(files))
+	for _, f := range files {
+		// Files without checksum cannot be compared by content.
+		if len(f.GetSha256()) == 0 {
+			unique = append(unique, f)
+			continue
+		}
+		key := fileKey{
+			sha256:   string(f.GetSha256()),
+			cf:       f.GetCf(),
+			startKey: string(f.GetStartKey()),
+			endKey:   string(f.GetEndKey()),
+		}
+		if origin, ok := d.seen[key]; ok {
+			log.Info("skip duplicated file",
+				zap.String("file", f.GetName()), zap.String("origin", origin))
+			continue
+		}
+		d.seen[key] = f.GetName()
+		unique = append(unique, f)
+	}
+	if dup := len(files) - len(unique); dup > 0 {
+		log.Info("deduplicate files", zap.Int("total", len(files)), zap.Int("duplicated", dup))
+	}
+	return unique
+}
+
+// CheckRawBackupChain checks that the raw backups can be restored one after
+// another, i.e. each incremental backup starts at the end of the previous one.
+func CheckRawBackupChain(metas []*backuppb.BackupMeta) error {
+	for i, meta := range metas {
+		if !meta.IsRawKv {
+			return errors.Annotatef(berrors.ErrRestoreModeMismatch,
+				"archive %d is transactional data, cannot do raw restore", i)
+		}
+		if i == 0 {
+			continue
+		}
+		prev := metas[i-1]
+		if meta.ClusterId != prev.ClusterId {
+			return errors.Annotatef(berrors.ErrBackupInvalidChain,
+				"archive %d is from cluster %d, but archive %d is from cluster %d",
+				i, meta.ClusterId, i-1, prev.ClusterId)
+		}
+		if meta.StartVersion == 0 {
+			return errors.Annotatef(berrors.ErrBackupInvalidChain, "archive %d is not an incremental backup", i)
+		}
+		if meta.StartVersion != prev.EndVersion {
+			return errors.Annotatef(berrors.ErrBackupInvalidChain,
+				"archive %d starts at %d, but archive %d ends at %d",
+				i, meta.StartVersion, i-1, prev.EndVersion)
+		}
+	}
+	return nil
+}
+
+// groupFilesByRange groups the files with the same key range, e.g. the files
+// of different column families of a region, in the order of their first
+// appearance.
+func groupFilesByRange(files []*backuppb.File) [][]*backuppb.File {
+	type rangeKey struct {
+		startKey, endKey string
+	}
+	index := make(map[rangeKey]int, len(files))
+	groups := make([][]*backuppb.File, 0, len(files))
+	for _, f := range files {
+		key := rangeKey{startKey: string(f.GetStartKey()), endKey: string(f.GetEndKey())}
+		i, ok := index[key]
+		if !ok {
+			i = len(groups)
+			index[key] = i
+			groups = append(groups, nil)
+		}
+		groups[i] = append(groups[i], f)
+	}
+	return groups
+}
+
+// groupFilesByOverlap groups the files whose key ranges overlap directly or
+// transitively, so the files of different column families covering the same
+// keys are in the same group even if their ranges differ. The groups are
+// sorted by the start key.
+func groupFilesByOverlap(files []*backuppb.File) [][]*backuppb.File {
+	sorted := append([]*backuppb.File(nil), files...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return bytes.Compare(sorted[i].GetStartKey(), sorted[j].GetStartKey()) < 0
+	})
+	groups := make([][]*backuppb.File, 0, len(sorted))
+	var groupEnd []byte
+	for _, f := range sorted {
+		n := len(groups)
+		if n == 0 || (len(groupEnd) != 0 && bytes.Compare(f.GetStartKey(), groupEnd) >= 0) {
+			groups = append(groups, []*backuppb.File{f})
+			groupEnd = f.GetEndKey()
+			continue
+		}
+		groups[n-1] = append(groups[n-1], f)
+		if len(groupEnd) != 0 && (len(f.GetEndKey()) == 0 || bytes.Compare(f.GetEndKey(), groupEnd) > 0) {
+			groupEnd = f.GetEndKey()
+		}
+	}
+	return groups
+}
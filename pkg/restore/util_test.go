@@ -10,6 +10,8 @@ import (
 	backuppb "github.com/pingcap/kvproto/pkg/backup"
 	"github.com/pingcap/kvproto/pkg/import_sstpb"
 	"github.com/pingcap/kvproto/pkg/metapb"
+	"github.com/pingcap/parser/model"
+	"github.com/pingcap/tidb/kv"
 	"github.com/pingcap/tidb/tablecodec"
 	"github.com/pingcap/tidb/util/codec"
 
@@ -167,6 +169,61 @@ func (s *testRestoreUtilSuite) TestValidateFileRewriteRule(c *C) {
 	c.Assert(err, ErrorMatches, ".*unexpected rewrite rules.*")
 }
 
+func (s *testRestoreUtilSuite) TestGarbageKeyFilter(c *C) {
+	recordPrefix := tablecodec.GenTableRecordPrefix(1)
+	indexPrefix := tablecodec.EncodeTableIndexPrefix(1, 1)
+	rules := &restore.RewriteRules{
+		Data: []*import_sstpb.RewriteRule{{
+			OldKeyPrefix: recordPrefix,
+			NewKeyPrefix: tablecodec.GenTableRecordPrefix(2),
+		}},
+	}
+	inRecord := &backuppb.File{
+		Name:     "in_record.sst",
+		StartKey: tablecodec.EncodeRowKeyWithHandle(1, kv.IntHandle(1)),
+		EndKey:   tablecodec.EncodeRowKeyWithHandle(1, kv.IntHandle(10)),
+	}
+	// The keys of the dropped index 1 are before the record keys.
+	orphanIndex := &backuppb.File{
+		Name:     "orphan_index.sst",
+		StartKey: append(append([]byte{}, indexPrefix...), 'a'),
+		EndKey:   append(append([]byte{}, indexPrefix...), 'z'),
+		TotalKvs: 7,
+	}
+	spanning := &backuppb.File{
+		Name:     "spanning.sst",
+		StartKey: append(append([]byte{}, indexPrefix...), 'a'),
+		EndKey:   tablecodec.EncodeRowKeyWithHandle(1, kv.IntHandle(5)),
+	}
+
+	filter := restore.NewGarbageKeyFilter()
+	files := filter.Filter([]*backuppb.File{inRecord, orphanIndex, spanning}, rules)
+	c.Assert(files, HasLen, 2)
+	c.Assert(files[0], Equals, inRecord)
+	c.Assert(files[1].Name, Equals, "spanning.sst")
+	c.Assert(files[1].StartKey, DeepEquals, []byte(recordPrefix))
+	c.Assert(files[1].EndKey, DeepEquals, spanning.EndKey)
+	// The input isn't modified.
+	c.Assert(spanning.StartKey, DeepEquals, orphanIndex.StartKey)
+	for _, f := range files {
+		c.Assert(restore.ValidateFileRewriteRule(f, rules), IsNil)
+	}
+	c.Assert(filter.DroppedFiles(), Equals, uint64(1))
+	c.Assert(filter.DroppedKVs(), Equals, uint64(7))
+	c.Assert(filter.TrimmedFiles(), Equals, uint64(1))
+
+	// The end key out of the rules is trimmed into the rule.
+	tail := &backuppb.File{
+		Name:     "tail.sst",
+		StartKey: tablecodec.EncodeRowKeyWithHandle(1, kv.IntHandle(5)),
+		EndKey:   tablecodec.EncodeTablePrefix(2),
+	}
+	files = filter.Filter([]*backuppb.File{tail}, rules)
+	c.Assert(files, HasLen, 1)
+	c.Assert(restore.ValidateFileRewriteRule(files[0], rules), IsNil)
+	c.Assert(filter.TrimmedFiles(), Equals, uint64(2))
+}
+
 func (s *testRestoreUtilSuite) TestPaginateScanRegion(c *C) {
 	peers := make([]*metapb.Peer, 1)
 	peers[0] = &metapb.Peer{
@@ -268,3 +325,217 @@ func (s *testRestoreUtilSuite) TestPaginateScanRegion(c *C) {
 	_, err = restore.PaginateScanRegion(ctx, NewTestClient(stores, regionMap, 0), []byte{2}, []byte{1}, 3)
 	c.Assert(err, ErrorMatches, ".*startKey >= endKey.*")
 }
+
+func (s *testRestoreUtilSuite) TestDedupFiles(c *C) {
+	files := []*backuppb.File{
+		{Name: "1_write.sst", Sha256: []byte("w"), Cf: "write", StartKey: []byte("a"), EndKey: []byte("b")},
+		{Name: "1_default.sst", Sha256: []byte("d"), Cf: "default", StartKey: []byte("a"), EndKey: []byte("b")},
+		{Name: "2_write.sst", Sha256: []byte("w"), Cf: "write", StartKey: []byte("a"), EndKey: []byte("b")},
+		// Same content of another range is not a duplicate.
+		{Name: "3_write.sst", Sha256: []byte("w"), Cf: "write", StartKey: []byte("b"), EndKey: []byte("c")},
+		{Name: "4_write.sst", Cf: "write", StartKey: []byte("a"), EndKey: []byte("b")},
+		{Name: "5_write.sst", Cf: "write", StartKey: []byte("a"), EndKey: []byte("b")},
+	}
+	unique := restore.DedupFiles(files)
+	names := make([]string, 0, len(unique))
+	for _, f := range unique {
+		names = append(names, f.Name)
+	}
+	c.Assert(names, DeepEquals, []string{"1_write.sst", "1_default.sst", "3_write.sst", "4_write.sst", "5_write.sst"})
+
+	// The duplicates across the pages are removed too.
+	deduper := restore.NewFileDeduper()
+	c.Assert(deduper.Dedup(files[:2]), HasLen, 2)
+	c.Assert(deduper.Dedup(files[2:4]), DeepEquals, files[3:4])
+}
+
+func (s *testRestoreUtilSuite) TestEstimateSplitKeys(c *C) {
+	file := func(tableID int64, handle int64) *backuppb.File {
+		return &backuppb.File{
+			Name:       "write.sst",
+			Cf:         "write",
+			StartKey:   tablecodec.EncodeRowKeyWithHandle(tableID, kv.IntHandle(handle)),
+			EndKey:     tablecodec.EncodeRowKeyWithHandle(tableID, kv.IntHandle(handle+1)),
+			TotalKvs:   1,
+			TotalBytes: 1,
+		}
+	}
+	files := []*backuppb.File{file(1, 1), file(1, 2), file(1, 3), file(2, 1)}
+
+	// Each range is split at, plus the prefix of each table.
+	keys, err := restore.EstimateSplitKeys(files, 1, 1, 0)
+	c.Assert(err, IsNil)
+	c.Assert(keys, Equals, 6)
+	// The ranges of a table are merged.
+	keys, err = restore.EstimateSplitKeys(files, 100, 100, 0)
+	c.Assert(err, IsNil)
+	c.Assert(keys, Equals, 4)
+	// The keys are coalesced by the target size across the tables, only the
+	// prefix of table 1 and the end of table 2 are split at.
+	keys, err = restore.EstimateSplitKeys(files, 1, 1, 100)
+	c.Assert(err, IsNil)
+	c.Assert(keys, Equals, 2)
+	keys, err = restore.EstimateSplitKeys(files, 1, 1, 2)
+	c.Assert(err, IsNil)
+	c.Assert(keys, Equals, 3)
+
+	keys, err = restore.EstimateSplitKeys(nil, 1, 1, 100)
+	c.Assert(err, IsNil)
+	c.Assert(keys, Equals, 0)
+}
+
+func (s *testRestoreUtilSuite) TestDedupFilesOfTables(c *C) {
+	file := func(name string, tableID int64) *backuppb.File {
+		return &backuppb.File{
+			Name:     name,
+			Sha256:   []byte("w"),
+			Cf:       "write",
+			StartKey: tablecodec.EncodeRowKeyWithHandle(tableID, kv.IntHandle(1)),
+			EndKey:   tablecodec.EncodeRowKeyWithHandle(tableID, kv.IntHandle(10)),
+		}
+	}
+	// The same file of table 2 is recorded twice, e.g. by a table and its partition.
+	t1 := []*backuppb.File{file("1_write.sst", 1), file("2_write.sst", 2)}
+	t2 := []*backuppb.File{file("3_write.sst", 2)}
+
+	fileOfTable := restore.MapTableToFiles(restore.DedupFiles(append(t1, t2...)))
+	c.Assert(fileOfTable, HasLen, 2)
+	c.Assert(fileOfTable[1], HasLen, 1)
+	c.Assert(fileOfTable[2], HasLen, 1)
+	c.Assert(fileOfTable[2][0].Name, Equals, "2_write.sst")
+}
+
+func (s *testRestoreUtilSuite) TestParseKeyCodec(c *C) {
+	key := []byte("key")
+
+	mc, err := restore.ParseKeyCodec(restore.KeyCodecMemComparable)
+	c.Assert(err, IsNil)
+	encoded := mc.EncodeKey(key)
+	c.Assert(encoded, DeepEquals, codec.EncodeBytes(nil, key))
+	decoded, err := mc.DecodeKey(encoded)
+	c.Assert(err, IsNil)
+	c.Assert(decoded, DeepEquals, key)
+
+	ic, err := restore.ParseKeyCodec("IDENTITY")
+	c.Assert(err, IsNil)
+	c.Assert(ic.EncodeKey(key), DeepEquals, key)
+	decoded, err = ic.DecodeKey(key)
+	c.Assert(err, IsNil)
+	c.Assert(decoded, DeepEquals, key)
+
+	_, err = restore.ParseKeyCodec("base64")
+	c.Assert(err, ErrorMatches, ".*unknown key codec base64.*")
+}
+
+func (s *testRestoreUtilSuite) TestParseGRPCCompression(c *C) {
+	for _, name := range []string{"", "none", "NONE"} {
+		compressor, err := restore.ParseGRPCCompression(name)
+		c.Assert(err, IsNil)
+		c.Assert(compressor, Equals, "")
+	}
+	compressor, err := restore.ParseGRPCCompression("gzip")
+	c.Assert(err, IsNil)
+	c.Assert(compressor, Equals, "gzip")
+
+	_, err = restore.ParseGRPCCompression("zstd")
+	c.Assert(err, ErrorMatches, ".*unknown grpc compression zstd.*")
+}
+
+func (s *testRestoreUtilSuite) TestParseStoreAddressMap(c *C) {
+	addressMap, err := restore.ParseStoreAddressMap(nil)
+	c.Assert(err, IsNil)
+	c.Assert(addressMap, IsNil)
+
+	addressMap, err = restore.ParseStoreAddressMap([]string{
+		"tikv-0.tikv:20160=10.0.1.10:30160",
+		"tikv-1.tikv:20160=10.0.1.11:30160",
+	})
+	c.Assert(err, IsNil)
+	c.Assert(addressMap, DeepEquals, map[string]string{
+		"tikv-0.tikv:20160": "10.0.1.10:30160",
+		"tikv-1.tikv:20160": "10.0.1.11:30160",
+	})
+
+	_, err = restore.ParseStoreAddressMap([]string{"tikv-0.tikv:20160"})
+	c.Assert(err, ErrorMatches, ".*invalid store address rule 'tikv-0.tikv:20160'.*")
+	_, err = restore.ParseStoreAddressMap([]string{"a:1=b:1", "a:1=c:1"})
+	c.Assert(err, ErrorMatches, ".*duplicated store address a:1.*")
+}
+
+func (s *testRestoreUtilSuite) TestPartitionSplitKeys(c *C) {
+	c.Assert(restore.PartitionSplitKeys(&model.TableInfo{ID: 10}), IsNil)
+
+	newTable := &model.TableInfo{
+		ID:   10,
+		Name: model.NewCIStr("t"),
+		Partition: &model.PartitionInfo{
+			Definitions: []model.PartitionDefinition{
+				{ID: 13, Name: model.NewCIStr("p2")},
+				{ID: 11, Name: model.NewCIStr("p0")},
+				{ID: 12, Name: model.NewCIStr("p1")},
+			},
+		},
+	}
+	c.Assert(restore.PartitionSplitKeys(newTable), DeepEquals, [][]byte{
+		tablecodec.EncodeTablePrefix(11),
+		tablecodec.EncodeTablePrefix(12),
+		tablecodec.EncodeTablePrefix(13),
+		tablecodec.EncodeTablePrefix(14),
+	})
+
+	oldTable := &model.TableInfo{
+		ID:   20,
+		Name: model.NewCIStr("t"),
+		Partition: &model.PartitionInfo{
+			Definitions: []model.PartitionDefinition{
+				{ID: 21, Name: model.NewCIStr("p0")},
+				{ID: 22, Name: model.NewCIStr("p1")},
+				{ID: 23, Name: model.NewCIStr("p2")},
+			},
+		},
+	}
+	rules := restore.GetRewriteRules(newTable, oldTable, 0)
+	c.Assert(rules.SplitKeys, HasLen, 4)
+	merged := restore.EmptyRewriteRule()
+	merged.Append(*rules)
+	c.Assert(merged.SplitKeys, DeepEquals, rules.SplitKeys)
+}
+
+func (s *testRestoreUtilSuite) TestFilterLockCFFiles(c *C) {
+	files := []*backuppb.File{
+		{Name: "1_2_default.sst", Cf: "default"},
+		{Name: "1_2_lock.sst"},
+		{Name: "1_3_write.sst", Cf: "write"},
+		{Name: "1_4.sst", Cf: "lock"},
+	}
+	_, err := restore.FilterLockCFFiles(files, "ignore")
+	c.Assert(err, ErrorMatches, ".*unknown policy ignore.*")
+
+	_, err = restore.FilterLockCFFiles(files, restore.LockCFFilesFail)
+	c.Assert(err, ErrorMatches, ".*2 lock CF files: 1_2_lock.sst, 1_4.sst.*")
+
+	kept, err := restore.FilterLockCFFiles(files, restore.LockCFFilesSkip)
+	c.Assert(err, IsNil)
+	c.Assert(kept, DeepEquals, []*backuppb.File{files[0], files[2]})
+
+	kept, err = restore.FilterLockCFFiles(kept, restore.LockCFFilesFail)
+	c.Assert(err, IsNil)
+	c.Assert(kept, HasLen, 2)
+}
+
+func (s *testRestoreUtilSuite) TestCheckRawBackupChain(c *C) {
+	base := &backuppb.BackupMeta{IsRawKv: true, EndVersion: 10}
+	inc1 := &backuppb.BackupMeta{IsRawKv: true, StartVersion: 10, EndVersion: 20}
+	inc2 := &backuppb.BackupMeta{IsRawKv: true, StartVersion: 20, EndVersion: 30}
+	c.Assert(restore.CheckRawBackupChain([]*backuppb.BackupMeta{base}), IsNil)
+	c.Assert(restore.CheckRawBackupChain([]*backuppb.BackupMeta{base, inc1, inc2}), IsNil)
+
+	err := restore.CheckRawBackupChain([]*backuppb.BackupMeta{base, inc2})
+	c.Assert(err, ErrorMatches, ".*archive 1 starts at 20, but archive 0 ends at 10.*")
+	err = restore.CheckRawBackupChain([]*backuppb.BackupMeta{base, {IsRawKv: true, EndVersion: 20}})
+	c.Assert(err, ErrorMatches, ".*not an incremental backup.*")
+	err = restore.CheckRawBackupChain([]*backuppb.BackupMeta{base, {StartVersion: 10, EndVersion: 20}})
+	c.Assert(err, ErrorMatches, ".*archive 1 is transactional data.*")
+	err = restore.CheckRawBackupChain([]*backuppb.BackupMeta{base, {IsRawKv: true, ClusterId: 1, StartVersion: 10}})
+	c.Assert(err, ErrorMatches, ".*archive 1 is from cluster 1.*")
+}
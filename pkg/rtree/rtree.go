@@ -4,6 +4,7 @@ package rtree
 
 import (
 	"bytes"
+	"sort"
 
 	"github.com/google/btree"
 	backuppb "github.com/pingcap/kvproto/pkg/backup"
@@ -67,6 +68,38 @@ func (rg *Range) Contains(key []byte) bool {
 		(len(end) == 0 || bytes.Compare(key, end) < 0)
 }
 
+// SubtractRanges returns the sorted parts of the range which are not covered
+// by any of the ranges, the ranges may overlap. Empty end key means the max
+// key.
+func SubtractRanges(rg Range, ranges []Range) []Range {
+	sorted := append([]Range{}, ranges...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return bytes.Compare(sorted[i].StartKey, sorted[j].StartKey) < 0
+	})
+	result := make([]Range, 0, len(sorted)+1)
+	cursor := rg.StartKey
+	for _, r := range sorted {
+		if len(r.EndKey) != 0 && bytes.Compare(r.EndKey, cursor) <= 0 {
+			continue
+		}
+		if len(rg.EndKey) != 0 && bytes.Compare(r.StartKey, rg.EndKey) >= 0 {
+			break
+		}
+		if bytes.Compare(r.StartKey, cursor) > 0 {
+			result = append(result, Range{StartKey: cursor, EndKey: r.StartKey})
+		}
+		if len(r.EndKey) == 0 {
+			// The rest of the range is covered.
+			return result
+		}
+		cursor = r.EndKey
+	}
+	if len(rg.EndKey) == 0 || bytes.Compare(cursor, rg.EndKey) < 0 {
+		result = append(result, Range{StartKey: cursor, EndKey: rg.EndKey})
+	}
+	return result
+}
+
 // Less impls btree.Item.
 func (rg *Range) Less(than btree.Item) bool {
 	// rg.StartKey < than.StartKey
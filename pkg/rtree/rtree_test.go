@@ -174,6 +174,22 @@ func (s *testRangeTreeSuite) TestRangeIntersect(c *C) {
 	c.Assert(end, DeepEquals, []byte(nil))
 }
 
+func (s *testRangeTreeSuite) TestSubtractRanges(c *C) {
+	rg := func(start, end string) rtree.Range {
+		return rtree.Range{StartKey: []byte(start), EndKey: []byte(end)}
+	}
+
+	c.Assert(rtree.SubtractRanges(rg("a", "z"), nil), DeepEquals, []rtree.Range{rg("a", "z")})
+	c.Assert(rtree.SubtractRanges(rg("a", "z"), []rtree.Range{rg("x", ""), rg("b", "d"), rg("c", "e")}),
+		DeepEquals, []rtree.Range{rg("a", "b"), rg("e", "x")})
+	c.Assert(rtree.SubtractRanges(rg("c", "f"), []rtree.Range{rg("a", "b"), rg("d", "e"), rg("g", "h")}),
+		DeepEquals, []rtree.Range{rg("c", "d"), rg("e", "f")})
+	c.Assert(rtree.SubtractRanges(rg("", ""), []rtree.Range{rg("b", "c")}),
+		DeepEquals, []rtree.Range{rg("", "b"), rg("c", "")})
+	c.Assert(rtree.SubtractRanges(rg("b", "c"), []rtree.Range{rg("a", "d")}), HasLen, 0)
+	c.Assert(rtree.SubtractRanges(rg("", ""), []rtree.Range{rg("", "")}), HasLen, 0)
+}
+
 func BenchmarkRangeTreeUpdate(b *testing.B) {
 	rangeTree := rtree.NewRangeTree()
 	for i := 0; i < b.N; i++ {
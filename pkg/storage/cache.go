@@ -0,0 +1,165 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package storage
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pingcap/errors"
+)
+
+// DefaultCacheSize is the default capacity in bytes of the storage created by
+// WithCache.
+const DefaultCacheSize = 64 * 1024 * 1024
+
+// cacheValidateInterval is the interval of validating a cached file by its
+// entity tag, the cached file is returned without validation within it.
+const cacheValidateInterval = 30 * time.Second
+
+// eTagger is implemented by the storages which can fetch the entity tag of a
+// file without reading its content.
+type eTagger interface {
+	ETag(ctx context.Context, name string) (string, error)
+}
+
+type cacheEntry struct {
+	name      string
+	eTag      string
+	data      []byte
+	validated time.Time
+}
+
+type withCache struct {
+	ExternalStorage
+	capacity         int
+	validateInterval time.Duration
+
+	mu      sync.Mutex
+	size    int
+	lru     *list.List
+	entries map[string]*list.Element
+}
+
+// WithCache returns an ExternalStorage which caches the contents returned by
+// ReadFile in a LRU cache of `capacity` bytes, so the files read repeatedly,
+// e.g. the backup meta and the schema files, are only downloaded once.
+//
+// The cached content is keyed by the file path and its entity tag if the
+// inner storage supports it, otherwise the files are assumed to be immutable
+// unless they are written through the returned storage. The entity tag is
+// fetched on a miss and at most every 30 seconds for a cached file, so a file
+// changed behind the cache may be returned stale within the interval. The
+// data returned by ReadFile may be shared and must not be modified.
+func WithCache(inner ExternalStorage, capacity int) ExternalStorage {
+	if capacity <= 0 {
+		return inner
+	}
+	return &withCache{
+		ExternalStorage:  inner,
+		capacity:         capacity,
+		validateInterval: cacheValidateInterval,
+		lru:              list.New(),
+		entries:          make(map[string]*list.Element),
+	}
+}
+
+// ReadFile implements ExternalStorage.ReadFile.
+func (c *withCache) ReadFile(ctx context.Context, name string) ([]byte, error) {
+	if data, ok := c.getValidated(name); ok {
+		return data, nil
+	}
+	eTag := ""
+	if t, ok := c.ExternalStorage.(eTagger); ok {
+		var err error
+		if eTag, err = t.ETag(ctx, name); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+	if data, ok := c.get(name, eTag); ok {
+		return data, nil
+	}
+	data, err := c.ExternalStorage.ReadFile(ctx, name)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	c.put(name, eTag, data)
+	return data, nil
+}
+
+// WriteFile implements ExternalStorage.WriteFile.
+func (c *withCache) WriteFile(ctx context.Context, name string, data []byte) error {
+	c.remove(name)
+	return c.ExternalStorage.WriteFile(ctx, name, data)
+}
+
+// Create implements ExternalStorage.Create.
+func (c *withCache) Create(ctx context.Context, name string) (ExternalFileWriter, error) {
+	c.remove(name)
+	return c.ExternalStorage.Create(ctx, name)
+}
+
+// getValidated returns the cached file validated within the interval.
+func (c *withCache) getValidated(name string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[name]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*cacheEntry)
+	if time.Since(entry.validated) >= c.validateInterval {
+		return nil, false
+	}
+	c.lru.MoveToFront(elem)
+	return entry.data, true
+}
+
+func (c *withCache) get(name, eTag string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[name]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*cacheEntry)
+	if entry.eTag != eTag {
+		c.removeElement(elem)
+		return nil, false
+	}
+	entry.validated = time.Now()
+	c.lru.MoveToFront(elem)
+	return entry.data, true
+}
+
+func (c *withCache) put(name, eTag string, data []byte) {
+	if len(data) > c.capacity {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[name]; ok {
+		c.removeElement(elem)
+	}
+	c.entries[name] = c.lru.PushFront(&cacheEntry{name: name, eTag: eTag, data: data, validated: time.Now()})
+	c.size += len(data)
+	for c.size > c.capacity {
+		c.removeElement(c.lru.Back())
+	}
+}
+
+func (c *withCache) remove(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[name]; ok {
+		c.removeElement(elem)
+	}
+}
+
+func (c *withCache) removeElement(elem *list.Element) {
+	entry := c.lru.Remove(elem).(*cacheEntry)
+	delete(c.entries, entry.name)
+	c.size -= len(entry.data)
+}
@@ -0,0 +1,106 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package storage
+
+import (
+	"context"
+
+	. "github.com/pingcap/check"
+)
+
+type countReadStorage struct {
+	*LocalStorage
+	reads int
+	eTags int
+}
+
+func (s *countReadStorage) ReadFile(ctx context.Context, name string) ([]byte, error) {
+	s.reads++
+	return s.LocalStorage.ReadFile(ctx, name)
+}
+
+func (s *countReadStorage) ETag(ctx context.Context, name string) (string, error) {
+	s.eTags++
+	return s.LocalStorage.ETag(ctx, name)
+}
+
+func (r *testStorageSuite) TestWithCache(c *C) {
+	ctx := context.Background()
+	local, err := NewLocalStorage(c.MkDir())
+	c.Assert(err, IsNil)
+	inner := &countReadStorage{LocalStorage: local}
+	s := WithCache(inner, 8)
+	// Validate the cached files on every read.
+	s.(*withCache).validateInterval = 0
+
+	c.Assert(inner.WriteFile(ctx, "a", []byte("aaaa")), IsNil)
+	c.Assert(inner.WriteFile(ctx, "b", []byte("bbbb")), IsNil)
+	for i := 0; i < 3; i++ {
+		data, err := s.ReadFile(ctx, "a")
+		c.Assert(err, IsNil)
+		c.Assert(data, DeepEquals, []byte("aaaa"))
+	}
+	c.Assert(inner.reads, Equals, 1)
+
+	// The file changed behind the cache is read again.
+	c.Assert(inner.WriteFile(ctx, "a", []byte("aaaaa")), IsNil)
+	data, err := s.ReadFile(ctx, "a")
+	c.Assert(err, IsNil)
+	c.Assert(data, DeepEquals, []byte("aaaaa"))
+	c.Assert(inner.reads, Equals, 2)
+
+	// The file written through the cache is read again.
+	c.Assert(s.WriteFile(ctx, "a", []byte("aaaa")), IsNil)
+	_, err = s.ReadFile(ctx, "a")
+	c.Assert(err, IsNil)
+	c.Assert(inner.reads, Equals, 3)
+
+	// Reading "b" evicts nothing, reading "c" evicts "a".
+	_, err = s.ReadFile(ctx, "b")
+	c.Assert(err, IsNil)
+	c.Assert(inner.WriteFile(ctx, "c", []byte("c")), IsNil)
+	_, err = s.ReadFile(ctx, "c")
+	c.Assert(err, IsNil)
+	c.Assert(inner.reads, Equals, 5)
+	_, err = s.ReadFile(ctx, "b")
+	c.Assert(err, IsNil)
+	c.Assert(inner.reads, Equals, 5)
+	_, err = s.ReadFile(ctx, "a")
+	c.Assert(err, IsNil)
+	c.Assert(inner.reads, Equals, 6)
+
+	c.Assert(WithCache(inner, 0), Equals, inner)
+}
+
+func (r *testStorageSuite) TestWithCacheValidateInterval(c *C) {
+	ctx := context.Background()
+	local, err := NewLocalStorage(c.MkDir())
+	c.Assert(err, IsNil)
+	inner := &countReadStorage{LocalStorage: local}
+	s := WithCache(inner, 8)
+
+	// The entity tag is fetched on a miss only.
+	c.Assert(inner.WriteFile(ctx, "a", []byte("aaaa")), IsNil)
+	for i := 0; i < 3; i++ {
+		data, err := s.ReadFile(ctx, "a")
+		c.Assert(err, IsNil)
+		c.Assert(data, DeepEquals, []byte("aaaa"))
+	}
+	c.Assert(inner.reads, Equals, 1)
+	c.Assert(inner.eTags, Equals, 1)
+
+	// The file changed behind the cache is stale within the interval.
+	c.Assert(inner.WriteFile(ctx, "a", []byte("aaaaa")), IsNil)
+	data, err := s.ReadFile(ctx, "a")
+	c.Assert(err, IsNil)
+	c.Assert(data, DeepEquals, []byte("aaaa"))
+	c.Assert(inner.eTags, Equals, 1)
+
+	// And it's validated after the interval.
+	s.(*withCache).validateInterval = 0
+	data, err = s.ReadFile(ctx, "a")
+	c.Assert(err, IsNil)
+	c.Assert(data, DeepEquals, []byte("aaaaa"))
+	c.Assert(inner.reads, Equals, 2)
+	c.Assert(inner.eTags, Equals, 2)
+}
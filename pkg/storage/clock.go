@@ -0,0 +1,67 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package storage
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pingcap/errors"
+
+	berrors "github.com/pingcap/br/pkg/errors"
+)
+
+// serverTimer is implemented by the storages which can report the current
+// time of the storage server.
+type serverTimer interface {
+	ServerTime(ctx context.Context) (time.Time, error)
+}
+
+// ServerTime returns the current time of the storage server, the time has a
+// precision of one second. The second return value is false if the storage
+// cannot report it.
+func ServerTime(ctx context.Context, s ExternalStorage) (time.Time, bool, error) {
+	for {
+		switch inner := s.(type) {
+		case serverTimer:
+			t, err := inner.ServerTime(ctx)
+			if err != nil {
+				return time.Time{}, false, errors.Trace(err)
+			}
+			return t, true, nil
+		case *withCache:
+			s = inner.ExternalStorage
+		case *withCompression:
+			s = inner.ExternalStorage
+		case *withEncryption:
+			s = inner.ExternalStorage
+		default:
+			return time.Time{}, false, nil
+		}
+	}
+}
+
+// ServerTime returns the time in the `Date` header of the response of a
+// HeadBucket request. The header is present even if the request is denied.
+func (rs *S3Storage) ServerTime(ctx context.Context) (time.Time, error) {
+	req, _ := rs.svc.HeadBucketRequest(&s3.HeadBucketInput{
+		Bucket: aws.String(rs.options.Bucket),
+	})
+	req.SetContext(ctx)
+	err := req.Send()
+	if req.HTTPResponse == nil {
+		return time.Time{}, annotateError(err, "failed to get the time of s3 bucket '%s'", rs.options.Bucket)
+	}
+	date := req.HTTPResponse.Header.Get("Date")
+	if date == "" {
+		return time.Time{}, errors.Annotatef(berrors.ErrStorageUnknown, "no date in the response of s3 bucket '%s'", rs.options.Bucket)
+	}
+	t, err := http.ParseTime(date)
+	if err != nil {
+		return time.Time{}, errors.Annotatef(berrors.ErrStorageUnknown, "invalid date '%s' in the response of s3 bucket '%s'", date, rs.options.Bucket)
+	}
+	return t, nil
+}
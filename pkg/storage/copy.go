@@ -0,0 +1,84 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"io"
+
+	"github.com/pingcap/errors"
+)
+
+// copyBufferSize is the size of the chunks streamed between the storages, it's
+// the min part size of the multipart uploads of S3.
+const copyBufferSize = 5 * 1024 * 1024
+
+// CopyFile streams the file from the source storage to the target storage
+// with the name dstName, without staging the whole file in memory or on the
+// local disk. It returns the size and the sha256 of the content copied.
+func CopyFile(ctx context.Context, src ExternalStorage, srcName string, dst ExternalStorage, dstName string) (int64, []byte, error) {
+	reader, err := src.Open(ctx, srcName)
+	if err != nil {
+		return 0, nil, errors.Trace(err)
+	}
+	defer reader.Close()
+	writer, err := dst.Create(ctx, dstName)
+	if err != nil {
+		return 0, nil, errors.Trace(err)
+	}
+	hash := sha256.New()
+	size, err := streamFile(reader, func(chunk []byte) error {
+		hash.Write(chunk)
+		_, err := writer.Write(ctx, chunk)
+		return errors.Trace(err)
+	})
+	if err != nil {
+		// Close the writer to release the resources, the error of the copy is
+		// more relevant.
+		_ = writer.Close(ctx)
+		return 0, nil, errors.Annotatef(err, "failed to copy %s", srcName)
+	}
+	if err = writer.Close(ctx); err != nil {
+		return 0, nil, errors.Annotatef(err, "failed to complete writing %s", dstName)
+	}
+	return size, hash.Sum(nil), nil
+}
+
+// FileSha256 streams the file in the storage, and returns its size and sha256.
+func FileSha256(ctx context.Context, s ExternalStorage, name string) (int64, []byte, error) {
+	reader, err := s.Open(ctx, name)
+	if err != nil {
+		return 0, nil, errors.Trace(err)
+	}
+	defer reader.Close()
+	hash := sha256.New()
+	size, err := streamFile(reader, func(chunk []byte) error {
+		hash.Write(chunk)
+		return nil
+	})
+	if err != nil {
+		return 0, nil, errors.Annotatef(err, "failed to read %s", name)
+	}
+	return size, hash.Sum(nil), nil
+}
+
+func streamFile(reader io.Reader, fn func(chunk []byte) error) (int64, error) {
+	buf := make([]byte, copyBufferSize)
+	var size int64
+	for {
+		n, err := io.ReadFull(reader, buf)
+		if n > 0 {
+			if errFn := fn(buf[:n]); errFn != nil {
+				return size, errors.Trace(errFn)
+			}
+			size += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF { // nolint:errorlint
+			return size, nil
+		}
+		if err != nil {
+			return size, errors.Trace(err)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+
+	. "github.com/pingcap/check"
+)
+
+type testCopySuite struct{}
+
+var _ = Suite(&testCopySuite{})
+
+func (r *testCopySuite) TestCopyFile(c *C) {
+	ctx := context.Background()
+	src, err := NewLocalStorage(c.MkDir())
+	c.Assert(err, IsNil)
+	dst, err := NewLocalStorage(c.MkDir())
+	c.Assert(err, IsNil)
+
+	// The content spans more than one chunk.
+	content := bytes.Repeat([]byte("0123456789"), copyBufferSize/5)
+	c.Assert(src.WriteFile(ctx, "1.sst", content), IsNil)
+	expected := sha256.Sum256(content)
+
+	size, sum, err := CopyFile(ctx, src, "1.sst", dst, "copied.sst")
+	c.Assert(err, IsNil)
+	c.Assert(size, Equals, int64(len(content)))
+	c.Assert(sum, DeepEquals, expected[:])
+
+	copied, err := dst.ReadFile(ctx, "copied.sst")
+	c.Assert(err, IsNil)
+	c.Assert(copied, DeepEquals, content)
+	size, sum, err = FileSha256(ctx, dst, "copied.sst")
+	c.Assert(err, IsNil)
+	c.Assert(size, Equals, int64(len(content)))
+	c.Assert(sum, DeepEquals, expected[:])
+
+	// An empty file is copied as well.
+	c.Assert(src.WriteFile(ctx, "empty", nil), IsNil)
+	size, _, err = CopyFile(ctx, src, "empty", dst, "empty")
+	c.Assert(err, IsNil)
+	c.Assert(size, Equals, int64(0))
+	exists, err := dst.FileExists(ctx, "empty")
+	c.Assert(err, IsNil)
+	c.Assert(exists, IsTrue)
+
+	_, _, err = CopyFile(ctx, src, "missing", dst, "missing")
+	c.Assert(err, NotNil)
+}
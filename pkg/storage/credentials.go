@@ -0,0 +1,151 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package storage
+
+import (
+	"os"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/gogo/protobuf/proto"
+	"github.com/pingcap/errors"
+	backuppb "github.com/pingcap/kvproto/pkg/backup"
+	"golang.org/x/oauth2"
+
+	berrors "github.com/pingcap/br/pkg/errors"
+)
+
+// CredentialsRefreshIntervalEnv is the environment variable of the interval
+// to reload the default credentials of the cloud storages, e.g. "15m".
+//
+// The default credentials are found through the environment variables, the
+// shared credentials files or the web identity token files, which may be
+// rotated by the environment during a multi-hour task. The SDKs cache them
+// until they are reported as expired, which short-lived session tokens often
+// aren't, so the requests fail with 403 after the tokens expire. Setting this
+// variable makes BR reload them periodically, and the requests sent to TiKV
+// carry the reloaded ones, see WithFreshCredentials. The static credentials
+// given by the storage URL or the flags are never reloaded.
+const CredentialsRefreshIntervalEnv = "BR_CREDENTIALS_REFRESH_INTERVAL"
+
+// credentialsRefreshInterval parses CredentialsRefreshIntervalEnv, zero means
+// the default credentials are never reloaded.
+func credentialsRefreshInterval() (time.Duration, error) {
+	value := os.Getenv(CredentialsRefreshIntervalEnv)
+	if value == "" {
+		return 0, nil
+	}
+	interval, err := time.ParseDuration(value)
+	if err != nil || interval < 0 {
+		return 0, errors.Annotatef(berrors.ErrStorageInvalidConfig,
+			"invalid %s '%s', it should be a duration like '15m'", CredentialsRefreshIntervalEnv, value)
+	}
+	return interval, nil
+}
+
+// refreshingProvider is an AWS credentials provider which reloads the inner
+// credentials when they are expired, or when they have been used for the
+// interval.
+type refreshingProvider struct {
+	inner    *credentials.Credentials
+	interval time.Duration
+	now      func() time.Time
+	expireAt time.Time
+}
+
+func newRefreshingCredentials(inner *credentials.Credentials, interval time.Duration) *credentials.Credentials {
+	return credentials.NewCredentials(&refreshingProvider{
+		inner:    inner,
+		interval: interval,
+		now:      time.Now,
+	})
+}
+
+// Retrieve implements credentials.Provider. The callers are serialized by
+// credentials.Credentials.
+func (p *refreshingProvider) Retrieve() (credentials.Value, error) {
+	p.inner.Expire()
+	value, err := p.inner.Get()
+	if err != nil {
+		return credentials.Value{}, errors.Trace(err)
+	}
+	p.expireAt = p.now().Add(p.interval)
+	return value, nil
+}
+
+// IsExpired implements credentials.Provider.
+func (p *refreshingProvider) IsExpired() bool {
+	return !p.now().Before(p.expireAt) || p.inner.IsExpired()
+}
+
+// refreshingTokenSource is an OAuth2 token source which reloads the inner
+// token source when it has been used for the interval.
+type refreshingTokenSource struct {
+	mu       sync.Mutex
+	load     func() (oauth2.TokenSource, error)
+	interval time.Duration
+	now      func() time.Time
+	src      oauth2.TokenSource
+	expireAt time.Time
+}
+
+func newRefreshingTokenSource(load func() (oauth2.TokenSource, error), interval time.Duration) *refreshingTokenSource {
+	return &refreshingTokenSource{
+		load:     load,
+		interval: interval,
+		now:      time.Now,
+	}
+}
+
+// Token implements oauth2.TokenSource.
+func (ts *refreshingTokenSource) Token() (*oauth2.Token, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if ts.src == nil || !ts.now().Before(ts.expireAt) {
+		src, err := ts.load()
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		ts.src = src
+		ts.expireAt = ts.now().Add(ts.interval)
+	}
+	token, err := ts.src.Token()
+	return token, errors.Trace(err)
+}
+
+// WithFreshCredentials returns the backend with the current default
+// credentials of the storage, if they are sent to TiKV. The credentials in the
+// backend are captured when the storage is created, so the requests built
+// from it fail after the credentials are rotated or expire during a long
+// task. The backend is returned as is if nothing is refreshed.
+func WithFreshCredentials(backend *backuppb.StorageBackend, s ExternalStorage) (*backuppb.StorageBackend, error) {
+	for {
+		switch inner := s.(type) {
+		case *S3Storage:
+			b, ok := backend.Backend.(*backuppb.StorageBackend_S3)
+			if !ok || !inner.sendDefaultCredentials {
+				return backend, nil
+			}
+			v, err := inner.session.Config.Credentials.Get()
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+			if v.AccessKeyID == b.S3.AccessKey && v.SecretAccessKey == b.S3.SecretAccessKey {
+				return backend, nil
+			}
+			s3 := proto.Clone(b.S3).(*backuppb.S3)
+			s3.AccessKey = v.AccessKeyID
+			s3.SecretAccessKey = v.SecretAccessKey
+			return &backuppb.StorageBackend{Backend: &backuppb.StorageBackend_S3{S3: s3}}, nil
+		case *withCache:
+			s = inner.ExternalStorage
+		case *withCompression:
+			s = inner.ExternalStorage
+		case *withEncryption:
+			s = inner.ExternalStorage
+		default:
+			return backend, nil
+		}
+	}
+}
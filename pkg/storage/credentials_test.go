@@ -0,0 +1,124 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package storage
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	. "github.com/pingcap/check"
+	backuppb "github.com/pingcap/kvproto/pkg/backup"
+	"golang.org/x/oauth2"
+)
+
+type countingProvider struct {
+	retrieved int
+}
+
+func (p *countingProvider) Retrieve() (credentials.Value, error) {
+	p.retrieved++
+	return credentials.Value{AccessKeyID: fmt.Sprintf("ak%d", p.retrieved)}, nil
+}
+
+func (p *countingProvider) IsExpired() bool {
+	return false
+}
+
+func (r *testStorageSuite) TestCredentialsRefreshInterval(c *C) {
+	defer os.Unsetenv(CredentialsRefreshIntervalEnv)
+	interval, err := credentialsRefreshInterval()
+	c.Assert(err, IsNil)
+	c.Assert(interval, Equals, time.Duration(0))
+
+	c.Assert(os.Setenv(CredentialsRefreshIntervalEnv, "15m"), IsNil)
+	interval, err = credentialsRefreshInterval()
+	c.Assert(err, IsNil)
+	c.Assert(interval, Equals, 15*time.Minute)
+
+	c.Assert(os.Setenv(CredentialsRefreshIntervalEnv, "-1s"), IsNil)
+	_, err = credentialsRefreshInterval()
+	c.Assert(err, ErrorMatches, ".*invalid BR_CREDENTIALS_REFRESH_INTERVAL '-1s'.*")
+}
+
+func (r *testStorageSuite) TestRefreshingCredentials(c *C) {
+	now := time.Unix(1000, 0)
+	inner := &countingProvider{}
+	provider := &refreshingProvider{
+		inner:    credentials.NewCredentials(inner),
+		interval: time.Minute,
+		now:      func() time.Time { return now },
+	}
+	creds := credentials.NewCredentials(provider)
+
+	value, err := creds.Get()
+	c.Assert(err, IsNil)
+	c.Assert(value.AccessKeyID, Equals, "ak1")
+	now = now.Add(30 * time.Second)
+	value, err = creds.Get()
+	c.Assert(err, IsNil)
+	c.Assert(value.AccessKeyID, Equals, "ak1")
+
+	// The inner provider never expires, but it's reloaded after the interval.
+	now = now.Add(30 * time.Second)
+	value, err = creds.Get()
+	c.Assert(err, IsNil)
+	c.Assert(value.AccessKeyID, Equals, "ak2")
+	c.Assert(inner.retrieved, Equals, 2)
+}
+
+func (r *testStorageSuite) TestRefreshingTokenSource(c *C) {
+	now := time.Unix(1000, 0)
+	loaded := 0
+	ts := newRefreshingTokenSource(func() (oauth2.TokenSource, error) {
+		loaded++
+		return oauth2.StaticTokenSource(&oauth2.Token{AccessToken: fmt.Sprintf("token%d", loaded)}), nil
+	}, time.Minute)
+	ts.now = func() time.Time { return now }
+
+	token, err := ts.Token()
+	c.Assert(err, IsNil)
+	c.Assert(token.AccessToken, Equals, "token1")
+	now = now.Add(59 * time.Second)
+	token, err = ts.Token()
+	c.Assert(err, IsNil)
+	c.Assert(token.AccessToken, Equals, "token1")
+
+	now = now.Add(time.Second)
+	token, err = ts.Token()
+	c.Assert(err, IsNil)
+	c.Assert(token.AccessToken, Equals, "token2")
+	c.Assert(loaded, Equals, 2)
+}
+
+func (r *testStorageSuite) TestWithFreshCredentials(c *C) {
+	creds := credentials.NewCredentials(&countingProvider{})
+	s := &S3Storage{
+		session:                &session.Session{Config: &aws.Config{Credentials: creds}},
+		sendDefaultCredentials: true,
+	}
+	backend := &backuppb.StorageBackend{Backend: &backuppb.StorageBackend_S3{
+		S3: &backuppb.S3{Bucket: "bucket", AccessKey: "ak1"},
+	}}
+	fresh, err := WithFreshCredentials(backend, s)
+	c.Assert(err, IsNil)
+	c.Assert(fresh, Equals, backend)
+
+	// The expired credentials are reloaded, and the backend isn't modified.
+	creds.Expire()
+	fresh, err = WithFreshCredentials(backend, &withCompression{ExternalStorage: s})
+	c.Assert(err, IsNil)
+	c.Assert(fresh.GetS3().AccessKey, Equals, "ak2")
+	c.Assert(fresh.GetS3().Bucket, Equals, "bucket")
+	c.Assert(backend.GetS3().AccessKey, Equals, "ak1")
+
+	// The static credentials aren't refreshed.
+	s.sendDefaultCredentials = false
+	creds.Expire()
+	fresh, err = WithFreshCredentials(backend, s)
+	c.Assert(err, IsNil)
+	c.Assert(fresh, Equals, backend)
+}
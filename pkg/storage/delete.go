@@ -0,0 +1,94 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package storage
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+
+	"cloud.google.com/go/storage"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pingcap/errors"
+)
+
+// fileDeleter is implemented by the storages which can delete a file.
+type fileDeleter interface {
+	DeleteFile(ctx context.Context, name string) error
+}
+
+// DeleteFile deletes the file in the storage, deleting a file which doesn't
+// exist isn't an error. The second return value is false if the storage
+// cannot delete files.
+func DeleteFile(ctx context.Context, s ExternalStorage, name string) (bool, error) {
+	for {
+		switch inner := s.(type) {
+		case fileDeleter:
+			if err := inner.DeleteFile(ctx, name); err != nil {
+				return false, errors.Trace(err)
+			}
+			return true, nil
+		case *withCache:
+			inner.remove(name)
+			s = inner.ExternalStorage
+		case *withCompression:
+			s = inner.ExternalStorage
+		case *withEncryption:
+			s = inner.ExternalStorage
+		default:
+			return false, nil
+		}
+	}
+}
+
+// CanDeleteFile returns whether DeleteFile can delete the files of the
+// storage.
+func CanDeleteFile(s ExternalStorage) bool {
+	for {
+		switch inner := s.(type) {
+		case fileDeleter:
+			return true
+		case *withCache:
+			s = inner.ExternalStorage
+		case *withCompression:
+			s = inner.ExternalStorage
+		case *withEncryption:
+			s = inner.ExternalStorage
+		default:
+			return false
+		}
+	}
+}
+
+// DeleteFile deletes the file from the local directory.
+func (l *LocalStorage) DeleteFile(ctx context.Context, name string) error {
+	err := os.Remove(filepath.Join(l.base, name))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return errors.Trace(err)
+}
+
+// DeleteFile deletes the object from the s3 bucket.
+func (rs *S3Storage) DeleteFile(ctx context.Context, name string) error {
+	_, err := rs.svc.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(rs.options.Bucket),
+		Key:    aws.String(rs.options.Prefix + name),
+	})
+	if err != nil {
+		return annotateError(err, "failed to delete s3 file, file info: input.bucket='%s', input.key='%s'",
+			rs.options.Bucket, rs.options.Prefix+name)
+	}
+	return nil
+}
+
+// DeleteFile deletes the object from the gcs bucket.
+func (s *gcsStorage) DeleteFile(ctx context.Context, name string) error {
+	err := s.bucket.Object(s.objectName(name)).Delete(ctx)
+	if err != nil && errors.Cause(err) != storage.ErrObjectNotExist {
+		return annotateError(err, "failed to delete gcs file, file info: input.bucket='%s', input.key='%s'",
+			s.gcs.Bucket, s.objectName(name))
+	}
+	return nil
+}
@@ -0,0 +1,412 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+
+	"github.com/pingcap/errors"
+
+	berrors "github.com/pingcap/br/pkg/errors"
+)
+
+// encryptedMagic is written at the beginning of the encrypted files, followed
+// by the nonce prefix. Neither a marshaled protobuf, a JSON nor a zstd frame
+// starts with a zero byte.
+var encryptedMagic = []byte("\x00BRENC\x02\x00")
+
+const (
+	gcmNonceLen        = 12
+	gcmTagLen          = 16
+	encryptedHeaderLen = 8 + gcmNonceLen
+	// encryptedChunkSize is the size of the plaintext sealed at once. Each
+	// chunk is authenticated alone, so the files can be read randomly.
+	encryptedChunkSize = 64 * 1024
+	sealedChunkSize    = encryptedChunkSize + gcmTagLen
+)
+
+type withEncryption struct {
+	ExternalStorage
+	key  []byte
+	aead cipher.AEAD
+	// plaintextFiles are the files allowed to be read without encryption.
+	plaintextFiles map[string]struct{}
+}
+
+// WithEncryption returns an ExternalStorage encrypting the files written
+// through it by AES-256-GCM with the 32-byte key, and decrypting the files
+// read through it. The files are sealed in chunks, so tampering, reordering
+// and truncation are all detected. Reading a file which isn't encrypted
+// fails, except the plaintextFiles.
+//
+// The SST files written by TiKV are encrypted by TiKV itself with the same
+// key, see ReadDataFileMapped.
+func WithEncryption(inner ExternalStorage, key []byte, plaintextFiles ...string) (ExternalStorage, error) {
+	if len(key) != 32 {
+		return nil, errors.Annotatef(berrors.ErrStorageInvalidConfig,
+			"the key of AES-256 should be 32 bytes, got %d bytes", len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	plaintext := make(map[string]struct{}, len(plaintextFiles))
+	for _, name := range plaintextFiles {
+		plaintext[name] = struct{}{}
+	}
+	return &withEncryption{ExternalStorage: inner, key: key, aead: aead, plaintextFiles: plaintext}, nil
+}
+
+func (w *withEncryption) newHeader() ([]byte, error) {
+	header := make([]byte, encryptedHeaderLen)
+	copy(header, encryptedMagic)
+	if _, err := io.ReadFull(rand.Reader, header[len(encryptedMagic):]); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return header, nil
+}
+
+// chunkNonce returns the nonce of the chunk, which is the nonce prefix with
+// the chunk index XORed into the last 8 bytes.
+func chunkNonce(header []byte, index uint64) []byte {
+	nonce := make([]byte, gcmNonceLen)
+	copy(nonce, header[len(encryptedMagic):])
+	binary.BigEndian.PutUint64(nonce[4:], binary.BigEndian.Uint64(nonce[4:])^index)
+	return nonce
+}
+
+// chunkAD is the additional data of the chunk, which marks the last chunk so
+// that a file truncated at a chunk boundary is detected.
+func chunkAD(final bool) []byte {
+	if final {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+func (w *withEncryption) sealChunk(dst, header []byte, index uint64, chunk []byte, final bool) []byte {
+	return w.aead.Seal(dst, chunkNonce(header, index), chunk, chunkAD(final))
+}
+
+// openChunk opens the sealed chunk, and returns whether it's the last chunk.
+// A full chunk may be the last one, so both are tried.
+func (w *withEncryption) openChunk(dst, header []byte, index uint64, sealed []byte) ([]byte, bool, error) {
+	nonce := chunkNonce(header, index)
+	if len(sealed) == sealedChunkSize {
+		if plain, err := w.aead.Open(dst, nonce, sealed, chunkAD(false)); err == nil {
+			return plain, false, nil
+		}
+	}
+	plain, err := w.aead.Open(dst, nonce, sealed, chunkAD(true))
+	if err != nil {
+		return nil, false, errors.Annotatef(berrors.ErrStorageDecryption,
+			"chunk %d is corrupted or the key mismatches", index)
+	}
+	return plain, true, nil
+}
+
+func (w *withEncryption) WriteFile(ctx context.Context, name string, data []byte) error {
+	header, err := w.newHeader()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	chunks := (len(data) + encryptedChunkSize - 1) / encryptedChunkSize
+	if chunks == 0 {
+		chunks = 1
+	}
+	encrypted := make([]byte, 0, len(header)+len(data)+chunks*gcmTagLen)
+	encrypted = append(encrypted, header...)
+	for i := 0; i < chunks; i++ {
+		end := (i + 1) * encryptedChunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+		encrypted = w.sealChunk(encrypted, header, uint64(i), data[i*encryptedChunkSize:end], i == chunks-1)
+	}
+	return w.ExternalStorage.WriteFile(ctx, name, encrypted)
+}
+
+func (w *withEncryption) notEncrypted(name string) error {
+	return errors.Annotatef(berrors.ErrStorageDecryption,
+		"the file %s isn't encrypted, but the backup is encrypted", name)
+}
+
+func (w *withEncryption) ReadFile(ctx context.Context, name string) ([]byte, error) {
+	data, err := w.ExternalStorage.ReadFile(ctx, name)
+	if err != nil {
+		return data, errors.Trace(err)
+	}
+	if !bytes.HasPrefix(data, encryptedMagic) {
+		if _, ok := w.plaintextFiles[name]; ok {
+			return data, nil
+		}
+		return nil, w.notEncrypted(name)
+	}
+	if len(data) < encryptedHeaderLen {
+		return nil, errors.Annotatef(berrors.ErrStorageDecryption, "the encrypted file %s is truncated", name)
+	}
+	header, sealed := data[:encryptedHeaderLen], data[encryptedHeaderLen:]
+	decrypted := make([]byte, 0, len(sealed))
+	for i := uint64(0); ; i++ {
+		n := len(sealed)
+		if n > sealedChunkSize {
+			n = sealedChunkSize
+		}
+		var final bool
+		decrypted, final, err = w.openChunk(decrypted, header, i, sealed[:n])
+		if err != nil {
+			return nil, errors.Annotatef(err, "failed to decrypt %s", name)
+		}
+		sealed = sealed[n:]
+		if final != (len(sealed) == 0) {
+			return nil, errors.Annotatef(berrors.ErrStorageDecryption, "the encrypted file %s is truncated", name)
+		}
+		if final {
+			return decrypted, nil
+		}
+	}
+}
+
+func (w *withEncryption) Create(ctx context.Context, name string) (ExternalFileWriter, error) {
+	writer, err := w.ExternalStorage.Create(ctx, name)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	header, err := w.newHeader()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return &encryptWriter{storage: w, writer: writer, header: header}, nil
+}
+
+func (w *withEncryption) Open(ctx context.Context, path string) (ExternalFileReader, error) {
+	reader, err := w.ExternalStorage.Open(ctx, path)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	header := make([]byte, encryptedHeaderLen)
+	n, err := io.ReadFull(reader, header)
+	if cause := errors.Cause(err); err != nil && cause != io.ErrUnexpectedEOF && cause != io.EOF { // nolint:errorlint
+		_ = reader.Close()
+		return nil, errors.Trace(err)
+	}
+	if !bytes.HasPrefix(header[:n], encryptedMagic) || n < encryptedHeaderLen {
+		if _, ok := w.plaintextFiles[path]; !ok {
+			_ = reader.Close()
+			return nil, w.notEncrypted(path)
+		}
+		// Read it from the beginning as it is.
+		if _, err = reader.Seek(0, io.SeekStart); err != nil {
+			_ = reader.Close()
+			return nil, errors.Trace(err)
+		}
+		return reader, nil
+	}
+	return &decryptReader{storage: w, reader: reader, header: header, chunk: -1}, nil
+}
+
+type encryptWriter struct {
+	storage *withEncryption
+	writer  ExternalFileWriter
+	header  []byte
+	// buf is the plaintext not sealed yet. A full chunk is kept until more
+	// data comes, as the last chunk is sealed differently.
+	buf    []byte
+	chunks uint64
+}
+
+func (w *encryptWriter) flush(ctx context.Context, chunk []byte, final bool) error {
+	sealed := make([]byte, 0, len(w.header)+len(chunk)+gcmTagLen)
+	if w.chunks == 0 {
+		sealed = append(sealed, w.header...)
+	}
+	sealed = w.storage.sealChunk(sealed, w.header, w.chunks, chunk, final)
+	w.chunks++
+	_, err := w.writer.Write(ctx, sealed)
+	return errors.Trace(err)
+}
+
+func (w *encryptWriter) Write(ctx context.Context, p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	sent := 0
+	for len(w.buf)-sent > encryptedChunkSize {
+		if err := w.flush(ctx, w.buf[sent:sent+encryptedChunkSize], false); err != nil {
+			return 0, errors.Trace(err)
+		}
+		sent += encryptedChunkSize
+	}
+	w.buf = append(w.buf[:0], w.buf[sent:]...)
+	return len(p), nil
+}
+
+func (w *encryptWriter) Close(ctx context.Context) error {
+	if err := w.flush(ctx, w.buf, true); err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(w.writer.Close(ctx))
+}
+
+type decryptReader struct {
+	storage *withEncryption
+	reader  ExternalFileReader
+	header  []byte
+	// chunk is the index of the chunk in buf, and pos is the position of the
+	// next read in it.
+	chunk int64
+	buf   []byte
+	pos   int
+	final bool
+	// next is the index of the chunk the inner reader is positioned at.
+	next   int64
+	sealed []byte
+}
+
+// load reads and opens the chunk.
+func (r *decryptReader) load(index int64) error {
+	if index != r.next {
+		if _, err := r.reader.Seek(encryptedHeaderLen+index*sealedChunkSize, io.SeekStart); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	if r.sealed == nil {
+		r.sealed = make([]byte, sealedChunkSize)
+	}
+	n, err := io.ReadFull(r.reader, r.sealed)
+	if cause := errors.Cause(err); err != nil && cause != io.ErrUnexpectedEOF && cause != io.EOF { // nolint:errorlint
+		return errors.Trace(err)
+	}
+	r.next = index + 1
+	if n == 0 {
+		return errors.Annotate(berrors.ErrStorageDecryption, "the encrypted file is truncated")
+	}
+	plain, final, err := r.storage.openChunk(r.buf[:0], r.header, uint64(index), r.sealed[:n])
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if !final && n < sealedChunkSize {
+		return errors.Annotate(berrors.ErrStorageDecryption, "the encrypted file is truncated")
+	}
+	r.chunk, r.buf, r.pos, r.final = index, plain, 0, final
+	return nil
+}
+
+func (r *decryptReader) Read(p []byte) (int, error) {
+	if r.pos == len(r.buf) {
+		if r.final {
+			return 0, io.EOF
+		}
+		if err := r.load(r.chunk + 1); err != nil {
+			return 0, errors.Trace(err)
+		}
+	}
+	n := copy(p, r.buf[r.pos:])
+	r.pos += n
+	return n, nil
+}
+
+func (r *decryptReader) Close() error {
+	return r.reader.Close()
+}
+
+// plaintextSize returns the size of the plaintext from the size of the file.
+func (r *decryptReader) plaintextSize() (int64, error) {
+	size, err := r.reader.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	// The inner reader isn't positioned at a chunk any more.
+	r.next = -1
+	sealed := size - encryptedHeaderLen
+	chunks := (sealed + sealedChunkSize - 1) / sealedChunkSize
+	if chunks == 0 || sealed-chunks*gcmTagLen < 0 {
+		return 0, errors.Annotate(berrors.ErrStorageDecryption, "the encrypted file is truncated")
+	}
+	return sealed - chunks*gcmTagLen, nil
+}
+
+// Seek seeks the plaintext offset, the chunk of the offset is read and opened.
+func (r *decryptReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		if r.chunk >= 0 {
+			offset += r.chunk*encryptedChunkSize + int64(r.pos)
+		}
+	case io.SeekEnd:
+		size, err := r.plaintextSize()
+		if err != nil {
+			return 0, errors.Trace(err)
+		}
+		offset += size
+	default:
+		return 0, errors.Annotatef(berrors.ErrInvalidArgument, "invalid whence %d", whence)
+	}
+	if offset < 0 {
+		return 0, errors.Annotatef(berrors.ErrStorageInvalidConfig, "seek to a negative offset %d", offset)
+	}
+	// The offset at the end of a chunk is positioned in the chunk, so that
+	// the end of the last full chunk is reachable.
+	index := int64(0)
+	if offset > 0 {
+		index = (offset - 1) / encryptedChunkSize
+	}
+	if err := r.load(index); err != nil {
+		return 0, errors.Trace(err)
+	}
+	pos := offset - index*encryptedChunkSize
+	if pos > int64(len(r.buf)) {
+		return 0, errors.Annotatef(berrors.ErrStorageInvalidConfig, "seek beyond the end of the file to %d", offset)
+	}
+	r.pos = int(pos)
+	return offset, nil
+}
+
+// DecryptDataFile decrypts the SST file written by TiKV with the data key, as
+// TiKV encrypts it by AES-256-CTR with the IV recorded in the backupmeta.
+func (w *withEncryption) DecryptDataFile(name string, data, iv []byte) ([]byte, error) {
+	if len(iv) != aes.BlockSize {
+		return nil, errors.Annotatef(berrors.ErrStorageDecryption,
+			"the data file %s isn't encrypted, but the backup is encrypted", name)
+	}
+	block, err := aes.NewCipher(w.key)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	decrypted := make([]byte, len(data))
+	cipher.NewCTR(block, iv).XORKeyStream(decrypted, data)
+	return decrypted, nil
+}
+
+// ReadDataFileMapped reads the SST file written by TiKV like ReadFileMapped.
+// If the storage is encrypted, the file is decrypted with its IV, and a file
+// without the IV is refused.
+func ReadDataFileMapped(ctx context.Context, s ExternalStorage, name string, iv []byte) ([]byte, func(), error) {
+	inner := s
+	if cached, ok := s.(*withCache); ok {
+		inner = cached.ExternalStorage
+	}
+	encrypted, ok := inner.(*withEncryption)
+	if !ok {
+		return ReadFileMapped(ctx, s, name)
+	}
+	data, release, err := ReadFileMapped(ctx, encrypted.ExternalStorage, name)
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+	defer release()
+	decrypted, err := encrypted.DecryptDataFile(name, data, iv)
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+	return decrypted, func() {}, nil
+}
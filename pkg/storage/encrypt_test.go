@@ -0,0 +1,210 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"io"
+	"time"
+
+	. "github.com/pingcap/check"
+	"github.com/pingcap/errors"
+
+	berrors "github.com/pingcap/br/pkg/errors"
+)
+
+type timedStorage struct {
+	ExternalStorage
+	now time.Time
+}
+
+func (s *timedStorage) ServerTime(context.Context) (time.Time, error) {
+	return s.now, nil
+}
+
+func (r *testStorageSuite) TestServerTimeWithEncryption(c *C) {
+	inner, err := NewLocalStorage(c.MkDir())
+	c.Assert(err, IsNil)
+	now := time.Unix(1600000000, 0)
+	s, err := WithEncryption(&timedStorage{ExternalStorage: inner, now: now}, bytes.Repeat([]byte{0x42}, 32))
+	c.Assert(err, IsNil)
+	t, ok, err := ServerTime(context.Background(), WithCache(s, DefaultCacheSize))
+	c.Assert(err, IsNil)
+	c.Assert(ok, IsTrue)
+	c.Assert(t.Equal(now), IsTrue)
+}
+
+func (r *testStorageSuite) TestWithEncryption(c *C) {
+	ctx := context.Background()
+	inner, err := NewLocalStorage(c.MkDir())
+	c.Assert(err, IsNil)
+	_, err = WithEncryption(inner, []byte("short"))
+	c.Assert(err, ErrorMatches, ".*should be 32 bytes.*")
+	key := bytes.Repeat([]byte{0x42}, 32)
+	s, err := WithEncryption(inner, key)
+	c.Assert(err, IsNil)
+
+	content := bytes.Repeat([]byte("hello, world! "), 10)
+	c.Assert(s.WriteFile(ctx, "meta", content), IsNil)
+	raw, err := inner.ReadFile(ctx, "meta")
+	c.Assert(err, IsNil)
+	c.Assert(bytes.Contains(raw, []byte("hello")), IsFalse)
+	read, err := s.ReadFile(ctx, "meta")
+	c.Assert(err, IsNil)
+	c.Assert(read, DeepEquals, content)
+
+	// The files not encrypted are refused, except the plaintext files.
+	c.Assert(inner.WriteFile(ctx, "plain", content), IsNil)
+	_, err = s.ReadFile(ctx, "plain")
+	c.Assert(errors.Cause(err), Equals, berrors.ErrStorageDecryption)
+	_, err = s.Open(ctx, "plain")
+	c.Assert(errors.Cause(err), Equals, berrors.ErrStorageDecryption)
+	plain, err := WithEncryption(inner, key, "plain")
+	c.Assert(err, IsNil)
+	read, err = plain.ReadFile(ctx, "plain")
+	c.Assert(err, IsNil)
+	c.Assert(read, DeepEquals, content)
+	reader, err := plain.Open(ctx, "plain")
+	c.Assert(err, IsNil)
+	read, err = io.ReadAll(reader)
+	c.Assert(err, IsNil)
+	c.Assert(read, DeepEquals, content)
+	c.Assert(reader.Close(), IsNil)
+
+	// Streaming write and read with seeking.
+	writer, err := s.Create(ctx, "stream")
+	c.Assert(err, IsNil)
+	_, err = writer.Write(ctx, content[:20])
+	c.Assert(err, IsNil)
+	_, err = writer.Write(ctx, content[20:])
+	c.Assert(err, IsNil)
+	c.Assert(writer.Close(ctx), IsNil)
+	reader, err = s.Open(ctx, "stream")
+	c.Assert(err, IsNil)
+	read, err = io.ReadAll(reader)
+	c.Assert(err, IsNil)
+	c.Assert(read, DeepEquals, content)
+	for _, offset := range []int64{0, 15, 16, 33, int64(len(content)) - 1} {
+		pos, err := reader.Seek(offset, io.SeekStart)
+		c.Assert(err, IsNil)
+		c.Assert(pos, Equals, offset)
+		read, err = io.ReadAll(reader)
+		c.Assert(err, IsNil)
+		c.Assert(read, DeepEquals, content[offset:])
+	}
+	c.Assert(reader.Close(), IsNil)
+
+	// A wrong key can't decrypt it.
+	wrong, err := WithEncryption(inner, bytes.Repeat([]byte{0x43}, 32))
+	c.Assert(err, IsNil)
+	_, err = wrong.ReadFile(ctx, "meta")
+	c.Assert(errors.Cause(err), Equals, berrors.ErrStorageDecryption)
+}
+
+func (r *testStorageSuite) TestEncryptionChunks(c *C) {
+	ctx := context.Background()
+	inner, err := NewLocalStorage(c.MkDir())
+	c.Assert(err, IsNil)
+	s, err := WithEncryption(inner, bytes.Repeat([]byte{0x42}, 32))
+	c.Assert(err, IsNil)
+
+	content := make([]byte, 2*encryptedChunkSize+100)
+	for i := range content {
+		content[i] = byte(i * 7)
+	}
+	for _, size := range []int{0, 1, encryptedChunkSize, len(content)} {
+		c.Assert(s.WriteFile(ctx, "whole", content[:size]), IsNil)
+		read, err := s.ReadFile(ctx, "whole")
+		c.Assert(err, IsNil)
+		c.Assert(read, HasLen, size)
+		c.Assert(bytes.Equal(read, content[:size]), IsTrue)
+
+		writer, err := s.Create(ctx, "stream")
+		c.Assert(err, IsNil)
+		for i := 0; i < size; i += 1000 {
+			end := i + 1000
+			if end > size {
+				end = size
+			}
+			_, err = writer.Write(ctx, content[i:end])
+			c.Assert(err, IsNil)
+		}
+		c.Assert(writer.Close(ctx), IsNil)
+		// Both ways write the same format.
+		read, err = s.ReadFile(ctx, "stream")
+		c.Assert(err, IsNil)
+		c.Assert(bytes.Equal(read, content[:size]), IsTrue)
+
+		reader, err := s.Open(ctx, "stream")
+		c.Assert(err, IsNil)
+		end, err := reader.Seek(0, io.SeekEnd)
+		c.Assert(err, IsNil)
+		c.Assert(end, Equals, int64(size))
+		for _, offset := range []int64{0, 1, encryptedChunkSize - 1, encryptedChunkSize, encryptedChunkSize + 1, int64(size)} {
+			if offset > int64(size) {
+				continue
+			}
+			pos, err := reader.Seek(offset, io.SeekStart)
+			c.Assert(err, IsNil)
+			c.Assert(pos, Equals, offset)
+			pos, err = reader.Seek(0, io.SeekCurrent)
+			c.Assert(err, IsNil)
+			c.Assert(pos, Equals, offset)
+			read, err = io.ReadAll(reader)
+			c.Assert(err, IsNil)
+			c.Assert(bytes.Equal(read, content[offset:size]), IsTrue, Commentf("size %d offset %d", size, offset))
+		}
+		c.Assert(reader.Close(), IsNil)
+	}
+
+	raw, err := inner.ReadFile(ctx, "whole")
+	c.Assert(err, IsNil)
+	// A modified byte is detected.
+	tampered := append([]byte{}, raw...)
+	tampered[encryptedHeaderLen+sealedChunkSize+10] ^= 1
+	c.Assert(inner.WriteFile(ctx, "tampered", tampered), IsNil)
+	_, err = s.ReadFile(ctx, "tampered")
+	c.Assert(errors.Cause(err), Equals, berrors.ErrStorageDecryption)
+	// The file truncated at a chunk boundary is detected.
+	c.Assert(inner.WriteFile(ctx, "truncated", raw[:encryptedHeaderLen+sealedChunkSize]), IsNil)
+	_, err = s.ReadFile(ctx, "truncated")
+	c.Assert(errors.Cause(err), Equals, berrors.ErrStorageDecryption)
+	reader, err := s.Open(ctx, "truncated")
+	c.Assert(err, IsNil)
+	_, err = io.ReadAll(reader)
+	c.Assert(errors.Cause(err), Equals, berrors.ErrStorageDecryption)
+	c.Assert(reader.Close(), IsNil)
+}
+
+func (r *testStorageSuite) TestReadDataFileMapped(c *C) {
+	ctx := context.Background()
+	inner, err := NewLocalStorage(c.MkDir())
+	c.Assert(err, IsNil)
+	key := bytes.Repeat([]byte{0x42}, 32)
+	iv := bytes.Repeat([]byte{0x01}, aes.BlockSize)
+	content := []byte("the content of the sst file")
+	// TiKV encrypts the SST files by AES-256-CTR.
+	block, err := aes.NewCipher(key)
+	c.Assert(err, IsNil)
+	encrypted := make([]byte, len(content))
+	cipher.NewCTR(block, iv).XORKeyStream(encrypted, content)
+	c.Assert(inner.WriteFile(ctx, "1.sst", encrypted), IsNil)
+
+	s, err := WithEncryption(inner, key)
+	c.Assert(err, IsNil)
+	data, release, err := ReadDataFileMapped(ctx, WithCache(s, DefaultCacheSize), "1.sst", iv)
+	c.Assert(err, IsNil)
+	c.Assert(data, DeepEquals, content)
+	release()
+	_, _, err = ReadDataFileMapped(ctx, s, "1.sst", nil)
+	c.Assert(errors.Cause(err), Equals, berrors.ErrStorageDecryption)
+
+	// The files are read as they are without encryption.
+	data, release, err = ReadDataFileMapped(ctx, inner, "1.sst", nil)
+	c.Assert(err, IsNil)
+	c.Assert(data, DeepEquals, encrypted)
+	release()
+}
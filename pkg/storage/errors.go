@@ -0,0 +1,111 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package storage
+
+import (
+	"io"
+	"net"
+	"net/http"
+
+	"cloud.google.com/go/storage"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pingcap/errors"
+	"google.golang.org/api/googleapi"
+
+	berrors "github.com/pingcap/br/pkg/errors"
+)
+
+// classifyError maps the error returned by a storage backend to one of the
+// typed storage errors:
+//
+//   - berrors.ErrStorageNotFound and berrors.ErrStorageInvalidPermission are
+//     permanent, retrying would not help;
+//   - berrors.ErrStorageTransient should be retried after backing off.
+//
+// It returns nil if the error cannot be classified.
+func classifyError(err error) *errors.Error {
+	cause := errors.Cause(err)
+	if e, ok := cause.(*errors.Error); ok { // nolint:errorlint
+		for _, typed := range []*errors.Error{
+			berrors.ErrStorageNotFound, berrors.ErrStorageInvalidPermission, berrors.ErrStorageTransient,
+		} {
+			if e.ID() == typed.ID() {
+				return typed
+			}
+		}
+		return nil
+	}
+
+	// s3
+	if aerr, ok := cause.(awserr.Error); ok { // nolint:errorlint
+		switch aerr.Code() {
+		case s3.ErrCodeNoSuchKey, s3.ErrCodeNoSuchBucket, notFound:
+			return berrors.ErrStorageNotFound
+		case "AccessDenied", "Forbidden", "InvalidAccessKeyId", "SignatureDoesNotMatch", "ExpiredToken":
+			return berrors.ErrStorageInvalidPermission
+		}
+		if request.IsErrorThrottle(aerr) || request.IsErrorRetryable(aerr) {
+			return berrors.ErrStorageTransient
+		}
+		if reqErr, ok := aerr.(awserr.RequestFailure); ok { // nolint:errorlint
+			return classifyHTTPStatus(reqErr.StatusCode())
+		}
+		return nil
+	}
+
+	// gcs
+	if cause == storage.ErrObjectNotExist || cause == storage.ErrBucketNotExist { // nolint:errorlint
+		return berrors.ErrStorageNotFound
+	}
+	if gerr, ok := cause.(*googleapi.Error); ok { // nolint:errorlint
+		return classifyHTTPStatus(gerr.Code)
+	}
+
+	if nerr, ok := cause.(net.Error); ok && (nerr.Timeout() || nerr.Temporary()) { // nolint:errorlint
+		return berrors.ErrStorageTransient
+	}
+	if cause == io.ErrUnexpectedEOF { // nolint:errorlint
+		return berrors.ErrStorageTransient
+	}
+	return nil
+}
+
+// classifyHTTPStatus maps the HTTP status code of a failed request to the
+// typed storage errors, or returns nil if the status cannot be classified.
+func classifyHTTPStatus(code int) *errors.Error {
+	switch {
+	case code == http.StatusNotFound:
+		return berrors.ErrStorageNotFound
+	case code == http.StatusUnauthorized || code == http.StatusForbidden:
+		return berrors.ErrStorageInvalidPermission
+	case code == http.StatusRequestTimeout || code == http.StatusTooManyRequests || code >= http.StatusInternalServerError:
+		return berrors.ErrStorageTransient
+	default:
+		return nil
+	}
+}
+
+// annotateError annotates the error returned by a storage backend, replacing
+// its cause with the typed storage error if it can be classified.
+func annotateError(err error, format string, args ...interface{}) error {
+	typed := classifyError(err)
+	if typed == nil {
+		return errors.Annotatef(err, format, args...)
+	}
+	return errors.Annotatef(typed, format+": %v", append(args, err)...)
+}
+
+// IsRetryableError checks whether the storage error is transient, so the
+// operation should be retried after backing off.
+func IsRetryableError(err error) bool {
+	return classifyError(err) == berrors.ErrStorageTransient
+}
+
+// IsPermanentError checks whether the storage error is permanent, e.g. the
+// object does not exist or the access is denied, so retrying is pointless.
+func IsPermanentError(err error) bool {
+	typed := classifyError(err)
+	return typed == berrors.ErrStorageNotFound || typed == berrors.ErrStorageInvalidPermission
+}
@@ -0,0 +1,55 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package storage
+
+import (
+	"io"
+	"net/http"
+
+	"cloud.google.com/go/storage"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	. "github.com/pingcap/check"
+	"github.com/pingcap/errors"
+	"google.golang.org/api/googleapi"
+
+	berrors "github.com/pingcap/br/pkg/errors"
+)
+
+func (r *testStorageSuite) TestClassifyError(c *C) {
+	cases := []struct {
+		err       error
+		retryable bool
+		permanent bool
+	}{
+		{awserr.New(s3.ErrCodeNoSuchKey, "no such key", nil), false, true},
+		{awserr.New("AccessDenied", "access denied", nil), false, true},
+		{awserr.New("SlowDown", "please reduce your request rate", nil), true, false},
+		{awserr.NewRequestFailure(awserr.New("InternalError", "internal error", nil), http.StatusInternalServerError, "id"), true, false},
+		{awserr.NewRequestFailure(awserr.New("Unknown", "forbidden", nil), http.StatusForbidden, "id"), false, true},
+		{storage.ErrObjectNotExist, false, true},
+		{&googleapi.Error{Code: http.StatusTooManyRequests}, true, false},
+		{&googleapi.Error{Code: http.StatusUnauthorized}, false, true},
+		{&googleapi.Error{Code: http.StatusBadRequest}, false, false},
+		{io.ErrUnexpectedEOF, true, false},
+		{errors.Trace(io.ErrUnexpectedEOF), true, false},
+		{berrors.ErrStorageTransient, true, false},
+		{errors.Annotate(berrors.ErrStorageNotFound, "file"), false, true},
+		{berrors.ErrStorageUnknown, false, false},
+		{errors.New("whatever"), false, false},
+	}
+	for i, cs := range cases {
+		c.Assert(IsRetryableError(cs.err), Equals, cs.retryable, Commentf("case %d: %v", i, cs.err))
+		c.Assert(IsPermanentError(cs.err), Equals, cs.permanent, Commentf("case %d: %v", i, cs.err))
+	}
+}
+
+func (r *testStorageSuite) TestAnnotateError(c *C) {
+	err := annotateError(awserr.New(s3.ErrCodeNoSuchKey, "no such key", nil), "failed to read '%s'", "backupmeta")
+	c.Assert(berrors.Is(err, berrors.ErrStorageNotFound), IsTrue)
+	c.Assert(err, ErrorMatches, ".*failed to read 'backupmeta'.*NoSuchKey.*")
+
+	origin := errors.New("whatever")
+	err = annotateError(origin, "failed to read '%s'", "backupmeta")
+	c.Assert(errors.Cause(err), Equals, origin)
+}
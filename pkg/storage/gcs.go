@@ -5,6 +5,7 @@ package storage
 import (
 	"context"
 	"io"
+	"net/http"
 	"os"
 	"path"
 	"strings"
@@ -15,9 +16,11 @@ import (
 	"github.com/pingcap/log"
 	"github.com/spf13/pflag"
 	"go.uber.org/zap"
+	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
 	"google.golang.org/api/iterator"
 	"google.golang.org/api/option"
+	htransport "google.golang.org/api/transport/http"
 
 	berrors "github.com/pingcap/br/pkg/errors"
 )
@@ -25,16 +28,18 @@ import (
 const (
 	gcsEndpointOption     = "gcs.endpoint"
 	gcsStorageClassOption = "gcs.storage-class"
+	gcsMetaStorageClass   = "gcs.meta-storage-class"
 	gcsPredefinedACL      = "gcs.predefined-acl"
 	gcsCredentialsFile    = "gcs.credentials-file"
 )
 
 // GCSBackendOptions are options for configuration the GCS storage.
 type GCSBackendOptions struct {
-	Endpoint        string `json:"endpoint" toml:"endpoint"`
-	StorageClass    string `json:"storage-class" toml:"storage-class"`
-	PredefinedACL   string `json:"predefined-acl" toml:"predefined-acl"`
-	CredentialsFile string `json:"credentials-file" toml:"credentials-file"`
+	Endpoint         string `json:"endpoint" toml:"endpoint"`
+	StorageClass     string `json:"storage-class" toml:"storage-class"`
+	MetaStorageClass string `json:"meta-storage-class" toml:"meta-storage-class"`
+	PredefinedACL    string `json:"predefined-acl" toml:"predefined-acl"`
+	CredentialsFile  string `json:"credentials-file" toml:"credentials-file"`
 }
 
 func (options *GCSBackendOptions) apply(gcs *backuppb.GCS) error {
@@ -56,6 +61,8 @@ func defineGCSFlags(flags *pflag.FlagSet) {
 	// TODO: remove experimental tag if it's stable
 	flags.String(gcsEndpointOption, "", "(experimental) Set the GCS endpoint URL")
 	flags.String(gcsStorageClassOption, "", "(experimental) Specify the GCS storage class for objects")
+	flags.String(gcsMetaStorageClass, "", "(experimental) Specify the GCS storage class for the metadata files "+
+		"written by BR, empty to use --gcs.storage-class")
 	flags.String(gcsPredefinedACL, "", "(experimental) Specify the GCS predefined acl for objects")
 	flags.String(gcsCredentialsFile, "", "(experimental) Set the GCS credentials file path")
 }
@@ -72,6 +79,11 @@ func (options *GCSBackendOptions) parseFromFlags(flags *pflag.FlagSet) error {
 		return errors.Trace(err)
 	}
 
+	options.MetaStorageClass, err = flags.GetString(gcsMetaStorageClass)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
 	options.PredefinedACL, err = flags.GetString(gcsPredefinedACL)
 	if err != nil {
 		return errors.Trace(err)
@@ -111,7 +123,7 @@ func (s *gcsStorage) ReadFile(ctx context.Context, name string) ([]byte, error)
 	object := s.objectName(name)
 	rc, err := s.bucket.Object(object).NewReader(ctx)
 	if err != nil {
-		return nil, errors.Annotatef(err,
+		return nil, annotateError(err,
 			"failed to read gcs file, file info: input.bucket='%s', input.key='%s'",
 			s.gcs.Bucket, object)
 	}
@@ -129,6 +141,16 @@ func (s *gcsStorage) ReadFile(ctx context.Context, name string) ([]byte, error)
 	return b, errors.Trace(err)
 }
 
+// ETag returns the entity tag of the file.
+func (s *gcsStorage) ETag(ctx context.Context, name string) (string, error) {
+	object := s.objectName(name)
+	attrs, err := s.bucket.Object(object).Attrs(ctx)
+	if err != nil {
+		return "", annotateError(err, "failed to get attributes of gcs file '%s'", object)
+	}
+	return attrs.Etag, nil
+}
+
 // FileExists return true if file exists.
 func (s *gcsStorage) FileExists(ctx context.Context, name string) (bool, error) {
 	object := s.objectName(name)
@@ -137,7 +159,7 @@ func (s *gcsStorage) FileExists(ctx context.Context, name string) (bool, error)
 		if errors.Cause(err) == storage.ErrObjectNotExist { // nolint:errorlint
 			return false, nil
 		}
-		return false, errors.Trace(err)
+		return false, annotateError(err, "failed to check gcs file '%s'", object)
 	}
 	return true, nil
 }
@@ -149,7 +171,7 @@ func (s *gcsStorage) Open(ctx context.Context, path string) (ExternalFileReader,
 
 	rc, err := handle.NewRangeReader(ctx, 0, -1)
 	if err != nil {
-		return nil, errors.Annotatef(err,
+		return nil, annotateError(err,
 			"failed to read gcs file, file info: input.bucket='%s', input.key='%s'",
 			s.gcs.Bucket, path)
 	}
@@ -194,7 +216,7 @@ func (s *gcsStorage) WalkDir(ctx context.Context, opt *WalkOption, fn func(strin
 			break
 		}
 		if err != nil {
-			return errors.Trace(err)
+			return annotateError(err, "failed to list gcs objects with prefix '%s'", prefix)
 		}
 		// when walk on specify directory, the result include storage.Prefix,
 		// which can not be reuse in other API(Open/Read) directly.
@@ -230,6 +252,10 @@ func newGCSStorage(ctx context.Context, gcs *backuppb.GCS, opts *ExternalStorage
 			if err != nil {
 				return nil, errors.Annotatef(berrors.ErrStorageInvalidConfig, "%v Or you should provide '--gcs.credentials_file'", err)
 			}
+			refreshInterval, err := credentialsRefreshInterval()
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
 			if opts.SendCredentials {
 				if len(creds.JSON) > 0 {
 					gcs.CredentialsBlob = string(creds.JSON)
@@ -238,7 +264,23 @@ func newGCSStorage(ctx context.Context, gcs *backuppb.GCS, opts *ExternalStorage
 						"You should provide '--gcs.credentials_file' when '--send-credentials-to-tikv' is true")
 				}
 			}
-			if creds != nil {
+			if refreshInterval > 0 {
+				log.Info("reload the default gcs credentials periodically", zap.Duration("interval", refreshInterval))
+				// The first load reuses the credentials found above.
+				loaded := creds
+				clientOps = append(clientOps, option.WithTokenSource(newRefreshingTokenSource(func() (oauth2.TokenSource, error) {
+					if loaded != nil {
+						src := loaded.TokenSource
+						loaded = nil
+						return src, nil
+					}
+					reloaded, err := google.FindDefaultCredentials(ctx, storage.ScopeReadWrite)
+					if err != nil {
+						return nil, errors.Trace(err)
+					}
+					return reloaded.TokenSource, nil
+				}, refreshInterval)))
+			} else if creds != nil {
 				clientOps = append(clientOps, option.WithCredentials(creds))
 			}
 		} else {
@@ -250,7 +292,15 @@ func newGCSStorage(ctx context.Context, gcs *backuppb.GCS, opts *ExternalStorage
 		clientOps = append(clientOps, option.WithEndpoint(gcs.Endpoint))
 	}
 	if opts.HTTPClient != nil {
-		clientOps = append(clientOps, option.WithHTTPClient(opts.HTTPClient))
+		// The client given by option.WithHTTPClient is used as it is, without
+		// the credentials, so they are applied by the transport wrapping the
+		// one of the HTTP client, e.g. the one trusting --storage-ca.
+		transportOps := append(clientOps[:len(clientOps):len(clientOps)], option.WithScopes(storage.ScopeReadWrite))
+		transport, err := htransport.NewTransport(ctx, opts.HTTPClient.Transport, transportOps...)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		clientOps = append(clientOps, option.WithHTTPClient(&http.Client{Transport: transport}))
 	}
 	client, err := storage.NewClient(ctx, clientOps...)
 	if err != nil {
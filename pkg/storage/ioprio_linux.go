@@ -0,0 +1,43 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+// +build linux
+
+package storage
+
+import (
+	"os"
+	"strconv"
+	"syscall"
+
+	"github.com/pingcap/errors"
+)
+
+const (
+	ioprioWhoProcess = 1
+	ioprioClassIdle  = 3
+	ioprioClassShift = 13
+)
+
+// setIdleIOPriority sets the I/O scheduling class of all threads of the
+// process to idle, like `ionice -c 3`, so the disk I/O of BR only takes the
+// bandwidth left by the other processes. The new threads inherit the class
+// from the thread creating them. It only takes effect with the I/O schedulers
+// supporting the priorities, e.g. BFQ.
+func setIdleIOPriority() error {
+	tasks, err := os.ReadDir("/proc/self/task")
+	if err != nil {
+		return errors.Trace(err)
+	}
+	for _, task := range tasks {
+		tid, err := strconv.Atoi(task.Name())
+		if err != nil {
+			continue
+		}
+		_, _, errno := syscall.Syscall(syscall.SYS_IOPRIO_SET,
+			ioprioWhoProcess, uintptr(tid), ioprioClassIdle<<ioprioClassShift)
+		if errno != 0 && errno != syscall.ESRCH {
+			return errors.Annotatef(errno, "failed to set the I/O priority of thread %d", tid)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,16 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+// +build !linux
+
+package storage
+
+import (
+	"github.com/pingcap/errors"
+
+	berrors "github.com/pingcap/br/pkg/errors"
+)
+
+// setIdleIOPriority is only supported on Linux.
+func setIdleIOPriority() error {
+	return errors.Annotate(berrors.ErrStorageInvalidConfig, "the idle I/O priority is only supported on Linux")
+}
@@ -5,10 +5,13 @@ package storage
 import (
 	"bufio"
 	"context"
+	"fmt"
 	"os"
 	"path/filepath"
 
 	"github.com/pingcap/errors"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
 )
 
 const (
@@ -23,13 +26,30 @@ const (
 // export for using in tests.
 type LocalStorage struct {
 	base string
+	// mmap makes ReadFileMapped map the files instead of reading them, see
+	// ExternalStorageOptions.MmapLocalFiles.
+	mmap bool
+	// writeLimiter paces the writes, see
+	// ExternalStorageOptions.LocalWriteRateLimit.
+	writeLimiter *localWriteLimiter
 }
 
 // WriteFile writes data to a file to storage.
 func (l *LocalStorage) WriteFile(ctx context.Context, name string, data []byte) error {
 	path := filepath.Join(l.base, name)
-	return os.WriteFile(path, data, localFilePerm)
+	if l.writeLimiter == nil {
+		return os.WriteFile(path, data, localFilePerm)
+	}
 	// the backup meta file _is_ intended to be world-readable.
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, localFilePerm)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	_, err = l.writeLimiter.write(ctx, data, file.Write)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return errors.Trace(err)
 }
 
 // ReadFile reads the file from the storage and returns the contents.
@@ -38,6 +58,44 @@ func (l *LocalStorage) ReadFile(ctx context.Context, name string) ([]byte, error
 	return os.ReadFile(path)
 }
 
+// ReadFileMapped returns the content of the file in the storage. If the
+// storage is a local storage created with MmapLocalFiles, the file is mapped
+// into memory instead of being read, and the content must not be used after
+// calling release. Otherwise the file is read by ReadFile.
+func ReadFileMapped(ctx context.Context, s ExternalStorage, name string) (data []byte, release func(), err error) {
+	inner := s
+	if cached, ok := s.(*withCache); ok {
+		inner = cached.ExternalStorage
+	}
+	if local, ok := inner.(*LocalStorage); ok && local.mmap {
+		path := filepath.Join(local.base, name)
+		data, unmap, err := mmapFile(path)
+		if err != nil {
+			return nil, nil, errors.Trace(err)
+		}
+		return data, func() {
+			if err := unmap(); err != nil {
+				log.Warn("failed to unmap file", zap.String("path", path), zap.Error(err))
+			}
+		}, nil
+	}
+	data, err = s.ReadFile(ctx, name)
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+	return data, func() {}, nil
+}
+
+// ETag returns the entity tag of the file, which is made of its size and
+// modification time.
+func (l *LocalStorage) ETag(ctx context.Context, name string) (string, error) {
+	stat, err := os.Stat(filepath.Join(l.base, name))
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	return fmt.Sprintf("%d-%d", stat.Size(), stat.ModTime().UnixNano()), nil
+}
+
 // FileExists implement ExternalStorage.FileExists.
 func (l *LocalStorage) FileExists(ctx context.Context, name string) (bool, error) {
 	path := filepath.Join(l.base, name)
@@ -97,7 +155,11 @@ func (l *LocalStorage) Create(ctx context.Context, name string) (ExternalFileWri
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
-	buf := bufio.NewWriter(file)
+	if l.writeLimiter == nil {
+		buf := bufio.NewWriter(file)
+		return newFlushStorageWriter(buf, buf, file), nil
+	}
+	buf := bufio.NewWriter(&limitedFile{ctx: ctx, limiter: l.writeLimiter, file: file})
 	return newFlushStorageWriter(buf, buf, file), nil
 }
 
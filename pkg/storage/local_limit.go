@@ -0,0 +1,88 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package storage
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pingcap/errors"
+)
+
+// localWriteChunkSize is the size of the chunks a rate-limited write is split
+// into, so a large write doesn't burst to the disk.
+const localWriteChunkSize = 1 << 20
+
+// localWriteLimiter paces the writes of the local storage to the rate, shared
+// by all the files written concurrently.
+type localWriteLimiter struct {
+	mu   sync.Mutex
+	rate float64 // bytes per second
+	next time.Time
+}
+
+func newLocalWriteLimiter(bytesPerSecond uint64) *localWriteLimiter {
+	if bytesPerSecond == 0 {
+		return nil
+	}
+	return &localWriteLimiter{rate: float64(bytesPerSecond)}
+}
+
+// wait reserves n bytes and waits until they can be written.
+func (l *localWriteLimiter) wait(ctx context.Context, n int) error {
+	if l == nil || n <= 0 {
+		return nil
+	}
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	start := l.next
+	l.next = l.next.Add(time.Duration(float64(n) / l.rate * float64(time.Second)))
+	l.mu.Unlock()
+
+	delay := time.Until(start)
+	if delay <= 0 {
+		return nil
+	}
+	select {
+	case <-ctx.Done():
+		return errors.Trace(ctx.Err())
+	case <-time.After(delay):
+		return nil
+	}
+}
+
+// write writes the data by write in chunks paced by the limiter.
+func (l *localWriteLimiter) write(ctx context.Context, data []byte, write func([]byte) (int, error)) (int, error) {
+	written := 0
+	for len(data) > 0 {
+		chunk := data
+		if l != nil && len(chunk) > localWriteChunkSize {
+			chunk = chunk[:localWriteChunkSize]
+		}
+		if err := l.wait(ctx, len(chunk)); err != nil {
+			return written, errors.Trace(err)
+		}
+		n, err := write(chunk)
+		written += n
+		if err != nil {
+			return written, errors.Trace(err)
+		}
+		data = data[n:]
+	}
+	return written, nil
+}
+
+// limitedFile is a file whose writes are paced by the limiter.
+type limitedFile struct {
+	ctx     context.Context
+	limiter *localWriteLimiter
+	file    interface{ Write([]byte) (int, error) }
+}
+
+func (f *limitedFile) Write(p []byte) (int, error) {
+	return f.limiter.write(f.ctx, p, f.file.Write)
+}
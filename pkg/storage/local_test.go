@@ -3,12 +3,15 @@
 package storage
 
 import (
+	"bytes"
 	"context"
 	"os"
 	"path/filepath"
 	"runtime"
+	"time"
 
 	. "github.com/pingcap/check"
+	backuppb "github.com/pingcap/kvproto/pkg/backup"
 )
 
 type testLocalSuite struct{}
@@ -66,3 +69,93 @@ func (r *testStorageSuite) TestWalkDirWithSoftLinkFile(c *C) {
 	c.Assert(err, IsNil)
 	c.Assert(i, Equals, 2)
 }
+
+func (r *testLocalSuite) TestReadFileMapped(c *C) {
+	ctx := context.Background()
+	dir := c.MkDir()
+	c.Assert(os.WriteFile(filepath.Join(dir, "1.sst"), []byte("sst content"), localFilePerm), IsNil)
+	c.Assert(os.WriteFile(filepath.Join(dir, "empty.sst"), nil, localFilePerm), IsNil)
+
+	for _, mmap := range []bool{false, true} {
+		s, err := New(ctx, &backuppb.StorageBackend{
+			Backend: &backuppb.StorageBackend_Local{Local: &backuppb.Local{Path: dir}},
+		}, &ExternalStorageOptions{MmapLocalFiles: mmap})
+		c.Assert(err, IsNil)
+		c.Assert(s.(*LocalStorage).mmap, Equals, mmap)
+
+		// The cache doesn't hide the local storage.
+		for _, s := range []ExternalStorage{s, WithCache(s, DefaultCacheSize)} {
+			data, release, err := ReadFileMapped(ctx, s, "1.sst")
+			c.Assert(err, IsNil)
+			c.Assert(string(data), Equals, "sst content")
+			release()
+
+			data, release, err = ReadFileMapped(ctx, s, "empty.sst")
+			c.Assert(err, IsNil)
+			c.Assert(data, HasLen, 0)
+			release()
+
+			_, _, err = ReadFileMapped(ctx, s, "missing.sst")
+			c.Assert(err, NotNil)
+		}
+	}
+}
+
+func (r *testStorageSuite) TestLocalWriteRateLimit(c *C) {
+	ctx := context.Background()
+	dir := c.MkDir()
+	s, err := New(ctx, &backuppb.StorageBackend{
+		Backend: &backuppb.StorageBackend_Local{Local: &backuppb.Local{Path: dir}},
+	}, &ExternalStorageOptions{LocalWriteRateLimit: 10 * localWriteChunkSize})
+	c.Assert(err, IsNil)
+
+	// the first chunk is written at once, the rest 2 chunks take 0.2s.
+	data := bytes.Repeat([]byte{'x'}, 3*localWriteChunkSize)
+	start := time.Now()
+	c.Assert(s.WriteFile(ctx, "a", data), IsNil)
+	c.Assert(time.Since(start) >= 150*time.Millisecond, IsTrue)
+
+	w, err := s.Create(ctx, "b")
+	c.Assert(err, IsNil)
+	_, err = w.Write(ctx, data)
+	c.Assert(err, IsNil)
+	c.Assert(w.Close(ctx), IsNil)
+	for _, name := range []string{"a", "b"} {
+		content, err := s.ReadFile(ctx, name)
+		c.Assert(err, IsNil)
+		c.Assert(content, DeepEquals, data)
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	c.Assert(s.WriteFile(cancelled, "c", data), ErrorMatches, ".*context canceled.*")
+}
+
+func (r *testLocalSuite) TestDeleteFile(c *C) {
+	ctx := context.Background()
+	local, err := NewLocalStorage(c.MkDir())
+	c.Assert(err, IsNil)
+	s := WithCache(local, 1024)
+	c.Assert(s.WriteFile(ctx, "marker", []byte("data")), IsNil)
+	// The cached content is dropped along with the file.
+	_, err = s.ReadFile(ctx, "marker")
+	c.Assert(err, IsNil)
+
+	ok, err := DeleteFile(ctx, s, "marker")
+	c.Assert(err, IsNil)
+	c.Assert(ok, IsTrue)
+	exists, err := s.FileExists(ctx, "marker")
+	c.Assert(err, IsNil)
+	c.Assert(exists, IsFalse)
+	_, err = s.ReadFile(ctx, "marker")
+	c.Assert(err, NotNil)
+
+	// Deleting a missing file succeeds.
+	ok, err = DeleteFile(ctx, s, "marker")
+	c.Assert(err, IsNil)
+	c.Assert(ok, IsTrue)
+
+	ok, err = DeleteFile(ctx, &noopStorage{}, "marker")
+	c.Assert(err, IsNil)
+	c.Assert(ok, IsFalse)
+}
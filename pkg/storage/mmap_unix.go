@@ -0,0 +1,34 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+// +build !windows
+
+package storage
+
+import (
+	"os"
+	"syscall"
+
+	"github.com/pingcap/errors"
+)
+
+// mmapFile maps the whole file into memory read-only.
+func mmapFile(path string) ([]byte, func() error, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+	// The mapping is kept after the file is closed.
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+	if stat.Size() == 0 {
+		return []byte{}, func() error { return nil }, nil
+	}
+	data, err := syscall.Mmap(int(f.Fd()), 0, int(stat.Size()), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, nil, errors.Annotatef(err, "failed to mmap %s", path)
+	}
+	return data, func() error { return errors.Trace(syscall.Munmap(data)) }, nil
+}
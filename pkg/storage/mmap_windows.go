@@ -0,0 +1,20 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+// +build windows
+
+package storage
+
+import (
+	"os"
+
+	"github.com/pingcap/errors"
+)
+
+// mmapFile reads the whole file, mmap isn't supported on windows.
+func mmapFile(path string) ([]byte, func() error, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+	return data, func() error { return nil }, nil
+}
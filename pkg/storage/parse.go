@@ -9,6 +9,7 @@ import (
 	"strconv"
 	"strings"
 
+	"github.com/gogo/protobuf/proto"
 	"github.com/pingcap/errors"
 	backuppb "github.com/pingcap/kvproto/pkg/backup"
 
@@ -22,6 +23,40 @@ type BackendOptions struct {
 	GCS GCSBackendOptions `json:"gcs" toml:"gcs"`
 }
 
+// MetaStorageClass returns the storage class of the metadata files of the
+// backend, empty if it's the same as the SST files.
+func (options *BackendOptions) MetaStorageClass(backend *backuppb.StorageBackend) string {
+	switch backend.Backend.(type) {
+	case *backuppb.StorageBackend_S3:
+		return options.S3.MetaStorageClass
+	case *backuppb.StorageBackend_Gcs:
+		return options.GCS.MetaStorageClass
+	default:
+		return ""
+	}
+}
+
+// WithStorageClass returns a copy of the backend whose objects are written
+// in the storage class. The backend is returned as is if the storage class
+// is empty or the backend doesn't support storage classes.
+func WithStorageClass(backend *backuppb.StorageBackend, storageClass string) *backuppb.StorageBackend {
+	if len(storageClass) == 0 {
+		return backend
+	}
+	switch b := backend.Backend.(type) {
+	case *backuppb.StorageBackend_S3:
+		s3 := proto.Clone(b.S3).(*backuppb.S3)
+		s3.StorageClass = storageClass
+		return &backuppb.StorageBackend{Backend: &backuppb.StorageBackend_S3{S3: s3}}
+	case *backuppb.StorageBackend_Gcs:
+		gcs := proto.Clone(b.Gcs).(*backuppb.GCS)
+		gcs.StorageClass = storageClass
+		return &backuppb.StorageBackend{Backend: &backuppb.StorageBackend_Gcs{Gcs: gcs}}
+	default:
+		return backend
+	}
+}
+
 // ParseRawURL parse raw url to url object.
 func ParseRawURL(rawURL string) (*url.URL, error) {
 	// https://github.com/pingcap/br/issues/603
@@ -41,7 +76,16 @@ func ParseBackend(rawURL string, options *BackendOptions) (*backuppb.StorageBack
 	if len(rawURL) == 0 {
 		return nil, errors.Annotate(berrors.ErrStorageInvalidConfig, "empty store is not allowed")
 	}
-	u, err := ParseRawURL(rawURL)
+	var accessPoint *s3AccessPoint
+	parseURL := rawURL
+	if strings.HasPrefix(rawURL, "s3://") {
+		var rest string
+		accessPoint, rest = parseS3AccessPoint(strings.TrimPrefix(rawURL, "s3://"))
+		if accessPoint != nil {
+			parseURL = "s3://" + s3AccessPointHost + rest
+		}
+	}
+	u, err := ParseRawURL(parseURL)
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
@@ -72,6 +116,12 @@ func ParseBackend(rawURL string, options *BackendOptions) (*backuppb.StorageBack
 			options = &BackendOptions{S3: S3BackendOptions{ForcePathStyle: true}}
 		}
 		ExtractQueryParameters(u, &options.S3)
+		if accessPoint != nil {
+			s3.Bucket = accessPoint.arn
+			if err := accessPoint.apply(&options.S3); err != nil {
+				return nil, errors.Trace(err)
+			}
+		}
 		if err := options.S3.Apply(s3); err != nil {
 			return nil, errors.Trace(err)
 		}
@@ -161,6 +211,12 @@ func FormatBackendURL(backend *backuppb.StorageBackend) (u url.URL) {
 		u.Path = "/"
 	case *backuppb.StorageBackend_S3:
 		u.Scheme = "s3"
+		if isS3AccessPointARN(b.S3.Bucket) {
+			// The ARN would be escaped as a host.
+			prefix := url.URL{Path: "/" + strings.TrimPrefix(b.S3.Prefix, "/")}
+			u.Opaque = "//" + b.S3.Bucket + prefix.EscapedPath()
+			break
+		}
 		u.Host = b.S3.Bucket
 		u.Path = b.S3.Prefix
 	case *backuppb.StorageBackend_Gcs:
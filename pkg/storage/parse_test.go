@@ -137,6 +137,44 @@ func (r *testStorageSuite) TestCreateStorage(c *C) {
 	c.Assert(local.GetPath(), Equals, expectedLocalPath)
 }
 
+func (r *testStorageSuite) TestS3AccessPoint(c *C) {
+	s, err := ParseBackend("s3://arn:aws:s3:us-west-2:123456789012:accesspoint/my-ap/backup/full?sse=aws:kms", nil)
+	c.Assert(err, IsNil)
+	s3 := s.GetS3()
+	c.Assert(s3, NotNil)
+	c.Assert(s3.Bucket, Equals, "arn:aws:s3:us-west-2:123456789012:accesspoint/my-ap")
+	c.Assert(s3.Prefix, Equals, "backup/full")
+	c.Assert(s3.Region, Equals, "us-west-2")
+	c.Assert(s3.Sse, Equals, "aws:kms")
+	c.Assert(s3.ForcePathStyle, IsFalse)
+	u := FormatBackendURL(s)
+	s2, err := ParseBackend(u.String(), nil)
+	c.Assert(err, IsNil)
+	c.Assert(s2.GetS3().Bucket, Equals, s3.Bucket)
+	c.Assert(s2.GetS3().Prefix, Equals, s3.Prefix)
+
+	s, err = ParseBackend("s3://arn:aws-cn:s3:cn-north-1:123456789012:accesspoint:my-ap", nil)
+	c.Assert(err, IsNil)
+	c.Assert(s.GetS3().Bucket, Equals, "arn:aws-cn:s3:cn-north-1:123456789012:accesspoint:my-ap")
+	c.Assert(s.GetS3().Prefix, Equals, "")
+	c.Assert(s.GetS3().Region, Equals, "cn-north-1")
+
+	_, err = ParseBackend("s3://arn:aws:s3:us-west-2:123456789012:accesspoint/my-ap/prefix?region=us-east-1", nil)
+	c.Assert(err, ErrorMatches, "region us-east-1 conflicts with the region us-west-2.*")
+
+	_, err = ParseBackend("s3://arn:aws:s3::123456789012:accesspoint/mfzwi23gnjvgw.mrap/prefix", nil)
+	c.Assert(err, ErrorMatches, "multi-region access point .* is not supported yet.*")
+
+	// An access point alias is used as a normal bucket.
+	s, err = ParseBackend("s3://my-ap-hrzrlukc5m36ft7okagglf3gmwluquse1b-s3alias/prefix", nil)
+	c.Assert(err, IsNil)
+	c.Assert(s.GetS3().Bucket, Equals, "my-ap-hrzrlukc5m36ft7okagglf3gmwluquse1b-s3alias")
+
+	c.Assert(isS3AccessPointARN("arn:aws:s3:us-west-2:123456789012:accesspoint/my-ap"), IsTrue)
+	c.Assert(isS3AccessPointARN("arn:aws:s3:us-west-2:123456789012:accesspoint/my-ap/x"), IsFalse)
+	c.Assert(isS3AccessPointARN("bucket"), IsFalse)
+}
+
 func (r *testStorageSuite) TestFormatBackendURL(c *C) {
 	url := FormatBackendURL(&backuppb.StorageBackend{
 		Backend: &backuppb.StorageBackend_Local{
@@ -163,6 +201,16 @@ func (r *testStorageSuite) TestFormatBackendURL(c *C) {
 	})
 	c.Assert(url.String(), Equals, "s3://bucket/some%20prefix/")
 
+	url = FormatBackendURL(&backuppb.StorageBackend{
+		Backend: &backuppb.StorageBackend_S3{
+			S3: &backuppb.S3{
+				Bucket: "arn:aws:s3:us-west-2:123456789012:accesspoint/my-ap",
+				Prefix: "/some prefix/",
+			},
+		},
+	})
+	c.Assert(url.String(), Equals, "s3://arn:aws:s3:us-west-2:123456789012:accesspoint/my-ap/some%20prefix/")
+
 	url = FormatBackendURL(&backuppb.StorageBackend{
 		Backend: &backuppb.StorageBackend_Gcs{
 			Gcs: &backuppb.GCS{
@@ -174,3 +222,29 @@ func (r *testStorageSuite) TestFormatBackendURL(c *C) {
 	})
 	c.Assert(url.String(), Equals, "gcs://bucket/some%20prefix/")
 }
+
+func (r *testStorageSuite) TestMetaStorageClass(c *C) {
+	options := &BackendOptions{S3: S3BackendOptions{StorageClass: "GLACIER_IR"}}
+	s, err := ParseBackend("s3://bucket/prefix?meta-storage-class=STANDARD", options)
+	c.Assert(err, IsNil)
+	c.Assert(s.GetS3().StorageClass, Equals, "GLACIER_IR")
+	class := options.MetaStorageClass(s)
+	c.Assert(class, Equals, "STANDARD")
+
+	meta := WithStorageClass(s, class)
+	c.Assert(meta.GetS3().StorageClass, Equals, "STANDARD")
+	c.Assert(meta.GetS3().Bucket, Equals, "bucket")
+	// the backend sent to TiKV is untouched.
+	c.Assert(s.GetS3().StorageClass, Equals, "GLACIER_IR")
+	c.Assert(WithStorageClass(s, ""), Equals, s)
+
+	options = &BackendOptions{GCS: GCSBackendOptions{MetaStorageClass: "STANDARD"}}
+	s, err = ParseBackend("gcs://bucket/prefix", options)
+	c.Assert(err, IsNil)
+	c.Assert(WithStorageClass(s, options.MetaStorageClass(s)).GetGcs().StorageClass, Equals, "STANDARD")
+
+	s, err = ParseBackend("local:///tmp/storage", options)
+	c.Assert(err, IsNil)
+	c.Assert(options.MetaStorageClass(s), Equals, "")
+	c.Assert(WithStorageClass(s, "STANDARD"), Equals, s)
+}
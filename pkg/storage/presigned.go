@@ -0,0 +1,290 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/pingcap/errors"
+
+	berrors "github.com/pingcap/br/pkg/errors"
+)
+
+// URLSigner produces URLs which can be used to read an object without any
+// further credentials, e.g. the pre-signed URLs of S3 or the signed URLs of
+// GCS.
+type URLSigner interface {
+	// SignURL returns the URL for reading the object `name`, which is relative
+	// to the storage base path. It returns an error satisfying
+	// `berrors.ErrStorageInvalidConfig` if the object is unknown to the signer.
+	SignURL(ctx context.Context, name string) (string, error)
+}
+
+// URLSignerFunc adapts an ordinary function to an URLSigner.
+type URLSignerFunc func(ctx context.Context, name string) (string, error)
+
+// SignURL implements URLSigner.
+func (f URLSignerFunc) SignURL(ctx context.Context, name string) (string, error) {
+	return f(ctx, name)
+}
+
+// PresignedObject is an entry of the pre-signed URL manifest.
+type PresignedObject struct {
+	URL string `json:"url"`
+	// Size is the size of the object in bytes. It is only used by WalkDir, and
+	// may be left unset when it is unknown.
+	Size int64 `json:"size,omitempty"`
+}
+
+// URLManifest is an URLSigner which looks up the URLs from a fixed manifest.
+// Unlike an arbitrary URLSigner, a manifest also knows the full list of
+// objects, so the storage created from it supports WalkDir.
+type URLManifest struct {
+	objects map[string]PresignedObject
+}
+
+// NewURLManifest creates an URLManifest from the object name to URL mapping.
+func NewURLManifest(objects map[string]PresignedObject) *URLManifest {
+	return &URLManifest{objects: objects}
+}
+
+// LoadURLManifest reads an URLManifest from a local JSON file. The file
+// contains an object mapping object names to PresignedObject, for example
+//
+//	{"backupmeta": {"url": "https://bucket.s3.amazonaws.com/prefix/backupmeta?X-Amz-Signature=..."}}
+func LoadURLManifest(path string) (*URLManifest, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Annotatef(berrors.ErrStorageInvalidConfig, "failed to read pre-signed URL manifest %s: %v", path, err)
+	}
+	objects := make(map[string]PresignedObject)
+	if err := json.Unmarshal(content, &objects); err != nil {
+		return nil, errors.Annotatef(berrors.ErrStorageInvalidConfig, "failed to parse pre-signed URL manifest %s: %v", path, err)
+	}
+	return NewURLManifest(objects), nil
+}
+
+// SignURL implements URLSigner.
+func (m *URLManifest) SignURL(ctx context.Context, name string) (string, error) {
+	obj, ok := m.objects[name]
+	if !ok {
+		return "", errors.Annotatef(berrors.ErrStorageInvalidConfig, "object '%s' not found in pre-signed URL manifest", name)
+	}
+	return obj.URL, nil
+}
+
+// presignedStorage is a read-only ExternalStorage which accesses every object
+// through the URL provided by an URLSigner, so no credentials are needed.
+type presignedStorage struct {
+	signer     URLSigner
+	httpClient *http.Client
+}
+
+func newPresignedStorage(signer URLSigner, opts *ExternalStorageOptions) *presignedStorage {
+	httpClient := opts.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	return &presignedStorage{signer: signer, httpClient: httpClient}
+}
+
+// request sends a GET request for the object. If `startOffset` is positive,
+// only the content starting from that offset would be requested.
+func (p *presignedStorage) request(ctx context.Context, name string, startOffset int64) (*http.Response, error) {
+	url, err := p.signer.SignURL(ctx, name)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, errors.Annotatef(berrors.ErrStorageInvalidConfig, "invalid pre-signed URL for '%s': %v", name, err)
+	}
+	if startOffset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", startOffset))
+	}
+	resp, err := p.httpClient.Do(req)
+	return resp, errors.Trace(err)
+}
+
+// get is like request, but converts unsuccessful responses to errors.
+func (p *presignedStorage) get(ctx context.Context, name string, startOffset int64) (*http.Response, error) {
+	resp, err := p.request(ctx, name, startOffset)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusPartialContent {
+		return resp, nil
+	}
+	resp.Body.Close()
+	typed := classifyHTTPStatus(resp.StatusCode)
+	if typed == nil {
+		typed = berrors.ErrStorageUnknown
+	}
+	if typed == berrors.ErrStorageInvalidPermission {
+		return nil, errors.Annotatef(typed,
+			"access to '%s' denied, the pre-signed URL may have expired: %s", name, resp.Status)
+	}
+	return nil, errors.Annotatef(typed, "failed to read '%s': %s", name, resp.Status)
+}
+
+// WriteFile implements ExternalStorage. Pre-signed storage is read-only.
+func (p *presignedStorage) WriteFile(ctx context.Context, name string, data []byte) error {
+	return errors.Annotatef(berrors.ErrStorageInvalidPermission, "cannot write '%s' to a pre-signed URL storage", name)
+}
+
+// ReadFile implements ExternalStorage.
+func (p *presignedStorage) ReadFile(ctx context.Context, name string) ([]byte, error) {
+	resp, err := p.get(ctx, name, 0)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	return data, errors.Trace(err)
+}
+
+// FileExists implements ExternalStorage.
+func (p *presignedStorage) FileExists(ctx context.Context, name string) (bool, error) {
+	if m, ok := p.signer.(*URLManifest); ok {
+		_, exists := m.objects[name]
+		return exists, nil
+	}
+	// the URL is signed for GET only, so we cannot send a HEAD request here.
+	resp, err := p.request(ctx, name, 0)
+	if err != nil {
+		return false, errors.Trace(err)
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusPartialContent:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, errors.Annotatef(berrors.ErrStorageUnknown, "failed to check '%s': %s", name, resp.Status)
+	}
+}
+
+// Open implements ExternalStorage.
+func (p *presignedStorage) Open(ctx context.Context, name string) (ExternalFileReader, error) {
+	resp, err := p.get(ctx, name, 0)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return &presignedObjectReader{
+		storage: p,
+		ctx:     ctx,
+		name:    name,
+		reader:  resp.Body,
+		size:    resp.ContentLength,
+	}, nil
+}
+
+// WalkDir implements ExternalStorage. It is only supported when the storage
+// is created from an URLManifest.
+func (p *presignedStorage) WalkDir(ctx context.Context, opt *WalkOption, fn func(string, int64) error) error {
+	m, ok := p.signer.(*URLManifest)
+	if !ok {
+		return errors.Annotate(berrors.ErrStorageInvalidConfig, "cannot list objects without a pre-signed URL manifest")
+	}
+	prefix := ""
+	if opt != nil && len(opt.SubDir) > 0 {
+		prefix = strings.TrimSuffix(opt.SubDir, "/") + "/"
+	}
+	names := make([]string, 0, len(m.objects))
+	for name := range m.objects {
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := fn(name, m.objects[name].Size); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
+
+// URI implements ExternalStorage.
+func (p *presignedStorage) URI() string {
+	return "presigned:///"
+}
+
+// Create implements ExternalStorage. Pre-signed storage is read-only.
+func (p *presignedStorage) Create(ctx context.Context, name string) (ExternalFileWriter, error) {
+	return nil, errors.Annotatef(berrors.ErrStorageInvalidPermission, "cannot write '%s' to a pre-signed URL storage", name)
+}
+
+// presignedObjectReader reads an object through its pre-signed URL, and
+// reopens the object with a Range request on Seek.
+type presignedObjectReader struct {
+	storage *presignedStorage
+	ctx     context.Context
+	name    string
+	reader  io.ReadCloser
+	pos     int64
+	// size is the total size of the object, or -1 if unknown.
+	size int64
+}
+
+// Read implements io.Reader.
+func (r *presignedObjectReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.pos += int64(n)
+	return n, err
+}
+
+// Close implements io.Closer.
+func (r *presignedObjectReader) Close() error {
+	return r.reader.Close()
+}
+
+// Seek implements io.Seeker.
+func (r *presignedObjectReader) Seek(offset int64, whence int) (int64, error) {
+	var realOffset int64
+	switch whence {
+	case io.SeekStart:
+		realOffset = offset
+	case io.SeekCurrent:
+		realOffset = r.pos + offset
+	case io.SeekEnd:
+		if r.size < 0 {
+			return 0, errors.Annotatef(berrors.ErrStorageUnknown, "Seek: size of '%s' is unknown", r.name)
+		}
+		realOffset = r.size + offset
+	default:
+		return 0, errors.Annotatef(berrors.ErrStorageUnknown, "Seek: invalid whence '%d'", whence)
+	}
+	if realOffset == r.pos {
+		return realOffset, nil
+	}
+	if realOffset < 0 {
+		return 0, errors.Annotatef(berrors.ErrStorageUnknown, "Seek: invalid offset %d", realOffset)
+	}
+
+	if err := r.reader.Close(); err != nil {
+		return 0, errors.Trace(err)
+	}
+	resp, err := r.storage.get(r.ctx, r.name, realOffset)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	if realOffset > 0 && resp.StatusCode != http.StatusPartialContent {
+		// the server ignored the Range header, skip the leading bytes by ourselves.
+		if _, err := io.CopyN(io.Discard, resp.Body, realOffset); err != nil {
+			resp.Body.Close()
+			return 0, errors.Trace(err)
+		}
+	}
+	r.reader = resp.Body
+	r.pos = realOffset
+	return realOffset, nil
+}
@@ -0,0 +1,144 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package storage
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	. "github.com/pingcap/check"
+	backuppb "github.com/pingcap/kvproto/pkg/backup"
+
+	berrors "github.com/pingcap/br/pkg/errors"
+)
+
+func newPresignedTestServer(content map[string][]byte) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("signature") != "ok" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		data, ok := content[strings.TrimPrefix(r.URL.Path, "/")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		http.ServeContent(w, r, r.URL.Path, time.Time{}, bytes.NewReader(data))
+	}))
+}
+
+func (r *testStorageSuite) TestPresignedStorage(c *C) {
+	server := newPresignedTestServer(map[string][]byte{
+		"backupmeta":  []byte("meta"),
+		"data/1.sst":  []byte("0123456789"),
+		"data/2.sst":  []byte("abc"),
+		"data/gone.x": []byte("x"),
+	})
+	defer server.Close()
+
+	manifest := NewURLManifest(map[string]PresignedObject{
+		"backupmeta": {URL: server.URL + "/backupmeta?signature=ok", Size: 4},
+		"data/1.sst": {URL: server.URL + "/data/1.sst?signature=ok", Size: 10},
+		"data/2.sst": {URL: server.URL + "/data/2.sst?signature=ok", Size: 3},
+		"expired":    {URL: server.URL + "/backupmeta?signature=bad"},
+	})
+	ctx := context.Background()
+	s, err := New(ctx, &backuppb.StorageBackend{
+		Backend: &backuppb.StorageBackend_Noop{Noop: &backuppb.Noop{}},
+	}, &ExternalStorageOptions{URLSigner: manifest})
+	c.Assert(err, IsNil)
+
+	data, err := s.ReadFile(ctx, "backupmeta")
+	c.Assert(err, IsNil)
+	c.Assert(data, DeepEquals, []byte("meta"))
+
+	exists, err := s.FileExists(ctx, "data/1.sst")
+	c.Assert(err, IsNil)
+	c.Assert(exists, IsTrue)
+	exists, err = s.FileExists(ctx, "data/gone.x")
+	c.Assert(err, IsNil)
+	c.Assert(exists, IsFalse)
+
+	_, err = s.ReadFile(ctx, "expired")
+	c.Assert(berrors.Is(err, berrors.ErrStorageInvalidPermission), IsTrue)
+	_, err = s.ReadFile(ctx, "not-in-manifest")
+	c.Assert(berrors.Is(err, berrors.ErrStorageInvalidConfig), IsTrue)
+
+	reader, err := s.Open(ctx, "data/1.sst")
+	c.Assert(err, IsNil)
+	offset, err := reader.Seek(6, io.SeekStart)
+	c.Assert(err, IsNil)
+	c.Assert(offset, Equals, int64(6))
+	rest, err := io.ReadAll(reader)
+	c.Assert(err, IsNil)
+	c.Assert(string(rest), Equals, "6789")
+	offset, err = reader.Seek(-3, io.SeekEnd)
+	c.Assert(err, IsNil)
+	c.Assert(offset, Equals, int64(7))
+	rest, err = io.ReadAll(reader)
+	c.Assert(err, IsNil)
+	c.Assert(string(rest), Equals, "789")
+	c.Assert(reader.Close(), IsNil)
+
+	var names []string
+	var sizes []int64
+	err = s.WalkDir(ctx, &WalkOption{SubDir: "data"}, func(name string, size int64) error {
+		names = append(names, name)
+		sizes = append(sizes, size)
+		return nil
+	})
+	c.Assert(err, IsNil)
+	c.Assert(names, DeepEquals, []string{"data/1.sst", "data/2.sst"})
+	c.Assert(sizes, DeepEquals, []int64{10, 3})
+
+	err = s.WriteFile(ctx, "backupmeta", []byte("x"))
+	c.Assert(berrors.Is(err, berrors.ErrStorageInvalidPermission), IsTrue)
+}
+
+func (r *testStorageSuite) TestPresignedStorageWithSigner(c *C) {
+	server := newPresignedTestServer(map[string][]byte{"backupmeta": []byte("meta")})
+	defer server.Close()
+
+	signer := URLSignerFunc(func(ctx context.Context, name string) (string, error) {
+		return server.URL + "/" + name + "?signature=ok", nil
+	})
+	s := newPresignedStorage(signer, &ExternalStorageOptions{})
+	ctx := context.Background()
+
+	data, err := s.ReadFile(ctx, "backupmeta")
+	c.Assert(err, IsNil)
+	c.Assert(data, DeepEquals, []byte("meta"))
+	exists, err := s.FileExists(ctx, "backupmeta")
+	c.Assert(err, IsNil)
+	c.Assert(exists, IsTrue)
+	exists, err = s.FileExists(ctx, "other")
+	c.Assert(err, IsNil)
+	c.Assert(exists, IsFalse)
+
+	err = s.WalkDir(ctx, &WalkOption{}, func(string, int64) error { return nil })
+	c.Assert(berrors.Is(err, berrors.ErrStorageInvalidConfig), IsTrue)
+}
+
+func (r *testStorageSuite) TestLoadURLManifest(c *C) {
+	path := filepath.Join(c.MkDir(), "manifest.json")
+	err := os.WriteFile(path, []byte(`{"backupmeta": {"url": "https://example.com/backupmeta?sig=1", "size": 42}}`), 0o644)
+	c.Assert(err, IsNil)
+
+	manifest, err := LoadURLManifest(path)
+	c.Assert(err, IsNil)
+	url, err := manifest.SignURL(context.Background(), "backupmeta")
+	c.Assert(err, IsNil)
+	c.Assert(url, Equals, "https://example.com/backupmeta?sig=1")
+
+	err = os.WriteFile(path, []byte(`not json`), 0o644)
+	c.Assert(err, IsNil)
+	_, err = LoadURLManifest(path)
+	c.Assert(berrors.Is(err, berrors.ErrStorageInvalidConfig), IsTrue)
+}
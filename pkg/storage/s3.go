@@ -32,14 +32,15 @@ import (
 )
 
 const (
-	s3EndpointOption     = "s3.endpoint"
-	s3RegionOption       = "s3.region"
-	s3StorageClassOption = "s3.storage-class"
-	s3SseOption          = "s3.sse"
-	s3SseKmsKeyIDOption  = "s3.sse-kms-key-id"
-	s3ACLOption          = "s3.acl"
-	s3ProviderOption     = "s3.provider"
-	notFound             = "NotFound"
+	s3EndpointOption         = "s3.endpoint"
+	s3RegionOption           = "s3.region"
+	s3StorageClassOption     = "s3.storage-class"
+	s3MetaStorageClassOption = "s3.meta-storage-class"
+	s3SseOption              = "s3.sse"
+	s3SseKmsKeyIDOption      = "s3.sse-kms-key-id"
+	s3ACLOption              = "s3.acl"
+	s3ProviderOption         = "s3.provider"
+	notFound                 = "NotFound"
 	// number of retries to make of operations.
 	maxRetries = 7
 	// max number of retries when meets error
@@ -63,6 +64,9 @@ type S3Storage struct {
 	session *session.Session
 	svc     s3iface.S3API
 	options *backuppb.S3
+	// sendDefaultCredentials is whether the default credentials are sent to
+	// TiKV, see WithFreshCredentials.
+	sendDefaultCredentials bool
 }
 
 // S3Uploader does multi-part upload to s3.
@@ -109,11 +113,70 @@ func (u *S3Uploader) Close(ctx context.Context) error {
 	return errors.Trace(err)
 }
 
+// s3AccessPointARNRegexp matches an S3 access point ARN used as the bucket,
+// e.g. "arn:aws:s3:us-west-2:123456789012:accesspoint/my-ap". The region of a
+// multi-region access point ARN is empty, and its name is the alias of the
+// multi-region access point ending with ".mrap".
+var s3AccessPointARNRegexp = regexp.MustCompile(`^arn:aws[a-z-]*:s3:([a-z0-9-]*):[0-9]{12}:accesspoint[/:][a-zA-Z0-9.-]+`)
+
+// s3AccessPointHost is the placeholder of the access point ARN when parsing
+// the storage URL, since an ARN isn't a valid host.
+const s3AccessPointHost = "s3-access-point"
+
+// s3AccessPoint is an S3 access point ARN which is used in place of the bucket.
+type s3AccessPoint struct {
+	arn    string
+	region string
+}
+
+// parseS3AccessPoint extracts the access point ARN at the beginning of the
+// URL without the "s3://" scheme, and returns the rest of the URL (the prefix
+// and the query). It returns nil if the URL doesn't start with an ARN.
+func parseS3AccessPoint(rawURL string) (*s3AccessPoint, string) {
+	m := s3AccessPointARNRegexp.FindStringSubmatch(rawURL)
+	if m == nil {
+		return nil, rawURL
+	}
+	rest := rawURL[len(m[0]):]
+	if len(rest) > 0 && rest[0] != '/' && rest[0] != '?' {
+		return nil, rawURL
+	}
+	return &s3AccessPoint{arn: m[0], region: m[1]}, rest
+}
+
+// isS3AccessPointARN checks whether the bucket is an access point ARN.
+func isS3AccessPointARN(bucket string) bool {
+	ap, rest := parseS3AccessPoint(bucket)
+	return ap != nil && rest == ""
+}
+
+// apply adjusts the options for accessing S3 through the access point.
+func (ap *s3AccessPoint) apply(options *S3BackendOptions) error {
+	if ap.region == "" {
+		// TODO: support it once the AWS SDK supports SigV4A signing.
+		return errors.Annotatef(berrors.ErrStorageInvalidConfig,
+			"multi-region access point %s is not supported yet, it requires SigV4A signing", ap.arn)
+	}
+	if options.Region != "" && options.Region != ap.region {
+		return errors.Annotatef(berrors.ErrStorageInvalidConfig,
+			"region %s conflicts with the region %s of access point %s", options.Region, ap.region, ap.arn)
+	}
+	if options.UseAccelerateEndpoint {
+		return errors.Annotatef(berrors.ErrStorageInvalidConfig,
+			"accelerate endpoint cannot be used with access point %s", ap.arn)
+	}
+	options.Region = ap.region
+	// The access points only support the virtual-hosted-style requests.
+	options.ForcePathStyle = false
+	return nil
+}
+
 // S3BackendOptions contains options for s3 storage.
 type S3BackendOptions struct {
 	Endpoint              string `json:"endpoint" toml:"endpoint"`
 	Region                string `json:"region" toml:"region"`
 	StorageClass          string `json:"storage-class" toml:"storage-class"`
+	MetaStorageClass      string `json:"meta-storage-class" toml:"meta-storage-class"`
 	Sse                   string `json:"sse" toml:"sse"`
 	SseKmsKeyID           string `json:"sse-kms-key-id" toml:"sse-kms-key-id"`
 	ACL                   string `json:"acl" toml:"acl"`
@@ -174,6 +237,8 @@ func defineS3Flags(flags *pflag.FlagSet) {
 		"(experimental) Set the S3 endpoint URL, please specify the http or https scheme explicitly")
 	flags.String(s3RegionOption, "", "(experimental) Set the S3 region, e.g. us-east-1")
 	flags.String(s3StorageClassOption, "", "(experimental) Set the S3 storage class, e.g. STANDARD")
+	flags.String(s3MetaStorageClassOption, "", "(experimental) Set the S3 storage class of the metadata files "+
+		"written by BR, e.g. STANDARD, while the SST files use --s3.storage-class. Empty to use --s3.storage-class")
 	flags.String(s3SseOption, "", "Set S3 server-side encryption, e.g. aws:kms")
 	flags.String(s3SseKmsKeyIDOption, "", "KMS CMK key id to use with S3 server-side encryption."+
 		"Leave empty to use S3 owned key.")
@@ -208,6 +273,10 @@ func (options *S3BackendOptions) parseFromFlags(flags *pflag.FlagSet) error {
 	if err != nil {
 		return errors.Trace(err)
 	}
+	options.MetaStorageClass, err = flags.GetString(s3MetaStorageClassOption)
+	if err != nil {
+		return errors.Trace(err)
+	}
 	options.ForcePathStyle = true
 	options.Provider, err = flags.GetString(s3ProviderOption)
 	if err != nil {
@@ -244,13 +313,19 @@ func newS3Storage(backend *backuppb.S3, opts *ExternalStorageOptions) (*S3Storag
 		WithS3ForcePathStyle(qs.ForcePathStyle).
 		WithRegion(qs.Region)
 	request.WithRetryer(awsConfig, defaultS3Retryer())
+	if isS3AccessPointARN(qs.Bucket) {
+		awsConfig.WithS3UseARNRegion(true)
+	}
 	if qs.Endpoint != "" {
 		awsConfig.WithEndpoint(qs.Endpoint)
 	}
 	if opts.HTTPClient != nil {
 		awsConfig.WithHTTPClient(opts.HTTPClient)
 	}
-	var cred *credentials.Credentials
+	var (
+		cred        *credentials.Credentials
+		sendDefault bool
+	)
 	if qs.AccessKey != "" && qs.SecretAccessKey != "" {
 		cred = credentials.NewStaticCredentials(qs.AccessKey, qs.SecretAccessKey, "")
 	}
@@ -265,6 +340,14 @@ func newS3Storage(backend *backuppb.S3, opts *ExternalStorageOptions) (*S3Storag
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
+	refreshInterval, err := credentialsRefreshInterval()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if cred == nil && ses.Config.Credentials != nil && refreshInterval > 0 {
+		log.Info("reload the default s3 credentials periodically", zap.Duration("interval", refreshInterval))
+		ses.Config.Credentials = newRefreshingCredentials(ses.Config.Credentials, refreshInterval)
+	}
 
 	if !opts.SendCredentials {
 		// Clear the credentials if exists so that they will not be sent to TiKV
@@ -278,6 +361,7 @@ func newS3Storage(backend *backuppb.S3, opts *ExternalStorageOptions) (*S3Storag
 			}
 			backend.AccessKey = v.AccessKeyID
 			backend.SecretAccessKey = v.SecretAccessKey
+			sendDefault = true
 		}
 	}
 
@@ -302,9 +386,10 @@ func newS3Storage(backend *backuppb.S3, opts *ExternalStorageOptions) (*S3Storag
 	}
 
 	return &S3Storage{
-		session: ses,
-		svc:     c,
-		options: &qs,
+		session:                ses,
+		svc:                    c,
+		options:                &qs,
+		sendDefaultCredentials: sendDefault,
 	}, nil
 }
 
@@ -390,7 +475,7 @@ func (rs *S3Storage) ReadFile(ctx context.Context, file string) ([]byte, error)
 	}
 	result, err := rs.svc.GetObjectWithContext(ctx, input)
 	if err != nil {
-		return nil, errors.Annotatef(err,
+		return nil, annotateError(err,
 			"failed to read s3 file, file info: input.bucket='%s', input.key='%s'",
 			*input.Bucket, *input.Key)
 	}
@@ -402,6 +487,19 @@ func (rs *S3Storage) ReadFile(ctx context.Context, file string) ([]byte, error)
 	return data, nil
 }
 
+// ETag returns the entity tag of the file.
+func (rs *S3Storage) ETag(ctx context.Context, file string) (string, error) {
+	input := &s3.HeadObjectInput{
+		Bucket: aws.String(rs.options.Bucket),
+		Key:    aws.String(rs.options.Prefix + file),
+	}
+	result, err := rs.svc.HeadObjectWithContext(ctx, input)
+	if err != nil {
+		return "", annotateError(err, "failed to head s3 file '%s'", file)
+	}
+	return aws.StringValue(result.ETag), nil
+}
+
 // FileExists check if file exists on s3 storage.
 func (rs *S3Storage) FileExists(ctx context.Context, file string) (bool, error) {
 	input := &s3.HeadObjectInput{
@@ -417,7 +515,7 @@ func (rs *S3Storage) FileExists(ctx context.Context, file string) (bool, error)
 				return false, nil
 			}
 		}
-		return false, errors.Trace(err)
+		return false, annotateError(err, "failed to check s3 file '%s'", file)
 	}
 	return true, nil
 }
@@ -452,7 +550,7 @@ func (rs *S3Storage) WalkDir(ctx context.Context, opt *WalkOption, fn func(strin
 		// (as of 2020, DigitalOcean Spaces still does not support V2 - https://developers.digitalocean.com/documentation/spaces/#list-bucket-contents)
 		res, err := rs.svc.ListObjectsWithContext(ctx, req)
 		if err != nil {
-			return errors.Trace(err)
+			return annotateError(err, "failed to list s3 objects with prefix '%s'", prefix)
 		}
 		for _, r := range res.Contents {
 			// when walk on specify directory, the result include storage.Prefix,
@@ -538,7 +636,7 @@ func (rs *S3Storage) open(
 	input.Range = rangeOffset
 	result, err := rs.svc.GetObjectWithContext(ctx, input)
 	if err != nil {
-		return nil, RangeInfo{}, errors.Trace(err)
+		return nil, RangeInfo{}, annotateError(err, "failed to open s3 file '%s'", path)
 	}
 
 	r, err := ParseRangeInfo(result.ContentRange)
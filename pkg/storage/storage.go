@@ -139,6 +139,29 @@ type ExternalStorageOptions struct {
 	// CheckPermissions check the given permission in New() function.
 	// make sure we can access the storage correctly before execute tasks.
 	CheckPermissions []Permission
+
+	// URLSigner, if set, makes New() create a read-only storage which reads
+	// every object through the URL returned by the signer, without using any
+	// credentials of the backend.
+	//
+	// Note that TiKV still downloads the SST files using the backend directly,
+	// so it must be able to access the storage by itself.
+	URLSigner URLSigner
+
+	// MmapLocalFiles makes ReadFileMapped map the files of the local storage
+	// into memory instead of reading them through buffers, which is much
+	// faster when inspecting a large amount of SST files on a local or NFS
+	// mounted archive.
+	MmapLocalFiles bool
+
+	// LocalWriteRateLimit is the max bytes per second written to the local
+	// storage in total, so the co-located workloads, e.g. TiKV, aren't starved
+	// of the disk bandwidth. Zero means unlimited.
+	LocalWriteRateLimit uint64
+
+	// LocalIdleIOPriority sets the I/O scheduling class of the process to
+	// idle when creating a local storage, like `ionice -c 3`. Linux only.
+	LocalIdleIOPriority bool
 }
 
 // Create creates ExternalStorage.
@@ -154,12 +177,28 @@ func Create(ctx context.Context, backend *backuppb.StorageBackend, sendCreds boo
 
 // New creates an ExternalStorage with options.
 func New(ctx context.Context, backend *backuppb.StorageBackend, opts *ExternalStorageOptions) (ExternalStorage, error) {
+	if opts != nil && opts.URLSigner != nil {
+		return newPresignedStorage(opts.URLSigner, opts), nil
+	}
 	switch backend := backend.Backend.(type) {
 	case *backuppb.StorageBackend_Local:
 		if backend.Local == nil {
 			return nil, errors.Annotate(berrors.ErrStorageInvalidConfig, "local config not found")
 		}
-		return NewLocalStorage(backend.Local.Path)
+		local, err := NewLocalStorage(backend.Local.Path)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		if opts != nil {
+			local.mmap = opts.MmapLocalFiles
+			local.writeLimiter = newLocalWriteLimiter(opts.LocalWriteRateLimit)
+			if opts.LocalIdleIOPriority {
+				if err := setIdleIOPriority(); err != nil {
+					return nil, errors.Trace(err)
+				}
+			}
+		}
+		return local, nil
 	case *backuppb.StorageBackend_S3:
 		if backend.S3 == nil {
 			return nil, errors.Annotate(berrors.ErrStorageInvalidConfig, "s3 config not found")
@@ -0,0 +1,205 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package stream
+
+import (
+	"context"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/pingcap/errors"
+	"github.com/pingcap/log"
+	"github.com/pingcap/tidb/kv"
+	"go.etcd.io/etcd/clientv3"
+	"go.uber.org/zap"
+
+	berrors "github.com/pingcap/br/pkg/errors"
+)
+
+// MetaDataClient manages the log backup tasks in the etcd embedded in PD.
+type MetaDataClient struct {
+	cli *clientv3.Client
+}
+
+// NewMetaDataClient returns a MetaDataClient on the etcd client.
+func NewMetaDataClient(cli *clientv3.Client) *MetaDataClient {
+	return &MetaDataClient{cli: cli}
+}
+
+// PutTask registers the task without the credentials of its storage, along
+// with its ranges. It fails if a task of the same name exists.
+func (c *MetaDataClient) PutTask(ctx context.Context, info *TaskInfo) error {
+	if err := info.Validate(); err != nil {
+		return errors.Trace(err)
+	}
+	pbInfo := info.StreamBackupTaskInfo
+	pbInfo.Storage = StripCredentials(info.Storage)
+	data, err := proto.Marshal(&pbInfo)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	key := taskInfoKey(info.Name)
+	ops := make([]clientv3.Op, 0, 1+len(info.Ranges))
+	ops = append(ops, clientv3.OpPut(key, string(data)))
+	for _, r := range info.Ranges {
+		ops = append(ops, clientv3.OpPut(taskRangeKey(info.Name, r.StartKey), string(r.EndKey)))
+	}
+	resp, err := c.cli.Txn(ctx).
+		If(clientv3.Compare(clientv3.CreateRevision(key), "=", 0)).
+		Then(ops...).
+		Commit()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if !resp.Succeeded {
+		return errors.Annotatef(berrors.ErrStreamTaskExists, "task %s", info.Name)
+	}
+	return nil
+}
+
+// GetTask returns the task of the name.
+func (c *MetaDataClient) GetTask(ctx context.Context, name string) (*TaskInfo, error) {
+	resp, err := c.cli.Get(ctx, taskInfoKey(name))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, errors.Annotatef(berrors.ErrStreamTaskNotFound, "task %s", name)
+	}
+	info := &TaskInfo{}
+	if err = proto.Unmarshal(resp.Kvs[0].Value, &info.StreamBackupTaskInfo); err != nil {
+		return nil, errors.Annotatef(err, "invalid log backup task %s", name)
+	}
+	if info.Ranges, err = c.getRanges(ctx, name); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return info, nil
+}
+
+// getRanges returns the ranges of the task in order.
+func (c *MetaDataClient) getRanges(ctx context.Context, name string) ([]kv.KeyRange, error) {
+	resp, err := c.cli.Get(ctx, taskRangesKeyPrefix(name),
+		clientv3.WithPrefix(), clientv3.WithSort(clientv3.SortByKey, clientv3.SortAscend))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	ranges := make([]kv.KeyRange, 0, len(resp.Kvs))
+	for _, pair := range resp.Kvs {
+		r, err := parseRange(name, pair.Key, pair.Value)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		ranges = append(ranges, r)
+	}
+	return ranges, nil
+}
+
+// GetAllTasks returns all the tasks in the order of their names.
+func (c *MetaDataClient) GetAllTasks(ctx context.Context) ([]*TaskInfo, error) {
+	resp, err := c.cli.Get(ctx, taskInfoPrefix, clientv3.WithPrefix(), clientv3.WithSort(clientv3.SortByKey, clientv3.SortAscend))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	tasks := make([]*TaskInfo, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		info := &TaskInfo{}
+		if err := proto.Unmarshal(kv.Value, &info.StreamBackupTaskInfo); err != nil {
+			log.Warn("skip the invalid log backup task", zap.ByteString("key", kv.Key), zap.Error(err))
+			continue
+		}
+		if info.Ranges, err = c.getRanges(ctx, info.Name); err != nil {
+			return nil, errors.Trace(err)
+		}
+		tasks = append(tasks, info)
+	}
+	return tasks, nil
+}
+
+// PauseTask makes the stores stop backing up the changes of the task. The
+// changes since its checkpoint are backed up after resuming, as long as they
+// are not garbage collected.
+func (c *MetaDataClient) PauseTask(ctx context.Context, name string) error {
+	if _, err := c.GetTask(ctx, name); err != nil {
+		return errors.Trace(err)
+	}
+	_, err := c.cli.Put(ctx, taskPauseKey(name), "")
+	return errors.Trace(err)
+}
+
+// ResumeTask resumes the paused task.
+func (c *MetaDataClient) ResumeTask(ctx context.Context, name string) error {
+	if _, err := c.GetTask(ctx, name); err != nil {
+		return errors.Trace(err)
+	}
+	_, err := c.cli.Delete(ctx, taskPauseKey(name))
+	return errors.Trace(err)
+}
+
+// GetTaskStatus returns the status of the task of the name.
+func (c *MetaDataClient) GetTaskStatus(ctx context.Context, name string) (*TaskStatus, error) {
+	info, err := c.GetTask(ctx, name)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return c.getTaskStatus(ctx, info)
+}
+
+func (c *MetaDataClient) getTaskStatus(ctx context.Context, info *TaskInfo) (*TaskStatus, error) {
+	status := &TaskStatus{Info: *info, Checkpoints: make(map[uint64]uint64)}
+	resp, err := c.cli.Get(ctx, taskPauseKey(info.Name), clientv3.WithCountOnly())
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	status.Paused = resp.Count > 0
+	resp, err = c.cli.Get(ctx, storeCheckpointsKeyPrefix(info.Name), clientv3.WithPrefix())
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	for _, kv := range resp.Kvs {
+		storeID, ts, err := parseCheckpoint(info.Name, kv.Key, kv.Value)
+		if err != nil {
+			log.Warn("skip the invalid checkpoint", zap.String("task", info.Name), zap.Error(err))
+			continue
+		}
+		status.Checkpoints[storeID] = ts
+	}
+	return status, nil
+}
+
+// GetAllTaskStatus returns the status of all the tasks.
+func (c *MetaDataClient) GetAllTaskStatus(ctx context.Context) ([]*TaskStatus, error) {
+	tasks, err := c.GetAllTasks(ctx)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	statuses := make([]*TaskStatus, 0, len(tasks))
+	for _, info := range tasks {
+		status, err := c.getTaskStatus(ctx, info)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+// DeleteTask removes the task along with its ranges, pause mark and
+// checkpoints.
+func (c *MetaDataClient) DeleteTask(ctx context.Context, name string) error {
+	key := taskInfoKey(name)
+	resp, err := c.cli.Txn(ctx).
+		If(clientv3.Compare(clientv3.CreateRevision(key), ">", 0)).
+		Then(
+			clientv3.OpDelete(key),
+			clientv3.OpDelete(taskRangesKeyPrefix(name), clientv3.WithPrefix()),
+			clientv3.OpDelete(taskPauseKey(name)),
+			clientv3.OpDelete(checkpointsKeyPrefix(name), clientv3.WithPrefix()),
+		).
+		Commit()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if !resp.Succeeded {
+		return errors.Annotatef(berrors.ErrStreamTaskNotFound, "task %s", name)
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package stream
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"strings"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/pingcap/errors"
+	backuppb "github.com/pingcap/kvproto/pkg/backup"
+
+	berrors "github.com/pingcap/br/pkg/errors"
+	"github.com/pingcap/br/pkg/storage"
+)
+
+const (
+	// MetadataDir is the directory of the storage where each store writes
+	// the Metadata of the log files it flushed, see the backup-stream
+	// component of TiKV.
+	MetadataDir = "v1/backupmeta"
+	// metadataSuffix is the suffix of the Metadata files.
+	metadataSuffix = ".meta"
+)
+
+// ReadMetadata calls fn with each Metadata file written by the stores into
+// the storage of the log backup task.
+func ReadMetadata(ctx context.Context, s storage.ExternalStorage, fn func(*backuppb.Metadata) error) error {
+	return s.WalkDir(ctx, &storage.WalkOption{SubDir: MetadataDir}, func(path string, _ int64) error {
+		if !strings.HasSuffix(path, metadataSuffix) {
+			return nil
+		}
+		data, err := s.ReadFile(ctx, path)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		meta := &backuppb.Metadata{}
+		if err = proto.Unmarshal(data, meta); err != nil {
+			return errors.Annotatef(berrors.ErrInvalidMetaFile, "invalid metadata %s: %v", path, err)
+		}
+		return errors.Trace(fn(meta))
+	})
+}
+
+// ReadResolvedTS returns the TS the log files of all the stores cover up to,
+// i.e. the minimal resolved ts of the stores. Every store resolves the TS
+// when it flushes the log files, so the latest one of a store counts.
+func ReadResolvedTS(ctx context.Context, s storage.ExternalStorage) (uint64, error) {
+	stores := make(map[uint64]uint64)
+	err := ReadMetadata(ctx, s, func(meta *backuppb.Metadata) error {
+		if meta.ResolvedTs > stores[meta.StoreId] {
+			stores[meta.StoreId] = meta.ResolvedTs
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	if len(stores) == 0 {
+		return 0, errors.Annotatef(berrors.ErrRestoreInvalidBackup, "no metadata in %s of the log backup", MetadataDir)
+	}
+	var resolvedTS uint64
+	first := true
+	for _, ts := range stores {
+		if first || ts < resolvedTS {
+			resolvedTS = ts
+			first = false
+		}
+	}
+	return resolvedTS, nil
+}
+
+// ReadDataFiles returns the data files of the log backup holding the changes
+// committed in [startTS, endTS].
+func ReadDataFiles(
+	ctx context.Context, s storage.ExternalStorage, startTS, endTS uint64,
+) ([]*backuppb.DataFileInfo, error) {
+	files := make([]*backuppb.DataFileInfo, 0)
+	err := ReadMetadata(ctx, s, func(meta *backuppb.Metadata) error {
+		for _, f := range meta.Files {
+			if f.MaxTs < startTS || f.MinTs > endTS {
+				continue
+			}
+			files = append(files, f)
+		}
+		return nil
+	})
+	return files, errors.Trace(err)
+}
+
+// KVEvent is a change of a key of the write or default CF backed up by the
+// log backup. The key is the memcomparable encoded key followed by the TS in
+// the descending order, the same as the key of the CF in TiKV.
+type KVEvent struct {
+	Key   []byte
+	Value []byte
+}
+
+// ReadKVEvents reads the events of the data file, each of which is encoded
+// as the little endian uint32 length of the key, the key, the little endian
+// uint32 length of the value and the value.
+func ReadKVEvents(ctx context.Context, s storage.ExternalStorage, file *backuppb.DataFileInfo) ([]KVEvent, error) {
+	data, err := s.ReadFile(ctx, file.Path)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if len(file.Sha256) > 0 {
+		checksum := sha256.Sum256(data)
+		if !bytes.Equal(file.Sha256, checksum[:]) {
+			return nil, errors.Annotatef(berrors.ErrInvalidMetaFile,
+				"checksum mismatch of log file %s, expect %x, got %x", file.Path, file.Sha256, checksum[:])
+		}
+	}
+	events, err := DecodeKVEvents(data)
+	return events, errors.Annotatef(err, "log file %s", file.Path)
+}
+
+// DecodeKVEvents decodes the events of the content of a data file, see
+// ReadKVEvents.
+func DecodeKVEvents(data []byte) ([]KVEvent, error) {
+	events := make([]KVEvent, 0)
+	next := func() ([]byte, error) {
+		if len(data) < 4 {
+			return nil, errors.Annotatef(berrors.ErrRestoreInvalidBackup, "truncated length of %d bytes", len(data))
+		}
+		n := binary.LittleEndian.Uint32(data)
+		if uint64(len(data)-4) < uint64(n) {
+			return nil, errors.Annotatef(berrors.ErrRestoreInvalidBackup,
+				"truncated field of %d bytes, expect %d bytes", len(data)-4, n)
+		}
+		field := data[4 : 4+n]
+		data = data[4+n:]
+		return field, nil
+	}
+	for len(data) > 0 {
+		key, err := next()
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		value, err := next()
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		events = append(events, KVEvent{Key: key, Value: value})
+	}
+	return events, nil
+}
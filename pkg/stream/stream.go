@@ -0,0 +1,219 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+// Package stream manages the log backup tasks. A task is registered in the
+// etcd embedded in PD, the TiKV stores observe the changes of its key ranges
+// and write them as log files into its storage, and report the TS they have
+// backed up to as checkpoints. Only the TiKV since v6.2.0 runs the tasks, see
+// version.CheckVersionForLogBackup. The log files are replayed by the PiTR.
+package stream
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"strconv"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/pingcap/errors"
+	backuppb "github.com/pingcap/kvproto/pkg/backup"
+	"github.com/pingcap/tidb/kv"
+	"github.com/pingcap/tidb/tablecodec"
+
+	berrors "github.com/pingcap/br/pkg/errors"
+	"github.com/pingcap/br/pkg/storage"
+)
+
+const (
+	// keyPrefix is the etcd path of PD where the stores watch the log backup
+	// tasks, see the observer of the backup-stream component of TiKV.
+	keyPrefix         = "/tidb/br-stream/"
+	taskInfoPrefix    = keyPrefix + "info/"
+	taskRangesPrefix  = keyPrefix + "ranges/"
+	taskPausePrefix   = keyPrefix + "pause/"
+	checkpointsPrefix = keyPrefix + "checkpoint/"
+
+	// MetaFile is the metadata of the log backup task written to its storage,
+	// so the PiTR finds the range of TS the log files cover.
+	MetaFile = "stream.meta"
+)
+
+// TaskInfo is a log backup task registered in PD. The stores read the
+// StreamBackupTaskInfo from the info key, and the key ranges to back up from
+// the range keys of the task.
+type TaskInfo struct {
+	// StreamBackupTaskInfo.Storage is where the stores write the log files
+	// to. It's registered without the credentials, see StripCredentials.
+	// Its TableFilter is applied when replaying the log files. The stores
+	// back up the changes of all the ranges, so the tables created after the
+	// task started are included.
+	backuppb.StreamBackupTaskInfo
+	Ranges []kv.KeyRange `json:"ranges"`
+}
+
+// NewTaskInfo returns a task backing up the changes of all tables. The EndTs
+// of 0 means the task runs until it's stopped.
+func NewTaskInfo(name string, backend *backuppb.StorageBackend, startTS, endTS uint64) TaskInfo {
+	return TaskInfo{
+		StreamBackupTaskInfo: backuppb.StreamBackupTaskInfo{
+			Name:    name,
+			Storage: backend,
+			StartTs: startTS,
+			EndTs:   endTS,
+		},
+		Ranges: []kv.KeyRange{{
+			StartKey: tablecodec.TablePrefix(),
+			EndKey:   kv.Key(tablecodec.TablePrefix()).PrefixNext(),
+		}},
+	}
+}
+
+// Validate checks the task can be registered.
+func (t *TaskInfo) Validate() error {
+	if len(t.Name) == 0 {
+		return errors.Annotate(berrors.ErrInvalidArgument, "the name of the log backup task is empty")
+	}
+	if t.Storage == nil {
+		return errors.Annotatef(berrors.ErrInvalidArgument, "log backup task %s has no storage", t.Name)
+	}
+	if t.EndTs != 0 && t.EndTs <= t.StartTs {
+		return errors.Annotatef(berrors.ErrInvalidArgument,
+			"end ts %d of log backup task %s isn't greater than its start ts %d", t.EndTs, t.Name, t.StartTs)
+	}
+	if len(t.Ranges) == 0 {
+		return errors.Annotatef(berrors.ErrInvalidArgument, "log backup task %s has no range", t.Name)
+	}
+	return nil
+}
+
+// TaskStatus is the status of a log backup task.
+type TaskStatus struct {
+	Info   TaskInfo `json:"info"`
+	Paused bool     `json:"paused"`
+	// Checkpoints are the TS the stores have backed up to, by the store IDs.
+	Checkpoints map[uint64]uint64 `json:"checkpoints"`
+}
+
+// GlobalCheckpoint returns the TS all the stores have backed up to. It's the
+// start ts of the task if no store has reported its checkpoint yet.
+func (s *TaskStatus) GlobalCheckpoint() uint64 {
+	checkpoint := s.Info.StartTs
+	first := true
+	for _, ts := range s.Checkpoints {
+		if first || ts < checkpoint {
+			checkpoint = ts
+			first = false
+		}
+	}
+	return checkpoint
+}
+
+// StripCredentials returns a copy of the backend without the credentials, so
+// they aren't stored in plaintext in PD. The stores write the log files with
+// their own credentials, e.g. the IAM role of the instances.
+func StripCredentials(backend *backuppb.StorageBackend) *backuppb.StorageBackend {
+	if backend == nil {
+		return nil
+	}
+	stripped := proto.Clone(backend).(*backuppb.StorageBackend)
+	if s3 := stripped.GetS3(); s3 != nil {
+		s3.AccessKey = ""
+		s3.SecretAccessKey = ""
+	}
+	if gcs := stripped.GetGcs(); gcs != nil {
+		gcs.CredentialsBlob = ""
+	}
+	return stripped
+}
+
+// ServiceSafePointID returns the ID of the service GC safepoint holding the
+// changes not backed up by the task yet.
+func ServiceSafePointID(name string) string {
+	return "br-stream-" + name
+}
+
+func taskInfoKey(name string) string {
+	return taskInfoPrefix + name
+}
+
+func taskRangesKeyPrefix(name string) string {
+	return taskRangesPrefix + name + "/"
+}
+
+// taskRangeKey is the key of the range, whose value is the end key.
+func taskRangeKey(name string, startKey []byte) string {
+	return taskRangesKeyPrefix(name) + string(startKey)
+}
+
+func taskPauseKey(name string) string {
+	return taskPausePrefix + name
+}
+
+func checkpointsKeyPrefix(name string) string {
+	return checkpointsPrefix + name + "/"
+}
+
+func storeCheckpointsKeyPrefix(name string) string {
+	return checkpointsKeyPrefix(name) + "store/"
+}
+
+// parseRange parses the range of the task stored at the range key.
+func parseRange(name string, key, value []byte) (kv.KeyRange, error) {
+	prefix := taskRangesKeyPrefix(name)
+	if !bytes.HasPrefix(key, []byte(prefix)) {
+		return kv.KeyRange{}, errors.Errorf("invalid range key %q of log backup task %s", key, name)
+	}
+	return kv.KeyRange{StartKey: kv.Key(key[len(prefix):]), EndKey: kv.Key(value)}, nil
+}
+
+// parseCheckpoint parses the checkpoint reported by a store, the key is
+// suffixed by "store/" and the store ID, and the value is the TS in big
+// endian.
+func parseCheckpoint(name string, key, value []byte) (storeID, ts uint64, err error) {
+	prefix := storeCheckpointsKeyPrefix(name)
+	if len(key) <= len(prefix) || string(key[:len(prefix)]) != prefix {
+		return 0, 0, errors.Errorf("invalid checkpoint key %q of log backup task %s", key, name)
+	}
+	if storeID, err = strconv.ParseUint(string(key[len(prefix):]), 10, 64); err != nil {
+		return 0, 0, errors.Annotatef(err, "invalid checkpoint key %q of log backup task %s", key, name)
+	}
+	if len(value) != 8 {
+		return 0, 0, errors.Errorf("invalid checkpoint %x of log backup task %s", value, name)
+	}
+	return storeID, binary.BigEndian.Uint64(value), nil
+}
+
+// Meta is the content of MetaFile.
+type Meta struct {
+	Info TaskInfo `json:"info"`
+	// CheckpointTS is the TS the log files cover up to, it's recorded when
+	// the task is stopped.
+	CheckpointTS uint64 `json:"checkpoint-ts,omitempty"`
+	Stopped      bool   `json:"stopped"`
+}
+
+// SaveMeta writes the metadata of the task into its storage.
+func SaveMeta(ctx context.Context, s storage.ExternalStorage, meta *Meta) error {
+	// The stores are given the credentials in PD, but they aren't written
+	// along with the log files.
+	info := meta.Info
+	info.Storage = nil
+	data, err := json.Marshal(&Meta{Info: info, CheckpointTS: meta.CheckpointTS, Stopped: meta.Stopped})
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(s.WriteFile(ctx, MetaFile, data))
+}
+
+// LoadMeta reads the metadata of the task from its storage.
+func LoadMeta(ctx context.Context, s storage.ExternalStorage) (*Meta, error) {
+	data, err := s.ReadFile(ctx, MetaFile)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	meta := &Meta{}
+	if err = json.Unmarshal(data, meta); err != nil {
+		return nil, errors.Annotatef(err, "invalid %s", MetaFile)
+	}
+	return meta, nil
+}
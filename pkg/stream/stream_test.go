@@ -0,0 +1,198 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package stream
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"testing"
+
+	. "github.com/pingcap/check"
+	backuppb "github.com/pingcap/kvproto/pkg/backup"
+
+	"github.com/pingcap/br/pkg/storage"
+)
+
+func TestT(t *testing.T) {
+	TestingT(t)
+}
+
+var _ = Suite(&testStreamSuite{})
+
+type testStreamSuite struct{}
+
+func (s *testStreamSuite) TestTaskInfo(c *C) {
+	backend := &backuppb.StorageBackend{
+		Backend: &backuppb.StorageBackend_Local{Local: &backuppb.Local{Path: "/tmp/log"}},
+	}
+	info := NewTaskInfo("t1", backend, 100, 0)
+	c.Assert(info.Validate(), IsNil)
+	c.Assert(info.Ranges, HasLen, 1)
+	c.Assert(string(info.Ranges[0].StartKey), Equals, "t")
+	c.Assert(string(info.Ranges[0].EndKey), Equals, "u")
+
+	c.Assert(info.Name, Equals, "t1")
+	c.Assert(info.Storage, Equals, backend)
+	c.Assert(info.StartTs, Equals, uint64(100))
+
+	info.EndTs = 100
+	c.Assert(info.Validate(), ErrorMatches, ".*isn't greater than its start ts.*")
+	info.EndTs = 0
+	info.Ranges = nil
+	c.Assert(info.Validate(), ErrorMatches, ".*has no range.*")
+	info = NewTaskInfo("", backend, 100, 0)
+	c.Assert(info.Validate(), ErrorMatches, ".*name.*empty.*")
+	info = NewTaskInfo("t1", nil, 100, 0)
+	c.Assert(info.Validate(), ErrorMatches, ".*no storage.*")
+}
+
+func (s *testStreamSuite) TestRange(c *C) {
+	key := taskRangeKey("t1", []byte("t\x80"))
+	c.Assert(key, Equals, "/tidb/br-stream/ranges/t1/t\x80")
+	r, err := parseRange("t1", []byte(key), []byte("u"))
+	c.Assert(err, IsNil)
+	c.Assert(string(r.StartKey), Equals, "t\x80")
+	c.Assert(string(r.EndKey), Equals, "u")
+	_, err = parseRange("t2", []byte(key), []byte("u"))
+	c.Assert(err, NotNil)
+}
+
+func (s *testStreamSuite) TestCheckpoint(c *C) {
+	value := make([]byte, 8)
+	binary.BigEndian.PutUint64(value, 42)
+	// The stores report the checkpoints at checkpoint/<task>/store/<id>.
+	c.Assert(storeCheckpointsKeyPrefix("t1")+"3", Equals, "/tidb/br-stream/checkpoint/t1/store/3")
+	storeID, ts, err := parseCheckpoint("t1", []byte(storeCheckpointsKeyPrefix("t1")+"3"), value)
+	c.Assert(err, IsNil)
+	c.Assert(storeID, Equals, uint64(3))
+	c.Assert(ts, Equals, uint64(42))
+	_, _, err = parseCheckpoint("t1", []byte(storeCheckpointsKeyPrefix("t2")+"3"), value)
+	c.Assert(err, NotNil)
+	_, _, err = parseCheckpoint("t1", []byte(checkpointsKeyPrefix("t1")+"3"), value)
+	c.Assert(err, NotNil)
+	_, _, err = parseCheckpoint("t1", []byte(storeCheckpointsKeyPrefix("t1")+"3"), value[:4])
+	c.Assert(err, NotNil)
+
+	status := &TaskStatus{Info: TaskInfo{StreamBackupTaskInfo: backuppb.StreamBackupTaskInfo{StartTs: 10}}}
+	c.Assert(status.GlobalCheckpoint(), Equals, uint64(10))
+	status.Checkpoints = map[uint64]uint64{1: 30, 2: 20, 3: 40}
+	c.Assert(status.GlobalCheckpoint(), Equals, uint64(20))
+}
+
+func (s *testStreamSuite) TestMeta(c *C) {
+	ctx := context.Background()
+	dir := c.MkDir()
+	st, err := storage.NewLocalStorage(dir)
+	c.Assert(err, IsNil)
+	backend := &backuppb.StorageBackend{
+		Backend: &backuppb.StorageBackend_Local{Local: &backuppb.Local{Path: dir}},
+	}
+	info := NewTaskInfo("t1", backend, 100, 0)
+	c.Assert(SaveMeta(ctx, st, &Meta{Info: info, CheckpointTS: 200, Stopped: true}), IsNil)
+	meta, err := LoadMeta(ctx, st)
+	c.Assert(err, IsNil)
+	c.Assert(meta.Info.Name, Equals, "t1")
+	c.Assert(meta.Info.Storage, IsNil)
+	c.Assert(meta.Info.StartTs, Equals, uint64(100))
+	c.Assert(meta.Info.Ranges, DeepEquals, info.Ranges)
+	c.Assert(meta.CheckpointTS, Equals, uint64(200))
+	c.Assert(meta.Stopped, IsTrue)
+}
+
+func (s *testStreamSuite) TestStripCredentials(c *C) {
+	c.Assert(StripCredentials(nil), IsNil)
+	backend := &backuppb.StorageBackend{
+		Backend: &backuppb.StorageBackend_S3{S3: &backuppb.S3{
+			Bucket: "bucket", Prefix: "log", AccessKey: "ak", SecretAccessKey: "sk",
+		}},
+	}
+	stripped := StripCredentials(backend)
+	c.Assert(stripped.GetS3().Bucket, Equals, "bucket")
+	c.Assert(stripped.GetS3().Prefix, Equals, "log")
+	c.Assert(stripped.GetS3().AccessKey, Equals, "")
+	c.Assert(stripped.GetS3().SecretAccessKey, Equals, "")
+	// The backend of the task isn't changed.
+	c.Assert(backend.GetS3().AccessKey, Equals, "ak")
+
+	backend = &backuppb.StorageBackend{
+		Backend: &backuppb.StorageBackend_Gcs{Gcs: &backuppb.GCS{Bucket: "bucket", CredentialsBlob: "{}"}},
+	}
+	c.Assert(StripCredentials(backend).GetGcs().CredentialsBlob, Equals, "")
+	c.Assert(StripCredentials(backend).GetGcs().Bucket, Equals, "bucket")
+}
+
+func encodeKVEvents(events ...KVEvent) []byte {
+	var buf []byte
+	for _, e := range events {
+		for _, field := range [][]byte{e.Key, e.Value} {
+			var n [4]byte
+			binary.LittleEndian.PutUint32(n[:], uint32(len(field)))
+			buf = append(append(buf, n[:]...), field...)
+		}
+	}
+	return buf
+}
+
+func (s *testStreamSuite) TestDecodeKVEvents(c *C) {
+	events := []KVEvent{
+		{Key: []byte("k1"), Value: []byte("v1")},
+		{Key: []byte("k2"), Value: []byte{}},
+	}
+	data := encodeKVEvents(events...)
+	decoded, err := DecodeKVEvents(data)
+	c.Assert(err, IsNil)
+	c.Assert(decoded, HasLen, 2)
+	c.Assert(decoded[0].Key, DeepEquals, []byte("k1"))
+	c.Assert(decoded[0].Value, DeepEquals, []byte("v1"))
+	c.Assert(decoded[1].Key, DeepEquals, []byte("k2"))
+	c.Assert(decoded[1].Value, HasLen, 0)
+
+	_, err = DecodeKVEvents(data[:len(data)-1])
+	c.Assert(err, ErrorMatches, ".*truncated field.*")
+	_, err = DecodeKVEvents(data[:2])
+	c.Assert(err, ErrorMatches, ".*truncated length.*")
+}
+
+func (s *testStreamSuite) TestReadMetadata(c *C) {
+	ctx := context.Background()
+	st, err := storage.NewLocalStorage(c.MkDir())
+	c.Assert(err, IsNil)
+	_, err = ReadResolvedTS(ctx, st)
+	c.Assert(err, ErrorMatches, ".*no metadata.*")
+
+	data := encodeKVEvents(KVEvent{Key: []byte("k"), Value: []byte("v")})
+	checksum := sha256.Sum256(data)
+	c.Assert(st.WriteFile(ctx, "v1/20211015/1/1.log", data), IsNil)
+	metas := []*backuppb.Metadata{
+		{StoreId: 1, ResolvedTs: 100, Files: []*backuppb.DataFileInfo{
+			{Path: "v1/20211015/1/1.log", Sha256: checksum[:], MinTs: 50, MaxTs: 90},
+		}},
+		{StoreId: 1, ResolvedTs: 300, Files: []*backuppb.DataFileInfo{{Path: "2.log", MinTs: 100, MaxTs: 280}}},
+		{StoreId: 2, ResolvedTs: 200, Files: []*backuppb.DataFileInfo{{Path: "3.log", MinTs: 150, MaxTs: 190}}},
+	}
+	for i, meta := range metas {
+		content, err := meta.Marshal()
+		c.Assert(err, IsNil)
+		c.Assert(st.WriteFile(ctx, fmt.Sprintf("%s/%d.meta", MetadataDir, i), content), IsNil)
+	}
+	// The resolved ts of store 2 holds the global one back.
+	resolvedTS, err := ReadResolvedTS(ctx, st)
+	c.Assert(err, IsNil)
+	c.Assert(resolvedTS, Equals, uint64(200))
+
+	files, err := ReadDataFiles(ctx, st, 95, 140)
+	c.Assert(err, IsNil)
+	c.Assert(files, HasLen, 1)
+	c.Assert(files[0].Path, Equals, "2.log")
+	files, err = ReadDataFiles(ctx, st, 0, 1000)
+	c.Assert(err, IsNil)
+	c.Assert(files, HasLen, 3)
+
+	events, err := ReadKVEvents(ctx, st, metas[0].Files[0])
+	c.Assert(err, IsNil)
+	c.Assert(events, HasLen, 1)
+	_, err = ReadKVEvents(ctx, st, &backuppb.DataFileInfo{Path: "v1/20211015/1/1.log", Sha256: []byte("bad")})
+	c.Assert(err, ErrorMatches, ".*checksum mismatch.*")
+}
@@ -5,6 +5,7 @@ package summary
 import (
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/docker/go-units"
@@ -29,6 +30,28 @@ const (
 	RestoreDataSize = "restore data size(after compressed)"
 )
 
+// The categories of the retries collected by CollectRetry.
+const (
+	// RetrySplit counts the retries of splitting regions.
+	RetrySplit = "split"
+	// RetryScatter counts the retries of scattering regions.
+	RetryScatter = "scatter"
+	// RetryDownload counts the retries of downloading SST files.
+	RetryDownload = "download"
+	// RetryIngest counts the retries of ingesting SST files.
+	RetryIngest = "ingest"
+	// RetryStorage counts the retries caused by the transient errors of the
+	// external storage.
+	RetryStorage = "storage"
+	// RetryPDLeader counts the retries of the requests to PD caused by the
+	// transfer of the PD leader.
+	RetryPDLeader = "pd leader"
+)
+
+func retryKeyFor(category string) string {
+	return "retry " + category
+}
+
 // LogCollector collects infos into summary log.
 type LogCollector interface {
 	SetUnit(unit string)
@@ -45,9 +68,51 @@ type LogCollector interface {
 
 	SetSuccessStatus(success bool)
 
+	// Snapshot returns the structured summary collected so far.
+	Snapshot() Snapshot
+
 	Summary(name string)
 }
 
+// Snapshot is a point-in-time copy of the collected summary, aggregated by
+// the units of the values.
+type Snapshot struct {
+	// Unit is "backup" or "restore".
+	Unit string
+	// Success is whether the task is marked succeeded without any failure
+	// unit.
+	Success bool
+	// SuccessUnits and FailureUnits are the numbers of the ranges succeeded
+	// and failed.
+	SuccessUnits int
+	FailureUnits int
+	// FailureReasons are the reasons of the failure units by name.
+	FailureReasons map[string]error
+	// SuccessCosts are the durations collected by CollectSuccessUnit.
+	SuccessCosts map[string]time.Duration
+	// SuccessData are the bytes collected by CollectSuccessUnit, e.g.
+	// TotalBytes and TotalKV.
+	SuccessData map[string]uint64
+	// Durations, Ints and Uints are the fields collected by CollectDuration,
+	// CollectInt (including the retries) and CollectUint.
+	Durations map[string]time.Duration
+	Ints      map[string]int
+	Uints     map[string]uint64
+	// TotalTake is the time elapsed since the collector was created.
+	TotalTake time.Duration
+}
+
+// Retries returns the numbers of the retries by category.
+func (s Snapshot) Retries() map[string]int {
+	retries := make(map[string]int)
+	for key, val := range s.Ints {
+		if strings.HasPrefix(key, retryKeyFor("")) {
+			retries[strings.TrimPrefix(key, retryKeyFor(""))] = val
+		}
+	}
+	return retries
+}
+
 type logFunc func(msg string, fields ...zap.Field)
 
 var collector LogCollector = NewLogCollector(log.Info)
@@ -71,18 +136,97 @@ func InitCollector( // revive:disable-line:flag-parameter
 	collector = NewLogCollector(logF)
 }
 
+// counters is a set of named counters, which can be added concurrently. The
+// lock only guards the map, the counters themselves are added atomically, so
+// the goroutines of a parallel restore don't contend on the hot path once a
+// name has been collected.
+type counters struct {
+	mu sync.RWMutex
+	m  map[string]*uint64
+}
+
+func newCounters() *counters {
+	return &counters{m: make(map[string]*uint64)}
+}
+
+func (c *counters) add(name string, delta uint64) {
+	c.mu.RLock()
+	p, ok := c.m[name]
+	c.mu.RUnlock()
+	if !ok {
+		c.mu.Lock()
+		if p, ok = c.m[name]; !ok {
+			p = new(uint64)
+			c.m[name] = p
+		}
+		c.mu.Unlock()
+	}
+	atomic.AddUint64(p, delta)
+}
+
+func (c *counters) load() map[string]uint64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	values := make(map[string]uint64, len(c.m))
+	for name, p := range c.m {
+		values[name] = atomic.LoadUint64(p)
+	}
+	return values
+}
+
+func (c *counters) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.m = make(map[string]*uint64)
+}
+
+// durationCounters aggregates the durations by name.
+type durationCounters struct{ *counters }
+
+func (c *durationCounters) add(name string, d time.Duration) {
+	c.counters.add(name, uint64(d))
+}
+
+func (c *durationCounters) load() map[string]time.Duration {
+	values := c.counters.load()
+	durations := make(map[string]time.Duration, len(values))
+	for name, v := range values {
+		durations[name] = time.Duration(v)
+	}
+	return durations
+}
+
+// intCounters aggregates the counts by name, the deltas may be negative.
+type intCounters struct{ *counters }
+
+func (c *intCounters) add(name string, delta int) {
+	// two's complement makes adding a negative delta work.
+	c.counters.add(name, uint64(delta))
+}
+
+func (c *intCounters) load() map[string]int {
+	values := c.counters.load()
+	ints := make(map[string]int, len(values))
+	for name, v := range values {
+		ints[name] = int(int64(v))
+	}
+	return ints
+}
+
 type logCollector struct {
-	mu               sync.Mutex
-	unit             string
-	successUnitCount int
-	failureUnitCount int
-	successCosts     map[string]time.Duration
-	successData      map[string]uint64
-	failureReasons   map[string]error
-	durations        map[string]time.Duration
-	ints             map[string]int
-	uints            map[string]uint64
-	successStatus    bool
+	// mu guards the fields which are rarely set, the others are collected
+	// atomically.
+	mu             sync.Mutex
+	unit           string
+	failureReasons map[string]error
+	successStatus  bool
+
+	successUnitCount int64
+	successCosts     durationCounters
+	successData      *counters
+	durations        durationCounters
+	ints             intCounters
+	uints            *counters
 	startTime        time.Time
 
 	log logFunc
@@ -91,16 +235,14 @@ type logCollector struct {
 // NewLogCollector returns a new LogCollector.
 func NewLogCollector(log logFunc) LogCollector {
 	return &logCollector{
-		successUnitCount: 0,
-		failureUnitCount: 0,
-		successCosts:     make(map[string]time.Duration),
-		successData:      make(map[string]uint64),
-		failureReasons:   make(map[string]error),
-		durations:        make(map[string]time.Duration),
-		ints:             make(map[string]int),
-		uints:            make(map[string]uint64),
-		log:              log,
-		startTime:        time.Now(),
+		failureReasons: make(map[string]error),
+		successCosts:   durationCounters{newCounters()},
+		successData:    newCounters(),
+		durations:      durationCounters{newCounters()},
+		ints:           intCounters{newCounters()},
+		uints:          newCounters(),
+		log:            log,
+		startTime:      time.Now(),
 	}
 }
 
@@ -111,15 +253,12 @@ func (tc *logCollector) SetUnit(unit string) {
 }
 
 func (tc *logCollector) CollectSuccessUnit(name string, unitCount int, arg interface{}) {
-	tc.mu.Lock()
-	defer tc.mu.Unlock()
-
 	switch v := arg.(type) {
 	case time.Duration:
-		tc.successUnitCount += unitCount
-		tc.successCosts[name] += v
+		atomic.AddInt64(&tc.successUnitCount, int64(unitCount))
+		tc.successCosts.add(name, v)
 	case uint64:
-		tc.successData[name] += v
+		tc.successData.add(name, v)
 	}
 }
 
@@ -128,26 +267,19 @@ func (tc *logCollector) CollectFailureUnit(name string, reason error) {
 	defer tc.mu.Unlock()
 	if _, ok := tc.failureReasons[name]; !ok {
 		tc.failureReasons[name] = reason
-		tc.failureUnitCount++
 	}
 }
 
 func (tc *logCollector) CollectDuration(name string, t time.Duration) {
-	tc.mu.Lock()
-	defer tc.mu.Unlock()
-	tc.durations[name] += t
+	tc.durations.add(name, t)
 }
 
 func (tc *logCollector) CollectInt(name string, t int) {
-	tc.mu.Lock()
-	defer tc.mu.Unlock()
-	tc.ints[name] += t
+	tc.ints.add(name, t)
 }
 
 func (tc *logCollector) CollectUInt(name string, t uint64) {
-	tc.mu.Lock()
-	defer tc.mu.Unlock()
-	tc.uints[name] += t
+	tc.uints.add(name, t)
 }
 
 func (tc *logCollector) SetSuccessStatus(success bool) {
@@ -156,49 +288,74 @@ func (tc *logCollector) SetSuccessStatus(success bool) {
 	tc.successStatus = success
 }
 
+func (tc *logCollector) Snapshot() Snapshot {
+	tc.mu.Lock()
+	failures := make(map[string]error, len(tc.failureReasons))
+	for name, reason := range tc.failureReasons {
+		failures[name] = reason
+	}
+	snapshot := Snapshot{
+		Unit:           tc.unit,
+		Success:        tc.successStatus && len(tc.failureReasons) == 0,
+		FailureReasons: failures,
+	}
+	tc.mu.Unlock()
+
+	snapshot.SuccessUnits = int(atomic.LoadInt64(&tc.successUnitCount))
+	snapshot.FailureUnits = len(failures)
+	snapshot.SuccessCosts = tc.successCosts.load()
+	snapshot.SuccessData = tc.successData.load()
+	snapshot.Durations = tc.durations.load()
+	snapshot.Ints = tc.ints.load()
+	snapshot.Uints = tc.uints.load()
+	snapshot.TotalTake = time.Since(tc.startTime)
+	return snapshot
+}
+
 func logKeyFor(key string) string {
 	return strings.ReplaceAll(key, " ", "-")
 }
 
 func (tc *logCollector) Summary(name string) {
-	tc.mu.Lock()
+	s := tc.Snapshot()
 	defer func() {
-		tc.durations = make(map[string]time.Duration)
-		tc.ints = make(map[string]int)
-		tc.successCosts = make(map[string]time.Duration)
+		tc.durations.reset()
+		tc.ints.reset()
+		tc.successCosts.reset()
+		tc.mu.Lock()
 		tc.failureReasons = make(map[string]error)
 		tc.mu.Unlock()
 	}()
 
-	logFields := make([]zap.Field, 0, len(tc.durations)+len(tc.ints)+3)
+	logFields := make([]zap.Field, 0, len(s.Durations)+len(s.Ints)+3)
 
 	logFields = append(logFields,
-		zap.Int("total-ranges", tc.failureUnitCount+tc.successUnitCount),
-		zap.Int("ranges-succeed", tc.successUnitCount),
-		zap.Int("ranges-failed", tc.failureUnitCount),
+		zap.Int("total-ranges", s.FailureUnits+s.SuccessUnits),
+		zap.Int("ranges-succeed", s.SuccessUnits),
+		zap.Int("ranges-failed", s.FailureUnits),
 	)
 
-	for key, val := range tc.durations {
+	for key, val := range s.Durations {
 		logFields = append(logFields, zap.Duration(logKeyFor(key), val))
 	}
-	for key, val := range tc.ints {
+	for key, val := range s.Ints {
 		logFields = append(logFields, zap.Int(logKeyFor(key), val))
 	}
-	for key, val := range tc.uints {
+	for key, val := range s.Uints {
 		logFields = append(logFields, zap.Uint64(logKeyFor(key), val))
 	}
 
-	if len(tc.failureReasons) != 0 || !tc.successStatus {
-		for unitName, reason := range tc.failureReasons {
+	if !s.Success {
+		for unitName, reason := range s.FailureReasons {
 			logFields = append(logFields, zap.String("unit-name", unitName), zap.Error(reason))
 		}
 		tc.log(name+" failed summary", logFields...)
 		return
 	}
 
-	totalDureTime := time.Since(tc.startTime)
+	totalDureTime := s.TotalTake
 	logFields = append(logFields, zap.Duration("total-take", totalDureTime))
-	for name, data := range tc.successData {
+	for name, data := range s.SuccessData {
 		if name == TotalBytes {
 			logFields = append(logFields,
 				zap.String("total-kv-size", units.HumanSize(float64(data))),
@@ -206,7 +363,7 @@ func (tc *logCollector) Summary(name string) {
 			continue
 		}
 		if name == BackupDataSize {
-			if tc.failureUnitCount+tc.successUnitCount == 0 {
+			if s.FailureUnits+s.SuccessUnits == 0 {
 				logFields = append(logFields, zap.String("Result", "Nothing to bakcup"))
 			} else {
 				logFields = append(logFields,
@@ -215,7 +372,7 @@ func (tc *logCollector) Summary(name string) {
 			continue
 		}
 		if name == RestoreDataSize {
-			if tc.failureUnitCount+tc.successUnitCount == 0 {
+			if s.FailureUnits+s.SuccessUnits == 0 {
 				logFields = append(logFields, zap.String("Result", "Nothing to restore"))
 			} else {
 				logFields = append(logFields,
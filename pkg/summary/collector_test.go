@@ -3,6 +3,9 @@
 package summary
 
 import (
+	"errors"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -47,3 +50,69 @@ func (suit *testCollectorSuite) TestSumDurationInt(c *C) {
 	assertContains(zap.Duration("b", 2*time.Second))
 	assertContains(zap.Int("c", 4))
 }
+
+func (suit *testCollectorSuite) TestCollectRetry(c *C) {
+	fields := []zap.Field{}
+	logger := func(msg string, fs ...zap.Field) {
+		fields = append(fields, fs...)
+	}
+	origin := collector
+	defer SetLogCollector(origin)
+	SetLogCollector(NewLogCollector(logger))
+
+	CollectRetry(RetrySplit)
+	CollectRetry(RetrySplit)
+	CollectRetry(RetryStorage)
+	SetSuccessStatus(true)
+	Summary("foo")
+
+	retries := make(map[string]int64)
+	for _, f := range fields {
+		if strings.HasPrefix(f.Key, "retry-") {
+			retries[f.Key] = f.Integer
+		}
+	}
+	c.Assert(retries, DeepEquals, map[string]int64{"retry-split": 2, "retry-storage": 1})
+}
+
+func (suit *testCollectorSuite) TestConcurrentSnapshot(c *C) {
+	col := NewLogCollector(func(msg string, fs ...zap.Field) {})
+	col.SetUnit(RestoreUnit)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				col.CollectSuccessUnit("download", 1, time.Millisecond)
+				col.CollectSuccessUnit(TotalBytes, 1, uint64(10))
+				col.CollectDuration("split", time.Millisecond)
+				col.CollectInt(retryKeyFor(RetryIngest), 1)
+				col.CollectInt("delta", -1)
+				col.CollectUInt("files", 2)
+				_ = col.Snapshot()
+			}
+		}()
+	}
+	wg.Wait()
+	col.CollectFailureUnit("range", errors.New("failed"))
+	col.CollectFailureUnit("range", errors.New("failed again"))
+	col.SetSuccessStatus(true)
+
+	s := col.Snapshot()
+	c.Assert(s.Unit, Equals, RestoreUnit)
+	c.Assert(s.Success, IsFalse)
+	c.Assert(s.SuccessUnits, Equals, 800)
+	c.Assert(s.FailureUnits, Equals, 1)
+	c.Assert(s.FailureReasons["range"], ErrorMatches, "failed")
+	c.Assert(s.SuccessCosts, DeepEquals, map[string]time.Duration{"download": 800 * time.Millisecond})
+	c.Assert(s.SuccessData, DeepEquals, map[string]uint64{TotalBytes: 8000})
+	c.Assert(s.Durations, DeepEquals, map[string]time.Duration{"split": 800 * time.Millisecond})
+	c.Assert(s.Ints["delta"], Equals, -800)
+	c.Assert(s.Uints, DeepEquals, map[string]uint64{"files": 1600})
+	c.Assert(s.Retries(), DeepEquals, map[string]int{RetryIngest: 800})
+
+	// the snapshot is a copy.
+	col.CollectDuration("split", time.Second)
+	c.Assert(s.Durations["split"], Equals, 800*time.Millisecond)
+}
@@ -34,11 +34,22 @@ func CollectUint(name string, t uint64) {
 	collector.CollectUInt(name, t)
 }
 
+// CollectRetry counts a retry of the category, see the Retry* constants.
+func CollectRetry(category string) {
+	collector.CollectInt(retryKeyFor(category), 1)
+}
+
 // SetSuccessStatus sets final success status.
 func SetSuccessStatus(success bool) {
 	collector.SetSuccessStatus(success)
 }
 
+// GetSnapshot returns the structured summary collected so far. It's safe to
+// call while the collectors are called concurrently.
+func GetSnapshot() Snapshot {
+	return collector.Snapshot()
+}
+
 // Summary outputs summary log.
 func Summary(name string) {
 	collector.Summary(name)
@@ -0,0 +1,162 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package task
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pingcap/errors"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+
+	berrors "github.com/pingcap/br/pkg/errors"
+	"github.com/pingcap/br/pkg/httputil"
+	"github.com/pingcap/br/pkg/restore"
+)
+
+const (
+	// restoreAbortPath is the path of the status server to abort a restore
+	// task.
+	restoreAbortPath = "/restore/abort"
+	// abortCleanupTimeout is the timeout of removing the downloaded SST files
+	// after aborting.
+	abortCleanupTimeout = 30 * time.Second
+)
+
+// abortableTasks are the running restore tasks, which can be aborted through
+// the status server.
+var abortableTasks = struct {
+	sync.Mutex
+	cancels map[string]context.CancelFunc
+}{cancels: make(map[string]context.CancelFunc)}
+
+func init() {
+	http.HandleFunc(restoreAbortPath, handleAbortRestore)
+}
+
+// registerAbortableRestore assigns a task ID to the restore task, which can
+// be aborted by `br restore abort --task-id` afterwards. Aborting cancels the
+// context of the task, so the task stops sending requests to TiKV and runs its
+// cleanup, e.g. switching TiKV back to normal mode and resuming the paused PD
+// schedulers, and the SST files downloaded but not ingested yet are removed
+// from TiKV by cleanupAbortedRestore. The returned function unregisters the
+// task.
+func registerAbortableRestore(cancel context.CancelFunc) (taskID string, unregister func()) {
+	taskID = uuid.New().String()
+	abortableTasks.Lock()
+	abortableTasks.cancels[taskID] = cancel
+	abortableTasks.Unlock()
+	log.Info("restore task started, it can be aborted by `br restore abort` through the status server",
+		zap.String("task-id", taskID))
+	return taskID, func() {
+		abortableTasks.Lock()
+		delete(abortableTasks.cancels, taskID)
+		abortableTasks.Unlock()
+	}
+}
+
+// cleanupAbortedRestore asks TiKV to remove the SST files downloaded but not
+// ingested by the restore client if the restore is aborted, i.e. its context
+// is canceled. The files of a failed restore are kept, as it may be retried
+// with the checkpoint.
+func cleanupAbortedRestore(ctx context.Context, client *restore.Client) {
+	if ctx.Err() == nil {
+		return
+	}
+	cleanupCtx, cancel := context.WithTimeout(context.Background(), abortCleanupTimeout)
+	defer cancel()
+	if err := client.CleanupDownloadedSSTs(cleanupCtx); err != nil {
+		log.Warn("failed to remove the downloaded SST files from TiKV, they are left in the import directory",
+			zap.Error(err))
+	}
+}
+
+// isAbortAllowed checks the request to abort comes from the host of BR, or
+// carries a client certificate verified by the TLS of the status server.
+func isAbortAllowed(r *http.Request) bool {
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		return true
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func handleAbortRestore(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !isAbortAllowed(r) {
+		log.Warn("refused to abort restore task", zap.String("from", r.RemoteAddr))
+		http.Error(w, "only the local host or the clients with a verified certificate can abort restore tasks",
+			http.StatusForbidden)
+		return
+	}
+	taskID := r.URL.Query().Get("task-id")
+	abortableTasks.Lock()
+	cancel, ok := abortableTasks.cancels[taskID]
+	abortableTasks.Unlock()
+	if !ok {
+		http.Error(w, fmt.Sprintf("restore task %q not found", taskID), http.StatusNotFound)
+		return
+	}
+	log.Warn("aborting restore task", zap.String("task-id", taskID), zap.String("from", r.RemoteAddr))
+	cancel()
+	fmt.Fprintf(w, "restore task %s is aborting\n", taskID)
+}
+
+// AbortRestore asks the BR process serving the status address to abort the
+// restore task.
+func AbortRestore(ctx context.Context, statusAddr, taskID string, cfg *TLSConfig) error {
+	if len(taskID) == 0 {
+		return errors.Annotate(berrors.ErrInvalidArgument, "the task ID is required")
+	}
+	scheme := "http://"
+	var tlsConf *tls.Config
+	if cfg.IsEnabled() {
+		var err error
+		tlsConf, err = cfg.ToTLSConfig()
+		if err != nil {
+			return errors.Trace(err)
+		}
+		scheme = "https://"
+	}
+	client := httputil.NewClient(tlsConf)
+	if !strings.Contains(statusAddr, "://") {
+		statusAddr = scheme + statusAddr
+	}
+	reqURL := strings.TrimRight(statusAddr, "/") + restoreAbortPath + "?task-id=" + url.QueryEscape(taskID)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, reqURL, nil)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer resp.Body.Close()
+	msg, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return errors.Annotatef(berrors.ErrInvalidArgument, "failed to abort restore task: [%d] %s",
+			resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	log.Info("restore task aborting", zap.String("task-id", taskID), zap.String("status-addr", statusAddr))
+	return nil
+}
@@ -26,10 +26,12 @@ import (
 
 	"github.com/pingcap/br/pkg/backup"
 	"github.com/pingcap/br/pkg/checksum"
+	"github.com/pingcap/br/pkg/conn"
 	berrors "github.com/pingcap/br/pkg/errors"
 	"github.com/pingcap/br/pkg/glue"
 	"github.com/pingcap/br/pkg/logutil"
 	"github.com/pingcap/br/pkg/metautil"
+	"github.com/pingcap/br/pkg/rtree"
 	"github.com/pingcap/br/pkg/storage"
 	"github.com/pingcap/br/pkg/summary"
 	"github.com/pingcap/br/pkg/utils"
@@ -44,6 +46,11 @@ const (
 	flagRemoveSchedulers = "remove-schedulers"
 	flagIgnoreStats      = "ignore-stats"
 	flagUseBackupMetaV2  = "use-backupmeta-v2"
+	flagResume           = "resume"
+	flagWaitResolvedTS   = "wait-resolved-ts"
+	flagCompressMeta     = "compress-meta"
+	flagBackupGroup      = "backup-group"
+	flagBackupGroupShard = "backup-group-shards"
 
 	flagGCTTL = "gcttl"
 
@@ -51,7 +58,9 @@ const (
 	maxBackupConcurrency     = 256
 )
 
-// CompressionConfig is the configuration for sst file compression.
+// CompressionConfig is the configuration for sst file compression. The codec
+// of each SST file is recorded in the trailers of its blocks, which TiKV
+// reads when ingesting the file, so restore needs no configuration for it.
 type CompressionConfig struct {
 	CompressionType  backuppb.CompressionType `json:"compression-type" toml:"compression-type"`
 	CompressionLevel int32                    `json:"compression-level" toml:"compression-level"`
@@ -68,6 +77,13 @@ type BackupConfig struct {
 	RemoveSchedulers bool          `json:"remove-schedulers" toml:"remove-schedulers"`
 	IgnoreStats      bool          `json:"ignore-stats" toml:"ignore-stats"`
 	UseBackupMetaV2  bool          `json:"use-backupmeta-v2"`
+	Resume           bool          `json:"resume" toml:"resume"`
+	WaitResolvedTS   time.Duration `json:"wait-resolved-ts" toml:"wait-resolved-ts"`
+	CompressMeta     bool          `json:"compress-meta" toml:"compress-meta"`
+	// BackupGroup is the name of the backup group, whose members back up the
+	// shards of the ranges into the same storage.
+	BackupGroup       string `json:"backup-group" toml:"backup-group"`
+	BackupGroupShards uint   `json:"backup-group-shards" toml:"backup-group-shards"`
 	CompressionConfig
 }
 
@@ -100,6 +116,26 @@ func DefineBackupFlags(flags *pflag.FlagSet) {
 	// This flag is used for test. we should backup stats all the time.
 	_ = flags.MarkHidden(flagIgnoreStats)
 
+	flags.Bool(flagResume, false,
+		"make the backup resumable: record the finished ranges in the storage, "+
+			"and skip them when the backup is restarted with this flag")
+
+	flags.Duration(flagWaitResolvedTS, 0,
+		"after the backup, wait at most this duration for all stores to resolve past the backup ts, "+
+			"and record the resolved ts beside the backupmeta. 0 to disable")
+
+	flags.Bool(flagCompressMeta, false,
+		"compress the backupmeta with zstd, and store the identical schemas only once with the v2 meta, "+
+			"the backup cannot be restored by the BR without this feature")
+
+	flags.String(flagBackupGroup, "",
+		"(experimental) join the backup group of the name: the BR processes of the group, "+
+			"possibly on different machines, back up the disjoint shards of the ranges into the same --storage, "+
+			"and the last one finishing its shards writes the backupmeta")
+	flags.Uint(flagBackupGroupShard, defaultBackupGroupShards,
+		"the number of the shards of the ranges backed up by the backup group, "+
+			"it should be the same for all members and be several times of the number of the members")
+
 	flags.Bool(flagUseBackupMetaV2, false,
 		"use backup meta v2 to store meta info")
 	// This flag will change the structure of backupmeta.
@@ -149,6 +185,9 @@ func (cfg *BackupConfig) ParseFromFlags(flags *pflag.FlagSet) error {
 	if err = cfg.Config.ParseFromFlags(flags); err != nil {
 		return errors.Trace(err)
 	}
+	if cfg.RateLimitAuto {
+		return errors.Annotatef(berrors.ErrInvalidArgument, "--%s=%s is only supported by restore", flagRateLimit, rateLimitAuto)
+	}
 	cfg.RemoveSchedulers, err = flags.GetBool(flagRemoveSchedulers)
 	if err != nil {
 		return errors.Trace(err)
@@ -157,10 +196,61 @@ func (cfg *BackupConfig) ParseFromFlags(flags *pflag.FlagSet) error {
 	if err != nil {
 		return errors.Trace(err)
 	}
+	cfg.Resume, err = flags.GetBool(flagResume)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	cfg.WaitResolvedTS, err = flags.GetDuration(flagWaitResolvedTS)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	cfg.CompressMeta, err = flags.GetBool(flagCompressMeta)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if cfg.BackupGroup, err = flags.GetString(flagBackupGroup); err != nil {
+		return errors.Trace(err)
+	}
+	if cfg.BackupGroupShards, err = flags.GetUint(flagBackupGroupShard); err != nil {
+		return errors.Trace(err)
+	}
+	if cfg.BackupGroup != "" {
+		if cfg.LastBackupTS > 0 || cfg.Resume {
+			return errors.Annotatef(berrors.ErrInvalidArgument,
+				"--%s doesn't support the incremental or resumable backup yet", flagBackupGroup)
+		}
+		if cfg.BackupGroupShards == 0 {
+			return errors.Annotatef(berrors.ErrInvalidArgument, "--%s must be positive", flagBackupGroupShard)
+		}
+	}
 	cfg.UseBackupMetaV2, err = flags.GetBool(flagUseBackupMetaV2)
 	return errors.Trace(err)
 }
 
+// loadResumeTS makes the resumed backup use the same snapshot as the previous
+// run, otherwise the finished ranges cannot be reused.
+func loadResumeTS(ctx context.Context, client *backup.Client, cfg *BackupConfig) error {
+	startVersion, endVersion, err := client.LoadResumeTS(ctx)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if endVersion == 0 {
+		return nil
+	}
+	if cfg.BackupTS != 0 && cfg.BackupTS != endVersion {
+		return errors.Annotatef(berrors.ErrInvalidArgument,
+			"the backup ts %d differs from the backup ts %d of the resumed backup", cfg.BackupTS, endVersion)
+	}
+	if cfg.LastBackupTS != startVersion {
+		return errors.Annotatef(berrors.ErrInvalidArgument,
+			"the last backup ts %d differs from the last backup ts %d of the resumed backup", cfg.LastBackupTS, startVersion)
+	}
+	log.Info("resume backup", zap.Uint64("BackupTS", endVersion), zap.Uint64("LastBackupTS", startVersion))
+	cfg.BackupTS = endVersion
+	cfg.TimeAgo = 0
+	return nil
+}
+
 // ParseFromFlags parses the backup-related flags from the flag set.
 func parseCompressionFlags(flags *pflag.FlagSet) (*CompressionConfig, error) {
 	compressionStr, err := flags.GetString(flagCompressionType)
@@ -246,6 +336,9 @@ func RunBackup(c context.Context, g glue.Glue, cmdName string, cfg *BackupConfig
 		return errors.Trace(err)
 	}
 	defer mgr.Close()
+	if cfg.RemoveSchedulers {
+		defer setupPDOpLog(ctx, &cfg.Config, cmdName, mgr)()
+	}
 	var statsHandle *handle.Handle
 	if !skipStats {
 		statsHandle = mgr.GetDomain().StatsHandle()
@@ -255,24 +348,70 @@ func RunBackup(c context.Context, g glue.Glue, cmdName string, cfg *BackupConfig
 	if err != nil {
 		return errors.Trace(err)
 	}
+	if cfg.Resume {
+		client.EnableResume()
+	}
+	if cfg.BackupGroup != "" {
+		client.EnableShared()
+	}
 	opts := storage.ExternalStorageOptions{
 		NoCredentials:   cfg.NoCreds,
 		SendCredentials: cfg.SendCreds,
 		SkipCheckPath:   cfg.SkipCheckPath,
 	}
+	client.SetMetaStorageClass(cfg.BackendOptions.MetaStorageClass(u))
 	if err = client.SetStorage(ctx, u, &opts); err != nil {
 		return errors.Trace(err)
 	}
+	if len(cfg.MetadataMasterKey) > 0 {
+		if err = client.EnableEncryption(ctx, cfg.MetadataMasterKey); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	if err = checkClockSkew(ctx, &cfg.Config, mgr.GetPDClient(), client.GetStorage()); err != nil {
+		return errors.Trace(err)
+	}
 	err = client.SetLockFile(ctx)
 	if err != nil {
 		return errors.Trace(err)
 	}
 	client.SetGCTTL(cfg.GCTTL)
+	leaveRateLimitGroup, err := setupSharedRateLimit(ctx, &cfg.Config, client)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer leaveRateLimitGroup()
+	if err = setupBackupBandwidthProbe(ctx, mgr, &cfg.Config, cmdName, client); err != nil {
+		return errors.Trace(err)
+	}
 
+	if cfg.Resume {
+		if err = loadResumeTS(ctx, client, cfg); err != nil {
+			return errors.Trace(err)
+		}
+	}
 	backupTS, err := client.GetTS(ctx, cfg.TimeAgo, cfg.BackupTS)
 	if err != nil {
 		return errors.Trace(err)
 	}
+	var group *backupGroup
+	if cfg.BackupGroup != "" {
+		// The members back up the snapshot of the member creating the group.
+		group, err = joinBackupGroup(ctx, cfg, backupTS)
+		if err != nil {
+			return errors.Annotatef(err, "failed to join the backup group %s", cfg.BackupGroup)
+		}
+		defer group.Close()
+		backupTS = group.info.BackupTS
+		if err = utils.CheckGCSafePoint(ctx, mgr.GetPDClient(), backupTS); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	if cfg.Resume {
+		if err = client.SaveResumeTS(ctx, cfg.LastBackupTS, backupTS); err != nil {
+			return errors.Trace(err)
+		}
+	}
 	g.Record("BackupTS", backupTS)
 	sp := utils.BRServiceSafePoint{
 		BackupTS: backupTS,
@@ -331,6 +470,12 @@ func RunBackup(c context.Context, g glue.Glue, cmdName string, cfg *BackupConfig
 
 	// Metafile size should be less than 64MB.
 	metawriter := metautil.NewMetaWriter(client.GetStorage(), metautil.MetaFileSize, cfg.UseBackupMetaV2)
+	if cfg.CompressMeta {
+		metawriter.EnableCompression()
+	}
+	if err = setSigner(ctx, metawriter, cfg.SigningKey); err != nil {
+		return errors.Trace(err)
+	}
 
 	// nothing to backup
 	if ranges == nil {
@@ -371,64 +516,17 @@ func RunBackup(c context.Context, g glue.Glue, cmdName string, cfg *BackupConfig
 		}
 	}
 
-	summary.CollectInt("backup total ranges", len(ranges))
-
-	var updateCh glue.Progress
-	var unit backup.ProgressUnit
-	if len(ranges) < 100 {
-		unit = backup.RegionUnit
-		// The number of regions need to backup
-		approximateRegions := 0
-		for _, r := range ranges {
-			var regionCount int
-			regionCount, err = mgr.GetRegionCount(ctx, r.StartKey, r.EndKey)
-			if err != nil {
-				return errors.Trace(err)
-			}
-			approximateRegions += regionCount
+	if group != nil {
+		finalizer, err := backupShards(ctx, g, cmdName, cfg, client, group, ranges, req, metawriter)
+		if err != nil {
+			return errors.Trace(err)
 		}
-		// Redirect to log if there is no log file to avoid unreadable output.
-		updateCh = g.StartProgress(
-			ctx, cmdName, int64(approximateRegions), !cfg.LogProgress)
-		summary.CollectInt("backup total regions", approximateRegions)
-	} else {
-		unit = backup.RangeUnit
-		// To reduce the costs, we can use the range as unit of progress.
-		updateCh = g.StartProgress(
-			ctx, cmdName, int64(len(ranges)), !cfg.LogProgress)
-	}
-
-	progressCount := 0
-	progressCallBack := func(callBackUnit backup.ProgressUnit) {
-		if unit == callBackUnit {
-			updateCh.Inc()
-			progressCount++
-			failpoint.Inject("progress-call-back", func(v failpoint.Value) {
-				log.Info("failpoint progress-call-back injected")
-				if fileName, ok := v.(string); ok {
-					f, osErr := os.OpenFile(fileName, os.O_CREATE|os.O_WRONLY, os.ModePerm)
-					if osErr != nil {
-						log.Warn("failed to create file", zap.Error(osErr))
-					}
-					msg := []byte(fmt.Sprintf("%s:%d\n", unit, progressCount))
-					_, err = f.Write(msg)
-					if err != nil {
-						log.Warn("failed to write data to file", zap.Error(err))
-					}
-				}
-			})
+		if !finalizer {
+			// The backupmeta has been written by another member.
+			summary.SetSuccessStatus(true)
+			return nil
 		}
-	}
-	metawriter.StartWriteMetasAsync(ctx, metautil.AppendDataFile)
-	err = client.BackupRanges(ctx, ranges, req, uint(cfg.Concurrency), metawriter, progressCallBack)
-	if err != nil {
-		return errors.Trace(err)
-	}
-	// Backup has finished
-	updateCh.Close()
-
-	err = metawriter.FinishWriteMetas(ctx, metautil.AppendDataFile)
-	if err != nil {
+	} else if err = backupAllRanges(ctx, g, cmdName, cfg, mgr, client, ranges, req, metawriter); err != nil {
 		return errors.Trace(err)
 	}
 
@@ -455,6 +553,9 @@ func RunBackup(c context.Context, g glue.Glue, cmdName string, cfg *BackupConfig
 	}
 	updateCh = g.StartProgress(ctx, "Checksum", checksumProgress, !cfg.LogProgress)
 	schemasConcurrency := uint(utils.MinInt(backup.DefaultSchemaConcurrency, schemas.Len()))
+	if cfg.Resume {
+		schemas.EnableChecksumResume(client.GetStorage())
+	}
 
 	err = schemas.BackupSchemas(
 		ctx, metawriter, mgr.GetStorage(), statsHandle, backupTS, schemasConcurrency, cfg.ChecksumConcurrency, skipChecksum, updateCh)
@@ -472,6 +573,34 @@ func RunBackup(c context.Context, g glue.Glue, cmdName string, cfg *BackupConfig
 		}
 	}
 
+	ext := &backup.Extension{EncryptionAtRest: encryptionAtRest(ctx, mgr)}
+	if cfg.WaitResolvedTS > 0 {
+		resolvedTS, err := backup.WaitResolvedTS(ctx, mgr, backupTS, cfg.WaitResolvedTS)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		ext.ResolvedTS = &backup.ResolvedTS{BackupTS: backupTS, MaxResolvedTS: resolvedTS}
+	}
+	if err = backup.SaveExtension(ctx, client.GetStorage(), ext); err != nil {
+		return errors.Trace(err)
+	}
+
+	// The finish marker is written at last, so an interrupted backup is
+	// refused by restore.
+	if err = metawriter.WriteFinishMarker(ctx); err != nil {
+		return errors.Trace(err)
+	}
+	if cfg.Resume {
+		// The backup is complete, failing to delete the markers only leaves
+		// some small files.
+		if err := client.CleanResumeMarkers(ctx); err != nil {
+			log.Warn("failed to delete the resume markers", zap.Error(err))
+		}
+	}
+	if group != nil {
+		group.Finish(ctx)
+	}
+
 	g.Record(summary.BackupDataSize, metawriter.ArchiveSize())
 	failpoint.Inject("s3-outage-during-writing-file", func(v failpoint.Value) {
 		log.Info("failpoint s3-outage-during-writing-file injected, " +
@@ -492,6 +621,75 @@ func RunBackup(c context.Context, g glue.Glue, cmdName string, cfg *BackupConfig
 	return nil
 }
 
+// backupAllRanges backs up the ranges into the metawriter by this process.
+func backupAllRanges(
+	ctx context.Context,
+	g glue.Glue,
+	cmdName string,
+	cfg *BackupConfig,
+	mgr *conn.Mgr,
+	client *backup.Client,
+	ranges []rtree.Range,
+	req backuppb.BackupRequest,
+	metawriter *metautil.MetaWriter,
+) error {
+	summary.CollectInt("backup total ranges", len(ranges))
+
+	var updateCh glue.Progress
+	var unit backup.ProgressUnit
+	if len(ranges) < 100 {
+		unit = backup.RegionUnit
+		// The number of regions need to backup
+		approximateRegions := 0
+		for _, r := range ranges {
+			regionCount, err := mgr.GetRegionCount(ctx, r.StartKey, r.EndKey)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			approximateRegions += regionCount
+		}
+		// Redirect to log if there is no log file to avoid unreadable output.
+		updateCh = g.StartProgress(
+			ctx, cmdName, int64(approximateRegions), !cfg.LogProgress)
+		summary.CollectInt("backup total regions", approximateRegions)
+	} else {
+		unit = backup.RangeUnit
+		// To reduce the costs, we can use the range as unit of progress.
+		updateCh = g.StartProgress(
+			ctx, cmdName, int64(len(ranges)), !cfg.LogProgress)
+	}
+
+	progressCount := 0
+	progressCallBack := func(callBackUnit backup.ProgressUnit) {
+		if unit == callBackUnit {
+			updateCh.Inc()
+			progressCount++
+			failpoint.Inject("progress-call-back", func(v failpoint.Value) {
+				log.Info("failpoint progress-call-back injected")
+				if fileName, ok := v.(string); ok {
+					f, osErr := os.OpenFile(fileName, os.O_CREATE|os.O_WRONLY, os.ModePerm)
+					if osErr != nil {
+						log.Warn("failed to create file", zap.Error(osErr))
+					}
+					msg := []byte(fmt.Sprintf("%s:%d\n", unit, progressCount))
+					if _, err := f.Write(msg); err != nil {
+						log.Warn("failed to write data to file", zap.Error(err))
+					}
+				}
+			})
+		}
+	}
+	metawriter.StartWriteMetasAsync(ctx, metautil.AppendDataFile)
+	err := client.BackupRanges(ctx, ranges, req, uint(cfg.Concurrency), metawriter, progressCallBack)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	// Backup has finished
+	updateCh.Close()
+
+	return errors.Trace(metawriter.FinishWriteMetas(ctx, metautil.AppendDataFile))
+}
+
 // parseTSString port from tidb setSnapshotTS.
 func parseTSString(ts string) (uint64, error) {
 	if len(ts) == 0 {
@@ -530,3 +728,30 @@ func parseCompressionType(s string) (backuppb.CompressionType, error) {
 	}
 	return ct, nil
 }
+
+// setSigner makes the metawriter sign the backup by the key if it's set.
+func setSigner(ctx context.Context, metawriter *metautil.MetaWriter, keyURI string) error {
+	if len(keyURI) == 0 {
+		return nil
+	}
+	signer, err := backup.NewSigner(ctx, keyURI)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	metawriter.SetSigner(signer, keyURI)
+	return nil
+}
+
+// encryptionAtRest returns the encryption at rest of the TiKV stores to
+// record in the extension of the backup. It's only used to check the
+// restore, so the backup goes on without it if the stores can't be queried.
+func encryptionAtRest(ctx context.Context, mgr *conn.Mgr) *backup.EncryptionAtRestMeta {
+	stores, err := mgr.GetStoresEncryptionAtRest(ctx)
+	if err != nil {
+		log.Warn("failed to get the encryption at rest of the stores", zap.Error(err))
+		return nil
+	}
+	meta := backup.NewEncryptionAtRestMeta(stores)
+	log.Info("the encryption at rest of the stores", zap.Strings("methods", meta.Methods))
+	return &meta
+}
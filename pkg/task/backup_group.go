@@ -0,0 +1,376 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package task
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"strconv"
+	"time"
+
+	"github.com/pingcap/errors"
+	backuppb "github.com/pingcap/kvproto/pkg/backup"
+	"github.com/pingcap/log"
+	"go.etcd.io/etcd/clientv3"
+	"go.uber.org/zap"
+
+	"github.com/pingcap/br/pkg/backup"
+	berrors "github.com/pingcap/br/pkg/errors"
+	"github.com/pingcap/br/pkg/glue"
+	"github.com/pingcap/br/pkg/metautil"
+	"github.com/pingcap/br/pkg/rtree"
+	"github.com/pingcap/br/pkg/storage"
+	"github.com/pingcap/br/pkg/summary"
+)
+
+const (
+	// backupGroupKeyPrefix is the etcd path of PD to coordinate the members
+	// of the backup groups.
+	backupGroupKeyPrefix = "/tidb/br/backup-group/"
+	// backupGroupLeaseTTL is the TTL in seconds of the shards claimed by a
+	// member, the shards of a crashed member are claimed by the others after
+	// it.
+	backupGroupLeaseTTL      = 30
+	backupGroupPollPeriod    = 3 * time.Second
+	defaultBackupGroupShards = 64
+)
+
+// backupGroupInfo is the backup shared by the members of a backup group,
+// it's recorded by the member creating the group.
+type backupGroupInfo struct {
+	BackupTS uint64 `json:"backup-ts"`
+	Shards   uint   `json:"shards"`
+	// Storage is the URL of the storage without the credentials.
+	Storage string `json:"storage"`
+}
+
+// backupGroup is the membership of a backup group. The group is kept in PD:
+// "info" is the backupGroupInfo, "digest" is the digest of the ranges,
+// "claim/<shard>" is the member backing up the shard bound to its lease,
+// "done/<shard>" marks the shard whose files are recorded in the storage, and
+// "finalizer" is the member writing the backupmeta bound to its lease. The
+// keys are removed after the backupmeta is written, the done shards of an
+// abandoned group are skipped when the group is joined again.
+type backupGroup struct {
+	*pdEtcdSession
+	member string
+	prefix string
+	info   backupGroupInfo
+}
+
+// joinBackupGroup joins the backup group of the config, the group is created
+// with backupTS if it doesn't exist.
+func joinBackupGroup(ctx context.Context, cfg *BackupConfig, backupTS uint64) (*backupGroup, error) {
+	info := backupGroupInfo{
+		BackupTS: backupTS,
+		Shards:   cfg.BackupGroupShards,
+		Storage:  redactStorageURL(cfg.Storage),
+	}
+	data, err := json.Marshal(&info)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	session, err := newPDEtcdSession(ctx, &cfg.Config, backupGroupLeaseTTL)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	g := &backupGroup{
+		pdEtcdSession: session,
+		member:        fmt.Sprintf("%016x", int64(session.lease)),
+		prefix:        backupGroupKeyPrefix + cfg.BackupGroup + "/",
+	}
+	infoKey := g.prefix + "info"
+	resp, err := g.cli.Txn(ctx).
+		If(clientv3.Compare(clientv3.CreateRevision(infoKey), "=", 0)).
+		Then(clientv3.OpPut(infoKey, string(data))).
+		Else(clientv3.OpGet(infoKey)).
+		Commit()
+	if err != nil {
+		session.Close()
+		return nil, errors.Trace(err)
+	}
+	if resp.Succeeded {
+		g.info = info
+	} else {
+		kvs := resp.Responses[0].GetResponseRange().GetKvs()
+		if len(kvs) == 0 {
+			session.Close()
+			return nil, errors.Errorf("the backup group %s is removed while joining", cfg.BackupGroup)
+		}
+		if err = json.Unmarshal(kvs[0].Value, &g.info); err != nil {
+			session.Close()
+			return nil, errors.Annotatef(err, "invalid info of the backup group %s", cfg.BackupGroup)
+		}
+		if err = checkBackupGroupInfo(&g.info, &info); err != nil {
+			session.Close()
+			return nil, errors.Trace(err)
+		}
+	}
+	log.Info("joined the backup group",
+		zap.String("group", cfg.BackupGroup),
+		zap.String("member", g.member),
+		zap.Bool("created", resp.Succeeded),
+		zap.Uint64("backup-ts", g.info.BackupTS))
+	return g, nil
+}
+
+// checkBackupGroupInfo checks the member backs up the same as the group.
+func checkBackupGroupInfo(group, member *backupGroupInfo) error {
+	if group.Shards != member.Shards {
+		return errors.Annotatef(berrors.ErrInvalidArgument,
+			"the backup group has %d shards, but --%s is %d", group.Shards, flagBackupGroupShard, member.Shards)
+	}
+	if group.Storage != member.Storage {
+		return errors.Annotatef(berrors.ErrInvalidArgument,
+			"the backup group backs up into %s, but --%s is %s", group.Storage, flagStorage, member.Storage)
+	}
+	return nil
+}
+
+// checkRanges checks the member backs up the same ranges as the others,
+// e.g. they use the same filter.
+func (g *backupGroup) checkRanges(ctx context.Context, digest string) error {
+	key := g.prefix + "digest"
+	resp, err := g.cli.Txn(ctx).
+		If(clientv3.Compare(clientv3.CreateRevision(key), "=", 0)).
+		Then(clientv3.OpPut(key, digest)).
+		Else(clientv3.OpGet(key)).
+		Commit()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if resp.Succeeded {
+		return nil
+	}
+	kvs := resp.Responses[0].GetResponseRange().GetKvs()
+	if len(kvs) > 0 && string(kvs[0].Value) != digest {
+		return errors.Annotate(berrors.ErrInvalidArgument,
+			"the ranges differ from the other members of the backup group, check the filters are the same")
+	}
+	return nil
+}
+
+func (g *backupGroup) shardKey(kind string, shard int) string {
+	return g.prefix + kind + "/" + strconv.Itoa(shard)
+}
+
+// claimShard claims a shard neither done nor claimed by the others. It
+// returns -1 if there isn't such a shard, and the number of the done shards.
+func (g *backupGroup) claimShard(ctx context.Context, shards int) (shard int, done int, err error) {
+	resp, err := g.cli.Get(ctx, g.prefix+"done/", clientv3.WithPrefix(), clientv3.WithKeysOnly())
+	if err != nil {
+		return -1, 0, errors.Trace(err)
+	}
+	doneShards := make(map[string]struct{}, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		doneShards[string(kv.Key)] = struct{}{}
+	}
+	// The members start from different shards to reduce the conflicts.
+	offset := int(crc32.ChecksumIEEE([]byte(g.member)) % uint32(shards))
+	for i := 0; i < shards; i++ {
+		shard = (offset + i) % shards
+		doneKey := g.shardKey("done", shard)
+		if _, ok := doneShards[doneKey]; ok {
+			continue
+		}
+		claimKey := g.shardKey("claim", shard)
+		txn, err := g.cli.Txn(ctx).
+			If(
+				clientv3.Compare(clientv3.CreateRevision(claimKey), "=", 0),
+				clientv3.Compare(clientv3.CreateRevision(doneKey), "=", 0),
+			).
+			Then(clientv3.OpPut(claimKey, g.member, clientv3.WithLease(g.lease))).
+			Commit()
+		if err != nil {
+			return -1, 0, errors.Trace(err)
+		}
+		if txn.Succeeded {
+			return shard, len(doneShards), nil
+		}
+	}
+	return -1, len(doneShards), nil
+}
+
+// finishShard marks the shard claimed by the member done.
+func (g *backupGroup) finishShard(ctx context.Context, shard int) error {
+	claimKey := g.shardKey("claim", shard)
+	resp, err := g.cli.Txn(ctx).
+		If(clientv3.Compare(clientv3.Value(claimKey), "=", g.member)).
+		Then(clientv3.OpPut(g.shardKey("done", shard), g.member), clientv3.OpDelete(claimKey)).
+		Commit()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if !resp.Succeeded {
+		return errors.Errorf("lost the claim of shard %d, the lease of the member may have expired", shard)
+	}
+	return nil
+}
+
+// claimFinalizer makes the member write the backupmeta if no other member
+// is writing it. It returns the member writing the backupmeta, which is
+// empty if the group is finished and removed.
+func (g *backupGroup) claimFinalizer(ctx context.Context) (string, error) {
+	key := g.prefix + "finalizer"
+	infoKey := g.prefix + "info"
+	resp, err := g.cli.Txn(ctx).
+		If(
+			clientv3.Compare(clientv3.CreateRevision(key), "=", 0),
+			clientv3.Compare(clientv3.CreateRevision(infoKey), "!=", 0),
+		).
+		Then(clientv3.OpPut(key, g.member, clientv3.WithLease(g.lease))).
+		Else(clientv3.OpGet(key)).
+		Commit()
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	if resp.Succeeded {
+		return g.member, nil
+	}
+	// The finalizer key is removed with the group.
+	kvs := resp.Responses[0].GetResponseRange().GetKvs()
+	if len(kvs) == 0 {
+		return "", nil
+	}
+	return string(kvs[0].Value), nil
+}
+
+// waitFinalizer makes the member write the backupmeta, or waits until the
+// backupmeta is written by another member. If the member writing it crashes
+// or fails, its lease expires and the waiting members take it over. It
+// returns true if this member writes the backupmeta.
+func (g *backupGroup) waitFinalizer(ctx context.Context) (bool, error) {
+	for {
+		finalizer, err := g.claimFinalizer(ctx)
+		if err != nil {
+			return false, errors.Trace(err)
+		}
+		switch finalizer {
+		case g.member:
+			return true, nil
+		case "":
+			log.Info("the backupmeta is written by another member of the backup group", zap.String("prefix", g.prefix))
+			return false, nil
+		}
+		log.Info("waiting for another member of the backup group to write the backupmeta",
+			zap.String("prefix", g.prefix), zap.String("finalizer", finalizer))
+		select {
+		case <-ctx.Done():
+			return false, errors.Trace(ctx.Err())
+		case <-time.After(backupGroupPollPeriod):
+		}
+	}
+}
+
+// Finish removes the group after the backupmeta is written.
+func (g *backupGroup) Finish(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, pdEtcdTimeout)
+	defer cancel()
+	if _, err := g.cli.Delete(ctx, g.prefix, clientv3.WithPrefix()); err != nil {
+		log.Warn("failed to remove the finished backup group", zap.String("prefix", g.prefix), zap.Error(err))
+	}
+}
+
+// Close leaves the group, the shards claimed by the member are given back.
+func (g *backupGroup) Close() {
+	if err := g.pdEtcdSession.Close(); err != nil {
+		log.Warn("failed to leave the backup group, the claimed shards are given back after the lease expires",
+			zap.String("prefix", g.prefix), zap.Error(err))
+	}
+}
+
+// backupShards backs up the shards of the ranges claimed by this process
+// until all the shards of the group are done. It returns true if this
+// process writes the backupmeta, then the files of all the shards are sent
+// to the metawriter. Otherwise, it returns after the backupmeta is written
+// by another member.
+func backupShards(
+	ctx context.Context,
+	g glue.Glue,
+	cmdName string,
+	cfg *BackupConfig,
+	client *backup.Client,
+	group *backupGroup,
+	ranges []rtree.Range,
+	req backuppb.BackupRequest,
+	metawriter *metautil.MetaWriter,
+) (bool, error) {
+	if err := group.checkRanges(ctx, backup.RangesDigest(ranges)); err != nil {
+		return false, errors.Trace(err)
+	}
+	shards := backup.ShardRanges(ranges, int(group.info.Shards))
+	summary.CollectInt("backup total ranges", len(ranges))
+	summary.CollectInt("backup total shards", len(shards))
+	// The files of a shard are collected in memory and recorded in the
+	// storage, the backupmeta is written by the finalizer only.
+	noop, err := storage.New(ctx, &backuppb.StorageBackend{
+		Backend: &backuppb.StorageBackend_Noop{Noop: &backuppb.Noop{}},
+	}, &storage.ExternalStorageOptions{})
+	if err != nil {
+		return false, errors.Trace(err)
+	}
+
+	updateCh := g.StartProgress(ctx, cmdName, int64(len(shards)), !cfg.LogProgress)
+	defer updateCh.Close()
+	reported := 0
+	for {
+		shard, done, err := group.claimShard(ctx, len(shards))
+		if err != nil {
+			return false, errors.Trace(err)
+		}
+		for ; reported < done; reported++ {
+			updateCh.Inc()
+		}
+		if shard >= 0 {
+			log.Info("backing up the shard", zap.Int("shard", shard), zap.Int("ranges", len(shards[shard])))
+			shardWriter := metautil.NewMetaWriter(noop, metautil.MetaFileSize, false)
+			shardWriter.StartWriteMetasAsync(ctx, metautil.AppendDataFile)
+			err = client.BackupRanges(ctx, shards[shard], req, uint(cfg.Concurrency), shardWriter, func(backup.ProgressUnit) {})
+			if err != nil {
+				return false, errors.Trace(err)
+			}
+			if err = shardWriter.FinishWriteMetas(ctx, metautil.AppendDataFile); err != nil {
+				return false, errors.Trace(err)
+			}
+			files := shardWriter.Backupmeta().Files
+			if err = backup.WriteShardFiles(ctx, client.GetStorage(), shard, files); err != nil {
+				return false, errors.Trace(err)
+			}
+			if err = group.finishShard(ctx, shard); err != nil {
+				return false, errors.Trace(err)
+			}
+			continue
+		}
+		if done == len(shards) {
+			break
+		}
+		// The other shards are being backed up, they may be claimed again if
+		// their members crash.
+		select {
+		case <-ctx.Done():
+			return false, errors.Trace(ctx.Err())
+		case <-time.After(backupGroupPollPeriod):
+		}
+	}
+
+	finalizer, err := group.waitFinalizer(ctx)
+	if err != nil || !finalizer {
+		return false, errors.Trace(err)
+	}
+	log.Info("all the shards are done, write the backupmeta", zap.Int("shards", len(shards)))
+	metawriter.StartWriteMetasAsync(ctx, metautil.AppendDataFile)
+	for shard := range shards {
+		files, err := backup.ReadShardFiles(ctx, client.GetStorage(), shard)
+		if err != nil {
+			return false, errors.Trace(err)
+		}
+		for _, file := range files {
+			if err = metawriter.Send(file, metautil.AppendDataFile); err != nil {
+				return false, errors.Trace(err)
+			}
+		}
+	}
+	return true, errors.Trace(metawriter.FinishWriteMetas(ctx, metautil.AppendDataFile))
+}
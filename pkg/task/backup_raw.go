@@ -5,6 +5,7 @@ package task
 import (
 	"bytes"
 	"context"
+	"strings"
 
 	"github.com/pingcap/br/pkg/metautil"
 
@@ -17,8 +18,10 @@ import (
 	"go.uber.org/zap"
 
 	"github.com/pingcap/br/pkg/backup"
+	"github.com/pingcap/br/pkg/conn"
 	berrors "github.com/pingcap/br/pkg/errors"
 	"github.com/pingcap/br/pkg/glue"
+	"github.com/pingcap/br/pkg/logutil"
 	"github.com/pingcap/br/pkg/rtree"
 	"github.com/pingcap/br/pkg/storage"
 	"github.com/pingcap/br/pkg/summary"
@@ -26,10 +29,19 @@ import (
 )
 
 const (
+	keyFormatUsage = "start/end key format, support raw|escaped|hex|auto, " +
+		"auto takes the key as hex if it's an even number of hex digits, as escaped if it contains a backslash, " +
+		"and as raw otherwise"
+	keyArgUsage = "@path reads the key from the file and @- reads it from stdin"
+
 	flagKeyFormat        = "format"
 	flagTiKVColumnFamily = "cf"
 	flagStartKey         = "start"
 	flagEndKey           = "end"
+	flagExcludeRange     = "exclude-range"
+	// flagKeyspace is the flag name of the keyspace of API V2 to back up or
+	// restore.
+	flagKeyspace = "keyspace"
 )
 
 // RawKvConfig is the common config for rawkv backup and restore.
@@ -41,16 +53,38 @@ type RawKvConfig struct {
 	CF       string `json:"cf" toml:"cf"`
 	CompressionConfig
 	RemoveSchedulers bool `json:"remove-schedulers" toml:"remove-schedulers"`
+	// ExcludeRanges are the sub-ranges omitted from the raw backup.
+	ExcludeRanges []rtree.Range `json:"exclude-ranges" toml:"exclude-ranges"`
+	// Keyspace is the ID of the keyspace of API V2. If set, the keys of the
+	// flags are the user keys in the keyspace, which are converted into the
+	// raw keys with the prefix of the keyspace.
+	Keyspace string `json:"keyspace" toml:"keyspace"`
+	// LastBackupTS is the backup ts of the previous raw backup, only the keys
+	// changed after it are backed up if it's set.
+	LastBackupTS uint64 `json:"last-backup-ts" toml:"last-backup-ts"`
+
+	// keyArgs resolves the arguments of the key flags read from files.
+	keyArgs *keyArgs
 }
 
 // DefineRawBackupFlags defines common flags for the backup command.
 func DefineRawBackupFlags(command *cobra.Command) {
-	command.Flags().StringP(flagKeyFormat, "", "hex", "start/end key format, support raw|escaped|hex")
+	command.Flags().StringP(flagKeyFormat, "", "hex", keyFormatUsage)
 	command.Flags().StringP(flagTiKVColumnFamily, "", "default", "backup specify cf, correspond to tikv cf")
-	command.Flags().StringP(flagStartKey, "", "", "backup raw kv start key, key is inclusive")
-	command.Flags().StringP(flagEndKey, "", "", "backup raw kv end key, key is exclusive")
+	command.Flags().StringP(flagStartKey, "", "", "backup raw kv start key, key is inclusive. "+keyArgUsage)
+	command.Flags().StringP(flagEndKey, "", "", "backup raw kv end key, key is exclusive. "+keyArgUsage)
+	command.Flags().String(flagKeyspace, "",
+		"the ID of the keyspace of an API V2 cluster to back up, the keys of --start, --end and --exclude-range "+
+			"are the user keys in the keyspace. empty means the keys are the raw keys")
 	command.Flags().String(flagCompressionType, "zstd",
 		"backup sst file compression algorithm, value can be one of 'lz4|zstd|snappy'")
+	command.Flags().StringArray(flagExcludeRange, nil,
+		"the sub-range to omit from the backup in the form of `start:end` in the key format, "+
+			"empty end means the max key, can be specified multiple times. "+
+			"@path reads the ranges from the file, one range per line, and @- reads them from stdin")
+	command.Flags().Uint64(flagLastBackupTS, 0,
+		"(experimental) the backup ts of the previous raw backup, only the keys changed since then are backed up. "+
+			"it requires an API V2 cluster, which keeps the versions of the raw keys")
 	command.Flags().Bool(flagRemoveSchedulers, false,
 		"disable the balance, shuffle and region-merge schedulers in PD to speed up backup")
 	// This flag can impact the online cluster, so hide it in case of abuse.
@@ -59,6 +93,9 @@ func DefineRawBackupFlags(command *cobra.Command) {
 
 // ParseFromFlags parses the raw kv backup&restore common flags from the flag set.
 func (cfg *RawKvConfig) ParseFromFlags(flags *pflag.FlagSet) error {
+	if cfg.keyArgs == nil {
+		cfg.keyArgs = newKeyArgs()
+	}
 	format, err := flags.GetString(flagKeyFormat)
 	if err != nil {
 		return errors.Trace(err)
@@ -67,6 +104,9 @@ func (cfg *RawKvConfig) ParseFromFlags(flags *pflag.FlagSet) error {
 	if err != nil {
 		return errors.Trace(err)
 	}
+	if start, err = cfg.keyArgs.key(flagStartKey, start); err != nil {
+		return errors.Trace(err)
+	}
 	cfg.StartKey, err = utils.ParseKey(format, start)
 	if err != nil {
 		return errors.Trace(err)
@@ -75,6 +115,9 @@ func (cfg *RawKvConfig) ParseFromFlags(flags *pflag.FlagSet) error {
 	if err != nil {
 		return errors.Trace(err)
 	}
+	if end, err = cfg.keyArgs.key(flagEndKey, end); err != nil {
+		return errors.Trace(err)
+	}
 	cfg.EndKey, err = utils.ParseKey(format, end)
 	if err != nil {
 		return errors.Trace(err)
@@ -87,6 +130,17 @@ func (cfg *RawKvConfig) ParseFromFlags(flags *pflag.FlagSet) error {
 	if err != nil {
 		return errors.Trace(err)
 	}
+	cfg.Keyspace, err = flags.GetString(flagKeyspace)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if len(cfg.Keyspace) > 0 {
+		id, err := utils.ParseKeyspaceID(cfg.Keyspace)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		cfg.StartKey, cfg.EndKey = utils.KeyspaceRange(id, cfg.StartKey, cfg.EndKey)
+	}
 	if err = cfg.Config.ParseFromFlags(flags); err != nil {
 		return errors.Trace(err)
 	}
@@ -99,6 +153,9 @@ func (cfg *RawKvConfig) ParseBackupConfigFromFlags(flags *pflag.FlagSet) error {
 	if err != nil {
 		return errors.Trace(err)
 	}
+	if cfg.RateLimitAuto {
+		return errors.Annotatef(berrors.ErrInvalidArgument, "--%s=%s is only supported by restore", flagRateLimit, rateLimitAuto)
+	}
 
 	compressionCfg, err := parseCompressionFlags(flags)
 	if err != nil {
@@ -115,10 +172,82 @@ func (cfg *RawKvConfig) ParseBackupConfigFromFlags(flags *pflag.FlagSet) error {
 		return errors.Trace(err)
 	}
 	cfg.CompressionLevel = level
+	cfg.LastBackupTS, err = flags.GetUint64(flagLastBackupTS)
+	if err != nil {
+		return errors.Trace(err)
+	}
 
+	format, err := flags.GetString(flagKeyFormat)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	excludes, err := flags.GetStringArray(flagExcludeRange)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if excludes, err = cfg.keyArgs.list(flagExcludeRange, excludes); err != nil {
+		return errors.Trace(err)
+	}
+	cfg.ExcludeRanges, err = parseExcludeRanges(format, excludes)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if len(cfg.Keyspace) > 0 {
+		id, err := utils.ParseKeyspaceID(cfg.Keyspace)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		for i, r := range cfg.ExcludeRanges {
+			cfg.ExcludeRanges[i].StartKey, cfg.ExcludeRanges[i].EndKey = utils.KeyspaceRange(id, r.StartKey, r.EndKey)
+		}
+	}
 	return nil
 }
 
+// keyspaceMeta returns the keyspace of the raw backup with the range of the
+// user keys, nil if the keyspace isn't set.
+func (cfg *RawKvConfig) keyspaceMeta() (*backup.KeyspaceMeta, error) {
+	if len(cfg.Keyspace) == 0 {
+		return nil, nil
+	}
+	id, err := utils.ParseKeyspaceID(cfg.Keyspace)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	prefix := utils.KeyspacePrefix(id)
+	meta := &backup.KeyspaceMeta{ID: id, StartKey: bytes.TrimPrefix(cfg.StartKey, prefix)}
+	if bytes.HasPrefix(cfg.EndKey, prefix) {
+		meta.EndKey = cfg.EndKey[len(prefix):]
+	}
+	return meta, nil
+}
+
+// parseExcludeRanges parses the ranges in the form of `start:end`.
+func parseExcludeRanges(format string, items []string) ([]rtree.Range, error) {
+	ranges := make([]rtree.Range, 0, len(items))
+	for _, item := range items {
+		sep := strings.IndexByte(item, ':')
+		if sep < 0 {
+			return nil, errors.Annotatef(berrors.ErrInvalidArgument,
+				"invalid exclude range %s, should be in the form of `start:end`", item)
+		}
+		start, err := utils.ParseKey(format, item[:sep])
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		end, err := utils.ParseKey(format, item[sep+1:])
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		if len(end) > 0 && bytes.Compare(start, end) >= 0 {
+			return nil, errors.Annotatef(berrors.ErrBackupInvalidRange,
+				"the end key of exclude range %s must be greater than the start key", item)
+		}
+		ranges = append(ranges, rtree.Range{StartKey: start, EndKey: end})
+	}
+	return ranges, nil
+}
+
 // RunBackupRaw starts a backup task inside the current goroutine.
 func RunBackupRaw(c context.Context, g glue.Glue, cmdName string, cfg *RawKvConfig) error {
 	cfg.adjust()
@@ -144,6 +273,9 @@ func RunBackupRaw(c context.Context, g glue.Glue, cmdName string, cfg *RawKvConf
 		return errors.Trace(err)
 	}
 	defer mgr.Close()
+	if cfg.RemoveSchedulers {
+		defer setupPDOpLog(ctx, &cfg.Config, cmdName, mgr)()
+	}
 
 	client, err := backup.NewBackupClient(ctx, mgr)
 	if err != nil {
@@ -154,11 +286,36 @@ func RunBackupRaw(c context.Context, g glue.Glue, cmdName string, cfg *RawKvConf
 		SendCredentials: cfg.SendCreds,
 		SkipCheckPath:   cfg.SkipCheckPath,
 	}
+	client.SetMetaStorageClass(cfg.BackendOptions.MetaStorageClass(u))
 	if err = client.SetStorage(ctx, u, &opts); err != nil {
 		return errors.Trace(err)
 	}
+	if len(cfg.MetadataMasterKey) > 0 {
+		if err = client.EnableEncryption(ctx, cfg.MetadataMasterKey); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	if err = checkClockSkew(ctx, &cfg.Config, mgr.GetPDClient(), client.GetStorage()); err != nil {
+		return errors.Trace(err)
+	}
+	leaveRateLimitGroup, err := setupSharedRateLimit(ctx, &cfg.Config, client)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer leaveRateLimitGroup()
+	if err = setupBackupBandwidthProbe(ctx, mgr, &cfg.Config, cmdName, client); err != nil {
+		return errors.Trace(err)
+	}
 
 	backupRange := rtree.Range{StartKey: cfg.StartKey, EndKey: cfg.EndKey}
+	backupRanges := rtree.SubtractRanges(backupRange, cfg.ExcludeRanges)
+	if len(backupRanges) == 0 {
+		return errors.Annotate(berrors.ErrBackupInvalidRange, "the whole range is excluded")
+	}
+	for _, excluded := range cfg.ExcludeRanges {
+		log.Info("exclude range from backup", logutil.Key("startKey", excluded.StartKey),
+			logutil.Key("endKey", excluded.EndKey))
+	}
 
 	if cfg.RemoveSchedulers {
 		restore, e := mgr.RemoveSchedulers(ctx)
@@ -183,9 +340,13 @@ func RunBackupRaw(c context.Context, g glue.Glue, cmdName string, cfg *RawKvConf
 	}
 
 	// The number of regions need to backup
-	approximateRegions, err := mgr.GetRegionCount(ctx, backupRange.StartKey, backupRange.EndKey)
-	if err != nil {
-		return errors.Trace(err)
+	approximateRegions := 0
+	for _, r := range backupRanges {
+		regions, err := mgr.GetRegionCount(ctx, r.StartKey, r.EndKey)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		approximateRegions += regions
 	}
 
 	summary.CollectInt("backup total regions", approximateRegions)
@@ -202,26 +363,52 @@ func RunBackupRaw(c context.Context, g glue.Glue, cmdName string, cfg *RawKvConf
 		updateCh.Inc()
 	}
 
-	req := backuppb.BackupRequest{
-		ClusterId:        client.GetClusterID(),
-		StartVersion:     0,
-		EndVersion:       0,
-		RateLimit:        cfg.RateLimit,
-		Concurrency:      cfg.Concurrency,
-		IsRawKv:          true,
-		Cf:               cfg.CF,
-		CompressionType:  cfg.CompressionType,
-		CompressionLevel: cfg.CompressionLevel,
+	// The versions are ignored by the clusters of API V1, which keep no version
+	// of the raw keys, and the backup ts is recorded as the last backup ts of
+	// the next incremental backup.
+	backupTS, err := client.GetTS(ctx, 0, 0)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if len(cfg.Keyspace) > 0 {
+		if err = checkRawAPIV2(ctx, mgr, flagKeyspace); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	if cfg.LastBackupTS > 0 {
+		if err = checkRawAPIV2(ctx, mgr, flagLastBackupTS); err != nil {
+			return errors.Trace(err)
+		}
+		if backupTS <= cfg.LastBackupTS {
+			log.Error("LastBackupTS is larger or equal to current TS")
+			return errors.Annotate(berrors.ErrInvalidArgument, "LastBackupTS is larger or equal to current TS")
+		}
+		if err = utils.CheckGCSafePoint(ctx, mgr.GetPDClient(), cfg.LastBackupTS); err != nil {
+			log.Error("Check gc safepoint for last backup ts failed", zap.Error(err))
+			return errors.Trace(err)
+		}
+		log.Info("incremental raw backup", zap.Uint64("LastBackupTS", cfg.LastBackupTS),
+			zap.Uint64("BackupTS", backupTS))
 	}
+	g.Record("BackupTS", backupTS)
+
+	req := newRawBackupRequest(cfg, client.GetClusterID(), backupTS)
 	metaWriter := metautil.NewMetaWriter(client.GetStorage(), metautil.MetaFileSize, false)
-	metaWriter.StartWriteMetasAsync(ctx, metautil.AppendDataFile)
-	err = client.BackupRange(ctx, backupRange.StartKey, backupRange.EndKey, req, metaWriter, progressCallBack)
-	if err != nil {
+	if err = setSigner(ctx, metaWriter, cfg.SigningKey); err != nil {
 		return errors.Trace(err)
 	}
+	metaWriter.StartWriteMetasAsync(ctx, metautil.AppendDataFile)
+	// The excluded ranges are recorded as the gaps between the raw ranges.
+	rawRanges := make([]*backuppb.RawRange, 0, len(backupRanges))
+	for _, r := range backupRanges {
+		err = client.BackupRange(ctx, r.StartKey, r.EndKey, req, metaWriter, progressCallBack)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		rawRanges = append(rawRanges, &backuppb.RawRange{StartKey: r.StartKey, EndKey: r.EndKey, Cf: cfg.CF})
+	}
 	// Backup has finished
 	updateCh.Close()
-	rawRanges := []*backuppb.RawRange{{StartKey: backupRange.StartKey, EndKey: backupRange.EndKey, Cf: cfg.CF}}
 	metaWriter.Update(func(m *backuppb.BackupMeta) {
 		m.StartVersion = req.StartVersion
 		m.EndVersion = req.EndVersion
@@ -235,9 +422,56 @@ func RunBackupRaw(c context.Context, g glue.Glue, cmdName string, cfg *RawKvConf
 	if err != nil {
 		return errors.Trace(err)
 	}
+	ext := &backup.Extension{EncryptionAtRest: encryptionAtRest(ctx, mgr)}
+	if ext.Keyspace, err = cfg.keyspaceMeta(); err != nil {
+		return errors.Trace(err)
+	}
+	if err = backup.SaveExtension(ctx, client.GetStorage(), ext); err != nil {
+		return errors.Trace(err)
+	}
+	if err = metaWriter.WriteFinishMarker(ctx); err != nil {
+		return errors.Trace(err)
+	}
 	g.Record(summary.BackupDataSize, metaWriter.ArchiveSize())
 
 	// Set task summary to success status.
 	summary.SetSuccessStatus(true)
 	return nil
 }
+
+// checkRawAPIV2 checks all the TiKV stores run API V2, which the flag
+// requires. API V2 keeps the versions of the raw keys and the deletions, the
+// stores of API V1 ignore the versions of the backup request, which makes an
+// incremental backup full. The keyspaces only exist in API V2, the keys of
+// API V1 have no keyspace prefix.
+func checkRawAPIV2(ctx context.Context, mgr *conn.Mgr, flag string) error {
+	versions, err := mgr.GetStoresAPIVersion(ctx)
+	if err != nil {
+		return errors.Annotate(err, "failed to check the API version of the stores")
+	}
+	for storeID, version := range versions {
+		if version != 2 {
+			return errors.Annotatef(berrors.ErrInvalidArgument,
+				"--%s requires api-version=2, but store %d runs API V%d", flag, storeID, version)
+		}
+	}
+	return nil
+}
+
+// newRawBackupRequest returns the request backing up the raw keys changed in
+// (LastBackupTS, backupTS]. A full backup starts at version 0, so it covers
+// all the versions up to the backup ts, and the stores of API V1 ignore the
+// versions and back up all the raw keys as before.
+func newRawBackupRequest(cfg *RawKvConfig, clusterID, backupTS uint64) backuppb.BackupRequest {
+	return backuppb.BackupRequest{
+		ClusterId:        clusterID,
+		StartVersion:     cfg.LastBackupTS,
+		EndVersion:       backupTS,
+		RateLimit:        cfg.RateLimit,
+		Concurrency:      cfg.Concurrency,
+		IsRawKv:          true,
+		Cf:               cfg.CF,
+		CompressionType:  cfg.CompressionType,
+		CompressionLevel: cfg.CompressionLevel,
+	}
+}
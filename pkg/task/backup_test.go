@@ -3,6 +3,9 @@
 package task
 
 import (
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
@@ -59,3 +62,86 @@ func (s *testBackupSuite) TestParseCompressionType(c *C) {
 	c.Assert(err, ErrorMatches, "invalid compression.*")
 	c.Assert(int(ct), Equals, 0)
 }
+
+func (s *testBackupSuite) TestParseExcludeRanges(c *C) {
+	ranges, err := parseExcludeRanges("raw", []string{"cache_:cache`", "tmp:"})
+	c.Assert(err, IsNil)
+	c.Assert(ranges, HasLen, 2)
+	c.Assert(ranges[0].StartKey, DeepEquals, []byte("cache_"))
+	c.Assert(ranges[0].EndKey, DeepEquals, []byte("cache`"))
+	c.Assert(ranges[1].StartKey, DeepEquals, []byte("tmp"))
+	c.Assert(ranges[1].EndKey, HasLen, 0)
+
+	ranges, err = parseExcludeRanges("hex", []string{"0a:0b"})
+	c.Assert(err, IsNil)
+	c.Assert(ranges[0].StartKey, DeepEquals, []byte{0x0a})
+	c.Assert(ranges[0].EndKey, DeepEquals, []byte{0x0b})
+
+	_, err = parseExcludeRanges("raw", []string{"cache"})
+	c.Assert(err, ErrorMatches, ".*should be in the form of.*")
+	_, err = parseExcludeRanges("raw", []string{"b:a"})
+	c.Assert(err, ErrorMatches, ".*must be greater than the start key.*")
+}
+
+func (s *testBackupSuite) TestKeyArgs(c *C) {
+	dir := c.MkDir()
+	keyFile := filepath.Join(dir, "key")
+	c.Assert(os.WriteFile(keyFile, []byte("a b\\x00\n"), 0o644), IsNil)
+	rangesFile := filepath.Join(dir, "ranges")
+	c.Assert(os.WriteFile(rangesFile, []byte("0a:0b\r\n\n0c:\n"), 0o644), IsNil)
+
+	args := &keyArgs{stdin: strings.NewReader("74ff\n")}
+	key, err := args.key(flagStartKey, "plain")
+	c.Assert(err, IsNil)
+	c.Assert(key, Equals, "plain")
+	key, err = args.key(flagStartKey, "@"+keyFile)
+	c.Assert(err, IsNil)
+	c.Assert(key, Equals, "a b\\x00")
+	key, err = args.key(flagEndKey, "@-")
+	c.Assert(err, IsNil)
+	c.Assert(key, Equals, "74ff")
+	_, err = args.key(flagEndKey, "@-")
+	c.Assert(err, ErrorMatches, ".*has been read by another flag.*")
+	_, err = args.key(flagEndKey, "@"+filepath.Join(dir, "missing"))
+	c.Assert(err, ErrorMatches, ".*failed to read --end.*")
+
+	items, err := args.list(flagExcludeRange, []string{"@" + rangesFile, "0d:0e"})
+	c.Assert(err, IsNil)
+	c.Assert(items, DeepEquals, []string{"0a:0b", "0c:", "0d:0e"})
+	ranges, err := parseExcludeRanges("hex", items)
+	c.Assert(err, IsNil)
+	c.Assert(ranges, HasLen, 3)
+}
+
+func (s *testBackupSuite) TestShareRateLimit(c *C) {
+	c.Assert(shareRateLimit(100, 0), Equals, uint64(100))
+	c.Assert(shareRateLimit(100, 1), Equals, uint64(100))
+	c.Assert(shareRateLimit(100, 3), Equals, uint64(33))
+	// The share never becomes unlimited.
+	c.Assert(shareRateLimit(2, 3), Equals, uint64(1))
+}
+
+func (s *testBackupSuite) TestRawBackupRequest(c *C) {
+	cfg := &RawKvConfig{CF: "default"}
+	cfg.RateLimit = 10
+	cfg.Concurrency = 4
+
+	// A full backup covers all the versions up to the backup ts, the request
+	// is the same as the one ignoring the versions otherwise.
+	req := newRawBackupRequest(cfg, 1, 100)
+	c.Assert(req.StartVersion, Equals, uint64(0))
+	c.Assert(req.EndVersion, Equals, uint64(100))
+	req.EndVersion = 0
+	c.Assert(req, DeepEquals, backuppb.BackupRequest{
+		ClusterId:   1,
+		RateLimit:   10,
+		Concurrency: 4,
+		IsRawKv:     true,
+		Cf:          "default",
+	})
+
+	cfg.LastBackupTS = 50
+	req = newRawBackupRequest(cfg, 1, 100)
+	c.Assert(req.StartVersion, Equals, uint64(50))
+	c.Assert(req.EndVersion, Equals, uint64(100))
+}
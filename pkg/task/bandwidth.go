@@ -0,0 +1,145 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package task
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/docker/go-units"
+	"github.com/pingcap/errors"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+
+	"github.com/pingcap/br/pkg/backup"
+	"github.com/pingcap/br/pkg/conn"
+	"github.com/pingcap/br/pkg/restore"
+	"github.com/pingcap/br/pkg/utils"
+)
+
+const (
+	flagAutoTune = "auto-tune"
+	// bandwidthProbeWindow is the duration at the beginning of a task in which
+	// the throughput is measured.
+	bandwidthProbeWindow = 3 * time.Minute
+)
+
+// newBandwidthProbe returns a probe which logs the rate limit and the
+// concurrency suggested by the throughput of the task. The rate limit is
+// passed to apply if --auto-tune is set, the concurrency is only suggested
+// since it can't be changed after the task starts. rateLimit is the rate
+// limit of each store in effect when the task starts.
+//
+// With --auto-tune, the throughput is measured in every window of the task,
+// so the rate limit is raised while the throughput reaches it, and lowered
+// once the throughput drops.
+func newBandwidthProbe(
+	ctx context.Context, mgr *conn.Mgr, cfg *Config, cmdName string, concurrency uint, rateLimit uint64,
+	apply func(rateLimit uint64) error,
+) (*utils.BandwidthProbe, error) {
+	stores, err := conn.GetAllTiKVStores(ctx, mgr.GetPDClient(), conn.SkipTiFlash)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	autoTune := cfg.AutoTune
+	var probe *utils.BandwidthProbe
+	probe = utils.NewBandwidthProbe(bandwidthProbeWindow, len(stores), concurrency, func(s utils.BandwidthSuggestion) {
+		log.Info("measured the throughput, suggest the rate limit and the concurrency",
+			zap.String("task", cmdName),
+			zap.String("storage-throughput", units.HumanSize(s.StorageBytesPerSecond)+"/s"),
+			zap.String("kv-throughput", units.HumanSize(s.KVBytesPerSecond)+"/s"),
+			zap.Float64("utilization", s.Utilization),
+			zap.Bool("throttled", s.Throttled),
+			zap.Uint64("suggested-ratelimit-mb", s.RateLimit/units.MiB),
+			zap.Uint("concurrency", concurrency),
+			zap.Uint("suggested-concurrency", s.Concurrency),
+			zap.Bool("auto-tune", autoTune))
+		if !autoTune {
+			return
+		}
+		if err := apply(s.RateLimit); err != nil {
+			log.Warn("failed to apply the suggested rate limit", zap.Error(err))
+			return
+		}
+		probe.SetRateLimit(s.RateLimit)
+	})
+	if autoTune {
+		probe.Repeat().SetRateLimit(rateLimit)
+	}
+	return probe, nil
+}
+
+// setupBackupBandwidthProbe measures the throughput of the backup client. The
+// rate limit of TiKV applies to each backup request, so the suggested rate
+// limit of each store is shared by the concurrent ranges.
+func setupBackupBandwidthProbe(
+	ctx context.Context, mgr *conn.Mgr, cfg *Config, cmdName string, client *backup.Client,
+) error {
+	concurrency := uint(cfg.Concurrency)
+	if concurrency == 0 {
+		concurrency = 1
+	}
+	// The ranges started before the first suggestion use the rate limit of
+	// the config.
+	rateLimit := cfg.RateLimit
+	if cfg.AutoTune {
+		client.SetRateLimitFunc(func() uint64 {
+			return atomic.LoadUint64(&rateLimit)
+		})
+	}
+	storeRateLimit := rateLimit * uint64(concurrency)
+	probe, err := newBandwidthProbe(ctx, mgr, cfg, cmdName, concurrency, storeRateLimit, func(limit uint64) error {
+		limit /= uint64(concurrency)
+		if limit == 0 {
+			limit = 1
+		}
+		atomic.StoreUint64(&rateLimit, limit)
+		client.NotifyRateLimitChanged()
+		log.Info("applied the suggested rate limit to the backup requests",
+			zap.String("ratelimit", units.HumanSize(float64(limit))+"/s"))
+		return nil
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+	client.SetBandwidthProbe(probe)
+	return nil
+}
+
+// setupRestoreBandwidthProbe measures the throughput of the restore client,
+// the suggested rate limit is the download speed limit of each store.
+func setupRestoreBandwidthProbe(
+	ctx context.Context, mgr *conn.Mgr, cfg *Config, cmdName string, client *restore.Client,
+) error {
+	probe, err := newBandwidthProbe(ctx, mgr, cfg, cmdName, uint(cfg.Concurrency), cfg.RateLimit, func(limit uint64) error {
+		if err := client.SetDownloadSpeedLimit(ctx, limit); err != nil {
+			return errors.Trace(err)
+		}
+		log.Info("applied the suggested download speed limit",
+			zap.String("ratelimit", units.HumanSize(float64(limit))+"/s"))
+		return nil
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+	client.SetBandwidthProbe(probe)
+	return nil
+}
+
+// newAutoRateLimiter returns the AutoRateLimiter setting the download speed
+// limits of the stores through the client.
+func newAutoRateLimiter(load restore.StoresLoadFunc, client *restore.Client) *restore.AutoRateLimiter {
+	return restore.NewAutoRateLimiter(load, client.SetStoreDownloadSpeedLimit)
+}
+
+// startAutoRateLimit tunes the download speed limit of each store by its load
+// polled from PD in background until the context is done, see --ratelimit=auto.
+// It must be called after the backupmeta is loaded into the client, which
+// creates the import client setting the limits.
+func startAutoRateLimit(ctx context.Context, mgr *conn.Mgr, client *restore.Client) {
+	limiter := newAutoRateLimiter(mgr.GetStoresLoad, client)
+	log.Info("tune the download speed limit by the load of the stores",
+		zap.Duration("interval", restore.AutoRateLimitInterval))
+	go limiter.Run(ctx, restore.AutoRateLimitInterval)
+}
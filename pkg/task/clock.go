@@ -0,0 +1,83 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package task
+
+import (
+	"context"
+	"time"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/log"
+	"github.com/tikv/client-go/v2/oracle"
+	pd "github.com/tikv/pd/client"
+	"go.uber.org/zap"
+
+	berrors "github.com/pingcap/br/pkg/errors"
+	"github.com/pingcap/br/pkg/storage"
+)
+
+const (
+	flagClockSkewWarnThreshold = "clock-skew-warn-threshold"
+	flagClockSkewFailThreshold = "clock-skew-fail-threshold"
+
+	defaultClockSkewWarnThreshold = 5 * time.Second
+)
+
+// checkClockSkew compares the local time with the time of PD TSO and the
+// storage server. The skew breaks the semantics of the backup TS and the TTL
+// of the raw KV, so it warns if the skew exceeds cfg.ClockSkewWarnThreshold,
+// and fails if the skew exceeds cfg.ClockSkewFailThreshold.
+func checkClockSkew(ctx context.Context, cfg *Config, pdClient pd.Client, s storage.ExternalStorage) error {
+	before := time.Now()
+	physical, logical, err := pdClient.GetTS(ctx)
+	if err != nil {
+		return errors.Annotate(err, "failed to get ts from pd")
+	}
+	after := time.Now()
+	// Compare with the middle of the request to offset the network latency.
+	local := before.Add(after.Sub(before) / 2)
+	pdTime := oracle.GetTimeFromTS(oracle.ComposeTS(physical, logical))
+	if err = cfg.checkSkew("pd", pdTime.Sub(local)); err != nil {
+		return errors.Trace(err)
+	}
+
+	if s == nil {
+		return nil
+	}
+	before = time.Now()
+	storageTime, ok, err := storage.ServerTime(ctx, s)
+	if err != nil {
+		// The clock of the storage is less important, don't block the task.
+		log.Warn("failed to get the time of the storage, skip checking clock skew", zap.Error(err))
+		return nil
+	}
+	if !ok {
+		return nil
+	}
+	// The storage time is truncated to seconds.
+	skew := storageTime.Sub(before)
+	if skew < 0 && skew > -time.Second {
+		skew = 0
+	}
+	return errors.Trace(cfg.checkSkew("storage", skew))
+}
+
+func (cfg *Config) checkSkew(target string, skew time.Duration) error {
+	abs := skew
+	if abs < 0 {
+		abs = -abs
+	}
+	if cfg.ClockSkewFailThreshold > 0 && abs > cfg.ClockSkewFailThreshold {
+		return errors.Annotatef(berrors.ErrClockSkewTooLarge,
+			"the clock skew between BR and %s is %s, exceeds %s", target, skew, cfg.ClockSkewFailThreshold)
+	}
+	if cfg.ClockSkewWarnThreshold > 0 && abs > cfg.ClockSkewWarnThreshold {
+		log.Warn("clock skew is too large, please check the time synchronization",
+			zap.String("target", target),
+			zap.Duration("skew", skew),
+			zap.Duration("threshold", cfg.ClockSkewWarnThreshold))
+		return nil
+	}
+	log.Info("check clock skew", zap.String("target", target), zap.Duration("skew", skew))
+	return nil
+}
@@ -4,10 +4,15 @@ package task
 
 import (
 	"context"
+	"crypto/sha256"
 	"crypto/tls"
 	"fmt"
+	"net/http"
 	"net/url"
+	"os"
 	"path"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
@@ -29,6 +34,9 @@ import (
 	"github.com/pingcap/br/pkg/conn"
 	berrors "github.com/pingcap/br/pkg/errors"
 	"github.com/pingcap/br/pkg/glue"
+	"github.com/pingcap/br/pkg/metautil"
+	"github.com/pingcap/br/pkg/pdutil"
+	"github.com/pingcap/br/pkg/restore"
 	"github.com/pingcap/br/pkg/storage"
 	"github.com/pingcap/br/pkg/utils"
 )
@@ -38,6 +46,19 @@ const (
 	flagSendCreds = "send-credentials-to-tikv"
 	// No credentials specifies that cloud credentials should not be loaded
 	flagNoCreds = "no-credentials"
+	// flagPresignedManifest is the name of the pre-signed URL manifest flag.
+	flagPresignedManifest = "presigned-manifest"
+	// flagMetadataMasterKey is the flag name of the master key encrypting the
+	// metadata files written by BR.
+	flagMetadataMasterKey = "metadata-master-key"
+	// flagSigningKey is the flag name of the key signing the backupmeta.
+	flagSigningKey = "signing-key"
+	// flagMmapLocalFiles is the name of the flag to mmap the local SST files.
+	flagMmapLocalFiles = "mmap-local-files"
+	// flagLocalWriteRateLimit and flagLocalIdleIOPriority are the names of
+	// the flags to throttle the disk I/O of the local storage.
+	flagLocalWriteRateLimit = "local-write-ratelimit"
+	flagLocalIdleIOPriority = "local-idle-io-priority"
 	// flagStorage is the name of storage flag.
 	flagStorage = "storage"
 	// flagPD is the name of PD url flag.
@@ -48,6 +69,12 @@ const (
 	flagCert = "cert"
 	// flagKey is the name of TLS key flag.
 	flagKey = "key"
+	// flagPDTLSPrefix, flagTiKVTLSPrefix and flagStorageTLSPrefix are the
+	// prefixes of the TLS flags for the connections to the components, e.g.
+	// --pd-cert and --tikv-key.
+	flagPDTLSPrefix      = "pd-"
+	flagTiKVTLSPrefix    = "tikv-"
+	flagStorageTLSPrefix = "storage-"
 
 	flagDatabase = "db"
 	flagTable    = "table"
@@ -55,6 +82,7 @@ const (
 	flagChecksumConcurrency = "checksum-concurrency"
 	flagRateLimit           = "ratelimit"
 	flagRateLimitUnit       = "ratelimit-unit"
+	flagRateLimitGroup      = "ratelimit-group"
 	flagConcurrency         = "concurrency"
 	flagChecksum            = "checksum"
 	flagFilter              = "filter"
@@ -75,6 +103,9 @@ const (
 	defaultGRPCKeepaliveTimeout = 3 * time.Second
 
 	unlimited = 0
+	// rateLimitAuto is the value of --ratelimit to tune the rate limit by the
+	// load of the stores.
+	rateLimitAuto = "auto"
 )
 
 // TLSConfig is the common configuration for TLS connection.
@@ -82,6 +113,15 @@ type TLSConfig struct {
 	CA   string `json:"ca" toml:"ca"`
 	Cert string `json:"cert" toml:"cert"`
 	Key  string `json:"key" toml:"key"`
+
+	// PD and TiKV override the fields of the common config for the connections
+	// to PD and TiKV, which is needed if they live in different PKI domains.
+	PD   *TLSConfig `json:"pd,omitempty" toml:"pd"`
+	TiKV *TLSConfig `json:"tikv,omitempty" toml:"tikv"`
+	// Storage is the config for the HTTPS endpoint of the external storage,
+	// e.g. an S3 compatible service requiring client certificates. It doesn't
+	// inherit the common config, whose CA is usually private to the cluster.
+	Storage *TLSConfig `json:"storage,omitempty" toml:"storage"`
 }
 
 // IsEnabled checks if TLS open or not.
@@ -89,6 +129,50 @@ func (tls *TLSConfig) IsEnabled() bool {
 	return tls.CA != ""
 }
 
+// override returns the common config with the non-empty fields of the
+// component config.
+func (tls *TLSConfig) override(component *TLSConfig) TLSConfig {
+	result := TLSConfig{CA: tls.CA, Cert: tls.Cert, Key: tls.Key}
+	if component == nil {
+		return result
+	}
+	if component.CA != "" {
+		result.CA = component.CA
+	}
+	if component.Cert != "" {
+		result.Cert = component.Cert
+	}
+	if component.Key != "" {
+		result.Key = component.Key
+	}
+	return result
+}
+
+// ForPD returns the TLS config for the connections to PD.
+func (tls *TLSConfig) ForPD() TLSConfig {
+	return tls.override(tls.PD)
+}
+
+// ForTiKV returns the TLS config for the connections to TiKV.
+func (tls *TLSConfig) ForTiKV() TLSConfig {
+	return tls.override(tls.TiKV)
+}
+
+// ToStorageHTTPClient returns the HTTP client for the external storage with
+// the storage TLS config, or nil to use the default client.
+func (tls *TLSConfig) ToStorageHTTPClient() (*http.Client, error) {
+	if tls.Storage == nil || (tls.Storage.CA == "" && tls.Storage.Cert == "") {
+		return nil, nil
+	}
+	tlsConf, err := tls.Storage.ToTLSConfig()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.TLSClientConfig = tlsConf
+	return &http.Client{Transport: tr}, nil
+}
+
 // ToTLSConfig generate tls.Config.
 func (tls *TLSConfig) ToTLSConfig() (*tls.Config, error) {
 	tlsInfo := transport.TLSInfo{
@@ -103,6 +187,50 @@ func (tls *TLSConfig) ToTLSConfig() (*tls.Config, error) {
 	return tlsConfig, nil
 }
 
+// ToPDSecurityOption converts the TLS config to the security option of the
+// PD client.
+func (tls *TLSConfig) ToPDSecurityOption() pd.SecurityOption {
+	securityOption := pd.SecurityOption{}
+	if tls.IsEnabled() {
+		securityOption.CAPath = tls.CA
+		securityOption.CertPath = tls.Cert
+		securityOption.KeyPath = tls.Key
+	}
+	return securityOption
+}
+
+// ToStoreSecurityOption returns the security option of the storage opened by
+// the glue, which connects to both TiKV and PD with one option. It presents
+// the TiKV certificate and trusts the TiKV CA, and if PD has a different CA,
+// the CAs of both are bundled into a file in the temporary directory, so the
+// storage verifies both TiKV and PD.
+func (tls *TLSConfig) ToStoreSecurityOption() (pd.SecurityOption, error) {
+	tikvTLS, pdTLS := tls.ForTiKV(), tls.ForPD()
+	securityOption := tikvTLS.ToPDSecurityOption()
+	if !tikvTLS.IsEnabled() || !pdTLS.IsEnabled() || pdTLS.CA == tikvTLS.CA {
+		return securityOption, nil
+	}
+	var bundle []byte
+	for _, ca := range []string{tikvTLS.CA, pdTLS.CA} {
+		pem, err := os.ReadFile(ca)
+		if err != nil {
+			return securityOption, errors.Annotatef(err, "failed to read the CA %s", ca)
+		}
+		bundle = append(bundle, pem...)
+		bundle = append(bundle, '\n')
+	}
+	// The file is named by the content, so it's reused by the later runs.
+	// The storage reads it whenever connecting to a new store, so it isn't
+	// removed.
+	sum := sha256.Sum256(bundle)
+	bundlePath := filepath.Join(os.TempDir(), fmt.Sprintf("br-ca-bundle-%x.pem", sum[:8]))
+	if err := os.WriteFile(bundlePath, bundle, 0o644); err != nil {
+		return securityOption, errors.Annotate(err, "failed to write the CA bundle of PD and TiKV")
+	}
+	securityOption.CAPath = bundlePath
+	return securityOption, nil
+}
+
 // Config is the common configuration for all BRIE tasks.
 type Config struct {
 	storage.BackendOptions
@@ -126,6 +254,29 @@ type Config struct {
 
 	// NoCreds means don't try to load cloud credentials
 	NoCreds bool `json:"no-credentials" toml:"no-credentials"`
+	// PresignedManifest is the path of a local JSON file mapping the object
+	// names in the storage to their pre-signed URLs. When set, BR reads the
+	// storage through these URLs only.
+	PresignedManifest string `json:"presigned-manifest" toml:"presigned-manifest"`
+	// MetadataMasterKey is the URI of the master key, see backup.NewMasterKey.
+	// The backup encrypts the metadata files written by BR, e.g. the
+	// backupmeta, if it's set, and the restore decrypts them by it, or by the
+	// master key recorded by the backup if it's empty. The SST files written
+	// by TiKV are NOT encrypted by it.
+	MetadataMasterKey string `json:"metadata-master-key" toml:"metadata-master-key"`
+	// SigningKey is the URI of the signing key, see backup.NewSigner. The
+	// backup signs the backupmeta and the finish marker by it if it's set,
+	// and the restore verifies the signature by it before restoring.
+	SigningKey string `json:"signing-key" toml:"signing-key"`
+	// MmapLocalFiles maps the SST files of a local archive into memory when
+	// inspecting them, instead of reading them through buffers.
+	MmapLocalFiles bool `json:"mmap-local-files" toml:"mmap-local-files"`
+	// LocalWriteRateLimit is the max bytes per second written to a local
+	// storage, zero means unlimited.
+	LocalWriteRateLimit uint64 `json:"local-write-ratelimit" toml:"local-write-ratelimit"`
+	// LocalIdleIOPriority runs the disk I/O of BR in the idle class when
+	// using a local storage.
+	LocalIdleIOPriority bool `json:"local-idle-io-priority" toml:"local-idle-io-priority"`
 
 	CheckRequirements bool `json:"check-requirements" toml:"check-requirements"`
 	// EnableOpenTracing is whether to enable opentracing
@@ -150,20 +301,60 @@ type Config struct {
 	GRPCKeepaliveTime time.Duration `json:"grpc-keepalive-time" toml:"grpc-keepalive-time"`
 	// GrpcKeepaliveTimeout is the max time a grpc conn can keep idel before killed.
 	GRPCKeepaliveTimeout time.Duration `json:"grpc-keepalive-timeout" toml:"grpc-keepalive-timeout"`
+
+	// ClockSkewWarnThreshold is the clock skew between BR, PD and the storage
+	// to warn, zero means never warn.
+	ClockSkewWarnThreshold time.Duration `json:"clock-skew-warn-threshold" toml:"clock-skew-warn-threshold"`
+	// ClockSkewFailThreshold is the clock skew between BR, PD and the storage
+	// to fail the task, zero means never fail.
+	ClockSkewFailThreshold time.Duration `json:"clock-skew-fail-threshold" toml:"clock-skew-fail-threshold"`
+
+	// RateLimitAuto is set by --ratelimit=auto, see startAutoRateLimit.
+	RateLimitAuto bool `json:"rate-limit-auto" toml:"rate-limit-auto"`
+	// RecordHistory records the completed task into PD, see `br history`.
+	RecordHistory bool `json:"record-history" toml:"record-history"`
+	// MetricsPushAddr is the address of the Prometheus push gateway which
+	// the metrics are pushed to during the task, see StartMetricsPusher.
+	MetricsPushAddr string `json:"metrics-push-addr" toml:"metrics-push-addr"`
+	// RateLimitGroup makes the BR processes in the same group share RateLimit
+	// as a global budget, see joinRateLimitGroup.
+	RateLimitGroup string `json:"rate-limit-group" toml:"rate-limit-group"`
+	// AutoTune applies the rate limit suggested by the throughput measured at
+	// the beginning of the task, see newBandwidthProbe.
+	AutoTune bool `json:"auto-tune" toml:"auto-tune"`
 }
 
 // DefineCommonFlags defines the flags common to all BRIE commands.
 func DefineCommonFlags(flags *pflag.FlagSet) {
 	flags.BoolP(flagSendCreds, "c", true, "Whether send credentials to tikv")
 	flags.StringP(flagStorage, "s", "", `specify the url where backup storage, eg, "s3://bucket/path/prefix"`)
-	flags.StringSliceP(flagPD, "u", []string{"127.0.0.1:2379"}, "PD address")
+	flags.StringSliceP(flagPD, "u", []string{"127.0.0.1:2379"},
+		"PD address, can be an IPv6 literal, or srv://<name> to discover PD by DNS SRV records")
 	flags.String(flagCA, "", "CA certificate path for TLS connection")
 	flags.String(flagCert, "", "Certificate path for TLS connection")
 	flags.String(flagKey, "", "Private key path for TLS connection")
+	for _, component := range []struct{ prefix, name string }{
+		{flagPDTLSPrefix, "PD"},
+		{flagTiKVTLSPrefix, "TiKV"},
+	} {
+		flags.String(component.prefix+flagCA, "",
+			fmt.Sprintf("CA certificate path for TLS connection to %s, overrides --%s", component.name, flagCA))
+		flags.String(component.prefix+flagCert, "",
+			fmt.Sprintf("Certificate path for TLS connection to %s, overrides --%s", component.name, flagCert))
+		flags.String(component.prefix+flagKey, "",
+			fmt.Sprintf("Private key path for TLS connection to %s, overrides --%s", component.name, flagKey))
+	}
+	flags.String(flagStorageTLSPrefix+flagCA, "",
+		"CA certificate path for TLS connection to the storage endpoint, the system CAs are used by default")
+	flags.String(flagStorageTLSPrefix+flagCert, "", "Certificate path for TLS connection to the storage endpoint")
+	flags.String(flagStorageTLSPrefix+flagKey, "", "Private key path for TLS connection to the storage endpoint")
 	flags.Uint(flagChecksumConcurrency, variable.DefChecksumTableConcurrency, "The concurrency of table checksumming")
 	_ = flags.MarkHidden(flagChecksumConcurrency)
 
-	flags.Uint64(flagRateLimit, unlimited, "The rate limit of the task, MB/s per node")
+	flags.String(flagRateLimit, "0",
+		"The rate limit of the task, MB/s per node. restore also accepts auto, which tunes the download speed "+
+			"limit of each store by the bytes per second read and written by its foreground traffic, i.e. the "+
+			"hot store statistics of PD, the CPU and IO usage and the ingest speed aren't taken into account")
 	flags.Bool(flagChecksum, true, "Run checksum at end of task")
 	flags.Bool(flagRemoveTiFlash, true,
 		"Remove TiFlash replicas before backup or restore, for unsupported versions of TiFlash")
@@ -175,6 +366,10 @@ func DefineCommonFlags(flags *pflag.FlagSet) {
 	_ = flags.MarkHidden(flagConcurrency)
 
 	flags.Uint64(flagRateLimitUnit, units.MiB, "The unit of rate limit")
+	flags.String(flagRateLimitGroup, "",
+		"share --ratelimit of the backup with the other BR processes of the same group on the cluster, "+
+			"each process uses an even share of the budget, which is re-shared by the running ranges "+
+			"once a process joins or leaves")
 	_ = flags.MarkHidden(flagRateLimitUnit)
 	_ = flags.MarkDeprecated(flagRemoveTiFlash,
 		"TiFlash is fully supported by BR now, removing TiFlash isn't needed any more. This flag would be ignored.")
@@ -194,8 +389,42 @@ func DefineCommonFlags(flags *pflag.FlagSet) {
 
 	flags.BoolP(flagNoCreds, "", false, "Don't load credentials")
 	_ = flags.MarkHidden(flagNoCreds)
+	flags.String(flagPresignedManifest, "",
+		"Path of a JSON file mapping object names to pre-signed URLs, "+
+			"BR reads the storage through these URLs instead of using credentials")
+	flags.String(flagMetadataMasterKey, "",
+		"the master key encrypting the data key of the metadata files written by BR, e.g. the backupmeta, with "+
+			"AES-256-CTR, one of file:<path of the hex key>, aws-kms:<key-id>[?region=<region>] and "+
+			"gcp-kms:<key-name>. The SST files are written by TiKV and NOT encrypted by it, use the server-side "+
+			"encryption of the storage for them. restore uses the master key recorded by the backup by default")
+	flags.String(flagSigningKey, "",
+		"the key signing the backupmeta and the finish marker at backup, and verifying the signature before restore, "+
+			"one of file:<path of the PEM key>, aws-kms:<key-id>[?region=<region>&algorithm=<algorithm>] and "+
+			"gcp-kms:<key-version-name>. restore may use the file of the public key")
+	flags.Bool(flagMmapLocalFiles, false,
+		"mmap the SST files of a local or NFS mounted archive when checksumming or inspecting them, "+
+			"instead of reading them through buffers")
+	flags.Uint64(flagLocalWriteRateLimit, 0,
+		"the max MB/s written to a local storage by BR, so the co-located workloads, e.g. TiKV on the same host, "+
+			"aren't starved of the disk bandwidth. 0 means unlimited")
+	flags.Bool(flagLocalIdleIOPriority, false,
+		"run the disk I/O of BR in the idle I/O scheduling class when using a local storage, like `ionice -c 3`, "+
+			"only supported on Linux")
 	flags.BoolP(flagSkipCheckPath, "", false, "Skip path verification")
 	_ = flags.MarkHidden(flagSkipCheckPath)
+	flags.Duration(flagClockSkewWarnThreshold, defaultClockSkewWarnThreshold,
+		"warn if the clock skew between BR, PD and the storage exceeds this value, 0 means never warn")
+	flags.Duration(flagClockSkewFailThreshold, 0,
+		"fail the task if the clock skew between BR, PD and the storage exceeds this value, 0 means never fail")
+	flags.Bool(flagRecordHistory, false,
+		"record the completed backup or restore task into PD, the records can be listed by `br history`, "+
+			"only the latest 1000 records are kept")
+	flags.String(flagMetricsPushAddr, "",
+		"the address of the Prometheus push gateway, e.g. http://127.0.0.1:9091, the metrics of backup and "+
+			"restore are pushed to it periodically during the task and once the task finishes")
+	flags.Bool(flagAutoTune, false,
+		"apply the rate limit suggested by the throughput measured every few minutes of the task, "+
+			"which is raised while the throughput reaches it, the suggestion of the first minutes is logged anyway")
 
 	storage.DefineFlags(flags)
 }
@@ -224,9 +453,43 @@ func DefineFilterFlags(command *cobra.Command, defaultFilter []string) {
 func (tls *TLSConfig) ParseFromFlags(flags *pflag.FlagSet) error {
 	var err error
 	tls.CA, tls.Cert, tls.Key, err = ParseTLSTripleFromFlags(flags)
+	if err != nil {
+		return err
+	}
+	if tls.PD, err = parseComponentTLSFromFlags(flags, flagPDTLSPrefix); err != nil {
+		return err
+	}
+	if tls.TiKV, err = parseComponentTLSFromFlags(flags, flagTiKVTLSPrefix); err != nil {
+		return err
+	}
+	tls.Storage, err = parseComponentTLSFromFlags(flags, flagStorageTLSPrefix)
 	return err
 }
 
+// parseComponentTLSFromFlags parses the TLS flags with the prefix, it returns
+// nil if none of them is set.
+func parseComponentTLSFromFlags(flags *pflag.FlagSet, prefix string) (*TLSConfig, error) {
+	component := &TLSConfig{}
+	for _, field := range []struct {
+		flag  string
+		value *string
+	}{
+		{prefix + flagCA, &component.CA},
+		{prefix + flagCert, &component.Cert},
+		{prefix + flagKey, &component.Key},
+	} {
+		value, err := flags.GetString(field.flag)
+		if err != nil {
+			return nil, err
+		}
+		*field.value = value
+	}
+	if component.CA == "" && component.Cert == "" && component.Key == "" {
+		return nil, nil
+	}
+	return component, nil
+}
+
 // ParseTLSTripleFromFlags parses the (ca, cert, key) triple from flags.
 func ParseTLSTripleFromFlags(flags *pflag.FlagSet) (ca, cert, key string, err error) {
 	ca, err = flags.GetString(flagCA)
@@ -244,10 +507,26 @@ func ParseTLSTripleFromFlags(flags *pflag.FlagSet) (ca, cert, key string, err er
 	return
 }
 
+// parseRateLimit parses --ratelimit, which is either the MB/s or auto.
+func parseRateLimit(flags *pflag.FlagSet) (rateLimit uint64, auto bool, err error) {
+	value, err := flags.GetString(flagRateLimit)
+	if err != nil {
+		return 0, false, errors.Trace(err)
+	}
+	if strings.EqualFold(value, rateLimitAuto) {
+		return unlimited, true, nil
+	}
+	if rateLimit, err = strconv.ParseUint(value, 10, 64); err != nil {
+		return 0, false, errors.Annotatef(berrors.ErrInvalidArgument,
+			"--%s must be a number or %s, got %s", flagRateLimit, rateLimitAuto, value)
+	}
+	return rateLimit, false, nil
+}
+
 func (cfg *Config) normalizePDURLs() error {
 	for i := range cfg.PD {
 		var err error
-		cfg.PD[i], err = normalizePDURL(cfg.PD[i], cfg.TLS.IsEnabled())
+		cfg.PD[i], err = normalizePDURL(cfg.PD[i], cfg.TLS.ForPD().IsEnabled())
 		if err != nil {
 			return errors.Trace(err)
 		}
@@ -267,6 +546,26 @@ func (cfg *Config) ParseFromFlags(flags *pflag.FlagSet) error {
 	if cfg.NoCreds, err = flags.GetBool(flagNoCreds); err != nil {
 		return errors.Trace(err)
 	}
+	if cfg.PresignedManifest, err = flags.GetString(flagPresignedManifest); err != nil {
+		return errors.Trace(err)
+	}
+	if cfg.MetadataMasterKey, err = flags.GetString(flagMetadataMasterKey); err != nil {
+		return errors.Trace(err)
+	}
+	if cfg.SigningKey, err = flags.GetString(flagSigningKey); err != nil {
+		return errors.Trace(err)
+	}
+	if cfg.MmapLocalFiles, err = flags.GetBool(flagMmapLocalFiles); err != nil {
+		return errors.Trace(err)
+	}
+	localWriteRateLimit, err := flags.GetUint64(flagLocalWriteRateLimit)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	cfg.LocalWriteRateLimit = localWriteRateLimit * units.MiB
+	if cfg.LocalIdleIOPriority, err = flags.GetBool(flagLocalIdleIOPriority); err != nil {
+		return errors.Trace(err)
+	}
 	if cfg.Concurrency, err = flags.GetUint32(flagConcurrency); err != nil {
 		return errors.Trace(err)
 	}
@@ -278,13 +577,23 @@ func (cfg *Config) ParseFromFlags(flags *pflag.FlagSet) error {
 	}
 
 	var rateLimit, rateLimitUnit uint64
-	if rateLimit, err = flags.GetUint64(flagRateLimit); err != nil {
+	if rateLimit, cfg.RateLimitAuto, err = parseRateLimit(flags); err != nil {
 		return errors.Trace(err)
 	}
 	if rateLimitUnit, err = flags.GetUint64(flagRateLimitUnit); err != nil {
 		return errors.Trace(err)
 	}
 	cfg.RateLimit = rateLimit * rateLimitUnit
+	if cfg.RateLimitGroup, err = flags.GetString(flagRateLimitGroup); err != nil {
+		return errors.Trace(err)
+	}
+	if cfg.RateLimitGroup != "" && cfg.RateLimitAuto {
+		return errors.Annotatef(berrors.ErrInvalidArgument,
+			"--%s cannot be used with --%s=%s", flagRateLimitGroup, flagRateLimit, rateLimitAuto)
+	}
+	if cfg.RateLimitGroup != "" && cfg.RateLimit == unlimited {
+		return errors.Annotatef(berrors.ErrInvalidArgument, "--%s requires --%s", flagRateLimitGroup, flagRateLimit)
+	}
 
 	cfg.Schemas = make(map[string]struct{})
 	cfg.Tables = make(map[string]struct{})
@@ -368,10 +677,31 @@ func (cfg *Config) ParseFromFlags(flags *pflag.FlagSet) error {
 	if cfg.SkipCheckPath, err = flags.GetBool(flagSkipCheckPath); err != nil {
 		return errors.Trace(err)
 	}
+	if cfg.ClockSkewWarnThreshold, err = flags.GetDuration(flagClockSkewWarnThreshold); err != nil {
+		return errors.Trace(err)
+	}
+	if cfg.ClockSkewFailThreshold, err = flags.GetDuration(flagClockSkewFailThreshold); err != nil {
+		return errors.Trace(err)
+	}
+	if cfg.RecordHistory, err = flags.GetBool(flagRecordHistory); err != nil {
+		return errors.Trace(err)
+	}
+	if cfg.MetricsPushAddr, err = flags.GetString(flagMetricsPushAddr); err != nil {
+		return errors.Trace(err)
+	}
+	if cfg.AutoTune, err = flags.GetBool(flagAutoTune); err != nil {
+		return errors.Trace(err)
+	}
+	if cfg.AutoTune && (cfg.RateLimit != unlimited || cfg.RateLimitAuto) {
+		return errors.Annotatef(berrors.ErrInvalidArgument, "--%s cannot be used with --%s", flagAutoTune, flagRateLimit)
+	}
 	return cfg.normalizePDURLs()
 }
 
-// NewMgr creates a new mgr at the given PD address.
+// NewMgr creates a new mgr at the given PD address. The connections to PD and
+// TiKV use the TLS configs for them respectively, except that the storage
+// opened by the glue connects to both PD and TiKV with the TiKV certificate,
+// so PD must trust the TiKV certificate as well, see ToStoreSecurityOption.
 func NewMgr(ctx context.Context,
 	g glue.Glue, pds []string,
 	tlsConfig TLSConfig,
@@ -383,35 +713,59 @@ func NewMgr(ctx context.Context,
 		tlsConf *tls.Config
 		err     error
 	)
-	pdAddress := strings.Join(pds, ",")
-	if len(pdAddress) == 0 {
+	if len(strings.Join(pds, ",")) == 0 {
 		return nil, errors.Annotate(berrors.ErrInvalidArgument, "pd address can not be empty")
 	}
 
-	securityOption := pd.SecurityOption{}
-	if tlsConfig.IsEnabled() {
-		securityOption.CAPath = tlsConfig.CA
-		securityOption.CertPath = tlsConfig.Cert
-		securityOption.KeyPath = tlsConfig.Key
-		tlsConf, err = tlsConfig.ToTLSConfig()
+	pdTLS, tikvTLS := tlsConfig.ForPD(), tlsConfig.ForTiKV()
+	securityOption := pdTLS.ToPDSecurityOption()
+	var pdTLSConf *tls.Config
+	if pdTLS.IsEnabled() {
+		pdTLSConf, err = pdTLS.ToTLSConfig()
 		if err != nil {
 			return nil, errors.Trace(err)
 		}
 	}
+	if tikvTLS.IsEnabled() {
+		tlsConf, err = tikvTLS.ToTLSConfig()
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+	// Resolve the IPv6 literals and SRV records.
+	pds, err = pdutil.DiscoverAddrs(ctx, pds, pdTLSConf)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	pdAddress := strings.Join(pds, ",")
 
 	// Disable GC because TiDB enables GC already.
-	store, err := g.Open(fmt.Sprintf("tikv://%s?disableGC=true", pdAddress), securityOption)
+	storeSecurity, err := tlsConfig.ToStoreSecurityOption()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	store, err := g.Open(fmt.Sprintf("tikv://%s?disableGC=true", pdAddress), storeSecurity)
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
 
 	// Is it necessary to remove `StoreBehavior`?
 	return conn.NewMgr(
-		ctx, g, pdAddress, store, tlsConf, securityOption, keepalive, conn.SkipTiFlash,
+		ctx, g, pdAddress, store, tlsConf, pdTLSConf, securityOption, keepalive, conn.SkipTiFlash,
 		checkRequirements, needDomain,
 	)
 }
 
+// NewReadOnlyMgr reads the backupmeta and creates a read-only mgr on the
+// storage of the backup, for the operations that only read the backup.
+func NewReadOnlyMgr(ctx context.Context, cfg *Config) (*conn.ReadOnlyMgr, *backuppb.BackupMeta, error) {
+	u, s, backupMeta, err := ReadBackupMeta(ctx, metautil.MetaFile, cfg)
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+	return conn.NewReadOnlyMgr(u, s), backupMeta, nil
+}
+
 // GetStorage gets the storage backend from the config.
 func GetStorage(
 	ctx context.Context,
@@ -421,19 +775,40 @@ func GetStorage(
 	if err != nil {
 		return nil, nil, errors.Trace(err)
 	}
-	s, err := storage.New(ctx, u, storageOpts(cfg))
+	opts, err := storageOpts(cfg)
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+	s, err := storage.New(ctx, u, opts)
 	if err != nil {
 		return nil, nil, errors.Annotate(err, "create storage failed")
 	}
 	return u, s, nil
 }
 
-func storageOpts(cfg *Config) *storage.ExternalStorageOptions {
-	return &storage.ExternalStorageOptions{
+func storageOpts(cfg *Config) (*storage.ExternalStorageOptions, error) {
+	opts := &storage.ExternalStorageOptions{
 		NoCredentials:   cfg.NoCreds,
 		SendCredentials: cfg.SendCreds,
 		SkipCheckPath:   cfg.SkipCheckPath,
+		MmapLocalFiles:  cfg.MmapLocalFiles,
+
+		LocalWriteRateLimit: cfg.LocalWriteRateLimit,
+		LocalIdleIOPriority: cfg.LocalIdleIOPriority,
 	}
+	httpClient, err := cfg.TLS.ToStorageHTTPClient()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	opts.HTTPClient = httpClient
+	if len(cfg.PresignedManifest) > 0 {
+		manifest, err := storage.LoadURLManifest(cfg.PresignedManifest)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		opts.URLSigner = manifest
+	}
+	return opts, nil
 }
 
 // ReadBackupMeta reads the backupmeta file from the storage.
@@ -446,18 +821,31 @@ func ReadBackupMeta(
 	if err != nil {
 		return nil, nil, nil, errors.Trace(err)
 	}
+	if s, err = restore.DecryptStorage(ctx, s, cfg.MetadataMasterKey); err != nil {
+		return nil, nil, nil, errors.Trace(err)
+	}
+	// The meta files are read repeatedly during the restore planning.
+	s = storage.WithCache(s, storage.DefaultCacheSize)
 	metaData, err := s.ReadFile(ctx, fileName)
 	if err != nil {
-		if gcsObjectNotFound(err) {
+		if u.GetGcs() != nil && gcsObjectNotFound(err) {
 			// change gcs://bucket/abc/def to gcs://bucket/abc and read defbackupmeta
 			oldPrefix := u.GetGcs().GetPrefix()
 			newPrefix, file := path.Split(oldPrefix)
 			newFileName := file + fileName
 			u.GetGcs().Prefix = newPrefix
-			s, err = storage.New(ctx, u, storageOpts(cfg))
+			opts, err1 := storageOpts(cfg)
+			if err1 != nil {
+				return nil, nil, nil, errors.Trace(err1)
+			}
+			s, err = storage.New(ctx, u, opts)
 			if err != nil {
 				return nil, nil, nil, errors.Trace(err)
 			}
+			if s, err = restore.DecryptStorage(ctx, s, cfg.MetadataMasterKey); err != nil {
+				return nil, nil, nil, errors.Trace(err)
+			}
+			s = storage.WithCache(s, storage.DefaultCacheSize)
 			log.Info("retry load metadata in gcs", zap.String("newPrefix", newPrefix), zap.String("newFileName", newFileName))
 			metaData, err = s.ReadFile(ctx, newFileName)
 			if err != nil {
@@ -469,6 +857,9 @@ func ReadBackupMeta(
 			return nil, nil, nil, errors.Annotate(err, "load backupmeta failed")
 		}
 	}
+	if metaData, err = metautil.DecodeMetaContent(metaData); err != nil {
+		return nil, nil, nil, errors.Annotate(err, "decompress backupmeta failed")
+	}
 	backupMeta := &backuppb.BackupMeta{}
 	if err = proto.Unmarshal(metaData, backupMeta); err != nil {
 		return nil, nil, nil, errors.Annotate(err, "parse backupmeta failed")
@@ -546,5 +937,6 @@ func normalizePDURL(pd string, useTLS bool) (string, error) {
 // but the backupmeta is written wrongly to gcs://bucket/prefixbackupmeta.
 // see details https://github.com/pingcap/br/issues/675#issuecomment-753780742
 func gcsObjectNotFound(err error) bool {
-	return errors.Cause(err) == gcs.ErrObjectNotExist // nolint:errorlint
+	return berrors.Is(err, berrors.ErrStorageNotFound) ||
+		errors.Cause(err) == gcs.ErrObjectNotExist // nolint:errorlint
 }
@@ -0,0 +1,147 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package task
+
+import (
+	"context"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/pingcap/errors"
+	"github.com/spf13/pflag"
+
+	"github.com/pingcap/br/pkg/backup"
+	berrors "github.com/pingcap/br/pkg/errors"
+	"github.com/pingcap/br/pkg/glue"
+	"github.com/pingcap/br/pkg/metautil"
+	"github.com/pingcap/br/pkg/summary"
+)
+
+const (
+	flagIncremental = "incremental"
+	flagTarget      = "target"
+)
+
+// CompactConfig is the configuration specific for compacting a backup chain.
+type CompactConfig struct {
+	Config
+
+	// Incrementals are the URLs of the incremental backups of the full
+	// backup in --storage, in the order of the backup ts.
+	Incrementals []string `json:"incrementals" toml:"incrementals"`
+	// Target is the URL of the storage to save the compacted full backup.
+	Target string `json:"target" toml:"target"`
+}
+
+// DefineCompactFlags defines flags for compacting a backup chain.
+func DefineCompactFlags(flags *pflag.FlagSet) {
+	flags.StringSlice(flagIncremental, nil,
+		"the URLs of the incremental backups of the full backup in --storage, in the order of the backup ts")
+	flags.String(flagTarget, "", "the URL of the storage to save the compacted full backup")
+}
+
+// ParseFromFlags parses the compact-related flags from the flag set.
+func (cfg *CompactConfig) ParseFromFlags(flags *pflag.FlagSet) error {
+	var err error
+	if cfg.Incrementals, err = flags.GetStringSlice(flagIncremental); err != nil {
+		return errors.Trace(err)
+	}
+	if cfg.Target, err = flags.GetString(flagTarget); err != nil {
+		return errors.Trace(err)
+	}
+	if cfg.Target == "" {
+		return errors.Annotatef(berrors.ErrInvalidArgument, "--%s is required", flagTarget)
+	}
+	if err = cfg.Config.ParseFromFlags(flags); err != nil {
+		return errors.Trace(err)
+	}
+	if len(cfg.MetadataMasterKey) > 0 {
+		return errors.Annotatef(berrors.ErrInvalidArgument, "compact doesn't support --%s yet", flagMetadataMasterKey)
+	}
+	return nil
+}
+
+// readArchive reads the backupmeta in the storage with the same options as cfg.
+func readArchive(ctx context.Context, cfg *Config, storageURL string) (metautil.Archive, error) {
+	archiveCfg := *cfg
+	archiveCfg.Storage = storageURL
+	_, s, backupMeta, err := ReadBackupMeta(ctx, metautil.MetaFile, &archiveCfg)
+	if err != nil {
+		return metautil.Archive{}, errors.Annotatef(err, "failed to read the archive %s", redactStorageURL(storageURL))
+	}
+	// The compacted backup would be written without the encryption.
+	encryption, err := backup.LoadEncryptionMeta(ctx, s)
+	if err != nil {
+		return metautil.Archive{}, errors.Trace(err)
+	}
+	if encryption != nil {
+		return metautil.Archive{}, errors.Annotatef(berrors.ErrInvalidArgument,
+			"compact doesn't support the archive %s with encrypted metadata yet", redactStorageURL(storageURL))
+	}
+	return metautil.Archive{Storage: s, Meta: backupMeta}, nil
+}
+
+// RunCompact merges the full backup and its incremental backups into a new
+// full backup without accessing the cluster, so the restore doesn't need the
+// whole chain, and the old incremental backups can be purged.
+func RunCompact(c context.Context, g glue.Glue, cmdName string, cfg *CompactConfig) error {
+	ctx, cancel := context.WithCancel(c)
+	defer cancel()
+	defer summary.Summary(cmdName)
+
+	chain := make([]metautil.Archive, 0, len(cfg.Incrementals)+1)
+	for _, storageURL := range append([]string{cfg.Storage}, cfg.Incrementals...) {
+		archive, err := readArchive(ctx, &cfg.Config, storageURL)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		chain = append(chain, archive)
+	}
+
+	targetCfg := cfg.Config
+	targetCfg.Storage = cfg.Target
+	_, target, err := GetStorage(ctx, &targetCfg)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	exist, err := target.FileExists(ctx, metautil.MetaFile)
+	if err != nil {
+		return errors.Annotatef(err, "error occurred when checking %s file", metautil.MetaFile)
+	}
+	if exist {
+		return errors.Annotatef(berrors.ErrInvalidArgument,
+			"backup meta file exists in %s, please specify an empty target", redactStorageURL(cfg.Target))
+	}
+
+	compacted, report, err := metautil.CompactBackupChain(ctx, chain, target)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	compacted.BrVersion = g.GetVersion()
+	data, err := proto.Marshal(compacted)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	// The compacted backup is of the cluster at the last incremental backup.
+	ext, err := backup.LoadExtension(ctx, chain[len(chain)-1].Storage)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if err = backup.SaveExtension(ctx, target, ext); err != nil {
+		return errors.Trace(err)
+	}
+	// The backupmeta is written at last, so an interrupted compaction leaves
+	// no valid archive in the target.
+	if err = target.WriteFile(ctx, metautil.MetaFile, data); err != nil {
+		return errors.Trace(err)
+	}
+	if err = metautil.WriteFinishMarker(ctx, target, metautil.NewFinishMarker(data, len(compacted.Files))); err != nil {
+		return errors.Trace(err)
+	}
+
+	summary.CollectInt("compacted archives", len(chain))
+	summary.CollectInt("copied files", report.Copied)
+	summary.CollectInt("merged files", report.Merged)
+	summary.CollectInt("dropped files", report.Dropped)
+	summary.SetSuccessStatus(true)
+	return nil
+}
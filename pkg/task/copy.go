@@ -0,0 +1,254 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package task
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"strings"
+	"sync/atomic"
+
+	"github.com/pingcap/errors"
+	backuppb "github.com/pingcap/kvproto/pkg/backup"
+	"github.com/pingcap/log"
+	"github.com/spf13/pflag"
+	"go.uber.org/zap"
+	"golang.org/x/sync/errgroup"
+
+	berrors "github.com/pingcap/br/pkg/errors"
+	"github.com/pingcap/br/pkg/glue"
+	"github.com/pingcap/br/pkg/metautil"
+	"github.com/pingcap/br/pkg/storage"
+	"github.com/pingcap/br/pkg/summary"
+	"github.com/pingcap/br/pkg/utils"
+)
+
+const (
+	flagCopyFrom   = "from"
+	flagCopyTo     = "to"
+	flagCopyVerify = "verify"
+)
+
+// copyLastFiles are copied after all the other files in order, so an
+// interrupted copy leaves no complete archive in the target, like the backup.
+var copyLastFiles = []string{metautil.MetaFile, metautil.SignatureFile, metautil.FinishMarkerFile}
+
+// CopyConfig is the configuration specific for copying an archive between
+// the storages.
+type CopyConfig struct {
+	Config
+
+	// From is the URL of the archive to copy, --storage is used if it's
+	// empty. To is the URL of the storage to copy the archive into.
+	From string `json:"from" toml:"from"`
+	To   string `json:"to" toml:"to"`
+	// Verify reads back each file copied and compares it with the source.
+	Verify bool `json:"verify" toml:"verify"`
+}
+
+// DefineCopyFlags defines flags for copying an archive.
+func DefineCopyFlags(flags *pflag.FlagSet) {
+	flags.String(flagCopyFrom, "", "the URL of the archive to copy, --storage is used if it's empty")
+	flags.String(flagCopyTo, "", "the URL of the storage to copy the archive into, which should be empty")
+	flags.Bool(flagCopyVerify, true,
+		"read back each file copied and compare its sha256 with the source, besides verifying the data files "+
+			"against the backupmeta")
+}
+
+// ParseFromFlags parses the copy-related flags from the flag set.
+func (cfg *CopyConfig) ParseFromFlags(flags *pflag.FlagSet) error {
+	var err error
+	if cfg.From, err = flags.GetString(flagCopyFrom); err != nil {
+		return errors.Trace(err)
+	}
+	if cfg.To, err = flags.GetString(flagCopyTo); err != nil {
+		return errors.Trace(err)
+	}
+	if cfg.Verify, err = flags.GetBool(flagCopyVerify); err != nil {
+		return errors.Trace(err)
+	}
+	if err = cfg.Config.ParseFromFlags(flags); err != nil {
+		return errors.Trace(err)
+	}
+	if cfg.From == "" {
+		cfg.From = cfg.Storage
+	}
+	if cfg.From == "" || cfg.To == "" {
+		return errors.Annotatef(berrors.ErrInvalidArgument, "--%s and --%s are required", flagCopyFrom, flagCopyTo)
+	}
+	return nil
+}
+
+// RunCopy copies the archive between the storages, e.g. from S3 to GCS, by
+// streaming the files without a local staging disk. The files are copied as
+// they are, so an encrypted or signed archive stays valid. The object names
+// listed from the source are rewritten relative to the archive, which also
+// relocates the archives written by the older BR into GCS with the file
+// names concatenated to the prefix. The data files are verified against the
+// backupmeta while being copied.
+func RunCopy(c context.Context, g glue.Glue, cmdName string, cfg *CopyConfig) error {
+	ctx, cancel := context.WithCancel(c)
+	defer cancel()
+	defer summary.Summary(cmdName)
+
+	sourceCfg := cfg.Config
+	sourceCfg.Storage = cfg.From
+	// The backupmeta is read through the decryption only to know the data
+	// files, the source is copied without it.
+	_, s, backupMeta, err := ReadBackupMeta(ctx, metautil.MetaFile, &sourceCfg)
+	if err != nil {
+		return errors.Annotatef(err, "failed to read the archive %s", redactStorageURL(cfg.From))
+	}
+	if marker, err := metautil.CheckFinishMarker(ctx, s); err != nil {
+		log.Warn("the backup may be incomplete, copy it anyway", zap.Error(err))
+	} else {
+		log.Info("the backup is complete", zap.Int("file-count", marker.FileCount))
+	}
+	dataFiles, err := metautil.NewMetaReader(backupMeta, s).ReadDataFiles(ctx)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	recorded := make(map[string]*backuppb.File, len(dataFiles))
+	for _, f := range dataFiles {
+		recorded[strings.TrimPrefix(f.GetName(), "/")] = f
+	}
+
+	_, source, err := GetStorage(ctx, &sourceCfg)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	targetCfg := cfg.Config
+	targetCfg.Storage = cfg.To
+	_, target, err := GetStorage(ctx, &targetCfg)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	exist, err := target.FileExists(ctx, metautil.MetaFile)
+	if err != nil {
+		return errors.Annotatef(err, "error occurred when checking %s file", metautil.MetaFile)
+	}
+	if exist {
+		return errors.Annotatef(berrors.ErrInvalidArgument,
+			"backup meta file exists in %s, please specify an empty target", redactStorageURL(cfg.To))
+	}
+
+	names, lastNames, err := listArchiveFiles(ctx, source)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	listed := make(map[string]struct{}, len(names))
+	for _, name := range names {
+		listed[name] = struct{}{}
+	}
+	for name := range recorded {
+		if _, ok := listed[name]; !ok {
+			return errors.Annotatef(berrors.ErrBackupChecksumMismatch,
+				"the data file %s in the backupmeta is missing", name)
+		}
+	}
+
+	var copiedBytes int64
+	updateCh := g.StartProgress(ctx, cmdName, int64(len(names)+len(lastNames)), !cfg.LogProgress)
+	defer updateCh.Close()
+	copyOne := func(name string) error {
+		size, err := copyArchiveFile(ctx, source, target, name, recorded[name], cfg.Verify)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		atomic.AddInt64(&copiedBytes, size)
+		updateCh.Inc()
+		return nil
+	}
+	pool := utils.NewWorkerPool(uint(cfg.Concurrency), "copy")
+	eg, ectx := errgroup.WithContext(ctx)
+	for _, name := range names {
+		name := name
+		if ectx.Err() != nil {
+			break
+		}
+		pool.ApplyOnErrorGroup(eg, func() error { return copyOne(name) })
+	}
+	if err = eg.Wait(); err != nil {
+		return errors.Trace(err)
+	}
+	for _, name := range lastNames {
+		if err = copyOne(name); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	summary.CollectInt("copied files", len(names)+len(lastNames))
+	summary.CollectInt("verified data files", len(recorded))
+	summary.CollectSuccessUnit(summary.TotalBytes, 1, uint64(copiedBytes))
+	summary.SetSuccessStatus(true)
+	return nil
+}
+
+// listArchiveFiles lists the files of the archive by the names relative to the
+// archive. The files in copyLastFiles are returned separately in order.
+func listArchiveFiles(ctx context.Context, s storage.ExternalStorage) (names, lastNames []string, err error) {
+	last := make(map[string]bool, len(copyLastFiles))
+	for _, name := range copyLastFiles {
+		last[name] = false
+	}
+	err = s.WalkDir(ctx, &storage.WalkOption{}, func(path string, _ int64) error {
+		// The listed names may start with a slash if the prefix of the
+		// storage doesn't end with one.
+		name := strings.TrimPrefix(path, "/")
+		if name == "" {
+			return nil
+		}
+		if _, ok := last[name]; ok {
+			last[name] = true
+			return nil
+		}
+		names = append(names, name)
+		return nil
+	})
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+	for _, name := range copyLastFiles {
+		if last[name] {
+			lastNames = append(lastNames, name)
+		}
+	}
+	return names, lastNames, nil
+}
+
+// copyArchiveFile copies the file and verifies it against the data file in the
+// backupmeta if it's recorded, and against the source by reading it back if
+// verify is set. It returns the size of the file.
+func copyArchiveFile(
+	ctx context.Context, source, target storage.ExternalStorage, name string, recorded *backuppb.File, verify bool,
+) (int64, error) {
+	size, sum, err := storage.CopyFile(ctx, source, name, target, name)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	if recorded != nil {
+		if recorded.GetSize_() > 0 && uint64(size) != recorded.GetSize_() {
+			return 0, errors.Annotatef(berrors.ErrBackupChecksumMismatch,
+				"the size of %s is %d, but %d is recorded in the backupmeta", name, size, recorded.GetSize_())
+		}
+		if len(recorded.GetSha256()) > 0 && !bytes.Equal(sum, recorded.GetSha256()) {
+			return 0, errors.Annotatef(berrors.ErrBackupChecksumMismatch,
+				"the sha256 of %s is %s, but %s is recorded in the backupmeta",
+				name, hex.EncodeToString(sum), hex.EncodeToString(recorded.GetSha256()))
+		}
+	}
+	if verify {
+		copiedSize, copiedSum, err := storage.FileSha256(ctx, target, name)
+		if err != nil {
+			return 0, errors.Trace(err)
+		}
+		if copiedSize != size || !bytes.Equal(copiedSum, sum) {
+			return 0, errors.Annotatef(berrors.ErrBackupChecksumMismatch,
+				"the copied %s of %d bytes and sha256 %s doesn't match the source of %d bytes and sha256 %s",
+				name, copiedSize, hex.EncodeToString(copiedSum), size, hex.EncodeToString(sum))
+		}
+	}
+	log.Debug("copied the file", zap.String("name", name), zap.Int64("size", size))
+	return size, nil
+}
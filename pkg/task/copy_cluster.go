@@ -0,0 +1,200 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package task
+
+import (
+	"context"
+	"strings"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/log"
+	"github.com/spf13/pflag"
+	"go.uber.org/zap"
+
+	"github.com/pingcap/br/pkg/backup"
+	berrors "github.com/pingcap/br/pkg/errors"
+	"github.com/pingcap/br/pkg/glue"
+	"github.com/pingcap/br/pkg/restore"
+	"github.com/pingcap/br/pkg/summary"
+	"github.com/pingcap/br/pkg/utils"
+)
+
+const (
+	flagDestPD = "dest-pd"
+	// flagGRPCCompression is the flag name of the gRPC compression of the
+	// KV pairs written into the destination TiKV.
+	flagGRPCCompression = "grpc-compression"
+)
+
+// CopyClusterConfig is the configuration specific for copying the tables of
+// a cluster into another cluster.
+type CopyClusterConfig struct {
+	Config
+
+	// DestPD is the PD addresses of the destination cluster, the source is
+	// the cluster of --pd.
+	DestPD   []string `json:"dest-pd" toml:"dest-pd"`
+	BackupTS uint64   `json:"backup-ts" toml:"backup-ts"`
+	GCTTL    int64    `json:"gc-ttl" toml:"gc-ttl"`
+	// GRPCCompression is the compression of the Write requests carrying the
+	// KV pairs from BR to the destination TiKV, one of none and gzip.
+	GRPCCompression string `json:"grpc-compression" toml:"grpc-compression"`
+}
+
+// DefineCopyClusterFlags defines flags for copying a cluster.
+func DefineCopyClusterFlags(flags *pflag.FlagSet) {
+	flags.StringSlice(flagDestPD, nil, "PD address of the destination cluster")
+	flags.String(flagBackupTS, "", "the ts of the source cluster to copy, support TSO or datetime,"+
+		" e.g. '400036290571534337', '2018-05-11 01:42:23', the current ts is used if it's empty")
+	flags.Int64(flagGCTTL, utils.DefaultBRGCSafePointTTL,
+		"the TTL (in seconds) that PD of the source cluster holds for BR's GC safepoint")
+	flags.String(flagGRPCCompression, restore.GRPCCompressionNone,
+		"the compression of the KV pairs sent from BR to the destination TiKV, one of none and gzip, "+
+			"gzip saves the bandwidth on WAN at the cost of CPU")
+}
+
+// ParseFromFlags parses the copy-cluster-related flags from the flag set.
+func (cfg *CopyClusterConfig) ParseFromFlags(flags *pflag.FlagSet) error {
+	var err error
+	if cfg.DestPD, err = flags.GetStringSlice(flagDestPD); err != nil {
+		return errors.Trace(err)
+	}
+	if len(cfg.DestPD) == 0 {
+		return errors.Annotatef(berrors.ErrInvalidArgument, "--%s is required", flagDestPD)
+	}
+	backupTS, err := flags.GetString(flagBackupTS)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if cfg.BackupTS, err = parseTSString(backupTS); err != nil {
+		return errors.Trace(err)
+	}
+	if cfg.GCTTL, err = flags.GetInt64(flagGCTTL); err != nil {
+		return errors.Trace(err)
+	}
+	if cfg.GRPCCompression, err = flags.GetString(flagGRPCCompression); err != nil {
+		return errors.Trace(err)
+	}
+	if _, err = restore.ParseGRPCCompression(cfg.GRPCCompression); err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(cfg.Config.ParseFromFlags(flags))
+}
+
+// RunCopyCluster copies the tables of the source cluster at the backup ts into
+// the destination cluster without external storage. The tables are created
+// in the destination, then BR scans the source and writes the KV pairs into
+// the destination TiKV directly, so all data goes through BR. The copied
+// tables are compared with the source ones by the admin checksums unless
+// --checksum is false.
+func RunCopyCluster(c context.Context, g glue.Glue, cmdName string, cfg *CopyClusterConfig) error {
+	ctx, cancel := context.WithCancel(c)
+	defer cancel()
+	defer summary.Summary(cmdName)
+	cfg.adjust()
+	if cfg.Concurrency == 0 {
+		cfg.Concurrency = defaultRestoreConcurrency
+	}
+
+	sourceMgr, err := NewMgr(ctx, g, cfg.PD, cfg.TLS, GetKeepalive(&cfg.Config), cfg.CheckRequirements, false)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer sourceMgr.Close()
+	backupClient, err := backup.NewBackupClient(ctx, sourceMgr)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	backupClient.SetGCTTL(cfg.GCTTL)
+	backupTS, err := backupClient.GetTS(ctx, 0, cfg.BackupTS)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	g.Record("BackupTS", backupTS)
+	sp := utils.BRServiceSafePoint{
+		BackupTS: backupTS,
+		TTL:      backupClient.GetGCTTL(),
+		ID:       utils.MakeSafePointID(),
+	}
+	log.Info("current copy safePoint job", zap.Object("safePoint", sp))
+	if err = utils.StartServiceSafePointKeeper(ctx, sourceMgr.GetPDClient(), sp); err != nil {
+		return errors.Trace(err)
+	}
+	ranges, schemas, err := backup.BuildBackupRangeAndSchema(sourceMgr.GetStorage(), cfg.TableFilter, backupTS)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if schemas.Len() == 0 {
+		log.Info("nothing to copy, all databases and tables are filtered out")
+		summary.SetSuccessStatus(true)
+		return nil
+	}
+
+	// The destination needs domain to do DDL.
+	destMgr, err := NewMgr(ctx, g, cfg.DestPD, cfg.TLS, GetKeepalive(&cfg.Config), cfg.CheckRequirements, true)
+	if err != nil {
+		return errors.Annotatef(err, "failed to connect to the destination cluster %s", strings.Join(cfg.DestPD, ","))
+	}
+	defer destMgr.Close()
+	keepaliveCfg := GetKeepalive(&cfg.Config)
+	keepaliveCfg.PermitWithoutStream = true
+	client, err := restore.NewRestoreClient(g, destMgr.GetPDClient(), destMgr.GetStorage(), destMgr.GetTLSConfig(), keepaliveCfg)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	client.SetPDTLSConfig(destMgr.GetPDTLSConfig())
+	defer client.Close()
+	compressor, err := restore.ParseGRPCCompression(cfg.GRPCCompression)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	client.SetGRPCCompressor(compressor)
+
+	tables := schemas.Tables()
+	createdDatabases := make(map[string]struct{})
+	for _, table := range tables {
+		if _, ok := createdDatabases[table.DB.Name.L]; ok {
+			continue
+		}
+		if err = client.CreateDatabase(ctx, table.DB); err != nil {
+			return errors.Trace(err)
+		}
+		createdDatabases[table.DB.Name.L] = struct{}{}
+	}
+	rewriteRules, _, err := client.CreateTables(destMgr.GetDomain(), tables, 0)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	restoreSchedulers, err := restorePreWork(ctx, client, destMgr)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer restorePostWork(ctx, client, restoreSchedulers)
+
+	updateCh := g.StartProgress(ctx, cmdName, int64(len(ranges)), !cfg.LogProgress)
+	err = client.CopyRanges(ctx, sourceMgr.GetStorage(), ranges, backupTS, rewriteRules, uint(cfg.Concurrency), updateCh)
+	updateCh.Close()
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	// BR rewrites every copied KV pair, so the copied tables are checked
+	// against the source by the admin checksums.
+	if cfg.Checksum {
+		checksumCh := g.StartProgress(ctx, "Checksum", int64(len(tables)), !cfg.LogProgress)
+		err = client.ChecksumCopiedTables(ctx, sourceMgr.GetStorage(), destMgr.GetStorage().GetClient(),
+			tables, backupTS, cfg.ChecksumConcurrency, checksumCh)
+		checksumCh.Close()
+		if err != nil {
+			return errors.Trace(err)
+		}
+	} else {
+		log.Warn("skip the checksum of the copied tables")
+	}
+
+	summary.CollectInt("copied tables", len(tables))
+	summary.CollectInt("copied ranges", len(ranges))
+	summary.SetSuccessStatus(true)
+	return nil
+}
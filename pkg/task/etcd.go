@@ -0,0 +1,101 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package task
+
+import (
+	"context"
+	"crypto/tls"
+	"strings"
+	"time"
+
+	"github.com/pingcap/errors"
+	"go.etcd.io/etcd/clientv3"
+
+	"github.com/pingcap/br/pkg/pdutil"
+)
+
+// pdEtcdTimeout is the timeout of dialing and the requests to the etcd
+// embedded in PD.
+const pdEtcdTimeout = 10 * time.Second
+
+// newPDEtcdClient connects to the etcd embedded in PD, which stores the task
+// history, the shared rate limits, the backup groups and so on.
+func newPDEtcdClient(ctx context.Context, cfg *Config) (*clientv3.Client, error) {
+	var tlsConf *tls.Config
+	if pdTLS := cfg.TLS.ForPD(); pdTLS.IsEnabled() {
+		var err error
+		tlsConf, err = pdTLS.ToTLSConfig()
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+	addrs, err := pdutil.DiscoverAddrs(ctx, cfg.PD, tlsConf)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	scheme := "http://"
+	if tlsConf != nil {
+		scheme = "https://"
+	}
+	endpoints := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		if !strings.Contains(addr, "://") {
+			addr = scheme + addr
+		}
+		endpoints = append(endpoints, addr)
+	}
+	cli, err := clientv3.New(clientv3.Config{
+		Endpoints:   endpoints,
+		TLS:         tlsConf,
+		DialTimeout: pdEtcdTimeout,
+		Context:     ctx,
+	})
+	return cli, errors.Trace(err)
+}
+
+// pdEtcdSession is a connection to the etcd embedded in PD with a lease kept
+// alive in the background. The keys bound to the lease are removed after the
+// session is closed, or expire after the process crashes.
+type pdEtcdSession struct {
+	cli    *clientv3.Client
+	lease  clientv3.LeaseID
+	cancel context.CancelFunc
+}
+
+// newPDEtcdSession connects to the etcd embedded in PD and grants a lease of
+// the TTL in seconds.
+func newPDEtcdSession(ctx context.Context, cfg *Config, ttl int64) (*pdEtcdSession, error) {
+	cli, err := newPDEtcdClient(ctx, cfg)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	lease, err := cli.Grant(ctx, ttl)
+	if err != nil {
+		cli.Close()
+		return nil, errors.Trace(err)
+	}
+	keepAliveCtx, cancel := context.WithCancel(ctx)
+	keepAlive, err := cli.KeepAlive(keepAliveCtx, lease.ID)
+	if err != nil {
+		cancel()
+		cli.Close()
+		return nil, errors.Trace(err)
+	}
+	go func() {
+		// Drain the responses, or the client complains the channel is full.
+		for range keepAlive {
+		}
+	}()
+	return &pdEtcdSession{cli: cli, lease: lease.ID, cancel: cancel}, nil
+}
+
+// Close revokes the lease and closes the connection. The keys bound to the
+// lease expire after the TTL if it fails to revoke the lease.
+func (s *pdEtcdSession) Close() error {
+	s.cancel()
+	defer s.cli.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), pdEtcdTimeout)
+	defer cancel()
+	_, err := s.cli.Revoke(ctx, s.lease)
+	return errors.Trace(err)
+}
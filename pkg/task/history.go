@@ -0,0 +1,208 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package task
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/log"
+	"go.etcd.io/etcd/clientv3"
+	"go.uber.org/zap"
+
+	"github.com/pingcap/br/pkg/metautil"
+)
+
+const (
+	flagRecordHistory = "record-history"
+
+	// historyKeyPrefix is the etcd path of PD to store the task history.
+	historyKeyPrefix = "/tidb/br/history/"
+	// historyChecksumTimeout is the timeout of reading the checksums from the
+	// archive, which reads all the schemas and may be slow.
+	historyChecksumTimeout = time.Minute
+	// maxHistoryRecords is the count of the latest records kept in PD, the
+	// older records are deleted when recording a task.
+	maxHistoryRecords = 1000
+)
+
+// HistoryChecksum is the aggregated checksum of the tables in the archive.
+// Only the aggregation is recorded, so the size of a record doesn't grow with
+// the count of the tables.
+type HistoryChecksum struct {
+	Tables     int    `json:"tables"`
+	Crc64Xor   uint64 `json:"crc64xor"`
+	TotalKvs   uint64 `json:"total-kvs"`
+	TotalBytes uint64 `json:"total-bytes"`
+}
+
+// HistoryRecord is a completed backup or restore task.
+type HistoryRecord struct {
+	Command string `json:"command"`
+	// Storage is the URL of the archive without the credentials.
+	Storage   string           `json:"storage"`
+	StartTime time.Time        `json:"start-time"`
+	EndTime   time.Time        `json:"end-time"`
+	Success   bool             `json:"success"`
+	Error     string           `json:"error,omitempty"`
+	BackupTS  uint64           `json:"backup-ts,omitempty"`
+	Checksum  *HistoryChecksum `json:"checksum,omitempty"`
+}
+
+// redactStorageURL removes the user info and the query, which may contain
+// the credentials, from the storage URL.
+func redactStorageURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	u.User = nil
+	u.RawQuery = ""
+	return u.String()
+}
+
+// historyKey returns the key of the record, the records are ordered by the
+// start time.
+func historyKey(record *HistoryRecord) string {
+	return fmt.Sprintf("%s%020d", historyKeyPrefix, record.StartTime.UnixNano())
+}
+
+// readHistoryChecksum reads the checksums of the tables from the archive and
+// aggregates them.
+func readHistoryChecksum(ctx context.Context, cfg *Config) (uint64, *HistoryChecksum, error) {
+	ctx, cancel := context.WithTimeout(ctx, historyChecksumTimeout)
+	defer cancel()
+	_, s, backupMeta, err := ReadBackupMeta(ctx, metautil.MetaFile, cfg)
+	if err != nil {
+		return 0, nil, errors.Trace(err)
+	}
+	if backupMeta.IsRawKv {
+		return backupMeta.EndVersion, nil, nil
+	}
+	ch := make(chan *metautil.Table, 8)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- metautil.NewMetaReader(backupMeta, s).ReadSchemasFiles(ctx, ch)
+		close(ch)
+	}()
+	checksum := &HistoryChecksum{}
+	for tbl := range ch {
+		if tbl.Info == nil {
+			continue
+		}
+		checksum.Tables++
+		checksum.Crc64Xor ^= tbl.Crc64Xor
+		checksum.TotalKvs += tbl.TotalKvs
+		checksum.TotalBytes += tbl.TotalBytes
+	}
+	if err = <-errCh; err != nil {
+		return 0, nil, errors.Trace(err)
+	}
+	return backupMeta.EndVersion, checksum, nil
+}
+
+// RecordHistory records the completed task into PD if --record-history is
+// set. Failing to record doesn't fail the task.
+func RecordHistory(ctx context.Context, cfg *Config, command string, start time.Time, taskErr error) {
+	if !cfg.RecordHistory {
+		return
+	}
+	record := &HistoryRecord{
+		Command:   command,
+		Storage:   redactStorageURL(cfg.Storage),
+		StartTime: start,
+		EndTime:   time.Now(),
+		Success:   taskErr == nil,
+	}
+	if taskErr != nil {
+		record.Error = taskErr.Error()
+	} else {
+		var err error
+		record.BackupTS, record.Checksum, err = readHistoryChecksum(ctx, cfg)
+		if err != nil {
+			log.Warn("failed to read checksums of the archive for the history", zap.Error(err))
+		}
+	}
+	ctx, cancel := context.WithTimeout(ctx, pdEtcdTimeout)
+	defer cancel()
+	if err := putHistory(ctx, cfg, record); err != nil {
+		log.Warn("failed to record the task history", zap.Error(err))
+		return
+	}
+	log.Info("task history recorded", zap.String("key", historyKey(record)))
+}
+
+func putHistory(ctx context.Context, cfg *Config, record *HistoryRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	cli, err := newPDEtcdClient(ctx, cfg)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer cli.Close()
+	if _, err = cli.Put(ctx, historyKey(record), string(data)); err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(trimHistory(ctx, cli, maxHistoryRecords))
+}
+
+// trimHistory deletes the records older than the latest limit records.
+func trimHistory(ctx context.Context, cli *clientv3.Client, limit int) error {
+	resp, err := cli.Get(ctx, historyKeyPrefix,
+		clientv3.WithPrefix(),
+		clientv3.WithKeysOnly(),
+		clientv3.WithSort(clientv3.SortByKey, clientv3.SortDescend),
+		clientv3.WithLimit(int64(limit+1)),
+	)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if len(resp.Kvs) <= limit {
+		return nil
+	}
+	// Delete [historyKeyPrefix, the oldest kept key).
+	oldest := string(resp.Kvs[limit-1].Key)
+	deleted, err := cli.Delete(ctx, historyKeyPrefix, clientv3.WithRange(oldest))
+	if err != nil {
+		return errors.Trace(err)
+	}
+	log.Info("old task history deleted", zap.Int64("count", deleted.Deleted))
+	return nil
+}
+
+// ListHistory returns the latest task records in PD, newest first. Zero
+// limit returns all records.
+func ListHistory(ctx context.Context, cfg *Config, limit int) ([]*HistoryRecord, error) {
+	cli, err := newPDEtcdClient(ctx, cfg)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer cli.Close()
+	opts := []clientv3.OpOption{
+		clientv3.WithPrefix(),
+		clientv3.WithSort(clientv3.SortByKey, clientv3.SortDescend),
+	}
+	if limit > 0 {
+		opts = append(opts, clientv3.WithLimit(int64(limit)))
+	}
+	resp, err := cli.Get(ctx, historyKeyPrefix, opts...)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	records := make([]*HistoryRecord, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		record := &HistoryRecord{}
+		if err := json.Unmarshal(kv.Value, record); err != nil {
+			log.Warn("skip the invalid history record", zap.ByteString("key", kv.Key), zap.Error(err))
+			continue
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
@@ -0,0 +1,85 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package task
+
+import (
+	"io"
+	"os"
+	"strings"
+
+	"github.com/pingcap/errors"
+
+	berrors "github.com/pingcap/br/pkg/errors"
+)
+
+// keyArgs resolves the arguments of the key flags. An argument in the form of
+// `@path` is read from the file, and `@-` is read from stdin, so the keys with
+// shell-hostile bytes can be passed without quoting. Stdin can be read by one
+// flag only.
+type keyArgs struct {
+	stdin     io.Reader
+	stdinUsed bool
+}
+
+func newKeyArgs() *keyArgs {
+	return &keyArgs{stdin: os.Stdin}
+}
+
+func (a *keyArgs) readFile(flag, arg string) (string, error) {
+	path := arg[1:]
+	if path == "-" {
+		if a.stdinUsed {
+			return "", errors.Annotatef(berrors.ErrInvalidArgument,
+				"--%s can't read from stdin, which has been read by another flag", flag)
+		}
+		a.stdinUsed = true
+		data, err := io.ReadAll(a.stdin)
+		if err != nil {
+			return "", errors.Annotatef(err, "failed to read --%s from stdin", flag)
+		}
+		return string(data), nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", errors.Annotatef(err, "failed to read --%s from %s", flag, path)
+	}
+	return string(data), nil
+}
+
+// key resolves the argument of a flag of a single key. The trailing newline
+// of the file is trimmed, a raw key ending with a newline should be written in
+// the hex or escaped format instead.
+func (a *keyArgs) key(flag, arg string) (string, error) {
+	if !strings.HasPrefix(arg, "@") {
+		return arg, nil
+	}
+	content, err := a.readFile(flag, arg)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	content = strings.TrimSuffix(content, "\n")
+	return strings.TrimSuffix(content, "\r"), nil
+}
+
+// list resolves the arguments of a flag of a list, each line of the files is
+// an item, and the empty lines are skipped.
+func (a *keyArgs) list(flag string, args []string) ([]string, error) {
+	items := make([]string, 0, len(args))
+	for _, arg := range args {
+		if !strings.HasPrefix(arg, "@") {
+			items = append(items, arg)
+			continue
+		}
+		content, err := a.readFile(flag, arg)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		for _, line := range strings.Split(content, "\n") {
+			line = strings.TrimSuffix(line, "\r")
+			if len(line) > 0 {
+				items = append(items, line)
+			}
+		}
+	}
+	return items, nil
+}
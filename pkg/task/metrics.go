@@ -0,0 +1,99 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package task
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/pingcap/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+	"go.uber.org/zap"
+)
+
+const (
+	flagMetricsPushAddr = "metrics-push-addr"
+
+	// metricsPushJob is the job of the metrics pushed, and metricsPushInterval
+	// is the interval of pushing them during the task.
+	metricsPushJob      = "br"
+	metricsPushInterval = 15 * time.Second
+	metricsPushTimeout  = 10 * time.Second
+)
+
+var taskDurationHistogram = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Namespace: "br",
+		Subsystem: "task",
+		Name:      "duration_seconds",
+		Help:      "The duration of the backup and restore tasks.",
+		Buckets:   prometheus.ExponentialBuckets(1, 2, 20),
+	}, []string{"command", "result"})
+
+func init() { // nolint:gochecknoinits
+	prometheus.MustRegister(taskDurationHistogram)
+}
+
+// StartMetricsPusher pushes the metrics of the process to the push gateway
+// at --metrics-push-addr periodically during the task, grouped by the command
+// and the host, so the metrics of a short-lived BR can be collected without
+// scraping --status-addr. The returned function must be called with the result
+// of the task, it records the duration of the task, pushes the final metrics
+// and stops pushing.
+func StartMetricsPusher(ctx context.Context, cfg *Config, command string) (finish func(taskErr error)) {
+	start := time.Now()
+	record := func(taskErr error) {
+		result := "success"
+		if taskErr != nil {
+			result = "failure"
+		}
+		taskDurationHistogram.WithLabelValues(command, result).Observe(time.Since(start).Seconds())
+	}
+	if len(cfg.MetricsPushAddr) == 0 {
+		return record
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		log.Warn("failed to get the hostname for the metrics", zap.Error(err))
+	}
+	pusher := push.New(cfg.MetricsPushAddr, metricsPushJob).
+		Gatherer(prometheus.DefaultGatherer).
+		Client(&http.Client{Timeout: metricsPushTimeout}).
+		Grouping("instance", hostname).
+		Grouping("command", command)
+	log.Info("push the metrics to the gateway",
+		zap.String("addr", cfg.MetricsPushAddr), zap.Duration("interval", metricsPushInterval))
+
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(metricsPushInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				pushMetrics(pusher)
+			}
+		}
+	}()
+	return func(taskErr error) {
+		cancel()
+		<-done
+		record(taskErr)
+		pushMetrics(pusher)
+	}
+}
+
+// pushMetrics replaces the metrics of the group in the push gateway. Failing to
+// push doesn't fail the task.
+func pushMetrics(pusher *push.Pusher) {
+	if err := pusher.Push(); err != nil {
+		log.Warn("failed to push the metrics", zap.Error(err))
+	}
+}
@@ -0,0 +1,145 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package task
+
+import (
+	"bytes"
+	"context"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/log"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"go.uber.org/zap"
+
+	berrors "github.com/pingcap/br/pkg/errors"
+	"github.com/pingcap/br/pkg/glue"
+	"github.com/pingcap/br/pkg/logutil"
+	"github.com/pingcap/br/pkg/restore"
+	"github.com/pingcap/br/pkg/summary"
+	"github.com/pingcap/br/pkg/utils"
+)
+
+const (
+	flagScatterStartKey = "start-key"
+	flagScatterEndKey   = "end-key"
+)
+
+// OperatorScatterConfig is the configuration of scattering the regions of a
+// key range again.
+type OperatorScatterConfig struct {
+	Config
+	// RestoreCommonConfig only carries the flags of scattering.
+	RestoreCommonConfig
+
+	StartKey []byte `json:"start-key" toml:"start-key"`
+	EndKey   []byte `json:"end-key" toml:"end-key"`
+	// KeyCodec is the name of the codec which encodes the keys into the keys
+	// of regions, see restore.ParseKeyCodec.
+	KeyCodec string `json:"key-codec" toml:"key-codec"`
+}
+
+// DefineOperatorScatterFlags defines the flags of scattering the regions of
+// a key range.
+func DefineOperatorScatterFlags(command *cobra.Command) {
+	command.Flags().String(flagKeyFormat, "hex", keyFormatUsage)
+	command.Flags().String(flagScatterStartKey, "",
+		"the start key of the range to scatter, inclusive, empty means the min key. "+keyArgUsage)
+	command.Flags().String(flagScatterEndKey, "",
+		"the end key of the range to scatter, exclusive, empty means the max key. "+keyArgUsage)
+	command.Flags().String(flagKeyCodec, restore.KeyCodecMemComparable,
+		"the codec encoding the keys into the keys of regions, support memcomparable|identity, "+
+			"use identity if the keys have been encoded")
+	defineScatterFlags(command.Flags())
+}
+
+// ParseFromFlags parses the flags of scattering the regions of a key range.
+func (cfg *OperatorScatterConfig) ParseFromFlags(flags *pflag.FlagSet) error {
+	args := newKeyArgs()
+	format, err := flags.GetString(flagKeyFormat)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	for _, k := range []struct {
+		flag string
+		key  *[]byte
+	}{{flagScatterStartKey, &cfg.StartKey}, {flagScatterEndKey, &cfg.EndKey}} {
+		arg, err := flags.GetString(k.flag)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if arg, err = args.key(k.flag, arg); err != nil {
+			return errors.Trace(err)
+		}
+		if *k.key, err = utils.ParseKey(format, arg); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	if len(cfg.EndKey) > 0 && bytes.Compare(cfg.StartKey, cfg.EndKey) >= 0 {
+		return errors.Annotatef(berrors.ErrInvalidArgument,
+			"--%s must be greater than --%s", flagScatterEndKey, flagScatterStartKey)
+	}
+	if cfg.KeyCodec, err = flags.GetString(flagKeyCodec); err != nil {
+		return errors.Trace(err)
+	}
+	if _, err = restore.ParseKeyCodec(cfg.KeyCodec); err != nil {
+		return errors.Trace(err)
+	}
+	if err = cfg.RestoreCommonConfig.parseScatterFlags(flags); err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(cfg.Config.ParseFromFlags(flags))
+}
+
+// RunOperatorScatter scatters the regions of the key range again and waits for
+// them to be scattered, with the same retries as restore. It's for the
+// restored ranges whose leaders are left in a few stores, e.g. scattering
+// timed out.
+func RunOperatorScatter(c context.Context, g glue.Glue, cmdName string, cfg *OperatorScatterConfig) error {
+	ctx, cancel := context.WithCancel(c)
+	defer cancel()
+	defer summary.Summary(cmdName)
+
+	mgr, err := NewMgr(ctx, g, cfg.PD, cfg.TLS, GetKeepalive(&cfg.Config), cfg.CheckRequirements, false)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer mgr.Close()
+	client, err := restore.NewRestoreClient(g, mgr.GetPDClient(), mgr.GetStorage(), mgr.GetTLSConfig(),
+		GetKeepalive(&cfg.Config))
+	if err != nil {
+		return errors.Trace(err)
+	}
+	client.SetPDTLSConfig(mgr.GetPDTLSConfig())
+	defer client.Close()
+
+	keyCodec, err := restore.ParseKeyCodec(cfg.KeyCodec)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	client.SetKeyCodec(keyCodec)
+	if len(cfg.VerifyFailureDomain) > 0 {
+		client.EnableFailureDomainCheck(cfg.VerifyFailureDomain, cfg.RescatterViolating)
+	}
+	if cfg.ScatterLeader {
+		client.EnableScatterLeader()
+	}
+	client.SetRegionNotFoundGrace(cfg.RegionNotFoundGrace)
+	client.SetScatterWait(int(cfg.ScatterWaitConcurrency), cfg.ScatterWaitTimeout)
+	backoffPolicy, err := utils.ParseBackoffPolicy(cfg.BackoffPolicy)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	client.SetBackoffPolicy(backoffPolicy)
+	setRegionHeartbeatInterval(ctx, client, mgr)
+
+	regions, err := restore.ScatterRange(ctx, client, cfg.StartKey, cfg.EndKey)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	log.Info("scattered the regions in range",
+		logutil.Key("startKey", cfg.StartKey), logutil.Key("endKey", cfg.EndKey), zap.Int("regions", regions))
+	summary.CollectInt("scattered regions", regions)
+	summary.SetSuccessStatus(true)
+	return nil
+}
@@ -0,0 +1,139 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package task
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"strings"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/log"
+	"go.etcd.io/etcd/clientv3"
+	"go.uber.org/zap"
+
+	"github.com/pingcap/br/pkg/conn"
+	"github.com/pingcap/br/pkg/pdutil"
+)
+
+const (
+	// pdOpLogKeyPrefix is the etcd path of PD to store the changes of PD made
+	// by BR, see pdutil.OpLog.
+	pdOpLogKeyPrefix = "/tidb/br/pd-oplog/"
+	// pdOpLogLeaseTTL is the TTL in seconds of the lease owning the changes
+	// of a BR process, they can be reverted by others after it expires.
+	pdOpLogLeaseTTL = 30
+)
+
+// etcdOpLog is the pdutil.OpLog stored in the etcd embedded in PD, so it's
+// shared by the BR processes wherever they run. The ops are owned by the
+// lease of the process recording them, which is alive while it runs. The ops
+// themselves aren't bound to the lease, so they are kept after a crash.
+type etcdOpLog struct {
+	cli   *clientv3.Client
+	lease clientv3.LeaseID
+}
+
+func (l *etcdOpLog) Record(ctx context.Context, op *pdutil.Op) error {
+	op.Owner = int64(l.lease)
+	data, err := json.Marshal(op)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	ctx, cancel := context.WithTimeout(ctx, pdEtcdTimeout)
+	defer cancel()
+	_, err = l.cli.Put(ctx, pdOpLogKeyPrefix+op.ID, string(data))
+	return errors.Trace(err)
+}
+
+func (l *etcdOpLog) Done(ctx context.Context, id string) error {
+	ctx, cancel := context.WithTimeout(ctx, pdEtcdTimeout)
+	defer cancel()
+	_, err := l.cli.Delete(ctx, pdOpLogKeyPrefix+id)
+	return errors.Trace(err)
+}
+
+func (l *etcdOpLog) List(ctx context.Context) ([]*pdutil.Op, error) {
+	resp, err := l.cli.Get(ctx, pdOpLogKeyPrefix, clientv3.WithPrefix())
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	ops := make([]*pdutil.Op, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		op := &pdutil.Op{}
+		if err := json.Unmarshal(kv.Value, op); err != nil {
+			log.Warn("skip the invalid op of PD", zap.ByteString("key", kv.Key), zap.Error(err))
+			continue
+		}
+		ops = append(ops, op)
+	}
+	return ops, nil
+}
+
+func (l *etcdOpLog) OwnerAlive(ctx context.Context, op *pdutil.Op) (bool, error) {
+	// The ops without an owner are recorded by the older BR.
+	if op.Owner == 0 {
+		return false, nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, pdEtcdTimeout)
+	defer cancel()
+	resp, err := l.cli.TimeToLive(ctx, clientv3.LeaseID(op.Owner))
+	if err != nil {
+		return false, errors.Trace(err)
+	}
+	// The TTL of the expired or revoked leases is -1.
+	return resp.TTL > 0, nil
+}
+
+// setupPDOpLog makes mgr record the changes of PD into PD, so they are
+// reverted by `br restore-pd-config` if BR crashes before reverting them.
+// Failing to connect only disables the recording. The returned function
+// closes the connection and revokes the lease owning the changes.
+func setupPDOpLog(ctx context.Context, cfg *Config, cmdName string, mgr *conn.Mgr) func() {
+	session, err := newPDEtcdSession(ctx, cfg, pdOpLogLeaseTTL)
+	if err != nil {
+		log.Warn("failed to connect to PD for the op-log, the changes of PD won't be reverted if BR crashes",
+			zap.Error(err))
+		return func() {}
+	}
+	mgr.SetOpLog(&etcdOpLog{cli: session.cli, lease: session.lease}, cmdName)
+	return func() {
+		mgr.SetOpLog(nil, "")
+		if err := session.Close(); err != nil {
+			log.Warn("failed to close the connection of the op-log", zap.Error(err))
+		}
+	}
+}
+
+// RunRestorePDConfig reverts the changes of PD left by the crashed BR
+// processes, and returns the reverted changes. The changes of the running BR
+// processes are skipped. If dryRun is true, the changes
+// are only returned.
+func RunRestorePDConfig(ctx context.Context, cfg *Config, dryRun bool) ([]*pdutil.Op, error) {
+	pdTLS := cfg.TLS.ForPD()
+	var tlsConf *tls.Config
+	if pdTLS.IsEnabled() {
+		var err error
+		tlsConf, err = pdTLS.ToTLSConfig()
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+	addrs, err := pdutil.DiscoverAddrs(ctx, cfg.PD, tlsConf)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	pdCtl, err := pdutil.NewPdController(ctx, strings.Join(addrs, ","), tlsConf, pdTLS.ToPDSecurityOption())
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer pdCtl.Close()
+	cli, err := newPDEtcdClient(ctx, cfg)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer cli.Close()
+	ops, err := pdCtl.RevertOps(ctx, &etcdOpLog{cli: cli}, dryRun)
+	return ops, errors.Trace(err)
+}
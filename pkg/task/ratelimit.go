@@ -0,0 +1,153 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package task
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/log"
+	"go.etcd.io/etcd/clientv3"
+	"go.uber.org/zap"
+
+	"github.com/pingcap/br/pkg/backup"
+)
+
+const (
+	// rateLimitKeyPrefix is the etcd path of PD to register the members of
+	// the rate limit groups.
+	rateLimitKeyPrefix = "/tidb/br/ratelimit/"
+	// rateLimitLeaseTTL is the TTL in seconds of the member keys, the share of
+	// a crashed process is given back after it.
+	rateLimitLeaseTTL      = 10
+	rateLimitRefreshPeriod = 3 * time.Second
+)
+
+// shareRateLimit returns the rate limit of each member when the budget is
+// shared by the members evenly.
+func shareRateLimit(budget uint64, members int64) uint64 {
+	if members <= 1 {
+		return budget
+	}
+	limit := budget / uint64(members)
+	// Zero means unlimited in the backup request.
+	if limit == 0 {
+		limit = 1
+	}
+	return limit
+}
+
+// sharedRateLimit is the membership of a rate limit group. The members
+// register lease-bound keys under the group in PD, and each member uses an
+// even share of the budget. Once a member joins or leaves, the budget is
+// shared again and onChange is called, so the running ranges use the new
+// share at once.
+type sharedRateLimit struct {
+	*pdEtcdSession
+	prefix   string
+	budget   uint64
+	members  int64
+	onChange func()
+	// cancelRefresh stops refreshing the count of the members.
+	cancelRefresh context.CancelFunc
+}
+
+// joinRateLimitGroup registers this process in the rate limit group of the
+// config and keeps the count of the members up to date in the background,
+// onChange is called whenever the count changes.
+func joinRateLimitGroup(ctx context.Context, cfg *Config, onChange func()) (*sharedRateLimit, error) {
+	session, err := newPDEtcdSession(ctx, cfg, rateLimitLeaseTTL)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	s := &sharedRateLimit{
+		pdEtcdSession: session,
+		prefix:        rateLimitKeyPrefix + cfg.RateLimitGroup + "/",
+		budget:        cfg.RateLimit,
+		onChange:      onChange,
+	}
+	key := fmt.Sprintf("%s%016x", s.prefix, int64(s.lease))
+	if _, err = s.cli.Put(ctx, key, "", clientv3.WithLease(s.lease)); err != nil {
+		session.Close()
+		return nil, errors.Trace(err)
+	}
+	if err = s.refresh(ctx); err != nil {
+		session.Close()
+		return nil, errors.Trace(err)
+	}
+
+	refreshCtx, cancel := context.WithCancel(ctx)
+	s.cancelRefresh = cancel
+	go s.refreshLoop(refreshCtx)
+	log.Info("joined the rate limit group",
+		zap.String("group", cfg.RateLimitGroup),
+		zap.String("key", key),
+		zap.Int64("members", atomic.LoadInt64(&s.members)))
+	return s, nil
+}
+
+func (s *sharedRateLimit) refresh(ctx context.Context) error {
+	resp, err := s.cli.Get(ctx, s.prefix, clientv3.WithPrefix(), clientv3.WithCountOnly())
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if old := atomic.SwapInt64(&s.members, resp.Count); old != resp.Count {
+		log.Info("members of the rate limit group changed",
+			zap.String("prefix", s.prefix),
+			zap.Int64("members", resp.Count),
+			zap.Uint64("rate-limit", shareRateLimit(s.budget, resp.Count)))
+		// The first count is read before the ranges start.
+		if old != 0 && s.onChange != nil {
+			s.onChange()
+		}
+	}
+	return nil
+}
+
+func (s *sharedRateLimit) refreshLoop(ctx context.Context) {
+	ticker := time.NewTicker(rateLimitRefreshPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.refresh(ctx); err != nil {
+				log.Warn("failed to refresh the members of the rate limit group, keep the current share",
+					zap.String("prefix", s.prefix), zap.Error(err))
+			}
+		}
+	}
+}
+
+// RateLimit returns the current share of the budget.
+func (s *sharedRateLimit) RateLimit() uint64 {
+	return shareRateLimit(s.budget, atomic.LoadInt64(&s.members))
+}
+
+// Close leaves the group, the share is given back to the other members.
+func (s *sharedRateLimit) Close() {
+	s.cancelRefresh()
+	if err := s.pdEtcdSession.Close(); err != nil {
+		log.Warn("failed to leave the rate limit group, the share is given back after the lease expires",
+			zap.String("prefix", s.prefix), zap.Error(err))
+	}
+}
+
+// setupSharedRateLimit joins the rate limit group of the config if any, and
+// makes the backup client use the share of the group, including the running
+// ranges once the share changes. The returned function leaves the group.
+func setupSharedRateLimit(ctx context.Context, cfg *Config, client *backup.Client) (func(), error) {
+	if cfg.RateLimitGroup == "" {
+		return func() {}, nil
+	}
+	shared, err := joinRateLimitGroup(ctx, cfg, client.NotifyRateLimitChanged)
+	if err != nil {
+		return nil, errors.Annotatef(err, "failed to join the rate limit group %s", cfg.RateLimitGroup)
+	}
+	client.SetRateLimitFunc(shared.RateLimit)
+	return shared.Close, nil
+}
@@ -4,12 +4,19 @@ package task
 
 import (
 	"context"
+	"crypto/tls"
+	"encoding/json"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/pingcap/br/pkg/metautil"
 
 	"github.com/pingcap/br/pkg/version"
 
+	"github.com/docker/go-units"
 	"github.com/opentracing/opentracing-go"
 	"github.com/pingcap/errors"
 	"github.com/pingcap/failpoint"
@@ -17,12 +24,15 @@ import (
 	"github.com/pingcap/log"
 	"github.com/pingcap/tidb/config"
 	"github.com/spf13/pflag"
+	pd "github.com/tikv/pd/client"
 	"go.uber.org/multierr"
 	"go.uber.org/zap"
 
+	"github.com/pingcap/br/pkg/backup"
 	"github.com/pingcap/br/pkg/conn"
 	berrors "github.com/pingcap/br/pkg/errors"
 	"github.com/pingcap/br/pkg/glue"
+	"github.com/pingcap/br/pkg/logutil"
 	"github.com/pingcap/br/pkg/pdutil"
 	"github.com/pingcap/br/pkg/restore"
 	"github.com/pingcap/br/pkg/storage"
@@ -31,17 +41,113 @@ import (
 )
 
 const (
-	flagOnline   = "online"
-	flagNoSchema = "no-schema"
+	flagOnline         = "online"
+	flagNoSchema       = "no-schema"
+	flagDataOnly       = "data-only"
+	flagTableRateLimit = "table-ratelimit"
+	flagVerifyKVCount  = "verify-kv-count"
+	flagDryRunPlan     = "dry-run-plan"
+	flagSplitMap       = "split-map"
+	// flagRestoreTiFlashReplica is the flag name of re-creating the TiFlash
+	// replicas after restoring the data.
+	flagRestoreTiFlashReplica = "restore-tiflash-replica"
+	flagWaitTiFlashReplica    = "wait-tiflash-replica"
+	// flagRestoredTablePrefix and flagRestoredTableSuffix are the flag names
+	// of restoring the tables under other names.
+	flagRestoredTablePrefix = "restored-table-prefix"
+	flagRestoredTableSuffix = "restored-table-suffix"
+	// flagNetworkBandwidth is the flag name of the network bandwidth between
+	// the storage and the cluster, which the restore estimate is based on.
+	flagNetworkBandwidth = "network-bandwidth"
+	// flagBatchBytes and flagBatchKeys are the flag names of the total bytes
+	// and keys of the ranges of a split/ingest batch.
+	flagBatchBytes = "batch-bytes"
+	flagBatchKeys  = "batch-keys"
+	// flagQuarantineMismatch is the flag name of moving the mismatched
+	// tables into the quarantine database instead of failing.
+	flagQuarantineMismatch = "quarantine-mismatched-tables"
+	// flagDDLConcurrency, flagDDLBatchSize and flagIsolateDDLFailures are the
+	// flag names of creating the tables.
+	flagDDLConcurrency     = "ddl-concurrency"
+	flagDDLBatchSize       = "ddl-batch-size"
+	flagIsolateDDLFailures = "isolate-ddl-failures"
+	// flagFilterGarbageKeys is the flag name of dropping the keys of the
+	// files not covered by the rewrite rules.
+	flagFilterGarbageKeys = "filter-garbage-keys"
 
 	// FlagMergeRegionSizeBytes is the flag name of merge small regions by size
 	FlagMergeRegionSizeBytes = "merge-region-size-bytes"
 	// FlagMergeRegionKeyCount is the flag name of merge small regions by key count
 	FlagMergeRegionKeyCount = "merge-region-key-count"
+	// flagMergeTargetDuration is the flag name of merging small regions by
+	// the observed ingestion throughput.
+	flagMergeTargetDuration = "merge-region-target-duration"
+	// flagAccelerateMerge is the flag name of accelerating region merge after restore.
+	flagAccelerateMerge = "accelerate-merge"
+	// flagSplitWithoutScatter is the flag name of scattering regions after all
+	// splits are done.
+	flagSplitWithoutScatter = "split-without-scatter"
+	// flagSplitCheckpoint is the flag name of the storage to persist the
+	// split keys for resuming.
+	flagSplitCheckpoint = "split-checkpoint"
+	// flagAllowIncomplete is the flag name of restoring the archives without
+	// the finish marker.
+	flagAllowIncomplete = "allow-incomplete"
+	// flagAllowUnencryptedAtRest is the flag name of restoring the backup of
+	// a cluster with encryption at rest into the stores without it.
+	flagAllowUnencryptedAtRest = "allow-unencrypted-at-rest"
+	// flagPDHedgeDelay is the flag name of hedging the region reads to
+	// another PD client.
+	flagPDHedgeDelay = "pd-hedge-delay"
+	// flagStoreAddressMap is the flag name of translating the advertised
+	// addresses of the stores when dialing them for importing.
+	flagStoreAddressMap = "store-address-map"
+	// flagVerifyFailureDomain is the flag name of the store label key of the
+	// failure domains to verify after scattering.
+	flagVerifyFailureDomain = "verify-failure-domain"
+	flagRescatterViolating  = "rescatter-violating-regions"
+	// flagScatterLeader is the flag name of balancing the leaders of the new
+	// regions after scattering.
+	flagScatterLeader = "scatter-leader"
+	// flagRegionNotFoundGrace is the flag name of the duration of tolerating
+	// REGION_NOT_FOUND of the scattering regions.
+	flagRegionNotFoundGrace = "region-not-found-grace"
+	// flagScatterWaitConcurrency and flagScatterWaitTimeout are the flag names
+	// of bounding waiting for the scattering regions.
+	flagScatterWaitConcurrency = "scatter-wait-concurrency"
+	flagScatterWaitTimeout     = "scatter-wait-timeout"
+	// flagBackoffPolicy is the flag name of the policy of retrying split,
+	// scatter and the region scans.
+	flagBackoffPolicy = "backoff-policy"
+	// flagSplitTargetSize is the flag name of the size of the data each new
+	// region holds about when coalescing the split keys.
+	flagSplitTargetSize = "split-target-size"
+	// flagMemorySoftLimit is the flag name of the memory usage of BR beyond
+	// which the concurrency of restore is shed.
+	flagMemorySoftLimit = "memory-soft-limit"
+	// flagMaxRegionsPerStore and flagRegionGuardrail are the flag names of
+	// checking the region count planned by splitting.
+	flagMaxRegionsPerStore = "max-regions-per-store"
+	flagRegionGuardrail    = "region-guardrail"
+	// flagPerformanceProfile is the flag name of the preset of the restore
+	// performance knobs.
+	flagPerformanceProfile = "performance-profile"
 
 	defaultRestoreConcurrency = 128
+	// defaultMaxRegionsPerStore is the default threshold of the region
+	// replicas of each store checked before splitting.
+	defaultMaxRegionsPerStore = 50000
+	regionGuardrailWarn       = "warn"
+	regionGuardrailAbort      = "abort"
 	maxRestoreBatchSizeLimit  = 10240
 	defaultDDLConcurrency     = 16
+
+	// waitRegionMergeInterval is the interval of checking the region count
+	// when accelerating region merge.
+	waitRegionMergeInterval = 10 * time.Second
+	// waitRegionMergeStableRounds is the number of checks the region count
+	// doesn't decrease before we consider the merge is finished.
+	waitRegionMergeStableRounds = 3
 )
 
 // RestoreCommonConfig is the common configuration for all BR restore tasks.
@@ -53,6 +159,141 @@ type RestoreCommonConfig struct {
 	// See https://github.com/tikv/tikv/blob/v4.0.8/components/raftstore/src/coprocessor/config.rs#L35-L38
 	MergeSmallRegionSizeBytes uint64 `json:"merge-region-size-bytes" toml:"merge-region-size-bytes"`
 	MergeSmallRegionKeyCount  uint64 `json:"merge-region-key-count" toml:"merge-region-key-count"`
+	// MergeTargetDuration is the expected duration of restoring a batch of
+	// ranges, the small ranges are merged by the observed ingestion throughput
+	// to meet it, capped by the thresholds above. Zero merges by the fixed
+	// thresholds.
+	MergeTargetDuration time.Duration `json:"merge-region-target-duration" toml:"merge-region-target-duration"`
+
+	// AccelerateMerge is the max duration to relax the PD region merge limits
+	// after restore, so small regions created by restore are merged quickly.
+	// Zero disables it.
+	AccelerateMerge time.Duration `json:"accelerate-merge" toml:"accelerate-merge"`
+
+	// SplitWithoutScatter delays scattering the new regions until all regions
+	// of a split batch are split.
+	SplitWithoutScatter bool `json:"split-without-scatter" toml:"split-without-scatter"`
+
+	// SplitCheckpoint is the URL of the storage to persist the split keys,
+	// the restore resumed with the same checkpoint skips the split ranges.
+	SplitCheckpoint string `json:"split-checkpoint" toml:"split-checkpoint"`
+
+	// AllowIncomplete restores the archive without a valid finish marker,
+	// e.g. the archives written by the older BR.
+	AllowIncomplete bool `json:"allow-incomplete" toml:"allow-incomplete"`
+
+	// AllowUnencryptedAtRest restores the backup of a cluster encrypting the
+	// data at rest even if some stores don't encrypt it.
+	AllowUnencryptedAtRest bool `json:"allow-unencrypted-at-rest" toml:"allow-unencrypted-at-rest"`
+
+	// PerformanceProfile is the name of the preset of performance knobs.
+	PerformanceProfile string `json:"performance-profile" toml:"performance-profile"`
+
+	// PDHedgeDelay is the latency after which the region and operator reads
+	// are sent to another PD client as well. Zero disables it.
+	PDHedgeDelay time.Duration `json:"pd-hedge-delay" toml:"pd-hedge-delay"`
+
+	// StoreAddressMap maps the addresses of the stores advertised to PD to
+	// the addresses reachable by BR, e.g. the addresses of the load balancers
+	// or the NAT when BR is outside of the network of the cluster.
+	StoreAddressMap map[string]string `json:"store-address-map" toml:"store-address-map"`
+
+	// VerifyFailureDomain is the store label key, e.g. zone or host. If set,
+	// the voters of each scattered region are verified to be placed in the
+	// stores with distinct values of the label.
+	VerifyFailureDomain string `json:"verify-failure-domain" toml:"verify-failure-domain"`
+	// RescatterViolating scatters the regions violating the failure domains
+	// once more.
+	RescatterViolating bool `json:"rescatter-violating-regions" toml:"rescatter-violating-regions"`
+	// ScatterLeader balances the leaders of the new regions over the stores
+	// of their voters after scattering, instead of leaving the leaders where
+	// scattering puts them.
+	ScatterLeader bool `json:"scatter-leader" toml:"scatter-leader"`
+	// RegionNotFoundGrace is the duration of tolerating PD reporting
+	// REGION_NOT_FOUND for a scattering region, after which the region is
+	// considered merged away and the region covering it is scattered instead.
+	RegionNotFoundGrace time.Duration `json:"region-not-found-grace" toml:"region-not-found-grace"`
+	// ScatterWaitConcurrency is the max number of concurrent operator queries
+	// when waiting for the new regions to be scattered.
+	ScatterWaitConcurrency uint `json:"scatter-wait-concurrency" toml:"scatter-wait-concurrency"`
+	// ScatterWaitTimeout is the deadline shared by all the new regions of
+	// waiting for scattering, the regions not scattered by then are ingested
+	// anyway.
+	ScatterWaitTimeout time.Duration `json:"scatter-wait-timeout" toml:"scatter-wait-timeout"`
+	// BackoffPolicy is the policy of retrying split, scatter and the region
+	// scans, see utils.ParseBackoffPolicy.
+	BackoffPolicy string `json:"backoff-policy" toml:"backoff-policy"`
+	// SplitTargetSize coalesces the split keys of the small ranges, so that
+	// each new region holds about the size of the data in bytes, zero splits
+	// at every range.
+	SplitTargetSize uint64 `json:"split-target-size" toml:"split-target-size"`
+	// MemorySoftLimit is the memory in bytes in use by the heap and the stacks
+	// of BR, beyond which the import workers are serialized until the memory is
+	// released, zero disables the limit.
+	MemorySoftLimit uint64 `json:"memory-soft-limit" toml:"memory-soft-limit"`
+	// MaxRegionsPerStore is the threshold of the average region replicas of
+	// each store after splitting, zero disables the check.
+	MaxRegionsPerStore uint64 `json:"max-regions-per-store" toml:"max-regions-per-store"`
+	// RegionGuardrail is the action when MaxRegionsPerStore is exceeded, one
+	// of warn and abort.
+	RegionGuardrail string `json:"region-guardrail" toml:"region-guardrail"`
+}
+
+// performanceProfile is a coherent bundle of the knobs affecting the restore
+// performance and its impact on the cluster.
+type performanceProfile struct {
+	concurrency uint32
+	// rateLimit is the download rate limit in bytes per second of each store,
+	// 0 means unlimited.
+	rateLimit           uint64
+	online              bool
+	splitWithoutScatter bool
+	accelerateMerge     time.Duration
+}
+
+// performanceProfiles are the presets of --performance-profile.
+var performanceProfiles = map[string]performanceProfile{
+	// conservative is a gentle online restore, which keeps the schedulers
+	// and limits the resources taken from the cluster.
+	"conservative": {
+		concurrency: 32,
+		rateLimit:   64 * units.MiB,
+		online:      true,
+	},
+	// balanced is the default behavior.
+	"balanced": {
+		concurrency: defaultRestoreConcurrency,
+	},
+	// aggressive is a fast offline restore, which takes over the cluster.
+	"aggressive": {
+		concurrency:         4 * defaultRestoreConcurrency,
+		splitWithoutScatter: true,
+		accelerateMerge:     30 * time.Minute,
+	},
+}
+
+// applyPerformanceProfile sets the knobs which are not specified explicitly
+// by the flags according to the performance profile.
+func applyPerformanceProfile(flags *pflag.FlagSet, cfg *Config, restoreCfg *RestoreCommonConfig) {
+	if len(restoreCfg.PerformanceProfile) == 0 {
+		return
+	}
+	profile := performanceProfiles[restoreCfg.PerformanceProfile]
+	if !flags.Changed(flagConcurrency) {
+		cfg.Concurrency = profile.concurrency
+	}
+	if !flags.Changed(flagRateLimit) {
+		cfg.RateLimit = profile.rateLimit
+	}
+	if !flags.Changed(flagOnline) {
+		restoreCfg.Online = profile.online
+	}
+	if !flags.Changed(flagSplitWithoutScatter) {
+		restoreCfg.SplitWithoutScatter = profile.splitWithoutScatter
+	}
+	if !flags.Changed(flagAccelerateMerge) {
+		restoreCfg.AccelerateMerge = profile.accelerateMerge
+	}
 }
 
 // adjust adjusts the abnormal config value in the current config.
@@ -64,6 +305,9 @@ func (cfg *RestoreCommonConfig) adjust() {
 	if cfg.MergeSmallRegionSizeBytes == 0 {
 		cfg.MergeSmallRegionSizeBytes = restore.DefaultMergeRegionSizeBytes
 	}
+	if len(cfg.BackoffPolicy) == 0 {
+		cfg.BackoffPolicy = utils.DefaultBackoffPolicy.String()
+	}
 }
 
 // DefineRestoreCommonFlags defines common flags for the restore command.
@@ -77,6 +321,75 @@ func DefineRestoreCommonFlags(flags *pflag.FlagSet) {
 		"the threshold of merging smalle regions (Default 960_000, region split key count)")
 	_ = flags.MarkHidden(FlagMergeRegionSizeBytes)
 	_ = flags.MarkHidden(FlagMergeRegionKeyCount)
+	flags.Duration(flagMergeTargetDuration, 0,
+		"merge the small regions by the observed ingestion throughput, so each batch of regions takes "+
+			"about this duration to restore, capped by the region split size. 0 to merge by the region split size")
+
+	flags.Duration(flagAccelerateMerge, 0,
+		"relax the PD region merge limits for at most this duration after restore to merge the small regions quickly, "+
+			"the original config is restored afterwards. 0 to disable")
+	flags.Bool(flagSplitWithoutScatter, false,
+		"split all regions first and scatter them in a single pass afterwards, instead of scattering after each split")
+	flags.String(flagPerformanceProfile, "",
+		"the preset of concurrency, rate limit, scatter behavior and PD scheduler handling, "+
+			"one of conservative, balanced and aggressive. the flags specified explicitly take precedence")
+	flags.Duration(flagPDHedgeDelay, 0,
+		"send the region and operator reads of split and scatter to another PD connection as well "+
+			"if PD doesn't respond in this duration, and take the first response. 0 to disable")
+	flags.StringSlice(flagStoreAddressMap, nil,
+		"translate the addresses of the stores advertised to PD when splitting, downloading and ingesting, "+
+			"e.g. tikv-0.tikv:20160=10.0.1.10:30160, for restoring from outside of the network of the cluster. "+
+			"The TLS certificates of the stores are still verified against the advertised hosts")
+	defineScatterFlags(flags)
+	flags.Uint64(flagSplitTargetSize, 0,
+		"coalesce the split keys of the consecutive small ranges, so that each new region holds about this size "+
+			"of the data in bytes, e.g. 100663296 for 96MiB, which avoids a flood of tiny regions when restoring "+
+			"many small tables. the adjacent small tables and indexes share a region. 0 splits at every range "+
+			"and every table")
+	flags.Uint64(flagMemorySoftLimit, 0,
+		"the memory in bytes used by BR beyond which the download and ingest workers run one by one "+
+			"until the memory is released, which prevents BR from being killed for OOM on a small host. "+
+			"0 disables the limit")
+	flags.Uint64(flagMaxRegionsPerStore, defaultMaxRegionsPerStore,
+		"the threshold of the average region replicas of each TiKV store after splitting, "+
+			"too many regions destabilize small clusters. 0 disables the check")
+	flags.String(flagRegionGuardrail, regionGuardrailWarn,
+		"the action when --max-regions-per-store is exceeded, one of warn and abort")
+	flags.String(flagSplitCheckpoint, "",
+		"the URL of the storage to persist the split keys, e.g. local:///tmp/restore-checkpoint, "+
+			"a resumed restore with the same checkpoint skips the ranges that have been split")
+	flags.Bool(flagAllowIncomplete, false,
+		"restore the backup without a valid finish marker, which may be partially written. "+
+			"required by the backups written by BR without the finish marker")
+	flags.Bool(flagAllowUnencryptedAtRest, false,
+		"restore the backup of a cluster encrypting the data at rest even if some TiKV stores don't encrypt it, "+
+			"or their config can't be read to check it")
+}
+
+// defineScatterFlags defines the flags of scattering the regions.
+func defineScatterFlags(flags *pflag.FlagSet) {
+	flags.String(flagVerifyFailureDomain, "",
+		"the store label key of the failure domains, e.g. zone or host. if set, verify that the voters of each "+
+			"scattered region are placed in the stores with distinct values of the label")
+	flags.Bool(flagRescatterViolating, false,
+		"scatter the regions violating --verify-failure-domain once more")
+	flags.Bool(flagScatterLeader, false,
+		"balance the leaders of the new regions over the stores of their voters after scattering, "+
+			"so ingesting isn't bottlenecked by the store of the original region. "+
+			"disabled by default, which leaves the leaders where scattering puts them")
+	flags.Duration(flagRegionNotFoundGrace, restore.RegionNotFoundGracePeriod,
+		"the duration of tolerating PD reporting a scattering region not found, after which the region is "+
+			"considered merged away and the region covering it is scattered and waited for instead. "+
+			"0 considers the region scattered at once")
+	flags.Uint(flagScatterWaitConcurrency, restore.DefaultScatterWaitConcurrency,
+		"the max number of concurrent queries of the scatter operators when waiting for the new regions "+
+			"to be scattered")
+	flags.Duration(flagScatterWaitTimeout, restore.ScatterWaitUpperInterval,
+		"the deadline shared by all the new regions of a batch when waiting for them to be scattered, "+
+			"the regions not scattered by then are ingested anyway")
+	flags.String(flagBackoffPolicy, utils.DefaultBackoffPolicy.String(),
+		"the policy of retrying split, scatter and the region scans, one of exponential, exponential-jitter, "+
+			"constant and budget:<duration>, e.g. budget:30s gives up an operation once its retries wait 30s in total")
 }
 
 // ParseFromFlags parses the config from the flag set.
@@ -94,15 +407,171 @@ func (cfg *RestoreCommonConfig) ParseFromFlags(flags *pflag.FlagSet) error {
 	if err != nil {
 		return errors.Trace(err)
 	}
+	cfg.MergeTargetDuration, err = flags.GetDuration(flagMergeTargetDuration)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	cfg.AccelerateMerge, err = flags.GetDuration(flagAccelerateMerge)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	cfg.SplitWithoutScatter, err = flags.GetBool(flagSplitWithoutScatter)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	cfg.SplitCheckpoint, err = flags.GetString(flagSplitCheckpoint)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	cfg.AllowIncomplete, err = flags.GetBool(flagAllowIncomplete)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	cfg.AllowUnencryptedAtRest, err = flags.GetBool(flagAllowUnencryptedAtRest)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	cfg.PDHedgeDelay, err = flags.GetDuration(flagPDHedgeDelay)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	addressRules, err := flags.GetStringSlice(flagStoreAddressMap)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if cfg.StoreAddressMap, err = restore.ParseStoreAddressMap(addressRules); err != nil {
+		return errors.Trace(err)
+	}
+	if err = cfg.parseScatterFlags(flags); err != nil {
+		return errors.Trace(err)
+	}
+	cfg.SplitTargetSize, err = flags.GetUint64(flagSplitTargetSize)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	cfg.MemorySoftLimit, err = flags.GetUint64(flagMemorySoftLimit)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	cfg.MaxRegionsPerStore, err = flags.GetUint64(flagMaxRegionsPerStore)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	cfg.RegionGuardrail, err = flags.GetString(flagRegionGuardrail)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if cfg.RegionGuardrail != regionGuardrailWarn && cfg.RegionGuardrail != regionGuardrailAbort {
+		return errors.Annotatef(berrors.ErrInvalidArgument, "invalid --%s %s, should be one of %s and %s",
+			flagRegionGuardrail, cfg.RegionGuardrail, regionGuardrailWarn, regionGuardrailAbort)
+	}
+	cfg.PerformanceProfile, err = flags.GetString(flagPerformanceProfile)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if _, ok := performanceProfiles[cfg.PerformanceProfile]; len(cfg.PerformanceProfile) > 0 && !ok {
+		return errors.Annotatef(berrors.ErrInvalidArgument,
+			"invalid performance profile %s, should be one of conservative, balanced and aggressive",
+			cfg.PerformanceProfile)
+	}
 	return errors.Trace(err)
 }
 
+// parseScatterFlags parses the flags defined by defineScatterFlags.
+func (cfg *RestoreCommonConfig) parseScatterFlags(flags *pflag.FlagSet) error {
+	var err error
+	cfg.VerifyFailureDomain, err = flags.GetString(flagVerifyFailureDomain)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	cfg.RescatterViolating, err = flags.GetBool(flagRescatterViolating)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	cfg.ScatterLeader, err = flags.GetBool(flagScatterLeader)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	cfg.RegionNotFoundGrace, err = flags.GetDuration(flagRegionNotFoundGrace)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	cfg.ScatterWaitConcurrency, err = flags.GetUint(flagScatterWaitConcurrency)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	cfg.ScatterWaitTimeout, err = flags.GetDuration(flagScatterWaitTimeout)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	cfg.BackoffPolicy, err = flags.GetString(flagBackoffPolicy)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if _, err = utils.ParseBackoffPolicy(cfg.BackoffPolicy); err != nil {
+		return errors.Trace(err)
+	}
+	return nil
+}
+
 // RestoreConfig is the configuration specific for restore tasks.
 type RestoreConfig struct {
 	Config
 	RestoreCommonConfig
 
 	NoSchema bool `json:"no-schema" toml:"no-schema"`
+	// DataOnly skips the DDLs and restores the data into the existing tables
+	// whose schemas are compatible with the backup.
+	DataOnly bool `json:"data-only" toml:"data-only"`
+	// TableRateLimits are the bandwidth caps (bytes per second) of databases
+	// or tables, keyed by `db` or `db.table`.
+	TableRateLimits map[string]uint64 `json:"table-rate-limits" toml:"table-rate-limits"`
+	// VerifyKVCount verifies the KV count of the restored tables when the
+	// checksum is disabled. It's opt-in, so --checksum=false keeps skipping
+	// all the verification unless it's set.
+	VerifyKVCount bool `json:"verify-kv-count" toml:"verify-kv-count"`
+	// QuarantineMismatch continues to verify the rest tables when some tables
+	// fail in the verification, then moves the failed tables into
+	// restore.QuarantineSchema, and fails the restore with the full list of
+	// them after restoring the rest tables.
+	QuarantineMismatch bool `json:"quarantine-mismatched-tables" toml:"quarantine-mismatched-tables"`
+	// DDLConcurrency is the number of the sessions creating the tables.
+	DDLConcurrency uint `json:"ddl-concurrency" toml:"ddl-concurrency"`
+	// DDLBatchSize is the max number of the tables of a database created
+	// through one session in a batch.
+	DDLBatchSize uint `json:"ddl-batch-size" toml:"ddl-batch-size"`
+	// IsolateDDLFailures skips the rest tables of a database when its DDL
+	// fails, then fails with all the failed databases after the others are
+	// restored.
+	IsolateDDLFailures bool `json:"isolate-ddl-failures" toml:"isolate-ddl-failures"`
+	// DryRunPlan is the local path to write the restore plan to, the restore
+	// exits after planning if it is set.
+	DryRunPlan string `json:"dry-run-plan" toml:"dry-run-plan"`
+	// SplitMap is the local path to write the planned split map to, in the
+	// format of the key visualizer.
+	SplitMap string `json:"split-map" toml:"split-map"`
+	// RestoreTiFlashReplica creates the tables without TiFlash replicas and
+	// re-creates the replicas recorded in the backup after restoring the data.
+	RestoreTiFlashReplica bool `json:"restore-tiflash-replica" toml:"restore-tiflash-replica"`
+	// WaitTiFlashReplica is the max duration to wait for the re-created
+	// TiFlash replicas to be available. Zero doesn't wait.
+	WaitTiFlashReplica time.Duration `json:"wait-tiflash-replica" toml:"wait-tiflash-replica"`
+	// RestoredTablePrefix and RestoredTableSuffix are added to the names of
+	// the restored tables, e.g. to restore into a staging environment.
+	RestoredTablePrefix string `json:"restored-table-prefix" toml:"restored-table-prefix"`
+	RestoredTableSuffix string `json:"restored-table-suffix" toml:"restored-table-suffix"`
+	// NetworkBandwidth is the network bandwidth in bytes per second between
+	// the storage and the cluster, for estimating the restore duration. Zero
+	// means unknown.
+	NetworkBandwidth uint64 `json:"network-bandwidth" toml:"network-bandwidth"`
+	// BatchBytes and BatchKeys bound the total bytes and keys of the ranges
+	// of a split/ingest batch, so the batches take similar time however the
+	// sizes of the ranges vary. Zero derives them from the concurrency.
+	BatchBytes uint64 `json:"batch-bytes" toml:"batch-bytes"`
+	BatchKeys  uint64 `json:"batch-keys" toml:"batch-keys"`
+	// FilterGarbageKeys drops the keys of the files not covered by the
+	// rewrite rules, instead of failing the restore.
+	FilterGarbageKeys bool `json:"filter-garbage-keys" toml:"filter-garbage-keys"`
 }
 
 // DefineRestoreFlags defines common flags for the restore tidb command.
@@ -110,6 +579,56 @@ func DefineRestoreFlags(flags *pflag.FlagSet) {
 	flags.Bool(flagNoSchema, false, "skip creating schemas and tables, reuse existing empty ones")
 	// Do not expose this flag
 	_ = flags.MarkHidden(flagNoSchema)
+	flags.Bool(flagDataOnly, false,
+		"skip all DDLs and restore the data into the existing tables, "+
+			"the tables must have the same columns (including the column IDs) and indexes as the backup")
+	flags.StringSlice(flagTableRateLimit, nil,
+		"The rate limits of databases or tables, MB/s in total, e.g. `db.table=10` or `db=20`, "+
+			"the tables of a database share the limit of the database")
+	flags.Bool(flagVerifyKVCount, false,
+		"verify the KV count TiKV reports for the ingested data of each table against the backupmeta "+
+			"when --checksum=false, a lighter verification "+
+			"than the checksum. It's disabled by default, so --checksum=false alone skips any verification of "+
+			"the restored data at your own risk")
+	flags.Bool(flagQuarantineMismatch, false,
+		"continue to verify the rest tables when some tables fail in the checksum or kv count verification, "+
+			"then move the failed tables into the database "+restore.QuarantineSchema+" and fail the restore "+
+			"with all of them instead of at the first failed table")
+	flags.Uint(flagDDLConcurrency, defaultDDLConcurrency,
+		"the number of the sessions creating the tables concurrently")
+	flags.Uint(flagDDLBatchSize, 1,
+		"the max number of the tables of a database created through one session in a batch")
+	flags.Bool(flagIsolateDDLFailures, false,
+		"when a DDL fails, skip the rest tables of its database and continue restoring the other databases, "+
+			"then report all the failed databases")
+	flags.String(flagDryRunPlan, "",
+		"write the restore plan as JSON to the local file and exit without restoring anything, "+
+			"the plan is deterministic so the plans of different versions or configs can be diffed")
+	flags.String(flagSplitMap, "",
+		"write the planned split ranges and their data sizes to the local file before restoring, "+
+			"in the matrix format of the key visualizer of TiDB Dashboard, the keys are the keys in the backup")
+	flags.Bool(flagRestoreTiFlashReplica, false,
+		"create the tables without TiFlash replicas, and re-create the TiFlash replicas recorded in the backup "+
+			"after the data is restored, so the data isn't ingested into TiFlash directly")
+	flags.Duration(flagWaitTiFlashReplica, 0,
+		"the max duration to wait for the re-created TiFlash replicas to be available, 0 means not to wait")
+	flags.String(flagRestoredTablePrefix, "",
+		"restore the tables with the prefix added to their names, e.g. for blue/green deployment, "+
+			"the views and incremental backups can't be restored with it")
+	flags.String(flagRestoredTableSuffix, "",
+		"restore the tables with the suffix added to their names, e.g. `_restored`")
+	flags.Uint64(flagNetworkBandwidth, 0,
+		"the network bandwidth between the storage and the cluster in MB/s, "+
+			"which the estimated restore duration printed at the start is based on")
+	flags.Uint64(flagBatchBytes, 0,
+		"the max total bytes of the ranges split and ingested in a batch, a range larger than it makes up "+
+			"a batch alone. 0 means --concurrency times the region split size")
+	flags.Uint64(flagBatchKeys, 0,
+		"the max total keys of the ranges split and ingested in a batch. "+
+			"0 means --concurrency times the region split key count")
+	flags.Bool(flagFilterGarbageKeys, false,
+		"drop the keys of the backup files out of the restored tables and indexes, e.g. the orphan keys "+
+			"left in some old backups, instead of failing the restore. The dropped keys are counted in the log")
 
 	DefineRestoreCommonFlags(flags)
 }
@@ -121,6 +640,10 @@ func (cfg *RestoreConfig) ParseFromFlags(flags *pflag.FlagSet) error {
 	if err != nil {
 		return errors.Trace(err)
 	}
+	cfg.DataOnly, err = flags.GetBool(flagDataOnly)
+	if err != nil {
+		return errors.Trace(err)
+	}
 	err = cfg.Config.ParseFromFlags(flags)
 	if err != nil {
 		return errors.Trace(err)
@@ -129,6 +652,80 @@ func (cfg *RestoreConfig) ParseFromFlags(flags *pflag.FlagSet) error {
 	if err != nil {
 		return errors.Trace(err)
 	}
+	cfg.VerifyKVCount, err = flags.GetBool(flagVerifyKVCount)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	cfg.QuarantineMismatch, err = flags.GetBool(flagQuarantineMismatch)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	cfg.DDLConcurrency, err = flags.GetUint(flagDDLConcurrency)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	cfg.DDLBatchSize, err = flags.GetUint(flagDDLBatchSize)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	cfg.IsolateDDLFailures, err = flags.GetBool(flagIsolateDDLFailures)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	cfg.DryRunPlan, err = flags.GetString(flagDryRunPlan)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	cfg.SplitMap, err = flags.GetString(flagSplitMap)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	cfg.RestoreTiFlashReplica, err = flags.GetBool(flagRestoreTiFlashReplica)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	cfg.WaitTiFlashReplica, err = flags.GetDuration(flagWaitTiFlashReplica)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	cfg.RestoredTablePrefix, err = flags.GetString(flagRestoredTablePrefix)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	cfg.RestoredTableSuffix, err = flags.GetString(flagRestoredTableSuffix)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	networkBandwidth, err := flags.GetUint64(flagNetworkBandwidth)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	cfg.NetworkBandwidth = networkBandwidth * units.MiB
+	cfg.BatchBytes, err = flags.GetUint64(flagBatchBytes)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	cfg.BatchKeys, err = flags.GetUint64(flagBatchKeys)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	cfg.FilterGarbageKeys, err = flags.GetBool(flagFilterGarbageKeys)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	tableRateLimits, err := flags.GetStringSlice(flagTableRateLimit)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	rateLimitUnit, err := flags.GetUint64(flagRateLimitUnit)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	cfg.TableRateLimits, err = parseTableRateLimits(tableRateLimits, rateLimitUnit)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	applyPerformanceProfile(flags, &cfg.Config, &cfg.RestoreCommonConfig)
 
 	if cfg.Config.Concurrency == 0 {
 		cfg.Config.Concurrency = defaultRestoreConcurrency
@@ -136,6 +733,349 @@ func (cfg *RestoreConfig) ParseFromFlags(flags *pflag.FlagSet) error {
 	return nil
 }
 
+// restoreBatchSize returns the max total bytes and keys of the ranges of a
+// batch, which default to the size of batchSize regions.
+func restoreBatchSize(cfg *RestoreConfig, batchSize int) (bytes, keys uint64) {
+	bytes, keys = cfg.BatchBytes, cfg.BatchKeys
+	if bytes == 0 {
+		bytes = uint64(batchSize) * restore.DefaultMergeRegionSizeBytes
+	}
+	if keys == 0 {
+		keys = uint64(batchSize) * restore.DefaultMergeRegionKeyCount
+	}
+	return bytes, keys
+}
+
+// writeRestorePlan writes the plan to restore the files of the tables to the
+// path of --dry-run-plan.
+func writeRestorePlan(cfg *RestoreConfig, tables []*metautil.Table, files []*backuppb.File) error {
+	plan, err := restore.BuildRestorePlan(tables, files, restorePlanConfig(cfg))
+	if err != nil {
+		return errors.Trace(err)
+	}
+	data, err := json.MarshalIndent(plan, "", "  ")
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if err = ioutil.WriteFile(cfg.DryRunPlan, append(data, '\n'), 0o644); err != nil {
+		return errors.Annotatef(err, "failed to write the restore plan to %s", cfg.DryRunPlan)
+	}
+	log.Info("restore plan written, skip restoring",
+		zap.String("path", cfg.DryRunPlan),
+		zap.Int("tables", len(plan.Tables)),
+		zap.Int("ranges", plan.TotalRanges))
+	return nil
+}
+
+func restorePlanConfig(cfg *RestoreConfig) restore.RestorePlanConfig {
+	return restore.RestorePlanConfig{
+		Concurrency:          uint(cfg.Concurrency),
+		RateLimit:            cfg.RateLimit,
+		MergeRegionSizeBytes: cfg.MergeSmallRegionSizeBytes,
+		MergeRegionKeyCount:  cfg.MergeSmallRegionKeyCount,
+		Online:               cfg.Online,
+		DataOnly:             cfg.DataOnly,
+	}
+}
+
+// startRestoreETA estimates the duration of restoring the files of the tables
+// and starts tracking it. The estimate is only informative, so it returns nil
+// on failures.
+func startRestoreETA(
+	ctx context.Context,
+	cfg *RestoreConfig,
+	mgr *conn.Mgr,
+	tables []*metautil.Table,
+	files []*backuppb.File,
+	archiveSize uint64,
+) *restore.RestoreETA {
+	plan, err := restore.BuildRestorePlan(tables, files, restorePlanConfig(cfg))
+	if err != nil {
+		log.Warn("failed to plan the restore, skip estimating the duration", zap.Error(err))
+		return nil
+	}
+	stores, err := conn.GetAllTiKVStores(ctx, mgr.GetPDClient(), conn.SkipTiFlash)
+	if err != nil {
+		log.Warn("failed to get the stores, skip estimating the duration", zap.Error(err))
+		return nil
+	}
+	return restore.NewRestoreETA(restore.EstimateRestore(plan, restore.RestoreEstimateConfig{
+		ArchiveSize: archiveSize,
+		Stores:      len(stores),
+		RateLimit:   cfg.RateLimit,
+		Bandwidth:   cfg.NetworkBandwidth,
+		Checksum:    cfg.Checksum,
+	}))
+}
+
+// notifyOnClose forwards the tables, and calls onClose after the input is
+// closed.
+func notifyOnClose(input <-chan restore.CreatedTable, onClose func()) <-chan restore.CreatedTable {
+	output := make(chan restore.CreatedTable, cap(input))
+	go func() {
+		defer close(output)
+		for table := range input {
+			output <- table
+		}
+		onClose()
+	}()
+	return output
+}
+
+// writeSplitMap writes the planned split map of restoring the files of the
+// tables to the path of --split-map.
+func writeSplitMap(cfg *RestoreConfig, tables []*metautil.Table, files []*backuppb.File) error {
+	matrix, err := restore.BuildKeyVizMatrix(tables, files,
+		cfg.MergeSmallRegionSizeBytes, cfg.MergeSmallRegionKeyCount, time.Now())
+	if err != nil {
+		return errors.Trace(err)
+	}
+	data, err := json.Marshal(matrix)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if err = ioutil.WriteFile(cfg.SplitMap, data, 0o644); err != nil {
+		return errors.Annotatef(err, "failed to write the split map to %s", cfg.SplitMap)
+	}
+	log.Info("split map written", zap.String("path", cfg.SplitMap), zap.Int("keys", len(matrix.KeyAxis)))
+	return nil
+}
+
+// setRegionHeartbeatInterval makes the client derive the polling intervals of
+// splitting from the region heartbeat interval of the cluster, the default
+// intervals are kept if the interval isn't available.
+func setRegionHeartbeatInterval(ctx context.Context, client *restore.Client, mgr *conn.Mgr) {
+	interval, err := mgr.GetRegionHeartbeatInterval(ctx)
+	if err != nil {
+		log.Warn("failed to get the region heartbeat interval, use the default polling intervals",
+			zap.Error(err))
+		return
+	}
+	client.SetRegionHeartbeatInterval(interval)
+}
+
+// skipScatterOnSmallCluster makes the client skip scattering when the cluster
+// has no more TiKV stores than the replicas of a region, where scattering can
+// never succeed, e.g. a single-store cluster for development.
+func skipScatterOnSmallCluster(ctx context.Context, client *restore.Client, mgr *conn.Mgr) {
+	stores, err := conn.GetAllTiKVStores(ctx, mgr.GetPDClient(), conn.SkipTiFlash)
+	if err != nil {
+		log.Warn("failed to get the stores, scatter regions as usual", zap.Error(err))
+		return
+	}
+	maxReplicas, err := mgr.GetMaxReplicas(ctx)
+	if err != nil {
+		log.Warn("failed to get the max replicas, scatter regions as usual", zap.Error(err))
+		return
+	}
+	if len(stores) <= maxReplicas {
+		log.Info("skip scattering regions since every store has a replica of each region",
+			zap.Int("stores", len(stores)), zap.Int("max-replicas", maxReplicas))
+		client.DisableScatter()
+	}
+}
+
+// checkFinishMarker refuses to restore the archive without a valid finish
+// marker unless allowIncomplete is set.
+func checkFinishMarker(ctx context.Context, s storage.ExternalStorage, allowIncomplete bool) error {
+	marker, err := metautil.CheckFinishMarker(ctx, s)
+	if err != nil {
+		if allowIncomplete && berrors.Is(err, berrors.ErrRestoreIncompleteBackup) {
+			log.Warn("the backup may be incomplete, restore it anyway", zap.Error(err))
+			return nil
+		}
+		return errors.Annotatef(err, "use --%s to restore it anyway", flagAllowIncomplete)
+	}
+	log.Info("the backup is complete", zap.Int("file-count", marker.FileCount))
+	return nil
+}
+
+// checkSignature verifies the signature of the backup by the key if it's set.
+func checkSignature(ctx context.Context, s storage.ExternalStorage, keyURI string) error {
+	if len(keyURI) == 0 {
+		return nil
+	}
+	verifier, err := backup.NewVerifier(ctx, keyURI)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	sig, err := metautil.VerifySignature(ctx, s, verifier)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	log.Info("the signature of the backup is verified", zap.String("algorithm", sig.Algorithm))
+	return nil
+}
+
+// checkEncryptionAtRest checks the backup of a cluster encrypting the data at
+// rest is restored into the stores encrypting it too. The SST files of the
+// backup are in plaintext, and each store encrypts the ingested data by its
+// own master key, so the stores may use the keys different from the backed
+// up cluster, but the data must not be left unencrypted silently.
+func checkEncryptionAtRest(ctx context.Context, mgr *conn.Mgr, meta *backup.EncryptionAtRestMeta, allow bool) error {
+	if meta == nil || !meta.Encrypted() {
+		return nil
+	}
+	stores, err := mgr.GetStoresEncryptionAtRest(ctx)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	unencrypted := make([]uint64, 0)
+	unknown := make([]uint64, 0)
+	for id, store := range stores {
+		if store.Err != nil {
+			log.Warn("failed to read the encryption at rest of the store",
+				zap.Uint64("store", id), zap.Error(store.Err))
+			unknown = append(unknown, id)
+		} else if !store.Enabled() {
+			unencrypted = append(unencrypted, id)
+		}
+	}
+	if len(unencrypted) == 0 && len(unknown) == 0 {
+		log.Info("the backup of a cluster with encryption at rest is restored into the encrypted stores",
+			zap.Strings("methods", meta.Methods))
+		return nil
+	}
+	sort.Slice(unencrypted, func(i, j int) bool { return unencrypted[i] < unencrypted[j] })
+	sort.Slice(unknown, func(i, j int) bool { return unknown[i] < unknown[j] })
+	if allow {
+		log.Warn("the backup of a cluster with encryption at rest may be restored into the unencrypted stores",
+			zap.Strings("methods", meta.Methods),
+			zap.Uint64s("unencrypted", unencrypted), zap.Uint64s("unknown", unknown))
+		return nil
+	}
+	return errors.Annotatef(berrors.ErrRestoreEncryptionAtRest,
+		"the backup is from a cluster encrypting the data at rest by %v, but stores %v don't encrypt it "+
+			"and the config of stores %v can't be read, use --%s to restore anyway",
+		meta.Methods, unencrypted, unknown, flagAllowUnencryptedAtRest)
+}
+
+// checkRegionGuardrail estimates the average region replicas of each TiKV
+// store after splitting the new regions, and warns or aborts according to
+// the config if it exceeds the threshold.
+func checkRegionGuardrail(ctx context.Context, mgr *conn.Mgr, cfg *RestoreCommonConfig, newRegions int) error {
+	if cfg.MaxRegionsPerStore == 0 || newRegions == 0 {
+		return nil
+	}
+	stores, err := conn.GetAllTiKVStores(ctx, mgr.GetPDClient(), conn.SkipTiFlash)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if len(stores) == 0 {
+		return nil
+	}
+	regions, err := mgr.GetRegionCount(ctx, nil, nil)
+	if err != nil {
+		log.Warn("failed to get the region count, skip checking the region count", zap.Error(err))
+		return nil
+	}
+	maxReplicas, err := mgr.GetMaxReplicas(ctx)
+	if err != nil {
+		log.Warn("failed to get the max replicas, skip checking the region count", zap.Error(err))
+		return nil
+	}
+	return judgeRegionGuardrail(cfg, regions, newRegions, maxReplicas, len(stores))
+}
+
+// judgeRegionGuardrail warns or aborts according to the config if the
+// average region replicas of each store exceeds the threshold.
+func judgeRegionGuardrail(cfg *RestoreCommonConfig, regions, newRegions, maxReplicas, stores int) error {
+	perStore := uint64(regions+newRegions) * uint64(maxReplicas) / uint64(stores)
+	fields := []zap.Field{
+		zap.Int("regions", regions),
+		zap.Int("new-regions", newRegions),
+		zap.Int("max-replicas", maxReplicas),
+		zap.Int("stores", stores),
+		zap.Uint64("regions-per-store", perStore),
+		zap.Uint64("max-regions-per-store", cfg.MaxRegionsPerStore),
+	}
+	if perStore <= cfg.MaxRegionsPerStore {
+		log.Info("the region count after splitting is acceptable", fields...)
+		return nil
+	}
+	if cfg.RegionGuardrail == regionGuardrailAbort {
+		log.Error("too many regions after splitting", fields...)
+		return errors.Annotatef(berrors.ErrRestoreTooManyRegions,
+			"each store would have about %d regions, exceeding --%s %d, "+
+				"consider increasing --%s or scaling out the cluster",
+			perStore, flagMaxRegionsPerStore, cfg.MaxRegionsPerStore, FlagMergeRegionSizeBytes)
+	}
+	logutil.WarnTerm("too many regions after splitting, the cluster may be unstable", fields...)
+	return nil
+}
+
+// setupSplitCheckpoint loads the split checkpoint from the storage of the
+// URL into the client.
+func setupSplitCheckpoint(
+	ctx context.Context, client *restore.Client, rawURL string, backendOpts *storage.BackendOptions,
+) error {
+	if len(rawURL) == 0 {
+		return nil
+	}
+	u, err := storage.ParseBackend(rawURL, backendOpts)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	s, err := storage.New(ctx, u, &storage.ExternalStorageOptions{})
+	if err != nil {
+		return errors.Trace(err)
+	}
+	cp, err := restore.NewSplitCheckpoint(ctx, s)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	client.SetSplitCheckpoint(cp)
+	return nil
+}
+
+// newHedgePDClient creates another PD client for the hedged reads. The PD
+// addresses are rotated so it prefers another endpoint to discover the
+// leader, and it always uses an independent connection.
+func newHedgePDClient(ctx context.Context, cfg *Config) (pd.Client, error) {
+	var tlsConf *tls.Config
+	pdTLS := cfg.TLS.ForPD()
+	if pdTLS.IsEnabled() {
+		var err error
+		tlsConf, err = pdTLS.ToTLSConfig()
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+	addrs, err := pdutil.DiscoverAddrs(ctx, cfg.PD, tlsConf)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if len(addrs) > 1 {
+		addrs = append(addrs[1:], addrs[0])
+	}
+	log.Info("enable hedged pd reads", zap.Strings("pd", addrs))
+	cli, err := pdutil.NewPDClient(ctx, addrs, pdTLS.ToPDSecurityOption())
+	return cli, errors.Trace(err)
+}
+
+// parseTableRateLimits parses the rate limits in the form of `name=limit`,
+// the limits are multiplied by `unit`.
+func parseTableRateLimits(items []string, unit uint64) (map[string]uint64, error) {
+	if len(items) == 0 {
+		return nil, nil
+	}
+	limits := make(map[string]uint64, len(items))
+	for _, item := range items {
+		sep := strings.LastIndexByte(item, '=')
+		if sep <= 0 {
+			return nil, errors.Annotatef(berrors.ErrInvalidArgument,
+				"invalid table rate limit %s, should be `db.table=limit` or `db=limit`", item)
+		}
+		limit, err := strconv.ParseUint(strings.TrimSpace(item[sep+1:]), 10, 64)
+		if err != nil || limit == 0 {
+			return nil, errors.Annotatef(berrors.ErrInvalidArgument,
+				"invalid table rate limit %s, the limit should be a positive integer", item)
+		}
+		limits[strings.TrimSpace(item[:sep])] = limit * unit
+	}
+	return limits, nil
+}
+
 // adjustRestoreConfig is use for BR(binary) and BR in TiDB.
 // When new config was add and not included in parser.
 // we should set proper value in this function.
@@ -189,11 +1129,19 @@ func CheckRestoreDBAndTable(client *restore.Client, cfg *RestoreConfig) error {
 
 // RunRestore starts a restore task inside the current goroutine.
 func RunRestore(c context.Context, g glue.Glue, cmdName string, cfg *RestoreConfig) error {
+	defer summary.Summary(cmdName)
+	return runRestore(c, g, cmdName, cfg)
+}
+
+// runRestore restores the snapshot backup without printing the summary, so
+// it can be a phase of another task.
+func runRestore(c context.Context, g glue.Glue, cmdName string, cfg *RestoreConfig) (err error) {
 	cfg.adjustRestoreConfig()
 
-	defer summary.Summary(cmdName)
 	ctx, cancel := context.WithCancel(c)
 	defer cancel()
+	_, unregister := registerAbortableRestore(cancel)
+	defer unregister()
 
 	if span := opentracing.SpanFromContext(ctx); span != nil && span.Tracer() != nil {
 		span1 := span.Tracer().StartSpan("task.RunRestore", opentracing.ChildOf(span.Context()))
@@ -208,6 +1156,7 @@ func RunRestore(c context.Context, g glue.Glue, cmdName string, cfg *RestoreConf
 		return errors.Trace(err)
 	}
 	defer mgr.Close()
+	defer setupPDOpLog(ctx, &cfg.Config, cmdName, mgr)()
 
 	keepaliveCfg := GetKeepalive(&cfg.Config)
 	keepaliveCfg.PermitWithoutStream = true
@@ -215,18 +1164,22 @@ func RunRestore(c context.Context, g glue.Glue, cmdName string, cfg *RestoreConf
 	if err != nil {
 		return errors.Trace(err)
 	}
+	client.SetPDTLSConfig(mgr.GetPDTLSConfig())
 	defer client.Close()
+	defer cleanupAbortedRestore(ctx, client)
 
 	u, err := storage.ParseBackend(cfg.Storage, &cfg.BackendOptions)
 	if err != nil {
 		return errors.Trace(err)
 	}
-	opts := storage.ExternalStorageOptions{
-		NoCredentials:   cfg.NoCreds,
-		SendCredentials: cfg.SendCreds,
-		SkipCheckPath:   cfg.SkipCheckPath,
+	opts, err := storageOpts(&cfg.Config)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if err = client.SetStorage(ctx, u, opts); err != nil {
+		return errors.Trace(err)
 	}
-	if err = client.SetStorage(ctx, u, &opts); err != nil {
+	if err = client.EnableDecryption(ctx, cfg.MetadataMasterKey); err != nil {
 		return errors.Trace(err)
 	}
 	client.SetRateLimit(cfg.RateLimit)
@@ -237,6 +1190,55 @@ func RunRestore(c context.Context, g glue.Glue, cmdName string, cfg *RestoreConf
 	if cfg.NoSchema {
 		client.EnableSkipCreateSQL()
 	}
+	if cfg.DataOnly {
+		client.EnableDataOnly()
+	}
+	if cfg.SplitWithoutScatter {
+		client.EnableSplitWithoutScatter()
+	}
+	if len(cfg.VerifyFailureDomain) > 0 {
+		client.EnableFailureDomainCheck(cfg.VerifyFailureDomain, cfg.RescatterViolating)
+	}
+	if cfg.ScatterLeader {
+		client.EnableScatterLeader()
+	}
+	client.SetRegionNotFoundGrace(cfg.RegionNotFoundGrace)
+	client.SetScatterWait(int(cfg.ScatterWaitConcurrency), cfg.ScatterWaitTimeout)
+	client.SetSplitTargetSize(cfg.SplitTargetSize)
+	memory := restore.NewMemoryTracker(cfg.MemorySoftLimit)
+	client.SetMemoryTracker(memory)
+	backoffPolicy, err := utils.ParseBackoffPolicy(cfg.BackoffPolicy)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	client.SetBackoffPolicy(backoffPolicy)
+	setRegionHeartbeatInterval(ctx, client, mgr)
+	skipScatterOnSmallCluster(ctx, client, mgr)
+	if err = setupRestoreBandwidthProbe(ctx, mgr, &cfg.Config, cmdName, client); err != nil {
+		return errors.Trace(err)
+	}
+	if err = setupSplitCheckpoint(ctx, client, cfg.SplitCheckpoint, &cfg.BackendOptions); err != nil {
+		return errors.Trace(err)
+	}
+	if cfg.PDHedgeDelay > 0 {
+		hedgeClient, err := newHedgePDClient(ctx, &cfg.Config)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		defer hedgeClient.Close()
+		client.EnableHedgedPDReads(hedgeClient, cfg.PDHedgeDelay)
+	}
+	client.SetStoreAddressMap(cfg.StoreAddressMap)
+	if !cfg.Checksum && cfg.VerifyKVCount {
+		client.EnableKVCountVerification()
+	}
+	if cfg.QuarantineMismatch {
+		client.EnableChecksumQuarantine()
+	}
+	if cfg.IsolateDDLFailures {
+		client.EnableDDLFailureIsolation()
+	}
+	client.SetDDLBatchSize(cfg.DDLBatchSize)
 	client.SetSwitchModeInterval(cfg.SwitchModeInterval)
 	err = client.LoadRestoreStores(ctx)
 	if err != nil {
@@ -247,6 +1249,22 @@ func RunRestore(c context.Context, g glue.Glue, cmdName string, cfg *RestoreConf
 	if err != nil {
 		return errors.Trace(err)
 	}
+	if err = checkClockSkew(ctx, &cfg.Config, mgr.GetPDClient(), s); err != nil {
+		return errors.Trace(err)
+	}
+	if err = checkFinishMarker(ctx, s, cfg.AllowIncomplete); err != nil {
+		return errors.Trace(err)
+	}
+	if err = checkSignature(ctx, s, cfg.SigningKey); err != nil {
+		return errors.Trace(err)
+	}
+	ext, err := backup.LoadExtension(ctx, s)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if err = checkEncryptionAtRest(ctx, mgr, ext.EncryptionAtRest, cfg.AllowUnencryptedAtRest); err != nil {
+		return errors.Trace(err)
+	}
 	backupVersion := version.NormalizeBackupVersion(backupMeta.ClusterVersion)
 	if cfg.CheckRequirements && backupVersion != nil {
 		if versionErr := version.CheckClusterVersion(ctx, mgr.GetPDClient(), version.CheckVersionForBackup(backupVersion)); versionErr != nil {
@@ -257,10 +1275,16 @@ func RunRestore(c context.Context, g glue.Glue, cmdName string, cfg *RestoreConf
 	if err = client.InitBackupMeta(c, backupMeta, u, s, reader); err != nil {
 		return errors.Trace(err)
 	}
+	if cfg.RateLimitAuto {
+		startAutoRateLimit(ctx, mgr, client)
+	}
 
 	if client.IsRawKvMode() {
 		return errors.Annotate(berrors.ErrRestoreModeMismatch, "cannot do transactional restore from raw kv data")
 	}
+	if err = client.SetTableRateLimits(cfg.TableRateLimits); err != nil {
+		return errors.Trace(err)
+	}
 	if err = CheckRestoreDBAndTable(client, cfg); err != nil {
 		return err
 	}
@@ -268,8 +1292,31 @@ func RunRestore(c context.Context, g glue.Glue, cmdName string, cfg *RestoreConf
 	if len(dbs) == 0 && len(tables) != 0 {
 		return errors.Annotate(berrors.ErrRestoreInvalidBackup, "contain tables but no databases")
 	}
+	defer memory.Track(restore.MemoryPhasePlan, restore.FilesMemSize(files))()
 	archiveSize := reader.ArchiveSize(ctx, files)
 	g.Record(summary.RestoreDataSize, archiveSize)
+	if cfg.SplitMap != "" {
+		if err = writeSplitMap(cfg, tables, files); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	if cfg.DryRunPlan != "" {
+		if err = writeRestorePlan(cfg, tables, files); err != nil {
+			return errors.Trace(err)
+		}
+		summary.SetSuccessStatus(true)
+		return nil
+	}
+	// The region count is checked before any DDL, so an aborted restore
+	// doesn't leave the tables created but empty.
+	splitKeys, err := restore.EstimateSplitKeys(
+		files, cfg.MergeSmallRegionKeyCount, cfg.MergeSmallRegionKeyCount, cfg.SplitTargetSize)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if err = checkRegionGuardrail(ctx, mgr, &cfg.RestoreCommonConfig, splitKeys); err != nil {
+		return errors.Trace(err)
+	}
 	restoreTS, err := client.GetTS(ctx)
 	if err != nil {
 		return errors.Trace(err)
@@ -293,11 +1340,27 @@ func RunRestore(c context.Context, g glue.Glue, cmdName string, cfg *RestoreConf
 		newTS = restoreTS
 	}
 	ddlJobs := restore.FilterDDLJobs(client.GetDDLJobs(), tables)
+	if cfg.DataOnly && len(ddlJobs) > 0 {
+		log.Info("skip the ddl jobs in data only mode", zap.Int("jobs", len(ddlJobs)))
+		ddlJobs = nil
+	}
+
+	if len(cfg.RestoredTablePrefix) > 0 || len(cfg.RestoredTableSuffix) > 0 {
+		mangler := restore.AffixMangler{Prefix: cfg.RestoredTablePrefix, Suffix: cfg.RestoredTableSuffix}
+		if err = restore.MangleTableNames(tables, ddlJobs, mangler); err != nil {
+			return errors.Trace(err)
+		}
+	}
 
 	err = client.PreCheckTableTiFlashReplica(ctx, tables)
 	if err != nil {
 		return errors.Trace(err)
 	}
+	// the existing tables keep their own TiFlash replicas in data only mode.
+	var tiFlashReplicas []restore.TiFlashReplica
+	if cfg.RestoreTiFlashReplica && !cfg.DataOnly {
+		tiFlashReplicas = restore.StashTiFlashReplicas(tables)
+	}
 
 	err = client.PreCheckTableClusterIndex(tables, ddlJobs, mgr.GetDomain())
 	if err != nil {
@@ -331,16 +1394,17 @@ func RunRestore(c context.Context, g glue.Glue, cmdName string, cfg *RestoreConf
 
 	// We make bigger errCh so we won't block on multi-part failed.
 	errCh := make(chan error, 32)
-	// Maybe allow user modify the DDL concurrency isn't necessary,
-	// because executing DDL is really I/O bound (or, algorithm bound?),
-	// and we cost most of time at waiting DDL jobs be enqueued.
-	// So these jobs won't be faster or slower when machine become faster or slower,
-	// hence make it a fixed value would be fine.
+	// Executing DDL is mostly waiting for the DDL jobs to be enqueued, the
+	// concurrency is bounded by the DDL owner rather than BR.
+	ddlConcurrency := cfg.DDLConcurrency
+	if ddlConcurrency == 0 {
+		ddlConcurrency = defaultDDLConcurrency
+	}
 	var dbPool []*restore.DB
 	if g.OwnsStorage() {
 		// Only in binary we can use multi-thread sessions to create tables.
 		// so use OwnStorage() to tell whether we are use binary or SQL.
-		dbPool, err = restore.MakeDBPool(defaultDDLConcurrency, func() (*restore.DB, error) {
+		dbPool, err = restore.MakeDBPool(ddlConcurrency, func() (*restore.DB, error) {
 			return restore.NewDB(g, mgr.GetStorage())
 		})
 	}
@@ -350,6 +1414,9 @@ func RunRestore(c context.Context, g glue.Glue, cmdName string, cfg *RestoreConf
 			zap.Int("sessionCount", len(dbPool)),
 		)
 	}
+	eta := startRestoreETA(ctx, cfg, mgr, tables, files, archiveSize)
+	utils.SetProgressETA(eta.Remaining)
+	defer utils.SetProgressETA(nil)
 	tableStream := client.GoCreateTables(ctx, mgr.GetDomain(), tables, newTS, dbPool, errCh)
 	if len(files) == 0 {
 		log.Info("no files, empty databases and tables are restored")
@@ -360,13 +1427,44 @@ func RunRestore(c context.Context, g glue.Glue, cmdName string, cfg *RestoreConf
 	tableFileMap := restore.MapTableToFiles(files)
 	log.Debug("mapped table to files", zap.Any("result map", tableFileMap))
 
-	rangeStream := restore.GoValidateFileRanges(
-		ctx, tableStream, tableFileMap, cfg.MergeSmallRegionKeyCount, cfg.MergeSmallRegionKeyCount, errCh)
+	// Restore sst files in batch.
+	batchSize := utils.ClampInt(int(cfg.Concurrency), defaultRestoreConcurrency, maxRestoreBatchSizeLimit)
+	// The batches are bounded by the bytes and keys, the count of the ranges
+	// only keeps a batch from growing too large with the tiny ranges.
+	batchCount := maxRestoreBatchSizeLimit
+	failpoint.Inject("small-batch-size", func(v failpoint.Value) {
+		log.Info("failpoint small batch size is on", zap.Int("size", v.(int)))
+		batchSize = v.(int)
+		batchCount = batchSize
+	})
+
+	var garbageFilter *restore.GarbageKeyFilter
+	if cfg.FilterGarbageKeys {
+		garbageFilter = restore.NewGarbageKeyFilter()
+	}
+	var rangeStream <-chan restore.TableWithRange
+	if cfg.MergeTargetDuration > 0 {
+		estimator := restore.NewThroughputEstimator()
+		client.SetThroughputEstimator(estimator)
+		sizer := restore.NewMergeSizer(estimator, cfg.MergeTargetDuration, batchSize,
+			cfg.MergeSmallRegionSizeBytes, cfg.MergeSmallRegionKeyCount)
+		rangeStream = restore.GoValidateFileRangesWithSizer(ctx, tableStream, tableFileMap, sizer, garbageFilter, errCh)
+	} else {
+		rangeStream = restore.GoValidateFileRanges(
+			ctx, tableStream, tableFileMap, cfg.MergeSmallRegionKeyCount, cfg.MergeSmallRegionKeyCount,
+			garbageFilter, errCh)
+	}
 
 	rangeSize := restore.EstimateRangeSize(files)
 	summary.CollectInt("restore ranges", rangeSize)
 	log.Info("range and file prepared", zap.Int("file count", len(files)), zap.Int("range count", rangeSize))
 
+	// This runs after restorePostWork, which restores the merge config of PD.
+	defer func() {
+		if err == nil {
+			accelerateRegionMerge(ctx, mgr, cfg.AccelerateMerge, nil, nil)
+		}
+	}()
 	restoreSchedulers, err := restorePreWork(ctx, client, mgr)
 	if err != nil {
 		return errors.Trace(err)
@@ -378,19 +1476,12 @@ func RunRestore(c context.Context, g glue.Glue, cmdName string, cfg *RestoreConf
 	// Do not reset timestamp if we are doing incremental restore, because
 	// we are not allowed to decrease timestamp.
 	if !client.IsIncremental() {
-		if err = client.ResetTS(ctx, cfg.PD); err != nil {
+		if err = client.ResetTS(ctx, mgr.GetPDAddrs()); err != nil {
 			log.Error("reset pd TS failed", zap.Error(err))
 			return errors.Trace(err)
 		}
 	}
 
-	// Restore sst files in batch.
-	batchSize := utils.ClampInt(int(cfg.Concurrency), defaultRestoreConcurrency, maxRestoreBatchSizeLimit)
-	failpoint.Inject("small-batch-size", func(v failpoint.Value) {
-		log.Info("failpoint small batch size is on", zap.Int("size", v.(int)))
-		batchSize = v.(int)
-	})
-
 	// Redirect to log if there is no log file to avoid unreadable output.
 	updateCh := g.StartProgress(
 		ctx,
@@ -405,17 +1496,23 @@ func RunRestore(c context.Context, g glue.Glue, cmdName string, cfg *RestoreConf
 	}
 	manager := restore.NewBRContextManager(client)
 	batcher, afterRestoreStream := restore.NewBatcher(ctx, sender, manager, errCh)
-	batcher.SetThreshold(batchSize)
+	batcher.SetThreshold(batchCount)
+	batcher.SetSizeThreshold(restoreBatchSize(cfg, batchSize))
 	batcher.EnableAutoCommit(ctx, time.Second)
-	go restoreTableStream(ctx, rangeStream, batcher, errCh)
+	afterRestoreStream = notifyOnClose(afterRestoreStream, func() { eta.PhaseDone(restore.PhaseIngest) })
+	go restoreTableStream(ctx, rangeStream, batcher, eta, errCh)
 
 	var finish <-chan struct{}
 	// Checksum
-	if cfg.Checksum {
+	switch {
+	case cfg.Checksum:
 		finish = client.GoValidateChecksum(
 			ctx, afterRestoreStream, mgr.GetStorage().GetClient(), errCh, updateCh, cfg.ChecksumConcurrency)
-	} else {
+	case cfg.VerifyKVCount:
+		finish = client.GoValidateKVCount(ctx, afterRestoreStream, errCh, updateCh)
+	default:
 		// when user skip checksum, just collect tables, and drop them.
+		log.Warn("both checksum and kv count verification are disabled, the restored data is not verified")
 		finish = dropToBlackhole(ctx, afterRestoreStream, errCh, updateCh)
 	}
 
@@ -429,11 +1526,59 @@ func RunRestore(c context.Context, g glue.Glue, cmdName string, cfg *RestoreConf
 	if err != nil {
 		return errors.Trace(err)
 	}
+	eta.PhaseDone(restore.PhaseChecksum)
+	if garbageFilter != nil && (garbageFilter.DroppedFiles() > 0 || garbageFilter.TrimmedFiles() > 0) {
+		summary.CollectUint("garbage dropped files", garbageFilter.DroppedFiles())
+		summary.CollectUint("garbage dropped kvs", garbageFilter.DroppedKVs())
+		summary.CollectUint("garbage trimmed files", garbageFilter.TrimmedFiles())
+		log.Warn("dropped the keys not covered by the rewrite rules",
+			zap.Uint64("dropped files", garbageFilter.DroppedFiles()),
+			zap.Uint64("dropped kvs", garbageFilter.DroppedKVs()),
+			zap.Uint64("trimmed files", garbageFilter.TrimmedFiles()))
+	}
 
 	// The cost of rename user table / replace into system table wouldn't be so high.
 	// So leave it out of the pipeline for easier implementation.
 	client.RestoreSystemSchemas(ctx, cfg.TableFilter)
 
+	if failed := client.FailedDatabases(); len(failed) > 0 {
+		summary.CollectInt("failed databases", len(failed))
+		log.Error("some databases failed to restore the schemas", zap.Strings("databases", failed))
+		return errors.Annotatef(berrors.ErrRestoreDatabaseFailed,
+			"%d databases failed to restore the schemas: %s", len(failed), strings.Join(failed, ", "))
+	}
+	var quarantineErr error
+	if quarantined := client.QuarantinedTables(); len(quarantined) > 0 {
+		if err = client.QuarantineTables(ctx); err != nil {
+			return errors.Trace(err)
+		}
+		names := make([]string, 0, len(quarantined))
+		for _, t := range quarantined {
+			names = append(names, t.String())
+		}
+		summary.CollectInt("quarantined tables", len(quarantined))
+		log.Warn("some tables failed to validate checksum and are moved into the quarantine database",
+			zap.String("database", restore.QuarantineSchema), zap.Strings("tables", names))
+		tiFlashReplicas = skipQuarantinedReplicas(tiFlashReplicas, quarantined)
+		// The other tables are restored, but the restore fails with the full
+		// list of the quarantined tables.
+		quarantineErr = errors.Annotatef(berrors.ErrRestoreChecksumMismatch,
+			"%d tables failed to validate checksum and are moved into %s: %s",
+			len(quarantined), restore.QuarantineSchema, strings.Join(names, ", "))
+	}
+
+	if err = client.RestoreTiFlashReplicas(ctx, tiFlashReplicas); err != nil {
+		return errors.Trace(err)
+	}
+	if cfg.WaitTiFlashReplica > 0 {
+		if err = client.WaitTiFlashReplicasReady(ctx, tiFlashReplicas, cfg.WaitTiFlashReplica); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	if quarantineErr != nil {
+		return quarantineErr
+	}
+
 	// Set task summary to success status.
 	summary.SetSuccessStatus(true)
 	return nil
@@ -468,6 +1613,10 @@ func dropToBlackhole(
 	return outCh
 }
 
+// filterRestoreFiles returns the tables matching the filter, their databases
+// and the files. The files of all the tables are deduplicated together before
+// they are grouped by table, so a file recorded by several tables is restored
+// only once.
 func filterRestoreFiles(
 	client *restore.Client,
 	cfg *RestoreConfig,
@@ -490,6 +1639,7 @@ func filterRestoreFiles(
 			tables = append(tables, table)
 		}
 	}
+	files = restore.DedupFiles(files)
 	return
 }
 
@@ -526,6 +1676,73 @@ func restorePostWork(
 	}
 }
 
+// skipQuarantinedReplicas removes the TiFlash replicas of the quarantined
+// tables, which have been moved out of their databases.
+func skipQuarantinedReplicas(
+	replicas []restore.TiFlashReplica, quarantined []restore.QuarantinedTable,
+) []restore.TiFlashReplica {
+	skipped := make(map[restore.QuarantinedTable]struct{}, len(quarantined))
+	for _, t := range quarantined {
+		skipped[t] = struct{}{}
+	}
+	kept := replicas[:0]
+	for _, r := range replicas {
+		if _, ok := skipped[restore.QuarantinedTable{DB: r.DB.O, Table: r.Table.O}]; !ok {
+			kept = append(kept, r)
+		}
+	}
+	return kept
+}
+
+// accelerateRegionMerge relaxes the region merge limits of PD and waits the
+// regions in [startKey, endKey) to be merged, until the region count stops
+// decreasing or the timeout exceeds. The original config is always restored.
+func accelerateRegionMerge(ctx context.Context, mgr *conn.Mgr, timeout time.Duration, startKey, endKey []byte) {
+	if timeout <= 0 {
+		return
+	}
+	undo, err := mgr.AccelerateRegionMerge(ctx)
+	if err != nil {
+		log.Warn("failed to accelerate region merge", zap.Error(err))
+		return
+	}
+	defer func() {
+		if err := undo(context.Background()); err != nil {
+			log.Warn("failed to restore region merge config", zap.Error(err))
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	ticker := time.NewTicker(waitRegionMergeInterval)
+	defer ticker.Stop()
+	lastCount, stableRounds := -1, 0
+	for {
+		select {
+		case <-ctx.Done():
+			log.Info("stop waiting region merge", zap.Int("region-count", lastCount))
+			return
+		case <-ticker.C:
+			count, err := mgr.GetRegionCount(ctx, startKey, endKey)
+			if err != nil {
+				log.Warn("failed to get region count", zap.Error(err))
+				continue
+			}
+			if lastCount >= 0 && count >= lastCount {
+				stableRounds++
+			} else {
+				stableRounds = 0
+			}
+			log.Info("waiting region merge", zap.Int("region-count", count))
+			lastCount = count
+			if stableRounds >= waitRegionMergeStableRounds {
+				log.Info("region merge finished", zap.Int("region-count", count))
+				return
+			}
+		}
+	}
+}
+
 // enableTiDBConfig tweaks some of configs of TiDB to make the restore progress go well.
 // return a function that could restore the config to origin.
 func enableTiDBConfig() func() {
@@ -546,6 +1763,7 @@ func restoreTableStream(
 	ctx context.Context,
 	inputCh <-chan restore.TableWithRange,
 	batcher *restore.Batcher,
+	eta *restore.RestoreETA,
 	errCh chan<- error,
 ) {
 	// We cache old tables so that we can 'batch' recover TiFlash and tables.
@@ -565,6 +1783,7 @@ func restoreTableStream(
 			return
 		case t, ok := <-inputCh:
 			if !ok {
+				eta.PhaseDone(restore.PhaseCreateTables)
 				return
 			}
 			oldTables = append(oldTables, t.OldTable)
@@ -117,6 +117,7 @@ func RunLogRestore(c context.Context, g glue.Glue, cfg *LogRestoreConfig) error
 	if err != nil {
 		return errors.Trace(err)
 	}
+	client.SetPDTLSConfig(mgr.GetPDTLSConfig())
 	defer client.Close()
 
 	opts := storage.ExternalStorageOptions{
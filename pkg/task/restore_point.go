@@ -0,0 +1,425 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package task
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pingcap/errors"
+	backuppb "github.com/pingcap/kvproto/pkg/backup"
+	"github.com/pingcap/log"
+	"github.com/pingcap/parser/model"
+	"github.com/pingcap/tidb/infoschema"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"go.uber.org/zap"
+
+	berrors "github.com/pingcap/br/pkg/errors"
+	"github.com/pingcap/br/pkg/glue"
+	"github.com/pingcap/br/pkg/metautil"
+	"github.com/pingcap/br/pkg/restore"
+	"github.com/pingcap/br/pkg/storage"
+	"github.com/pingcap/br/pkg/stream"
+	"github.com/pingcap/br/pkg/summary"
+	"github.com/pingcap/br/pkg/utils"
+)
+
+const (
+	flagFullBackupStorage = "full-backup-storage"
+	flagRestoredTS        = "restored-ts"
+)
+
+// PointRestoreConfig is the configuration specific for point in time
+// restore tasks. The embedded storage is the one of the log backup.
+type PointRestoreConfig struct {
+	RestoreConfig
+
+	// FullBackupStorage is the storage of the snapshot backup restored
+	// before replaying the log backup.
+	FullBackupStorage string `json:"full-backup-storage" toml:"full-backup-storage"`
+	// RestoredTS is the TSO the cluster is restored to.
+	RestoredTS uint64 `json:"restored-ts" toml:"restored-ts"`
+}
+
+// DefinePointRestoreFlags defines the flags for the point in time restore.
+func DefinePointRestoreFlags(command *cobra.Command) {
+	command.Flags().String(flagFullBackupStorage, "",
+		"the storage of the snapshot backup restored before replaying the log backup in --storage")
+	command.Flags().String(flagRestoredTS, "",
+		"the TSO or datetime to restore the cluster to, "+
+			"restore to the resolved ts of the log backup if not set. "+
+			"Support TSO or datetime, e.g. '400036290571534337' or '2018-05-11 01:42:23'")
+	_ = command.MarkFlagRequired(flagFullBackupStorage)
+}
+
+// ParseFromFlags parses the point in time restore flags from the flag set.
+func (cfg *PointRestoreConfig) ParseFromFlags(flags *pflag.FlagSet) error {
+	var err error
+	cfg.FullBackupStorage, err = flags.GetString(flagFullBackupStorage)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	restoredTS, err := flags.GetString(flagRestoredTS)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if cfg.RestoredTS, err = parseTSString(restoredTS); err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(cfg.RestoreConfig.ParseFromFlags(flags))
+}
+
+// pointRestoreTSRange returns the TS range of the log events replayed after
+// restoring the snapshot backup at snapshotTS. restoredTS of 0 means the
+// resolved ts of the log backup.
+func pointRestoreTSRange(snapshotTS, restoredTS, resolvedTS uint64) (startTS, endTS uint64, err error) {
+	if restoredTS == 0 {
+		restoredTS = resolvedTS
+	}
+	if restoredTS < snapshotTS {
+		return 0, 0, errors.Annotatef(berrors.ErrInvalidArgument,
+			"restored ts %d is less than the backup ts %d of the snapshot backup", restoredTS, snapshotTS)
+	}
+	if restoredTS > resolvedTS {
+		return 0, 0, errors.Annotatef(berrors.ErrRestoreRTsConstrain,
+			"restored ts %d is greater than the resolved ts %d of the log backup", restoredTS, resolvedTS)
+	}
+	// The snapshot already contains the events committed at snapshotTS.
+	return snapshotTS + 1, restoredTS, nil
+}
+
+// readLogResolvedTS returns the resolved ts of the log backup in the storage,
+// and whether the log files are written by a log backup task of `br stream`
+// rather than TiCDC. A stopped task records the TS its log files cover up to,
+// otherwise it's resolved from the metadata written by the stores.
+func readLogResolvedTS(ctx context.Context, s storage.ExternalStorage) (resolvedTS uint64, isStream bool, err error) {
+	isStream, err = s.FileExists(ctx, stream.MetaFile)
+	if err != nil {
+		return 0, false, errors.Trace(err)
+	}
+	if isStream {
+		meta, err := stream.LoadMeta(ctx, s)
+		if err != nil {
+			return 0, true, errors.Trace(err)
+		}
+		if meta.Stopped && meta.CheckpointTS > 0 {
+			return meta.CheckpointTS, true, nil
+		}
+		resolvedTS, err = stream.ReadResolvedTS(ctx, s)
+		return resolvedTS, true, errors.Trace(err)
+	}
+	logMeta, err := restore.ReadLogMeta(ctx, s)
+	if err != nil {
+		return 0, false, errors.Trace(err)
+	}
+	return logMeta.GlobalResolvedTS, false, nil
+}
+
+// splitProgressSteps splits the restore.BytesProgressSteps steps of the
+// progress of the task between the snapshot and the log phases by the bytes
+// they restore.
+func splitProgressSteps(snapshotBytes, logBytes uint64) (snapshotSteps, logSteps int64) {
+	total := int64(restore.BytesProgressSteps)
+	if snapshotBytes+logBytes == 0 {
+		return total / 2, total - total/2
+	}
+	snapshotSteps = int64(float64(snapshotBytes) / float64(snapshotBytes+logBytes) * float64(total))
+	return snapshotSteps, total - snapshotSteps
+}
+
+// phaseProgress drives `weight` steps of the progress of the task by a
+// progress of a phase of `total` steps.
+type phaseProgress struct {
+	mu       sync.Mutex
+	progress glue.Progress
+	weight   int64
+	total    int64
+	done     int64
+	reported int64
+}
+
+func newPhaseProgress(progress glue.Progress, weight, total int64) *phaseProgress {
+	return &phaseProgress{progress: progress, weight: weight, total: total}
+}
+
+// Inc implements glue.Progress.
+func (p *phaseProgress) Inc() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.done >= p.total {
+		return
+	}
+	p.done++
+	p.report(p.done * p.weight / p.total)
+}
+
+// Close implements glue.Progress. It completes the steps of the phase rather
+// than the progress of the task.
+func (p *phaseProgress) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.report(p.weight)
+}
+
+func (p *phaseProgress) report(steps int64) {
+	for ; p.reported < steps; p.reported++ {
+		p.progress.Inc()
+	}
+}
+
+// phaseGlue maps the progress started by a phase of the task into its steps
+// of the progress of the task.
+type phaseGlue struct {
+	glue.Glue
+	progress glue.Progress
+	weight   int64
+}
+
+// StartProgress implements glue.Glue.
+func (g phaseGlue) StartProgress(_ context.Context, _ string, total int64, _ bool) glue.Progress {
+	return newPhaseProgress(g.progress, g.weight, total)
+}
+
+// logBackupSize returns the bytes of the log files to replay.
+func logBackupSize(
+	ctx context.Context, s storage.ExternalStorage, isStream bool, startTS, endTS uint64,
+) ([]*backuppb.DataFileInfo, uint64, error) {
+	var size uint64
+	if isStream {
+		files, err := stream.ReadDataFiles(ctx, s, startTS, endTS)
+		if err != nil {
+			return nil, 0, errors.Trace(err)
+		}
+		for _, f := range files {
+			size += f.Length
+		}
+		return files, size, nil
+	}
+	err := s.WalkDir(ctx, &storage.WalkOption{}, func(_ string, fileSize int64) error {
+		size += uint64(fileSize)
+		return nil
+	})
+	return nil, size, errors.Trace(err)
+}
+
+// RunPointRestore restores the snapshot backup and then replays the log
+// backup of TiCDC or of a log backup task of `br stream` up to the restored
+// ts inside the current goroutine. Both phases drive one progress, weighted
+// by the bytes they restore.
+func RunPointRestore(c context.Context, g glue.Glue, cmdName string, cfg *PointRestoreConfig) (err error) {
+	defer summary.Summary(cmdName)
+	ctx, cancel := context.WithCancel(c)
+	defer cancel()
+
+	snapshotCfg := cfg.RestoreConfig
+	snapshotCfg.Storage = cfg.FullBackupStorage
+	_, snapshotStorage, backupMeta, err := ReadBackupMeta(ctx, metautil.MetaFile, &snapshotCfg.Config)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if backupMeta.IsRawKv {
+		return errors.Annotate(berrors.ErrRestoreModeMismatch,
+			"the full backup storage contains raw kv data, cannot do point restore")
+	}
+	_, logStorage, err := GetStorage(ctx, &cfg.Config)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	resolvedTS, isStream, err := readLogResolvedTS(ctx, logStorage)
+	if err != nil {
+		return errors.Annotate(err, "read the meta of the log backup failed")
+	}
+	// Check the TS range before the snapshot phase, so a bad restored ts
+	// doesn't fail the task after the snapshot is restored.
+	startTS, endTS, err := pointRestoreTSRange(backupMeta.EndVersion, cfg.RestoredTS, resolvedTS)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	reader := metautil.NewMetaReader(backupMeta, snapshotStorage)
+	snapshotFiles, err := reader.ReadDataFiles(ctx)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	var (
+		logFiles []*backuppb.DataFileInfo
+		logBytes uint64
+	)
+	if startTS <= endTS {
+		logFiles, logBytes, err = logBackupSize(ctx, logStorage, isStream, startTS, endTS)
+		if err != nil {
+			return errors.Annotate(err, "read the files of the log backup failed")
+		}
+	}
+	snapshotSteps, logSteps := splitProgressSteps(restore.FilesSize(snapshotFiles), logBytes)
+	log.Info("start point restore",
+		zap.Uint64("snapshot-ts", backupMeta.EndVersion),
+		zap.Uint64("restored-ts", endTS),
+		zap.Bool("br-stream", isStream),
+		zap.Uint64("log-bytes", logBytes))
+	summary.CollectUint("snapshot ts", backupMeta.EndVersion)
+	summary.CollectUint("restored ts", endTS)
+
+	progress := g.StartProgress(ctx, cmdName, restore.BytesProgressSteps, !cfg.LogProgress)
+	defer progress.Close()
+
+	start := time.Now()
+	if err = runRestore(ctx, phaseGlue{Glue: g, progress: progress, weight: snapshotSteps}, cmdName, &snapshotCfg); err != nil {
+		return errors.Annotate(err, "restore the snapshot backup failed")
+	}
+	summary.CollectDuration("snapshot restore duration", time.Since(start))
+
+	if startTS > endTS {
+		log.Info("restored ts is the backup ts of the snapshot backup, skip replaying the log backup")
+		return nil
+	}
+	// The snapshot phase marked the task as success, the log phase reports
+	// it again when it finishes.
+	summary.SetSuccessStatus(false)
+	start = time.Now()
+	logCfg := &LogRestoreConfig{
+		Config:  cfg.Config,
+		StartTS: startTS,
+		EndTS:   endTS,
+	}
+	if isStream {
+		logProgress := newPhaseProgress(progress, logSteps, restore.BytesProgressSteps)
+		err = runStreamLogRestore(ctx, g, cfg, logCfg, reader, logStorage, logFiles, restore.NewBytesProgress(logProgress, logBytes))
+		if err == nil {
+			logProgress.Close()
+		}
+	} else {
+		logProgress := newPhaseProgress(progress, logSteps, 1)
+		if err = RunLogRestore(ctx, g, logCfg); err == nil {
+			logProgress.Inc()
+		}
+	}
+	if err != nil {
+		return errors.Annotate(err, "replay the log backup failed")
+	}
+	summary.CollectDuration("log restore duration", time.Since(start))
+	summary.SetSuccessStatus(true)
+	return nil
+}
+
+// mapTableIDs maps the IDs of the table and its partitions in the backup to
+// the ones of the restored table. The partitions are matched by names.
+func mapTableIDs(ids map[int64]int64, oldTable, newTable *model.TableInfo) {
+	ids[oldTable.ID] = newTable.ID
+	if oldTable.Partition == nil || newTable.Partition == nil {
+		return
+	}
+	for _, oldDef := range oldTable.Partition.Definitions {
+		for _, newDef := range newTable.Partition.Definitions {
+			if oldDef.Name.L == newDef.Name.L {
+				ids[oldDef.ID] = newDef.ID
+				break
+			}
+		}
+	}
+}
+
+// restoredTableIDs returns the IDs of the tables restored from the snapshot
+// backup, see mapTableIDs. The system tables are skipped, since their log
+// files may conflict with the ones of the cluster.
+func restoredTableIDs(
+	ctx context.Context, cfg *PointRestoreConfig, reader *metautil.MetaReader, is infoschema.InfoSchema,
+) (map[int64]int64, error) {
+	databases, err := utils.LoadBackupTables(ctx, reader)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	var mangler restore.TableNameMangler
+	if len(cfg.RestoredTablePrefix) > 0 || len(cfg.RestoredTableSuffix) > 0 {
+		mangler = restore.AffixMangler{Prefix: cfg.RestoredTablePrefix, Suffix: cfg.RestoredTableSuffix}
+	}
+	ids := make(map[int64]int64)
+	for _, db := range databases {
+		if _, isSysDB := utils.GetSysDBName(db.Info.Name); isSysDB {
+			continue
+		}
+		for _, table := range db.Tables {
+			if table.Info == nil || !cfg.TableFilter.MatchTable(db.Info.Name.O, table.Info.Name.O) {
+				continue
+			}
+			name := table.Info.Name
+			if mangler != nil {
+				name = model.NewCIStr(mangler.MangleTableName(db.Info.Name.O, name.O))
+			}
+			newTable, err := is.TableByName(db.Info.Name, name)
+			if err != nil {
+				return nil, errors.Annotatef(err, "the restored table %s",
+					utils.EncloseDBAndTable(db.Info.Name.O, name.O))
+			}
+			mapTableIDs(ids, table.Info, newTable.Meta())
+		}
+	}
+	return ids, nil
+}
+
+// runStreamLogRestore replays the log files of a log backup task of
+// `br stream` onto the tables restored from the snapshot backup, table by
+// table.
+func runStreamLogRestore(
+	ctx context.Context,
+	g glue.Glue,
+	cfg *PointRestoreConfig,
+	logCfg *LogRestoreConfig,
+	reader *metautil.MetaReader,
+	logStorage storage.ExternalStorage,
+	files []*backuppb.DataFileInfo,
+	progress *restore.BytesProgress,
+) error {
+	logCfg.adjustRestoreConfig()
+	// The domain reads the schemas of the tables restored by the snapshot
+	// phase.
+	needDomain := true
+	mgr, err := NewMgr(ctx, g, cfg.PD, cfg.TLS, GetKeepalive(&cfg.Config), cfg.CheckRequirements, needDomain)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer mgr.Close()
+	keepaliveCfg := GetKeepalive(&cfg.Config)
+	keepaliveCfg.PermitWithoutStream = true
+	client, err := restore.NewRestoreClient(g, mgr.GetPDClient(), mgr.GetStorage(), mgr.GetTLSConfig(), keepaliveCfg)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	client.SetPDTLSConfig(mgr.GetPDTLSConfig())
+	defer client.Close()
+
+	tableIDs, err := restoredTableIDs(ctx, cfg, reader, mgr.GetDomain().InfoSchema())
+	if err != nil {
+		return errors.Trace(err)
+	}
+	commitTS, err := client.GetTS(ctx)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	logClient := restore.NewStreamLogClient(client, logStorage, logCfg.StartTS, logCfg.EndTS, commitTS,
+		tableIDs, uint(logCfg.Concurrency), logCfg.BatchWriteKVPairs)
+	groups := logClient.GroupFilesByTable(files)
+	// The skipped files count as replayed.
+	var skippedBytes uint64
+	for _, f := range files {
+		skippedBytes += f.Length
+	}
+	for _, tableFiles := range groups {
+		for _, f := range tableFiles {
+			skippedBytes -= f.Length
+		}
+	}
+	progress.Add(skippedBytes)
+	for tableID, tableFiles := range groups {
+		if err = logClient.RestoreTable(ctx, tableID, tableFiles); err != nil {
+			return errors.Trace(err)
+		}
+		for _, f := range tableFiles {
+			progress.Add(f.Length)
+		}
+	}
+	summary.CollectInt("replayed log files", len(files))
+	summary.CollectInt("replayed tables", len(groups))
+	return nil
+}
@@ -3,33 +3,121 @@
 package task
 
 import (
+	"bytes"
 	"context"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/pingcap/br/pkg/metautil"
 
 	"github.com/pingcap/errors"
+	backuppb "github.com/pingcap/kvproto/pkg/backup"
 	"github.com/pingcap/log"
 	"github.com/spf13/cobra"
 	"github.com/spf13/pflag"
+	"go.uber.org/zap"
 
+	"github.com/pingcap/br/pkg/backup"
 	berrors "github.com/pingcap/br/pkg/errors"
 	"github.com/pingcap/br/pkg/glue"
+	"github.com/pingcap/br/pkg/pdutil"
 	"github.com/pingcap/br/pkg/restore"
+	"github.com/pingcap/br/pkg/rtree"
+	"github.com/pingcap/br/pkg/storage"
 	"github.com/pingcap/br/pkg/summary"
+	"github.com/pingcap/br/pkg/utils"
+)
+
+const (
+	flagToStores = "to-stores"
+	// flagPlacementTimeout bounds the wait for PD moving the regions onto
+	// the stores of flagToStores.
+	flagPlacementTimeout = "placement-timeout"
+	flagKeyCodec         = "key-codec"
+	// flagLockCFFiles decides how to handle the lock CF files in the backup archive.
+	flagLockCFFiles = "lock-cf-files"
+	// flagAtomicCFIngest makes the files of different column families
+	// covering the same keys ingested together.
+	flagAtomicCFIngest = "atomic-cf-ingest"
+	// flagIncrementalStorage is the storage of an incremental raw backup
+	// restored after the backup of flagStorage.
+	flagIncrementalStorage = "incremental-storage"
+	// flagMergeStorage is the storage of another raw backup restored together
+	// with the backup of flagStorage, and flagOverlapPolicy decides how to
+	// handle their overlapping files.
+	flagMergeStorage  = "merge-storage"
+	flagOverlapPolicy = "overlap-policy"
+
+	// rawFilePageSize is the count of the files read from the metafiles and
+	// restored at a time, see walkRawArchiveFiles.
+	rawFilePageSize = 4096
 )
 
 // RestoreRawConfig is the configuration specific for raw kv restore tasks.
 type RestoreRawConfig struct {
 	RawKvConfig
 	RestoreCommonConfig
+
+	// ToStores restricts the stores receiving the restored regions. Each item
+	// is either a store ID or a store label like `key=value`.
+	ToStores []string `json:"to-stores" toml:"to-stores"`
+	// PlacementTimeout is the longest time waiting for PD to move the regions
+	// onto ToStores, zero waits forever.
+	PlacementTimeout time.Duration `json:"placement-timeout" toml:"placement-timeout"`
+	// KeyCodec is the name of the codec which encodes the keys into the keys
+	// of regions, see restore.ParseKeyCodec.
+	KeyCodec string `json:"key-codec" toml:"key-codec"`
+	// LockCFFiles is the policy of handling the lock CF files found in the
+	// backup archive, see restore.FilterLockCFFiles.
+	LockCFFiles string `json:"lock-cf-files" toml:"lock-cf-files"`
+	// AtomicCFIngest makes the files of the default and write CF covering
+	// the same keys ingested together, see restore.Client.EnableAtomicCFIngest.
+	AtomicCFIngest bool `json:"atomic-cf-ingest" toml:"atomic-cf-ingest"`
+	// IncrementalStorages are the storages of the incremental raw backups,
+	// which are restored in order after the backup of Storage.
+	IncrementalStorages []string `json:"incremental-storages" toml:"incremental-storages"`
+	// MergeStorages are the storages of the raw backups restored together
+	// with the backup of Storage, e.g. the backups of different key ranges.
+	// Their overlapping files are handled by OverlapPolicy, see
+	// restore.MergeArchiveFiles.
+	MergeStorages []string              `json:"merge-storages" toml:"merge-storages"`
+	OverlapPolicy restore.OverlapPolicy `json:"overlap-policy" toml:"overlap-policy"`
 }
 
 // DefineRawRestoreFlags defines common flags for the backup command.
 func DefineRawRestoreFlags(command *cobra.Command) {
-	command.Flags().StringP(flagKeyFormat, "", "hex", "start/end key format, support raw|escaped|hex")
-	command.Flags().StringP(flagTiKVColumnFamily, "", "default", "restore specify cf, correspond to tikv cf")
-	command.Flags().StringP(flagStartKey, "", "", "restore raw kv start key, key is inclusive")
-	command.Flags().StringP(flagEndKey, "", "", "restore raw kv end key, key is exclusive")
+	command.Flags().StringP(flagKeyFormat, "", "hex", keyFormatUsage)
+	command.Flags().StringP(flagTiKVColumnFamily, "", "default",
+		"restore specify cf, correspond to tikv cf, multiple cfs are separated by comma, e.g. 'default,write'")
+	command.Flags().StringP(flagStartKey, "", "", "restore raw kv start key, key is inclusive. "+keyArgUsage)
+	command.Flags().StringP(flagEndKey, "", "", "restore raw kv end key, key is exclusive. "+keyArgUsage)
+	command.Flags().String(flagKeyspace, "",
+		"the ID of the keyspace of an API V2 cluster to restore, the keys of --start and --end are the user keys "+
+			"in the keyspace. empty restores the keyspace of the backup if --start and --end are empty too")
+	command.Flags().StringSlice(flagToStores, nil,
+		"only restore the regions to these TiKV stores, each item is either a store ID or a store label like 'zone=z1'")
+	command.Flags().Duration(flagPlacementTimeout, 30*time.Minute,
+		"the longest time waiting for PD to move the regions to --"+flagToStores+" before restoring, 0 means no limit")
+	command.Flags().String(flagKeyCodec, restore.KeyCodecMemComparable,
+		"the codec encoding the keys into the keys of regions, support memcomparable|identity, "+
+			"use identity if the keys have been encoded")
+	command.Flags().String(flagLockCFFiles, restore.LockCFFilesFail,
+		"how to handle the lock CF files accidentally included in the backup archive, "+
+			"fail to list them and stop, or skip them with a warning. support fail|skip")
+	command.Flags().Bool(flagAtomicCFIngest, false,
+		"ingest the default and write CF files covering the same keys in one request for each region, "+
+			"so the write CF records are never restored without their values, for the data in the TxnKV layout")
+	command.Flags().StringArray(flagIncrementalStorage, nil,
+		"the storage of an incremental raw backup to restore after the backup of --storage, "+
+			"can be specified multiple times in the order of the backups, each starting at the backup ts of the previous one")
+	command.Flags().StringArray(flagMergeStorage, nil,
+		"the storage of another raw backup to restore together with the backup of --storage, e.g. the backup of "+
+			"other key ranges, can be specified multiple times. The overlapping files are handled by --"+flagOverlapPolicy)
+	command.Flags().String(flagOverlapPolicy, string(restore.OverlapPolicyFail),
+		"how to handle the overlapping files of the backups of --merge-storage, support fail|skip|newest-ts-wins. "+
+			"newest-ts-wins drops the older files covered by the newer ones entirely, and fails on a partial overlap")
 
 	DefineRestoreCommonFlags(command.PersistentFlags())
 }
@@ -45,7 +133,50 @@ func (cfg *RestoreRawConfig) ParseFromFlags(flags *pflag.FlagSet) error {
 	if err != nil {
 		return errors.Trace(err)
 	}
-	return cfg.RawKvConfig.ParseFromFlags(flags)
+	cfg.ToStores, err = flags.GetStringSlice(flagToStores)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if cfg.PlacementTimeout, err = flags.GetDuration(flagPlacementTimeout); err != nil {
+		return errors.Trace(err)
+	}
+	if cfg.KeyCodec, err = flags.GetString(flagKeyCodec); err != nil {
+		return errors.Trace(err)
+	}
+	if _, err = restore.ParseKeyCodec(cfg.KeyCodec); err != nil {
+		return errors.Trace(err)
+	}
+	if cfg.LockCFFiles, err = flags.GetString(flagLockCFFiles); err != nil {
+		return errors.Trace(err)
+	}
+	if _, err = restore.FilterLockCFFiles(nil, cfg.LockCFFiles); err != nil {
+		return errors.Trace(err)
+	}
+	if cfg.AtomicCFIngest, err = flags.GetBool(flagAtomicCFIngest); err != nil {
+		return errors.Trace(err)
+	}
+	if cfg.IncrementalStorages, err = flags.GetStringArray(flagIncrementalStorage); err != nil {
+		return errors.Trace(err)
+	}
+	if cfg.MergeStorages, err = flags.GetStringArray(flagMergeStorage); err != nil {
+		return errors.Trace(err)
+	}
+	if len(cfg.MergeStorages) > 0 && len(cfg.IncrementalStorages) > 0 {
+		return errors.Annotatef(berrors.ErrInvalidArgument,
+			"--%s cannot be used with --%s", flagMergeStorage, flagIncrementalStorage)
+	}
+	policy, err := flags.GetString(flagOverlapPolicy)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if cfg.OverlapPolicy, err = restore.ParseOverlapPolicy(policy); err != nil {
+		return errors.Trace(err)
+	}
+	if err = cfg.RawKvConfig.ParseFromFlags(flags); err != nil {
+		return errors.Trace(err)
+	}
+	applyPerformanceProfile(flags, &cfg.Config, &cfg.RestoreCommonConfig)
+	return nil
 }
 
 func (cfg *RestoreRawConfig) adjust() {
@@ -64,6 +195,8 @@ func RunRestoreRaw(c context.Context, g glue.Glue, cmdName string, cfg *RestoreR
 	defer summary.Summary(cmdName)
 	ctx, cancel := context.WithCancel(c)
 	defer cancel()
+	_, unregister := registerAbortableRestore(cancel)
+	defer unregister()
 
 	// Restore raw does not need domain.
 	needDomain := false
@@ -72,6 +205,7 @@ func RunRestoreRaw(c context.Context, g glue.Glue, cmdName string, cfg *RestoreR
 		return errors.Trace(err)
 	}
 	defer mgr.Close()
+	defer setupPDOpLog(ctx, &cfg.Config, cmdName, mgr)()
 
 	keepaliveCfg := GetKeepalive(&cfg.Config)
 	// sometimes we have pooled the connections.
@@ -81,77 +215,501 @@ func RunRestoreRaw(c context.Context, g glue.Glue, cmdName string, cfg *RestoreR
 	if err != nil {
 		return errors.Trace(err)
 	}
+	client.SetPDTLSConfig(mgr.GetPDTLSConfig())
 	defer client.Close()
+	defer cleanupAbortedRestore(ctx, client)
 	client.SetRateLimit(cfg.RateLimit)
 	client.SetConcurrency(uint(cfg.Concurrency))
 	if cfg.Online {
 		client.EnableOnline()
 	}
+	if cfg.SplitWithoutScatter {
+		client.EnableSplitWithoutScatter()
+	}
+	if len(cfg.VerifyFailureDomain) > 0 {
+		client.EnableFailureDomainCheck(cfg.VerifyFailureDomain, cfg.RescatterViolating)
+	}
+	if cfg.ScatterLeader {
+		client.EnableScatterLeader()
+	}
+	if cfg.AtomicCFIngest {
+		client.EnableAtomicCFIngest()
+	}
+	client.SetRegionNotFoundGrace(cfg.RegionNotFoundGrace)
+	client.SetScatterWait(int(cfg.ScatterWaitConcurrency), cfg.ScatterWaitTimeout)
+	client.SetSplitTargetSize(cfg.SplitTargetSize)
+	memory := restore.NewMemoryTracker(cfg.MemorySoftLimit)
+	client.SetMemoryTracker(memory)
+	backoffPolicy, err := utils.ParseBackoffPolicy(cfg.BackoffPolicy)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	client.SetBackoffPolicy(backoffPolicy)
+	setRegionHeartbeatInterval(ctx, client, mgr)
+	skipScatterOnSmallCluster(ctx, client, mgr)
+	if err = setupRestoreBandwidthProbe(ctx, mgr, &cfg.Config, cmdName, client); err != nil {
+		return errors.Trace(err)
+	}
+	keyCodec, err := restore.ParseKeyCodec(cfg.KeyCodec)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	client.SetKeyCodec(keyCodec)
+	client.EnableRawKVSplitCheck()
+	if err = setupSplitCheckpoint(ctx, client, cfg.SplitCheckpoint, &cfg.BackendOptions); err != nil {
+		return errors.Trace(err)
+	}
+	if cfg.PDHedgeDelay > 0 {
+		hedgeClient, err := newHedgePDClient(ctx, &cfg.Config)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		defer hedgeClient.Close()
+		client.EnableHedgedPDReads(hedgeClient, cfg.PDHedgeDelay)
+	}
+	client.SetStoreAddressMap(cfg.StoreAddressMap)
 	client.SetSwitchModeInterval(cfg.SwitchModeInterval)
 
-	u, s, backupMeta, err := ReadBackupMeta(ctx, metautil.MetaFile, &cfg.Config)
+	archives, err := readRawArchives(ctx, cfg)
 	if err != nil {
 		return errors.Trace(err)
 	}
-	reader := metautil.NewMetaReader(backupMeta, s)
-	if err = client.InitBackupMeta(c, backupMeta, u, s, reader); err != nil {
+	if err = checkClockSkew(ctx, &cfg.Config, mgr.GetPDClient(), archives[0].storage); err != nil {
 		return errors.Trace(err)
 	}
+	for _, archive := range archives {
+		if err = checkEncryptionAtRest(ctx, mgr, archive.ext.EncryptionAtRest, cfg.AllowUnencryptedAtRest); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	if len(cfg.Keyspace) > 0 {
+		if err = checkRawAPIV2(ctx, mgr, flagKeyspace); err != nil {
+			return errors.Trace(err)
+		}
+	}
 
-	if !client.IsRawKvMode() {
-		return errors.Annotate(berrors.ErrRestoreModeMismatch, "cannot do raw restore from transactional data")
+	filter := restore.RawFileFilter{
+		StartKey: cfg.StartKey,
+		EndKey:   cfg.EndKey,
+		CFs:      splitColumnFamilies(cfg.CF),
+	}
+	// A single archive is split and restored page by page while its files are
+	// read from the metafiles, so the files of a large backup aren't all in
+	// memory. The files of the chained or merged archives are compared across
+	// the archives, and the files of several column families are paired, so
+	// they are collected before the restore.
+	paged := len(archives) == 1 && len(filter.CFs) == 1 && !cfg.AtomicCFIngest
+	var (
+		archiveSize uint64
+		totalFiles  int
+		totalBytes  uint64
+		rangeCount  int
+		ranges      []rtree.Range
+	)
+	for _, archive := range archives {
+		if err = client.InitBackupMeta(c, archive.meta, archive.backend, archive.storage, archive.reader); err != nil {
+			return errors.Trace(err)
+		}
+		reader := archive.reader
+		err = walkRawArchiveFiles(ctx, client, cfg, filter, func(page []*backuppb.File) error {
+			if !paged {
+				archive.files = append(archive.files, page...)
+				return nil
+			}
+			archiveSize += reader.ArchiveSize(ctx, page)
+			totalFiles += len(page)
+			totalBytes += restore.FilesSize(page)
+			pageRanges, _, err := restore.MergeFileRanges(
+				page, cfg.MergeSmallRegionKeyCount, cfg.MergeSmallRegionKeyCount)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			rangeCount += len(pageRanges)
+			return nil
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+	}
+	if cfg.RateLimitAuto {
+		startAutoRateLimit(ctx, mgr, client)
 	}
+	if len(cfg.MergeStorages) > 0 {
+		if err = mergeRawArchiveFiles(archives, cfg.OverlapPolicy); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	if !paged {
+		for _, archive := range archives {
+			files := archive.files
+			archiveSize += archive.reader.ArchiveSize(ctx, files)
+			totalFiles += len(files)
+			totalBytes += restore.FilesSize(files)
 
-	files, err := client.GetFilesInRawRange(cfg.StartKey, cfg.EndKey, cfg.CF)
-	if err != nil {
-		return errors.Trace(err)
+			// The files of the incremental backups overlap, so their ranges are
+			// merged separately and then merged across the archives below.
+			archiveRanges, _, err := restore.MergeFileRanges(
+				files, cfg.MergeSmallRegionKeyCount, cfg.MergeSmallRegionKeyCount)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			ranges = append(ranges, archiveRanges...)
+		}
+		// SplitRanges rejects the overlapping ranges, which are common between a
+		// full archive and its incremental archives.
+		ranges = restore.MergeOverlappedRanges(ranges)
+		rangeCount = len(ranges)
+		defer memory.Track(restore.MemoryPhasePlan, restore.RangesMemSize(ranges))()
 	}
-	archiveSize := reader.ArchiveSize(ctx, files)
 	g.Record(summary.RestoreDataSize, archiveSize)
 
-	if len(files) == 0 {
+	if totalFiles == 0 {
 		log.Info("all files are filtered out from the backup archive, nothing to restore")
 		return nil
 	}
-	summary.CollectInt("restore files", len(files))
+	summary.CollectInt("restore files", totalFiles)
 
-	ranges, _, err := restore.MergeFileRanges(
-		files, cfg.MergeSmallRegionKeyCount, cfg.MergeSmallRegionKeyCount)
-	if err != nil {
+	if err = checkRegionGuardrail(ctx, mgr, &cfg.RestoreCommonConfig, rangeCount); err != nil {
 		return errors.Trace(err)
 	}
 
 	// Redirect to log if there is no log file to avoid unreadable output.
-	// TODO: How to show progress?
-	updateCh := g.StartProgress(
-		ctx,
-		"Raw Restore",
-		// Split/Scatter + Download/Ingest
-		int64(len(ranges)+len(files)),
-		!cfg.LogProgress)
+	splitCh := g.StartProgress(ctx, "Split Regions", int64(rangeCount), !cfg.LogProgress)
+
+	if err = client.LoadRawRestoreStores(ctx, cfg.ToStores); err != nil {
+		return errors.Trace(err)
+	}
+	resetRawPlacementRule := pdutil.UndoFunc(client.ResetRawPlacementRule)
+	defer func() {
+		if err := resetRawPlacementRule(ctx); err != nil {
+			log.Warn("failed to reset placement rule for raw range", zap.Error(err))
+		}
+		if err := client.ResetRestoreLabels(ctx); err != nil {
+			log.Warn("failed to reset labels of restore stores", zap.Error(err))
+		}
+	}()
+	if err = client.SetupRawPlacementRule(ctx, cfg.StartKey, cfg.EndKey); err != nil {
+		return errors.Trace(err)
+	}
+	if len(cfg.ToStores) > 0 {
+		resetRawPlacementRule = mgr.RecordOp(ctx, &pdutil.Op{
+			Kind:      pdutil.OpPlacementRules,
+			RuleGroup: "pd",
+			RuleIDs:   []string{restore.RawRestoreRuleID},
+		}, resetRawPlacementRule)
+	}
 
 	// RawKV restore does not need to rewrite keys.
 	rewrite := &restore.RewriteRules{}
-	err = restore.SplitRanges(ctx, client, ranges, rewrite, updateCh)
-	if err != nil {
-		return errors.Trace(err)
+	if !paged {
+		err = restore.SplitRanges(ctx, client, ranges, rewrite, splitCh)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		splitCh.Close()
+		if err = client.WaitRawPlacementSchedule(ctx, cfg.StartKey, cfg.EndKey, cfg.PlacementTimeout); err != nil {
+			return errors.Trace(err)
+		}
 	}
 
+	// This runs after restorePostWork, which restores the merge config of PD.
+	defer func() {
+		if err == nil {
+			accelerateRegionMerge(ctx, mgr, cfg.AccelerateMerge, cfg.StartKey, cfg.EndKey)
+		}
+	}()
 	restoreSchedulers, err := restorePreWork(ctx, client, mgr)
 	if err != nil {
 		return errors.Trace(err)
 	}
 	defer restorePostWork(ctx, client, restoreSchedulers)
 
-	err = client.RestoreRaw(ctx, cfg.StartKey, cfg.EndKey, files, updateCh)
-	if err != nil {
-		return errors.Trace(err)
+	// The download/ingest progress is measured by the bytes read from the
+	// storage, which is more meaningful than the file count for large archives.
+	updateCh := g.StartProgress(ctx, "Raw Restore", restore.BytesProgressSteps, !cfg.LogProgress)
+	progress := restore.NewBytesProgress(updateCh, totalBytes)
+	splitBySize := 0
+	if paged {
+		// The files are read from the metafiles again, the regions of each
+		// page are split right before the page is restored.
+		err = walkRawArchiveFiles(ctx, client, cfg, filter, func(page []*backuppb.File) error {
+			pageRanges, _, err := restore.MergeFileRanges(
+				page, cfg.MergeSmallRegionKeyCount, cfg.MergeSmallRegionKeyCount)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			defer memory.Track(restore.MemoryPhasePlan, restore.RangesMemSize(pageRanges))()
+			if err = restore.SplitRanges(ctx, client, pageRanges, rewrite, splitCh); err != nil {
+				return errors.Trace(err)
+			}
+			err = client.WaitRawPlacementSchedule(ctx, cfg.StartKey, cfg.EndKey, cfg.PlacementTimeout)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			splits, err := restoreRawFilesBySize(ctx, client, cfg, page, progress)
+			splitBySize += splits
+			return errors.Trace(err)
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+		splitCh.Close()
+	}
+	// The incremental backups are restored in order, so the newer versions of
+	// the keys overwrite the older ones. The merged backups don't overlap.
+	for i, archive := range archives {
+		if len(archive.files) == 0 {
+			continue
+		}
+		if len(archives) > 1 {
+			log.Info("restore raw backup", zap.Int("index", i), zap.String("storage", archive.name),
+				zap.Uint64("StartVersion", archive.meta.GetStartVersion()),
+				zap.Uint64("EndVersion", archive.meta.GetEndVersion()))
+			err = client.InitBackupMeta(c, archive.meta, archive.backend, archive.storage, archive.reader)
+			if err != nil {
+				return errors.Trace(err)
+			}
+		}
+		splits, err := restoreRawFilesBySize(ctx, client, cfg, archive.files, progress)
+		splitBySize += splits
+		if err != nil {
+			return errors.Trace(err)
+		}
 	}
 
 	// Restore has finished.
 	updateCh.Close()
+	summary.CollectInt("split regions by size", splitBySize)
 
 	// Set task summary to success status.
 	summary.SetSuccessStatus(true)
 	return nil
 }
+
+// walkRawArchiveFiles walks the files of the backup of the client matching
+// the filter page by page, with the lock CF files handled by cfg.LockCFFiles
+// and the duplicated files removed across the pages.
+func walkRawArchiveFiles(
+	ctx context.Context,
+	client *restore.Client,
+	cfg *RestoreRawConfig,
+	filter restore.RawFileFilter,
+	output func([]*backuppb.File) error,
+) error {
+	deduper := restore.NewFileDeduper()
+	return client.WalkFilesInRawRange(ctx, filter, rawFilePageSize, func(page []*backuppb.File) error {
+		page, err := restore.FilterLockCFFiles(page, cfg.LockCFFiles)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if page = deduper.Dedup(page); len(page) == 0 {
+			return nil
+		}
+		return output(page)
+	})
+}
+
+// restoreRawFilesBySize restores the files in batches of about the region
+// size times the concurrency. Before a batch is ingested, the regions of its
+// range larger than the region size are split by their approximate sizes.
+// They are left by the earlier batches in the ranges without precise split
+// keys, e.g. a file larger than the region size, or an incremental archive
+// ingested onto the regions of the full archive, so the batch is spread over
+// the regions instead of piling up onto them until the split checks of TiKV.
+// It returns the number of the requested splits.
+func restoreRawFilesBySize(
+	ctx context.Context,
+	client *restore.Client,
+	cfg *RestoreRawConfig,
+	files []*backuppb.File,
+	progress *restore.BytesProgress,
+) (int, error) {
+	regionSize := cfg.MergeSmallRegionSizeBytes
+	splits := 0
+	for _, batch := range batchRawFilesBySize(files, regionSize*uint64(cfg.Concurrency)) {
+		start, end := batch[0].GetStartKey(), batch[0].GetEndKey()
+		for _, f := range batch[1:] {
+			if len(end) > 0 && (len(f.GetEndKey()) == 0 || bytes.Compare(f.GetEndKey(), end) > 0) {
+				end = f.GetEndKey()
+			}
+		}
+		// It's fine to leave the regions to TiKV on failures.
+		n, err := restore.SplitRangeBySize(ctx, client, start, end, regionSize)
+		if err != nil {
+			log.Warn("failed to split the regions by size before the raw restore", zap.Error(err))
+		}
+		splits += n
+		if err = client.RestoreRaw(ctx, cfg.StartKey, cfg.EndKey, batch, progress); err != nil {
+			return splits, errors.Trace(err)
+		}
+	}
+	return splits, nil
+}
+
+// batchRawFilesBySize sorts the files by the start keys and cuts them into
+// batches of at least batchSize bytes. The overlapping files, e.g. the files
+// of different column families of the same range, stay in the same batch, so
+// RestoreRaw can pair them.
+func batchRawFilesBySize(files []*backuppb.File, batchSize uint64) [][]*backuppb.File {
+	if len(files) == 0 {
+		return nil
+	}
+	sorted := append([]*backuppb.File(nil), files...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return bytes.Compare(sorted[i].GetStartKey(), sorted[j].GetStartKey()) < 0
+	})
+	var (
+		batches [][]*backuppb.File
+		batch   []*backuppb.File
+		size    uint64
+		end     []byte
+	)
+	for _, f := range sorted {
+		// An empty end key is the end of the key space, which overlaps the
+		// rest of the files.
+		overlapped := len(batch) > 0 && (len(end) == 0 || bytes.Compare(f.GetStartKey(), end) < 0)
+		if size >= batchSize && !overlapped {
+			batches = append(batches, batch)
+			batch, size = nil, 0
+		}
+		if len(batch) == 0 || (len(end) > 0 && (len(f.GetEndKey()) == 0 || bytes.Compare(f.GetEndKey(), end) > 0)) {
+			end = f.GetEndKey()
+		}
+		batch = append(batch, f)
+		size += restore.FileSize(f)
+	}
+	return append(batches, batch)
+}
+
+// rawArchive is a raw backup to restore.
+type rawArchive struct {
+	// name is the storage URL without the credentials.
+	name    string
+	backend *backuppb.StorageBackend
+	storage storage.ExternalStorage
+	meta    *backuppb.BackupMeta
+	reader  *metautil.MetaReader
+	ext     *backup.Extension
+	// files are the files of the backup to restore.
+	files []*backuppb.File
+}
+
+// readRawArchives reads the raw backup of the storage followed by the
+// incremental raw backups, and checks they can be restored one after another,
+// or followed by the raw backups to merge.
+func readRawArchives(ctx context.Context, cfg *RestoreRawConfig) ([]*rawArchive, error) {
+	storages := append([]string{cfg.Storage}, cfg.IncrementalStorages...)
+	storages = append(storages, cfg.MergeStorages...)
+	archives := make([]*rawArchive, 0, len(storages))
+	metas := make([]*backuppb.BackupMeta, 0, len(storages))
+	for _, storageURL := range storages {
+		archiveCfg := cfg.Config
+		archiveCfg.Storage = storageURL
+		u, s, backupMeta, err := ReadBackupMeta(ctx, metautil.MetaFile, &archiveCfg)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		if err = checkFinishMarker(ctx, s, cfg.AllowIncomplete); err != nil {
+			return nil, errors.Trace(err)
+		}
+		if err = checkSignature(ctx, s, cfg.SigningKey); err != nil {
+			return nil, errors.Trace(err)
+		}
+		ext, err := backup.LoadExtension(ctx, s)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		if err = checkRawKeyspace(ext.Keyspace, cfg); err != nil {
+			return nil, errors.Trace(err)
+		}
+		archives = append(archives, &rawArchive{
+			name:    redactStorageURL(storageURL),
+			backend: u,
+			storage: s,
+			meta:    backupMeta,
+			reader:  metautil.NewMetaReader(backupMeta, s),
+			ext:     ext,
+		})
+		metas = append(metas, backupMeta)
+	}
+	if len(cfg.MergeStorages) > 0 {
+		return archives, nil
+	}
+	if err := restore.CheckRawBackupChain(metas); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return archives, nil
+}
+
+// mergeRawArchiveFiles drops the overlapping files of the archives by the
+// policy, so the files of different archives never conflict.
+func mergeRawArchiveFiles(archives []*rawArchive, policy restore.OverlapPolicy) error {
+	merging := make([]restore.Archive, 0, len(archives))
+	for _, archive := range archives {
+		merging = append(merging, restore.Archive{
+			Name:     archive.name,
+			BackupTS: archive.meta.GetEndVersion(),
+			Files:    archive.files,
+		})
+	}
+	merged, err := restore.MergeArchiveFiles(merging, policy)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	kept := make(map[*backuppb.File]struct{}, len(merged))
+	for _, f := range merged {
+		kept[f] = struct{}{}
+	}
+	for _, archive := range archives {
+		files := archive.files[:0]
+		for _, f := range archive.files {
+			if _, ok := kept[f]; ok {
+				files = append(files, f)
+			}
+		}
+		if dropped := len(archive.files) - len(files); dropped > 0 {
+			log.Warn("drop the files overlapping with other raw backups",
+				zap.String("storage", archive.name), zap.Int("dropped", dropped))
+		}
+		archive.files = files
+	}
+	return nil
+}
+
+// splitColumnFamilies splits the comma separated column families.
+func splitColumnFamilies(cf string) []string {
+	cfs := make([]string, 0, 1)
+	for _, item := range strings.Split(cf, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			cfs = append(cfs, item)
+		}
+	}
+	return cfs
+}
+
+// checkRawKeyspace checks the keyspace to restore is the keyspace of the
+// backup, which is nil if the backup isn't of a keyspace. If the keyspace and
+// the range aren't set, the keyspace of the backup is restored.
+func checkRawKeyspace(meta *backup.KeyspaceMeta, cfg *RestoreRawConfig) error {
+	if meta == nil {
+		return nil
+	}
+	if len(cfg.Keyspace) == 0 {
+		if len(cfg.StartKey) > 0 || len(cfg.EndKey) > 0 {
+			return nil
+		}
+		log.Info("restore the keyspace of the backup", zap.Uint32("keyspace", meta.ID))
+		cfg.Keyspace = strconv.FormatUint(uint64(meta.ID), 10)
+		cfg.StartKey, cfg.EndKey = utils.KeyspaceRange(meta.ID, meta.StartKey, meta.EndKey)
+		return nil
+	}
+	id, err := utils.ParseKeyspaceID(cfg.Keyspace)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if id != meta.ID {
+		return errors.Annotatef(berrors.ErrInvalidArgument,
+			"the backup is of keyspace %d, it can't be restored into keyspace %d", meta.ID, id)
+	}
+	return nil
+}
@@ -3,9 +3,25 @@
 package task
 
 import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"github.com/docker/go-units"
+	"github.com/gogo/protobuf/proto"
 	. "github.com/pingcap/check"
+	backuppb "github.com/pingcap/kvproto/pkg/backup"
+	"github.com/pingcap/parser/model"
+	"github.com/spf13/pflag"
 
+	"github.com/pingcap/br/pkg/backup"
+	berrors "github.com/pingcap/br/pkg/errors"
 	"github.com/pingcap/br/pkg/restore"
+	"github.com/pingcap/br/pkg/storage"
+	"github.com/pingcap/br/pkg/stream"
+	"github.com/pingcap/br/pkg/utils"
 )
 
 type testRestoreSuite struct{}
@@ -21,3 +37,330 @@ func (s *testRestoreSuite) TestRestoreConfigAdjust(c *C) {
 	c.Assert(cfg.MergeSmallRegionKeyCount, Equals, restore.DefaultMergeRegionKeyCount)
 	c.Assert(cfg.MergeSmallRegionSizeBytes, Equals, restore.DefaultMergeRegionSizeBytes)
 }
+
+func (s *testRestoreSuite) TestParseTableRateLimits(c *C) {
+	limits, err := parseTableRateLimits(nil, 1024)
+	c.Assert(err, IsNil)
+	c.Assert(limits, IsNil)
+
+	limits, err = parseTableRateLimits([]string{"history.orders=10", "log = 2"}, 1024)
+	c.Assert(err, IsNil)
+	c.Assert(limits, DeepEquals, map[string]uint64{"history.orders": 10 * 1024, "log": 2 * 1024})
+
+	for _, item := range []string{"history.orders", "=10", "log=0", "log=abc"} {
+		_, err = parseTableRateLimits([]string{item}, 1024)
+		c.Assert(err, ErrorMatches, ".*invalid table rate limit.*", Commentf("item %s", item))
+	}
+}
+
+func (s *testRestoreSuite) TestApplyPerformanceProfile(c *C) {
+	flags := &pflag.FlagSet{}
+	DefineCommonFlags(flags)
+	DefineRestoreFlags(flags)
+	c.Assert(flags.Parse([]string{"--performance-profile", "conservative", "--concurrency", "8"}), IsNil)
+
+	cfg := &RestoreConfig{}
+	c.Assert(cfg.ParseFromFlags(flags), IsNil)
+	c.Assert(cfg.PerformanceProfile, Equals, "conservative")
+	// The flags specified explicitly take precedence.
+	c.Assert(cfg.Concurrency, Equals, uint32(8))
+	c.Assert(cfg.RateLimit, Equals, uint64(64*units.MiB))
+	c.Assert(cfg.Online, IsTrue)
+	c.Assert(cfg.SplitWithoutScatter, IsFalse)
+
+	flags = &pflag.FlagSet{}
+	DefineCommonFlags(flags)
+	DefineRestoreFlags(flags)
+	c.Assert(flags.Parse([]string{"--performance-profile", "fastest"}), IsNil)
+	c.Assert(cfg.ParseFromFlags(flags), ErrorMatches, ".*invalid performance profile fastest.*")
+}
+
+func (s *testRestoreSuite) TestSplitColumnFamilies(c *C) {
+	c.Assert(splitColumnFamilies("default"), DeepEquals, []string{"default"})
+	c.Assert(splitColumnFamilies("default, write,"), DeepEquals, []string{"default", "write"})
+	c.Assert(splitColumnFamilies(""), DeepEquals, []string{})
+}
+
+func (s *testRestoreSuite) TestSkipQuarantinedReplicas(c *C) {
+	replicas := []restore.TiFlashReplica{
+		{DB: model.NewCIStr("db"), Table: model.NewCIStr("t1"), Count: 1},
+		{DB: model.NewCIStr("db"), Table: model.NewCIStr("t2"), Count: 2},
+	}
+	kept := skipQuarantinedReplicas(replicas, []restore.QuarantinedTable{{DB: "db", Table: "t1"}})
+	c.Assert(kept, HasLen, 1)
+	c.Assert(kept[0].Table.O, Equals, "t2")
+	c.Assert(skipQuarantinedReplicas(nil, []restore.QuarantinedTable{{DB: "db", Table: "t1"}}), HasLen, 0)
+}
+
+func (s *testRestoreSuite) TestAbortRestore(c *C) {
+	server := httptest.NewServer(http.HandlerFunc(handleAbortRestore))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	taskID, unregister := registerAbortableRestore(cancel)
+	err := AbortRestore(context.Background(), server.URL, "unknown", &TLSConfig{})
+	c.Assert(err, ErrorMatches, `.*\[404\] restore task "unknown" not found.*`)
+	c.Assert(ctx.Err(), IsNil)
+
+	c.Assert(AbortRestore(context.Background(), server.URL, taskID, &TLSConfig{}), IsNil)
+	c.Assert(ctx.Err(), Equals, context.Canceled)
+
+	unregister()
+	err = AbortRestore(context.Background(), strings.TrimPrefix(server.URL, "http://"), taskID, &TLSConfig{})
+	c.Assert(err, ErrorMatches, ".*not found.*")
+
+	// The remote hosts without a verified certificate are refused.
+	ctx, cancel = context.WithCancel(context.Background())
+	taskID, unregister = registerAbortableRestore(cancel)
+	defer unregister()
+	req := httptest.NewRequest(http.MethodPost, restoreAbortPath+"?task-id="+taskID, nil)
+	req.RemoteAddr = "192.0.2.1:4000"
+	rec := httptest.NewRecorder()
+	handleAbortRestore(rec, req)
+	c.Assert(rec.Code, Equals, http.StatusForbidden)
+	c.Assert(ctx.Err(), IsNil)
+}
+
+func (s *testRestoreSuite) TestRegionGuardrail(c *C) {
+	// 3 stores and 3 replicas, (100 + 50) regions per store after splitting.
+	judge := func(guardrail string, maxRegionsPerStore uint64) error {
+		cfg := &RestoreCommonConfig{RegionGuardrail: guardrail, MaxRegionsPerStore: maxRegionsPerStore}
+		return judgeRegionGuardrail(cfg, 100, 50, 3, 3)
+	}
+	for _, guardrail := range []string{regionGuardrailWarn, regionGuardrailAbort} {
+		c.Assert(judge(guardrail, 200), IsNil)
+		c.Assert(judge(guardrail, 150), IsNil)
+	}
+	err := judge(regionGuardrailAbort, 149)
+	c.Assert(berrors.Is(err, berrors.ErrRestoreTooManyRegions), IsTrue)
+	c.Assert(err, ErrorMatches, ".*about 150 regions, exceeding --max-regions-per-store 149.*")
+	// The warn guardrail only warns.
+	c.Assert(judge(regionGuardrailWarn, 149), IsNil)
+
+	// Zero --max-regions-per-store disables the check without reaching PD.
+	ctx := context.Background()
+	cfg := &RestoreCommonConfig{RegionGuardrail: regionGuardrailAbort}
+	c.Assert(checkRegionGuardrail(ctx, nil, cfg, 1000000), IsNil)
+	cfg.MaxRegionsPerStore = 1
+	c.Assert(checkRegionGuardrail(ctx, nil, cfg, 0), IsNil)
+}
+
+func (s *testRestoreSuite) TestAutoRateLimitBeforeInit(c *C) {
+	load := func(context.Context) (map[uint64]float64, error) {
+		return map[uint64]float64{1: 0}, nil
+	}
+	// The limits can't be set before the backupmeta is loaded, tuning fails
+	// on the store rather than panicking.
+	limiter := newAutoRateLimiter(load, &restore.Client{})
+	c.Assert(limiter.Tune(context.Background()), IsNil)
+	c.Assert(limiter.RateLimit(1), Equals, uint64(0))
+
+	client := &restore.Client{}
+	err := client.SetStoreDownloadSpeedLimit(context.Background(), 1, 1)
+	c.Assert(berrors.Is(err, berrors.ErrRestoreNotInitialized), IsTrue)
+}
+
+func (s *testRestoreSuite) TestPointRestoreTSRange(c *C) {
+	startTS, endTS, err := pointRestoreTSRange(100, 200, 300)
+	c.Assert(err, IsNil)
+	c.Assert(startTS, Equals, uint64(101))
+	c.Assert(endTS, Equals, uint64(200))
+
+	// Restore to the resolved ts by default.
+	startTS, endTS, err = pointRestoreTSRange(100, 0, 300)
+	c.Assert(err, IsNil)
+	c.Assert(startTS, Equals, uint64(101))
+	c.Assert(endTS, Equals, uint64(300))
+
+	// Nothing to replay at the snapshot.
+	startTS, endTS, err = pointRestoreTSRange(100, 100, 300)
+	c.Assert(err, IsNil)
+	c.Assert(startTS > endTS, IsTrue)
+
+	_, _, err = pointRestoreTSRange(100, 50, 300)
+	c.Assert(err, ErrorMatches, ".*less than the backup ts.*")
+	_, _, err = pointRestoreTSRange(100, 400, 300)
+	c.Assert(err, ErrorMatches, ".*greater than the resolved ts.*")
+}
+
+func (s *testRestoreSuite) TestReadLogResolvedTS(c *C) {
+	ctx := context.Background()
+	st, err := storage.NewLocalStorage(c.MkDir())
+	c.Assert(err, IsNil)
+	c.Assert(st.WriteFile(ctx, "log.meta", []byte(`{"global_resolved_ts":300}`)), IsNil)
+	resolvedTS, isStream, err := readLogResolvedTS(ctx, st)
+	c.Assert(err, IsNil)
+	c.Assert(isStream, IsFalse)
+	c.Assert(resolvedTS, Equals, uint64(300))
+
+	// The running log backup task of br stream is resolved by the metadata of
+	// the stores.
+	st, err = storage.NewLocalStorage(c.MkDir())
+	c.Assert(err, IsNil)
+	c.Assert(stream.SaveMeta(ctx, st, &stream.Meta{}), IsNil)
+	for i, meta := range []*backuppb.Metadata{
+		{StoreId: 1, ResolvedTs: 500},
+		{StoreId: 1, ResolvedTs: 600},
+		{StoreId: 2, ResolvedTs: 550},
+	} {
+		data, err := proto.Marshal(meta)
+		c.Assert(err, IsNil)
+		c.Assert(st.WriteFile(ctx, fmt.Sprintf("%s/%d.meta", stream.MetadataDir, i), data), IsNil)
+	}
+	resolvedTS, isStream, err = readLogResolvedTS(ctx, st)
+	c.Assert(err, IsNil)
+	c.Assert(isStream, IsTrue)
+	c.Assert(resolvedTS, Equals, uint64(550))
+
+	// The stopped task records its checkpoint.
+	c.Assert(stream.SaveMeta(ctx, st, &stream.Meta{CheckpointTS: 400, Stopped: true}), IsNil)
+	resolvedTS, isStream, err = readLogResolvedTS(ctx, st)
+	c.Assert(err, IsNil)
+	c.Assert(isStream, IsTrue)
+	c.Assert(resolvedTS, Equals, uint64(400))
+}
+
+func (s *testRestoreSuite) TestPointRestoreProgress(c *C) {
+	snapshotSteps, logSteps := splitProgressSteps(300, 100)
+	c.Assert(snapshotSteps, Equals, int64(restore.BytesProgressSteps*3/4))
+	c.Assert(logSteps, Equals, int64(restore.BytesProgressSteps/4))
+	snapshotSteps, logSteps = splitProgressSteps(0, 0)
+	c.Assert(snapshotSteps+logSteps, Equals, int64(restore.BytesProgressSteps))
+
+	task := &countProgress{}
+	// The snapshot phase reports 4 steps of its own.
+	snapshot := phaseGlue{progress: task, weight: snapshotSteps}.StartProgress(context.Background(), "", 4, false)
+	snapshot.Inc()
+	c.Assert(task.count, Equals, snapshotSteps/4)
+	for i := 0; i < 5; i++ {
+		snapshot.Inc()
+	}
+	c.Assert(task.count, Equals, snapshotSteps)
+	snapshot.Close()
+	c.Assert(task.count, Equals, snapshotSteps)
+
+	// The log phase is driven by bytes, and completes its steps on close.
+	logProgress := newPhaseProgress(task, logSteps, restore.BytesProgressSteps)
+	restore.NewBytesProgress(logProgress, 1000).Add(500)
+	c.Assert(task.count, Equals, snapshotSteps+logSteps/2)
+	logProgress.Close()
+	c.Assert(task.count, Equals, int64(restore.BytesProgressSteps))
+}
+
+func (s *testRestoreSuite) TestCheckRawKeyspace(c *C) {
+	// The backup of a keyspace records the range of the user keys.
+	backupCfg := &RawKvConfig{Keyspace: "1"}
+	backupCfg.StartKey, backupCfg.EndKey = utils.KeyspaceRange(1, []byte("a"), nil)
+	meta, err := backupCfg.keyspaceMeta()
+	c.Assert(err, IsNil)
+	c.Assert(meta, DeepEquals, &backup.KeyspaceMeta{ID: 1, StartKey: []byte("a")})
+
+	// The backups of no keyspace are restored as before.
+	cfg := &RestoreRawConfig{}
+	c.Assert(checkRawKeyspace(nil, cfg), IsNil)
+	c.Assert(cfg.Keyspace, Equals, "")
+
+	// The keyspace of the backup is restored by default.
+	c.Assert(checkRawKeyspace(meta, cfg), IsNil)
+	c.Assert(cfg.Keyspace, Equals, "1")
+	c.Assert(cfg.StartKey, DeepEquals, backupCfg.StartKey)
+	c.Assert(cfg.EndKey, DeepEquals, backupCfg.EndKey)
+
+	// The range is restored as set.
+	cfg = &RestoreRawConfig{}
+	cfg.StartKey = []byte("x")
+	c.Assert(checkRawKeyspace(meta, cfg), IsNil)
+	c.Assert(cfg.Keyspace, Equals, "")
+	c.Assert(cfg.StartKey, DeepEquals, []byte("x"))
+
+	cfg = &RestoreRawConfig{}
+	cfg.Keyspace = "1"
+	c.Assert(checkRawKeyspace(meta, cfg), IsNil)
+	cfg.Keyspace = "2"
+	err = checkRawKeyspace(meta, cfg)
+	c.Assert(berrors.Is(err, berrors.ErrInvalidArgument), IsTrue)
+	c.Assert(err, ErrorMatches, ".*keyspace 1, it can't be restored into keyspace 2.*")
+}
+
+func (s *testRestoreSuite) TestMapTableIDs(c *C) {
+	partitions := func(defs ...model.PartitionDefinition) *model.PartitionInfo {
+		return &model.PartitionInfo{Definitions: defs}
+	}
+	oldTable := &model.TableInfo{ID: 1, Partition: partitions(
+		model.PartitionDefinition{ID: 2, Name: model.NewCIStr("p0")},
+		model.PartitionDefinition{ID: 3, Name: model.NewCIStr("p1")},
+	)}
+	newTable := &model.TableInfo{ID: 11, Partition: partitions(
+		model.PartitionDefinition{ID: 13, Name: model.NewCIStr("P1")},
+		model.PartitionDefinition{ID: 12, Name: model.NewCIStr("p0")},
+	)}
+	ids := make(map[int64]int64)
+	mapTableIDs(ids, oldTable, newTable)
+	mapTableIDs(ids, &model.TableInfo{ID: 4}, &model.TableInfo{ID: 14})
+	c.Assert(ids, DeepEquals, map[int64]int64{1: 11, 2: 12, 3: 13, 4: 14})
+}
+
+func (s *testRestoreSuite) TestMergeRawArchiveFiles(c *C) {
+	newFile := func(name, start, end string) *backuppb.File {
+		return &backuppb.File{Name: name, StartKey: []byte(start), EndKey: []byte(end)}
+	}
+	archives := []*rawArchive{
+		{
+			name:  "a1",
+			meta:  &backuppb.BackupMeta{EndVersion: 10},
+			files: []*backuppb.File{newFile("a1-1", "a", "c"), newFile("a1-2", "e", "f")},
+		},
+		{
+			name:  "a2",
+			meta:  &backuppb.BackupMeta{EndVersion: 20},
+			files: []*backuppb.File{newFile("a2-1", "a", "d")},
+		},
+	}
+	c.Assert(mergeRawArchiveFiles(archives, restore.OverlapPolicyFail), ErrorMatches, ".*archive a1 overlaps.*")
+	c.Assert(mergeRawArchiveFiles(archives, restore.OverlapPolicyNewestWins), IsNil)
+	c.Assert(archives[0].files, DeepEquals, []*backuppb.File{newFile("a1-2", "e", "f")})
+	c.Assert(archives[1].files, DeepEquals, []*backuppb.File{newFile("a2-1", "a", "d")})
+}
+
+func (s *testRestoreSuite) TestBatchRawFilesBySize(c *C) {
+	newFile := func(name, start, end string, size uint64) *backuppb.File {
+		return &backuppb.File{Name: name, StartKey: []byte(start), EndKey: []byte(end), Size_: size}
+	}
+	names := func(batches [][]*backuppb.File) [][]string {
+		result := make([][]string, 0, len(batches))
+		for _, batch := range batches {
+			batchNames := make([]string, 0, len(batch))
+			for _, f := range batch {
+				batchNames = append(batchNames, f.Name)
+			}
+			result = append(result, batchNames)
+		}
+		return result
+	}
+	c.Assert(batchRawFilesBySize(nil, 10), IsNil)
+
+	files := []*backuppb.File{
+		newFile("e", "e", "f", 4),
+		newFile("a-write", "a", "b", 6),
+		newFile("c", "c", "d", 10),
+		newFile("a-default", "a", "b", 6),
+		newFile("d", "d", "", 1),
+		newFile("x", "x", "z", 1),
+	}
+	// The files of the same range stay together, so do the files after the
+	// file reaching the end of the key space.
+	c.Assert(names(batchRawFilesBySize(files, 10)), DeepEquals, [][]string{
+		{"a-write", "a-default"}, {"c"}, {"d", "e", "x"},
+	})
+	c.Assert(names(batchRawFilesBySize(files[1:3], 100)), DeepEquals, [][]string{{"a-write", "c"}})
+}
+
+type countProgress struct {
+	count int64
+}
+
+func (p *countProgress) Inc() {
+	p.count++
+}
+
+func (p *countProgress) Close() {}
@@ -0,0 +1,282 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package task
+
+import (
+	"context"
+	"math"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/log"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/tikv/client-go/v2/oracle"
+	pd "github.com/tikv/pd/client"
+	"go.uber.org/zap"
+
+	berrors "github.com/pingcap/br/pkg/errors"
+	"github.com/pingcap/br/pkg/pdutil"
+	"github.com/pingcap/br/pkg/storage"
+	"github.com/pingcap/br/pkg/stream"
+	"github.com/pingcap/br/pkg/utils"
+	"github.com/pingcap/br/pkg/version"
+)
+
+const flagTaskName = "task-name"
+
+// StreamConfig is the configuration specific for log backup tasks.
+type StreamConfig struct {
+	Config
+
+	TaskName string `json:"task-name" toml:"task-name"`
+	// StartTS and EndTS are only used when starting the task.
+	StartTS uint64 `json:"start-ts" toml:"start-ts"`
+	EndTS   uint64 `json:"end-ts" toml:"end-ts"`
+	// FilterStr are the rules of --filter recorded into the task.
+	FilterStr []string `json:"filter-str" toml:"filter-str"`
+}
+
+// DefineStreamTaskNameFlag defines the flag of the name of the log backup
+// task.
+func DefineStreamTaskNameFlag(command *cobra.Command, required bool) { // revive:disable-line:flag-parameter
+	command.Flags().String(flagTaskName, "", "the name of the log backup task")
+	if required {
+		_ = command.MarkFlagRequired(flagTaskName)
+	}
+}
+
+// DefineStreamStartFlags defines the flags for starting a log backup task.
+func DefineStreamStartFlags(command *cobra.Command) {
+	DefineStreamTaskNameFlag(command, true)
+	command.Flags().String(flagStartTS, "",
+		"the TSO or datetime to back up the changes since, the current TSO if not set. "+
+			"Support TSO or datetime, e.g. '400036290571534337' or '2018-05-11 01:42:23'")
+	command.Flags().String(flagEndTS, "",
+		"the TSO or datetime to stop backing up the changes at, the task runs until it's stopped if not set")
+}
+
+// ParseFromFlags parses the log backup flags from the flag set.
+func (cfg *StreamConfig) ParseFromFlags(flags *pflag.FlagSet) error {
+	var err error
+	if cfg.TaskName, err = flags.GetString(flagTaskName); err != nil {
+		return errors.Trace(err)
+	}
+	if flags.Lookup(flagStartTS) != nil {
+		startTS, err := flags.GetString(flagStartTS)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if cfg.StartTS, err = parseTSString(startTS); err != nil {
+			return errors.Trace(err)
+		}
+		endTS, err := flags.GetString(flagEndTS)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if cfg.EndTS, err = parseTSString(endTS); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	if flags.Lookup(flagFilter) != nil {
+		if cfg.FilterStr, err = flags.GetStringArray(flagFilter); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return errors.Trace(cfg.Config.ParseFromFlags(flags))
+}
+
+// holdStreamSafePoint sets the service GC safepoint of the task to the ts,
+// so the changes since it, which the stores haven't backed up, aren't garbage
+// collected. The safepoint never expires, it's held until the task stops.
+func holdStreamSafePoint(ctx context.Context, pdClient pd.Client, name string, ts uint64) error {
+	_, err := pdClient.UpdateServiceGCSafePoint(ctx, stream.ServiceSafePointID(name), math.MaxInt64, ts-1)
+	return errors.Annotatef(err, "failed to hold the GC safepoint of log backup task %s", name)
+}
+
+// releaseStreamSafePoint removes the service GC safepoint of the task.
+func releaseStreamSafePoint(ctx context.Context, pdClient pd.Client, name string) error {
+	_, err := pdClient.UpdateServiceGCSafePoint(ctx, stream.ServiceSafePointID(name), 0, 0)
+	return errors.Annotatef(err, "failed to release the GC safepoint of log backup task %s", name)
+}
+
+// newStreamClient connects to the etcd embedded in PD to manage the log
+// backup tasks. The returned function closes the connection.
+func newStreamClient(ctx context.Context, cfg *Config) (*stream.MetaDataClient, func(), error) {
+	cli, err := newPDEtcdClient(ctx, cfg)
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+	return stream.NewMetaDataClient(cli), func() {
+		if err := cli.Close(); err != nil {
+			log.Warn("failed to close the connection of the log backup tasks", zap.Error(err))
+		}
+	}, nil
+}
+
+// RunStreamStart registers a log backup task, the stores start backing up
+// the changes since its start ts into its storage. It requires all the TiKV
+// stores run the log backup tasks, and holds a service GC safepoint at the
+// start ts until the task stops.
+func RunStreamStart(ctx context.Context, cfg *StreamConfig) (*stream.TaskInfo, error) {
+	u, s, err := GetStorage(ctx, &cfg.Config)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	exists, err := s.FileExists(ctx, stream.MetaFile)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if exists {
+		return nil, errors.Annotatef(berrors.ErrInvalidArgument,
+			"the storage already contains a log backup task, found %s", stream.MetaFile)
+	}
+
+	pdClient, err := pdutil.NewPDClient(ctx, cfg.PD, cfg.TLS.ForPD().ToPDSecurityOption())
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer pdClient.Close()
+	if err = version.CheckClusterVersion(ctx, pdClient, version.CheckVersionForLogBackup); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if cfg.StartTS == 0 {
+		physical, logical, err := pdClient.GetTS(ctx)
+		if err != nil {
+			return nil, errors.Annotate(err, "failed to get ts from pd")
+		}
+		cfg.StartTS = oracle.ComposeTS(physical, logical)
+	}
+	// The stores scan the changes since the start ts at first.
+	if err = utils.CheckGCSafePoint(ctx, pdClient, cfg.StartTS); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	info := stream.NewTaskInfo(cfg.TaskName, u, cfg.StartTS, cfg.EndTS)
+	info.TableFilter = cfg.FilterStr
+	cli, closeCli, err := newStreamClient(ctx, &cfg.Config)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer closeCli()
+	if err = holdStreamSafePoint(ctx, pdClient, info.Name, info.StartTs); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if err = cli.PutTask(ctx, &info); err != nil {
+		if err1 := releaseStreamSafePoint(ctx, pdClient, info.Name); err1 != nil {
+			log.Warn("failed to release the GC safepoint", zap.String("task", info.Name), zap.Error(err1))
+		}
+		return nil, errors.Trace(err)
+	}
+	if err = stream.SaveMeta(ctx, s, &stream.Meta{Info: info}); err != nil {
+		if err1 := cli.DeleteTask(ctx, info.Name); err1 != nil {
+			log.Warn("failed to remove the log backup task", zap.String("task", info.Name), zap.Error(err1))
+		}
+		if err1 := releaseStreamSafePoint(ctx, pdClient, info.Name); err1 != nil {
+			log.Warn("failed to release the GC safepoint", zap.String("task", info.Name), zap.Error(err1))
+		}
+		return nil, errors.Trace(err)
+	}
+	log.Info("log backup task started", zap.String("task", info.Name), zap.Uint64("start-ts", info.StartTs))
+	return &info, nil
+}
+
+// RunStreamPause pauses the log backup task.
+func RunStreamPause(ctx context.Context, cfg *StreamConfig) error {
+	cli, closeCli, err := newStreamClient(ctx, &cfg.Config)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer closeCli()
+	return errors.Trace(cli.PauseTask(ctx, cfg.TaskName))
+}
+
+// RunStreamResume resumes the paused log backup task.
+func RunStreamResume(ctx context.Context, cfg *StreamConfig) error {
+	cli, closeCli, err := newStreamClient(ctx, &cfg.Config)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer closeCli()
+	status, err := cli.GetTaskStatus(ctx, cfg.TaskName)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	// The changes since the checkpoint must not be garbage collected.
+	pdClient, err := pdutil.NewPDClient(ctx, cfg.PD, cfg.TLS.ForPD().ToPDSecurityOption())
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer pdClient.Close()
+	if err = version.CheckClusterVersion(ctx, pdClient, version.CheckVersionForLogBackup); err != nil {
+		return errors.Trace(err)
+	}
+	checkpoint := status.GlobalCheckpoint()
+	if err = utils.CheckGCSafePoint(ctx, pdClient, checkpoint); err != nil {
+		return errors.Trace(err)
+	}
+	// The changes before the checkpoint are backed up, so the safepoint held
+	// since the start is advanced to it.
+	if err = holdStreamSafePoint(ctx, pdClient, cfg.TaskName, checkpoint); err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(cli.ResumeTask(ctx, cfg.TaskName))
+}
+
+// RunStreamStop removes the log backup task, and records the TS its log
+// files cover up to into its storage.
+func RunStreamStop(ctx context.Context, cfg *StreamConfig) (*stream.TaskStatus, error) {
+	cli, closeCli, err := newStreamClient(ctx, &cfg.Config)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer closeCli()
+	status, err := cli.GetTaskStatus(ctx, cfg.TaskName)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	opts, err := storageOpts(&cfg.Config)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	s, err := storage.New(ctx, status.Info.Storage, opts)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	meta := &stream.Meta{Info: status.Info, CheckpointTS: status.GlobalCheckpoint(), Stopped: true}
+	if err = stream.SaveMeta(ctx, s, meta); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if err = cli.DeleteTask(ctx, cfg.TaskName); err != nil {
+		return nil, errors.Trace(err)
+	}
+	pdClient, err := pdutil.NewPDClient(ctx, cfg.PD, cfg.TLS.ForPD().ToPDSecurityOption())
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer pdClient.Close()
+	if err = releaseStreamSafePoint(ctx, pdClient, cfg.TaskName); err != nil {
+		return nil, errors.Trace(err)
+	}
+	log.Info("log backup task stopped", zap.String("task", cfg.TaskName),
+		zap.Uint64("checkpoint-ts", meta.CheckpointTS))
+	return status, nil
+}
+
+// RunStreamStatus returns the status of the log backup task, or of all the
+// tasks if the name isn't set.
+func RunStreamStatus(ctx context.Context, cfg *StreamConfig) ([]*stream.TaskStatus, error) {
+	cli, closeCli, err := newStreamClient(ctx, &cfg.Config)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer closeCli()
+	if len(cfg.TaskName) == 0 {
+		statuses, err := cli.GetAllTaskStatus(ctx)
+		return statuses, errors.Trace(err)
+	}
+	status, err := cli.GetTaskStatus(ctx, cfg.TaskName)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return []*stream.TaskStatus{status}, nil
+}
@@ -0,0 +1,68 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package task
+
+import (
+	"context"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+
+	berrors "github.com/pingcap/br/pkg/errors"
+	"github.com/pingcap/br/pkg/glue"
+	"github.com/pingcap/br/pkg/metautil"
+	"github.com/pingcap/br/pkg/summary"
+)
+
+// RunValidateChecksum reads every data file of the backup in the storage and
+// verifies it against the backupmeta, without accessing the cluster. It
+// fails if any file is missing or corrupted.
+func RunValidateChecksum(c context.Context, g glue.Glue, cmdName string, cfg *Config) error {
+	ctx, cancel := context.WithCancel(c)
+	defer cancel()
+	defer summary.Summary(cmdName)
+
+	_, s, backupMeta, err := ReadBackupMeta(ctx, metautil.MetaFile, cfg)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if marker, err := metautil.CheckFinishMarker(ctx, s); err != nil {
+		log.Warn("the backup may be incomplete, verify the files in the backupmeta anyway", zap.Error(err))
+	} else {
+		log.Info("the backup is complete", zap.Int("file-count", marker.FileCount))
+	}
+
+	files, err := metautil.NewMetaReader(backupMeta, s).ReadDataFiles(ctx)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	updateCh := g.StartProgress(ctx, cmdName, int64(len(files)), !cfg.LogProgress)
+	report, err := metautil.VerifyDataFiles(ctx, s, files, backupMeta.IsRawKv, uint(cfg.Concurrency), updateCh.Inc)
+	updateCh.Close()
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	summary.CollectInt("verified files", report.Verified)
+	summary.CollectInt("missing files", len(report.Missing))
+	summary.CollectInt("corrupted files", len(report.Corrupted))
+	if len(report.ChecksumOnly) > 0 {
+		summary.CollectInt("files verified by size and sha256 only", len(report.ChecksumOnly))
+		log.Warn("some data files cannot be decoded, only their sizes and sha256 are verified",
+			zap.Strings("files", report.ChecksumOnly))
+	}
+	if !report.OK() {
+		for _, name := range report.Missing {
+			log.Error("missing data file", zap.String("file", name))
+		}
+		for _, f := range report.Corrupted {
+			log.Error("corrupted data file", zap.String("file", f.Name), zap.String("reason", f.Reason))
+		}
+		return errors.Annotatef(berrors.ErrBackupChecksumMismatch,
+			"%d files are missing and %d files are corrupted in %d files",
+			len(report.Missing), len(report.Corrupted), len(files))
+	}
+	summary.SetSuccessStatus(true)
+	return nil
+}
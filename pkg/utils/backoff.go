@@ -0,0 +1,295 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package utils
+
+import (
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/pingcap/errors"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	berrors "github.com/pingcap/br/pkg/errors"
+)
+
+// pdLeaderChangedErrorIDs are the codes of the errors returned by the PD
+// client while the PD leader is being transferred.
+var pdLeaderChangedErrorIDs = map[errors.ErrorID]struct{}{
+	"PD:client:ErrClientGetLeader":   {},
+	berrors.ErrPDLeaderNotFound.ID(): {},
+}
+
+// ErrorClassifier decides whether an operation failed with the error is worth
+// retrying.
+type ErrorClassifier func(err error) bool
+
+// RetryAllErrors is an ErrorClassifier retrying every error.
+func RetryAllErrors(error) bool {
+	return true
+}
+
+// IsRetryableError is an ErrorClassifier retrying the transient errors of the
+// network, the external storage and gRPC, which are likely to go away in the
+// next attempt.
+func IsRetryableError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if MessageIsRetryableStorageError(err.Error()) {
+		return true
+	}
+	switch status.Code(errors.Cause(err)) {
+	case codes.Unavailable, codes.Aborted, codes.DeadlineExceeded, codes.ResourceExhausted:
+		return true
+	default:
+		return false
+	}
+}
+
+// IsPDLeaderChangedError is an ErrorClassifier retrying the errors caused by
+// the transfer of the PD leader, e.g. during a rolling upgrade of PD. The PD
+// client reconnects to the new leader in background, so the request is likely
+// to succeed after a while. The PD servers refuse the gRPC requests with
+// Unavailable until the new leader is elected.
+func IsPDLeaderChangedError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if status.Code(errors.Cause(err)) == codes.Unavailable {
+		return true
+	}
+	found := errors.Find(err, func(e error) bool {
+		normalized, ok := e.(*errors.Error)
+		if !ok {
+			return false
+		}
+		_, ok = pdLeaderChangedErrorIDs[normalized.ID()]
+		return ok
+	})
+	return found != nil
+}
+
+// ExponentialBackoffer is a Backoffer regulating a truncated exponential
+// backoff. The delay doubles on each retryable error until it reaches the max
+// delay, and the retrying stops at once on an error which isn't retryable.
+//
+// It's not safe for concurrent use, create one for each operation.
+type ExponentialBackoffer struct {
+	attempt   int
+	delay     time.Duration
+	maxDelay  time.Duration
+	jitter    float64
+	retryable ErrorClassifier
+}
+
+// NewExponentialBackoffer creates an ExponentialBackoffer which attempts the
+// operation at most `attempt` times and retries all errors.
+func NewExponentialBackoffer(attempt int, delay, maxDelay time.Duration) *ExponentialBackoffer {
+	return &ExponentialBackoffer{
+		attempt:   attempt,
+		delay:     delay,
+		maxDelay:  maxDelay,
+		retryable: RetryAllErrors,
+	}
+}
+
+// WithJitter makes the backoffer shorten each delay by a random fraction up
+// to `jitter`, which is in [0, 1], so the concurrent operations failed at the
+// same time don't retry at the same time.
+func (bo *ExponentialBackoffer) WithJitter(jitter float64) *ExponentialBackoffer {
+	switch {
+	case jitter < 0:
+		jitter = 0
+	case jitter > 1:
+		jitter = 1
+	}
+	bo.jitter = jitter
+	return bo
+}
+
+// WithClassifier makes the backoffer retry only the errors the classifier
+// accepts.
+func (bo *ExponentialBackoffer) WithClassifier(retryable ErrorClassifier) *ExponentialBackoffer {
+	bo.retryable = retryable
+	return bo
+}
+
+// NextBackoff implements Backoffer.
+func (bo *ExponentialBackoffer) NextBackoff(err error) time.Duration {
+	if !bo.retryable(err) {
+		bo.attempt = 0
+		return 0
+	}
+	bo.attempt--
+	bo.delay = 2 * bo.delay
+	if bo.delay > bo.maxDelay {
+		bo.delay = bo.maxDelay
+	}
+	delay := bo.delay
+	if bo.jitter > 0 {
+		delay -= time.Duration(rand.Float64() * bo.jitter * float64(delay)) //nolint:gosec
+	}
+	return delay
+}
+
+// Attempt implements Backoffer.
+func (bo *ExponentialBackoffer) Attempt() int {
+	return bo.attempt
+}
+
+// constantBackoffer is a Backoffer waiting the same delay between the
+// attempts.
+type constantBackoffer struct {
+	attempt int
+	delay   time.Duration
+}
+
+// NextBackoff implements Backoffer.
+func (bo *constantBackoffer) NextBackoff(error) time.Duration {
+	bo.attempt--
+	return bo.delay
+}
+
+// Attempt implements Backoffer.
+func (bo *constantBackoffer) Attempt() int {
+	return bo.attempt
+}
+
+// budgetBackoffer is a Backoffer giving up once the total delay exceeds the
+// budget, however many attempts are left.
+type budgetBackoffer struct {
+	Backoffer
+	budget time.Duration
+}
+
+// NextBackoff implements Backoffer.
+func (bo *budgetBackoffer) NextBackoff(err error) time.Duration {
+	delay := bo.Backoffer.NextBackoff(err)
+	if delay > bo.budget {
+		bo.budget = 0
+		return 0
+	}
+	bo.budget -= delay
+	return delay
+}
+
+// Attempt implements Backoffer.
+func (bo *budgetBackoffer) Attempt() int {
+	if bo.budget <= 0 {
+		return 0
+	}
+	return bo.Backoffer.Attempt()
+}
+
+// The names of the backoff policies, see ParseBackoffPolicy.
+const (
+	BackoffPolicyExponential = "exponential"
+	BackoffPolicyConstant    = "constant"
+	BackoffPolicyBudget      = "budget"
+
+	// defaultBackoffJitter is the jitter of the exponential backoff policy.
+	defaultBackoffJitter = 0.5
+)
+
+// BackoffPolicy creates the Backoffers of the retried operations, so the
+// retrying strategy is chosen by the user instead of hard-coded by the
+// operations, which only give their attempts and delays.
+type BackoffPolicy interface {
+	// NewBackoffer returns a Backoffer attempting at most `attempt` times,
+	// the delay grows from `delay` up to `maxDelay` if the policy grows it.
+	NewBackoffer(attempt int, delay, maxDelay time.Duration) Backoffer
+	// String returns the policy in the form parsed by ParseBackoffPolicy.
+	String() string
+}
+
+// ExponentialBackoffPolicy creates the ExponentialBackoffers with the jitter.
+type ExponentialBackoffPolicy struct {
+	Jitter float64
+}
+
+// NewBackoffer implements BackoffPolicy.
+func (p ExponentialBackoffPolicy) NewBackoffer(attempt int, delay, maxDelay time.Duration) Backoffer {
+	return NewExponentialBackoffer(attempt, delay, maxDelay).WithJitter(p.Jitter)
+}
+
+// String implements BackoffPolicy.
+func (p ExponentialBackoffPolicy) String() string {
+	if p.Jitter > 0 {
+		return BackoffPolicyExponential + "-jitter"
+	}
+	return BackoffPolicyExponential
+}
+
+// ConstantBackoffPolicy creates the Backoffers waiting the base delay between
+// the attempts, which suits the operations failing for a fixed while, e.g. the
+// regions waiting for the next heartbeat.
+type ConstantBackoffPolicy struct{}
+
+// NewBackoffer implements BackoffPolicy.
+func (ConstantBackoffPolicy) NewBackoffer(attempt int, delay, _ time.Duration) Backoffer {
+	return &constantBackoffer{attempt: attempt, delay: delay}
+}
+
+// String implements BackoffPolicy.
+func (ConstantBackoffPolicy) String() string {
+	return BackoffPolicyConstant
+}
+
+// BudgetBackoffPolicy creates the exponential Backoffers with jitter which
+// give up once the total delay of an operation exceeds the budget, so the
+// worst-case time of each operation is bounded.
+type BudgetBackoffPolicy struct {
+	Budget time.Duration
+}
+
+// NewBackoffer implements BackoffPolicy.
+func (p BudgetBackoffPolicy) NewBackoffer(attempt int, delay, maxDelay time.Duration) Backoffer {
+	return &budgetBackoffer{
+		Backoffer: ExponentialBackoffPolicy{Jitter: defaultBackoffJitter}.NewBackoffer(attempt, delay, maxDelay),
+		budget:    p.Budget,
+	}
+}
+
+// String implements BackoffPolicy.
+func (p BudgetBackoffPolicy) String() string {
+	return BackoffPolicyBudget + ":" + p.Budget.String()
+}
+
+// DefaultBackoffPolicy is the exponential backoff policy without jitter,
+// which is the behavior of the operations before the policy is configurable.
+var DefaultBackoffPolicy BackoffPolicy = ExponentialBackoffPolicy{}
+
+// ParseBackoffPolicy parses the backoff policy, one of
+//
+//   - exponential: the delay doubles on each attempt up to the max delay,
+//   - exponential-jitter: like exponential, each delay is shortened by a random
+//     fraction up to a half,
+//   - constant: the delay stays the base delay,
+//   - budget:<duration>: like exponential-jitter, and gives up once the total
+//     delay exceeds the duration.
+func ParseBackoffPolicy(s string) (BackoffPolicy, error) {
+	name, arg := s, ""
+	if i := strings.IndexByte(s, ':'); i >= 0 {
+		name, arg = s[:i], s[i+1:]
+	}
+	switch strings.ToLower(name) {
+	case BackoffPolicyExponential:
+		return ExponentialBackoffPolicy{}, nil
+	case BackoffPolicyExponential + "-jitter":
+		return ExponentialBackoffPolicy{Jitter: defaultBackoffJitter}, nil
+	case BackoffPolicyConstant:
+		return ConstantBackoffPolicy{}, nil
+	case BackoffPolicyBudget:
+		budget, err := time.ParseDuration(arg)
+		if err != nil || budget <= 0 {
+			return nil, errors.Annotatef(berrors.ErrInvalidArgument,
+				"invalid budget of backoff policy '%s', a positive duration like budget:30s is expected", s)
+		}
+		return BudgetBackoffPolicy{Budget: budget}, nil
+	default:
+		return nil, errors.Annotatef(berrors.ErrInvalidArgument,
+			"unknown backoff policy '%s', one of exponential, exponential-jitter, constant and budget:<duration>", s)
+	}
+}
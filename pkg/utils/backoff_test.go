@@ -0,0 +1,115 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package utils
+
+import (
+	"context"
+	"time"
+
+	. "github.com/pingcap/check"
+	"github.com/pingcap/errors"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type testBackoffSuite struct{}
+
+var _ = Suite(&testBackoffSuite{})
+
+func (*testBackoffSuite) TestExponentialBackoffer(c *C) {
+	bo := NewExponentialBackoffer(4, 10*time.Millisecond, 30*time.Millisecond)
+	err := errors.New("any error")
+	c.Assert(bo.NextBackoff(err), Equals, 20*time.Millisecond)
+	c.Assert(bo.NextBackoff(err), Equals, 30*time.Millisecond)
+	c.Assert(bo.NextBackoff(err), Equals, 30*time.Millisecond)
+	c.Assert(bo.Attempt(), Equals, 1)
+
+	bo = NewExponentialBackoffer(4, 10*time.Millisecond, time.Second).WithJitter(0.5)
+	for i := 0; i < 3; i++ {
+		delay := bo.NextBackoff(err)
+		upper := (20 * time.Millisecond) << i
+		c.Assert(delay <= upper && delay >= upper/2, IsTrue, Commentf("delay %s", delay))
+	}
+
+	bo = NewExponentialBackoffer(4, time.Nanosecond, time.Nanosecond).WithClassifier(IsRetryableError)
+	c.Assert(bo.NextBackoff(status.Error(codes.Unavailable, "transport is closing")), Equals, time.Nanosecond)
+	c.Assert(bo.NextBackoff(errors.Trace(status.Error(codes.Aborted, "aborted"))), Equals, time.Nanosecond)
+	c.Assert(bo.Attempt(), Equals, 2)
+	c.Assert(bo.NextBackoff(status.Error(codes.InvalidArgument, "invalid")), Equals, time.Duration(0))
+	c.Assert(bo.Attempt(), Equals, 0)
+}
+
+func (*testBackoffSuite) TestWithRetry(c *C) {
+	var counter int
+	fatal := status.Error(codes.PermissionDenied, "denied")
+	err := WithRetry(context.Background(), func() error {
+		counter++
+		if counter < 3 {
+			return errors.New("connection refused")
+		}
+		return fatal
+	}, NewExponentialBackoffer(10, time.Nanosecond, time.Nanosecond).WithClassifier(IsRetryableError))
+	c.Assert(counter, Equals, 3)
+	c.Assert(err, ErrorMatches, ".*denied")
+
+	// the last backoff isn't waited for.
+	counter = 0
+	start := time.Now()
+	err = WithRetry(context.Background(), func() error {
+		counter++
+		return errors.New("connection refused")
+	}, NewExponentialBackoffer(1, time.Hour, time.Hour))
+	c.Assert(err, NotNil)
+	c.Assert(counter, Equals, 1)
+	c.Assert(time.Since(start) < time.Minute, IsTrue)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	counter = 0
+	err = WithRetry(ctx, func() error {
+		counter++
+		cancel()
+		return errors.New("connection refused")
+	}, NewExponentialBackoffer(10, time.Hour, time.Hour))
+	c.Assert(err, NotNil)
+	c.Assert(counter, Equals, 1)
+}
+
+func (*testBackoffSuite) TestBackoffPolicy(c *C) {
+	err := errors.New("any error")
+
+	policy, e := ParseBackoffPolicy("exponential")
+	c.Assert(e, IsNil)
+	c.Assert(policy, Equals, DefaultBackoffPolicy)
+	bo := policy.NewBackoffer(3, 10*time.Millisecond, time.Second)
+	c.Assert(bo.NextBackoff(err), Equals, 20*time.Millisecond)
+	c.Assert(bo.NextBackoff(err), Equals, 40*time.Millisecond)
+
+	policy, e = ParseBackoffPolicy("exponential-jitter")
+	c.Assert(e, IsNil)
+	c.Assert(policy.String(), Equals, "exponential-jitter")
+
+	policy, e = ParseBackoffPolicy("constant")
+	c.Assert(e, IsNil)
+	bo = policy.NewBackoffer(3, 10*time.Millisecond, time.Second)
+	c.Assert(bo.NextBackoff(err), Equals, 10*time.Millisecond)
+	c.Assert(bo.NextBackoff(err), Equals, 10*time.Millisecond)
+	c.Assert(bo.Attempt(), Equals, 1)
+
+	// The budget gives up before the attempts run out.
+	policy, e = ParseBackoffPolicy("budget:50ms")
+	c.Assert(e, IsNil)
+	c.Assert(policy.String(), Equals, "budget:50ms")
+	bo = policy.NewBackoffer(100, 10*time.Millisecond, 20*time.Millisecond)
+	total := time.Duration(0)
+	for bo.Attempt() > 0 {
+		total += bo.NextBackoff(err)
+	}
+	c.Assert(total <= 50*time.Millisecond, IsTrue, Commentf("total %s", total))
+	c.Assert(WithRetry(context.Background(), func() error { return err },
+		policy.NewBackoffer(100, time.Millisecond, time.Millisecond)), NotNil)
+
+	_, e = ParseBackoffPolicy("budget")
+	c.Assert(e, ErrorMatches, ".*invalid budget of backoff policy.*")
+	_, e = ParseBackoffPolicy("linear")
+	c.Assert(e, ErrorMatches, ".*unknown backoff policy 'linear'.*")
+}
@@ -0,0 +1,169 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package utils
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/docker/go-units"
+)
+
+const (
+	// rateLimitHeadroom is the share of the measured throughput suggested as
+	// the rate limit, the rest is left to the online workload.
+	rateLimitHeadroom = 0.8
+	// saturatedUtilization is the utilization of the workers above which the
+	// workers are considered the bottleneck.
+	saturatedUtilization = 0.9
+)
+
+// BandwidthSuggestion is the rate limit and concurrency suggested by the
+// throughput measured by BandwidthProbe.
+type BandwidthSuggestion struct {
+	// StorageBytesPerSecond is the throughput of the external storage, i.e.
+	// the size of the SST files.
+	StorageBytesPerSecond float64
+	// KVBytesPerSecond is the throughput of TiKV, i.e. the size of the KV
+	// pairs backed up or restored.
+	KVBytesPerSecond float64
+	// RateLimit is the suggested rate limit of each store in bytes per
+	// second.
+	RateLimit uint64
+	// Concurrency is the suggested number of the concurrent workers.
+	Concurrency uint
+	// Utilization is the average share of the workers busy in the window.
+	Utilization float64
+	// Throttled indicates the throughput reached the rate limit in effect,
+	// so the suggested rate limit is raised to find the real capacity.
+	Throttled bool
+}
+
+// BandwidthProbe measures the throughput achieved in the first window of a
+// task, and suggests the rate limit and the concurrency by it once, or after
+// every window if it's made by Repeat.
+//
+// The rate limit leaves some headroom below the storage throughput of each
+// store. However, the throughput can't exceed the rate limit in effect, so if
+// the throughput reaches it, the rate limit is doubled instead. The average
+// number of the busy workers is the total duration of the
+// observed requests divided by the window (Little's law). If the workers are
+// almost always busy, they are the bottleneck and the concurrency is doubled,
+// otherwise it's reduced to the busy workers with some headroom.
+type BandwidthProbe struct {
+	mu          sync.Mutex
+	window      time.Duration
+	stores      int
+	concurrency uint
+	onSuggest   func(BandwidthSuggestion)
+	now         func() time.Time
+	repeat      bool
+	// rateLimit is the rate limit of each store in effect, zero means
+	// unlimited, see SetRateLimit.
+	rateLimit uint64
+
+	start        time.Time
+	storageBytes uint64
+	kvBytes      uint64
+	busy         time.Duration
+	done         bool
+}
+
+// NewBandwidthProbe creates a BandwidthProbe of the task with the concurrency
+// on the stores, onSuggest is called once the window passes.
+func NewBandwidthProbe(
+	window time.Duration, stores int, concurrency uint, onSuggest func(BandwidthSuggestion),
+) *BandwidthProbe {
+	if stores <= 0 {
+		stores = 1
+	}
+	if concurrency == 0 {
+		concurrency = 1
+	}
+	return &BandwidthProbe{
+		window:      window,
+		stores:      stores,
+		concurrency: concurrency,
+		onSuggest:   onSuggest,
+		now:         time.Now,
+		start:       time.Now(),
+	}
+}
+
+// Repeat makes the probe start a new window after each suggestion, so the
+// suggestions follow the throughput changing during the task.
+func (p *BandwidthProbe) Repeat() *BandwidthProbe {
+	p.repeat = true
+	return p
+}
+
+// SetRateLimit sets the rate limit of each store in effect, zero means
+// unlimited. It should be updated once a suggested rate limit is applied.
+func (p *BandwidthProbe) SetRateLimit(rateLimit uint64) {
+	p.mu.Lock()
+	p.rateLimit = rateLimit
+	p.mu.Unlock()
+}
+
+// Observe records the bytes a worker transferred in the duration, which is
+// either a finished request or the part of a request since it's last
+// observed. The long requests should be observed in parts, otherwise they are
+// counted in the window they finish.
+func (p *BandwidthProbe) Observe(storageBytes, kvBytes uint64, elapsed time.Duration) {
+	p.mu.Lock()
+	if p.done {
+		p.mu.Unlock()
+		return
+	}
+	p.storageBytes += storageBytes
+	p.kvBytes += kvBytes
+	p.busy += elapsed
+	now := p.now()
+	span := now.Sub(p.start)
+	if span < p.window || span <= 0 {
+		p.mu.Unlock()
+		return
+	}
+	suggestion := p.suggest(span)
+	if p.repeat {
+		p.start = now
+		p.storageBytes, p.kvBytes, p.busy = 0, 0, 0
+	} else {
+		p.done = true
+	}
+	p.mu.Unlock()
+	p.onSuggest(suggestion)
+}
+
+func (p *BandwidthProbe) suggest(span time.Duration) BandwidthSuggestion {
+	s := BandwidthSuggestion{
+		StorageBytesPerSecond: float64(p.storageBytes) / span.Seconds(),
+		KVBytesPerSecond:      float64(p.kvBytes) / span.Seconds(),
+	}
+	perStore := s.StorageBytesPerSecond / float64(p.stores)
+	if p.rateLimit > 0 && perStore >= float64(p.rateLimit)*saturatedUtilization {
+		s.Throttled = true
+		s.RateLimit = 2 * p.rateLimit
+	} else {
+		s.RateLimit = uint64(math.Ceil(perStore*rateLimitHeadroom/units.MiB)) * units.MiB
+		if s.RateLimit == 0 {
+			s.RateLimit = units.MiB
+		}
+	}
+
+	busyWorkers := p.busy.Seconds() / span.Seconds()
+	s.Utilization = busyWorkers / float64(p.concurrency)
+	if s.Utilization >= saturatedUtilization {
+		s.Concurrency = 2 * p.concurrency
+	} else {
+		s.Concurrency = uint(math.Ceil(busyWorkers / saturatedUtilization))
+		if s.Concurrency == 0 {
+			s.Concurrency = 1
+		}
+		if s.Concurrency > p.concurrency {
+			s.Concurrency = p.concurrency
+		}
+	}
+	return s
+}
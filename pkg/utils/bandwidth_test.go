@@ -0,0 +1,89 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package utils
+
+import (
+	"time"
+
+	"github.com/docker/go-units"
+	. "github.com/pingcap/check"
+)
+
+type testBandwidthSuite struct{}
+
+var _ = Suite(&testBandwidthSuite{})
+
+func newTestProbe(concurrency uint, suggestions *[]BandwidthSuggestion) (*BandwidthProbe, *time.Time) {
+	now := time.Unix(1000, 0)
+	p := NewBandwidthProbe(time.Minute, 2, concurrency, func(s BandwidthSuggestion) {
+		*suggestions = append(*suggestions, s)
+	})
+	p.now = func() time.Time { return now }
+	p.start = now
+	return p, &now
+}
+
+func (s *testBandwidthSuite) TestSaturatedWorkers(c *C) {
+	var suggestions []BandwidthSuggestion
+	p, now := newTestProbe(4, &suggestions)
+
+	// 4 workers are always busy, transferring 1200MiB in a minute.
+	for i := 0; i < 4; i++ {
+		p.Observe(100*units.MiB, 300*units.MiB, 30*time.Second)
+	}
+	c.Assert(suggestions, HasLen, 0)
+	*now = now.Add(time.Minute)
+	for i := 0; i < 4; i++ {
+		p.Observe(200*units.MiB, 600*units.MiB, 30*time.Second)
+	}
+	c.Assert(suggestions, HasLen, 1)
+	suggestion := suggestions[0]
+	c.Assert(suggestion.StorageBytesPerSecond, Equals, float64(20*units.MiB))
+	c.Assert(suggestion.KVBytesPerSecond, Equals, float64(60*units.MiB))
+	// 80% of the 10MiB/s of each store.
+	c.Assert(suggestion.RateLimit, Equals, uint64(8*units.MiB))
+	c.Assert(suggestion.Utilization, Equals, 1.0)
+	c.Assert(suggestion.Concurrency, Equals, uint(8))
+
+	// The suggestion is made only once.
+	*now = now.Add(time.Minute)
+	p.Observe(units.MiB, units.MiB, time.Second)
+	c.Assert(suggestions, HasLen, 1)
+}
+
+func (s *testBandwidthSuite) TestIdleWorkers(c *C) {
+	var suggestions []BandwidthSuggestion
+	p, now := newTestProbe(16, &suggestions)
+
+	*now = now.Add(time.Minute)
+	// 2 workers are busy on average.
+	p.Observe(units.KiB, units.KiB, 2*time.Minute)
+	c.Assert(suggestions, HasLen, 1)
+	suggestion := suggestions[0]
+	c.Assert(suggestion.RateLimit, Equals, uint64(units.MiB))
+	c.Assert(suggestion.Utilization, Equals, 0.125)
+	c.Assert(suggestion.Concurrency, Equals, uint(3))
+}
+
+func (s *testBandwidthSuite) TestRepeatAndRaiseRateLimit(c *C) {
+	var suggestions []BandwidthSuggestion
+	p, now := newTestProbe(4, &suggestions)
+	p.Repeat().SetRateLimit(10 * units.MiB)
+
+	// Each of the 2 stores reaches its 10MiB/s.
+	*now = now.Add(time.Minute)
+	p.Observe(1200*units.MiB, 1200*units.MiB, 4*time.Minute)
+	c.Assert(suggestions, HasLen, 1)
+	c.Assert(suggestions[0].Throttled, IsTrue)
+	c.Assert(suggestions[0].RateLimit, Equals, uint64(20*units.MiB))
+	p.SetRateLimit(suggestions[0].RateLimit)
+
+	// The next window only measures its own bytes, which are 5MiB/s of each
+	// store, far from the raised rate limit.
+	*now = now.Add(time.Minute)
+	p.Observe(600*units.MiB, 600*units.MiB, 4*time.Minute)
+	c.Assert(suggestions, HasLen, 2)
+	c.Assert(suggestions[1].Throttled, IsFalse)
+	c.Assert(suggestions[1].StorageBytesPerSecond, Equals, float64(10*units.MiB))
+	c.Assert(suggestions[1].RateLimit, Equals, uint64(4*units.MiB))
+}
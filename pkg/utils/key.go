@@ -27,10 +27,27 @@ func ParseKey(format, key string) ([]byte, error) {
 			return nil, errors.Trace(err)
 		}
 		return key, nil
+	case "auto":
+		return ParseKey(DetectKeyFormat(key), key)
 	}
 	return nil, errors.Annotate(berrors.ErrInvalidArgument, "unknown format")
 }
 
+// DetectKeyFormat guesses the format of the key. It's hex if the key is an
+// even number of hex digits, escaped if it contains a backslash, and raw
+// otherwise. Note that a raw key like `abcd` is taken as hex.
+func DetectKeyFormat(key string) string {
+	if len(key)%2 == 0 {
+		if _, err := hex.DecodeString(key); err == nil {
+			return "hex"
+		}
+	}
+	if strings.ContainsRune(key, '\\') {
+		return "escaped"
+	}
+	return "raw"
+}
+
 // Ref PD: https://github.com/pingcap/pd/blob/master/tools/pd-ctl/pdctl/command/region_command.go#L334
 func unescapedKey(text string) ([]byte, error) {
 	var buf []byte
@@ -93,6 +93,23 @@ func (r *testKeySuite) TestParseKey(c *C) {
 	}
 }
 
+func (r *testKeySuite) TestDetectKeyFormat(c *C) {
+	c.Assert(DetectKeyFormat("7480000000000000ff"), Equals, "hex")
+	c.Assert(DetectKeyFormat("abc"), Equals, "raw")
+	c.Assert(DetectKeyFormat("t\\x80\\x00"), Equals, "escaped")
+	c.Assert(DetectKeyFormat("key-1"), Equals, "raw")
+
+	key, err := ParseKey("auto", "74ff")
+	c.Assert(err, IsNil)
+	c.Assert(key, BytesEquals, []byte("t\xff"))
+	key, err = ParseKey("auto", "t\\x80")
+	c.Assert(err, IsNil)
+	c.Assert(key, BytesEquals, []byte("t\x80"))
+	key, err = ParseKey("auto", "key-1")
+	c.Assert(err, IsNil)
+	c.Assert(key, BytesEquals, []byte("key-1"))
+}
+
 func (r *testKeySuite) TestCompareEndKey(c *C) {
 	// test endKey
 	testCase := []struct {
@@ -113,3 +130,23 @@ func (r *testKeySuite) TestCompareEndKey(c *C) {
 		c.Assert(res, Equals, tt.ans)
 	}
 }
+
+func (r *testKeySuite) TestKeyspaceRange(c *C) {
+	id, err := ParseKeyspaceID("258")
+	c.Assert(err, IsNil)
+	c.Assert(id, Equals, uint32(258))
+	for _, s := range []string{"", "-1", "abc", "16777216"} {
+		_, err = ParseKeyspaceID(s)
+		c.Assert(err, ErrorMatches, ".*invalid keyspace.*")
+	}
+
+	start, end := KeyspaceRange(258, []byte("a"), []byte("b"))
+	c.Assert(start, DeepEquals, []byte("r\x00\x01\x02a"))
+	c.Assert(end, DeepEquals, []byte("r\x00\x01\x02b"))
+	start, end = KeyspaceRange(258, nil, nil)
+	c.Assert(start, DeepEquals, []byte("r\x00\x01\x02"))
+	c.Assert(end, DeepEquals, []byte("r\x00\x01\x03"))
+	start, end = KeyspaceRange(MaxKeyspaceID, nil, nil)
+	c.Assert(start, DeepEquals, []byte("r\xff\xff\xff"))
+	c.Assert(end, DeepEquals, []byte("s"))
+}
@@ -0,0 +1,48 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package utils
+
+import (
+	"strconv"
+
+	"github.com/pingcap/errors"
+
+	berrors "github.com/pingcap/br/pkg/errors"
+)
+
+const (
+	// apiV2RawKeyMode is the first byte of the raw keys of API V2, which is
+	// followed by the 3-byte big-endian keyspace ID.
+	apiV2RawKeyMode = 'r'
+	// MaxKeyspaceID is the max keyspace ID of API V2.
+	MaxKeyspaceID = 1<<24 - 1
+)
+
+// ParseKeyspaceID parses the keyspace ID of API V2.
+func ParseKeyspaceID(s string) (uint32, error) {
+	id, err := strconv.ParseUint(s, 10, 32)
+	if err != nil || id > MaxKeyspaceID {
+		return 0, errors.Annotatef(berrors.ErrInvalidArgument,
+			"invalid keyspace %s, should be an ID in [0, %d]", s, MaxKeyspaceID)
+	}
+	return uint32(id), nil
+}
+
+// KeyspacePrefix returns the prefix of the raw keys of the keyspace.
+func KeyspacePrefix(id uint32) []byte {
+	return []byte{apiV2RawKeyMode, byte(id >> 16), byte(id >> 8), byte(id)}
+}
+
+// KeyspaceRange converts the range of the user keys in the keyspace into the
+// range of the raw keys. The empty end key means the end of the keyspace.
+func KeyspaceRange(id uint32, startKey, endKey []byte) ([]byte, []byte) {
+	prefix := KeyspacePrefix(id)
+	start := append(append([]byte{}, prefix...), startKey...)
+	if len(endKey) > 0 {
+		return start, append(append([]byte{}, prefix...), endKey...)
+	}
+	if id == MaxKeyspaceID {
+		return start, []byte{apiV2RawKeyMode + 1}
+	}
+	return start, KeyspacePrefix(id + 1)
+}
@@ -21,6 +21,8 @@ import (
 
 	"github.com/pingcap/failpoint"
 	"github.com/pingcap/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"go.uber.org/zap"
 )
 
@@ -52,6 +54,13 @@ func listen(statusAddr string) (net.Listener, error) {
 	return listener, nil
 }
 
+func init() { // nolint:gochecknoinits
+	// The metrics and the progress of the task are served along with pprof.
+	prometheus.MustRegister(progressCollector{registry: progresses})
+	http.Handle("/metrics", promhttp.Handler())
+	http.HandleFunc("/progress", serveProgress)
+}
+
 // StartPProfListener forks a new goroutine listening on specified port and provide pprof info.
 func StartPProfListener(statusAddr string, wrapper *tidbutils.TLS) error {
 	listener, err := listen(statusAddr)
@@ -23,6 +23,9 @@ type ProgressPrinter struct {
 	total       int64
 	redirectLog bool
 	progress    int64
+	start       time.Time
+	// closed is set by Close, the progress is complete then.
+	closed int32
 
 	cancel context.CancelFunc
 }
@@ -37,6 +40,7 @@ func NewProgressPrinter(
 		name:        name,
 		total:       total,
 		redirectLog: redirectLog,
+		start:       time.Now(),
 		cancel: func() {
 			log.Warn("canceling non-started progress printer")
 		},
@@ -50,6 +54,7 @@ func (pp *ProgressPrinter) Inc() {
 
 // Close closes the current progress bar.
 func (pp *ProgressPrinter) Close() {
+	atomic.StoreInt32(&pp.closed, 1)
 	pp.cancel()
 }
 
@@ -151,5 +156,6 @@ func StartProgress(
 ) *ProgressPrinter {
 	progress := NewProgressPrinter(name, total, redirectLog)
 	progress.goPrintProgress(ctx, log, nil)
+	progresses.register(progress)
 	return progress
 }
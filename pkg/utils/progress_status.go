@@ -0,0 +1,174 @@
+// Copyright 2021 PingCAP, Inc. Licensed under Apache-2.0.
+
+package utils
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pingcap/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+
+	"github.com/pingcap/br/pkg/summary"
+)
+
+// StepProgress is the progress of a step of the task, i.e. a progress bar.
+type StepProgress struct {
+	Name     string  `json:"name"`
+	Done     int64   `json:"done"`
+	Total    int64   `json:"total"`
+	Percent  float64 `json:"percent"`
+	Finished bool    `json:"finished"`
+	// ElapsedSeconds is the time since the step started.
+	ElapsedSeconds float64 `json:"elapsed-seconds"`
+	// RemainingSeconds is extrapolated from the speed of the step so far, it's
+	// absent before any unit is done or after the step finishes.
+	RemainingSeconds *float64 `json:"remaining-seconds,omitempty"`
+}
+
+// ProgressStatus is the live progress of the task served by the status
+// server at /progress.
+type ProgressStatus struct {
+	// Task is the unit of the summary, e.g. backup or restore.
+	Task string `json:"task"`
+	// Phase is the name of the latest unfinished step.
+	Phase string         `json:"phase"`
+	Steps []StepProgress `json:"steps"`
+	// TotalBytes and TotalKVs are backed up or restored so far.
+	TotalBytes     uint64  `json:"total-bytes"`
+	TotalKVs       uint64  `json:"total-kvs"`
+	ElapsedSeconds float64 `json:"elapsed-seconds"`
+	// RemainingSeconds is the ETA of the task if it's estimated, see
+	// SetProgressETA, or of the current phase otherwise.
+	RemainingSeconds *float64 `json:"remaining-seconds,omitempty"`
+}
+
+// progressRegistry records the progress bars started by the task.
+type progressRegistry struct {
+	mu    sync.Mutex
+	steps []*ProgressPrinter
+	eta   func() (time.Duration, bool)
+}
+
+var progresses = &progressRegistry{}
+
+func (r *progressRegistry) register(pp *ProgressPrinter) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.steps = append(r.steps, pp)
+}
+
+// SetProgressETA sets the function estimating the remaining duration of the
+// task served by the status server, nil clears it.
+func SetProgressETA(eta func() (time.Duration, bool)) {
+	progresses.mu.Lock()
+	defer progresses.mu.Unlock()
+	progresses.eta = eta
+}
+
+func stepProgress(pp *ProgressPrinter) StepProgress {
+	step := StepProgress{
+		Name:           pp.name,
+		Done:           atomic.LoadInt64(&pp.progress),
+		Total:          pp.total,
+		Finished:       atomic.LoadInt32(&pp.closed) != 0,
+		ElapsedSeconds: time.Since(pp.start).Seconds(),
+	}
+	if step.Done > step.Total || step.Finished {
+		step.Done = step.Total
+	}
+	if step.Total > 0 {
+		step.Percent = float64(step.Done) * 100 / float64(step.Total)
+	}
+	if !step.Finished && step.Done > 0 && step.Done < step.Total {
+		remaining := step.ElapsedSeconds * float64(step.Total-step.Done) / float64(step.Done)
+		step.RemainingSeconds = &remaining
+	}
+	return step
+}
+
+func (r *progressRegistry) status() ProgressStatus {
+	r.mu.Lock()
+	steps := make([]StepProgress, 0, len(r.steps))
+	for _, pp := range r.steps {
+		steps = append(steps, stepProgress(pp))
+	}
+	eta := r.eta
+	r.mu.Unlock()
+
+	snapshot := summary.GetSnapshot()
+	status := ProgressStatus{
+		Task:           snapshot.Unit,
+		Steps:          steps,
+		TotalBytes:     snapshot.SuccessData[summary.TotalBytes],
+		TotalKVs:       snapshot.SuccessData[summary.TotalKV],
+		ElapsedSeconds: snapshot.TotalTake.Seconds(),
+	}
+	for i := len(steps) - 1; i >= 0; i-- {
+		if !steps[i].Finished {
+			status.Phase = steps[i].Name
+			status.RemainingSeconds = steps[i].RemainingSeconds
+			break
+		}
+	}
+	if eta != nil {
+		if remaining, ok := eta(); ok {
+			seconds := remaining.Seconds()
+			status.RemainingSeconds = &seconds
+		}
+	}
+	return status
+}
+
+func serveProgress(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(progresses.status()); err != nil {
+		log.Warn("failed to write the progress", zap.Error(err))
+	}
+}
+
+var (
+	progressDoneDesc = prometheus.NewDesc("br_progress_done",
+		"The completed units of the steps of the task.", []string{"step"}, nil)
+	progressTotalDesc = prometheus.NewDesc("br_progress_total",
+		"The total units of the steps of the task.", []string{"step"}, nil)
+	progressBytesDesc = prometheus.NewDesc("br_progress_bytes",
+		"The bytes backed up or restored so far.", nil, nil)
+	progressRemainingDesc = prometheus.NewDesc("br_progress_remaining_seconds",
+		"The estimated remaining duration of the task.", nil, nil)
+)
+
+// progressCollector exports the progress of the task as the metrics.
+type progressCollector struct {
+	registry *progressRegistry
+}
+
+// Describe implements prometheus.Collector.
+func (c progressCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- progressDoneDesc
+	ch <- progressTotalDesc
+	ch <- progressBytesDesc
+	ch <- progressRemainingDesc
+}
+
+// Collect implements prometheus.Collector.
+func (c progressCollector) Collect(ch chan<- prometheus.Metric) {
+	status := c.registry.status()
+	// A step may be started more than once, only the latest one is exported.
+	latest := make(map[string]StepProgress, len(status.Steps))
+	for _, step := range status.Steps {
+		latest[step.Name] = step
+	}
+	for name, step := range latest {
+		ch <- prometheus.MustNewConstMetric(progressDoneDesc, prometheus.GaugeValue, float64(step.Done), name)
+		ch <- prometheus.MustNewConstMetric(progressTotalDesc, prometheus.GaugeValue, float64(step.Total), name)
+	}
+	ch <- prometheus.MustNewConstMetric(progressBytesDesc, prometheus.GaugeValue, float64(status.TotalBytes))
+	if status.RemainingSeconds != nil {
+		ch <- prometheus.MustNewConstMetric(progressRemainingDesc, prometheus.GaugeValue, *status.RemainingSeconds)
+	}
+}
@@ -75,3 +75,32 @@ func (r *testProgressSuite) TestProgress(c *C) {
 	p = <-pCh8
 	c.Assert(p, Matches, `.*"P":"25\.00%".*`)
 }
+
+func (r *testProgressSuite) TestProgressStatus(c *C) {
+	registry := &progressRegistry{}
+	split := NewProgressPrinter("split", 4, true)
+	ingest := NewProgressPrinter("ingest", 10, true)
+	registry.register(split)
+	registry.register(ingest)
+	split.Inc()
+	split.Inc()
+	split.Inc()
+	split.Close()
+	ingest.Inc()
+	ingest.Inc()
+
+	status := registry.status()
+	c.Assert(status.Phase, Equals, "ingest")
+	c.Assert(status.Steps, HasLen, 2)
+	c.Assert(status.Steps[0].Finished, IsTrue)
+	c.Assert(status.Steps[0].Done, Equals, int64(4))
+	c.Assert(status.Steps[0].RemainingSeconds, IsNil)
+	c.Assert(status.Steps[1].Finished, IsFalse)
+	c.Assert(status.Steps[1].Done, Equals, int64(2))
+	c.Assert(status.Steps[1].Percent, Equals, float64(20))
+	c.Assert(status.RemainingSeconds, NotNil)
+
+	registry.eta = func() (time.Duration, bool) { return time.Minute, true }
+	status = registry.status()
+	c.Assert(*status.RemainingSeconds, Equals, float64(60))
+}
@@ -35,7 +35,9 @@ type Backoffer interface {
 // WithRetry retries a given operation with a backoff policy.
 //
 // Returns nil if `retryableFunc` succeeded at least once. Otherwise, returns a
-// multierr containing all errors encountered.
+// multierr containing all errors encountered. It stops retrying once the
+// context is done, or the backoffer has no attempts left, without waiting for
+// the last backoff.
 func WithRetry(
 	ctx context.Context,
 	retryableFunc RetryableFunc,
@@ -46,10 +48,14 @@ func WithRetry(
 		err := retryableFunc()
 		if err != nil {
 			allErrors = multierr.Append(allErrors, err)
+			backoff := backoffer.NextBackoff(err)
+			if backoffer.Attempt() <= 0 {
+				break
+			}
 			select {
 			case <-ctx.Done():
 				return allErrors // nolint:wrapcheck
-			case <-time.After(backoffer.NextBackoff(err)):
+			case <-time.After(backoff):
 			}
 		} else {
 			return nil
@@ -26,6 +26,12 @@ var (
 	incompatibleTiKVMajor4  = semver.New("4.0.0-rc.1")
 	compatibleTiFlashMajor3 = semver.New("3.1.0")
 	compatibleTiFlashMajor4 = semver.New("4.0.0")
+	// rawKVSplitTiKVVersion is the min TiKV version splitting the regions by
+	// the raw keys correctly.
+	rawKVSplitTiKVVersion = semver.New("5.1.0")
+	// logBackupTiKVVersion is the min TiKV version running the log backup
+	// tasks registered in PD.
+	logBackupTiKVVersion = semver.New("6.2.0")
 
 	versionHash = regexp.MustCompile("-[0-9]+-g[0-9a-f]{7,}")
 )
@@ -122,6 +128,37 @@ func CheckVersionForBackup(backupVersion *semver.Version) VerChecker {
 	}
 }
 
+// CheckVersionForRawKVSplit checks whether the TiKV supports splitting and
+// scattering the regions by the raw keys, which the raw restore relies on.
+func CheckVersionForRawKVSplit(s *metapb.Store, tikvVersion *semver.Version) error {
+	if IsTiFlash(s) {
+		return nil
+	}
+	// The pre-releases of the version, e.g. 5.1.0-alpha, support it as well.
+	if tikvVersion.Major < rawKVSplitTiKVVersion.Major ||
+		(tikvVersion.Major == rawKVSplitTiKVVersion.Major && tikvVersion.Minor < rawKVSplitTiKVVersion.Minor) {
+		return errors.Annotatef(berrors.ErrVersionMismatch,
+			"TiKV node %s version %s doesn't support splitting regions by raw keys, which requires %s",
+			s.Address, tikvVersion, rawKVSplitTiKVVersion)
+	}
+	return nil
+}
+
+// CheckVersionForLogBackup checks whether the TiKV runs the log backup tasks,
+// the older TiKV ignores the tasks registered in PD and backs up nothing.
+func CheckVersionForLogBackup(s *metapb.Store, tikvVersion *semver.Version) error {
+	if IsTiFlash(s) {
+		return nil
+	}
+	if tikvVersion.Major < logBackupTiKVVersion.Major ||
+		(tikvVersion.Major == logBackupTiKVVersion.Major && tikvVersion.Minor < logBackupTiKVVersion.Minor) {
+		return errors.Annotatef(berrors.ErrVersionMismatch,
+			"TiKV node %s version %s doesn't run log backup tasks, which requires %s",
+			s.Address, tikvVersion, logBackupTiKVVersion)
+	}
+	return nil
+}
+
 // CheckVersionForBR checks whether version of the cluster and BR itself is compatible.
 func CheckVersionForBR(s *metapb.Store, tikvVersion *semver.Version) error {
 	BRVersion, err := semver.NewVersion(removeVAndHash(build.ReleaseVersion))
@@ -161,6 +161,37 @@ func (s *checkSuite) TestCheckClusterVersion(c *C) {
 	}
 }
 
+func (s *checkSuite) TestCheckVersionForRawKVSplit(c *C) {
+	mock := mockPDClient{}
+	mock.getAllStores = func() []*metapb.Store {
+		return []*metapb.Store{{Address: "tikv-0", Version: "v5.0.3"}}
+	}
+	err := CheckClusterVersion(context.Background(), &mock, CheckVersionForRawKVSplit)
+	c.Assert(err, ErrorMatches, ".*TiKV node tikv-0 version 5.0.3 doesn't support splitting regions by raw keys.*")
+
+	for _, v := range []string{"v5.1.0-alpha", "v5.1.0", "v5.2.1", "v6.0.0"} {
+		version := v
+		mock.getAllStores = func() []*metapb.Store {
+			return append(tiflash("v5.0.0"), &metapb.Store{Version: version})
+		}
+		c.Assert(CheckClusterVersion(context.Background(), &mock, CheckVersionForRawKVSplit), IsNil, Commentf("%s", v))
+	}
+}
+
+func (s *checkSuite) TestCheckVersionForLogBackup(c *C) {
+	mock := mockPDClient{}
+	mock.getAllStores = func() []*metapb.Store {
+		return []*metapb.Store{{Address: "tikv-0", Version: "v6.2.0"}, {Address: "tikv-1", Version: "v5.1.0"}}
+	}
+	err := CheckClusterVersion(context.Background(), &mock, CheckVersionForLogBackup)
+	c.Assert(err, ErrorMatches, ".*TiKV node tikv-1 version 5.1.0 doesn't run log backup tasks.*")
+
+	mock.getAllStores = func() []*metapb.Store {
+		return append(tiflash("v5.0.0"), &metapb.Store{Version: "v6.2.0"}, &metapb.Store{Version: "v6.3.1"})
+	}
+	c.Assert(CheckClusterVersion(context.Background(), &mock, CheckVersionForLogBackup), IsNil)
+}
+
 func (s *checkSuite) TestCompareVersion(c *C) {
 	c.Assert(semver.New("4.0.0-rc").Compare(*semver.New("4.0.0-rc.2")), Equals, -1)
 	c.Assert(semver.New("4.0.0-beta.3").Compare(*semver.New("4.0.0-rc.2")), Equals, -1)